@@ -0,0 +1,180 @@
+//go:build linux
+// +build linux
+
+package embedshim
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/containerd/cgroups"
+	"github.com/containerd/containerd/errdefs"
+	"github.com/opencontainers/runtime-spec/specs-go"
+	"golang.org/x/sys/unix"
+)
+
+// admit verifies that the task can be created on this node before invoking
+// OCI runtime. It returns ErrFailedPrecondition if the host can't satisfy
+// the spec.
+func (manager *TaskManager) admit(spec *specs.Spec) error {
+	if spec.Linux == nil {
+		return nil
+	}
+
+	for _, check := range []func(*specs.Spec) error{
+		admitMemoryLimit,
+		admitDevices,
+		admitCgroupControllers,
+	} {
+		if err := check(spec); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// admitMemoryLimit checks the memory limit fits the node's total memory.
+func admitMemoryLimit(spec *specs.Spec) error {
+	r := spec.Linux.Resources
+	if r == nil || r.Memory == nil || r.Memory.Limit == nil || *r.Memory.Limit <= 0 {
+		return nil
+	}
+
+	var info unix.Sysinfo_t
+	if err := unix.Sysinfo(&info); err != nil {
+		return fmt.Errorf("failed to get sysinfo: %w", err)
+	}
+
+	total := uint64(info.Totalram) * uint64(info.Unit)
+	if limit := uint64(*r.Memory.Limit); limit > total {
+		return fmt.Errorf("memory limit %d exceeds node memory %d: %w", limit, total, errdefs.ErrFailedPrecondition)
+	}
+	return nil
+}
+
+// admitDevices checks the devices required by spec exist on the host.
+func admitDevices(spec *specs.Spec) error {
+	for _, d := range spec.Linux.Devices {
+		var class string
+
+		switch d.Type {
+		case "c", "u":
+			class = "char"
+		case "b":
+			class = "block"
+		default:
+			// fifo doesn't need the host device
+			continue
+		}
+
+		sysPath := filepath.Join("/sys/dev", class, fmt.Sprintf("%d:%d", d.Major, d.Minor))
+		if _, err := os.Stat(sysPath); err != nil {
+			if os.IsNotExist(err) {
+				return fmt.Errorf("device %s (%s %d:%d) not found on host: %w",
+					d.Path, d.Type, d.Major, d.Minor, errdefs.ErrFailedPrecondition)
+			}
+			return err
+		}
+	}
+	return nil
+}
+
+// admitCgroupControllers checks the cgroup controllers required by resources
+// have been enabled.
+func admitCgroupControllers(spec *specs.Spec) error {
+	required := requiredCgroupControllers(spec.Linux.Resources)
+	if len(required) == 0 {
+		return nil
+	}
+
+	enabled, err := enabledCgroupControllers()
+	if err != nil {
+		return err
+	}
+
+	for _, c := range required {
+		if _, ok := enabled[c]; !ok {
+			return fmt.Errorf("cgroup controller %s is not enabled: %w", c, errdefs.ErrFailedPrecondition)
+		}
+	}
+	return nil
+}
+
+func requiredCgroupControllers(r *specs.LinuxResources) []string {
+	if r == nil {
+		return nil
+	}
+
+	var (
+		controllers []string
+		unified     = cgroups.Mode() == cgroups.Unified
+	)
+
+	if r.Memory != nil {
+		controllers = append(controllers, "memory")
+	}
+	if r.CPU != nil {
+		if r.CPU.Shares != nil || r.CPU.Quota != nil || r.CPU.Period != nil {
+			controllers = append(controllers, "cpu")
+		}
+		if r.CPU.Cpus != "" || r.CPU.Mems != "" {
+			controllers = append(controllers, "cpuset")
+		}
+	}
+	if r.Pids != nil {
+		controllers = append(controllers, "pids")
+	}
+	if r.BlockIO != nil {
+		if unified {
+			controllers = append(controllers, "io")
+		} else {
+			controllers = append(controllers, "blkio")
+		}
+	}
+	if len(r.HugepageLimits) > 0 {
+		controllers = append(controllers, "hugetlb")
+	}
+	return controllers
+}
+
+// enabledCgroupControllers returns the available controllers in host.
+func enabledCgroupControllers() (map[string]struct{}, error) {
+	controllers := make(map[string]struct{})
+
+	if cgroups.Mode() == cgroups.Unified {
+		value, err := os.ReadFile("/sys/fs/cgroup/cgroup.controllers")
+		if err != nil {
+			return nil, err
+		}
+
+		for _, c := range strings.Fields(string(value)) {
+			controllers[c] = struct{}{}
+		}
+		return controllers, nil
+	}
+
+	f, err := os.Open("/proc/cgroups")
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	// #subsys_name hierarchy num_cgroups enabled
+	s := bufio.NewScanner(f)
+	for s.Scan() {
+		fields := strings.Fields(s.Text())
+		if len(fields) != 4 || strings.HasPrefix(fields[0], "#") {
+			continue
+		}
+		// NOTE: The hierarchy zero means that the controller isn't
+		// mounted as cgroup v1, like the controller bound to the cgroup
+		// v2 hierarchy in hybrid mode, which the runtime doesn't use.
+		if fields[3] == "1" && fields[1] != "0" {
+			controllers[fields[0]] = struct{}{}
+		}
+	}
+	return controllers, s.Err()
+}
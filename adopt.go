@@ -0,0 +1,218 @@
+//go:build linux
+// +build linux
+
+package embedshim
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	pkgbundle "github.com/fuweid/embedshim/pkg/bundle"
+	"github.com/fuweid/embedshim/pkg/protocompat"
+
+	"github.com/containerd/containerd/errdefs"
+	"github.com/containerd/containerd/identifiers"
+	"github.com/containerd/containerd/namespaces"
+	"github.com/containerd/containerd/runtime"
+	"github.com/gogo/protobuf/types"
+	"github.com/pkg/errors"
+	"google.golang.org/protobuf/types/known/anypb"
+)
+
+// AdoptOpts is used to adopt the runc container created outside embedshim,
+// like the one managed by containerd-shim-runc-v2.
+type AdoptOpts struct {
+	// Bundle is the container's original OCI bundle path.
+	Bundle string
+	// IO is the stdio fifos which the container's outputs are copied to.
+	IO runtime.IO
+	// RuntimeOptions is the runc options used by the original shim. The
+	// runc root must be the same so that the container can be found.
+	RuntimeOptions *anypb.Any
+}
+
+// Adopt takes over the existing runc container without restarting it.
+//
+// NOTE: The adopted container's stdout and stderr are pipes held by the
+// original shim. Adopt opens the pipes by procfs and copies them into the
+// IO fifos, so that it must be called before the original shim exits. The
+// copy is stopped if containerd restarts. The stdin and terminal are not
+// supported.
+func (manager *TaskManager) Adopt(ctx context.Context, id string, opts AdoptOpts) (_ runtime.Task, retErr error) {
+	if err := identifiers.Validate(id); err != nil {
+		return nil, errors.Wrapf(err, "invalid task id %s", id)
+	}
+
+	ns, err := namespaces.NamespaceRequired(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	if opts.IO.Stdin != "" || opts.IO.Terminal {
+		return nil, fmt.Errorf("adopting container with stdin or terminal: %w", errdefs.ErrNotImplemented)
+	}
+
+	if _, err := manager.tasks.Get(ctx, id); err == nil {
+		return nil, fmt.Errorf("task %s: %w", id, errdefs.ErrAlreadyExists)
+	}
+
+	container, err := manager.containers.Get(ctx, id)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get container %s: %w", id, err)
+	}
+
+	initOpts, err := initOptionsFromCreateOpts(runtime.CreateOpts{RuntimeOptions: protocompat.ToGogo(opts.RuntimeOptions)})
+	if err != nil {
+		return nil, err
+	}
+
+	specValue, err := os.ReadFile(filepath.Join(opts.Bundle, bundleFileKeyOCISpec))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read spec from original bundle: %w", err)
+	}
+
+	traceEventID, err := manager.nextTraceEventID()
+	if err != nil {
+		return nil, err
+	}
+
+	bundle, err := pkgbundle.NewBundle(manager.rootDir, manager.stateDir,
+		ns, id,
+		withBundleApplyFormatVersion(),
+		withBundleApplyInitOCISpec(&types.Any{Value: specValue}),
+		withBundleApplyInitOptions(initOpts),
+		withBundleApplyInitStdio(opts.IO),
+		withBundleApplyInitTraceEventID(traceEventID),
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		if retErr != nil {
+			bundle.Delete()
+		}
+	}()
+
+	s, err := newShim(manager, bundle)
+	if err != nil {
+		return nil, err
+	}
+	s.labels = container.Labels
+
+	if err := s.adopt(ctx); err != nil {
+		return nil, fmt.Errorf("failed to adopt container %s: %w", id, err)
+	}
+
+	manager.tasks.Add(ctx, s)
+	manager.watchBundle(bundle)
+	return s, nil
+}
+
+func (s *shim) adopt(ctx context.Context) error {
+	created, err := s.init.adopt(ctx)
+	if err != nil {
+		return err
+	}
+
+	// The runc-init holds the exec.fifo only if it is in created state.
+	if err := s.manager.monitor.trace(s.init, created); err != nil {
+		return err
+	}
+
+	s.loadCgroup()
+	return nil
+}
+
+// adopt loads the init process from OCI runtime state. It returns true if the
+// container is in created state.
+func (p *initProcess) adopt(ctx context.Context) (bool, error) {
+	c, err := p.runtime.State(ctx, p.ID())
+	if err != nil {
+		return false, p.runtimeError(err, "OCI runtime state failed")
+	}
+
+	created := false
+	switch c.Status {
+	case "created":
+		created = true
+		p.setState(&createdState{p: p})
+	case "running":
+		p.setState(&runningState{p: p})
+	case "paused":
+		p.setState(&pausedState{p: p})
+	default:
+		return false, fmt.Errorf("container in %s state can't be adopted: %w", c.Status, errdefs.ErrFailedPrecondition)
+	}
+
+	pidFile := newInitPidFile(p.bundle)
+	if err := os.WriteFile(pidFile.Path(), []byte(strconv.Itoa(c.Pid)), 0644); err != nil {
+		return false, fmt.Errorf("failed to store pid in %v: %w", pidFile.Path(), err)
+	}
+	p.pid = c.Pid
+
+	if err := p.adoptIO(); err != nil {
+		return false, err
+	}
+	return created, nil
+}
+
+// adoptIO copies the adopted init process's stdout and stderr into fifos.
+func (p *initProcess) adoptIO() (retErr error) {
+	p.io = &processIO{stdio: p.stdio}
+	defer func() {
+		if retErr != nil {
+			for _, c := range p.closers {
+				c.Close()
+			}
+			p.closers = nil
+		}
+	}()
+
+	for fd, target := range []string{1: p.stdio.Stdout, 2: p.stdio.Stderr} {
+		if fd == 0 || target == "" {
+			continue
+		}
+
+		procFD := filepath.Join("/proc", strconv.Itoa(p.pid), "fd", strconv.Itoa(fd))
+
+		// Only the pipe needs to be copied. For the others, like
+		// file, the init process writes it directly.
+		link, err := os.Readlink(procFD)
+		if err != nil {
+			return fmt.Errorf("failed to readlink %s: %w", procFD, err)
+		}
+		if !strings.HasPrefix(link, "pipe:") {
+			continue
+		}
+
+		// NOTE: Opening the procfs fd of pipe gets a new reference to
+		// the same pipe, so that we can read from it in read mode.
+		src, err := os.OpenFile(procFD, os.O_RDONLY, 0)
+		if err != nil {
+			return fmt.Errorf("failed to open %s: %w", procFD, err)
+		}
+		p.closers = append(p.closers, src)
+
+		dst, err := openRWFifo(context.TODO(), target, 0700)
+		if err != nil {
+			return err
+		}
+		p.closers = append(p.closers, dst)
+
+		p.wg.Add(1)
+		go func() {
+			defer p.wg.Done()
+
+			buf := bufPool.Get().(*[]byte)
+			defer bufPool.Put(buf)
+
+			io.CopyBuffer(dst, src, *buf)
+		}()
+	}
+	return nil
+}
@@ -0,0 +1,301 @@
+//go:build linux
+// +build linux
+
+package embedshim
+
+import (
+	"fmt"
+	"strconv"
+
+	"github.com/containerd/containerd/errdefs"
+)
+
+var (
+	// annotationPrefix is the common prefix for the embedshim's per-task
+	// settings carried by the OCI spec annotations.
+	annotationPrefix = "io.embedshim."
+
+	// annotationRestoreTimeNamespaceOffsets enables the time namespace
+	// for the restored init process so that CRIU is able to apply the
+	// dumped clock offsets and CLOCK_MONOTONIC keeps going forward.
+	annotationRestoreTimeNamespaceOffsets = annotationPrefix + "restore.time-namespace-offsets"
+
+	// annotationExitPolicy decides when the task is reported as exited,
+	// see exitPolicy for the values.
+	annotationExitPolicy = annotationPrefix + "exit-policy"
+
+	// annotationExecOOMScoreAdj is the oom_score_adj for the exec
+	// processes which don't specify it in process spec. The value can be
+	// "inherit", "default" or an integer in [-1000, 1000].
+	annotationExecOOMScoreAdj = annotationPrefix + "exec.oom-score-adj"
+
+	// annotationStdioMode is the init process's stdio mode, see
+	// StdioMode for the values.
+	annotationStdioMode = annotationPrefix + "stdio-mode"
+
+	// annotationStdioRateLimit is the max throughput in bytes per second
+	// of the container's stdout and stderr, which is shared by the init
+	// and exec processes. The terminal isn't limited.
+	annotationStdioRateLimit = annotationPrefix + "stdio.rate-limit"
+
+	// annotationStdioRateBurst is the token bucket's size in bytes. It is
+	// the same to rate limit by default.
+	annotationStdioRateBurst = annotationPrefix + "stdio.rate-burst"
+
+	// annotationStdioRateLimitMode is "throttle" (default) or "drop".
+	annotationStdioRateLimitMode = annotationPrefix + "stdio.rate-limit-mode"
+
+	// annotationExternalCgroup marks the spec's cgroupsPath as the cgroup
+	// managed by others, which is required for the systemd cgroupsPath.
+	// The existing cgroupfs path is treated as external by default.
+	annotationExternalCgroup = annotationPrefix + "cgroup.external"
+
+	// annotationStopSignal is the signal sent by Kill without signal, like
+	// Docker's STOPSIGNAL. The value can be number or name, like "SIGQUIT".
+	annotationStopSignal = annotationPrefix + "stop-signal"
+
+	// annotationRestartPolicy is the task's restart policy, like "no",
+	// "on-failure[:max-retries]", "always" or "unless-stopped".
+	annotationRestartPolicy = annotationPrefix + "restart-policy"
+
+	// annotationHealthCheckCmd is the health check command in JSON array,
+	// which runs as exec process in the container. The exit code zero
+	// means healthy.
+	annotationHealthCheckCmd = annotationPrefix + "healthcheck.cmd"
+
+	// annotationHealthCheckInterval is the duration between checks. The
+	// default is 30s.
+	annotationHealthCheckInterval = annotationPrefix + "healthcheck.interval"
+
+	// annotationHealthCheckTimeout is the max duration of one check. The
+	// default is 30s.
+	annotationHealthCheckTimeout = annotationPrefix + "healthcheck.timeout"
+
+	// annotationHealthCheckStartPeriod is the initialization time, the
+	// failures in which are not counted.
+	annotationHealthCheckStartPeriod = annotationPrefix + "healthcheck.start-period"
+
+	// annotationHealthCheckRetries is the number of consecutive failures
+	// to be considered unhealthy. The default is 3.
+	annotationHealthCheckRetries = annotationPrefix + "healthcheck.retries"
+
+	// annotationHealthCheckKillUnhealthy kills the unhealthy container so
+	// that the restart policy is able to restart it.
+	annotationHealthCheckKillUnhealthy = annotationPrefix + "healthcheck.kill-unhealthy"
+
+	// annotationExecProfiles are the named exec profiles in JSON object,
+	// like {"reload": {"args": ["nginx", "-s", "reload"]}}. See ExecProfile.
+	annotationExecProfiles = annotationPrefix + "exec-profiles"
+
+	// annotationSchedPolicy is the init process's scheduling policy, like
+	// "other", "batch", "idle", "fifo" or "rr".
+	annotationSchedPolicy = annotationPrefix + "sched.policy"
+
+	// annotationSchedPriority is the realtime priority in [1, 99], which
+	// is required by "fifo" and "rr" policy.
+	annotationSchedPriority = annotationPrefix + "sched.priority"
+
+	// annotationSchedNice is the init process's nice value in [-20, 19].
+	annotationSchedNice = annotationPrefix + "sched.nice"
+
+	// annotationSchedCPUs is the init process's CPU affinity in cpu list
+	// format, like "0-3,6".
+	annotationSchedCPUs = annotationPrefix + "sched.cpus"
+
+	// annotationSchedCore assigns the container its own core scheduling
+	// cookie if it is "true", so that the untrusted tasks never share the
+	// SMT siblings with it. The exec processes inherit the cookie.
+	annotationSchedCore = annotationPrefix + "sched.core"
+
+	// annotationMemoryQoSRequest is the container's memory request in
+	// bytes, which enables kubelet-like Memory QoS on cgroup v2. It is
+	// programmed as memory.min and used to compute memory.high.
+	annotationMemoryQoSRequest = annotationPrefix + "memory-qos.request"
+
+	// annotationMemoryQoSThrottlingFactor is in (0, 1]. The default is 0.9.
+	annotationMemoryQoSThrottlingFactor = annotationPrefix + "memory-qos.throttling-factor"
+
+	// annotationMemoryQoSNodeAllocatable is the node's allocatable memory
+	// in bytes, which is used as limit if the container has no limit.
+	annotationMemoryQoSNodeAllocatable = annotationPrefix + "memory-qos.node-allocatable"
+
+	// annotationCgroupExecSubgroups places the init and exec processes in
+	// separate leaf cgroups under the container's cgroup. It requires
+	// cgroup v2.
+	annotationCgroupExecSubgroups = annotationPrefix + "cgroup.exec-subgroups"
+
+	// annotationCgroupExecCPUMax is the default cpu.max of the exec's leaf
+	// cgroup, like "50000 100000".
+	annotationCgroupExecCPUMax = annotationPrefix + "cgroup.exec-cpu-max"
+
+	// annotationCgroupExecMemoryMax is the default memory.max in bytes of
+	// the exec's leaf cgroup.
+	annotationCgroupExecMemoryMax = annotationPrefix + "cgroup.exec-memory-max"
+
+	// annotationMaxLifetime is the task's max wall-clock runtime since the
+	// first start, like "2h". The task is killed when it is exceeded.
+	annotationMaxLifetime = annotationPrefix + "max-lifetime"
+
+	// annotationMaxLifetimeSignal is the signal sent first when the max
+	// lifetime is exceeded. The stop signal is used by default.
+	annotationMaxLifetimeSignal = annotationPrefix + "max-lifetime.signal"
+
+	// annotationMaxLifetimeGracePeriod is the duration between the signal
+	// and SIGKILL. The default is 10s.
+	annotationMaxLifetimeGracePeriod = annotationPrefix + "max-lifetime.grace-period"
+
+	// annotationStartPaused starts the container in paused state, which is
+	// frozen before the entrypoint's first instruction. It is resumed by
+	// Resume.
+	annotationStartPaused = annotationPrefix + "start-paused"
+
+	// annotationConsoleSocket is the caller's unix socket path, which is
+	// passed to the OCI runtime as --console-socket. The caller receives the
+	// PTY master and the stdio must be empty. It requires terminal.
+	annotationConsoleSocket = annotationPrefix + "console-socket"
+
+	// annotationKeyring is the init process's kernel keyring mode, see
+	// KeyringMode for the values. The runtime options' NoNewKeyring is
+	// used if it is absent.
+	annotationKeyring = annotationPrefix + "keyring"
+
+	// annotationReadiness makes Start block until the workload is ready,
+	// see ReadinessMode for the values.
+	annotationReadiness = annotationPrefix + "readiness"
+
+	// annotationReadinessCmd is the readiness command in JSON array for
+	// exec mode, like ["cat", "/tmp/ready"].
+	annotationReadinessCmd = annotationPrefix + "readiness.cmd"
+
+	// annotationReadinessTimeout is the max duration Start waits for. The
+	// default is 1m.
+	annotationReadinessTimeout = annotationPrefix + "readiness.timeout"
+
+	// annotationReadinessInterval is the duration between the readiness
+	// commands, which is also the timeout of one command. The default is
+	// 1s.
+	annotationReadinessInterval = annotationPrefix + "readiness.interval"
+
+	// annotationNotifySocketEvents publishes TaskNotify event for each
+	// sd_notify message from the container. The NOTIFY_SOCKET is mounted
+	// into the container if it is set.
+	annotationNotifySocketEvents = annotationPrefix + "notify-socket.events"
+
+	// annotationNotifySocketForward is the host's notify socket, like
+	// /run/systemd/notify, which receives the container's sd_notify
+	// messages with MAINPID of the init process.
+	annotationNotifySocketForward = annotationPrefix + "notify-socket.forward"
+
+	// annotationUmask is the init process's umask in octal, like "0027".
+	annotationUmask = annotationPrefix + "umask"
+
+	// annotationAdditionalGids replaces the init process's additional gids
+	// by the comma separated gids, like "10,20". The empty value clears
+	// them.
+	annotationAdditionalGids = annotationPrefix + "additional-gids"
+
+	// annotationExecUmask is the exec processes' umask in octal. The init
+	// process's umask annotation is used if it is unset.
+	annotationExecUmask = annotationPrefix + "exec.umask"
+
+	// annotationExecAdditionalGids replaces the exec processes' additional
+	// gids. The init process's annotation is used if it is unset.
+	annotationExecAdditionalGids = annotationPrefix + "exec.additional-gids"
+
+	// annotationIOPrioClass is the init process's I/O scheduling class,
+	// like "none", "realtime", "best-effort" or "idle".
+	annotationIOPrioClass = annotationPrefix + "ioprio.class"
+
+	// annotationIOPrioLevel is the priority in [0, 7] of the realtime and
+	// best-effort class. The default is 4.
+	annotationIOPrioLevel = annotationPrefix + "ioprio.level"
+
+	// annotationExecIOPrioClass is the exec processes' I/O scheduling
+	// class. The init process's ioprio is used if it is unset.
+	annotationExecIOPrioClass = annotationPrefix + "exec.ioprio.class"
+
+	// annotationExecIOPrioLevel is the exec processes' I/O priority.
+	annotationExecIOPrioLevel = annotationPrefix + "exec.ioprio.level"
+
+	// annotationWebhookURL is the http or https URL which receives the
+	// task's lifecycle webhooks. It requires the plugin's webhook to be
+	// enabled.
+	annotationWebhookURL = annotationPrefix + "webhook.url"
+
+	// annotationWebhookEvents is the comma separated events sent by the
+	// webhook, like "started,exited,oom". The default is all of them.
+	annotationWebhookEvents = annotationPrefix + "webhook.events"
+
+	// annotationWebhookSecret is the name of the plugin's webhook secret
+	// used to sign the requests. The requests are unsigned if it is unset.
+	annotationWebhookSecret = annotationPrefix + "webhook.secret"
+
+	// annotationDeviceOwner rewrites the owner of the spec's device nodes,
+	// which is "user" for the init process's uid and gid, or "UID:GID".
+	annotationDeviceOwner = annotationPrefix + "device.owner"
+
+	// annotationDeviceMode rewrites the permissions of the spec's device
+	// nodes in octal, like "0660".
+	annotationDeviceMode = annotationPrefix + "device.mode"
+
+	// annotationDevicePaths is the comma separated device paths which are
+	// rewritten by the owner and mode, like "/dev/kvm". The default is all
+	// the devices in the spec.
+	annotationDevicePaths = annotationPrefix + "device.paths"
+
+	// annotationHoldNamespacesDuration is the window to hold the init
+	// process's namespaces after it exits non-zero, like "10m", so that the
+	// debugger can nsenter them.
+	annotationHoldNamespacesDuration = annotationPrefix + "hold-namespaces.duration"
+
+	// annotationHoldNamespacesTypes is the comma separated namespace types
+	// to hold, like "net,mnt,pid". The default is "net,mnt".
+	annotationHoldNamespacesTypes = annotationPrefix + "hold-namespaces.types"
+
+	// annotationFluentAddress is the Fluentd or Fluent Bit forward input's
+	// address for the fluent stdio mode, like "tcp://127.0.0.1:24224" or
+	// "unix:///var/run/fluent.sock".
+	annotationFluentAddress = annotationPrefix + "fluent.address"
+
+	// annotationFluentTag is the tag of the forwarded records. The default
+	// is the container ID.
+	annotationFluentTag = annotationPrefix + "fluent.tag"
+
+	// annotationFluentBufferLimit is the max size in bytes of the records
+	// buffered while the forward input is unavailable, like "8388608". The
+	// oldest records are dropped if it is full. The default is 1MiB.
+	annotationFluentBufferLimit = annotationPrefix + "fluent.buffer-limit"
+
+	// annotationMountPropagation overrides the plugin's default mount
+	// propagation of the task's rootfs and bind mounts, like "rslave".
+	annotationMountPropagation = annotationPrefix + "mount-propagation"
+
+	// annotationInit injects the plugin's init binary as the container's
+	// pid 1 if it is "true", like `docker run --init`. It overrides the
+	// plugin's default.
+	annotationInit = annotationPrefix + "init"
+
+	// annotationCPUQuotaRampDuration is the Update's annotation which moves
+	// the CPU quota to the target gradually in the duration, like "30s",
+	// instead of at once.
+	annotationCPUQuotaRampDuration = annotationPrefix + "cpu-quota-ramp.duration"
+
+	// annotationCPUQuotaRampSteps is the number of the ramp's steps. The
+	// default is 10.
+	annotationCPUQuotaRampSteps = annotationPrefix + "cpu-quota-ramp.steps"
+)
+
+// annotationBool returns the boolean value of the annotation key. The absent
+// key is treated as false.
+func annotationBool(annotations map[string]string, key string) (bool, error) {
+	v, ok := annotations[key]
+	if !ok || v == "" {
+		return false, nil
+	}
+
+	b, err := strconv.ParseBool(v)
+	if err != nil {
+		return false, fmt.Errorf("invalid annotation %s=%q: %w", key, v, errdefs.ErrInvalidArgument)
+	}
+	return b, nil
+}
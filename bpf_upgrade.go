@@ -0,0 +1,33 @@
+//go:build linux
+// +build linux
+
+package embedshim
+
+import (
+	"context"
+
+	"github.com/fuweid/embedshim/pkg/exitsnoop"
+
+	"github.com/containerd/containerd/log"
+)
+
+// UpgradeBPF replaces the running exitsnoop program with the one in the BPF
+// object without restarting containers. The pinned maps are reused so that
+// the tracked processes and the recorded exit events are kept.
+//
+// The empty objPath rolls back to the BPF object embedded in plugin.
+func (manager *TaskManager) UpgradeBPF(ctx context.Context, objPath string) error {
+	if err := manager.monitor.upgradeProgram(manager.rootDir, objPath); err != nil {
+		return err
+	}
+	log.G(ctx).WithField("object", objPath).Info("upgraded exitsnoop program")
+	return nil
+}
+
+// upgradeProgram holds the lock so that it doesn't race with resize.
+func (m *monitor) upgradeProgram(bpffsRoot string, objPath string) error {
+	m.Lock()
+	defer m.Unlock()
+
+	return exitsnoop.Upgrade(bpffsRoot, objPath)
+}
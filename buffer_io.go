@@ -0,0 +1,235 @@
+//go:build linux
+// +build linux
+
+package embedshim
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/containerd/containerd/errdefs"
+	"github.com/containerd/containerd/pkg/stdio"
+	"github.com/containerd/go-runc"
+	"github.com/pkg/errors"
+	"golang.org/x/sys/unix"
+)
+
+var (
+	// bufferQueryMaxBytes is the URI query key to cap the buffered output,
+	// like buffer://?max_bytes=4096.
+	bufferQueryMaxBytes = "max_bytes"
+
+	// defaultBufferMaxBytes is the default cap of each buffered output.
+	defaultBufferMaxBytes int64 = 64 * 1024
+
+	// bufferDrainTimeout is the max time to wait for the output after
+	// process exits, in case that the pipe is held by the children.
+	bufferDrainTimeout = time.Second
+)
+
+// ExecOutput is the exec process's exit record with buffered output.
+type ExecOutput struct {
+	Stdout          []byte
+	Stderr          []byte
+	StdoutTruncated bool
+	StderrTruncated bool
+	ExitStatus      uint32
+	ExitedAt        time.Time
+}
+
+// ExecOutput returns the buffered output of the exited exec process, which
+// uses buffer:// scheme as stdout or stderr. It must be called before the
+// exec process is deleted.
+func (manager *TaskManager) ExecOutput(ctx context.Context, id, execID string) (*ExecOutput, error) {
+	t, err := manager.tasks.Get(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+
+	p, err := t.Process(ctx, execID)
+	if err != nil {
+		return nil, err
+	}
+
+	e, ok := p.(*execProcess)
+	if !ok {
+		return nil, fmt.Errorf("process %s is not exec process: %w", execID, errdefs.ErrInvalidArgument)
+	}
+	return e.output()
+}
+
+func (e *execProcess) output() (*ExecOutput, error) {
+	select {
+	case <-e.waitBlock:
+	default:
+		return nil, fmt.Errorf("exec process %s is still running: %w", e.id, errdefs.ErrFailedPrecondition)
+	}
+
+	var bio *bufferIO
+	if e.io != nil {
+		bio, _ = e.io.IO().(*bufferIO)
+	}
+	if bio == nil {
+		return nil, fmt.Errorf("exec process %s has no buffered output: %w", e.id, errdefs.ErrFailedPrecondition)
+	}
+
+	waitTimeout(context.Background(), &bio.wg, bufferDrainTimeout)
+
+	out := &ExecOutput{
+		ExitStatus: uint32(e.ExitStatus()),
+		ExitedAt:   e.ExitedAt(),
+	}
+	if bio.stdout != nil {
+		out.Stdout, out.StdoutTruncated = bio.stdout.snapshot()
+	}
+	if bio.stderr != nil {
+		out.Stderr, out.StderrTruncated = bio.stderr.snapshot()
+	}
+	return out, nil
+}
+
+// bufferIO keeps the stdout and stderr in memory with cap. It is designed for
+// the short probe commands so that the caller doesn't need to setup fifos.
+type bufferIO struct {
+	*pipeIO
+
+	stdout *cappedBuffer
+	stderr *cappedBuffer
+
+	readers []*os.File
+	wg      sync.WaitGroup
+}
+
+func (i *bufferIO) Close() error {
+	err := i.pipeIO.Close()
+	for _, r := range i.readers {
+		r.Close()
+	}
+	return err
+}
+
+// newRuncBufferIO creates pipes as stdout and stderr, and copies the output
+// into capped buffers.
+func newRuncBufferIO(uid, gid int, stdio stdio.Stdio) (_ runc.IO, retErr error) {
+	if stdio.Terminal {
+		return nil, fmt.Errorf("buffer stdio can't be used with terminal: %w", errdefs.ErrInvalidArgument)
+	}
+
+	i := &bufferIO{pipeIO: &pipeIO{}}
+	defer func() {
+		if retErr != nil {
+			i.Close()
+		}
+	}()
+
+	var err error
+	if stdio.Stdin != "" {
+		if i.in, err = newPipe(); err != nil {
+			return nil, err
+		}
+		if err = unix.Fchown(int(i.in.r.Fd()), uid, gid); err != nil {
+			return nil, errors.Wrap(err, "failed to chown stdin")
+		}
+	}
+
+	for _, target := range []struct {
+		uri string
+		w   **os.File
+		buf **cappedBuffer
+	}{
+		{stdio.Stdout, &i.out, &i.stdout},
+		{stdio.Stderr, &i.err, &i.stderr},
+	} {
+		if target.uri == "" {
+			continue
+		}
+
+		maxBytes, err := bufferMaxBytesFromURI(target.uri)
+		if err != nil {
+			return nil, err
+		}
+
+		r, w, err := os.Pipe()
+		if err != nil {
+			return nil, err
+		}
+		i.readers = append(i.readers, r)
+		*target.w = w
+
+		if err = unix.Fchown(int(w.Fd()), uid, gid); err != nil {
+			return nil, errors.Wrap(err, "failed to chown output pipe")
+		}
+
+		buf := &cappedBuffer{max: maxBytes}
+		*target.buf = buf
+
+		i.wg.Add(1)
+		go func() {
+			defer i.wg.Done()
+
+			// NOTE: The cappedBuffer discards the overflow and
+			// keeps draining the pipe so that the process isn't
+			// blocked on write.
+			io.Copy(buf, r)
+		}()
+	}
+	return i, nil
+}
+
+func bufferMaxBytesFromURI(uri string) (int64, error) {
+	u, err := url.Parse(uri)
+	if err != nil {
+		return 0, fmt.Errorf("unable to parse buffer uri %s: %w", uri, err)
+	}
+	if u.Scheme != "buffer" {
+		return 0, fmt.Errorf("stdout and stderr should both use buffer scheme, but got %s: %w", uri, errdefs.ErrInvalidArgument)
+	}
+
+	v := u.Query().Get(bufferQueryMaxBytes)
+	if v == "" {
+		return defaultBufferMaxBytes, nil
+	}
+
+	n, err := strconv.ParseInt(v, 10, 64)
+	if err != nil || n <= 0 {
+		return 0, fmt.Errorf("invalid %s=%q: %w", bufferQueryMaxBytes, v, errdefs.ErrInvalidArgument)
+	}
+	return n, nil
+}
+
+// cappedBuffer keeps the first max bytes and discards the rest.
+type cappedBuffer struct {
+	mu        sync.Mutex
+	buf       bytes.Buffer
+	max       int64
+	truncated bool
+}
+
+func (b *cappedBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	left := b.max - int64(b.buf.Len())
+	if left < int64(len(p)) {
+		b.truncated = true
+		if left > 0 {
+			b.buf.Write(p[:left])
+		}
+		return len(p), nil
+	}
+	return b.buf.Write(p)
+}
+
+func (b *cappedBuffer) snapshot() ([]byte, bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	return append([]byte{}, b.buf.Bytes()...), b.truncated
+}
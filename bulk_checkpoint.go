@@ -0,0 +1,198 @@
+//go:build linux
+// +build linux
+
+package embedshim
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/containerd/containerd/errdefs"
+	"github.com/containerd/containerd/log"
+	"github.com/containerd/containerd/namespaces"
+	"github.com/containerd/containerd/runtime"
+	"github.com/containerd/containerd/runtime/v2/runc/options"
+	"github.com/containerd/typeurl"
+)
+
+var (
+	// bulkCheckpointManifestFile is the manifest in the bulk checkpoint's
+	// directory.
+	bulkCheckpointManifestFile = "manifest.json"
+
+	defaultBulkCheckpointConcurrency = 4
+)
+
+// BulkCheckpointOptions is the options of CheckpointAll.
+type BulkCheckpointOptions struct {
+	// Dir is the root of the images. The task's image is dumped into
+	// <Dir>/<namespace>/<id>.
+	Dir string
+	// Filters selects the tasks by containerd filter syntax on TaskStatus,
+	// like labels."io.kubernetes.pod.namespace"==default. All the running
+	// and paused tasks are selected if it is empty.
+	Filters []string
+	// Concurrency is the max number of tasks dumped at the same time. The
+	// default is 4.
+	Concurrency int
+	// Options is the CRIU options applied on each task, like OpenTcp and
+	// Exit. The ImagePath is ignored.
+	Options options.CheckpointOptions
+}
+
+// BulkCheckpointResult is the result of one task in the manifest.
+type BulkCheckpointResult struct {
+	Namespace string            `json:"namespace"`
+	ID        string            `json:"id"`
+	ImagePath string            `json:"image_path"`
+	Labels    map[string]string `json:"labels,omitempty"`
+	StartedAt time.Time         `json:"started_at"`
+	Duration  time.Duration     `json:"duration"`
+	// Error is empty if the checkpoint succeeds.
+	Error string `json:"error,omitempty"`
+}
+
+// BulkCheckpointManifest is written into the bulk checkpoint's directory so
+// that the tasks can be restored after the node maintenance, like reboot
+// for kernel patching.
+type BulkCheckpointManifest struct {
+	CreatedAt time.Time              `json:"created_at"`
+	Exit      bool                   `json:"exit"`
+	Results   []BulkCheckpointResult `json:"results"`
+}
+
+// Failed returns the results with error.
+func (m *BulkCheckpointManifest) Failed() []BulkCheckpointResult {
+	var failed []BulkCheckpointResult
+	for _, r := range m.Results {
+		if r.Error != "" {
+			failed = append(failed, r)
+		}
+	}
+	return failed
+}
+
+// CheckpointAll checkpoints the selected tasks in all the namespaces in
+// parallel for node maintenance, and writes the manifest of the results into
+// the directory. The failure of one task doesn't stop the others, and the
+// error is only returned if the bulk checkpoint itself fails.
+//
+// NOTE: The tasks are dumped independently. The tasks sharing namespaces,
+// like the containers in one pod, aren't frozen at the same time.
+func (manager *TaskManager) CheckpointAll(ctx context.Context, opts BulkCheckpointOptions) (*BulkCheckpointManifest, error) {
+	if !filepath.IsAbs(opts.Dir) {
+		return nil, fmt.Errorf("checkpoint dir %q must be absolute path: %w", opts.Dir, errdefs.ErrInvalidArgument)
+	}
+
+	concurrency := opts.Concurrency
+	if concurrency <= 0 {
+		concurrency = defaultBulkCheckpointConcurrency
+	}
+
+	statuses, err := manager.TaskStatuses(ctx, true, opts.Filters...)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := os.MkdirAll(opts.Dir, 0700); err != nil {
+		return nil, err
+	}
+
+	manifest := &BulkCheckpointManifest{
+		CreatedAt: time.Now(),
+		Exit:      opts.Options.Exit,
+	}
+	for _, st := range statuses {
+		if st.Status != runtime.RunningStatus && st.Status != runtime.PausedStatus {
+			continue
+		}
+		manifest.Results = append(manifest.Results, BulkCheckpointResult{
+			Namespace: st.Namespace,
+			ID:        st.ID,
+			ImagePath: filepath.Join(opts.Dir, st.Namespace, st.ID),
+			Labels:    st.Labels,
+		})
+	}
+
+	var (
+		wg  sync.WaitGroup
+		sem = make(chan struct{}, concurrency)
+	)
+	for i := range manifest.Results {
+		r := &manifest.Results[i]
+
+		select {
+		case sem <- struct{}{}:
+		case <-ctx.Done():
+			r.Error = ctx.Err().Error()
+			continue
+		}
+
+		wg.Add(1)
+		go func() {
+			defer func() {
+				<-sem
+				wg.Done()
+			}()
+
+			r.StartedAt = time.Now()
+			if err := manager.checkpointOne(ctx, r.Namespace, r.ID, r.ImagePath, opts.Options); err != nil {
+				log.G(ctx).WithError(err).Warnf("failed to checkpoint task %s in namespace %s", r.ID, r.Namespace)
+				r.Error = err.Error()
+			}
+			r.Duration = time.Since(r.StartedAt)
+		}()
+	}
+	wg.Wait()
+
+	data, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	if err := writeFileAtomic(filepath.Join(opts.Dir, bulkCheckpointManifestFile), data); err != nil {
+		return nil, err
+	}
+
+	log.G(ctx).Infof("checkpointed %d tasks into %s, %d failed",
+		len(manifest.Results), opts.Dir, len(manifest.Failed()))
+	return manifest, nil
+}
+
+func (manager *TaskManager) checkpointOne(ctx context.Context, ns, id, imagePath string, opts options.CheckpointOptions) error {
+	ctx = namespaces.WithNamespace(ctx, ns)
+
+	t, err := manager.tasks.Get(ctx, id)
+	if err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(imagePath, 0700); err != nil {
+		return err
+	}
+
+	opts.ImagePath = imagePath
+	any, err := typeurl.MarshalAny(&opts)
+	if err != nil {
+		return err
+	}
+	return t.Checkpoint(ctx, imagePath, any)
+}
+
+// ReadBulkCheckpointManifest reads the manifest written by CheckpointAll.
+func ReadBulkCheckpointManifest(dir string) (*BulkCheckpointManifest, error) {
+	data, err := os.ReadFile(filepath.Join(dir, bulkCheckpointManifestFile))
+	if err != nil {
+		return nil, err
+	}
+
+	var manifest BulkCheckpointManifest
+	if err := json.Unmarshal(data, &manifest); err != nil {
+		return nil, fmt.Errorf("invalid bulk checkpoint manifest: %w", err)
+	}
+	return &manifest, nil
+}
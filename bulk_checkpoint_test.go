@@ -0,0 +1,63 @@
+//go:build linux
+// +build linux
+
+package embedshim
+
+import (
+	"errors"
+	"path/filepath"
+	"testing"
+
+	"github.com/containerd/containerd/errdefs"
+)
+
+func TestCheckpointAll(t *testing.T) {
+	h := newTestHarness(t, "bulk")
+	init := h.shim.init
+
+	if err := init.Create(h.ctx); err != nil {
+		t.Fatalf("failed to create: %v", err)
+	}
+	if err := init.Start(h.ctx); err != nil {
+		t.Fatalf("failed to start: %v", err)
+	}
+	if err := h.manager.tasks.Add(h.ctx, h.shim); err != nil {
+		t.Fatalf("failed to add task: %v", err)
+	}
+	h.runtime.injectError("Checkpoint", errors.New("criu failed"))
+
+	if _, err := h.manager.CheckpointAll(h.ctx, BulkCheckpointOptions{Dir: "relative"}); !errors.Is(err, errdefs.ErrInvalidArgument) {
+		t.Fatalf("expected ErrInvalidArgument for relative dir, but got %v", err)
+	}
+
+	dir := t.TempDir()
+	manifest, err := h.manager.CheckpointAll(h.ctx, BulkCheckpointOptions{Dir: dir, Filters: []string{"id==other"}})
+	if err != nil {
+		t.Fatalf("failed to checkpoint all: %v", err)
+	}
+	if len(manifest.Results) != 0 {
+		t.Fatalf("expected no task selected, but got %+v", manifest.Results)
+	}
+
+	// the failure is recorded in manifest instead of returned
+	manifest, err = h.manager.CheckpointAll(h.ctx, BulkCheckpointOptions{Dir: dir, Concurrency: 1})
+	if err != nil {
+		t.Fatalf("failed to checkpoint all: %v", err)
+	}
+	if len(manifest.Results) != 1 || len(manifest.Failed()) != 1 {
+		t.Fatalf("expected 1 failed result, but got %+v", manifest.Results)
+	}
+
+	r := manifest.Results[0]
+	if r.ID != "bulk" || r.Namespace != "testing" || r.ImagePath != filepath.Join(dir, "testing", "bulk") {
+		t.Fatalf("unexpected result %+v", r)
+	}
+
+	got, err := ReadBulkCheckpointManifest(dir)
+	if err != nil {
+		t.Fatalf("failed to read manifest: %v", err)
+	}
+	if len(got.Results) != 1 || got.Results[0].Error != r.Error {
+		t.Fatalf("expected %+v, but got %+v", manifest.Results, got.Results)
+	}
+}
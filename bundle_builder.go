@@ -0,0 +1,177 @@
+//go:build linux
+// +build linux
+
+package embedshim
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	pkgbundle "github.com/fuweid/embedshim/pkg/bundle"
+
+	"github.com/containerd/containerd/containers"
+	"github.com/containerd/containerd/errdefs"
+	"github.com/containerd/containerd/runtime"
+	"github.com/opencontainers/runtime-spec/specs-go"
+	"google.golang.org/protobuf/types/known/anypb"
+)
+
+// specDigestAlgorithm is the prefix of the spec digest.
+const specDigestAlgorithm = "sha256"
+
+// bundleFileKeyOCISpecDigest is the filename about the digest of the
+// config.json written by the bundle builder. It is the digest of the spec
+// which the task is created with, and is used for drift auditing.
+var bundleFileKeyOCISpecDigest = "config.json.digest"
+
+// fillCreateOptsFromContainer fills the spec and runtime options, which are
+// missing in the create options, from the containerd container's metadata,
+// so that the bundle can be generated from the metadata only.
+func fillCreateOptsFromContainer(container containers.Container, opts *runtime.CreateOpts) {
+	if opts.Spec == nil || len(opts.Spec.Value) == 0 {
+		opts.Spec = container.Spec
+	}
+	if opts.RuntimeOptions == nil && opts.TaskOptions == nil {
+		opts.RuntimeOptions = container.Runtime.Options
+	}
+}
+
+// canonicalSpecJSON returns the spec JSON with the stable ordering, in which
+// the object keys are sorted and the insignificant spaces are removed. The
+// numbers are kept as they are, so that the large uint64, like the rlimit,
+// doesn't lose precision.
+//
+// It verifies that the result is a valid OCI spec and round-trips: the
+// canonical JSON of the result is the result itself.
+func canonicalSpecJSON(value []byte) ([]byte, error) {
+	canonical, err := canonicalJSON(value)
+	if err != nil {
+		return nil, fmt.Errorf("failed to canonicalize spec: %s: %w", err, errdefs.ErrInvalidArgument)
+	}
+
+	var spec specs.Spec
+	if err := json.Unmarshal(canonical, &spec); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal canonical spec: %s: %w", err, errdefs.ErrInvalidArgument)
+	}
+
+	again, err := canonicalJSON(canonical)
+	if err != nil {
+		return nil, fmt.Errorf("failed to canonicalize spec again: %w", err)
+	}
+	if !bytes.Equal(canonical, again) {
+		return nil, fmt.Errorf("canonical spec doesn't round-trip")
+	}
+	return canonical, nil
+}
+
+func canonicalJSON(value []byte) ([]byte, error) {
+	dec := json.NewDecoder(bytes.NewReader(value))
+	dec.UseNumber()
+
+	var v interface{}
+	if err := dec.Decode(&v); err != nil {
+		return nil, err
+	}
+	if dec.More() {
+		return nil, fmt.Errorf("unexpected data after top-level value")
+	}
+
+	// NOTE: encoding/json sorts the map keys.
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	enc.SetEscapeHTML(false)
+	if err := enc.Encode(v); err != nil {
+		return nil, err
+	}
+	return bytes.TrimSuffix(buf.Bytes(), []byte("\n")), nil
+}
+
+// SpecDigest returns the digest of the spec's canonical JSON, like
+// sha256:<hex>. It can be compared with the task's SpecDigest to audit
+// whether the task runs with the container's current spec.
+func SpecDigest(spec *anypb.Any) (string, error) {
+	if spec == nil || len(spec.Value) == 0 {
+		return "", fmt.Errorf("spec is empty: %w", errdefs.ErrInvalidArgument)
+	}
+
+	canonical, err := canonicalSpecJSON(spec.Value)
+	if err != nil {
+		return "", err
+	}
+	return specDigest(canonical), nil
+}
+
+func specDigest(canonical []byte) string {
+	sum := sha256.Sum256(canonical)
+	return specDigestAlgorithm + ":" + hex.EncodeToString(sum[:])
+}
+
+// writeCanonicalInitOCISpec writes the canonical spec and its digest into
+// bundle. The config.json is replaced atomically and verified by reading it
+// back.
+func writeCanonicalInitOCISpec(b *pkgbundle.Bundle, value []byte) error {
+	canonical, err := canonicalSpecJSON(value)
+	if err != nil {
+		return err
+	}
+	digest := specDigest(canonical)
+
+	pathname := filepath.Join(b.Path, bundleFileKeyOCISpec)
+	if err := writeFileAtomic(pathname, canonical); err != nil {
+		return err
+	}
+
+	written, err := os.ReadFile(pathname)
+	if err != nil {
+		return fmt.Errorf("failed to read %v: %w", pathname, err)
+	}
+	if got := specDigest(written); got != digest {
+		return fmt.Errorf("config.json digest mismatch after write, expected %s, but got %s", digest, got)
+	}
+
+	return writeFileAtomic(filepath.Join(b.Path, bundleFileKeyOCISpecDigest), []byte(digest))
+}
+
+// readInitOCISpecDigest returns the digest of the spec which the task is
+// created with. The bundle created by the old version doesn't have the
+// digest file, so that the digest is calculated from the config.json.
+func readInitOCISpecDigest(b *pkgbundle.Bundle) (string, error) {
+	value, err := os.ReadFile(filepath.Join(b.Path, bundleFileKeyOCISpecDigest))
+	if err == nil {
+		return strings.TrimSpace(string(value)), nil
+	}
+	if !os.IsNotExist(err) {
+		return "", err
+	}
+
+	pathname := filepath.Join(b.Path, bundleFileKeyOCISpec)
+	value, err = os.ReadFile(pathname)
+	if err != nil {
+		return "", fmt.Errorf("failed to read %v: %w", pathname, err)
+	}
+
+	canonical, err := canonicalSpecJSON(value)
+	if err != nil {
+		return "", err
+	}
+	return specDigest(canonical), nil
+}
+
+func writeFileAtomic(pathname string, value []byte) error {
+	tmpPathname := pathname + ".tmp"
+	if err := os.WriteFile(tmpPathname, value, 0666); err != nil {
+		return fmt.Errorf("failed to store in %v: %w", tmpPathname, err)
+	}
+
+	if err := os.Rename(tmpPathname, pathname); err != nil {
+		os.Remove(tmpPathname)
+		return fmt.Errorf("failed to rename %v: %w", tmpPathname, err)
+	}
+	return nil
+}
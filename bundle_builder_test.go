@@ -0,0 +1,166 @@
+//go:build linux
+// +build linux
+
+package embedshim
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+
+	pkgbundle "github.com/fuweid/embedshim/pkg/bundle"
+	"github.com/fuweid/embedshim/pkg/protocompat"
+
+	"github.com/containerd/containerd/containers"
+	"github.com/containerd/containerd/runtime"
+	ptypes "github.com/gogo/protobuf/types"
+	"github.com/opencontainers/runtime-spec/specs-go"
+	"google.golang.org/protobuf/types/known/anypb"
+)
+
+func TestCanonicalSpecJSON(t *testing.T) {
+	a := []byte(`{"ociVersion":"1.0.2","process":{"cwd":"/","args":["sh"],"rlimits":[{"type":"RLIMIT_NOFILE","hard":18446744073709551615,"soft":1024}]},"annotations":{"b":"<2>","a":"1"}}`)
+	b := []byte(`{
+	"annotations": {"a": "1", "b": "<2>"},
+	"process": {"rlimits": [{"soft": 1024, "hard": 18446744073709551615, "type": "RLIMIT_NOFILE"}], "args": ["sh"], "cwd": "/"},
+	"ociVersion": "1.0.2"
+}`)
+
+	ca, err := canonicalSpecJSON(a)
+	if err != nil {
+		t.Fatalf("failed to canonicalize spec: %v", err)
+	}
+	cb, err := canonicalSpecJSON(b)
+	if err != nil {
+		t.Fatalf("failed to canonicalize spec: %v", err)
+	}
+
+	expected := `{"annotations":{"a":"1","b":"<2>"},"ociVersion":"1.0.2","process":{"args":["sh"],"cwd":"/","rlimits":[{"hard":18446744073709551615,"soft":1024,"type":"RLIMIT_NOFILE"}]}}`
+	if string(ca) != expected {
+		t.Fatalf("expected %v, but got %v", expected, string(ca))
+	}
+	if string(cb) != expected {
+		t.Fatalf("expected %v, but got %v", expected, string(cb))
+	}
+
+	for _, invalid := range []string{``, `{`, `[]`, `{} {}`, `{"process":"sh"}`} {
+		if _, err := canonicalSpecJSON([]byte(invalid)); err == nil {
+			t.Fatalf("expected error for %q, but got nil", invalid)
+		}
+	}
+}
+
+func TestSpecDigest(t *testing.T) {
+	d1, err := SpecDigest(&anypb.Any{Value: []byte(`{"ociVersion":"1.0.2","hostname":"a"}`)})
+	if err != nil {
+		t.Fatalf("failed to get digest: %v", err)
+	}
+	d2, err := SpecDigest(&anypb.Any{Value: []byte(`{"hostname":"a", "ociVersion":"1.0.2"}`)})
+	if err != nil {
+		t.Fatalf("failed to get digest: %v", err)
+	}
+	if d1 != d2 {
+		t.Fatalf("expected same digest, but got %v and %v", d1, d2)
+	}
+
+	d3, err := SpecDigest(&anypb.Any{Value: []byte(`{"hostname":"b","ociVersion":"1.0.2"}`)})
+	if err != nil {
+		t.Fatalf("failed to get digest: %v", err)
+	}
+	if d1 == d3 {
+		t.Fatalf("expected different digest, but got same %v", d1)
+	}
+
+	if _, err := SpecDigest(nil); err == nil {
+		t.Fatalf("expected error for nil spec, but got nil")
+	}
+}
+
+func TestBundleBuilderFromContainer(t *testing.T) {
+	spec := &specs.Spec{
+		Version:  "1.0.2",
+		Hostname: "test",
+		Process:  &specs.Process{Args: []string{"sh"}, Cwd: "/"},
+		Annotations: map[string]string{
+			"z": "1",
+			"a": "2",
+		},
+	}
+	value, err := json.Marshal(spec)
+	if err != nil {
+		t.Fatalf("failed to marshal spec: %v", err)
+	}
+
+	container := containers.Container{
+		ID:   "test",
+		Spec: &ptypes.Any{TypeUrl: "types.containerd.io/opencontainers/runtime-spec/1/Spec", Value: value},
+		Runtime: containers.RuntimeInfo{
+			Name:    "io.containerd.runc.v2",
+			Options: &ptypes.Any{TypeUrl: "containerd.runc.v1.Options"},
+		},
+	}
+
+	var opts runtime.CreateOpts
+	fillCreateOptsFromContainer(container, &opts)
+	if opts.Spec != container.Spec {
+		t.Fatalf("expected spec from container, but got %v", opts.Spec)
+	}
+	if opts.RuntimeOptions != container.Runtime.Options {
+		t.Fatalf("expected runtime options from container, but got %v", opts.RuntimeOptions)
+	}
+
+	// the create options take precedence over the metadata
+	taskOpts := &ptypes.Any{TypeUrl: "containerd.runc.v1.Options"}
+	opts = runtime.CreateOpts{TaskOptions: taskOpts}
+	fillCreateOptsFromContainer(container, &opts)
+	if opts.RuntimeOptions != nil || opts.TaskOptions != taskOpts {
+		t.Fatalf("expected task options unchanged, but got runtime %v and task %v", opts.RuntimeOptions, opts.TaskOptions)
+	}
+
+	var digests []string
+	for i := 0; i < 2; i++ {
+		b, err := pkgbundle.NewBundle(t.TempDir(), t.TempDir(), "ns", "test",
+			withBundleApplyInitOCISpec(container.Spec),
+		)
+		if err != nil {
+			t.Fatalf("failed to create bundle: %v", err)
+		}
+
+		got, err := readInitOCISpec(b)
+		if err != nil {
+			t.Fatalf("failed to read spec: %v", err)
+		}
+		if got.Hostname != spec.Hostname || got.Annotations["z"] != "1" {
+			t.Fatalf("expected spec %+v, but got %+v", spec, got)
+		}
+
+		digest, err := readInitOCISpecDigest(b)
+		if err != nil {
+			t.Fatalf("failed to read spec digest: %v", err)
+		}
+		digests = append(digests, digest)
+
+		// the bundle without digest file falls back to config.json
+		if err := os.Remove(filepath.Join(b.Path, bundleFileKeyOCISpecDigest)); err != nil {
+			t.Fatalf("failed to remove digest file: %v", err)
+		}
+		fallback, err := readInitOCISpecDigest(b)
+		if err != nil {
+			t.Fatalf("failed to read spec digest: %v", err)
+		}
+		if fallback != digest {
+			t.Fatalf("expected %v, but got %v", digest, fallback)
+		}
+	}
+
+	expected, err := SpecDigest(protocompat.FromGogo(container.Spec))
+	if err != nil {
+		t.Fatalf("failed to get digest: %v", err)
+	}
+	for _, digest := range digests {
+		if digest != expected {
+			t.Fatalf("expected %v, but got %v", expected, digest)
+		}
+	}
+}
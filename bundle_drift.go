@@ -0,0 +1,281 @@
+//go:build linux
+// +build linux
+
+package embedshim
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+	"unsafe"
+
+	pkgbundle "github.com/fuweid/embedshim/pkg/bundle"
+
+	"github.com/containerd/containerd/log"
+	"github.com/containerd/typeurl"
+	"golang.org/x/sys/unix"
+)
+
+// TaskBundleDriftEventTopic is the topic of TaskBundleDrift event.
+const TaskBundleDriftEventTopic = "/tasks/bundle-drift"
+
+func init() {
+	typeurl.Register(&TaskBundleDrift{}, "io.embedshim.events.v1", "TaskBundleDrift")
+}
+
+var (
+	// driftWatchedFiles are the bundle files which should not be changed
+	// by others while the task exists.
+	driftWatchedFiles = []string{
+		bundleFileKeyOCISpec,
+		bundleFileKeyOCISpecDigest,
+		bundleFileKeyOptions,
+		bundleFileKeyStio,
+		bundleFileKeyTraceEventID,
+	}
+
+	// driftDebounce is the delay before checking the bundle files. The
+	// plugin's own writes refresh the records within the delay so that
+	// they are not reported as drift.
+	driftDebounce = time.Second
+)
+
+// TaskBundleDrift is published when the bundle file has been modified by
+// others while the task exists.
+type TaskBundleDrift struct {
+	ContainerID string    `json:"container_id"`
+	File        string    `json:"file"`
+	Deleted     bool      `json:"deleted"`
+	DetectedAt  time.Time `json:"detected_at"`
+}
+
+// Field implements events.Event.
+func (e *TaskBundleDrift) Field(fieldpath []string) (string, bool) {
+	if len(fieldpath) == 0 {
+		return "", false
+	}
+
+	switch fieldpath[0] {
+	case "container_id":
+		return e.ContainerID, len(e.ContainerID) > 0
+	case "file":
+		return e.File, len(e.File) > 0
+	}
+	return "", false
+}
+
+// bundleWatcher detects the external modification of bundle files by inotify.
+type bundleWatcher struct {
+	mu      sync.Mutex
+	fd      int
+	bundles map[int]*watchedBundle
+	wds     map[string]int
+
+	publish func(ns string, event *TaskBundleDrift)
+}
+
+type watchedBundle struct {
+	bundle *pkgbundle.Bundle
+	hashes map[string]string
+	timer  *time.Timer
+}
+
+func newBundleWatcher(publish func(ns string, event *TaskBundleDrift)) (*bundleWatcher, error) {
+	fd, err := unix.InotifyInit1(unix.IN_CLOEXEC)
+	if err != nil {
+		return nil, fmt.Errorf("failed to init inotify: %w", err)
+	}
+
+	w := &bundleWatcher{
+		fd:      fd,
+		bundles: make(map[int]*watchedBundle),
+		wds:     make(map[string]int),
+		publish: publish,
+	}
+	go w.run()
+	return w, nil
+}
+
+// watch records the current bundle files and starts to watch them.
+func (w *bundleWatcher) watch(b *pkgbundle.Bundle) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if _, ok := w.wds[b.Path]; ok {
+		return nil
+	}
+
+	wd, err := unix.InotifyAddWatch(w.fd, b.Path,
+		unix.IN_CLOSE_WRITE|unix.IN_MOVED_TO|unix.IN_MOVED_FROM|unix.IN_DELETE|unix.IN_ATTRIB)
+	if err != nil {
+		return fmt.Errorf("failed to watch bundle %s: %w", b.Path, err)
+	}
+
+	w.wds[b.Path] = wd
+	w.bundles[wd] = &watchedBundle{
+		bundle: b,
+		hashes: hashBundleFiles(b),
+	}
+	return nil
+}
+
+// refresh records the bundle files again after the plugin updates them.
+func (w *bundleWatcher) refresh(b *pkgbundle.Bundle) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if wd, ok := w.wds[b.Path]; ok {
+		w.bundles[wd].hashes = hashBundleFiles(b)
+	}
+}
+
+// unwatch stops watching the bundle.
+func (w *bundleWatcher) unwatch(b *pkgbundle.Bundle) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	wd, ok := w.wds[b.Path]
+	if !ok {
+		return
+	}
+
+	if wb := w.bundles[wd]; wb.timer != nil {
+		wb.timer.Stop()
+	}
+	delete(w.wds, b.Path)
+	delete(w.bundles, wd)
+	unix.InotifyRmWatch(w.fd, uint32(wd))
+}
+
+func (w *bundleWatcher) run() {
+	buf := make([]byte, 64*(unix.SizeofInotifyEvent+unix.NAME_MAX+1))
+
+	for {
+		n, err := unix.Read(w.fd, buf)
+		if err != nil {
+			if err == unix.EINTR {
+				continue
+			}
+			log.G(context.Background()).WithError(err).Error("failed to read bundle inotify events")
+			return
+		}
+
+		for offset := 0; offset+unix.SizeofInotifyEvent <= n; {
+			ev := (*unix.InotifyEvent)(unsafe.Pointer(&buf[offset]))
+			nameBytes := buf[offset+unix.SizeofInotifyEvent : offset+unix.SizeofInotifyEvent+int(ev.Len)]
+			offset += unix.SizeofInotifyEvent + int(ev.Len)
+
+			name := string(nameBytes)
+			for i := 0; i < len(name); i++ {
+				if name[i] == 0 {
+					name = name[:i]
+					break
+				}
+			}
+
+			if isDriftWatchedFile(name) {
+				w.schedule(int(ev.Wd))
+			}
+		}
+	}
+}
+
+func (w *bundleWatcher) schedule(wd int) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	wb, ok := w.bundles[wd]
+	if !ok || wb.timer != nil {
+		return
+	}
+
+	wb.timer = time.AfterFunc(driftDebounce, func() {
+		w.check(wd)
+	})
+}
+
+func (w *bundleWatcher) check(wd int) {
+	w.mu.Lock()
+	wb, ok := w.bundles[wd]
+	if !ok {
+		w.mu.Unlock()
+		return
+	}
+	wb.timer = nil
+
+	current := hashBundleFiles(wb.bundle)
+	drifted := make([]*TaskBundleDrift, 0)
+	for _, name := range driftWatchedFiles {
+		if current[name] == wb.hashes[name] {
+			continue
+		}
+		drifted = append(drifted, &TaskBundleDrift{
+			ContainerID: wb.bundle.ID,
+			File:        name,
+			Deleted:     current[name] == "",
+			DetectedAt:  time.Now(),
+		})
+	}
+	// Report the drift once.
+	wb.hashes = current
+	w.mu.Unlock()
+
+	for _, ev := range drifted {
+		log.G(context.Background()).WithField("id", ev.ContainerID).
+			WithField("file", ev.File).
+			Warn("bundle file has been modified externally")
+		w.publish(wb.bundle.Namespace, ev)
+	}
+}
+
+func isDriftWatchedFile(name string) bool {
+	for _, f := range driftWatchedFiles {
+		if f == name {
+			return true
+		}
+	}
+	return false
+}
+
+// hashBundleFiles returns the sha256 of the watched files. The missing one is
+// recorded as empty.
+func hashBundleFiles(b *pkgbundle.Bundle) map[string]string {
+	hashes := make(map[string]string, len(driftWatchedFiles))
+	for _, name := range driftWatchedFiles {
+		value, err := os.ReadFile(filepath.Join(b.Path, name))
+		if err != nil {
+			hashes[name] = ""
+			continue
+		}
+		sum := sha256.Sum256(value)
+		hashes[name] = hex.EncodeToString(sum[:])
+	}
+	return hashes
+}
+
+func (manager *TaskManager) watchBundle(b *pkgbundle.Bundle) {
+	if manager.bundleWatcher == nil {
+		return
+	}
+
+	if err := manager.bundleWatcher.watch(b); err != nil {
+		log.G(context.Background()).WithError(err).Warnf("failed to detect drift of bundle %s", b.Path)
+	}
+}
+
+func (manager *TaskManager) refreshBundle(b *pkgbundle.Bundle) {
+	if manager.bundleWatcher != nil {
+		manager.bundleWatcher.refresh(b)
+	}
+}
+
+func (manager *TaskManager) unwatchBundle(b *pkgbundle.Bundle) {
+	if manager.bundleWatcher != nil {
+		manager.bundleWatcher.unwatch(b)
+	}
+}
@@ -1,3 +1,6 @@
+//go:build linux
+// +build linux
+
 package embedshim
 
 import (
@@ -10,9 +13,11 @@ import (
 	pkgbundle "github.com/fuweid/embedshim/pkg/bundle"
 	"github.com/fuweid/embedshim/pkg/runcext"
 
+	"github.com/containerd/containerd/errdefs"
 	"github.com/containerd/containerd/runtime"
 	"github.com/containerd/containerd/runtime/v2/runc/options"
 	"github.com/gogo/protobuf/types"
+	"github.com/opencontainers/runtime-spec/specs-go"
 )
 
 var (
@@ -68,15 +73,40 @@ func withBundleApplyInitTraceEventID(eventID uint64) pkgbundle.ApplyOpts {
 	}
 }
 
-// withBundleApplyInitOCISpec applies the init OCI spec into bundle.
+// withBundleApplyInitOCISpec applies the init OCI spec into bundle. The
+// spec is stored as canonical JSON so that the same spec always generates
+// the same config.json.
 func withBundleApplyInitOCISpec(spec *types.Any) pkgbundle.ApplyOpts {
 	return func(b *pkgbundle.Bundle) error {
-		pathname := filepath.Join(b.Path, bundleFileKeyOCISpec)
-		if err := os.WriteFile(pathname, spec.Value, 0666); err != nil {
-			return fmt.Errorf("failed to store in %v: %w", pathname, err)
+		if spec == nil || len(spec.Value) == 0 {
+			return fmt.Errorf("spec is empty: %w", errdefs.ErrInvalidArgument)
 		}
-		return nil
+		return writeCanonicalInitOCISpec(b, spec.Value)
+	}
+}
+
+func readInitOCISpec(b *pkgbundle.Bundle) (*specs.Spec, error) {
+	pathname := filepath.Join(b.Path, bundleFileKeyOCISpec)
+
+	value, err := os.ReadFile(pathname)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read %v: %w", pathname, err)
+	}
+
+	spec := &specs.Spec{}
+	if err := json.Unmarshal(value, spec); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal json into spec: %w", err)
+	}
+	return spec, nil
+}
+
+// writeInitOCISpec replaces the OCI spec in bundle atomically.
+func writeInitOCISpec(b *pkgbundle.Bundle, spec *specs.Spec) error {
+	value, err := json.Marshal(spec)
+	if err != nil {
+		return fmt.Errorf("failed to marshal spec into json: %w", err)
 	}
+	return writeCanonicalInitOCISpec(b, value)
 }
 
 func readInitOptions(b *pkgbundle.Bundle) (*options.Options, error) {
@@ -0,0 +1,98 @@
+//go:build linux
+// +build linux
+
+package embedshim
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	pkgbundle "github.com/fuweid/embedshim/pkg/bundle"
+)
+
+var (
+	// bundleFormatVersion is the version of bundle's on-disk layout, like
+	// trace event ID, options and stdio settings. It should be increased
+	// with migration if the layout changes.
+	bundleFormatVersion = 1
+
+	// bundleFileKeyVersion is the filename about bundle's format version.
+	//
+	// NOTE: The bundle created before versioning doesn't have the file
+	// and it is treated as version 0.
+	bundleFileKeyVersion = "version"
+
+	// errBundleVersionUnsupported means that the bundle is created by newer
+	// embedshim. The bundle should be kept as it is.
+	errBundleVersionUnsupported = errors.New("unsupported bundle format version")
+)
+
+// bundleMigration upgrades the bundle by one version.
+type bundleMigration func(*pkgbundle.Bundle) error
+
+// bundleMigrations[i] upgrades the bundle from version i to version i+1.
+var bundleMigrations = []bundleMigration{
+	// v0 -> v1: the unversioned bundle has the same layout with v1.
+	func(*pkgbundle.Bundle) error { return nil },
+}
+
+// withBundleApplyFormatVersion applies the current format version into bundle.
+func withBundleApplyFormatVersion() pkgbundle.ApplyOpts {
+	return func(b *pkgbundle.Bundle) error {
+		return writeBundleFormatVersion(b, bundleFormatVersion)
+	}
+}
+
+// migrateBundle upgrades the bundle into current format version.
+func migrateBundle(b *pkgbundle.Bundle) error {
+	version, err := readBundleFormatVersion(b)
+	if err != nil {
+		return err
+	}
+
+	if version > bundleFormatVersion {
+		return fmt.Errorf("bundle %s has version %d, but the latest is %d: %w",
+			b.Path, version, bundleFormatVersion, errBundleVersionUnsupported)
+	}
+
+	for ; version < bundleFormatVersion; version++ {
+		if err := bundleMigrations[version](b); err != nil {
+			return fmt.Errorf("failed to migrate bundle %s from version %d: %w", b.Path, version, err)
+		}
+
+		if err := writeBundleFormatVersion(b, version+1); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func readBundleFormatVersion(b *pkgbundle.Bundle) (int, error) {
+	pathname := filepath.Join(b.Path, bundleFileKeyVersion)
+
+	value, err := os.ReadFile(pathname)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return 0, nil
+		}
+		return 0, fmt.Errorf("failed to read %v: %w", pathname, err)
+	}
+
+	version, err := strconv.Atoi(strings.TrimSpace(string(value)))
+	if err != nil {
+		return 0, fmt.Errorf("invalid format version in %v: %w", pathname, err)
+	}
+	return version, nil
+}
+
+func writeBundleFormatVersion(b *pkgbundle.Bundle, version int) error {
+	pathname := filepath.Join(b.Path, bundleFileKeyVersion)
+	if err := os.WriteFile(pathname, []byte(strconv.Itoa(version)), 0666); err != nil {
+		return fmt.Errorf("failed to store in %v: %w", pathname, err)
+	}
+	return nil
+}
@@ -0,0 +1,352 @@
+//go:build linux
+// +build linux
+
+package embedshim
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"time"
+
+	v1 "github.com/containerd/cgroups/stats/v1"
+	v2 "github.com/containerd/cgroups/v2/stats"
+	"github.com/containerd/containerd/errdefs"
+	"github.com/containerd/containerd/log"
+)
+
+// CadvisorStats is the subset of cadvisor's info/v1.ContainerStats with the
+// same JSON layout, which is converted from the cgroup v1 or v2 metrics. The
+// fields unavailable in the cgroup version are left zero.
+type CadvisorStats struct {
+	Timestamp time.Time                       `json:"timestamp"`
+	Cpu       CadvisorCpuStats                `json:"cpu,omitempty"`
+	DiskIo    CadvisorDiskIoStats             `json:"diskio,omitempty"`
+	Memory    CadvisorMemoryStats             `json:"memory,omitempty"`
+	Hugetlb   map[string]CadvisorHugetlbStats `json:"hugetlb,omitempty"`
+	Network   CadvisorNetworkStats            `json:"network,omitempty"`
+	Processes CadvisorProcessStats            `json:"processes,omitempty"`
+}
+
+// CadvisorCpuStats is cadvisor's CpuStats. The values are in nanoseconds.
+type CadvisorCpuStats struct {
+	Usage CadvisorCpuUsage `json:"usage"`
+	CFS   CadvisorCpuCFS   `json:"cfs"`
+}
+
+// CadvisorCpuUsage is cadvisor's CpuUsage. PerCpu is unavailable in cgroup
+// v2.
+type CadvisorCpuUsage struct {
+	Total  uint64   `json:"total"`
+	PerCpu []uint64 `json:"per_cpu_usage,omitempty"`
+	User   uint64   `json:"user"`
+	System uint64   `json:"system"`
+}
+
+// CadvisorCpuCFS is cadvisor's CpuCFS.
+type CadvisorCpuCFS struct {
+	Periods          uint64 `json:"periods"`
+	ThrottledPeriods uint64 `json:"throttled_periods"`
+	ThrottledTime    uint64 `json:"throttled_time"`
+}
+
+// CadvisorMemoryStats is cadvisor's MemoryStats. MaxUsage is unavailable in
+// cgroup v2.
+type CadvisorMemoryStats struct {
+	Usage            uint64                  `json:"usage"`
+	MaxUsage         uint64                  `json:"max_usage"`
+	Cache            uint64                  `json:"cache"`
+	RSS              uint64                  `json:"rss"`
+	Swap             uint64                  `json:"swap"`
+	MappedFile       uint64                  `json:"mapped_file"`
+	WorkingSet       uint64                  `json:"working_set"`
+	Failcnt          uint64                  `json:"failcnt"`
+	ContainerData    CadvisorMemoryStatsData `json:"container_data,omitempty"`
+	HierarchicalData CadvisorMemoryStatsData `json:"hierarchical_data,omitempty"`
+}
+
+// CadvisorMemoryStatsData is cadvisor's MemoryStatsMemoryData.
+type CadvisorMemoryStatsData struct {
+	Pgfault    uint64 `json:"pgfault"`
+	Pgmajfault uint64 `json:"pgmajfault"`
+}
+
+// CadvisorDiskIoStats is cadvisor's DiskIoStats.
+type CadvisorDiskIoStats struct {
+	IoServiceBytes []CadvisorPerDiskStats `json:"io_service_bytes,omitempty"`
+	IoServiced     []CadvisorPerDiskStats `json:"io_serviced,omitempty"`
+}
+
+// CadvisorPerDiskStats is cadvisor's PerDiskStats. The Stats' keys are the
+// operations, like "Read", "Write" and "Total".
+type CadvisorPerDiskStats struct {
+	Device string            `json:"device"`
+	Major  uint64            `json:"major"`
+	Minor  uint64            `json:"minor"`
+	Stats  map[string]uint64 `json:"stats"`
+}
+
+// CadvisorHugetlbStats is cadvisor's HugetlbStats, keyed by page size.
+type CadvisorHugetlbStats struct {
+	Usage    uint64 `json:"usage,omitempty"`
+	MaxUsage uint64 `json:"max_usage,omitempty"`
+	Failcnt  uint64 `json:"failcnt"`
+}
+
+// CadvisorNetworkStats is cadvisor's NetworkStats. The inline stats are the
+// first interface other than the loopback, which is excluded.
+type CadvisorNetworkStats struct {
+	InterfaceStats
+	Interfaces []InterfaceStats `json:"interfaces,omitempty"`
+}
+
+// CadvisorProcessStats is cadvisor's ProcessStats.
+type CadvisorProcessStats struct {
+	ProcessCount uint64 `json:"process_count"`
+	ThreadsLimit uint64 `json:"threads_max"`
+}
+
+// CadvisorStats returns the task's stats in cadvisor's layout for the
+// monitoring consuming the legacy layout.
+func (manager *TaskManager) CadvisorStats(ctx context.Context, id string) (*CadvisorStats, error) {
+	t, err := manager.tasks.Get(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+
+	s, ok := t.(*shim)
+	if !ok {
+		return nil, errdefs.ErrNotImplemented
+	}
+
+	statsx, err := s.cgroupStats()
+	if err != nil {
+		return nil, err
+	}
+
+	var stats *CadvisorStats
+	switch m := statsx.(type) {
+	case *v1.Metrics:
+		stats = cadvisorStatsFromV1(m, time.Now())
+	case *v2.Metrics:
+		stats = cadvisorStatsFromV2(m, time.Now())
+	default:
+		return nil, fmt.Errorf("unsupported stats type %T: %w", m, errdefs.ErrNotImplemented)
+	}
+
+	ifaces, err := manager.NetworkStats(ctx, id)
+	if err != nil {
+		log.G(ctx).WithError(err).Debugf("failed to get network stats of task %s", id)
+	} else {
+		stats.Network = cadvisorNetworkStats(ifaces)
+	}
+	return stats, nil
+}
+
+func cadvisorNetworkStats(ifaces []InterfaceStats) CadvisorNetworkStats {
+	var stats CadvisorNetworkStats
+	for _, iface := range ifaces {
+		if iface.Name == "lo" {
+			continue
+		}
+		if len(stats.Interfaces) == 0 {
+			stats.InterfaceStats = iface
+		}
+		stats.Interfaces = append(stats.Interfaces, iface)
+	}
+	return stats
+}
+
+func cadvisorStatsFromV1(m *v1.Metrics, now time.Time) *CadvisorStats {
+	stats := &CadvisorStats{Timestamp: now}
+
+	if cpu := m.CPU; cpu != nil {
+		if u := cpu.Usage; u != nil {
+			stats.Cpu.Usage = CadvisorCpuUsage{
+				Total:  u.Total,
+				PerCpu: u.PerCPU,
+				User:   u.User,
+				System: u.Kernel,
+			}
+		}
+		if t := cpu.Throttling; t != nil {
+			stats.Cpu.CFS = CadvisorCpuCFS{
+				Periods:          t.Periods,
+				ThrottledPeriods: t.ThrottledPeriods,
+				ThrottledTime:    t.ThrottledTime,
+			}
+		}
+	}
+
+	if mem := m.Memory; mem != nil {
+		stats.Memory.Cache = mem.TotalCache
+		stats.Memory.RSS = mem.TotalRSS
+		stats.Memory.MappedFile = mem.TotalMappedFile
+		stats.Memory.ContainerData = CadvisorMemoryStatsData{
+			Pgfault:    mem.PgFault,
+			Pgmajfault: mem.PgMajFault,
+		}
+		stats.Memory.HierarchicalData = CadvisorMemoryStatsData{
+			Pgfault:    mem.TotalPgFault,
+			Pgmajfault: mem.TotalPgMajFault,
+		}
+		if u := mem.Usage; u != nil {
+			stats.Memory.Usage = u.Usage
+			stats.Memory.MaxUsage = u.Max
+			stats.Memory.Failcnt = u.Failcnt
+			stats.Memory.WorkingSet = workingSet(u.Usage, mem.TotalInactiveFile)
+		}
+		// NOTE: memory.memsw.usage_in_bytes includes the memory usage.
+		if sw := mem.Swap; sw != nil && mem.Usage != nil && sw.Usage > mem.Usage.Usage {
+			stats.Memory.Swap = sw.Usage - mem.Usage.Usage
+		}
+	}
+
+	if blkio := m.Blkio; blkio != nil {
+		stats.DiskIo.IoServiceBytes = cadvisorPerDiskStatsFromV1(blkio.IoServiceBytesRecursive)
+		stats.DiskIo.IoServiced = cadvisorPerDiskStatsFromV1(blkio.IoServicedRecursive)
+	}
+
+	for _, h := range m.Hugetlb {
+		if stats.Hugetlb == nil {
+			stats.Hugetlb = make(map[string]CadvisorHugetlbStats)
+		}
+		stats.Hugetlb[h.Pagesize] = CadvisorHugetlbStats{
+			Usage:    h.Usage,
+			MaxUsage: h.Max,
+			Failcnt:  h.Failcnt,
+		}
+	}
+
+	if pids := m.Pids; pids != nil {
+		stats.Processes = CadvisorProcessStats{
+			ProcessCount: pids.Current,
+			ThreadsLimit: pids.Limit,
+		}
+	}
+	return stats
+}
+
+func cadvisorStatsFromV2(m *v2.Metrics, now time.Time) *CadvisorStats {
+	stats := &CadvisorStats{Timestamp: now}
+
+	if cpu := m.CPU; cpu != nil {
+		stats.Cpu.Usage = CadvisorCpuUsage{
+			Total:  cpu.UsageUsec * uint64(time.Microsecond),
+			User:   cpu.UserUsec * uint64(time.Microsecond),
+			System: cpu.SystemUsec * uint64(time.Microsecond),
+		}
+		stats.Cpu.CFS = CadvisorCpuCFS{
+			Periods:          cpu.NrPeriods,
+			ThrottledPeriods: cpu.NrThrottled,
+			ThrottledTime:    cpu.ThrottledUsec * uint64(time.Microsecond),
+		}
+	}
+
+	if mem := m.Memory; mem != nil {
+		stats.Memory.Usage = mem.Usage
+		stats.Memory.Cache = mem.File
+		stats.Memory.RSS = mem.Anon
+		stats.Memory.Swap = mem.SwapUsage
+		stats.Memory.MappedFile = mem.FileMapped
+		stats.Memory.WorkingSet = workingSet(mem.Usage, mem.InactiveFile)
+		stats.Memory.ContainerData = CadvisorMemoryStatsData{
+			Pgfault:    mem.Pgfault,
+			Pgmajfault: mem.Pgmajfault,
+		}
+		stats.Memory.HierarchicalData = stats.Memory.ContainerData
+	}
+	if events := m.MemoryEvents; events != nil {
+		stats.Memory.Failcnt = events.Max
+	}
+
+	if io := m.Io; io != nil {
+		for _, e := range io.Usage {
+			stats.DiskIo.IoServiceBytes = append(stats.DiskIo.IoServiceBytes, CadvisorPerDiskStats{
+				Major: e.Major,
+				Minor: e.Minor,
+				Stats: map[string]uint64{
+					"Read":  e.Rbytes,
+					"Write": e.Wbytes,
+					"Total": e.Rbytes + e.Wbytes,
+				},
+			})
+			stats.DiskIo.IoServiced = append(stats.DiskIo.IoServiced, CadvisorPerDiskStats{
+				Major: e.Major,
+				Minor: e.Minor,
+				Stats: map[string]uint64{
+					"Read":  e.Rios,
+					"Write": e.Wios,
+					"Total": e.Rios + e.Wios,
+				},
+			})
+		}
+	}
+
+	for _, h := range m.Hugetlb {
+		if stats.Hugetlb == nil {
+			stats.Hugetlb = make(map[string]CadvisorHugetlbStats)
+		}
+		stats.Hugetlb[h.Pagesize] = CadvisorHugetlbStats{
+			Usage:    h.Current,
+			MaxUsage: h.Max,
+		}
+	}
+
+	if pids := m.Pids; pids != nil {
+		stats.Processes = CadvisorProcessStats{
+			ProcessCount: pids.Current,
+			ThreadsLimit: pids.Limit,
+		}
+	}
+	return stats
+}
+
+// cadvisorPerDiskStatsFromV1 groups the blkio entries by device.
+func cadvisorPerDiskStatsFromV1(entries []*v1.BlkIOEntry) []CadvisorPerDiskStats {
+	type device struct {
+		major, minor uint64
+	}
+
+	var (
+		devices []device
+		byDev   = make(map[device]*CadvisorPerDiskStats)
+	)
+	for _, e := range entries {
+		dev := device{major: e.Major, minor: e.Minor}
+		st, ok := byDev[dev]
+		if !ok {
+			st = &CadvisorPerDiskStats{
+				Device: e.Device,
+				Major:  e.Major,
+				Minor:  e.Minor,
+				Stats:  make(map[string]uint64),
+			}
+			byDev[dev] = st
+			devices = append(devices, dev)
+		}
+		st.Stats[e.Op] += e.Value
+	}
+
+	sort.Slice(devices, func(i, j int) bool {
+		if devices[i].major != devices[j].major {
+			return devices[i].major < devices[j].major
+		}
+		return devices[i].minor < devices[j].minor
+	})
+
+	res := make([]CadvisorPerDiskStats, 0, len(devices))
+	for _, dev := range devices {
+		res = append(res, *byDev[dev])
+	}
+	return res
+}
+
+// workingSet is the memory usage without the inactive file cache, which is
+// the same to cadvisor and kubelet's eviction.
+func workingSet(usage, inactiveFile uint64) uint64 {
+	if usage < inactiveFile {
+		return 0
+	}
+	return usage - inactiveFile
+}
@@ -0,0 +1,164 @@
+//go:build linux
+// +build linux
+
+package embedshim
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+
+	"github.com/fuweid/embedshim/pkg/pidfd"
+
+	"github.com/cilium/ebpf"
+	"github.com/cilium/ebpf/asm"
+	"github.com/cilium/ebpf/features"
+	"github.com/containerd/cgroups"
+	"github.com/containerd/containerd/errdefs"
+	"github.com/containerd/containerd/log"
+	"golang.org/x/sys/unix"
+)
+
+// capabilitiesFileName is the machine-readable capability report stored in
+// plugin's root dir.
+var capabilitiesFileName = "capabilities.json"
+
+// Capabilities is the host capability report detected at plugin init.
+type Capabilities struct {
+	KernelRelease string `json:"kernel_release"`
+	CgroupMode    string `json:"cgroup_mode"`
+
+	// Required by the exit tracking.
+	BPFRawTracepoint bool `json:"bpf_raw_tracepoint"`
+	BPFHashMap       bool `json:"bpf_hash_map"`
+	BPFNsPidHelper   bool `json:"bpf_get_ns_current_pid_tgid"`
+	PidfdOpen        bool `json:"pidfd_open"`
+
+	// Optional features which are disabled if missing.
+	PidfdGetfd    bool `json:"pidfd_getfd"`
+	BPFStats      bool `json:"bpf_stats"`
+	TimeNamespace bool `json:"time_namespace"`
+
+	// Missing lists the required capabilities which are not supported.
+	Missing []string `json:"missing,omitempty"`
+}
+
+// Supported returns nil if all the required capabilities are supported.
+func (c *Capabilities) Supported() error {
+	if len(c.Missing) == 0 {
+		return nil
+	}
+	return fmt.Errorf("kernel %s doesn't support %v: %w", c.KernelRelease, c.Missing, errdefs.ErrNotImplemented)
+}
+
+// Exports returns the report in plugin's exports format.
+func (c *Capabilities) Exports() map[string]string {
+	return map[string]string{
+		"kernel_release":              c.KernelRelease,
+		"cgroup_mode":                 c.CgroupMode,
+		"bpf_raw_tracepoint":          strconv.FormatBool(c.BPFRawTracepoint),
+		"bpf_hash_map":                strconv.FormatBool(c.BPFHashMap),
+		"bpf_get_ns_current_pid_tgid": strconv.FormatBool(c.BPFNsPidHelper),
+		"pidfd_open":                  strconv.FormatBool(c.PidfdOpen),
+		"pidfd_getfd":                 strconv.FormatBool(c.PidfdGetfd),
+		"bpf_stats":                   strconv.FormatBool(c.BPFStats),
+		"time_namespace":              strconv.FormatBool(c.TimeNamespace),
+	}
+}
+
+// Capabilities returns the host capability report detected at plugin init.
+func (manager *TaskManager) Capabilities() *Capabilities {
+	return manager.caps
+}
+
+// detectCapabilities probes the kernel features used by embedshim.
+func detectCapabilities() *Capabilities {
+	c := &Capabilities{
+		KernelRelease: kernelRelease(),
+		CgroupMode:    cgroupModeName(cgroups.Mode()),
+	}
+
+	c.BPFRawTracepoint = features.HaveProgramType(ebpf.RawTracepoint) == nil
+	c.BPFHashMap = features.HaveMapType(ebpf.Hash) == nil
+	c.BPFNsPidHelper = features.HaveProgramHelper(ebpf.RawTracepoint, asm.FnGetNsCurrentPidTgid) == nil
+
+	if fd, err := pidfd.Open(uint32(os.Getpid()), 0); err == nil {
+		c.PidfdOpen = true
+
+		if dupFD, err := fd.GetFd(0, 0); err == nil {
+			c.PidfdGetfd = true
+			unix.Close(dupFD)
+		}
+		unix.Close(int(fd))
+	}
+
+	if closer, err := ebpf.EnableStats(uint32(unix.BPF_STATS_RUN_TIME)); err == nil {
+		c.BPFStats = true
+		closer.Close()
+	}
+
+	if _, err := os.Stat("/proc/self/ns/time"); err == nil {
+		c.TimeNamespace = true
+	}
+
+	for _, required := range []struct {
+		name      string
+		supported bool
+	}{
+		{"bpf_raw_tracepoint", c.BPFRawTracepoint},
+		{"bpf_hash_map", c.BPFHashMap},
+		{"bpf_get_ns_current_pid_tgid", c.BPFNsPidHelper},
+		{"pidfd_open", c.PidfdOpen},
+	} {
+		if !required.supported {
+			c.Missing = append(c.Missing, required.name)
+		}
+	}
+	return c
+}
+
+// writeCapabilities stores the report in dir.
+func writeCapabilities(dir string, c *Capabilities) error {
+	value, err := json.MarshalIndent(c, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to marshal capabilities into json: %w", err)
+	}
+
+	pathname := filepath.Join(dir, capabilitiesFileName)
+	if err := os.WriteFile(pathname, value, 0644); err != nil {
+		return fmt.Errorf("failed to store in %v: %w", pathname, err)
+	}
+	return nil
+}
+
+// degradeConfig disables the optional features which are not supported.
+func degradeConfig(cfg *Config, c *Capabilities) {
+	if cfg.BPFStats && !c.BPFStats {
+		log.G(context.Background()).Warn("bpf_stats is not supported by kernel, disable it")
+		cfg.BPFStats = false
+	}
+}
+
+func kernelRelease() string {
+	var uts unix.Utsname
+	if err := unix.Uname(&uts); err != nil {
+		return "unknown"
+	}
+	return unix.ByteSliceToString(uts.Release[:])
+}
+
+func cgroupModeName(mode cgroups.CGMode) string {
+	switch mode {
+	case cgroups.Legacy:
+		return "legacy"
+	case cgroups.Hybrid:
+		return "hybrid"
+	case cgroups.Unified:
+		return "unified"
+	default:
+		return "unavailable"
+	}
+}
@@ -0,0 +1,104 @@
+//go:build linux
+// +build linux
+
+package embedshim
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	pkgbundle "github.com/fuweid/embedshim/pkg/bundle"
+
+	"github.com/containerd/containerd/log"
+	"golang.org/x/sys/unix"
+)
+
+// bundleFileKeyExternalCgroup is the filename about the cgroup path which is
+// managed by others, like systemd scope created by agent. The init process
+// joins it and the plugin must not remove it when the task is deleted.
+var bundleFileKeyExternalCgroup = "external_cgroup"
+
+// withBundleApplyExternalCgroup marks the task's cgroup as external if it is
+// forced by annotation or the cgroupsPath exists before the task is created.
+//
+// NOTE: The cgroupsPath in systemd format is only treated as external by
+// annotation.
+func withBundleApplyExternalCgroup(systemdCgroup bool) pkgbundle.ApplyOpts {
+	return func(b *pkgbundle.Bundle) error {
+		spec, err := readInitOCISpec(b)
+		if err != nil {
+			return err
+		}
+
+		if spec.Linux == nil || spec.Linux.CgroupsPath == "" {
+			return nil
+		}
+		cgroupsPath := spec.Linux.CgroupsPath
+
+		external, err := annotationBool(spec.Annotations, annotationExternalCgroup)
+		if err != nil {
+			return err
+		}
+
+		if !external && !systemdCgroup {
+			external = cgroupfsPathExists(cgroupsPath)
+		}
+
+		if !external {
+			return nil
+		}
+
+		pathname := filepath.Join(b.Path, bundleFileKeyExternalCgroup)
+		if err := os.WriteFile(pathname, []byte(cgroupsPath), 0644); err != nil {
+			return fmt.Errorf("failed to store in %v: %w", pathname, err)
+		}
+		return nil
+	}
+}
+
+// cgroupfsPathExists checks the cgroupsPath in the unified hierarchy or the
+// memory controller for cgroup v1.
+func cgroupfsPathExists(cgroupsPath string) bool {
+	root, err := cgroupControllerRoot("memory")
+	if err != nil {
+		return false
+	}
+
+	fi, err := os.Stat(filepath.Join(root, cgroupsPath))
+	return err == nil && fi.IsDir()
+}
+
+func hasExternalCgroup(b *pkgbundle.Bundle) bool {
+	_, err := os.Stat(filepath.Join(b.Path, bundleFileKeyExternalCgroup))
+	return err == nil
+}
+
+// deleteKeepCgroup removes the init process's runtime state without `runc
+// delete`, which destroys the cgroup or stops the systemd unit.
+//
+// NOTE: The poststop hooks are not executed because they are driven by
+// `runc delete`.
+func (p *initProcess) deleteKeepCgroup(ctx context.Context) error {
+	// The created init process is still blocked on exec.fifo.
+	if p.pid > 0 && p.ExitedAt().IsZero() {
+		if err := unix.Kill(p.pid, unix.SIGKILL); err != nil && err != unix.ESRCH {
+			return fmt.Errorf("failed to kill init process %d: %w", p.pid, err)
+		}
+	}
+
+	stateDir := filepath.Join(p.runtime.RootDir(), p.ID())
+	if err := os.RemoveAll(stateDir); err != nil {
+		return fmt.Errorf("failed to remove runtime state %s: %w", stateDir, err)
+	}
+
+	log.G(ctx).WithField("id", p.ID()).Debug("deleted task without destroying external cgroup")
+	return nil
+}
+
+// isRuntimeNotExist returns true if the runtime has deleted the container.
+func isRuntimeNotExist(err error) bool {
+	return strings.Contains(err.Error(), "does not exist")
+}
@@ -0,0 +1,145 @@
+//go:build linux
+// +build linux
+
+package embedshim
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/containerd/cgroups"
+	cgroupsv2 "github.com/containerd/cgroups/v2"
+)
+
+// cgroupMounts is the host's cgroup mountpoints.
+//
+// In hybrid mode, the controllers are mounted as cgroup v1 and the cgroup v2
+// hierarchy without controller is mounted at /sys/fs/cgroup/unified by
+// systemd. The cgroup v2 hierarchy is still the default one for the cgroup
+// ID, like bpf_get_current_cgroup_id.
+type cgroupMounts struct {
+	// unified is the cgroup v2 mountpoint. It is empty if not mounted.
+	unified string
+	// controllers maps the cgroup v1 controller to its mountpoint.
+	controllers map[string]string
+}
+
+var (
+	cgroupMountsOnce   sync.Once
+	cgroupMountsLoaded *cgroupMounts
+	cgroupMountsErr    error
+)
+
+// hostCgroupMounts returns the cgroup mountpoints in host, which are loaded
+// once like cgroups.Mode.
+func hostCgroupMounts() (*cgroupMounts, error) {
+	cgroupMountsOnce.Do(func() {
+		f, err := os.Open("/proc/self/mountinfo")
+		if err != nil {
+			cgroupMountsErr = err
+			return
+		}
+		defer f.Close()
+
+		cgroupMountsLoaded, cgroupMountsErr = parseCgroupMounts(f)
+	})
+	return cgroupMountsLoaded, cgroupMountsErr
+}
+
+// parseCgroupMounts parses the mountinfo for the cgroup mountpoints. The
+// first mountpoint wins if the hierarchy is mounted more than once.
+func parseCgroupMounts(r io.Reader) (*cgroupMounts, error) {
+	mounts := &cgroupMounts{controllers: make(map[string]string)}
+
+	s := bufio.NewScanner(r)
+	for s.Scan() {
+		// 36 35 98:0 /mnt1 /mnt2 rw,noatime master:1 - ext3 /dev/root rw,errors=continue
+		fields := strings.Fields(s.Text())
+
+		sep := -1
+		for i := 6; i < len(fields); i++ {
+			if fields[i] == "-" {
+				sep = i
+				break
+			}
+		}
+		if len(fields) < 5 || sep == -1 || sep+3 >= len(fields) {
+			continue
+		}
+
+		mountpoint, fstype, superOpts := fields[4], fields[sep+1], fields[sep+3]
+		switch fstype {
+		case "cgroup2":
+			if mounts.unified == "" {
+				mounts.unified = mountpoint
+			}
+		case "cgroup":
+			for _, opt := range strings.Split(superOpts, ",") {
+				if _, ok := mounts.controllers[opt]; ok {
+					continue
+				}
+				if strings.HasPrefix(opt, "name=") || isCgroupV1Controller(opt) {
+					mounts.controllers[opt] = mountpoint
+				}
+			}
+		}
+	}
+	return mounts, s.Err()
+}
+
+// isCgroupV1Controller filters the mount options which are not controllers.
+func isCgroupV1Controller(opt string) bool {
+	switch opt {
+	case "rw", "ro", "nosuid", "nodev", "noexec", "relatime", "noatime",
+		"clone_children", "noprefix", "xattr", "cpuset_v2_mode":
+		return false
+	}
+	return !strings.Contains(opt, "=")
+}
+
+// pidCgroupID returns the process's cgroup ID in the cgroup v2 hierarchy,
+// which is available in unified and hybrid mode. It returns zero in legacy
+// mode.
+func pidCgroupID(pid int) (uint64, error) {
+	if cgroups.Mode() == cgroups.Legacy {
+		return 0, nil
+	}
+
+	mounts, err := hostCgroupMounts()
+	if err != nil {
+		return 0, fmt.Errorf("loading cgroup mountpoints: %w", err)
+	}
+	if mounts.unified == "" {
+		return 0, nil
+	}
+
+	g, err := cgroupsv2.PidGroupPath(pid)
+	if err != nil {
+		return 0, fmt.Errorf("loading cgroup2 path for %d: %w", pid, err)
+	}
+	return inodeOf(filepath.Join(mounts.unified, g))
+}
+
+// cgroupControllerRoot returns the mountpoint for the controller. The cgroup
+// v2 mountpoint is returned in unified mode.
+func cgroupControllerRoot(controller string) (string, error) {
+	if cgroups.Mode() == cgroups.Unified {
+		return cgroupv2Root, nil
+	}
+
+	mounts, err := hostCgroupMounts()
+	if err != nil {
+		return "", fmt.Errorf("loading cgroup mountpoints: %w", err)
+	}
+
+	root, ok := mounts.controllers[controller]
+	if !ok {
+		return "", fmt.Errorf("cgroup controller %s is not mounted", controller)
+	}
+	return root, nil
+}
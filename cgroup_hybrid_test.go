@@ -0,0 +1,45 @@
+//go:build linux
+// +build linux
+
+package embedshim
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestParseCgroupMountsHybrid(t *testing.T) {
+	mountinfo := `25 30 0:23 / /sys rw,nosuid,nodev,noexec,relatime shared:7 - sysfs sysfs rw
+31 25 0:26 / /sys/fs/cgroup ro,nosuid,nodev,noexec shared:9 - tmpfs tmpfs ro,mode=755
+32 31 0:27 / /sys/fs/cgroup/unified rw,nosuid,nodev,noexec,relatime shared:10 - cgroup2 cgroup2 rw,nsdelegate
+33 31 0:28 / /sys/fs/cgroup/systemd rw,nosuid,nodev,noexec,relatime shared:11 - cgroup cgroup rw,xattr,name=systemd
+36 31 0:31 / /sys/fs/cgroup/memory rw,nosuid,nodev,noexec,relatime shared:15 - cgroup cgroup rw,memory
+37 31 0:32 / /sys/fs/cgroup/cpu,cpuacct rw,nosuid,nodev,noexec,relatime shared:16 - cgroup cgroup rw,cpu,cpuacct
+`
+
+	mounts, err := parseCgroupMounts(strings.NewReader(mountinfo))
+	if err != nil {
+		t.Fatalf("failed to parse mountinfo: %v", err)
+	}
+
+	if expected := "/sys/fs/cgroup/unified"; mounts.unified != expected {
+		t.Fatalf("expected unified %v, but got %v", expected, mounts.unified)
+	}
+
+	for controller, expected := range map[string]string{
+		"memory":       "/sys/fs/cgroup/memory",
+		"cpu":          "/sys/fs/cgroup/cpu,cpuacct",
+		"cpuacct":      "/sys/fs/cgroup/cpu,cpuacct",
+		"name=systemd": "/sys/fs/cgroup/systemd",
+	} {
+		if got := mounts.controllers[controller]; got != expected {
+			t.Fatalf("expected %v mounted at %v, but got %v", controller, expected, got)
+		}
+	}
+
+	for _, opt := range []string{"rw", "xattr"} {
+		if _, ok := mounts.controllers[opt]; ok {
+			t.Fatalf("expected %v isn't controller, but got it", opt)
+		}
+	}
+}
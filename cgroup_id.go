@@ -0,0 +1,92 @@
+//go:build linux
+// +build linux
+
+package embedshim
+
+import (
+	"context"
+	"fmt"
+	"sync"
+
+	"github.com/containerd/containerd/errdefs"
+)
+
+// TaskRef refers to the task in namespace.
+type TaskRef struct {
+	Namespace string
+	ID        string
+}
+
+// cgroupIDIndex maps the cgroup v2 ID to task. The zero value is ready to
+// use.
+type cgroupIDIndex struct {
+	mu   sync.RWMutex
+	byID map[uint64]TaskRef
+}
+
+func (idx *cgroupIDIndex) add(cgroupID uint64, ns, id string) {
+	if cgroupID == 0 {
+		return
+	}
+
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+
+	if idx.byID == nil {
+		idx.byID = make(map[uint64]TaskRef)
+	}
+	idx.byID[cgroupID] = TaskRef{Namespace: ns, ID: id}
+}
+
+func (idx *cgroupIDIndex) remove(cgroupID uint64, ns, id string) {
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+
+	// NOTE: The cgroup ID might be reused by the other task after the
+	// cgroup is removed.
+	if ref, ok := idx.byID[cgroupID]; ok && ref.Namespace == ns && ref.ID == id {
+		delete(idx.byID, cgroupID)
+	}
+}
+
+func (idx *cgroupIDIndex) get(cgroupID uint64) (TaskRef, bool) {
+	idx.mu.RLock()
+	defer idx.mu.RUnlock()
+
+	ref, ok := idx.byID[cgroupID]
+	return ref, ok
+}
+
+// CgroupID returns the cgroup v2 ID of the task's init process, which is the
+// same to the value returned by bpf_get_current_cgroup_id in the container.
+func (manager *TaskManager) CgroupID(ctx context.Context, id string) (uint64, error) {
+	t, err := manager.tasks.Get(ctx, id)
+	if err != nil {
+		return 0, err
+	}
+
+	s, ok := t.(*shim)
+	if !ok {
+		return 0, errdefs.ErrNotImplemented
+	}
+
+	cgroupID := s.loadedIdentity().CgroupID
+	if cgroupID == 0 {
+		return 0, fmt.Errorf("cgroup ID of task %s is unavailable: %w", id, errdefs.ErrNotFound)
+	}
+	return cgroupID, nil
+}
+
+// TaskByCgroupID resolves the cgroup v2 ID to the task in any namespace.
+func (manager *TaskManager) TaskByCgroupID(cgroupID uint64) (TaskRef, error) {
+	ref, ok := manager.cgroupIDs.get(cgroupID)
+	if !ok {
+		return TaskRef{}, fmt.Errorf("no task with cgroup ID %d: %w", cgroupID, errdefs.ErrNotFound)
+	}
+	return ref, nil
+}
+
+// forgetCgroupID removes the task from cgroup ID index.
+func (s *shim) forgetCgroupID() {
+	s.manager.cgroupIDs.remove(s.loadedIdentity().CgroupID, s.Namespace(), s.ID())
+}
@@ -0,0 +1,237 @@
+//go:build linux
+// +build linux
+
+package embedshim
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/containerd/cgroups"
+	cgroupsv2 "github.com/containerd/cgroups/v2"
+	v2 "github.com/containerd/cgroups/v2/stats"
+	"github.com/containerd/containerd/errdefs"
+	"github.com/containerd/containerd/log"
+)
+
+var (
+	// initSubgroupName is the leaf cgroup of the init process under the
+	// container's cgroup.
+	initSubgroupName = "init"
+
+	// execSubgroupPrefix is the prefix of the exec process's leaf cgroup.
+	execSubgroupPrefix = "exec-"
+
+	// subgroupControllers are delegated to the leaf cgroups if available.
+	subgroupControllers = []string{"cpu", "io", "memory", "pids"}
+)
+
+// execSubgroupConfig places the init and exec processes into separate leaf
+// cgroups under the container's cgroup, so that the exec processes' usage
+// can be measured and limited separately. It is only for cgroup v2.
+//
+// The container's cgroup can't have processes when the controllers are
+// delegated to the children, so the init process is moved into the "init"
+// leaf cgroup before it starts.
+type execSubgroupConfig struct {
+	// cpuMax is the default cpu.max of the exec's cgroup, like
+	// "50000 100000".
+	cpuMax string
+	// memoryMax is the default memory.max of the exec's cgroup.
+	memoryMax string
+}
+
+func execSubgroupConfigFromAnnotations(annotations map[string]string) (*execSubgroupConfig, error) {
+	enabled, err := annotationBool(annotations, annotationCgroupExecSubgroups)
+	if err != nil || !enabled {
+		return nil, err
+	}
+
+	if cgroups.Mode() != cgroups.Unified {
+		return nil, fmt.Errorf("annotation %s requires cgroup v2: %w", annotationCgroupExecSubgroups, errdefs.ErrNotImplemented)
+	}
+
+	cfg := &execSubgroupConfig{}
+	if v := annotations[annotationCgroupExecCPUMax]; v != "" {
+		fields := strings.Fields(v)
+		valid := len(fields) == 1 || len(fields) == 2
+		for i, f := range fields {
+			if i == 0 && f == "max" {
+				continue
+			}
+			if n, err := strconv.ParseUint(f, 10, 64); err != nil || n == 0 {
+				valid = false
+			}
+		}
+		if !valid {
+			return nil, fmt.Errorf("invalid annotation %s=%q: %w", annotationCgroupExecCPUMax, v, errdefs.ErrInvalidArgument)
+		}
+		cfg.cpuMax = v
+	}
+
+	if v := annotations[annotationCgroupExecMemoryMax]; v != "" {
+		if n, err := strconv.ParseInt(v, 10, 64); err != nil || n <= 0 {
+			return nil, fmt.Errorf("invalid annotation %s=%q: %w", annotationCgroupExecMemoryMax, v, errdefs.ErrInvalidArgument)
+		}
+		cfg.memoryMax = v
+	}
+	return cfg, nil
+}
+
+// trimInitSubgroup returns the container's cgroup path if the cgroup path is
+// the init's leaf cgroup.
+func (s *shim) trimInitSubgroup(cgroupPath string) string {
+	if s.init.execSubgroups != nil && filepath.Base(cgroupPath) == initSubgroupName {
+		return filepath.Dir(cgroupPath)
+	}
+	return cgroupPath
+}
+
+// setupSubgroups moves the created init process into the leaf cgroup and
+// delegates the controllers to the children.
+func (s *shim) setupSubgroups() error {
+	if s.init.execSubgroups == nil {
+		return nil
+	}
+
+	cgroupPath := s.loadedIdentity().CgroupPath
+	if cgroupPath == "" {
+		return fmt.Errorf("cgroup of task %s is unavailable: %w", s.ID(), errdefs.ErrNotFound)
+	}
+	dir := filepath.Join(cgroupv2Root, cgroupPath)
+
+	initDir := filepath.Join(dir, initSubgroupName)
+	if err := os.MkdirAll(initDir, 0755); err != nil {
+		return err
+	}
+	if err := writeCgroupFile(initDir, "cgroup.procs", strconv.Itoa(s.init.Pid())); err != nil {
+		return err
+	}
+
+	available, err := os.ReadFile(filepath.Join(dir, "cgroup.controllers"))
+	if err != nil {
+		return err
+	}
+
+	var enables []string
+	for _, c := range strings.Fields(string(available)) {
+		for _, want := range subgroupControllers {
+			if c == want {
+				enables = append(enables, "+"+c)
+			}
+		}
+	}
+	if len(enables) == 0 {
+		return nil
+	}
+	return writeCgroupFile(dir, "cgroup.subtree_control", strings.Join(enables, " "))
+}
+
+// createExecSubgroup creates the exec's leaf cgroup with the default limits
+// and returns the name relative to the container's cgroup, which is used by
+// `runc exec --cgroup`.
+func (e *execProcess) createExecSubgroup() (string, error) {
+	cfg := e.parent.execSubgroups
+	if cfg == nil {
+		return "", nil
+	}
+
+	dir, err := e.subgroupDir()
+	if err != nil {
+		return "", err
+	}
+
+	if err := os.Mkdir(dir, 0755); err != nil && !os.IsExist(err) {
+		return "", err
+	}
+
+	for file, value := range map[string]string{
+		"cpu.max":    cfg.cpuMax,
+		"memory.max": cfg.memoryMax,
+	} {
+		if value == "" {
+			continue
+		}
+		if err := writeCgroupFile(dir, file, value); err != nil {
+			os.Remove(dir)
+			return "", err
+		}
+	}
+	return filepath.Base(dir), nil
+}
+
+// removeExecSubgroup removes the exec's leaf cgroup. The cgroup with the
+// processes forked by exec is left and it will be removed with the
+// container's cgroup.
+func (e *execProcess) removeExecSubgroup(ctx context.Context) {
+	if e.parent.execSubgroups == nil {
+		return
+	}
+
+	dir, err := e.subgroupDir()
+	if err != nil {
+		return
+	}
+	if err := os.Remove(dir); err != nil && !os.IsNotExist(err) {
+		log.G(ctx).WithError(err).Warnf("failed to remove cgroup of exec %s", e.id)
+	}
+}
+
+func (e *execProcess) subgroupDir() (string, error) {
+	cgroupPath := e.shim().loadedIdentity().CgroupPath
+	if cgroupPath == "" {
+		return "", fmt.Errorf("cgroup of task %s is unavailable: %w", e.parent.ID(), errdefs.ErrNotFound)
+	}
+	return filepath.Join(cgroupv2Root, cgroupPath, execSubgroupPrefix+e.id), nil
+}
+
+// ExecStats returns the cgroup v2 metrics of the exec process's leaf cgroup,
+// which requires exec sub-grouping enabled by annotation.
+func (manager *TaskManager) ExecStats(ctx context.Context, id string, execID string) (*v2.Metrics, error) {
+	t, err := manager.tasks.Get(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+
+	s, ok := t.(*shim)
+	if !ok {
+		return nil, errdefs.ErrNotImplemented
+	}
+
+	if s.init.execSubgroups == nil {
+		return nil, fmt.Errorf("exec sub-grouping of task %s is disabled: %w", id, errdefs.ErrFailedPrecondition)
+	}
+
+	p, err := s.Process(ctx, execID)
+	if err != nil {
+		return nil, err
+	}
+
+	e, ok := p.(*execProcess)
+	if !ok {
+		return nil, fmt.Errorf("%s is not exec process: %w", execID, errdefs.ErrInvalidArgument)
+	}
+
+	cgroupPath := s.loadedIdentity().CgroupPath
+	if cgroupPath == "" {
+		return nil, fmt.Errorf("cgroup of task %s is unavailable: %w", id, errdefs.ErrNotFound)
+	}
+
+	cg, err := cgroupsv2.LoadManager(cgroupv2Root, filepath.Join(cgroupPath, execSubgroupPrefix+e.id))
+	if err != nil {
+		return nil, err
+	}
+	return cg.Stat()
+}
+
+func writeCgroupFile(dir string, file string, value string) error {
+	pathname := filepath.Join(dir, file)
+	if err := os.WriteFile(pathname, []byte(value), 0); err != nil {
+		return fmt.Errorf("failed to write %s into %s: %w", value, pathname, err)
+	}
+	return nil
+}
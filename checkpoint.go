@@ -0,0 +1,241 @@
+//go:build linux
+// +build linux
+
+package embedshim
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+
+	"github.com/containerd/containerd/errdefs"
+	"github.com/containerd/containerd/log"
+	"github.com/containerd/containerd/runtime/v2/runc/options"
+	"github.com/containerd/go-runc"
+	"github.com/containerd/typeurl"
+	ptypes "github.com/gogo/protobuf/types"
+	"golang.org/x/sys/unix"
+)
+
+var (
+	// checkpointIODrainTimeout is the max duration to wait for the reader
+	// to drain the stdout and stderr fifos before dump.
+	checkpointIODrainTimeout = 5 * time.Second
+
+	checkpointIODrainInterval = 50 * time.Millisecond
+
+	// checkpointStdioImageFile records the init process's stdio in the
+	// checkpoint image so that the restore can verify the new stdio.
+	checkpointStdioImageFile = "embedshim-stdio.json"
+)
+
+// checkpointStdio is the init process's stdio when it was dumped.
+type checkpointStdio struct {
+	Terminal bool `json:"terminal"`
+	Stdin    bool `json:"stdin"`
+	// Descriptors are the targets of fd 0, 1 and 2, like "pipe:[123]" or
+	// the fifo's path.
+	Descriptors []string `json:"descriptors"`
+}
+
+// checkpointConfigFromOptions converts the containerd's checkpoint options.
+func checkpointConfigFromOptions(path string, any *ptypes.Any) (*CheckpointConfig, error) {
+	opts := &options.CheckpointOptions{}
+	if any != nil && any.GetTypeUrl() != "" {
+		v, err := typeurl.UnmarshalAny(any)
+		if err != nil {
+			return nil, err
+		}
+
+		vopts, ok := v.(*options.CheckpointOptions)
+		if !ok {
+			return nil, fmt.Errorf("invalid checkpoint options %T: %w", v, errdefs.ErrInvalidArgument)
+		}
+		opts = vopts
+	}
+
+	if opts.ImagePath != "" {
+		path = opts.ImagePath
+	}
+	if path == "" {
+		return nil, fmt.Errorf("checkpoint image path is required: %w", errdefs.ErrInvalidArgument)
+	}
+	return &CheckpointConfig{
+		Path:                     path,
+		WorkDir:                  opts.WorkPath,
+		Exit:                     opts.Exit,
+		AllowOpenTCP:             opts.OpenTcp,
+		AllowExternalUnixSockets: opts.ExternalUnixSockets,
+		AllowTerminal:            opts.Terminal,
+		FileLocks:                opts.FileLocks,
+		EmptyNamespaces:          opts.EmptyNamespaces,
+		CgroupsMode:              opts.CgroupsMode,
+	}, nil
+}
+
+// checkpoint dumps the init process by CRIU.
+//
+// The stdout and stderr are the fifos shared with the reader, and CRIU dumps
+// the unread data in them. The fifos are drained before dump so that the
+// restored container doesn't replay the output which the reader has seen.
+// If the container exits after dump, the stdin relay is closed right away
+// because nothing reads it anymore.
+func (p *initProcess) checkpoint(ctx context.Context, r *CheckpointConfig) (retErr error) {
+	if err := p.drainStdio(ctx); err != nil {
+		log.G(ctx).WithError(err).Warnf("failed to drain stdio of task %s before checkpoint", p.ID())
+	}
+
+	record, err := p.dumpedStdio()
+	if err != nil {
+		return fmt.Errorf("failed to inspect stdio of task %s: %w", p.ID(), err)
+	}
+
+	network, err := p.dumpedNetwork(r)
+	if err != nil {
+		return fmt.Errorf("failed to inspect network of task %s: %w", p.ID(), err)
+	}
+
+	var actions []runc.CheckpointAction
+	if !r.Exit {
+		actions = append(actions, runc.LeaveRunning)
+	}
+
+	// NOTE: Keep the CRIU work dir if the caller provides it.
+	work := r.WorkDir
+	if work == "" {
+		work = filepath.Join(p.bundle.Path, "criu-work")
+		defer os.RemoveAll(work)
+	}
+
+	if err := p.runtime.Checkpoint(ctx, p.ID(), &runc.CheckpointOpts{
+		WorkDir:                  work,
+		ImagePath:                r.Path,
+		AllowOpenTCP:             r.AllowOpenTCP,
+		AllowExternalUnixSockets: r.AllowExternalUnixSockets,
+		AllowTerminal:            r.AllowTerminal,
+		FileLocks:                r.FileLocks,
+		EmptyNamespaces:          r.EmptyNamespaces,
+		Cgroups:                  runc.CgroupMode(r.CgroupsMode),
+	}, actions...); err != nil {
+		dumpLog := filepath.Join(p.bundle.Path, "criu-dump.log")
+		if data, rerr := os.ReadFile(filepath.Join(work, "dump.log")); rerr == nil {
+			if werr := os.WriteFile(dumpLog, data, 0600); werr != nil {
+				log.G(ctx).WithError(werr).Warn("failed to copy dump.log to criu-dump.log")
+			}
+		}
+		return fmt.Errorf("%s, see %s", p.runtimeError(err, "OCI runtime checkpoint failed"), dumpLog)
+	}
+
+	data, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+	if err := os.WriteFile(filepath.Join(r.Path, checkpointStdioImageFile), data, 0600); err != nil {
+		return fmt.Errorf("failed to record stdio in checkpoint image: %w", err)
+	}
+
+	data, err = json.Marshal(network)
+	if err != nil {
+		return err
+	}
+	if err := os.WriteFile(filepath.Join(r.Path, checkpointNetworkImageFile), data, 0600); err != nil {
+		return fmt.Errorf("failed to record network in checkpoint image: %w", err)
+	}
+
+	if r.Exit && p.stdin != nil {
+		if err := p.stdin.Close(); err != nil {
+			log.G(ctx).WithError(err).Warnf("failed to close stdin of checkpointed task %s", p.ID())
+		}
+	}
+	return nil
+}
+
+// drainStdio waits for the reader to consume the stdout and stderr fifos.
+// It only applies to the fifos held by embedshim. The file or rate-limited
+// stdio is copied by embedshim and it has nothing buffered in kernel.
+func (p *initProcess) drainStdio(ctx context.Context) error {
+	if p.io == nil {
+		return nil
+	}
+
+	pio, ok := p.io.IO().(*pipeIO)
+	if !ok {
+		return nil
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, checkpointIODrainTimeout)
+	defer cancel()
+
+	for {
+		unread := 0
+		for _, f := range []*os.File{pio.out, pio.err} {
+			if f == nil {
+				continue
+			}
+
+			n, err := unix.IoctlGetInt(int(f.Fd()), unix.TIOCINQ)
+			if err != nil {
+				return err
+			}
+			unread += n
+		}
+		if unread == 0 {
+			return nil
+		}
+
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("%d bytes unread: %w", unread, ctx.Err())
+		case <-time.After(checkpointIODrainInterval):
+		}
+	}
+}
+
+// dumpedStdio returns the init process's stdio which will be dumped.
+func (p *initProcess) dumpedStdio() (*checkpointStdio, error) {
+	record := &checkpointStdio{
+		Terminal: p.stdio.Terminal,
+		Stdin:    p.stdio.Stdin != "",
+	}
+
+	for fd := 0; fd < 3; fd++ {
+		target, err := os.Readlink(filepath.Join("/proc", strconv.Itoa(p.pid), "fd", strconv.Itoa(fd)))
+		if err != nil {
+			return nil, err
+		}
+		record.Descriptors = append(record.Descriptors, target)
+	}
+	return record, nil
+}
+
+// verifyRestoreStdio makes sure that the new stdio is able to replace the
+// dumped one. runc hands the new stdin pipe and fifos to CRIU as the
+// inherited fds, which requires the same kind of stdio. The image without
+// record is dumped by others and it is skipped.
+func (p *initProcess) verifyRestoreStdio(imagePath string) error {
+	data, err := os.ReadFile(filepath.Join(imagePath, checkpointStdioImageFile))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+
+	var record checkpointStdio
+	if err := json.Unmarshal(data, &record); err != nil {
+		return fmt.Errorf("invalid stdio record in checkpoint image: %w", err)
+	}
+
+	if record.Terminal != p.stdio.Terminal {
+		return fmt.Errorf("checkpoint was dumped with terminal=%v but restored with terminal=%v: %w",
+			record.Terminal, p.stdio.Terminal, errdefs.ErrFailedPrecondition)
+	}
+	if record.Stdin && p.stdio.Stdin == "" {
+		return fmt.Errorf("checkpoint was dumped with stdin but restored without stdin: %w", errdefs.ErrFailedPrecondition)
+	}
+	return nil
+}
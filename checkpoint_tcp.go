@@ -0,0 +1,248 @@
+//go:build linux
+// +build linux
+
+package embedshim
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	goruntime "runtime"
+	"strconv"
+	"strings"
+
+	"github.com/containerd/containerd/log"
+	"golang.org/x/sys/unix"
+)
+
+var (
+	// checkpointNetworkImageFile records whether the established TCP
+	// connections are dumped, so that the restore passes the same
+	// tcp-established option to CRIU.
+	checkpointNetworkImageFile = "embedshim-network.json"
+
+	// conntrackTCPLooseSysctl allows the netns's conntrack to pick up the
+	// restored connections in the middle of the stream.
+	conntrackTCPLooseSysctl = "/proc/sys/net/netfilter/nf_conntrack_tcp_loose"
+)
+
+// tcpStateEstablished is TCP_ESTABLISHED in /proc/net/tcp's st column.
+const tcpStateEstablished = "01"
+
+// checkpointNetwork is the init process's network state when it was
+// dumped.
+type checkpointNetwork struct {
+	TCPEstablished bool `json:"tcp_established"`
+	// LocalAddrs are the local addresses of the established connections.
+	LocalAddrs []string `json:"local_addrs,omitempty"`
+}
+
+// dumpedNetwork returns the network state which will be dumped. The
+// connections are inspected before dump because the process might exit
+// after dump.
+func (p *initProcess) dumpedNetwork(r *CheckpointConfig) (*checkpointNetwork, error) {
+	record := &checkpointNetwork{TCPEstablished: r.AllowOpenTCP}
+	if !r.AllowOpenTCP {
+		return record, nil
+	}
+
+	seen := make(map[string]struct{})
+	for _, name := range []string{"tcp", "tcp6"} {
+		f, err := os.Open(filepath.Join("/proc", strconv.Itoa(p.pid), "net", name))
+		if err != nil {
+			if os.IsNotExist(err) {
+				continue
+			}
+			return nil, err
+		}
+
+		addrs, err := parseEstablishedTCPLocalAddrs(f)
+		f.Close()
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse net/%s: %w", name, err)
+		}
+
+		for _, addr := range addrs {
+			if _, ok := seen[addr]; !ok {
+				seen[addr] = struct{}{}
+				record.LocalAddrs = append(record.LocalAddrs, addr)
+			}
+		}
+	}
+	return record, nil
+}
+
+// parseEstablishedTCPLocalAddrs returns the local IP of the established
+// connections in /proc/net/tcp or /proc/net/tcp6. The loopback connections
+// are skipped because they are restored within the container.
+func parseEstablishedTCPLocalAddrs(r io.Reader) ([]string, error) {
+	var addrs []string
+
+	scanner := bufio.NewScanner(r)
+	for n := 1; scanner.Scan(); n++ {
+		// The first line is header.
+		if n == 1 {
+			continue
+		}
+
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 4 {
+			return nil, fmt.Errorf("invalid line %d: %q", n, scanner.Text())
+		}
+		if fields[3] != tcpStateEstablished {
+			continue
+		}
+
+		ip, err := parseProcNetIP(strings.SplitN(fields[1], ":", 2)[0])
+		if err != nil {
+			return nil, fmt.Errorf("invalid line %d: %w", n, err)
+		}
+		if ip.IsLoopback() {
+			continue
+		}
+		addrs = append(addrs, ip.String())
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return addrs, nil
+}
+
+// parseProcNetIP decodes the address in /proc/net/tcp, which is the hex of
+// 32-bit words in host byte order.
+func parseProcNetIP(s string) (net.IP, error) {
+	b, err := hex.DecodeString(s)
+	if err != nil || (len(b) != net.IPv4len && len(b) != net.IPv6len) {
+		return nil, fmt.Errorf("invalid address %q", s)
+	}
+
+	ip := make(net.IP, len(b))
+	for i := 0; i < len(b); i += 4 {
+		binary.BigEndian.PutUint32(ip[i:], binary.LittleEndian.Uint32(b[i:]))
+	}
+	return ip, nil
+}
+
+// readCheckpointNetwork returns nil if the image is dumped by others.
+func readCheckpointNetwork(imagePath string) (*checkpointNetwork, error) {
+	data, err := os.ReadFile(filepath.Join(imagePath, checkpointNetworkImageFile))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	var record checkpointNetwork
+	if err := json.Unmarshal(data, &record); err != nil {
+		return nil, fmt.Errorf("invalid network record in checkpoint image: %w", err)
+	}
+	return &record, nil
+}
+
+// repairRestoredTCP is the best-effort fixup after the established TCP
+// connections are restored by CRIU. The failure is logged only because the
+// container itself is restored.
+//
+// CRIU restores the sockets by TCP_REPAIR with the dumped sequence numbers,
+// but the state outside the container's network namespace isn't in the
+// image:
+//
+//   - The conntrack entries are lost. The netns's conntrack is set to pick
+//     up the connections in the middle of the stream, otherwise the packets
+//     are dropped as INVALID by the stateful rules. The host's conntrack,
+//     like the NAT of the port mapping, can't be repaired here.
+//   - The connection survives only if the local address is the same. It is
+//     reported if the address isn't assigned in the restored netns, which
+//     is decided by the CNI.
+//   - The peer resets the connection if it sent anything while the
+//     container was frozen longer than its retransmission timeout.
+func (p *initProcess) repairRestoredTCP(ctx context.Context, record *checkpointNetwork) {
+	nsFD, err := unix.Open(filepath.Join("/proc", strconv.Itoa(p.pid), "ns", "net"), unix.O_RDONLY|unix.O_CLOEXEC, 0)
+	if err != nil {
+		log.G(ctx).WithError(err).Warnf("failed to open netns of restored task %s", p.ID())
+		return
+	}
+	defer unix.Close(nsFD)
+
+	var missing []string
+	err = runInNetNS(nsFD, func() error {
+		if err := enableConntrackTCPLoose(); err != nil {
+			log.G(ctx).WithError(err).Warnf("failed to enable conntrack tcp loose for restored task %s", p.ID())
+		}
+
+		addrs, err := net.InterfaceAddrs()
+		if err != nil {
+			return err
+		}
+		missing = missingLocalAddrs(record.LocalAddrs, addrs)
+		return nil
+	})
+	if err != nil {
+		log.G(ctx).WithError(err).Warnf("failed to repair tcp connections of restored task %s", p.ID())
+		return
+	}
+
+	if len(missing) > 0 {
+		log.G(ctx).Warnf("restored task %s doesn't have addresses %v, the established connections on them will be reset", p.ID(), missing)
+	}
+}
+
+// enableConntrackTCPLoose is no-op if the nf_conntrack isn't loaded.
+func enableConntrackTCPLoose() error {
+	data, err := os.ReadFile(conntrackTCPLooseSysctl)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	if strings.TrimSpace(string(data)) != "0" {
+		return nil
+	}
+	return os.WriteFile(conntrackTCPLooseSysctl, []byte("1"), 0644)
+}
+
+// missingLocalAddrs returns the recorded addresses which aren't assigned.
+func missingLocalAddrs(recorded []string, assigned []net.Addr) []string {
+	have := make(map[string]struct{}, len(assigned))
+	for _, addr := range assigned {
+		if ipnet, ok := addr.(*net.IPNet); ok {
+			have[ipnet.IP.String()] = struct{}{}
+		}
+	}
+
+	var missing []string
+	for _, addr := range recorded {
+		if _, ok := have[addr]; !ok {
+			missing = append(missing, addr)
+		}
+	}
+	return missing
+}
+
+// runInNetNS runs fn in the network namespace nsFD. The /proc/sys/net is
+// resolved by the thread's network namespace.
+//
+// NOTE: The thread is never unlocked, so that it is terminated with the
+// goroutine instead of being reused in the other namespace.
+func runInNetNS(nsFD int, fn func() error) error {
+	errCh := make(chan error, 1)
+	go func() {
+		goruntime.LockOSThread()
+
+		if err := unix.Setns(nsFD, unix.CLONE_NEWNET); err != nil {
+			errCh <- fmt.Errorf("failed to enter network namespace: %w", err)
+			return
+		}
+		errCh <- fn()
+	}()
+	return <-errCh
+}
@@ -0,0 +1,61 @@
+//go:build linux
+// +build linux
+
+package embedshim
+
+import (
+	"net"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseEstablishedTCPLocalAddrs(t *testing.T) {
+	tcp := `  sl  local_address rem_address   st tx_queue rx_queue tr tm->when retrnsmt   uid  timeout inode
+   0: 00000000:1F90 00000000:0000 0A 00000000:00000000 00:00000000 00000000     0        0 1 1 0000000000000000 100 0 0 10 0
+   1: 0100007F:1F90 0100007F:A2C4 01 00000000:00000000 00:00000000 00000000     0        0 2 1 0000000000000000 20 4 30 10 -1
+   2: 0200580A:1F90 0100580A:D2F0 01 00000000:00000000 00:00000000 00000000     0        0 3 1 0000000000000000 20 4 30 10 -1
+`
+	addrs, err := parseEstablishedTCPLocalAddrs(strings.NewReader(tcp))
+	if err != nil {
+		t.Fatalf("failed to parse net/tcp: %v", err)
+	}
+	if expected := []string{"10.88.0.2"}; !reflect.DeepEqual(addrs, expected) {
+		t.Fatalf("expected %v, but got %v", expected, addrs)
+	}
+
+	tcp6 := `  sl  local_address                         remote_address                        st
+   0: 0000000000000000FFFF00000200580A:1F90 0000000000000000FFFF00000100580A:D2F0 01
+   1: B80D01200000000000000000DDCCBBAA:0050 B80D0120000000000000000001000000:D2F0 01
+`
+	addrs, err = parseEstablishedTCPLocalAddrs(strings.NewReader(tcp6))
+	if err != nil {
+		t.Fatalf("failed to parse net/tcp6: %v", err)
+	}
+	if expected := []string{"10.88.0.2", "2001:db8::aabb:ccdd"}; !reflect.DeepEqual(addrs, expected) {
+		t.Fatalf("expected %v, but got %v", expected, addrs)
+	}
+
+	if _, err := parseEstablishedTCPLocalAddrs(strings.NewReader("header\n 0: XYZ:0050 00000000:0000 01\n")); err == nil {
+		t.Fatalf("expected error for invalid address, but got nil")
+	}
+}
+
+func TestMissingLocalAddrs(t *testing.T) {
+	assigned := []net.Addr{
+		&net.IPNet{IP: net.ParseIP("127.0.0.1"), Mask: net.CIDRMask(8, 32)},
+		&net.IPNet{IP: net.ParseIP("10.88.0.2").To4(), Mask: net.CIDRMask(16, 32)},
+	}
+
+	missing := missingLocalAddrs([]string{"10.88.0.2", "10.88.0.3"}, assigned)
+	if expected := []string{"10.88.0.3"}; !reflect.DeepEqual(missing, expected) {
+		t.Fatalf("expected %v, but got %v", expected, missing)
+	}
+}
+
+func TestReadCheckpointNetwork(t *testing.T) {
+	record, err := readCheckpointNetwork(t.TempDir())
+	if err != nil || record != nil {
+		t.Fatalf("expected nil record for image dumped by others, but got %v (err: %v)", record, err)
+	}
+}
@@ -0,0 +1,64 @@
+//go:build linux
+// +build linux
+
+package embedshim
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/containerd/containerd/errdefs"
+	"github.com/containerd/containerd/pkg/stdio"
+)
+
+func TestVerifyRestoreStdio(t *testing.T) {
+	for _, tc := range []struct {
+		name     string
+		record   *checkpointStdio
+		stdio    stdio.Stdio
+		expected error
+	}{
+		{
+			name:  "no record",
+			stdio: stdio.Stdio{Terminal: true},
+		},
+		{
+			name:   "same",
+			record: &checkpointStdio{Stdin: true},
+			stdio:  stdio.Stdio{Stdin: "/run/stdin", Stdout: "/run/stdout"},
+		},
+		{
+			name:     "terminal mismatch",
+			record:   &checkpointStdio{Terminal: true},
+			stdio:    stdio.Stdio{Stdout: "/run/stdout"},
+			expected: errdefs.ErrFailedPrecondition,
+		},
+		{
+			name:     "stdin missing",
+			record:   &checkpointStdio{Stdin: true},
+			stdio:    stdio.Stdio{Stdout: "/run/stdout"},
+			expected: errdefs.ErrFailedPrecondition,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			imagePath := t.TempDir()
+			if tc.record != nil {
+				data, err := json.Marshal(tc.record)
+				if err != nil {
+					t.Fatalf("failed to marshal record: %v", err)
+				}
+				if err := os.WriteFile(filepath.Join(imagePath, checkpointStdioImageFile), data, 0600); err != nil {
+					t.Fatalf("failed to write record: %v", err)
+				}
+			}
+
+			p := &initProcess{stdio: tc.stdio}
+			if err := p.verifyRestoreStdio(imagePath); !errors.Is(err, tc.expected) {
+				t.Fatalf("expected %v, but got %v", tc.expected, err)
+			}
+		})
+	}
+}
@@ -0,0 +1,42 @@
+//go:build linux
+// +build linux
+
+package embedshim
+
+import (
+	"fmt"
+	"path/filepath"
+
+	"github.com/containerd/containerd/errdefs"
+	"github.com/containerd/containerd/runtime"
+)
+
+// externalConsoleSocket is the console socket provided by the caller, which
+// receives the PTY master from the OCI runtime directly. It implements
+// runc.ConsoleSocket.
+type externalConsoleSocket string
+
+func (s externalConsoleSocket) Path() string {
+	return string(s)
+}
+
+// consoleSocketFromAnnotations returns the caller's console socket path. It
+// requires terminal and the stdio must be empty because the PTY master is
+// owned by the caller.
+func consoleSocketFromAnnotations(annotations map[string]string, stdio runtime.IO) (string, error) {
+	v, ok := annotations[annotationConsoleSocket]
+	if !ok || v == "" {
+		return "", nil
+	}
+
+	if !filepath.IsAbs(v) {
+		return "", fmt.Errorf("invalid annotation %s=%q, it must be absolute path: %w", annotationConsoleSocket, v, errdefs.ErrInvalidArgument)
+	}
+	if !stdio.Terminal {
+		return "", fmt.Errorf("console socket %s requires terminal: %w", v, errdefs.ErrInvalidArgument)
+	}
+	if stdio.Stdin != "" || stdio.Stdout != "" || stdio.Stderr != "" {
+		return "", fmt.Errorf("console socket %s can't be used with stdio: %w", v, errdefs.ErrInvalidArgument)
+	}
+	return v, nil
+}
@@ -0,0 +1,320 @@
+//go:build linux
+// +build linux
+
+package embedshim
+
+import (
+	"archive/tar"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/fuweid/embedshim/pkg/pidfd"
+
+	"github.com/containerd/containerd/errdefs"
+	"golang.org/x/sys/unix"
+)
+
+// CopyFromContainer writes the tar archive of srcPath in the container's
+// mount namespace into w, like `kubectl cp` and `docker cp`. The directory
+// is archived recursively. The symlinks are archived as they are and the
+// special files, like device and fifo, are skipped.
+func (manager *TaskManager) CopyFromContainer(ctx context.Context, id string, srcPath string, w io.Writer) error {
+	return manager.inContainerRoot(ctx, id, func(rootFD int) error {
+		return copyFromContainerRoot(rootFD, id, srcPath, w)
+	})
+}
+
+func copyFromContainerRoot(rootFD int, id string, srcPath string, w io.Writer) error {
+	srcPath = path.Clean("/" + srcPath)
+	parent, name, hdrName := path.Dir(srcPath), path.Base(srcPath), path.Base(srcPath)
+	if srcPath == "/" {
+		name, hdrName = ".", "."
+	}
+
+	parentFD, err := openInContainerRoot(rootFD, parent, unix.O_PATH|unix.O_DIRECTORY)
+	if err != nil {
+		return fmt.Errorf("failed to open %s in task %s: %w", parent, id, err)
+	}
+	defer unix.Close(parentFD)
+
+	tw := tar.NewWriter(w)
+	if err := writeTarEntry(tw, parentFD, name, hdrName); err != nil {
+		return fmt.Errorf("failed to archive %s in task %s: %w", srcPath, id, err)
+	}
+	return tw.Close()
+}
+
+// CopyToContainer extracts the tar archive from r into the directory dstDir
+// in the container's mount namespace. The existing files are overwritten.
+//
+// The entries are resolved with dstDir as root so that neither ".." nor the
+// symlink, including the one created by the archive itself, can escape from
+// dstDir.
+func (manager *TaskManager) CopyToContainer(ctx context.Context, id string, dstDir string, r io.Reader) error {
+	return manager.inContainerRoot(ctx, id, func(rootFD int) error {
+		return copyToContainerRoot(rootFD, id, dstDir, r)
+	})
+}
+
+func copyToContainerRoot(rootFD int, id string, dstDir string, r io.Reader) error {
+	dirFD, err := openInContainerRoot(rootFD, dstDir, unix.O_PATH|unix.O_DIRECTORY)
+	if err != nil {
+		return fmt.Errorf("failed to open %s in task %s: %w", dstDir, id, err)
+	}
+	defer unix.Close(dirFD)
+
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if err != nil {
+			if errors.Is(err, io.EOF) {
+				return nil
+			}
+			return fmt.Errorf("failed to read archive: %w", err)
+		}
+
+		name := cleanTarEntryName(hdr.Name)
+		if name == "" {
+			continue
+		}
+
+		if err := extractTarEntry(dirFD, name, hdr, tr); err != nil {
+			return fmt.Errorf("failed to extract %s into task %s: %w", hdr.Name, id, err)
+		}
+	}
+}
+
+// inContainerRoot runs fn in the container's mount namespace with the
+// container's root directory, which is the root of the namespace after
+// setns. The paths are still resolved by openat2(RESOLVE_IN_ROOT) on it so
+// that the symlinks can't escape from the directory being copied.
+func (manager *TaskManager) inContainerRoot(ctx context.Context, id string, fn func(rootFD int) error) error {
+	nsFD, err := manager.openInitProcEntry(ctx, id, "ns/mnt", unix.O_RDONLY)
+	if err != nil {
+		return err
+	}
+	defer unix.Close(nsFD)
+
+	return runInMountNS(nsFD, func() error {
+		rootFD, err := unix.Open("/", unix.O_PATH|unix.O_DIRECTORY|unix.O_CLOEXEC, 0)
+		if err != nil {
+			return fmt.Errorf("failed to open root of task %s: %w", id, err)
+		}
+		defer unix.Close(rootFD)
+
+		return fn(rootFD)
+	})
+}
+
+// openContainerRoot opens the container's root directory in the container's
+// mount namespace. The fd can be used outside the namespace.
+func (manager *TaskManager) openContainerRoot(ctx context.Context, id string) (int, error) {
+	rootFD := -1
+	err := manager.inContainerRoot(ctx, id, func(fd int) error {
+		dup, err := unix.FcntlInt(uintptr(fd), unix.F_DUPFD_CLOEXEC, 0)
+		if err != nil {
+			return err
+		}
+		rootFD = dup
+		return nil
+	})
+	return rootFD, err
+}
+
+// openInitProcEntry opens the init process's /proc/$pid/$entry. The pidfd
+// is used to make sure that the pid isn't reused when the entry is opened.
+func (manager *TaskManager) openInitProcEntry(ctx context.Context, id string, entry string, flags int) (int, error) {
+	t, err := manager.tasks.Get(ctx, id)
+	if err != nil {
+		return -1, err
+	}
+
+	s, ok := t.(*shim)
+	if !ok {
+		return -1, errdefs.ErrNotImplemented
+	}
+
+	pid := s.PID()
+	if pid == 0 {
+		return -1, fmt.Errorf("task %s has no running init process: %w", id, errdefs.ErrFailedPrecondition)
+	}
+
+	fd, err := manager.monitor.dupInitPidFD(s.init)
+	if err != nil {
+		return -1, err
+	}
+	defer unix.Close(fd)
+
+	entryFD, err := unix.Open(fmt.Sprintf("/proc/%d/%s", pid, entry), flags|unix.O_CLOEXEC, 0)
+	if err != nil {
+		return -1, fmt.Errorf("failed to open %s of task %s: %w", entry, id, err)
+	}
+
+	if err := pidfd.FD(fd).SendSignal(0, 0); err != nil {
+		unix.Close(entryFD)
+		return -1, fmt.Errorf("init process of task %s has exited: %w", id, errdefs.ErrFailedPrecondition)
+	}
+	return entryFD, nil
+}
+
+// openInContainerRoot opens the path with rootFD as root, which never
+// resolves out of rootFD.
+func openInContainerRoot(rootFD int, p string, flags int) (int, error) {
+	return unix.Openat2(rootFD, p, &unix.OpenHow{
+		Flags:   uint64(flags | unix.O_CLOEXEC),
+		Resolve: unix.RESOLVE_IN_ROOT | unix.RESOLVE_NO_MAGICLINKS,
+	})
+}
+
+// cleanTarEntryName returns the entry's path relative to the destination
+// directory. The ".." components are dropped by path.Clean with leading
+// slash. The empty string means the destination directory itself.
+func cleanTarEntryName(name string) string {
+	return strings.TrimPrefix(path.Clean("/"+name), "/")
+}
+
+// writeTarEntry archives the entry name in the directory dirFD as hdrName.
+func writeTarEntry(tw *tar.Writer, dirFD int, name, hdrName string) error {
+	var st unix.Stat_t
+	if err := unix.Fstatat(dirFD, name, &st, unix.AT_SYMLINK_NOFOLLOW); err != nil {
+		return err
+	}
+
+	switch st.Mode & unix.S_IFMT {
+	case unix.S_IFLNK:
+		buf := make([]byte, unix.PathMax)
+		n, err := unix.Readlinkat(dirFD, name, buf)
+		if err != nil {
+			return err
+		}
+
+		hdr := tarHeaderFromStat(hdrName, &st, tar.TypeSymlink)
+		hdr.Linkname = string(buf[:n])
+		return tw.WriteHeader(hdr)
+
+	case unix.S_IFREG:
+		fd, err := unix.Openat(dirFD, name, unix.O_RDONLY|unix.O_NOFOLLOW|unix.O_CLOEXEC, 0)
+		if err != nil {
+			return err
+		}
+		f := os.NewFile(uintptr(fd), hdrName)
+		defer f.Close()
+
+		hdr := tarHeaderFromStat(hdrName, &st, tar.TypeReg)
+		hdr.Size = st.Size
+		if err := tw.WriteHeader(hdr); err != nil {
+			return err
+		}
+		_, err = io.CopyN(tw, f, st.Size)
+		return err
+
+	case unix.S_IFDIR:
+		fd, err := unix.Openat(dirFD, name, unix.O_RDONLY|unix.O_DIRECTORY|unix.O_NOFOLLOW|unix.O_CLOEXEC, 0)
+		if err != nil {
+			return err
+		}
+		f := os.NewFile(uintptr(fd), hdrName)
+		defer f.Close()
+
+		if err := tw.WriteHeader(tarHeaderFromStat(hdrName+"/", &st, tar.TypeDir)); err != nil {
+			return err
+		}
+
+		names, err := f.Readdirnames(-1)
+		if err != nil {
+			return err
+		}
+		sort.Strings(names)
+
+		for _, n := range names {
+			if err := writeTarEntry(tw, fd, n, path.Join(hdrName, n)); err != nil {
+				return err
+			}
+		}
+		return nil
+
+	default:
+		return nil
+	}
+}
+
+func tarHeaderFromStat(name string, st *unix.Stat_t, typ byte) *tar.Header {
+	return &tar.Header{
+		Typeflag: typ,
+		Name:     name,
+		Mode:     int64(st.Mode & 07777),
+		Uid:      int(st.Uid),
+		Gid:      int(st.Gid),
+		ModTime:  time.Unix(int64(st.Mtim.Sec), int64(st.Mtim.Nsec)),
+		Format:   tar.FormatPAX,
+	}
+}
+
+// extractTarEntry creates the entry name under dirFD. The parent directory
+// is resolved with dirFD as root and the last component is never followed.
+func extractTarEntry(dirFD int, name string, hdr *tar.Header, r io.Reader) error {
+	parent, base := path.Split(name)
+	if parent == "" {
+		parent = "."
+	}
+
+	parentFD, err := openInContainerRoot(dirFD, parent, unix.O_PATH|unix.O_DIRECTORY)
+	if err != nil {
+		return err
+	}
+	defer unix.Close(parentFD)
+
+	mode := uint32(hdr.Mode & 07777)
+	switch hdr.Typeflag {
+	case tar.TypeDir:
+		if err := unix.Mkdirat(parentFD, base, 0700); err != nil && !errors.Is(err, unix.EEXIST) {
+			return err
+		}
+
+		fd, err := unix.Openat(parentFD, base, unix.O_RDONLY|unix.O_DIRECTORY|unix.O_NOFOLLOW|unix.O_CLOEXEC, 0)
+		if err != nil {
+			return err
+		}
+		defer unix.Close(fd)
+		return chownAndChmod(fd, hdr, mode)
+
+	case tar.TypeReg, tar.TypeRegA:
+		fd, err := unix.Openat(parentFD, base, unix.O_WRONLY|unix.O_CREAT|unix.O_TRUNC|unix.O_NOFOLLOW|unix.O_CLOEXEC, 0600)
+		if err != nil {
+			return err
+		}
+		f := os.NewFile(uintptr(fd), name)
+		defer f.Close()
+
+		if _, err := io.Copy(f, r); err != nil {
+			return err
+		}
+		return chownAndChmod(fd, hdr, mode)
+
+	case tar.TypeSymlink:
+		if err := unix.Unlinkat(parentFD, base, 0); err != nil && !errors.Is(err, unix.ENOENT) {
+			return err
+		}
+		if err := unix.Symlinkat(hdr.Linkname, parentFD, base); err != nil {
+			return err
+		}
+		return unix.Fchownat(parentFD, base, hdr.Uid, hdr.Gid, unix.AT_SYMLINK_NOFOLLOW)
+
+	default:
+		return fmt.Errorf("unsupported tar entry type %q: %w", hdr.Typeflag, errdefs.ErrNotImplemented)
+	}
+}
+
+func chownAndChmod(fd int, hdr *tar.Header, mode uint32) error {
+	if err := unix.Fchown(fd, hdr.Uid, hdr.Gid); err != nil {
+		return err
+	}
+	return unix.Fchmod(fd, mode)
+}
@@ -0,0 +1,26 @@
+//go:build linux
+// +build linux
+
+package embedshim
+
+import "testing"
+
+func TestCleanTarEntryName(t *testing.T) {
+	for name, expected := range map[string]string{
+		"a/b/c":         "a/b/c",
+		"./a/b/":        "a/b",
+		"/etc/passwd":   "etc/passwd",
+		"../../etc":     "etc",
+		"a/../../b":     "b",
+		"a/./b/../c":    "a/c",
+		".":             "",
+		"..":            "",
+		"/":             "",
+		"a//b":          "a/b",
+		"../a/../../..": "",
+	} {
+		if got := cleanTarEntryName(name); got != expected {
+			t.Fatalf("expected %q for %q, but got %q", expected, name, got)
+		}
+	}
+}
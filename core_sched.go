@@ -0,0 +1,65 @@
+//go:build linux
+// +build linux
+
+package embedshim
+
+import (
+	"errors"
+	"fmt"
+	goruntime "runtime"
+
+	"github.com/containerd/containerd/errdefs"
+	"golang.org/x/sys/unix"
+)
+
+// createCoreSchedCookie assigns the new core scheduling cookie to the
+// process's thread group, so that its threads only share the SMT siblings
+// with the tasks holding the same cookie. The children forked later
+// inherit the cookie.
+//
+// NOTE: It is applied on the runc-init before starting so that the
+// workload never runs without the cookie.
+func createCoreSchedCookie(pid int) error {
+	err := unix.Prctl(unix.PR_SCHED_CORE, unix.PR_SCHED_CORE_CREATE, uintptr(pid), unix.PR_SCHED_CORE_SCOPE_THREAD_GROUP, 0)
+	return coreSchedError(err)
+}
+
+// shareCoreSchedCookie copies the cookie of the from process to the to
+// process's thread group, like the exec process joining the container.
+//
+// The cookie can only be pulled into the current thread and pushed from it,
+// so that it is done in the dedicated thread which is never unlocked. The
+// thread is terminated with the goroutine instead of running the others
+// with the container's cookie.
+func shareCoreSchedCookie(from, to int) error {
+	errCh := make(chan error, 1)
+	go func() {
+		goruntime.LockOSThread()
+
+		if err := unix.Prctl(unix.PR_SCHED_CORE, unix.PR_SCHED_CORE_SHARE_FROM, uintptr(from), unix.PR_SCHED_CORE_SCOPE_THREAD, 0); err != nil {
+			errCh <- fmt.Errorf("failed to get cookie from %d: %w", from, coreSchedError(err))
+			return
+		}
+		if err := unix.Prctl(unix.PR_SCHED_CORE, unix.PR_SCHED_CORE_SHARE_TO, uintptr(to), unix.PR_SCHED_CORE_SCOPE_THREAD_GROUP, 0); err != nil {
+			errCh <- fmt.Errorf("failed to share cookie to %d: %w", to, coreSchedError(err))
+			return
+		}
+		errCh <- nil
+	}()
+	return <-errCh
+}
+
+// coreSchedError maps the errors of the kernel without CONFIG_SCHED_CORE or
+// SMT.
+func coreSchedError(err error) error {
+	switch {
+	case err == nil:
+		return nil
+	case errors.Is(err, unix.EINVAL):
+		return fmt.Errorf("core scheduling requires kernel 5.14 with CONFIG_SCHED_CORE: %v: %w", err, errdefs.ErrNotImplemented)
+	case errors.Is(err, unix.ENODEV):
+		return fmt.Errorf("core scheduling requires SMT: %v: %w", err, errdefs.ErrNotImplemented)
+	default:
+		return err
+	}
+}
@@ -0,0 +1,28 @@
+//go:build linux
+// +build linux
+
+package embedshim
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/containerd/containerd/errdefs"
+	"golang.org/x/sys/unix"
+)
+
+func TestCoreSchedError(t *testing.T) {
+	for _, tc := range []struct {
+		err      error
+		expected error
+	}{
+		{err: nil, expected: nil},
+		{err: unix.EINVAL, expected: errdefs.ErrNotImplemented},
+		{err: unix.ENODEV, expected: errdefs.ErrNotImplemented},
+		{err: unix.EPERM, expected: unix.EPERM},
+	} {
+		if got := coreSchedError(tc.err); !errors.Is(got, tc.expected) {
+			t.Fatalf("expected %v for %v, but got %v", tc.expected, tc.err, got)
+		}
+	}
+}
@@ -0,0 +1,258 @@
+//go:build linux
+// +build linux
+
+package embedshim
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+
+	pkgbundle "github.com/fuweid/embedshim/pkg/bundle"
+
+	eventstypes "github.com/containerd/containerd/api/events"
+	"github.com/containerd/containerd/log"
+	"github.com/containerd/typeurl"
+	"golang.org/x/sys/unix"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+const (
+	// TaskCoreDumpEventTopic is the topic of TaskCoreDump event.
+	TaskCoreDumpEventTopic = "/tasks/coredump"
+
+	// TaskExitCorePathField is the field number of the core file's path
+	// in TaskExit event. containerd's TaskExit has no such field, so it
+	// is carried as the unknown field, which is kept by the proto
+	// decoders and can be read by TaskExitCorePath.
+	TaskExitCorePathField protowire.Number = 100
+
+	// coreDumpDirName is the default dir of the collected core files in
+	// the plugin's root dir, which is kept after the task is deleted.
+	coreDumpDirName = "cores"
+)
+
+func init() {
+	typeurl.Register(&TaskCoreDump{}, "io.embedshim.events.v1", "TaskCoreDump")
+}
+
+// CoreDumpConfig is used to collect the core dump of the crashed processes.
+//
+// The kernel's core_pattern must write the core file into SpoolDir named by
+// the global pid, like "/var/lib/embedshim/cores/core.%P" or the pipe helper
+// "|/bin/sh -c 'cat > /var/lib/embedshim/cores/core.%P'".
+type CoreDumpConfig struct {
+	// SpoolDir is where the kernel writes the core files. The collection
+	// is disabled if it is empty.
+	SpoolDir string `toml:"spool_dir"`
+	// Dir is where the collected core files are stored. The "cores" dir
+	// in the plugin's root dir is used if it is empty.
+	Dir string `toml:"dir"`
+	// MaxBytes is the size cap of one core file. The larger one is
+	// dropped. Zero means no limit.
+	MaxBytes int64 `toml:"max_bytes"`
+}
+
+// TaskCoreDump is published when the core dump of the task's process has
+// been collected.
+type TaskCoreDump struct {
+	ContainerID string    `json:"container_id"`
+	ID          string    `json:"id"`
+	Pid         uint32    `json:"pid"`
+	Path        string    `json:"path"`
+	Size        int64     `json:"size"`
+	CollectedAt time.Time `json:"collected_at"`
+}
+
+// Field implements events.Event.
+func (e *TaskCoreDump) Field(fieldpath []string) (string, bool) {
+	if len(fieldpath) == 0 {
+		return "", false
+	}
+
+	switch fieldpath[0] {
+	case "container_id":
+		return e.ContainerID, len(e.ContainerID) > 0
+	case "id":
+		return e.ID, len(e.ID) > 0
+	case "path":
+		return e.Path, len(e.Path) > 0
+	}
+	return "", false
+}
+
+// collectCoreDump moves the process's core file out of the spool dir and
+// publishes TaskCoreDump event if the wait status indicates a core dump. It
+// returns the path of the collected core file, which is attached to the
+// TaskExit event, or empty if it isn't collected.
+//
+// NOTE: It runs in background because the pipe helper might be still
+// flushing the core file when the process exits. The file is at the path
+// once TaskCoreDump event is published.
+func (manager *TaskManager) collectCoreDump(bundle *pkgbundle.Bundle, id string, pid int, status int) string {
+	if manager.config == nil || manager.config.CoreDump.SpoolDir == "" {
+		return ""
+	}
+
+	if !unix.WaitStatus(status).CoreDump() {
+		return ""
+	}
+
+	path := manager.coreDumpPath(bundle, pid)
+	go func() {
+		size, err := manager.moveCoreDump(path, pid)
+		if err != nil {
+			log.G(context.Background()).WithError(err).
+				WithField("id", bundle.ID).WithField("pid", pid).
+				Warn("failed to collect core dump")
+			return
+		}
+
+		manager.publishEvent(bundle.Namespace, TaskCoreDumpEventTopic, &TaskCoreDump{
+			ContainerID: bundle.ID,
+			ID:          id,
+			Pid:         uint32(pid),
+			Path:        path,
+			Size:        size,
+			CollectedAt: time.Now(),
+		})
+	}()
+	return path
+}
+
+// coreDumpPath returns where the process's core file is stored.
+func (manager *TaskManager) coreDumpPath(bundle *pkgbundle.Bundle, pid int) string {
+	dir := manager.config.CoreDump.Dir
+	if dir == "" {
+		dir = filepath.Join(manager.rootDir, coreDumpDirName)
+	}
+	return filepath.Join(dir, bundle.Namespace, bundle.ID, "core."+strconv.Itoa(pid))
+}
+
+func (manager *TaskManager) moveCoreDump(dst string, pid int) (int64, error) {
+	cfg := manager.config.CoreDump
+
+	src := filepath.Join(cfg.SpoolDir, "core."+strconv.Itoa(pid))
+	size, err := waitCoreDumpFlushed(src)
+	if err != nil {
+		return 0, err
+	}
+
+	if cfg.MaxBytes > 0 && size > cfg.MaxBytes {
+		os.Remove(src)
+		return 0, fmt.Errorf("core file size %d exceeds max bytes %d", size, cfg.MaxBytes)
+	}
+
+	if err := os.MkdirAll(filepath.Dir(dst), 0700); err != nil {
+		return 0, err
+	}
+
+	if err := os.Rename(src, dst); err != nil {
+		// The spool dir might be on the different filesystem.
+		if err := copyCoreDump(src, dst); err != nil {
+			return 0, err
+		}
+		os.Remove(src)
+	}
+	return size, nil
+}
+
+// newTaskExit returns TaskExit event with the core file's path if it isn't
+// empty.
+func newTaskExit(containerID, id string, pid uint32, exitStatus uint32, exitedAt time.Time, corePath string) *eventstypes.TaskExit {
+	ev := &eventstypes.TaskExit{
+		ContainerID: containerID,
+		ID:          id,
+		Pid:         pid,
+		ExitStatus:  exitStatus,
+		ExitedAt:    exitedAt,
+	}
+	if corePath != "" {
+		b := protowire.AppendTag(nil, TaskExitCorePathField, protowire.BytesType)
+		ev.XXX_unrecognized = protowire.AppendString(b, corePath)
+	}
+	return ev
+}
+
+// TaskExitCorePath returns the path of the collected core file attached to
+// the TaskExit event, or empty if there is none.
+func TaskExitCorePath(ev *eventstypes.TaskExit) string {
+	b := ev.XXX_unrecognized
+	for len(b) > 0 {
+		num, typ, n := protowire.ConsumeTag(b)
+		if n < 0 {
+			return ""
+		}
+		b = b[n:]
+
+		if num == TaskExitCorePathField && typ == protowire.BytesType {
+			v, n := protowire.ConsumeString(b)
+			if n < 0 {
+				return ""
+			}
+			return v
+		}
+
+		n = protowire.ConsumeFieldValue(num, typ, b)
+		if n < 0 {
+			return ""
+		}
+		b = b[n:]
+	}
+	return ""
+}
+
+// waitCoreDumpFlushed waits until the size of core file keeps unchanged.
+func waitCoreDumpFlushed(pathname string) (int64, error) {
+	const (
+		interval = 200 * time.Millisecond
+		retries  = 50
+	)
+
+	last := int64(-1)
+	for i := 0; i < retries; i++ {
+		fi, err := os.Stat(pathname)
+		if err != nil && !os.IsNotExist(err) {
+			return 0, err
+		}
+
+		if err == nil {
+			if fi.Size() == last {
+				return last, nil
+			}
+			last = fi.Size()
+		}
+		time.Sleep(interval)
+	}
+
+	if last < 0 {
+		return 0, fmt.Errorf("core file %s not found", pathname)
+	}
+	return 0, fmt.Errorf("core file %s is still being written", pathname)
+}
+
+func copyCoreDump(src, dst string) (retErr error) {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := os.OpenFile(dst, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		out.Close()
+		if retErr != nil {
+			os.Remove(dst)
+		}
+	}()
+
+	_, err = io.Copy(out, in)
+	return err
+}
@@ -0,0 +1,52 @@
+//go:build linux
+// +build linux
+
+package embedshim
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+
+	pkgbundle "github.com/fuweid/embedshim/pkg/bundle"
+
+	eventstypes "github.com/containerd/containerd/api/events"
+)
+
+func TestTaskExitCorePath(t *testing.T) {
+	corePath := "/var/lib/embedshim/cores/default/c1/core.1234"
+
+	data, err := newTaskExit("c1", "c1", 1234, 139, time.Now(), corePath).Marshal()
+	if err != nil {
+		t.Fatalf("failed to marshal TaskExit: %v", err)
+	}
+
+	var ev eventstypes.TaskExit
+	if err := ev.Unmarshal(data); err != nil {
+		t.Fatalf("failed to unmarshal TaskExit: %v", err)
+	}
+	if ev.ContainerID != "c1" || ev.Pid != 1234 || ev.ExitStatus != 139 {
+		t.Fatalf("unexpected TaskExit %+v", ev)
+	}
+	if got := TaskExitCorePath(&ev); got != corePath {
+		t.Fatalf("expected %v, but got %v", corePath, got)
+	}
+
+	if got := TaskExitCorePath(newTaskExit("c1", "c1", 1234, 0, time.Now(), "")); got != "" {
+		t.Fatalf("expected no core path, but got %v", got)
+	}
+}
+
+func TestCoreDumpPath(t *testing.T) {
+	bundle := &pkgbundle.Bundle{ID: "c1", Namespace: "default", Path: "/run/embedshim/default/c1"}
+
+	manager := &TaskManager{rootDir: "/var/lib/embedshim", config: &Config{}}
+	if got, expected := manager.coreDumpPath(bundle, 1234), "/var/lib/embedshim/cores/default/c1/core.1234"; got != expected {
+		t.Fatalf("expected %v, but got %v", expected, got)
+	}
+
+	manager.config.CoreDump.Dir = "/data/cores"
+	if got, expected := manager.coreDumpPath(bundle, 1234), filepath.Join("/data/cores", "default", "c1", "core.1234"); got != expected {
+		t.Fatalf("expected %v, but got %v", expected, got)
+	}
+}
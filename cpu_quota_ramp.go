@@ -0,0 +1,330 @@
+//go:build linux
+// +build linux
+
+package embedshim
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	goruntime "runtime"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/containerd/cgroups"
+	"github.com/containerd/containerd/errdefs"
+	"github.com/containerd/containerd/log"
+	ptypes "github.com/gogo/protobuf/types"
+	"github.com/opencontainers/runtime-spec/specs-go"
+)
+
+var (
+	defaultCPUQuotaRampSteps = 10
+	maxCPUQuotaRampSteps     = 1000
+
+	// minCPUQuotaRampInterval is the min interval between the steps, which
+	// avoids flooding the cgroup with writes.
+	minCPUQuotaRampInterval = 10 * time.Millisecond
+
+	// defaultCPUPeriod is the kernel's default CFS period in microseconds.
+	defaultCPUPeriod uint64 = 100000
+)
+
+// cpuQuotaRampPlan moves the CPU quota from one to the other linearly. The
+// quotas are in the unit of the period.
+type cpuQuotaRampPlan struct {
+	from     int64
+	to       int64
+	period   uint64
+	steps    int
+	interval time.Duration
+}
+
+// quota returns the quota of the step in [0, steps]. The last step is the
+// target.
+func (plan *cpuQuotaRampPlan) quota(step int) int64 {
+	return plan.from + (plan.to-plan.from)*int64(step)/int64(plan.steps)
+}
+
+// cpuQuotaRampFromAnnotations parses the Update's annotations. The zero
+// duration means the quota is updated at once.
+func cpuQuotaRampFromAnnotations(annotations map[string]string) (time.Duration, int, error) {
+	v, ok := annotations[annotationCPUQuotaRampDuration]
+	if !ok || v == "" {
+		return 0, 0, nil
+	}
+
+	duration, err := time.ParseDuration(v)
+	if err != nil || duration <= 0 {
+		return 0, 0, fmt.Errorf("invalid annotation %s=%q: %w", annotationCPUQuotaRampDuration, v, errdefs.ErrInvalidArgument)
+	}
+
+	steps := defaultCPUQuotaRampSteps
+	if v := annotations[annotationCPUQuotaRampSteps]; v != "" {
+		steps, err = strconv.Atoi(v)
+		if err != nil || steps <= 0 || steps > maxCPUQuotaRampSteps {
+			return 0, 0, fmt.Errorf("invalid annotation %s=%q, expected [1, %d]: %w",
+				annotationCPUQuotaRampSteps, v, maxCPUQuotaRampSteps, errdefs.ErrInvalidArgument)
+		}
+	}
+
+	if duration/time.Duration(steps) < minCPUQuotaRampInterval {
+		return 0, 0, fmt.Errorf("invalid annotation %s=%q, expected at least %v for %d steps: %w",
+			annotationCPUQuotaRampDuration, v, minCPUQuotaRampInterval*time.Duration(steps), steps, errdefs.ErrInvalidArgument)
+	}
+	return duration, steps, nil
+}
+
+// newCPUQuotaRampPlan returns nil if the resources don't set the limited
+// quota, or the quota isn't changed. The unlimited current quota is treated
+// as all the host's CPUs.
+func newCPUQuotaRampPlan(resources *specs.LinuxResources, curQuota int64, curPeriod uint64, duration time.Duration, steps int) *cpuQuotaRampPlan {
+	cpu := resources.CPU
+	if cpu == nil || cpu.Quota == nil || *cpu.Quota <= 0 {
+		return nil
+	}
+
+	if curPeriod == 0 {
+		curPeriod = defaultCPUPeriod
+	}
+	period := curPeriod
+	if cpu.Period != nil && *cpu.Period > 0 {
+		period = *cpu.Period
+	}
+
+	from := int64(goruntime.NumCPU()) * int64(period)
+	if curQuota > 0 {
+		from = curQuota * int64(period) / int64(curPeriod)
+	}
+	if from == *cpu.Quota {
+		return nil
+	}
+
+	return &cpuQuotaRampPlan{
+		from:     from,
+		to:       *cpu.Quota,
+		period:   period,
+		steps:    steps,
+		interval: duration / time.Duration(steps),
+	}
+}
+
+// parseCPUMax parses cgroup v2 cpu.max, like "max 100000". The unlimited
+// quota is -1.
+func parseCPUMax(value string) (int64, uint64, error) {
+	fields := strings.Fields(value)
+	if len(fields) == 0 || len(fields) > 2 {
+		return 0, 0, fmt.Errorf("invalid cpu.max %q", value)
+	}
+
+	quota := int64(-1)
+	if fields[0] != "max" {
+		q, err := strconv.ParseInt(fields[0], 10, 64)
+		if err != nil {
+			return 0, 0, fmt.Errorf("invalid cpu.max %q: %w", value, err)
+		}
+		quota = q
+	}
+
+	period := defaultCPUPeriod
+	if len(fields) == 2 {
+		p, err := strconv.ParseUint(fields[1], 10, 64)
+		if err != nil {
+			return 0, 0, fmt.Errorf("invalid cpu.max %q: %w", value, err)
+		}
+		period = p
+	}
+	return quota, period, nil
+}
+
+// readCPUQuota reads the current quota and period of the task's cgroup. The
+// unlimited quota is -1.
+func (s *shim) readCPUQuota() (int64, uint64, error) {
+	if cgroups.Mode() == cgroups.Unified {
+		cgroupPath := s.loadedIdentity().CgroupPath
+		if cgroupPath == "" {
+			return 0, 0, fmt.Errorf("cgroup of task %s is unavailable: %w", s.ID(), errdefs.ErrNotFound)
+		}
+
+		value, err := os.ReadFile(filepath.Join(cgroupv2Root, cgroupPath, "cpu.max"))
+		if err != nil {
+			return 0, 0, err
+		}
+		return parseCPUMax(string(value))
+	}
+
+	paths, err := cgroups.ParseCgroupFile(filepath.Join("/proc", strconv.Itoa(int(s.PID())), "cgroup"))
+	if err != nil {
+		return 0, 0, err
+	}
+	cgroupPath, ok := paths["cpu"]
+	if !ok {
+		return 0, 0, fmt.Errorf("cpu cgroup of task %s is unavailable: %w", s.ID(), errdefs.ErrNotFound)
+	}
+
+	root, err := cgroupControllerRoot("cpu")
+	if err != nil {
+		return 0, 0, err
+	}
+	dir := filepath.Join(root, s.trimInitSubgroup(cgroupPath))
+
+	values := make([]string, 2)
+	for i, file := range []string{"cpu.cfs_quota_us", "cpu.cfs_period_us"} {
+		value, err := os.ReadFile(filepath.Join(dir, file))
+		if err != nil {
+			return 0, 0, err
+		}
+		values[i] = strings.TrimSpace(string(value))
+	}
+
+	quota, err := strconv.ParseInt(values[0], 10, 64)
+	if err != nil {
+		return 0, 0, fmt.Errorf("invalid cpu.cfs_quota_us %q: %w", values[0], err)
+	}
+	period, err := strconv.ParseUint(values[1], 10, 64)
+	if err != nil {
+		return 0, 0, fmt.Errorf("invalid cpu.cfs_period_us %q: %w", values[1], err)
+	}
+	return quota, period, nil
+}
+
+// planCPUQuotaRamp returns the ramp of the Update if it is requested by the
+// annotations.
+func (s *shim) planCPUQuotaRamp(resources *specs.LinuxResources, annotations map[string]string) (*cpuQuotaRampPlan, error) {
+	duration, steps, err := cpuQuotaRampFromAnnotations(annotations)
+	if err != nil || duration == 0 {
+		return nil, err
+	}
+
+	quota, period, err := s.readCPUQuota()
+	if err != nil {
+		return nil, fmt.Errorf("failed to read cpu quota of task %s: %w", s.ID(), err)
+	}
+	return newCPUQuotaRampPlan(resources, quota, period, duration, steps), nil
+}
+
+// setCPUQuota replaces the quota and period in the resources.
+func setCPUQuota(r *ptypes.Any, quota int64, period uint64) (*ptypes.Any, error) {
+	return patchRawJSON(r, "resources", func(root map[string]json.RawMessage) (bool, error) {
+		cpu := map[string]json.RawMessage{}
+		if _, err := unmarshalRawField(root, "cpu", "cpu resources", &cpu); err != nil {
+			return false, err
+		}
+
+		var err error
+		if cpu["quota"], err = json.Marshal(quota); err != nil {
+			return false, err
+		}
+		if cpu["period"], err = json.Marshal(period); err != nil {
+			return false, err
+		}
+		if root["cpu"], err = json.Marshal(cpu); err != nil {
+			return false, err
+		}
+		return true, nil
+	})
+}
+
+// cpuQuotaRamp is the task's in-flight quota ramp. There is at most one
+// ramp, and the new Update cancels the previous one.
+type cpuQuotaRamp struct {
+	mu     sync.Mutex
+	cancel context.CancelFunc
+	done   chan struct{}
+}
+
+// start cancels the previous ramp and moves the quota to the plan's target
+// step by step in background. The step 0 has been applied by the caller.
+func (ramp *cpuQuotaRamp) start(s *shim, plan *cpuQuotaRampPlan) {
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+
+	ramp.mu.Lock()
+	prevCancel, prevDone := ramp.cancel, ramp.done
+	ramp.cancel, ramp.done = cancel, done
+	ramp.mu.Unlock()
+
+	if prevCancel != nil {
+		prevCancel()
+		<-prevDone
+	}
+
+	go func() {
+		defer close(done)
+		defer func() {
+			ramp.mu.Lock()
+			if ramp.done == done {
+				ramp.cancel, ramp.done = nil, nil
+			}
+			ramp.mu.Unlock()
+		}()
+
+		s.runCPUQuotaRamp(ctx, plan)
+	}()
+}
+
+// stop cancels the in-flight ramp and waits for it. It returns false if
+// there is no ramp.
+func (ramp *cpuQuotaRamp) stop() bool {
+	ramp.mu.Lock()
+	cancel, done := ramp.cancel, ramp.done
+	ramp.cancel, ramp.done = nil, nil
+	ramp.mu.Unlock()
+
+	if cancel == nil {
+		return false
+	}
+	cancel()
+	<-done
+	return true
+}
+
+func (s *shim) runCPUQuotaRamp(ctx context.Context, plan *cpuQuotaRampPlan) {
+	ticker := time.NewTicker(plan.interval)
+	defer ticker.Stop()
+
+	for step := 1; step <= plan.steps; step++ {
+		select {
+		case <-ctx.Done():
+			log.G(ctx).Infof("cpu quota ramp of task %s is cancelled at step %d/%d", s.ID(), step-1, plan.steps)
+			return
+		case <-ticker.C:
+		}
+
+		quota := plan.quota(step)
+		r, err := setCPUQuota(&ptypes.Any{Value: []byte("{}")}, quota, plan.period)
+		if err == nil {
+			err = s.init.Update(ctx, r)
+		}
+		if err != nil {
+			log.G(ctx).WithError(err).Warnf("failed to set cpu quota of task %s to %d at step %d/%d, stop ramping",
+				s.ID(), quota, step, plan.steps)
+			return
+		}
+	}
+	log.G(ctx).Infof("cpu quota of task %s is ramped to %d/%d", s.ID(), plan.to, plan.period)
+}
+
+// CancelCPUQuotaRamp stops the task's in-flight CPU quota ramp started by
+// Update. The quota stays at the latest applied step. It returns NotFound if
+// there is no ramp.
+func (manager *TaskManager) CancelCPUQuotaRamp(ctx context.Context, id string) error {
+	t, err := manager.tasks.Get(ctx, id)
+	if err != nil {
+		return err
+	}
+
+	s, ok := t.(*shim)
+	if !ok {
+		return errdefs.ErrNotImplemented
+	}
+
+	if !s.quotaRamp.stop() {
+		return fmt.Errorf("cpu quota ramp of task %s: %w", id, errdefs.ErrNotFound)
+	}
+	return nil
+}
@@ -0,0 +1,119 @@
+//go:build linux
+// +build linux
+
+package embedshim
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	ptypes "github.com/gogo/protobuf/types"
+	"github.com/opencontainers/runtime-spec/specs-go"
+)
+
+func TestCPUQuotaRampFromAnnotations(t *testing.T) {
+	duration, steps, err := cpuQuotaRampFromAnnotations(nil)
+	if err != nil || duration != 0 {
+		t.Fatalf("expected no ramp, but got %v (err: %v)", duration, err)
+	}
+
+	duration, steps, err = cpuQuotaRampFromAnnotations(map[string]string{
+		annotationCPUQuotaRampDuration: "30s",
+	})
+	if err != nil || duration != 30*time.Second || steps != defaultCPUQuotaRampSteps {
+		t.Fatalf("expected 30s in %v steps, but got %v in %v steps (err: %v)", defaultCPUQuotaRampSteps, duration, steps, err)
+	}
+
+	for _, annotations := range []map[string]string{
+		{annotationCPUQuotaRampDuration: "-1s"},
+		{annotationCPUQuotaRampDuration: "abc"},
+		{annotationCPUQuotaRampDuration: "10s", annotationCPUQuotaRampSteps: "0"},
+		{annotationCPUQuotaRampDuration: "10s", annotationCPUQuotaRampSteps: "1001"},
+		{annotationCPUQuotaRampDuration: "5ns"},
+		{annotationCPUQuotaRampDuration: "50ms", annotationCPUQuotaRampSteps: "10"},
+	} {
+		if _, _, err := cpuQuotaRampFromAnnotations(annotations); err == nil {
+			t.Fatalf("expected error for %v, but got nil", annotations)
+		}
+	}
+}
+
+func TestParseCPUMax(t *testing.T) {
+	for value, expected := range map[string][2]int64{
+		"max 100000\n": {-1, 100000},
+		"50000 100000": {50000, 100000},
+		"20000":        {20000, 100000},
+	} {
+		quota, period, err := parseCPUMax(value)
+		if err != nil || quota != expected[0] || period != uint64(expected[1]) {
+			t.Fatalf("expected %v for %q, but got %v %v (err: %v)", expected, value, quota, period, err)
+		}
+	}
+
+	for _, value := range []string{"", "max max", "1 2 3"} {
+		if _, _, err := parseCPUMax(value); err == nil {
+			t.Fatalf("expected error for %q, but got nil", value)
+		}
+	}
+}
+
+func TestNewCPUQuotaRampPlan(t *testing.T) {
+	quota, period := int64(50000), uint64(50000)
+	resources := &specs.LinuxResources{CPU: &specs.LinuxCPU{Quota: &quota, Period: &period}}
+
+	// 4 CPUs in 100ms period is 200000 in 50ms period
+	plan := newCPUQuotaRampPlan(resources, 400000, 100000, 10*time.Second, 4)
+	if plan == nil {
+		t.Fatalf("expected ramp plan, but got nil")
+	}
+	if plan.from != 200000 || plan.to != 50000 || plan.period != 50000 || plan.interval != 2500*time.Millisecond {
+		t.Fatalf("unexpected plan %+v", plan)
+	}
+
+	expected := []int64{200000, 162500, 125000, 87500, 50000}
+	for step, q := range expected {
+		if got := plan.quota(step); got != q {
+			t.Fatalf("expected %v at step %d, but got %v", q, step, got)
+		}
+	}
+
+	if plan := newCPUQuotaRampPlan(resources, 50000, 50000, time.Second, 1); plan != nil {
+		t.Fatalf("expected nil plan for unchanged quota, but got %+v", plan)
+	}
+
+	unlimited := int64(-1)
+	resources.CPU.Quota = &unlimited
+	if plan := newCPUQuotaRampPlan(resources, 50000, 50000, time.Second, 1); plan != nil {
+		t.Fatalf("expected nil plan for unlimited target, but got %+v", plan)
+	}
+}
+
+func TestSetCPUQuota(t *testing.T) {
+	r, err := setCPUQuota(&ptypes.Any{
+		TypeUrl: "resources",
+		Value:   []byte(`{"cpu":{"quota":1000,"shares":2},"unknown":true}`),
+	}, 2000, 100000)
+	if err != nil {
+		t.Fatalf("failed to set cpu quota: %v", err)
+	}
+
+	var got map[string]interface{}
+	if err := json.Unmarshal(r.Value, &got); err != nil {
+		t.Fatalf("failed to unmarshal: %v", err)
+	}
+	cpu := got["cpu"].(map[string]interface{})
+	if cpu["quota"] != float64(2000) || cpu["period"] != float64(100000) || cpu["shares"] != float64(2) || got["unknown"] != true {
+		t.Fatalf("unexpected resources %s", r.Value)
+	}
+	if r.TypeUrl != "resources" {
+		t.Fatalf("expected type url resources, but got %v", r.TypeUrl)
+	}
+}
+
+func TestCPUQuotaRampStop(t *testing.T) {
+	var ramp cpuQuotaRamp
+	if ramp.stop() {
+		t.Fatalf("expected no ramp to stop")
+	}
+}
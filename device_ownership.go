@@ -0,0 +1,204 @@
+//go:build linux
+// +build linux
+
+package embedshim
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/containerd/containerd/errdefs"
+	ptypes "github.com/gogo/protobuf/types"
+)
+
+// deviceOwnerUser means that the device nodes are owned by the init
+// process's user.
+const deviceOwnerUser = "user"
+
+// deviceOwnership rewrites the uid, gid and permissions of the spec's device
+// nodes, which are created by runc in the container's /dev. It allows the
+// non-root container to access the injected devices, like /dev/kvm, without
+// privileged mode.
+type deviceOwnership struct {
+	// owner is false if the uid and gid are unchanged.
+	owner bool
+	// fromUser uses the init process's uid and gid.
+	fromUser bool
+	uid      uint32
+	gid      uint32
+	// mode is the permission bits. It is unchanged if it is nil.
+	mode *uint32
+	// paths are the devices to rewrite. All the devices are rewritten if
+	// it is empty.
+	paths map[string]struct{}
+}
+
+// deviceOwnershipFromAnnotations returns nil if the ownership isn't
+// rewritten.
+func deviceOwnershipFromAnnotations(annotations map[string]string) (*deviceOwnership, error) {
+	owner, modeValue := annotations[annotationDeviceOwner], annotations[annotationDeviceMode]
+	if owner == "" && modeValue == "" {
+		if annotations[annotationDevicePaths] != "" {
+			return nil, fmt.Errorf("annotation %s requires %s or %s: %w",
+				annotationDevicePaths, annotationDeviceOwner, annotationDeviceMode, errdefs.ErrInvalidArgument)
+		}
+		return nil, nil
+	}
+
+	o := &deviceOwnership{}
+	switch owner {
+	case "":
+	case deviceOwnerUser:
+		o.owner, o.fromUser = true, true
+	default:
+		parts := strings.Split(owner, ":")
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("invalid annotation %s=%q, expected %q or UID:GID: %w",
+				annotationDeviceOwner, owner, deviceOwnerUser, errdefs.ErrInvalidArgument)
+		}
+
+		uid, err := strconv.ParseUint(parts[0], 10, 32)
+		if err != nil {
+			return nil, fmt.Errorf("invalid uid in annotation %s=%q: %w", annotationDeviceOwner, owner, errdefs.ErrInvalidArgument)
+		}
+		gid, err := strconv.ParseUint(parts[1], 10, 32)
+		if err != nil {
+			return nil, fmt.Errorf("invalid gid in annotation %s=%q: %w", annotationDeviceOwner, owner, errdefs.ErrInvalidArgument)
+		}
+		o.owner, o.uid, o.gid = true, uint32(uid), uint32(gid)
+	}
+
+	if modeValue != "" {
+		mode, err := strconv.ParseUint(modeValue, 8, 32)
+		if err != nil || mode > 0777 {
+			return nil, fmt.Errorf("invalid annotation %s=%q, expected octal in [0, 0777]: %w",
+				annotationDeviceMode, modeValue, errdefs.ErrInvalidArgument)
+		}
+		m := uint32(mode)
+		o.mode = &m
+	}
+
+	if v := annotations[annotationDevicePaths]; v != "" {
+		o.paths = make(map[string]struct{})
+		for _, p := range strings.Split(v, ",") {
+			if p = strings.TrimSpace(p); p != "" {
+				o.paths[p] = struct{}{}
+			}
+		}
+	}
+	return o, nil
+}
+
+// applyDeviceOwnership applies the ownership defined by the spec's
+// annotations on the spec's linux.devices. The spec is returned as it is if
+// the ownership isn't rewritten.
+func applyDeviceOwnership(spec *ptypes.Any) (*ptypes.Any, error) {
+	if spec == nil {
+		return spec, nil
+	}
+
+	return patchRawJSON(spec, "spec", func(root map[string]json.RawMessage) (bool, error) {
+		var annotations map[string]string
+		if _, err := unmarshalRawField(root, "annotations", "spec annotations", &annotations); err != nil {
+			return false, err
+		}
+
+		o, err := deviceOwnershipFromAnnotations(annotations)
+		if err != nil || o == nil {
+			return false, err
+		}
+
+		var linux struct {
+			Devices    []map[string]json.RawMessage `json:"devices"`
+			Namespaces []struct {
+				Type string `json:"type"`
+			} `json:"namespaces"`
+		}
+		if ok, err := unmarshalRawField(root, "linux", "spec linux", &linux); err != nil || !ok {
+			return false, err
+		}
+		if len(linux.Devices) == 0 {
+			return false, nil
+		}
+
+		// NOTE: runc bind-mounts the host's device nodes instead of mknod in
+		// the user namespace, so that the ownership can't be rewritten.
+		for _, ns := range linux.Namespaces {
+			if ns.Type == "user" {
+				return false, fmt.Errorf("device ownership can't be rewritten in user namespace: %w", errdefs.ErrInvalidArgument)
+			}
+		}
+
+		if o.fromUser {
+			if o.uid, o.gid, err = processUserIDs(root["process"]); err != nil {
+				return false, err
+			}
+		}
+
+		if err := o.applyDevices(linux.Devices); err != nil {
+			return false, err
+		}
+
+		var rawLinux map[string]json.RawMessage
+		if _, err := unmarshalRawField(root, "linux", "spec linux", &rawLinux); err != nil {
+			return false, err
+		}
+		if rawLinux["devices"], err = json.Marshal(linux.Devices); err != nil {
+			return false, err
+		}
+		if root["linux"], err = json.Marshal(rawLinux); err != nil {
+			return false, err
+		}
+		return true, nil
+	})
+}
+
+// applyDevices rewrites the devices in place.
+func (o *deviceOwnership) applyDevices(devices []map[string]json.RawMessage) error {
+	for _, dev := range devices {
+		var path string
+		if err := unmarshalRawJSON(dev["path"], "device path", &path); err != nil {
+			return err
+		}
+		if len(o.paths) > 0 {
+			if _, ok := o.paths[path]; !ok {
+				continue
+			}
+		}
+
+		if o.owner {
+			dev["uid"], _ = json.Marshal(o.uid)
+			dev["gid"], _ = json.Marshal(o.gid)
+		}
+
+		if o.mode != nil {
+			// The bits except permissions, like setgid, are kept.
+			var mode uint32
+			if _, err := unmarshalRawField(dev, "fileMode", "fileMode of device "+path, &mode); err != nil {
+				return err
+			}
+			dev["fileMode"], _ = json.Marshal(mode&^0777 | *o.mode)
+		}
+	}
+	return nil
+}
+
+// processUserIDs returns the uid and gid of the spec's process.
+func processUserIDs(rawProcess json.RawMessage) (uint32, uint32, error) {
+	if rawProcess == nil {
+		return 0, 0, nil
+	}
+
+	var process struct {
+		User struct {
+			UID uint32 `json:"uid"`
+			GID uint32 `json:"gid"`
+		} `json:"user"`
+	}
+	if err := unmarshalRawJSON(rawProcess, "process spec", &process); err != nil {
+		return 0, 0, err
+	}
+	return process.User.UID, process.User.GID, nil
+}
@@ -0,0 +1,75 @@
+//go:build linux
+// +build linux
+
+package embedshim
+
+import (
+	"encoding/json"
+	"testing"
+
+	ptypes "github.com/gogo/protobuf/types"
+	"github.com/opencontainers/runtime-spec/specs-go"
+)
+
+func TestApplyDeviceOwnership(t *testing.T) {
+	raw := []byte(`{
+		"annotations": {
+			"` + annotationDeviceOwner + `": "user",
+			"` + annotationDeviceMode + `": "0660",
+			"` + annotationDevicePaths + `": "/dev/kvm"
+		},
+		"process": {"user": {"uid": 1000, "gid": 2000}},
+		"linux": {
+			"devices": [
+				{"path": "/dev/kvm", "type": "c", "major": 10, "minor": 232, "fileMode": 512},
+				{"path": "/dev/fuse", "type": "c", "major": 10, "minor": 229}
+			],
+			"x-unknown": true
+		}
+	}`)
+
+	got, err := applyDeviceOwnership(&ptypes.Any{Value: raw})
+	if err != nil {
+		t.Fatalf("failed to apply device ownership: %v", err)
+	}
+
+	var spec specs.Spec
+	if err := json.Unmarshal(got.Value, &spec); err != nil {
+		t.Fatal(err)
+	}
+
+	kvm, fuse := spec.Linux.Devices[0], spec.Linux.Devices[1]
+	if *kvm.UID != 1000 || *kvm.GID != 2000 || *kvm.FileMode != 01000|0660 {
+		t.Fatalf("expected /dev/kvm 1000:2000 %o, but got %v:%v %o", 01000|0660, *kvm.UID, *kvm.GID, *kvm.FileMode)
+	}
+	if fuse.UID != nil || fuse.GID != nil || fuse.FileMode != nil {
+		t.Fatalf("expected /dev/fuse unchanged, but got %+v", fuse)
+	}
+
+	var root map[string]map[string]json.RawMessage
+	if err := json.Unmarshal(got.Value, &root); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := root["linux"]["x-unknown"]; !ok {
+		t.Fatalf("expected unknown linux field kept, but got %s", got.Value)
+	}
+}
+
+func TestDeviceOwnershipFromAnnotations(t *testing.T) {
+	for _, tc := range []struct {
+		annotations map[string]string
+		hasErr      bool
+	}{
+		{annotations: map[string]string{annotationDeviceOwner: "0:44"}},
+		{annotations: map[string]string{annotationDeviceMode: "0666"}},
+		{annotations: map[string]string{annotationDeviceOwner: "root"}, hasErr: true},
+		{annotations: map[string]string{annotationDeviceOwner: "1:2:3"}, hasErr: true},
+		{annotations: map[string]string{annotationDeviceMode: "01777"}, hasErr: true},
+		{annotations: map[string]string{annotationDevicePaths: "/dev/kvm"}, hasErr: true},
+	} {
+		_, err := deviceOwnershipFromAnnotations(tc.annotations)
+		if got := err != nil; got != tc.hasErr {
+			t.Fatalf("expected error %v for %v, but got %v", tc.hasErr, tc.annotations, err)
+		}
+	}
+}
@@ -0,0 +1,333 @@
+//go:build linux
+// +build linux
+
+package embedshim
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+
+	"github.com/cilium/ebpf"
+	"github.com/cilium/ebpf/asm"
+	"github.com/cilium/ebpf/link"
+	"github.com/containerd/cgroups"
+	"github.com/containerd/containerd/errdefs"
+	"github.com/containerd/containerd/log"
+	ptypes "github.com/gogo/protobuf/types"
+	"github.com/opencontainers/runtime-spec/specs-go"
+	"golang.org/x/sys/unix"
+)
+
+// defaultAllowedDevices are always allowed by runc, which must be kept when
+// the device rules are replaced.
+var defaultAllowedDevices = []specs.LinuxDeviceCgroup{
+	{Allow: true, Type: "c", Access: "m"},
+	{Allow: true, Type: "b", Access: "m"},
+	{Allow: true, Type: "c", Major: devNum(1), Minor: devNum(3), Access: "rwm"},    // /dev/null
+	{Allow: true, Type: "c", Major: devNum(1), Minor: devNum(8), Access: "rwm"},    // /dev/random
+	{Allow: true, Type: "c", Major: devNum(1), Minor: devNum(7), Access: "rwm"},    // /dev/full
+	{Allow: true, Type: "c", Major: devNum(5), Minor: devNum(0), Access: "rwm"},    // /dev/tty
+	{Allow: true, Type: "c", Major: devNum(1), Minor: devNum(5), Access: "rwm"},    // /dev/zero
+	{Allow: true, Type: "c", Major: devNum(1), Minor: devNum(9), Access: "rwm"},    // /dev/urandom
+	{Allow: true, Type: "c", Major: devNum(5), Minor: devNum(1), Access: "rwm"},    // /dev/console
+	{Allow: true, Type: "c", Major: devNum(136), Access: "rwm"},                    // /dev/pts/*
+	{Allow: true, Type: "c", Major: devNum(5), Minor: devNum(2), Access: "rwm"},    // /dev/ptmx
+	{Allow: true, Type: "c", Major: devNum(10), Minor: devNum(200), Access: "rwm"}, // /dev/net/tun
+}
+
+func devNum(n int64) *int64 {
+	return &n
+}
+
+// updateDevices replaces the task's device cgroup rules if the resources
+// have devices. `runc update` doesn't support devices so that the rules are
+// programmed into devices.allow and devices.deny for cgroup v1, or the new
+// eBPF device filter which replaces the existing one for cgroup v2.
+//
+// The rules replace the spec's resources.devices. The rules for the spec's
+// device nodes and runc's default devices are kept.
+func (s *shim) updateDevices(ctx context.Context, r *ptypes.Any) error {
+	var resources specs.LinuxResources
+	if err := json.Unmarshal(r.Value, &resources); err != nil {
+		return err
+	}
+	if len(resources.Devices) == 0 {
+		return nil
+	}
+
+	spec, err := readInitOCISpec(s.bundle)
+	if err != nil {
+		return err
+	}
+
+	var nodes []specs.LinuxDevice
+	if spec.Linux != nil {
+		nodes = spec.Linux.Devices
+	}
+	rules := effectiveDeviceRules(resources.Devices, nodes)
+
+	if cgroups.Mode() == cgroups.Unified {
+		cgroupPath := s.loadedIdentity().CgroupPath
+		if cgroupPath == "" {
+			return fmt.Errorf("cgroup of task %s is unavailable: %w", s.ID(), errdefs.ErrNotFound)
+		}
+		err = replaceDeviceFilter(filepath.Join(cgroupv2Root, cgroupPath), rules)
+	} else {
+		err = s.writeDeviceRulesV1(rules)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to update devices of task %s: %w", s.ID(), err)
+	}
+
+	log.G(ctx).Debugf("updated %d device rules of task %s", len(rules), s.ID())
+	return nil
+}
+
+// effectiveDeviceRules returns the rules in order like runc, in which the
+// later rule overrides the earlier one.
+func effectiveDeviceRules(rules []specs.LinuxDeviceCgroup, nodes []specs.LinuxDevice) []specs.LinuxDeviceCgroup {
+	res := make([]specs.LinuxDeviceCgroup, 0, len(rules)+len(nodes)+len(defaultAllowedDevices))
+	res = append(res, rules...)
+	for _, d := range nodes {
+		res = append(res, specs.LinuxDeviceCgroup{
+			Allow:  true,
+			Type:   d.Type,
+			Major:  devNum(d.Major),
+			Minor:  devNum(d.Minor),
+			Access: "rwm",
+		})
+	}
+	return append(res, defaultAllowedDevices...)
+}
+
+// deviceRuleV1 returns the rule in the format of devices.allow, like
+// "c 1:3 rwm".
+func deviceRuleV1(rule specs.LinuxDeviceCgroup) string {
+	typ := rule.Type
+	if typ == "" {
+		typ = "a"
+	}
+
+	num := func(n *int64) string {
+		if n == nil || *n < 0 {
+			return "*"
+		}
+		return strconv.FormatInt(*n, 10)
+	}
+
+	access := rule.Access
+	if access == "" {
+		access = "rwm"
+	}
+	return fmt.Sprintf("%s %s:%s %s", typ, num(rule.Major), num(rule.Minor), access)
+}
+
+// writeDeviceRulesV1 denies all the devices first and then writes the rules
+// in order.
+//
+// NOTE: The container can't access the devices between deny-all and the
+// following allows, which is short but not atomic.
+func (s *shim) writeDeviceRulesV1(rules []specs.LinuxDeviceCgroup) error {
+	paths, err := cgroups.ParseCgroupFile(filepath.Join("/proc", strconv.Itoa(int(s.PID())), "cgroup"))
+	if err != nil {
+		return err
+	}
+
+	cgroupPath, ok := paths["devices"]
+	if !ok {
+		return fmt.Errorf("devices cgroup of task %s not found: %w", s.ID(), errdefs.ErrNotFound)
+	}
+
+	root, err := cgroupControllerRoot("devices")
+	if err != nil {
+		return err
+	}
+	dir := filepath.Join(root, s.trimInitSubgroup(cgroupPath))
+
+	if err := writeCgroupFile(dir, "devices.deny", "a"); err != nil {
+		return err
+	}
+	for _, rule := range rules {
+		file := "devices.deny"
+		if rule.Allow {
+			file = "devices.allow"
+		}
+		if err := writeCgroupFile(dir, file, deviceRuleV1(rule)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// replaceDeviceFilter loads the device filter program for the rules and
+// replaces the one attached to the cgroup by BPF_F_REPLACE, so that there is
+// no window without filter. The other attached programs are detached after
+// that.
+func replaceDeviceFilter(dir string, rules []specs.LinuxDeviceCgroup) error {
+	insts, err := deviceFilterInstructions(rules)
+	if err != nil {
+		return err
+	}
+
+	prog, err := ebpf.NewProgram(&ebpf.ProgramSpec{
+		Type:         ebpf.CGroupDevice,
+		AttachType:   ebpf.AttachCGroupDevice,
+		Instructions: insts,
+		License:      "Apache",
+	})
+	if err != nil {
+		return fmt.Errorf("failed to load device filter: %w", err)
+	}
+	defer prog.Close()
+
+	ids, err := link.QueryPrograms(link.QueryOptions{
+		Path:   dir,
+		Attach: ebpf.AttachCGroupDevice,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to query device filters: %w", err)
+	}
+
+	var olds []*ebpf.Program
+	defer func() {
+		for _, p := range olds {
+			p.Close()
+		}
+	}()
+	for _, id := range ids {
+		p, err := ebpf.NewProgramFromID(id)
+		if err != nil {
+			return fmt.Errorf("failed to open device filter %d: %w", id, err)
+		}
+		olds = append(olds, p)
+	}
+
+	cg, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer cg.Close()
+
+	opts := link.RawAttachProgramOptions{
+		Target:  int(cg.Fd()),
+		Program: prog,
+		Attach:  ebpf.AttachCGroupDevice,
+		Flags:   unix.BPF_F_ALLOW_MULTI,
+	}
+	if len(olds) > 0 {
+		opts.Replace = olds[0]
+		opts.Flags |= unix.BPF_F_REPLACE
+	}
+	if err := link.RawAttachProgram(opts); err != nil {
+		return fmt.Errorf("failed to attach device filter: %w", err)
+	}
+
+	if len(olds) <= 1 {
+		return nil
+	}
+
+	var errs []error
+	for _, p := range olds[1:] {
+		if err := link.RawDetachProgram(link.RawDetachProgramOptions{
+			Target:  int(cg.Fd()),
+			Program: p,
+			Attach:  ebpf.AttachCGroupDevice,
+		}); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	if len(errs) > 0 {
+		return fmt.Errorf("failed to detach old device filters: %v", errs)
+	}
+	return nil
+}
+
+// deviceFilterInstructions generates the BPF_PROG_TYPE_CGROUP_DEVICE program
+// like runc. The rules are checked in reverse order because the later rule
+// overrides the earlier one, and the device is denied if there is no match.
+func deviceFilterInstructions(rules []specs.LinuxDeviceCgroup) (asm.Instructions, error) {
+	// struct bpf_cgroup_dev_ctx {
+	//	u32 access_type; /* (access << 16) | type */
+	//	u32 major;
+	//	u32 minor;
+	// };
+	insts := asm.Instructions{
+		// R2 <- type
+		asm.LoadMem(asm.R2, asm.R1, 0, asm.Word),
+		asm.And.Imm32(asm.R2, 0xFFFF),
+		// R3 <- access
+		asm.LoadMem(asm.R3, asm.R1, 0, asm.Word),
+		asm.RSh.Imm32(asm.R3, 16),
+		// R4 <- major
+		asm.LoadMem(asm.R4, asm.R1, 4, asm.Word),
+		// R5 <- minor
+		asm.LoadMem(asm.R5, asm.R1, 8, asm.Word),
+	}
+
+	blockID := 0
+	for idx := len(rules) - 1; idx >= 0; idx-- {
+		rule := rules[idx]
+
+		var (
+			block []asm.Instruction
+			next  = "block-" + strconv.Itoa(blockID+1)
+		)
+
+		switch rule.Type {
+		case "c":
+			block = append(block, asm.JNE.Imm(asm.R2, unix.BPF_DEVCG_DEV_CHAR, next))
+		case "b":
+			block = append(block, asm.JNE.Imm(asm.R2, unix.BPF_DEVCG_DEV_BLOCK, next))
+		case "a", "":
+		default:
+			return nil, fmt.Errorf("invalid device type %q: %w", rule.Type, errdefs.ErrInvalidArgument)
+		}
+
+		var access int32
+		for _, c := range rule.Access {
+			switch c {
+			case 'r':
+				access |= unix.BPF_DEVCG_ACC_READ
+			case 'w':
+				access |= unix.BPF_DEVCG_ACC_WRITE
+			case 'm':
+				access |= unix.BPF_DEVCG_ACC_MKNOD
+			default:
+				return nil, fmt.Errorf("invalid device access %q: %w", rule.Access, errdefs.ErrInvalidArgument)
+			}
+		}
+		if access != 0 && access != unix.BPF_DEVCG_ACC_READ|unix.BPF_DEVCG_ACC_WRITE|unix.BPF_DEVCG_ACC_MKNOD {
+			block = append(block,
+				// if (R3 & access != R3) goto next
+				asm.Mov.Reg32(asm.R1, asm.R3),
+				asm.And.Imm32(asm.R1, access),
+				asm.JNE.Reg(asm.R1, asm.R3, next),
+			)
+		}
+		if rule.Major != nil && *rule.Major >= 0 {
+			block = append(block, asm.JNE.Imm(asm.R4, int32(*rule.Major), next))
+		}
+		if rule.Minor != nil && *rule.Minor >= 0 {
+			block = append(block, asm.JNE.Imm(asm.R5, int32(*rule.Minor), next))
+		}
+
+		var allow int32
+		if rule.Allow {
+			allow = 1
+		}
+		block = append(block, asm.Mov.Imm32(asm.R0, allow), asm.Return())
+		block[0] = block[0].WithSymbol("block-" + strconv.Itoa(blockID))
+
+		insts = append(insts, block...)
+		blockID++
+	}
+
+	return append(insts,
+		asm.Mov.Imm32(asm.R0, 0).WithSymbol("block-"+strconv.Itoa(blockID)),
+		asm.Return(),
+	), nil
+}
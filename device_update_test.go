@@ -0,0 +1,54 @@
+//go:build linux
+// +build linux
+
+package embedshim
+
+import (
+	"testing"
+
+	"github.com/opencontainers/runtime-spec/specs-go"
+)
+
+func TestDeviceRuleV1(t *testing.T) {
+	for _, tc := range []struct {
+		rule     specs.LinuxDeviceCgroup
+		expected string
+	}{
+		{specs.LinuxDeviceCgroup{Access: "rwm"}, "a *:* rwm"},
+		{specs.LinuxDeviceCgroup{Type: "c", Major: devNum(1), Minor: devNum(3), Access: "rw"}, "c 1:3 rw"},
+		{specs.LinuxDeviceCgroup{Type: "c", Major: devNum(136)}, "c 136:* rwm"},
+		{specs.LinuxDeviceCgroup{Type: "b", Major: devNum(-1), Minor: devNum(0), Access: "m"}, "b *:0 m"},
+	} {
+		if got := deviceRuleV1(tc.rule); got != tc.expected {
+			t.Fatalf("expected %v, but got %v", tc.expected, got)
+		}
+	}
+}
+
+func TestEffectiveDeviceRulesKeepDefaults(t *testing.T) {
+	rules := effectiveDeviceRules(
+		[]specs.LinuxDeviceCgroup{{Allow: false, Access: "rwm"}},
+		[]specs.LinuxDevice{{Path: "/dev/fuse", Type: "c", Major: 10, Minor: 229}},
+	)
+
+	if len(rules) != 2+len(defaultAllowedDevices) {
+		t.Fatalf("expected %v rules, but got %v", 2+len(defaultAllowedDevices), len(rules))
+	}
+	if rules[0].Allow {
+		t.Fatalf("expected the requested deny-all rule first, but got %+v", rules[0])
+	}
+	if got := deviceRuleV1(rules[1]); got != "c 10:229 rwm" {
+		t.Fatalf("expected device node rule c 10:229 rwm, but got %v", got)
+	}
+}
+
+func TestDeviceFilterInstructionsInvalid(t *testing.T) {
+	for _, rule := range []specs.LinuxDeviceCgroup{
+		{Type: "x", Access: "rwm"},
+		{Type: "c", Access: "rwx"},
+	} {
+		if _, err := deviceFilterInstructions([]specs.LinuxDeviceCgroup{rule}); err == nil {
+			t.Fatalf("expected error for %+v, but got nil", rule)
+		}
+	}
+}
@@ -0,0 +1,145 @@
+//go:build linux
+// +build linux
+
+package embedshim
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+
+	"github.com/containerd/containerd/errdefs"
+	"github.com/containerd/containerd/log"
+	"golang.org/x/sys/unix"
+)
+
+// bundleFileKeyShimOptions is the filename about runc options used by
+// containerd-shim-runc-v2.
+var bundleFileKeyShimOptions = "options.json"
+
+// DisownOpts is used to hand the task over to the standard shim.
+type DisownOpts struct {
+	// Bundle is the target bundle path used by the standard shim, like
+	// /run/containerd/io.containerd.runtime.v2.task/<ns>/<id>.
+	Bundle string
+}
+
+// Disown stops embedshim's monitoring on the task and hands it over to the
+// standard shim without restarting the workload. It is the rollback of
+// Adopt.
+//
+// The runc state has been stored in runc root, which is the same layout as
+// the standard shim. Disown prepares the target bundle with OCI spec, init
+// pid and options, and moves the rootfs mount into it. The task must not
+// have any exec process.
+func (manager *TaskManager) Disown(ctx context.Context, id string, opts DisownOpts) (uint32, error) {
+	if opts.Bundle == "" {
+		return 0, fmt.Errorf("target bundle is required: %w", errdefs.ErrInvalidArgument)
+	}
+
+	t, err := manager.tasks.Get(ctx, id)
+	if err != nil {
+		return 0, err
+	}
+
+	s, ok := t.(*shim)
+	if !ok {
+		return 0, fmt.Errorf("task %s is not managed by embedshim: %w", id, errdefs.ErrNotImplemented)
+	}
+
+	pid, err := s.disown(ctx, opts.Bundle)
+	if err != nil {
+		return 0, fmt.Errorf("failed to disown task %s: %w", id, err)
+	}
+
+	manager.Delete(ctx, id)
+	s.teardown()
+	if err := s.bundle.Delete(); err != nil {
+		log.G(ctx).WithError(err).Warnf("failed to delete bundle of disowned task %s", id)
+	}
+	return pid, nil
+}
+
+func (s *shim) disown(ctx context.Context, target string) (uint32, error) {
+	if s.execCount() != 0 {
+		return 0, fmt.Errorf("task with exec processes can't be disowned: %w", errdefs.ErrFailedPrecondition)
+	}
+
+	p := s.init
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	switch p.initState.(type) {
+	case *createdState, *runningState, *pausedState:
+	default:
+		return 0, fmt.Errorf("task in %s state can't be disowned: %w", stateName(p.initState), errdefs.ErrFailedPrecondition)
+	}
+
+	if p.console != nil {
+		return 0, fmt.Errorf("task with terminal can't be disowned: %w", errdefs.ErrNotImplemented)
+	}
+
+	if err := p.prepareDisownBundle(target); err != nil {
+		return 0, err
+	}
+
+	if err := s.manager.monitor.untrace(p); err != nil {
+		return 0, err
+	}
+
+	// NOTE: The container keeps the fifos opened so that closing ours
+	// doesn't break the outputs.
+	if p.io != nil {
+		for _, c := range p.closers {
+			c.Close()
+		}
+		p.io.Close()
+	}
+	p.setState(&deletedState{})
+	return uint32(p.pid), nil
+}
+
+// prepareDisownBundle creates the bundle used by the standard shim.
+func (p *initProcess) prepareDisownBundle(target string) error {
+	if err := os.MkdirAll(target, 0711); err != nil {
+		return err
+	}
+
+	spec, err := os.ReadFile(filepath.Join(p.bundle.Path, bundleFileKeyOCISpec))
+	if err != nil {
+		return err
+	}
+
+	opts, err := json.Marshal(p.options)
+	if err != nil {
+		return fmt.Errorf("failed to marshal options into json: %w", err)
+	}
+
+	for name, value := range map[string][]byte{
+		bundleFileKeyOCISpec:     spec,
+		bundleFileKeyShimOptions: opts,
+		bundleInitPidFile:        []byte(strconv.Itoa(p.pid)),
+	} {
+		pathname := filepath.Join(target, name)
+		if err := os.WriteFile(pathname, value, 0644); err != nil {
+			return fmt.Errorf("failed to store in %v: %w", pathname, err)
+		}
+	}
+
+	rootfs := filepath.Join(target, "rootfs")
+	if err := os.Mkdir(rootfs, 0711); err != nil && !os.IsExist(err) {
+		return err
+	}
+
+	// The rootfs is not mount point if there is no rootfs in CreateOpts.
+	if err := unix.Mount(p.bundle.Rootfs(), rootfs, "", unix.MS_MOVE, ""); err != nil &&
+		!errors.Is(err, unix.EINVAL) && !errors.Is(err, unix.ENOENT) {
+		return fmt.Errorf("failed to move rootfs mount into %s: %w", rootfs, err)
+	}
+	return nil
+}
@@ -0,0 +1,10 @@
+// Package embedshim is the containerd runtime plugin which runs the tasks in
+// containerd without the shim processes. The task's exit is traced by the
+// exitsnoop eBPF program and the pidfd.
+//
+// The containers are only supported on linux. On the other platforms, like
+// darwin for development, the plugin runs the task's process on the host
+// without isolation so that the embedders and unit tests still build and
+// run. The exit is tracked by the process-wait monitor, which reaps the
+// process and records its status in exitsnoop's in-memory store.
+package embedshim
@@ -0,0 +1,212 @@
+//go:build linux
+// +build linux
+
+package embedshim
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	pkgbundle "github.com/fuweid/embedshim/pkg/bundle"
+
+	"github.com/containerd/cgroups"
+	"github.com/containerd/containerd/errdefs"
+	"github.com/containerd/containerd/identifiers"
+	"github.com/containerd/containerd/mount"
+	"github.com/containerd/containerd/namespaces"
+	"github.com/containerd/containerd/runtime"
+	"github.com/opencontainers/runtime-spec/specs-go"
+)
+
+// DryRunReport is the result of DryRunCreate.
+type DryRunReport struct {
+	ID        string
+	Namespace string
+
+	// Problems are the spec's problems, including the invalid embedshim
+	// annotations and stdio.
+	Problems []SpecProblem
+	// AdmissionError is the reason why this node can't satisfy the spec.
+	// It is empty if the task is admitted.
+	AdmissionError string
+
+	// Mounts are the rootfs mounts which would be mounted on the bundle's
+	// rootfs in order.
+	Mounts []mount.Mount
+	// Cgroup is the cgroup plan of the init process.
+	Cgroup DryRunCgroupPlan
+}
+
+// DryRunCgroupPlan describes how the task's cgroup would be managed.
+type DryRunCgroupPlan struct {
+	// Path is the spec's cgroupsPath.
+	Path string
+	// Mode is the host's cgroup mode, like "unified", "hybrid" or "legacy".
+	Mode string
+	// Systemd means that the cgroup is managed by systemd.
+	Systemd bool
+	// External means that the cgroup is managed by others and it won't be
+	// removed by embedshim.
+	External bool
+	// ExecSubgroups means that the init and exec processes are placed in
+	// separate leaf cgroups.
+	ExecSubgroups bool
+	// MemoryMin and MemoryHigh are the memory QoS settings. The zero
+	// MemoryHigh means "max".
+	MemoryMin  int64
+	MemoryHigh int64
+}
+
+// Admitted returns true if the task would be created on this node.
+func (r *DryRunReport) Admitted() bool {
+	return len(r.Problems) == 0 && r.AdmissionError == ""
+}
+
+// DryRunCreate performs the preparation of Create, including the bundle,
+// spec validation, admission, mount plan and cgroup plan, and reports the
+// result without invoking OCI runtime. The bundle is discarded and nothing
+// is mounted so that the admission controller is able to verify the task
+// against this node without side effect.
+//
+// The error is returned only if the dry run itself fails. The problems of
+// the task are in the report.
+func (manager *TaskManager) DryRunCreate(ctx context.Context, id string, opts runtime.CreateOpts) (*DryRunReport, error) {
+	if err := identifiers.Validate(id); err != nil {
+		return nil, fmt.Errorf("invalid task id %s: %w", id, err)
+	}
+
+	ns, err := namespaces.NamespaceRequired(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	report := &DryRunReport{
+		ID:        id,
+		Namespace: ns,
+		Mounts:    opts.Rootfs,
+	}
+
+	if err := manager.validateStdinSource(ns, opts.IO.Stdin, opts.IO.Terminal); err != nil {
+		report.Problems = append(report.Problems, SpecProblem{Field: "io.stdin", Message: err.Error()})
+	}
+
+	overrides, err := initOverridesFromCreateOpts(opts)
+	if err != nil {
+		report.Problems = append(report.Problems, SpecProblem{Field: "task_options", Message: err.Error()})
+		return report, nil
+	}
+
+	opts.Spec, err = applyInitOverrides(opts.Spec, overrides)
+	if err != nil {
+		report.Problems = append(report.Problems, SpecProblem{Field: "process", Message: err.Error()})
+		return report, nil
+	}
+
+	opts.Spec, err = manager.sanitizeInitSpecEnv(ctx, id, opts.Spec)
+	if err != nil {
+		return nil, err
+	}
+
+	opts.Spec, err = applyInitUserOverride(opts.Spec)
+	if err != nil {
+		report.Problems = append(report.Problems, SpecProblem{Field: "annotations", Message: err.Error()})
+		return report, nil
+	}
+
+	opts.Spec, err = applyDeviceOwnership(opts.Spec)
+	if err != nil {
+		report.Problems = append(report.Problems, SpecProblem{Field: "annotations", Message: err.Error()})
+		return report, nil
+	}
+
+	opts.Spec, err = applyMountPropagation(opts.Spec, manager.config.MountPropagation)
+	if err != nil {
+		report.Problems = append(report.Problems, SpecProblem{Field: "mounts", Message: err.Error()})
+		return report, nil
+	}
+
+	opts.Spec, err = applyInitInjection(opts.Spec, manager.config.InitInjection)
+	if err != nil {
+		report.Problems = append(report.Problems, SpecProblem{Field: "process.args", Message: err.Error()})
+		return report, nil
+	}
+
+	var spec specs.Spec
+	if err := json.Unmarshal(opts.Spec.Value, &spec); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal spec: %v: %w", err, errdefs.ErrInvalidArgument)
+	}
+
+	if err := validateSpec(&spec); err != nil {
+		var verr *SpecValidationError
+		if !errors.As(err, &verr) {
+			return nil, err
+		}
+		report.Problems = append(report.Problems, verr.Problems...)
+	}
+
+	// NOTE: The namespaces of sysctls are checked by validateSpec.
+	if manager.config.SysctlPolicy.Enabled {
+		v := &specValidator{}
+		if spec.Linux != nil {
+			v.validateUnsafeSysctls(spec.Linux, manager.config.SysctlPolicy)
+		}
+		report.Problems = append(report.Problems, v.problems...)
+	}
+
+	if err := manager.admit(&spec); err != nil {
+		report.AdmissionError = err.Error()
+	}
+
+	initOpts, err := initOptionsFromCreateOpts(opts)
+	if err != nil {
+		return nil, err
+	}
+
+	// NOTE: The bundle is created in the temporary root so that the dry run
+	// doesn't conflict with the existing task with the same id.
+	tmpDir, err := os.MkdirTemp(manager.stateDir, "dry-run-")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(tmpDir)
+
+	bundle, err := pkgbundle.NewBundle(filepath.Join(tmpDir, "root"), filepath.Join(tmpDir, "state"),
+		ns, id,
+		withBundleApplyFormatVersion(),
+		withBundleApplyInitOCISpec(opts.Spec),
+		withBundleApplyInitOptions(initOpts),
+		withBundleApplyInitStdio(opts.IO),
+		withBundleApplyInitTraceEventID(0),
+		withBundleApplyExternalCgroup(initOpts.SystemdCgroup),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to prepare bundle: %w", err)
+	}
+	defer bundle.Delete()
+
+	report.Cgroup = DryRunCgroupPlan{
+		Mode:     cgroupModeName(cgroups.Mode()),
+		Systemd:  initOpts.SystemdCgroup,
+		External: hasExternalCgroup(bundle),
+	}
+	if spec.Linux != nil {
+		report.Cgroup.Path = spec.Linux.CgroupsPath
+	}
+
+	p, err := newInitProcess(bundle)
+	if err != nil {
+		report.Problems = append(report.Problems, SpecProblem{Field: "annotations", Message: err.Error()})
+		return report, nil
+	}
+	p.platform.Close()
+
+	report.Cgroup.ExecSubgroups = p.execSubgroups != nil
+	if q := p.memoryQoS; q != nil {
+		report.Cgroup.MemoryMin, report.Cgroup.MemoryHigh = q.compute(q.limit, int64(os.Getpagesize()))
+	}
+	return report, nil
+}
@@ -0,0 +1,131 @@
+//go:build linux
+// +build linux
+
+package embedshim
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"github.com/containerd/containerd/log"
+	ptypes "github.com/gogo/protobuf/types"
+)
+
+// EnvPolicyConfig strips the environment variables leaked from host, like
+// HTTP_PROXY, before the init and exec processes are created.
+//
+// The pattern is the exact key or the prefix ending with "*", like "LC_*".
+// The variable is stripped if its key matches Deny but not Allow.
+type EnvPolicyConfig struct {
+	Allow []string `toml:"allow"`
+	Deny  []string `toml:"deny"`
+}
+
+func (p *EnvPolicyConfig) enabled() bool {
+	return p != nil && len(p.Deny) > 0
+}
+
+// sanitize returns the kept variables and the stripped keys.
+func (p *EnvPolicyConfig) sanitize(env []string) ([]string, []string) {
+	var (
+		kept     = make([]string, 0, len(env))
+		stripped []string
+	)
+	for _, kv := range env {
+		key := strings.SplitN(kv, "=", 2)[0]
+		if matchEnvPatterns(p.Deny, key) && !matchEnvPatterns(p.Allow, key) {
+			stripped = append(stripped, key)
+			continue
+		}
+		kept = append(kept, kv)
+	}
+	return kept, stripped
+}
+
+func matchEnvPatterns(patterns []string, key string) bool {
+	for _, pattern := range patterns {
+		if strings.HasSuffix(pattern, "*") {
+			if strings.HasPrefix(key, strings.TrimSuffix(pattern, "*")) {
+				return true
+			}
+			continue
+		}
+		if pattern == key {
+			return true
+		}
+	}
+	return false
+}
+
+// sanitizeInitSpecEnv applies the policy on the OCI spec's process.env. The
+// spec is returned as it is if nothing is stripped.
+func (manager *TaskManager) sanitizeInitSpecEnv(ctx context.Context, id string, spec *ptypes.Any) (*ptypes.Any, error) {
+	if manager.config == nil || !manager.config.EnvPolicy.enabled() || spec == nil {
+		return spec, nil
+	}
+
+	return patchRawJSON(spec, "spec", func(root map[string]json.RawMessage) (bool, error) {
+		rawProcess, ok := root["process"]
+		if !ok {
+			return false, nil
+		}
+
+		process, changed, err := manager.sanitizeRawProcessEnv(ctx, id, "", rawProcess)
+		if err != nil || !changed {
+			return false, err
+		}
+		root["process"] = process
+		return true, nil
+	})
+}
+
+// sanitizeExecSpecEnv applies the policy on the exec process spec's env. The
+// spec is returned as it is if nothing is stripped.
+func (manager *TaskManager) sanitizeExecSpecEnv(ctx context.Context, id string, execID string, spec *ptypes.Any) (*ptypes.Any, error) {
+	if manager.config == nil || !manager.config.EnvPolicy.enabled() || spec == nil {
+		return spec, nil
+	}
+
+	value, changed, err := manager.sanitizeRawProcessEnv(ctx, id, execID, spec.Value)
+	if err != nil || !changed {
+		return spec, err
+	}
+	return &ptypes.Any{TypeUrl: spec.TypeUrl, Value: value}, nil
+}
+
+func (manager *TaskManager) sanitizeRawProcessEnv(ctx context.Context, id string, execID string, raw json.RawMessage) (json.RawMessage, bool, error) {
+	var process map[string]json.RawMessage
+	if err := unmarshalRawJSON(raw, "process spec", &process); err != nil {
+		return nil, false, err
+	}
+
+	var env []string
+	if ok, err := unmarshalRawField(process, "env", "process env", &env); err != nil {
+		return nil, false, err
+	} else if !ok {
+		return raw, false, nil
+	}
+
+	kept, stripped := manager.config.EnvPolicy.sanitize(env)
+	if len(stripped) == 0 {
+		return raw, false, nil
+	}
+
+	// NOTE: Only the keys are logged because the values might be secrets.
+	log.G(ctx).WithField("id", id).WithField("exec", execID).WithField("keys", stripped).
+		Warn("stripped environment variables by env policy")
+
+	envValue, err := json.Marshal(kept)
+	if err != nil {
+		return nil, false, err
+	}
+	process["env"] = envValue
+
+	value, err := json.Marshal(process)
+	if err != nil {
+		return nil, false, fmt.Errorf("failed to marshal process spec: %w", err)
+	}
+	return value, true, nil
+}
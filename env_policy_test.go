@@ -0,0 +1,34 @@
+//go:build linux
+// +build linux
+
+package embedshim
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestEnvPolicySanitize(t *testing.T) {
+	policy := &EnvPolicyConfig{
+		Allow: []string{"NO_PROXY"},
+		Deny:  []string{"HTTP_PROXY", "NO_PROXY", "AWS_*"},
+	}
+
+	kept, stripped := policy.sanitize([]string{
+		"PATH=/usr/bin",
+		"HTTP_PROXY=http://127.0.0.1:3128",
+		"NO_PROXY=localhost",
+		"AWS_SECRET_ACCESS_KEY=secret",
+		"HTTP_PROXY_EXTRA=x",
+	})
+
+	expectedKept := []string{"PATH=/usr/bin", "NO_PROXY=localhost", "HTTP_PROXY_EXTRA=x"}
+	if !reflect.DeepEqual(kept, expectedKept) {
+		t.Fatalf("expected %v, but got %v", expectedKept, kept)
+	}
+
+	expectedStripped := []string{"HTTP_PROXY", "AWS_SECRET_ACCESS_KEY"}
+	if !reflect.DeepEqual(stripped, expectedStripped) {
+		t.Fatalf("expected %v, but got %v", expectedStripped, stripped)
+	}
+}
@@ -0,0 +1,25 @@
+package embedshim
+
+import (
+	"context"
+
+	"github.com/containerd/containerd/events"
+	"github.com/containerd/containerd/log"
+	"github.com/containerd/containerd/namespaces"
+)
+
+// publishEvent publishes the task event in the task's namespace.
+//
+// NOTE: The event is always scoped by the namespace which owns the task,
+// instead of the caller's context, so that the subscribers in other
+// namespaces can't receive it even if the tasks share the same ID.
+func (manager *TaskManager) publishEvent(ns string, topic string, event events.Event) {
+	if manager.events == nil {
+		return
+	}
+
+	ctx := namespaces.WithNamespace(context.Background(), ns)
+	if err := manager.events.Publish(ctx, topic, event); err != nil {
+		log.G(ctx).WithError(err).WithField("topic", topic).Warn("failed to publish event")
+	}
+}
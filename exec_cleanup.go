@@ -0,0 +1,70 @@
+//go:build linux
+// +build linux
+
+package embedshim
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/containerd/containerd/errdefs"
+	"github.com/containerd/containerd/log"
+	"golang.org/x/sys/unix"
+)
+
+// lingeringExecTimeout is the max time to wait for the killed exec process
+// to be reaped before the task is deleted.
+var lingeringExecTimeout = 5 * time.Second
+
+// killLingeringExecs kills the running exec processes and waits for their
+// exit events before the init process is deleted with the cgroup.
+//
+// The exec process might outlive the init process if the container shares
+// pid namespace with others. The exec process which isn't reaped in time is
+// marked exited so that the subscribers waiting for its exit event don't
+// hang forever.
+func (s *shim) killLingeringExecs(ctx context.Context) {
+	s.mu.Lock()
+	execs := make([]*execProcess, 0, len(s.execProcesses))
+	for _, p := range s.execProcesses {
+		if e, ok := p.(*execProcess); ok {
+			execs = append(execs, e)
+		}
+	}
+	s.mu.Unlock()
+
+	var wg sync.WaitGroup
+	for _, e := range execs {
+		// The exec process which isn't started has no exit event.
+		if e.Pid() == 0 {
+			continue
+		}
+
+		select {
+		case <-e.waitBlock:
+			continue
+		default:
+		}
+
+		wg.Add(1)
+		go func(e *execProcess) {
+			defer wg.Done()
+
+			if err := e.Kill(ctx, uint32(unix.SIGKILL), false); err != nil && !errdefs.IsNotFound(err) {
+				log.G(ctx).WithError(err).Warnf("failed to kill lingering exec %s of task %s", e.ID(), s.ID())
+			}
+
+			select {
+			case <-e.waitBlock:
+				return
+			case <-time.After(lingeringExecTimeout):
+			}
+
+			log.G(ctx).Warnf("lingering exec %s of task %s isn't reaped in time, mark it exited", e.ID(), s.ID())
+			// 128 + SIGKILL like the shell does.
+			e.SetExited((128 + int(unix.SIGKILL)) << 8)
+		}(e)
+	}
+	wg.Wait()
+}
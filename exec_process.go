@@ -1,3 +1,6 @@
+//go:build linux
+// +build linux
+
 /*
    Copyright The containerd Authors.
 
@@ -26,6 +29,7 @@ import (
 	"path/filepath"
 	"strconv"
 	"sync"
+	"sync/atomic"
 	"syscall"
 	"time"
 
@@ -35,7 +39,9 @@ import (
 
 	"github.com/cilium/ebpf"
 	"github.com/containerd/console"
+	eventstypes "github.com/containerd/containerd/api/events"
 	"github.com/containerd/containerd/errdefs"
+	"github.com/containerd/containerd/log"
 	"github.com/containerd/containerd/pkg/stdio"
 	"github.com/containerd/containerd/runtime"
 	"github.com/containerd/fifo"
@@ -56,17 +62,29 @@ type execProcess struct {
 
 	waitBlock chan struct{}
 
-	stdio   stdio.Stdio
-	console console.Console
-	io      *processIO
-	stdin   io.Closer
-	closers []io.Closer
+	stdio    stdio.Stdio
+	console  console.Console
+	recorder *sessionRecorder
+	io       *processIO
+	stdin    io.Closer
+	closers  []io.Closer
+
+	// subgroup is the exec's leaf cgroup name under the container's
+	// cgroup if sub-grouping is enabled.
+	subgroup string
+
+	// consoleSize is the size requested before the console is received
+	// from runc, which is applied once the console is ready.
+	consoleSize *console.WinSize
 
 	mu     sync.Mutex
 	status int
 	exited time.Time
 	pid    safePid
 	pidFD  pidfd.FD
+	// nsPid is the pid in the container's pid namespace captured during
+	// start so that it is still available after exit.
+	nsPid uint32
 }
 
 func (e *execProcess) ID() string {
@@ -99,13 +117,19 @@ func (e *execProcess) SetExited(status int) {
 }
 
 func (e *execProcess) setExited(status int) {
-	e.status = unix.WaitStatus(status).ExitStatus()
+	e.status = exitStatus(status)
 	e.exited = time.Now()
 
 	if e.parent.platform != nil {
 		e.parent.platform.ShutdownConsole(context.Background(), e.console)
 	}
 	close(e.waitBlock)
+
+	corePath := e.shim().manager.collectCoreDump(e.parent.bundle, e.id, e.pid.get(), status)
+	e.shim().manager.recordExit(e.parent.bundle.Namespace, e.parent.ID(), e.id, e.pid.get(), status, time.Time{}, e.exited, corePath)
+	e.shim().manager.notifyExit(e.parent.bundle.Namespace, e.parent.ID(), e.id, e.pid.get(), uint32(e.status), e.exited)
+	e.shim().publishTaskEvent(runtime.TaskExitEventTopic, e.id, uint32(e.pid.get()),
+		newTaskExit(e.parent.ID(), e.id, uint32(e.pid.get()), uint32(e.status), e.exited, corePath))
 }
 
 func (e *execProcess) CloseIO(_ context.Context) error {
@@ -186,6 +210,7 @@ func (e *execProcess) delete(ctx context.Context) error {
 	// silently ignore error
 	os.Remove(e.pidFilePath())
 	os.Remove(e.processJSONPath())
+	e.removeExecSubgroup(ctx)
 	return nil
 }
 
@@ -201,10 +226,36 @@ func (e *execProcess) ResizePty(_ context.Context, size runtime.ConsoleSize) err
 
 func (e *execProcess) resize(ws console.WinSize) error {
 	if e.console == nil {
+		if e.stdio.Terminal {
+			e.consoleSize = &ws
+		}
+		return nil
+	}
+
+	if err := e.console.Resize(ws); err != nil {
+		return err
+	}
+	e.recorder.resize(ws)
+	return nil
+}
+
+// resizeInitialConsole applies the size requested before the console is
+// ready, or the spec's consoleSize, since runc doesn't resize the console
+// sent by console socket.
+func (e *execProcess) resizeInitialConsole() error {
+	ws := e.consoleSize
+	if ws == nil && e.spec.ConsoleSize != nil {
+		ws = &console.WinSize{
+			Width:  uint16(e.spec.ConsoleSize.Width),
+			Height: uint16(e.spec.ConsoleSize.Height),
+		}
+	}
+	if ws == nil {
 		return nil
 	}
 
-	return e.console.Resize(ws)
+	e.consoleSize = nil
+	return e.resize(*ws)
 }
 
 func (e *execProcess) Kill(ctx context.Context, sig uint32, _ bool) error {
@@ -241,7 +292,16 @@ func (e *execProcess) Start(ctx context.Context) error {
 	e.mu.Lock()
 	defer e.mu.Unlock()
 
-	return e.execState.Start(ctx)
+	if err := e.execState.Start(ctx); err != nil {
+		return err
+	}
+
+	e.shim().publishTaskEvent(runtime.TaskExecStartedEventTopic, e.id, uint32(e.pid.get()), &eventstypes.TaskExecStarted{
+		ContainerID: e.parent.ID(),
+		ExecID:      e.id,
+		Pid:         uint32(e.pid.get()),
+	})
+	return nil
 }
 
 func (e *execProcess) start(ctx context.Context) (retErr error) {
@@ -262,23 +322,41 @@ func (e *execProcess) start(ctx context.Context) (retErr error) {
 		err error
 	)
 
+	if err := e.resolveUser(ctx); err != nil {
+		return err
+	}
+
 	if e.stdio.Terminal {
 		if socket, err = runc.NewTempConsoleSocket(); err != nil {
 			return fmt.Errorf("failed to create runc console socket: %w", err)
 		}
 		defer socket.Close()
+	} else if e.stdio.IsNull() {
+		// NOTE: The exec without stdio only reports the exit code, like
+		// the probe. There is no pipe or copy goroutine.
+	} else if e.parent.ioLimiter == nil && canUseLazyFifoIO(e.stdio) {
+		lio, err := newLazyFifoIO(ioUID, ioGID, e.stdio, &e.wg)
+		if err != nil {
+			return fmt.Errorf("failed to create exec process I/O: %w", err)
+		}
+		pio = &processIO{io: lio, stdio: e.stdio}
+		e.io = pio
 	} else {
-		// FIXME(fuweid):
-		//
-		// Maybe we should use pipe as relay for exec process, because
-		// it should be short-live process. And just in case that
-		// the buffer of fifo by UID will be filled with the log.
-		if pio, err = createIO(ctx, e.id, ioUID, ioGID, e.stdio); err != nil {
+		owner := stdioOwner{namespace: e.parent.bundle.Namespace, containerID: e.parent.ID(), execID: e.id}
+		if pio, err = createIO(ctx, owner, ioUID, ioGID, e.stdio); err != nil {
 			return fmt.Errorf("failed to create exec process I/O: %w", err)
 		}
+		if err = pio.withRateLimit(ioUID, ioGID, e.parent.ioLimiter); err != nil {
+			pio.Close()
+			return fmt.Errorf("failed to rate limit exec process I/O: %w", err)
+		}
 		e.io = pio
 	}
 
+	if e.subgroup, err = e.createExecSubgroup(); err != nil {
+		return fmt.Errorf("failed to create exec cgroup: %w", err)
+	}
+
 	opts := &runc.ExecOpts{
 		PidFile: e.pidFilePath(),
 		Detach:  true,
@@ -325,10 +403,27 @@ func (e *execProcess) start(ctx context.Context) (retErr error) {
 
 					execPid = msg.Pid
 
+					if err := e.applyOOMScoreAdj(execPid); err != nil {
+						return err
+					}
+
+					if prio := e.parent.execIOPrio; prio != nil {
+						if err := prio.apply(int(execPid)); err != nil {
+							return fmt.Errorf("failed to apply ioprio on exec process %d: %w", execPid, err)
+						}
+					}
+
+					if e.parent.coreSched {
+						if err := shareCoreSchedCookie(e.parent.Pid(), int(execPid)); err != nil {
+							return fmt.Errorf("failed to share core scheduling cookie with exec process %d: %w", execPid, err)
+						}
+					}
+
 					nsInfo, err := getPidnsInfo(execPid)
 					if err != nil {
 						return err
 					}
+					atomic.StoreUint32(&e.nsPid, nsPidOf(execPid, e.shim().pidnsLevel()))
 
 					pidFD, err = pidfd.Open(execPid, 0)
 					if err != nil {
@@ -418,7 +513,16 @@ func (e *execProcess) start(ctx context.Context) (retErr error) {
 }
 
 func (e *execProcess) handleIOAfterExec(ctx context.Context, pio *processIO, socket *runc.Socket) error {
-	if e.stdio.Stdin != "" {
+	if isStdinSource(e.stdio.Stdin) {
+		src, err := e.shim().manager.openStdinSource(e.parent.bundle.Namespace, e.stdio.Stdin)
+		if err != nil {
+			return err
+		}
+		pio.copyStdinFrom(src)
+		return nil
+	}
+
+	if e.stdio.Stdin != "" && !isVsockURI(e.stdio.Stdin) {
 		if err := e.openStdin(e.stdio.Stdin); err != nil {
 			return err
 		}
@@ -433,10 +537,17 @@ func (e *execProcess) handleIOAfterExec(ctx context.Context, pio *processIO, soc
 			return fmt.Errorf("failed to retrieve console master: %w", err)
 		}
 
-		if e.console, err = e.parent.platform.CopyConsole(ctx, console, e.id, e.stdio.Stdin, e.stdio.Stdout, e.stdio.Stderr, &e.wg); err != nil {
+		rec := e.shim().manager.openSessionRecording(e.parent.bundle, e.id, &e.spec)
+		if e.console, err = copyRecordedConsole(ctx, e.parent.platform, rec, console, e.id, e.stdio, &e.wg); err != nil {
+			rec.close()
 			return fmt.Errorf("failed to start console copy: %w", err)
 		}
-	} else {
+		e.recorder = rec
+
+		if err := e.resizeInitialConsole(); err != nil {
+			log.G(ctx).WithError(err).Warnf("failed to set initial console size of exec %s", e.id)
+		}
+	} else if pio != nil {
 		if err := pio.CopyStdin(); err != nil {
 			return fmt.Errorf("failed to start io pipe copy: %w", err)
 		}
@@ -445,6 +556,12 @@ func (e *execProcess) handleIOAfterExec(ctx context.Context, pio *processIO, soc
 }
 
 func (e *execProcess) invokeRuncExec(ctx context.Context, opts *runc.ExecOpts, syncFn func(syncPipe *os.File) error) (retErr error) {
+	limiter := e.shim().manager.execStarts
+	if err := limiter.acquire(ctx); err != nil {
+		return fmt.Errorf("failed to wait for exec start slot: %w", err)
+	}
+	defer limiter.release()
+
 	processJSON := e.processJSONPath()
 	stdioFDCnt := 3
 
@@ -475,8 +592,11 @@ func (e *execProcess) invokeRuncExec(ctx context.Context, opts *runc.ExecOpts, s
 		return err
 	}
 	args = append(args, oargs...)
+	if e.subgroup != "" {
+		args = append(args, "--cgroup", e.subgroup)
+	}
 
-	execCmd := runcext.RuntimeCommand(ctx, true, e.parent.runtime, append(args, e.parent.ID())...)
+	execCmd := e.parent.runtime.ExtCommand(ctx, append(args, e.parent.ID())...)
 
 	execCmd.ExtraFiles = append(execCmd.ExtraFiles, childSyncPipe)
 	execCmd.Env = append(execCmd.Env,
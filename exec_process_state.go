@@ -1,3 +1,6 @@
+//go:build linux
+// +build linux
+
 /*
    Copyright The containerd Authors.
 
@@ -55,6 +58,10 @@ func (s *execCreatedState) Resize(ws console.WinSize) error {
 }
 
 func (s *execCreatedState) Start(ctx context.Context) error {
+	if err := s.p.parent.checkExecStart(s.p.id); err != nil {
+		return err
+	}
+
 	if err := s.p.start(ctx); err != nil {
 		return err
 	}
@@ -0,0 +1,107 @@
+//go:build linux
+// +build linux
+
+package embedshim
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+
+	"github.com/containerd/containerd/errdefs"
+	"github.com/containerd/containerd/runtime"
+	ptypes "github.com/gogo/protobuf/types"
+	"github.com/opencontainers/runtime-spec/specs-go"
+)
+
+// processSpecTypeURL is the type URL used by containerd for the exec process
+// spec.
+var processSpecTypeURL = "types.containerd.io/opencontainers/runtime-spec/1/Process"
+
+// ExecProfile is the named exec process template registered with the
+// container by annotation. The unset fields inherit from the init process.
+type ExecProfile struct {
+	Args []string `json:"args"`
+	// Env are merged into the init process's env in KEY=VALUE format.
+	Env      []string    `json:"env,omitempty"`
+	User     *specs.User `json:"user,omitempty"`
+	Cwd      string      `json:"cwd,omitempty"`
+	Terminal bool        `json:"terminal,omitempty"`
+}
+
+func execProfilesFromAnnotations(annotations map[string]string) (map[string]ExecProfile, error) {
+	v, ok := annotations[annotationExecProfiles]
+	if !ok || v == "" {
+		return nil, nil
+	}
+
+	var profiles map[string]ExecProfile
+	if err := json.Unmarshal([]byte(v), &profiles); err != nil {
+		return nil, fmt.Errorf("invalid annotation %s: %v: %w", annotationExecProfiles, err, errdefs.ErrInvalidArgument)
+	}
+
+	for name, profile := range profiles {
+		if len(profile.Args) == 0 {
+			return nil, fmt.Errorf("exec profile %s without args: %w", name, errdefs.ErrInvalidArgument)
+		}
+	}
+	return profiles, nil
+}
+
+// ExecProfile creates the exec process by the named profile. The caller
+// starts it like the other exec processes.
+func (manager *TaskManager) ExecProfile(ctx context.Context, id, execID, name string, io runtime.IO) (runtime.Process, error) {
+	t, err := manager.tasks.Get(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+
+	s, ok := t.(*shim)
+	if !ok {
+		return nil, errdefs.ErrNotImplemented
+	}
+
+	profile, ok := s.init.execProfiles[name]
+	if !ok {
+		return nil, fmt.Errorf("exec profile %s of task %s: %w", name, id, errdefs.ErrNotFound)
+	}
+
+	if profile.Terminal != io.Terminal {
+		return nil, fmt.Errorf("exec profile %s requires terminal=%v: %w", name, profile.Terminal, errdefs.ErrInvalidArgument)
+	}
+
+	spec, err := s.execSpecFromProfile(profile)
+	if err != nil {
+		return nil, err
+	}
+	return s.Exec(ctx, execID, runtime.ExecOpts{Spec: spec, IO: io})
+}
+
+// execSpecFromProfile builds the exec process spec based on the init
+// process's spec.
+func (s *shim) execSpecFromProfile(profile ExecProfile) (*ptypes.Any, error) {
+	spec, err := readInitOCISpec(s.bundle)
+	if err != nil {
+		return nil, err
+	}
+	if spec.Process == nil {
+		return nil, fmt.Errorf("spec without process: %w", errdefs.ErrFailedPrecondition)
+	}
+
+	proc := *spec.Process
+	proc.Args = profile.Args
+	proc.Terminal = profile.Terminal
+	proc.Env = mergeEnv(proc.Env, profile.Env)
+	if profile.User != nil {
+		proc.User = *profile.User
+	}
+	if profile.Cwd != "" {
+		proc.Cwd = profile.Cwd
+	}
+
+	value, err := json.Marshal(&proc)
+	if err != nil {
+		return nil, err
+	}
+	return &ptypes.Any{TypeUrl: processSpecTypeURL, Value: value}, nil
+}
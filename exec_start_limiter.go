@@ -0,0 +1,47 @@
+//go:build linux
+// +build linux
+
+package embedshim
+
+import "context"
+
+// execStartLimiter bounds the number of in-flight runcext exec invocations.
+//
+// The exec process is started by `runc exec --detach` with pid-file, and
+// the runcext hands over the pidfd and exits, so that the started exec
+// process only holds one pidfd in the epoller and one slot in the exitsnoop
+// map. However, each starting exec still holds the runcext and runc
+// children, their sync socketpair and stdio. The limiter queues the
+// starts during exec storm instead of forking thousands of runc children,
+// and their SIGCHLDs, at the same time.
+//
+// The nil limiter means unlimited.
+type execStartLimiter chan struct{}
+
+func newExecStartLimiter(n int) execStartLimiter {
+	if n <= 0 {
+		return nil
+	}
+	return make(execStartLimiter, n)
+}
+
+// acquire waits for the slot until the context is done.
+func (l execStartLimiter) acquire(ctx context.Context) error {
+	if l == nil {
+		return nil
+	}
+
+	select {
+	case l <- struct{}{}:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (l execStartLimiter) release() {
+	if l == nil {
+		return
+	}
+	<-l
+}
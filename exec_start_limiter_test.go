@@ -0,0 +1,44 @@
+//go:build linux
+// +build linux
+
+package embedshim
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestExecStartLimiter(t *testing.T) {
+	l := newExecStartLimiter(1)
+
+	if err := l.acquire(context.Background()); err != nil {
+		t.Fatalf("expected nil, but got %v", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if err := l.acquire(ctx); err != context.DeadlineExceeded {
+		t.Fatalf("expected %v, but got %v", context.DeadlineExceeded, err)
+	}
+
+	l.release()
+	if err := l.acquire(context.Background()); err != nil {
+		t.Fatalf("expected nil, but got %v", err)
+	}
+	l.release()
+}
+
+func TestExecStartLimiterUnlimited(t *testing.T) {
+	l := newExecStartLimiter(0)
+	if l != nil {
+		t.Fatalf("expected nil limiter, but got %v", cap(l))
+	}
+
+	for i := 0; i < 10; i++ {
+		if err := l.acquire(context.Background()); err != nil {
+			t.Fatalf("expected nil, but got %v", err)
+		}
+	}
+	l.release()
+}
@@ -0,0 +1,140 @@
+//go:build linux
+// +build linux
+
+package embedshim
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+
+	"github.com/containerd/containerd/errdefs"
+	"github.com/containerd/containerd/log"
+	"github.com/containerd/continuity/fs"
+	"github.com/opencontainers/runc/libcontainer/user"
+	"github.com/opencontainers/runtime-spec/specs-go"
+)
+
+// resolveUser resolves the exec process's user against the container's
+// /etc/passwd and /etc/group before invoking OCI runtime, so that the
+// unknown user is reported clearly instead of the runc's exec failure.
+//
+// The username, like "nobody" or "nobody:nogroup", is resolved into the
+// uid, gid and the supplementary groups of /etc/group like runc. The
+// resolved ids must be mapped if the container has user namespace.
+func (e *execProcess) resolveUser(ctx context.Context) error {
+	u := &e.spec.User
+
+	if u.Username != "" {
+		root := filepath.Join("/proc", strconv.Itoa(e.parent.Pid()), "root")
+		execUser, err := lookupExecUser(root, u.Username)
+		if err != nil {
+			return fmt.Errorf("exec %s: %v: %w", e.id, err, errdefs.ErrInvalidArgument)
+		}
+
+		u.UID, u.GID = uint32(execUser.Uid), uint32(execUser.Gid)
+		u.AdditionalGids = mergeAdditionalGids(u.AdditionalGids, execUser.Sgids)
+		u.Username = ""
+
+		log.G(ctx).Debugf("resolved user of exec %s in task %s: uid=%d gid=%d groups=%v",
+			e.id, e.parent.ID(), u.UID, u.GID, u.AdditionalGids)
+	}
+
+	spec, err := readInitOCISpec(e.parent.bundle)
+	if err != nil {
+		return err
+	}
+	if err := checkUserMapped(spec.Linux, *u); err != nil {
+		return fmt.Errorf("exec %s: %v: %w", e.id, err, errdefs.ErrInvalidArgument)
+	}
+	return nil
+}
+
+// lookupExecUser resolves the user spec in the rootfs. The files are
+// resolved in the rootfs scope so that the symlink doesn't escape.
+func lookupExecUser(root, userSpec string) (*user.ExecUser, error) {
+	open := func(name string) (io.ReadCloser, error) {
+		pathname, err := fs.RootPath(root, name)
+		if err != nil {
+			return nil, err
+		}
+
+		f, err := os.Open(pathname)
+		if err != nil {
+			if os.IsNotExist(err) {
+				return nil, nil
+			}
+			return nil, err
+		}
+		return f, nil
+	}
+
+	passwd, err := open("/etc/passwd")
+	if err != nil {
+		return nil, fmt.Errorf("failed to open /etc/passwd: %w", err)
+	}
+	if passwd != nil {
+		defer passwd.Close()
+	}
+
+	group, err := open("/etc/group")
+	if err != nil {
+		return nil, fmt.Errorf("failed to open /etc/group: %w", err)
+	}
+	if group != nil {
+		defer group.Close()
+	}
+	return user.GetExecUser(userSpec, &user.ExecUser{}, passwd, group)
+}
+
+// mergeAdditionalGids appends the supplementary groups which aren't in the
+// gids.
+func mergeAdditionalGids(gids []uint32, sgids []int) []uint32 {
+	seen := make(map[uint32]struct{}, len(gids))
+	for _, gid := range gids {
+		seen[gid] = struct{}{}
+	}
+
+	for _, sgid := range sgids {
+		gid := uint32(sgid)
+		if _, ok := seen[gid]; ok {
+			continue
+		}
+		seen[gid] = struct{}{}
+		gids = append(gids, gid)
+	}
+	return gids
+}
+
+// checkUserMapped returns error if the uid, gid or the additional gids
+// aren't mapped in the container's user namespace.
+func checkUserMapped(linux *specs.Linux, u specs.User) error {
+	if linux == nil {
+		return nil
+	}
+
+	if len(linux.UIDMappings) > 0 && !idMapped(linux.UIDMappings, u.UID) {
+		return fmt.Errorf("uid %d isn't mapped in the container's user namespace", u.UID)
+	}
+
+	if len(linux.GIDMappings) > 0 {
+		for _, gid := range append([]uint32{u.GID}, u.AdditionalGids...) {
+			if !idMapped(linux.GIDMappings, gid) {
+				return fmt.Errorf("gid %d isn't mapped in the container's user namespace", gid)
+			}
+		}
+	}
+	return nil
+}
+
+func idMapped(mappings []specs.LinuxIDMapping, id uint32) bool {
+	for _, m := range mappings {
+		if id >= m.ContainerID && uint64(id) < uint64(m.ContainerID)+uint64(m.Size) {
+			return true
+		}
+	}
+	return false
+}
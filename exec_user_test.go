@@ -0,0 +1,87 @@
+//go:build linux
+// +build linux
+
+package embedshim
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/opencontainers/runtime-spec/specs-go"
+)
+
+func TestLookupExecUser(t *testing.T) {
+	root := t.TempDir()
+	if err := os.MkdirAll(filepath.Join(root, "etc"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(root, "etc", "passwd"),
+		[]byte("root:x:0:0:root:/root:/bin/sh\nalice:x:1000:1000::/home/alice:/bin/sh\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(root, "etc", "group"),
+		[]byte("root:x:0:\nalice:x:1000:\nwheel:x:10:alice\nstaff:x:50:\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	u, err := lookupExecUser(root, "alice")
+	if err != nil {
+		t.Fatalf("failed to lookup alice: %v", err)
+	}
+	if u.Uid != 1000 || u.Gid != 1000 || !reflect.DeepEqual(u.Sgids, []int{10}) {
+		t.Fatalf("unexpected user %+v", u)
+	}
+
+	u, err = lookupExecUser(root, "alice:staff")
+	if err != nil {
+		t.Fatalf("failed to lookup alice:staff: %v", err)
+	}
+	if u.Gid != 50 {
+		t.Fatalf("expected gid 50, but got %v", u.Gid)
+	}
+
+	if _, err := lookupExecUser(root, "bob"); err == nil {
+		t.Fatalf("expected error for unknown user")
+	}
+
+	// the user can't be resolved without /etc/passwd
+	if _, err := lookupExecUser(t.TempDir(), "alice"); err == nil {
+		t.Fatalf("expected error without /etc/passwd")
+	}
+}
+
+func TestMergeAdditionalGids(t *testing.T) {
+	got := mergeAdditionalGids([]uint32{10, 20}, []int{20, 30, 30})
+	expected := []uint32{10, 20, 30}
+	if !reflect.DeepEqual(got, expected) {
+		t.Fatalf("expected %v, but got %v", expected, got)
+	}
+}
+
+func TestCheckUserMapped(t *testing.T) {
+	linux := &specs.Linux{
+		UIDMappings: []specs.LinuxIDMapping{{ContainerID: 0, HostID: 100000, Size: 65536}},
+		GIDMappings: []specs.LinuxIDMapping{{ContainerID: 0, HostID: 100000, Size: 1000}},
+	}
+
+	for _, tc := range []struct {
+		user specs.User
+		ok   bool
+	}{
+		{user: specs.User{UID: 1000, GID: 10}, ok: true},
+		{user: specs.User{UID: 65536, GID: 10}, ok: false},
+		{user: specs.User{UID: 1000, GID: 1000}, ok: false},
+		{user: specs.User{UID: 1000, GID: 10, AdditionalGids: []uint32{999, 2000}}, ok: false},
+	} {
+		err := checkUserMapped(linux, tc.user)
+		if got := err == nil; got != tc.ok {
+			t.Fatalf("expected ok=%v for %+v, but got %v", tc.ok, tc.user, err)
+		}
+	}
+
+	if err := checkUserMapped(nil, specs.User{UID: 12345}); err != nil {
+		t.Fatalf("expected nil, but got %v", err)
+	}
+}
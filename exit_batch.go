@@ -0,0 +1,163 @@
+//go:build linux
+// +build linux
+
+package embedshim
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	eventstypes "github.com/containerd/containerd/api/events"
+	"github.com/containerd/containerd/events"
+	"github.com/containerd/containerd/log"
+	"github.com/containerd/typeurl"
+)
+
+// TaskExitBatchEventTopic is the topic of TaskExitBatch event.
+const TaskExitBatchEventTopic = "/tasks/exit-batch"
+
+var defaultExitEventBatchMaxLatency = 10 * time.Millisecond
+
+func init() {
+	typeurl.Register(&TaskExitBatch{}, "io.embedshim.events.v1", "TaskExitBatch")
+}
+
+// ExitEventBatchConfig is the configuration of TaskExit event batching.
+type ExitEventBatchConfig struct {
+	// MaxBatch is the max number of TaskExit events in one batch. Zero
+	// disables batching.
+	MaxBatch int `toml:"max_batch"`
+
+	// MaxLatency is the max delay of the TaskExit event, like "10ms".
+	MaxLatency string `toml:"max_latency"`
+}
+
+// TaskExitBatch carries the TaskExit events in the same namespace in the
+// order of exit. It replaces the TaskExit events when batching is enabled so
+// the subscribers must handle it instead.
+type TaskExitBatch struct {
+	Exits []*eventstypes.TaskExit `json:"exits"`
+}
+
+// Field implements events.Event.
+func (e *TaskExitBatch) Field(fieldpath []string) (string, bool) {
+	return "", false
+}
+
+// exitEventBatcher groups the TaskExit events by namespace and publishes them
+// if the batch is full or the oldest event reaches max latency.
+//
+// The task's other events flush the pending TaskExit events of the same task
+// first so that the order in the task is kept.
+type exitEventBatcher struct {
+	publish    func(ns string, topic string, event events.Event)
+	maxBatch   int
+	maxLatency time.Duration
+
+	// publishMu serializes taking batches and publishing them so that the
+	// batches are published in order.
+	publishMu sync.Mutex
+
+	mu      sync.Mutex
+	pending map[string][]*eventstypes.TaskExit
+	timer   *time.Timer
+}
+
+// newExitEventBatcher returns nil if batching is disabled.
+func newExitEventBatcher(cfg ExitEventBatchConfig, publish func(ns string, topic string, event events.Event)) *exitEventBatcher {
+	if cfg.MaxBatch <= 0 {
+		return nil
+	}
+
+	maxLatency := defaultExitEventBatchMaxLatency
+	if cfg.MaxLatency != "" {
+		d, err := time.ParseDuration(cfg.MaxLatency)
+		if err != nil || d <= 0 {
+			log.G(context.Background()).WithError(err).Warnf("invalid exit_event_batch.max_latency %q, use %s",
+				cfg.MaxLatency, defaultExitEventBatchMaxLatency)
+		} else {
+			maxLatency = d
+		}
+	}
+
+	return &exitEventBatcher{
+		publish:    publish,
+		maxBatch:   cfg.MaxBatch,
+		maxLatency: maxLatency,
+		pending:    make(map[string][]*eventstypes.TaskExit),
+	}
+}
+
+// add queues the TaskExit event and publishes the batch if it is full.
+func (b *exitEventBatcher) add(ns string, ev *eventstypes.TaskExit) {
+	b.publishMu.Lock()
+	defer b.publishMu.Unlock()
+
+	b.mu.Lock()
+	b.pending[ns] = append(b.pending[ns], ev)
+	if len(b.pending[ns]) < b.maxBatch {
+		if b.timer == nil {
+			b.timer = time.AfterFunc(b.maxLatency, b.flushAll)
+		}
+		b.mu.Unlock()
+		return
+	}
+	exits := b.takeLocked(ns)
+	b.mu.Unlock()
+
+	b.publishBatch(ns, exits)
+}
+
+// flushTask publishes the pending batch in the namespace if it has the
+// task's TaskExit event.
+func (b *exitEventBatcher) flushTask(ns string, containerID string) {
+	b.publishMu.Lock()
+	defer b.publishMu.Unlock()
+
+	b.mu.Lock()
+	var exits []*eventstypes.TaskExit
+	for _, ev := range b.pending[ns] {
+		if ev.ContainerID == containerID {
+			exits = b.takeLocked(ns)
+			break
+		}
+	}
+	b.mu.Unlock()
+
+	b.publishBatch(ns, exits)
+}
+
+func (b *exitEventBatcher) flushAll() {
+	b.publishMu.Lock()
+	defer b.publishMu.Unlock()
+
+	b.mu.Lock()
+	batches := make(map[string][]*eventstypes.TaskExit, len(b.pending))
+	for ns := range b.pending {
+		batches[ns] = b.takeLocked(ns)
+	}
+	b.mu.Unlock()
+
+	for ns, exits := range batches {
+		b.publishBatch(ns, exits)
+	}
+}
+
+func (b *exitEventBatcher) takeLocked(ns string) []*eventstypes.TaskExit {
+	exits := b.pending[ns]
+	delete(b.pending, ns)
+
+	if len(b.pending) == 0 && b.timer != nil {
+		b.timer.Stop()
+		b.timer = nil
+	}
+	return exits
+}
+
+func (b *exitEventBatcher) publishBatch(ns string, exits []*eventstypes.TaskExit) {
+	if len(exits) == 0 {
+		return
+	}
+	b.publish(ns, TaskExitBatchEventTopic, &TaskExitBatch{Exits: exits})
+}
@@ -0,0 +1,173 @@
+//go:build linux
+// +build linux
+
+package embedshim
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/containerd/containerd/errdefs"
+	"golang.org/x/sys/unix"
+)
+
+// defaultExitNotifierMaxPending is the max number of the undrained exits of
+// one notifier. The oldest ones are dropped first.
+var defaultExitNotifierMaxPending = 4096
+
+// ExitNotification is the exit of the task's process.
+type ExitNotification struct {
+	Namespace   string
+	ContainerID string
+	// ExecID is empty for the init process.
+	ExecID     string
+	Pid        uint32
+	ExitStatus uint32
+	ExitedAt   time.Time
+}
+
+// ExitNotifier is the eventfd-based exit subscription for the embedder
+// which integrates into its own epoll loop instead of waiting in goroutines.
+// The FD becomes readable when any task's process exits, and Drain returns
+// the exits since the previous Drain in the order of exit.
+type ExitNotifier struct {
+	fd         int
+	maxPending int
+
+	mu      sync.Mutex
+	pending []ExitNotification
+	dropped uint64
+	closed  bool
+
+	set *exitNotifierSet
+}
+
+// NewExitNotifier subscribes the exits of the tasks in all namespaces. The
+// caller must close the returned notifier.
+func (manager *TaskManager) NewExitNotifier() (*ExitNotifier, error) {
+	fd, err := unix.Eventfd(0, unix.EFD_CLOEXEC|unix.EFD_NONBLOCK)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create eventfd: %w", err)
+	}
+
+	n := &ExitNotifier{
+		fd:         fd,
+		maxPending: defaultExitNotifierMaxPending,
+		set:        &manager.exitNotifiers,
+	}
+	manager.exitNotifiers.add(n)
+	return n, nil
+}
+
+// FD returns the non-blocking eventfd which is readable if there are
+// pending exits. The caller must not read or close it, but use Drain and
+// Close instead.
+func (n *ExitNotifier) FD() int {
+	return n.fd
+}
+
+// Drain returns the pending exits and resets the FD's readiness. The
+// dropped is the number of the exits dropped since the previous Drain
+// because the embedder didn't drain in time.
+func (n *ExitNotifier) Drain() (exits []ExitNotification, dropped uint64, _ error) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	if n.closed {
+		return nil, 0, fmt.Errorf("exit notifier is closed: %w", errdefs.ErrFailedPrecondition)
+	}
+
+	// NOTE: The counter is reset under the lock so that the exit queued
+	// after that makes the FD readable again.
+	buf := make([]byte, 8)
+	if _, err := unix.Read(n.fd, buf); err != nil && !errors.Is(err, unix.EAGAIN) {
+		return nil, 0, fmt.Errorf("failed to read eventfd: %w", err)
+	}
+
+	exits, dropped = n.pending, n.dropped
+	n.pending, n.dropped = nil, 0
+	return exits, dropped, nil
+}
+
+// Close unsubscribes the exits and closes the FD.
+func (n *ExitNotifier) Close() error {
+	n.set.remove(n)
+
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	if n.closed {
+		return nil
+	}
+	n.closed = true
+	n.pending = nil
+	return unix.Close(n.fd)
+}
+
+func (n *ExitNotifier) notify(exit ExitNotification) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	if n.closed {
+		return
+	}
+
+	if len(n.pending) >= n.maxPending {
+		n.pending = n.pending[1:]
+		n.dropped++
+	}
+	n.pending = append(n.pending, exit)
+
+	buf := make([]byte, 8)
+	binary.LittleEndian.PutUint64(buf, 1)
+	// NOTE: The write only fails with EAGAIN if the counter overflows,
+	// and the FD is readable in that case.
+	unix.Write(n.fd, buf)
+}
+
+// exitNotifierSet is the subscribed exit notifiers.
+type exitNotifierSet struct {
+	mu        sync.Mutex
+	notifiers map[*ExitNotifier]struct{}
+}
+
+func (set *exitNotifierSet) add(n *ExitNotifier) {
+	set.mu.Lock()
+	defer set.mu.Unlock()
+
+	if set.notifiers == nil {
+		set.notifiers = make(map[*ExitNotifier]struct{})
+	}
+	set.notifiers[n] = struct{}{}
+}
+
+func (set *exitNotifierSet) remove(n *ExitNotifier) {
+	set.mu.Lock()
+	defer set.mu.Unlock()
+
+	delete(set.notifiers, n)
+}
+
+func (set *exitNotifierSet) notify(exit ExitNotification) {
+	set.mu.Lock()
+	defer set.mu.Unlock()
+
+	for n := range set.notifiers {
+		n.notify(exit)
+	}
+}
+
+// notifyExit queues the process's exit into the subscribed exit notifiers.
+func (manager *TaskManager) notifyExit(ns, id, execID string, pid int, exitStatus uint32, exitedAt time.Time) {
+	manager.exitNotifiers.notify(ExitNotification{
+		Namespace:   ns,
+		ContainerID: id,
+		ExecID:      execID,
+		Pid:         uint32(pid),
+		ExitStatus:  exitStatus,
+		ExitedAt:    exitedAt,
+	})
+}
@@ -0,0 +1,67 @@
+//go:build linux
+// +build linux
+
+package embedshim
+
+import (
+	"testing"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+func exitNotifierReadable(t *testing.T, n *ExitNotifier) bool {
+	fds := []unix.PollFd{{Fd: int32(n.FD()), Events: unix.POLLIN}}
+	nr, err := unix.Poll(fds, 0)
+	if err != nil {
+		t.Fatalf("failed to poll: %v", err)
+	}
+	return nr == 1
+}
+
+func TestExitNotifier(t *testing.T) {
+	manager := &TaskManager{}
+
+	n, err := manager.NewExitNotifier()
+	if err != nil {
+		t.Fatalf("failed to create exit notifier: %v", err)
+	}
+	defer n.Close()
+	n.maxPending = 2
+
+	if exitNotifierReadable(t, n) {
+		t.Fatalf("expected unreadable fd without exits")
+	}
+
+	now := time.Now()
+	manager.notifyExit("default", "c1", "", 1, 0, now)
+	manager.notifyExit("default", "c1", "e1", 2, 137, now)
+	manager.notifyExit("k8s.io", "c2", "", 3, 1, now)
+
+	if !exitNotifierReadable(t, n) {
+		t.Fatalf("expected readable fd after exits")
+	}
+
+	exits, dropped, err := n.Drain()
+	if err != nil {
+		t.Fatalf("failed to drain: %v", err)
+	}
+	if dropped != 1 {
+		t.Fatalf("expected 1 dropped exit, but got %v", dropped)
+	}
+	if len(exits) != 2 || exits[0].ExecID != "e1" || exits[0].ExitStatus != 137 || exits[1].Namespace != "k8s.io" {
+		t.Fatalf("expected exits of e1 and c2, but got %+v", exits)
+	}
+
+	if exitNotifierReadable(t, n) {
+		t.Fatalf("expected unreadable fd after drain")
+	}
+
+	if err := n.Close(); err != nil {
+		t.Fatalf("failed to close: %v", err)
+	}
+	manager.notifyExit("default", "c3", "", 4, 0, now)
+	if _, _, err := n.Drain(); err == nil {
+		t.Fatalf("expected error for closed notifier, but got nil")
+	}
+}
@@ -0,0 +1,119 @@
+//go:build linux
+// +build linux
+
+package embedshim
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/containerd/cgroups"
+	cgroupsv2 "github.com/containerd/cgroups/v2"
+	"github.com/containerd/containerd/errdefs"
+	"github.com/sirupsen/logrus"
+)
+
+// exitPolicy decides when the task is reported as exited.
+type exitPolicy string
+
+const (
+	// exitPolicyInitExit reports the task exit right after the init
+	// process exits. It is default policy.
+	exitPolicyInitExit exitPolicy = "init-exit"
+
+	// exitPolicyCgroupEmpty keeps the task running until the cgroup is
+	// empty.
+	//
+	// NOTE: If the container has its own pid namespace, the kernel kills
+	// all the processes in that namespace when the init process exits.
+	// The policy only makes difference for the container sharing pid
+	// namespace with others, whose grandchildren can outlive the init.
+	exitPolicyCgroupEmpty exitPolicy = "cgroup-empty"
+)
+
+var cgroupEmptyPollInterval = 500 * time.Millisecond
+
+func exitPolicyFromAnnotations(annotations map[string]string) (exitPolicy, error) {
+	v, ok := annotations[annotationExitPolicy]
+	if !ok || v == "" {
+		return exitPolicyInitExit, nil
+	}
+
+	switch policy := exitPolicy(v); policy {
+	case exitPolicyInitExit, exitPolicyCgroupEmpty:
+		return policy, nil
+	default:
+		return "", fmt.Errorf("invalid annotation %s=%q: %w", annotationExitPolicy, v, errdefs.ErrInvalidArgument)
+	}
+}
+
+// waitCgroupEmpty blocks until there is no process in the task's cgroup. The
+// cgroup is captured by the caller so that the polling goroutine doesn't
+// race with the shim which reloads it.
+func (s *shim) waitCgroupEmpty(cg interface{}) {
+	ticker := time.NewTicker(cgroupEmptyPollInterval)
+	defer ticker.Stop()
+
+	for {
+		populated, err := cgroupPopulated(cg)
+		if err != nil {
+			logrus.WithError(err).Warnf("failed to check cgroup of task %s, treat it as empty", s.ID())
+			return
+		}
+		if !populated {
+			return
+		}
+		<-ticker.C
+	}
+}
+
+// cgroupPopulated returns true if there is any process in the cgroup.
+func cgroupPopulated(cg interface{}) (bool, error) {
+	pids, err := pidsOfCgroup(cg)
+	if err != nil {
+		return false, err
+	}
+	return len(pids) > 0, nil
+}
+
+// cgroupPids returns the pids of the processes in the task's cgroup,
+// including the sub-cgroups.
+func (s *shim) cgroupPids() ([]int, error) {
+	return pidsOfCgroup(s.cg)
+}
+
+// pidsOfCgroup returns the pids of the processes in the cgroup, including the
+// sub-cgroups.
+func pidsOfCgroup(cgx interface{}) ([]int, error) {
+	switch cg := cgx.(type) {
+	case nil:
+		return nil, nil
+	case cgroups.Cgroup:
+		procs, err := cg.Processes(cgroups.Freezer, true)
+		if err != nil {
+			if cg.State() == cgroups.Deleted {
+				return nil, nil
+			}
+			return nil, err
+		}
+
+		pids := make([]int, 0, len(procs))
+		for _, p := range procs {
+			pids = append(pids, p.Pid)
+		}
+		return pids, nil
+	case *cgroupsv2.Manager:
+		procs, err := cg.Procs(true)
+		if err != nil {
+			return nil, err
+		}
+
+		pids := make([]int, 0, len(procs))
+		for _, p := range procs {
+			pids = append(pids, int(p))
+		}
+		return pids, nil
+	default:
+		return nil, fmt.Errorf("unsupported cgroup type %T: %w", cg, errdefs.ErrNotImplemented)
+	}
+}
@@ -0,0 +1,350 @@
+//go:build linux
+// +build linux
+
+package embedshim
+
+import (
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"path/filepath"
+	"strconv"
+	"time"
+
+	"github.com/containerd/containerd/errdefs"
+	"github.com/containerd/containerd/filters"
+	"github.com/containerd/containerd/log"
+	"github.com/containerd/containerd/namespaces"
+	bolt "go.etcd.io/bbolt"
+	"golang.org/x/sys/unix"
+)
+
+var (
+	exitRecordsDBName        = "exit_records.db"
+	exitRecordsBucketVersion = "v1"
+
+	defaultExitRecordsRetention = 7 * 24 * time.Hour
+	defaultExitRecordsPageSize  = 100
+	exitRecordsPruneInterval    = time.Hour
+)
+
+// ExitRecordsConfig keeps the exit records of the init and exec processes
+// so that they can be queried by ExitRecords after the TaskExit events.
+type ExitRecordsConfig struct {
+	Enabled bool `toml:"enabled"`
+	// Retention is how long the records are kept, like "168h", which is
+	// the default.
+	Retention string `toml:"retention"`
+	// MaxRecords is the max number of the records in each namespace. The
+	// oldest ones are removed first. Zero means no limit.
+	MaxRecords int `toml:"max_records"`
+}
+
+// ExitRecord is the historical exit of the task's process.
+type ExitRecord struct {
+	Namespace   string `json:"namespace"`
+	ContainerID string `json:"container_id"`
+	// ExecID is empty for the init process.
+	ExecID     string `json:"exec_id,omitempty"`
+	Pid        uint32 `json:"pid"`
+	ExitStatus uint32 `json:"exit_status"`
+	// Signal is the signal which killed the process. It is zero if the
+	// process exited normally.
+	Signal     uint32 `json:"signal,omitempty"`
+	CoreDumped bool   `json:"core_dumped,omitempty"`
+	// CorePath is the path of the collected core file.
+	CorePath  string    `json:"core_path,omitempty"`
+	StartedAt time.Time `json:"started_at,omitempty"`
+	ExitedAt  time.Time `json:"exited_at"`
+}
+
+// Field implements filters.Adaptor so that the records can be filtered by
+// containerd filter syntax, like container_id==redis,exit_status!=0.
+func (r ExitRecord) Field(fieldpath []string) (string, bool) {
+	if len(fieldpath) == 0 {
+		return "", false
+	}
+
+	switch fieldpath[0] {
+	case "container_id":
+		return r.ContainerID, len(r.ContainerID) > 0
+	case "exec_id":
+		return r.ExecID, len(r.ExecID) > 0
+	case "pid":
+		return strconv.FormatUint(uint64(r.Pid), 10), true
+	case "exit_status":
+		return strconv.FormatUint(uint64(r.ExitStatus), 10), true
+	case "signal":
+		return strconv.FormatUint(uint64(r.Signal), 10), true
+	case "core_dumped":
+		return strconv.FormatBool(r.CoreDumped), true
+	}
+	return "", false
+}
+
+// ExitRecordQuery selects the exit records in the namespace of the
+// context. The records are returned from the newest one.
+type ExitRecordQuery struct {
+	// Filters are containerd filters on the record's fields.
+	Filters []string
+	// Since and Until are the range of ExitedAt. The zero value means
+	// unbounded.
+	Since time.Time
+	Until time.Time
+	// Limit is the page size. The default is 100.
+	Limit int
+	// PageToken is the NextPageToken of the previous page.
+	PageToken string
+}
+
+// ExitRecordPage is one page of the query result.
+type ExitRecordPage struct {
+	Records []ExitRecord
+	// NextPageToken is empty if there are no more records.
+	NextPageToken string
+}
+
+// exitRecordStore persists the exit records in bolt db. The records are
+// keyed by the namespace's sequence so that they are sorted by exit.
+type exitRecordStore struct {
+	db         *bolt.DB
+	retention  time.Duration
+	maxRecords int
+}
+
+func newExitRecordStore(storeDir string, cfg ExitRecordsConfig) (*exitRecordStore, error) {
+	retention := defaultExitRecordsRetention
+	if cfg.Retention != "" {
+		d, err := time.ParseDuration(cfg.Retention)
+		if err != nil || d <= 0 {
+			return nil, fmt.Errorf("invalid exit records retention %q: %w", cfg.Retention, errdefs.ErrInvalidArgument)
+		}
+		retention = d
+	}
+
+	db, err := bolt.Open(filepath.Join(storeDir, exitRecordsDBName), 0644, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open db in %s: %w", storeDir, err)
+	}
+	return &exitRecordStore{db: db, retention: retention, maxRecords: cfg.MaxRecords}, nil
+}
+
+func (store *exitRecordStore) add(r *ExitRecord) error {
+	value, err := json.Marshal(r)
+	if err != nil {
+		return err
+	}
+
+	return store.db.Update(func(tx *bolt.Tx) error {
+		bkt, err := createExitRecordsBucket(tx, r.Namespace)
+		if err != nil {
+			return err
+		}
+
+		seq, err := bkt.NextSequence()
+		if err != nil {
+			return fmt.Errorf("failed to get next sequence: %w", err)
+		}
+		return bkt.Put(exitRecordKey(seq), value)
+	})
+}
+
+func (store *exitRecordStore) query(ns string, q ExitRecordQuery) (*ExitRecordPage, error) {
+	filter, err := filters.ParseAll(q.Filters...)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", err.Error(), errdefs.ErrInvalidArgument)
+	}
+
+	limit := q.Limit
+	if limit <= 0 {
+		limit = defaultExitRecordsPageSize
+	}
+
+	var start uint64
+	if q.PageToken != "" {
+		if start, err = strconv.ParseUint(q.PageToken, 10, 64); err != nil {
+			return nil, fmt.Errorf("invalid page token %q: %w", q.PageToken, errdefs.ErrInvalidArgument)
+		}
+	}
+
+	page := &ExitRecordPage{}
+	err = store.db.View(func(tx *bolt.Tx) error {
+		bkt := exitRecordsBucket(tx, ns)
+		if bkt == nil {
+			return nil
+		}
+
+		c := bkt.Cursor()
+		k, v := c.Last()
+		if start > 0 {
+			k, v = c.Seek(exitRecordKey(start))
+			switch {
+			case k == nil:
+				k, v = c.Last()
+			case binary.BigEndian.Uint64(k) != start:
+				// The record has been pruned, so start from
+				// the previous one.
+				k, v = c.Prev()
+			}
+		}
+
+		for ; k != nil; k, v = c.Prev() {
+			var r ExitRecord
+			if err := json.Unmarshal(v, &r); err != nil {
+				return fmt.Errorf("failed to unmarshal exit record %d: %w", binary.BigEndian.Uint64(k), err)
+			}
+
+			if !q.Until.IsZero() && r.ExitedAt.After(q.Until) {
+				continue
+			}
+			// NOTE: The records are sorted by exit so that
+			// the older ones are all out of range.
+			if !q.Since.IsZero() && r.ExitedAt.Before(q.Since) {
+				break
+			}
+			if !filter.Match(r) {
+				continue
+			}
+
+			if len(page.Records) == limit {
+				page.NextPageToken = strconv.FormatUint(binary.BigEndian.Uint64(k), 10)
+				break
+			}
+			page.Records = append(page.Records, r)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return page, nil
+}
+
+// prune removes the records out of the retention window and the oldest ones
+// beyond the max records.
+func (store *exitRecordStore) prune(now time.Time) error {
+	return store.db.Update(func(tx *bolt.Tx) error {
+		root := tx.Bucket([]byte(exitRecordsBucketVersion))
+		if root == nil {
+			return nil
+		}
+
+		return root.ForEach(func(ns, v []byte) error {
+			bkt := root.Bucket(ns)
+			if v != nil || bkt == nil {
+				return nil
+			}
+
+			excess := 0
+			if store.maxRecords > 0 {
+				excess = bkt.Stats().KeyN - store.maxRecords
+			}
+
+			c := bkt.Cursor()
+			for k, v := c.First(); k != nil; k, v = c.First() {
+				if excess <= 0 {
+					var r ExitRecord
+					if err := json.Unmarshal(v, &r); err == nil && now.Sub(r.ExitedAt) <= store.retention {
+						break
+					}
+				}
+				if err := c.Delete(); err != nil {
+					return err
+				}
+				excess--
+			}
+			return nil
+		})
+	})
+}
+
+func (store *exitRecordStore) close() error {
+	return store.db.Close()
+}
+
+func createExitRecordsBucket(tx *bolt.Tx, ns string) (*bolt.Bucket, error) {
+	root, err := tx.CreateBucketIfNotExists([]byte(exitRecordsBucketVersion))
+	if err != nil {
+		return nil, fmt.Errorf("failed to create version bucket: %w", err)
+	}
+
+	bkt, err := root.CreateBucketIfNotExists([]byte(ns))
+	if err != nil {
+		return nil, fmt.Errorf("failed to create namespace bucket %s: %w", ns, err)
+	}
+	return bkt, nil
+}
+
+func exitRecordsBucket(tx *bolt.Tx, ns string) *bolt.Bucket {
+	root := tx.Bucket([]byte(exitRecordsBucketVersion))
+	if root == nil {
+		return nil
+	}
+	return root.Bucket([]byte(ns))
+}
+
+func exitRecordKey(seq uint64) []byte {
+	key := make([]byte, 8)
+	binary.BigEndian.PutUint64(key, seq)
+	return key
+}
+
+// recordExit stores the process's exit with the wait status if the exit
+// records are enabled.
+func (manager *TaskManager) recordExit(ns, id, execID string, pid int, status int, startedAt, exitedAt time.Time, corePath string) {
+	if manager.exitRecords == nil {
+		return
+	}
+
+	ws := unix.WaitStatus(status)
+	r := &ExitRecord{
+		Namespace:   ns,
+		ContainerID: id,
+		ExecID:      execID,
+		Pid:         uint32(pid),
+		ExitStatus:  uint32(ws.ExitStatus()),
+		CoreDumped:  ws.CoreDump(),
+		CorePath:    corePath,
+		StartedAt:   startedAt,
+		ExitedAt:    exitedAt,
+	}
+	if ws.Signaled() {
+		r.Signal = uint32(ws.Signal())
+		r.ExitStatus = exitSignalOffset + r.Signal
+	}
+
+	if err := manager.exitRecords.add(r); err != nil {
+		log.G(context.Background()).WithError(err).
+			WithField("id", id).WithField("exec", execID).
+			Warn("failed to store exit record")
+	}
+}
+
+// pruneExitRecordsPeriodically applies the retention of the exit records.
+func (manager *TaskManager) pruneExitRecordsPeriodically() {
+	ticker := time.NewTicker(exitRecordsPruneInterval)
+	defer ticker.Stop()
+
+	for {
+		if err := manager.exitRecords.prune(time.Now()); err != nil {
+			log.G(context.Background()).WithError(err).Warn("failed to prune exit records")
+		}
+		<-ticker.C
+	}
+}
+
+// ExitRecords returns the historical exit records in the namespace of the
+// context, which are kept for the retention window even if the tasks have
+// been deleted.
+func (manager *TaskManager) ExitRecords(ctx context.Context, q ExitRecordQuery) (*ExitRecordPage, error) {
+	if manager.exitRecords == nil {
+		return nil, fmt.Errorf("exit records are disabled: %w", errdefs.ErrNotImplemented)
+	}
+
+	ns, err := namespaces.NamespaceRequired(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return manager.exitRecords.query(ns, q)
+}
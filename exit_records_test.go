@@ -0,0 +1,72 @@
+//go:build linux
+// +build linux
+
+package embedshim
+
+import (
+	"testing"
+	"time"
+)
+
+func TestExitRecordStore(t *testing.T) {
+	store, err := newExitRecordStore(t.TempDir(), ExitRecordsConfig{Retention: "1h", MaxRecords: 4})
+	if err != nil {
+		t.Fatalf("failed to open store: %v", err)
+	}
+	defer store.close()
+
+	now := time.Now()
+	for i, r := range []ExitRecord{
+		{ContainerID: "c0", ExitedAt: now.Add(-2 * time.Hour)},
+		{ContainerID: "c1", ExitStatus: 1, ExitedAt: now.Add(-40 * time.Minute)},
+		{ContainerID: "c1", ExecID: "e1", ExitedAt: now.Add(-30 * time.Minute)},
+		{ContainerID: "c2", ExitStatus: 137, Signal: 9, ExitedAt: now.Add(-20 * time.Minute)},
+		{ContainerID: "c3", ExitedAt: now.Add(-10 * time.Minute)},
+	} {
+		r.Namespace = "default"
+		if err := store.add(&r); err != nil {
+			t.Fatalf("failed to add record %d: %v", i, err)
+		}
+	}
+
+	if err := store.prune(now); err != nil {
+		t.Fatalf("failed to prune: %v", err)
+	}
+
+	page, err := store.query("default", ExitRecordQuery{Limit: 2})
+	if err != nil {
+		t.Fatalf("failed to query: %v", err)
+	}
+	if len(page.Records) != 2 || page.Records[0].ContainerID != "c3" || page.Records[1].ContainerID != "c2" {
+		t.Fatalf("unexpected first page %+v", page.Records)
+	}
+
+	page, err = store.query("default", ExitRecordQuery{Limit: 2, PageToken: page.NextPageToken})
+	if err != nil {
+		t.Fatalf("failed to query: %v", err)
+	}
+	if len(page.Records) != 2 || page.Records[1].ContainerID != "c1" || page.NextPageToken != "" {
+		t.Fatalf("unexpected second page %+v, token %q", page.Records, page.NextPageToken)
+	}
+
+	page, err = store.query("default", ExitRecordQuery{Filters: []string{"exit_status!=0"}})
+	if err != nil {
+		t.Fatalf("failed to query: %v", err)
+	}
+	if len(page.Records) != 2 || page.Records[0].Signal != 9 {
+		t.Fatalf("unexpected filtered records %+v", page.Records)
+	}
+
+	page, err = store.query("default", ExitRecordQuery{Since: now.Add(-25 * time.Minute), Until: now.Add(-15 * time.Minute)})
+	if err != nil {
+		t.Fatalf("failed to query: %v", err)
+	}
+	if len(page.Records) != 1 || page.Records[0].ContainerID != "c2" {
+		t.Fatalf("unexpected ranged records %+v", page.Records)
+	}
+
+	page, err = store.query("other", ExitRecordQuery{})
+	if err != nil || len(page.Records) != 0 {
+		t.Fatalf("expected no records in other namespace, but got %v, %v", page, err)
+	}
+}
@@ -0,0 +1,19 @@
+package embedshim
+
+import (
+	"golang.org/x/sys/unix"
+)
+
+// exitSignalOffset is added to the signal which kills the process, like the
+// shell and containerd's reaper.
+const exitSignalOffset = 128
+
+// exitStatus converts the wait status into the exit status. The process
+// killed by signal is reported as 128+signal, like 137 for SIGKILL.
+func exitStatus(status int) int {
+	ws := unix.WaitStatus(status)
+	if ws.Signaled() {
+		return exitSignalOffset + int(ws.Signal())
+	}
+	return ws.ExitStatus()
+}
@@ -0,0 +1,253 @@
+//go:build linux
+// +build linux
+
+package embedshim
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"strconv"
+	"sync"
+
+	"github.com/containerd/go-runc"
+	"github.com/opencontainers/runtime-spec/specs-go"
+)
+
+// fakeRuntime is the in-memory OCI runtime which doesn't require root. It
+// only records the containers' states and the received signals.
+type fakeRuntime struct {
+	mu sync.Mutex
+
+	root       string
+	nextPid    int
+	containers map[string]*runc.Container
+	signals    map[string][]int
+
+	// errs injects the error returned by the method name.
+	errs map[string]error
+}
+
+func newFakeRuntime(root string) *fakeRuntime {
+	return &fakeRuntime{
+		root:       root,
+		nextPid:    10000,
+		containers: make(map[string]*runc.Container),
+		signals:    make(map[string][]int),
+		errs:       make(map[string]error),
+	}
+}
+
+func (r *fakeRuntime) injectError(method string, err error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.errs[method] = err
+}
+
+func (r *fakeRuntime) Create(_ context.Context, id, bundle string, opts *runc.CreateOpts) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if err := r.errs["Create"]; err != nil {
+		return err
+	}
+	return r.newContainer(id, bundle, "created", opts.PidFile)
+}
+
+func (r *fakeRuntime) Start(_ context.Context, id string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if err := r.errs["Start"]; err != nil {
+		return err
+	}
+
+	c, err := r.get(id)
+	if err != nil {
+		return err
+	}
+	if c.Status != "created" {
+		return fmt.Errorf("cannot start a container that has stopped")
+	}
+	c.Status = "running"
+	return nil
+}
+
+func (r *fakeRuntime) Delete(_ context.Context, id string, opts *runc.DeleteOpts) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if err := r.errs["Delete"]; err != nil {
+		return err
+	}
+
+	c, err := r.get(id)
+	if err != nil {
+		return err
+	}
+	if c.Status == "running" && (opts == nil || !opts.Force) {
+		return fmt.Errorf("cannot delete container %s that is not stopped", id)
+	}
+	delete(r.containers, id)
+	return nil
+}
+
+func (r *fakeRuntime) Kill(_ context.Context, id string, sig int, _ *runc.KillOpts) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if err := r.errs["Kill"]; err != nil {
+		return err
+	}
+
+	c, err := r.get(id)
+	if err != nil {
+		return err
+	}
+	if c.Status == "stopped" {
+		return fmt.Errorf("container not running")
+	}
+	r.signals[id] = append(r.signals[id], sig)
+	return nil
+}
+
+func (r *fakeRuntime) Pause(_ context.Context, id string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	c, err := r.get(id)
+	if err != nil {
+		return err
+	}
+	if c.Status != "running" {
+		return fmt.Errorf("container not running")
+	}
+	c.Status = "paused"
+	return nil
+}
+
+func (r *fakeRuntime) Resume(_ context.Context, id string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	c, err := r.get(id)
+	if err != nil {
+		return err
+	}
+	if c.Status != "paused" {
+		return fmt.Errorf("container not paused")
+	}
+	c.Status = "running"
+	return nil
+}
+
+func (r *fakeRuntime) Update(_ context.Context, id string, _ *specs.LinuxResources) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	_, err := r.get(id)
+	return err
+}
+
+func (r *fakeRuntime) State(_ context.Context, id string) (*runc.Container, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	c, err := r.get(id)
+	if err != nil {
+		return nil, err
+	}
+	copied := *c
+	return &copied, nil
+}
+
+func (r *fakeRuntime) Restore(_ context.Context, id, bundle string, opts *runc.RestoreOpts) (int, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if err := r.errs["Restore"]; err != nil {
+		return -1, err
+	}
+	return 0, r.newContainer(id, bundle, "running", opts.PidFile)
+}
+
+func (r *fakeRuntime) Checkpoint(_ context.Context, id string, _ *runc.CheckpointOpts, actions ...runc.CheckpointAction) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if err := r.errs["Checkpoint"]; err != nil {
+		return err
+	}
+
+	c, err := r.get(id)
+	if err != nil {
+		return err
+	}
+	if len(actions) == 0 {
+		c.Status = "stopped"
+	}
+	return nil
+}
+
+func (r *fakeRuntime) RootDir() string {
+	return r.root
+}
+
+func (r *fakeRuntime) LastError() (string, error) {
+	return "", nil
+}
+
+func (r *fakeRuntime) ExtCommand(ctx context.Context, _ ...string) *exec.Cmd {
+	// The fake runtime doesn't support exec.
+	return exec.CommandContext(ctx, "false")
+}
+
+// setStatus changes the container's status, like the init process exits.
+func (r *fakeRuntime) setStatus(id, status string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if c, ok := r.containers[id]; ok {
+		c.Status = status
+	}
+}
+
+func (r *fakeRuntime) receivedSignals(id string) []int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	return append([]int{}, r.signals[id]...)
+}
+
+func (r *fakeRuntime) newContainer(id, bundle, status, pidFile string) error {
+	if _, ok := r.containers[id]; ok {
+		return fmt.Errorf("container with id exists: %s", id)
+	}
+
+	r.nextPid++
+	pid := r.nextPid
+
+	if pidFile != "" {
+		if err := os.WriteFile(pidFile, []byte(strconv.Itoa(pid)), 0644); err != nil {
+			return err
+		}
+	}
+
+	r.containers[id] = &runc.Container{
+		ID:     id,
+		Pid:    pid,
+		Status: status,
+		Bundle: bundle,
+	}
+	return nil
+}
+
+func (r *fakeRuntime) get(id string) (*runc.Container, error) {
+	c, ok := r.containers[id]
+	if !ok {
+		return nil, fmt.Errorf("container %s does not exist", id)
+	}
+	return c, nil
+}
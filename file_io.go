@@ -0,0 +1,234 @@
+//go:build linux
+// +build linux
+
+package embedshim
+
+import (
+	"fmt"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/containerd/containerd/errdefs"
+	"github.com/containerd/containerd/pkg/stdio"
+	"github.com/containerd/go-runc"
+	"github.com/pkg/errors"
+	"golang.org/x/sys/unix"
+)
+
+var (
+	// fileSyncCheckInterval is the interval to check the file's size when
+	// fdatasync_bytes is used.
+	fileSyncCheckInterval = 100 * time.Millisecond
+
+	// fileQueryFsyncInterval is the URI query key to fsync the file
+	// periodically, like file:///var/log/c.log?fsync_interval=1s.
+	fileQueryFsyncInterval = "fsync_interval"
+
+	// fileQueryFdatasyncBytes is the URI query key to fdatasync the file
+	// once at least N bytes has been appended since last sync.
+	fileQueryFdatasyncBytes = "fdatasync_bytes"
+)
+
+// fileSyncPolicy decides how to flush the file output into disk. The zero
+// value relies on kernel's writeback, which has the best throughput.
+type fileSyncPolicy struct {
+	interval time.Duration
+	bytes    int64
+}
+
+func (p fileSyncPolicy) enabled() bool {
+	return p.interval > 0 || p.bytes > 0
+}
+
+func fileSyncPolicyFromURL(u *url.URL) (fileSyncPolicy, error) {
+	var (
+		policy fileSyncPolicy
+		query  = u.Query()
+		err    error
+	)
+
+	if v := query.Get(fileQueryFsyncInterval); v != "" {
+		policy.interval, err = time.ParseDuration(v)
+		if err != nil || policy.interval <= 0 {
+			return policy, fmt.Errorf("invalid %s=%q: %w", fileQueryFsyncInterval, v, errdefs.ErrInvalidArgument)
+		}
+	}
+
+	if v := query.Get(fileQueryFdatasyncBytes); v != "" {
+		policy.bytes, err = strconv.ParseInt(v, 10, 64)
+		if err != nil || policy.bytes <= 0 {
+			return policy, fmt.Errorf("invalid %s=%q: %w", fileQueryFdatasyncBytes, v, errdefs.ErrInvalidArgument)
+		}
+	}
+
+	if policy.interval > 0 && policy.bytes > 0 {
+		return policy, fmt.Errorf("%s and %s are exclusive: %w",
+			fileQueryFsyncInterval, fileQueryFdatasyncBytes, errdefs.ErrInvalidArgument)
+	}
+	return policy, nil
+}
+
+// fileIO redirects stdout and stderr into host file opened with O_APPEND.
+type fileIO struct {
+	*pipeIO
+
+	syncer *fileSyncer
+}
+
+func (i *fileIO) Close() error {
+	err := i.pipeIO.Close()
+	if i.syncer != nil {
+		if serr := i.syncer.Close(); err == nil {
+			err = serr
+		}
+	}
+	return err
+}
+
+// newRuncFileIO creates stdin pipe pairs and opens the host file as stdout
+// and stderr to be used with runc.
+//
+// NOTE: Like the fifo, the file is passed to init process directly and there
+// is no copy goroutine. The syncer holds extra file descriptor to flush the
+// data. It stops if containerd restarts.
+func newRuncFileIO(uid, gid int, u *url.URL, stdio stdio.Stdio) (_ runc.IO, retErr error) {
+	policy, err := fileSyncPolicyFromURL(u)
+	if err != nil {
+		return nil, err
+	}
+
+	path := u.Path
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return nil, err
+	}
+
+	i := &fileIO{pipeIO: &pipeIO{}}
+	defer func() {
+		if retErr != nil {
+			i.Close()
+		}
+	}()
+
+	if stdio.Stdin != "" {
+		if i.in, err = newPipe(); err != nil {
+			return nil, err
+		}
+		if err = unix.Fchown(int(i.in.r.Fd()), uid, gid); err != nil {
+			return nil, errors.Wrap(err, "failed to chown stdin")
+		}
+	}
+
+	if stdio.Stdout != "" {
+		if i.out, err = openAppendFile(path, uid, gid); err != nil {
+			return nil, err
+		}
+	}
+
+	if stdio.Stderr != "" {
+		if i.err, err = openAppendFile(path, uid, gid); err != nil {
+			return nil, err
+		}
+	}
+
+	if policy.enabled() {
+		if i.syncer, err = newFileSyncer(path, policy); err != nil {
+			return nil, err
+		}
+	}
+	return i, nil
+}
+
+func openAppendFile(path string, uid, gid int) (*os.File, error) {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0640)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open file %s: %w", path, err)
+	}
+
+	if err := unix.Fchown(int(f.Fd()), uid, gid); err != nil {
+		f.Close()
+		return nil, errors.Wrapf(err, "failed to chown %s", path)
+	}
+	return f, nil
+}
+
+// fileSyncer flushes the file based on sync policy in background.
+type fileSyncer struct {
+	f      *os.File
+	policy fileSyncPolicy
+
+	done      chan struct{}
+	wg        sync.WaitGroup
+	closeOnce sync.Once
+}
+
+func newFileSyncer(path string, policy fileSyncPolicy) (*fileSyncer, error) {
+	// NOTE: fsync on read-only file descriptor is allowed in linux.
+	f, err := os.OpenFile(path, os.O_RDONLY, 0)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open file %s for sync: %w", path, err)
+	}
+
+	s := &fileSyncer{
+		f:      f,
+		policy: policy,
+		done:   make(chan struct{}),
+	}
+
+	s.wg.Add(1)
+	go s.run()
+	return s, nil
+}
+
+func (s *fileSyncer) run() {
+	defer s.wg.Done()
+
+	interval := s.policy.interval
+	if s.policy.bytes > 0 {
+		interval = fileSyncCheckInterval
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	var synced int64
+	for {
+		select {
+		case <-s.done:
+			return
+		case <-ticker.C:
+		}
+
+		if s.policy.bytes == 0 {
+			s.f.Sync()
+			continue
+		}
+
+		fi, err := s.f.Stat()
+		if err != nil || fi.Size()-synced < s.policy.bytes {
+			continue
+		}
+
+		if err := unix.Fdatasync(int(s.f.Fd())); err == nil {
+			synced = fi.Size()
+		}
+	}
+}
+
+// Close stops the syncer and flushes the file at the last time.
+func (s *fileSyncer) Close() error {
+	var err error
+	s.closeOnce.Do(func() {
+		close(s.done)
+		s.wg.Wait()
+
+		err = s.f.Sync()
+		if cerr := s.f.Close(); err == nil {
+			err = cerr
+		}
+	})
+	return err
+}
@@ -0,0 +1,466 @@
+//go:build linux
+// +build linux
+
+package embedshim
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math"
+	"net"
+	"net/url"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/containerd/containerd/errdefs"
+	"github.com/containerd/containerd/log"
+	"github.com/pkg/errors"
+	"golang.org/x/sys/unix"
+)
+
+var (
+	defaultFluentBufferLimit = 1 << 20
+
+	// fluentMaxLineSize is the max size of one record's log. The longer
+	// line is split into the records with partial_message=true.
+	fluentMaxLineSize = 16 * 1024
+
+	// fluentFlushInterval is the max delay of the buffered records.
+	fluentFlushInterval = time.Second
+
+	fluentWriteTimeout = 10 * time.Second
+
+	fluentMinReconnectDelay = time.Second
+	fluentMaxReconnectDelay = 30 * time.Second
+
+	// fluentCloseTimeout bounds the flush of the remaining records when the
+	// process's stdio is closed.
+	fluentCloseTimeout = 5 * time.Second
+)
+
+// fluentConfig is defined by annotations.
+type fluentConfig struct {
+	network     string
+	address     string
+	tag         string
+	bufferLimit int
+}
+
+// fluentConfigFromAnnotations returns nil if the stdio mode isn't fluent.
+func fluentConfigFromAnnotations(mode StdioMode, annotations map[string]string, id string) (*fluentConfig, error) {
+	v := annotations[annotationFluentAddress]
+	if mode != StdioModeFluent {
+		if v != "" {
+			return nil, fmt.Errorf("annotation %s requires %s=%s: %w",
+				annotationFluentAddress, annotationStdioMode, StdioModeFluent, errdefs.ErrInvalidArgument)
+		}
+		return nil, nil
+	}
+
+	u, err := url.Parse(v)
+	if err != nil || v == "" {
+		return nil, fmt.Errorf("invalid annotation %s=%q: %w", annotationFluentAddress, v, errdefs.ErrInvalidArgument)
+	}
+
+	cfg := &fluentConfig{
+		network:     u.Scheme,
+		tag:         id,
+		bufferLimit: defaultFluentBufferLimit,
+	}
+	switch u.Scheme {
+	case "tcp":
+		cfg.address = u.Host
+	case "unix":
+		cfg.address = u.Path
+	default:
+		return nil, fmt.Errorf("invalid annotation %s=%q, expected tcp:// or unix://: %w",
+			annotationFluentAddress, v, errdefs.ErrInvalidArgument)
+	}
+	if cfg.address == "" {
+		return nil, fmt.Errorf("invalid annotation %s=%q: %w", annotationFluentAddress, v, errdefs.ErrInvalidArgument)
+	}
+
+	if v := annotations[annotationFluentTag]; v != "" {
+		cfg.tag = v
+	}
+
+	if v := annotations[annotationFluentBufferLimit]; v != "" {
+		limit, err := strconv.Atoi(v)
+		if err != nil || limit < fluentMaxLineSize {
+			return nil, fmt.Errorf("invalid annotation %s=%q, expected integer no less than %d: %w",
+				annotationFluentBufferLimit, v, fluentMaxLineSize, errdefs.ErrInvalidArgument)
+		}
+		cfg.bufferLimit = limit
+	}
+	return cfg, nil
+}
+
+// fluentIO forwards the stdout and stderr to the Fluent forward input, so
+// that the logs are shipped off-node without the intermediate file.
+//
+// NOTE: The pipes are held by the plugin. The init process's records stop
+// after the plugin restarts.
+type fluentIO struct {
+	*pipeIO
+
+	forwarder *fluentForwarder
+	readers   []*os.File
+	wg        sync.WaitGroup
+}
+
+func (i *fluentIO) Close() error {
+	err := i.pipeIO.Close()
+	for _, r := range i.readers {
+		r.Close()
+	}
+	i.wg.Wait()
+
+	i.forwarder.close()
+	return err
+}
+
+// newFluentIO creates pipes as stdout and stderr, and forwards each line as
+// one record.
+func newFluentIO(uid, gid int, cfg *fluentConfig, owner stdioOwner) (_ *fluentIO, retErr error) {
+	i := &fluentIO{
+		pipeIO:    &pipeIO{},
+		forwarder: newFluentForwarder(cfg),
+	}
+	defer func() {
+		if retErr != nil {
+			i.Close()
+		}
+	}()
+
+	for _, target := range []struct {
+		w      **os.File
+		source string
+	}{
+		{&i.out, "stdout"},
+		{&i.err, "stderr"},
+	} {
+		r, w, err := os.Pipe()
+		if err != nil {
+			return nil, err
+		}
+		i.readers = append(i.readers, r)
+		*target.w = w
+
+		if err := unix.Fchown(int(w.Fd()), uid, gid); err != nil {
+			return nil, errors.Wrap(err, "failed to chown output pipe")
+		}
+
+		fields := fluentRecordFields(owner, target.source)
+
+		i.wg.Add(1)
+		go func() {
+			defer i.wg.Done()
+
+			i.forwarder.forwardLines(r, fields)
+		}()
+	}
+	return i, nil
+}
+
+// fluentRecordFields returns the metadata fields of each record, which are
+// the same to docker's fluentd logging driver.
+func fluentRecordFields(owner stdioOwner, source string) [][2]string {
+	return [][2]string{
+		{"container_id", owner.containerID},
+		{"container_name", owner.containerID},
+		{"namespace", owner.namespace},
+		{"source", source},
+	}
+}
+
+// fluentForwarder buffers the encoded entries and sends them in forward mode
+// with reconnect. It is at-most-once, because the ack isn't required.
+type fluentForwarder struct {
+	cfg *fluentConfig
+
+	mu       sync.Mutex
+	entries  [][]byte
+	size     int
+	dropped  uint64
+	closed   bool
+	notifyCh chan struct{}
+	doneCh   chan struct{}
+}
+
+func newFluentForwarder(cfg *fluentConfig) *fluentForwarder {
+	f := &fluentForwarder{
+		cfg:      cfg,
+		notifyCh: make(chan struct{}, 1),
+		doneCh:   make(chan struct{}),
+	}
+	go f.run()
+	return f
+}
+
+// forwardLines buffers each line as one entry until EOF.
+func (f *fluentForwarder) forwardLines(r io.Reader, fields [][2]string) {
+	br := bufio.NewReaderSize(r, fluentMaxLineSize)
+	for {
+		line, err := br.ReadSlice('\n')
+		partial := err == bufio.ErrBufferFull
+
+		line = bytes.TrimSuffix(line, []byte("\n"))
+		if len(line) > 0 || (err == nil && !partial) {
+			f.push(fluentEntry(time.Now(), line, partial, fields))
+		}
+
+		if err != nil && !partial {
+			return
+		}
+	}
+}
+
+// push appends the entry and drops the oldest ones if the buffer is full.
+func (f *fluentForwarder) push(entry []byte) {
+	f.mu.Lock()
+	f.entries = append(f.entries, entry)
+	f.size += len(entry)
+	for f.size > f.cfg.bufferLimit && len(f.entries) > 1 {
+		f.size -= len(f.entries[0])
+		f.entries = f.entries[1:]
+		f.dropped++
+	}
+	f.mu.Unlock()
+
+	select {
+	case f.notifyCh <- struct{}{}:
+	default:
+	}
+}
+
+// requeue puts back the unsent entries before the new ones if there is room.
+func (f *fluentForwarder) requeue(entries [][]byte) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	for i := len(entries) - 1; i >= 0; i-- {
+		if f.size+len(entries[i]) > f.cfg.bufferLimit {
+			f.dropped += uint64(i + 1)
+			return
+		}
+		f.entries = append([][]byte{entries[i]}, f.entries...)
+		f.size += len(entries[i])
+	}
+}
+
+// take returns the buffered entries, and whether the forwarder is closed.
+func (f *fluentForwarder) take() ([][]byte, bool) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	entries := f.entries
+	f.entries, f.size = nil, 0
+	return entries, f.closed
+}
+
+// close flushes the remaining entries until fluentCloseTimeout.
+func (f *fluentForwarder) close() {
+	f.mu.Lock()
+	if f.closed {
+		f.mu.Unlock()
+		return
+	}
+	f.closed = true
+	f.mu.Unlock()
+
+	select {
+	case f.notifyCh <- struct{}{}:
+	default:
+	}
+
+	select {
+	case <-f.doneCh:
+	case <-time.After(fluentCloseTimeout):
+		log.G(context.Background()).Warnf("timeout to flush fluent records to %s", f.cfg.address)
+	}
+}
+
+func (f *fluentForwarder) run() {
+	defer close(f.doneCh)
+
+	var (
+		conn    net.Conn
+		delay   = fluentMinReconnectDelay
+		retryAt time.Time
+		dropped uint64
+	)
+	defer func() {
+		if conn != nil {
+			conn.Close()
+		}
+	}()
+
+	ticker := time.NewTicker(fluentFlushInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-f.notifyCh:
+		case <-ticker.C:
+		}
+
+		f.mu.Lock()
+		if f.dropped != dropped {
+			log.G(context.Background()).Warnf("fluent buffer of %s is full, %d records dropped", f.cfg.tag, f.dropped-dropped)
+			dropped = f.dropped
+		}
+		closing := f.closed
+		f.mu.Unlock()
+
+		// NOTE: The last flush doesn't wait for the reconnect delay.
+		if !closing && time.Now().Before(retryAt) {
+			continue
+		}
+
+		entries, closed := f.take()
+		if len(entries) == 0 {
+			if closed {
+				return
+			}
+			continue
+		}
+
+		err := func() error {
+			if conn == nil {
+				c, err := net.DialTimeout(f.cfg.network, f.cfg.address, fluentWriteTimeout)
+				if err != nil {
+					return err
+				}
+				conn = c
+			}
+
+			conn.SetWriteDeadline(time.Now().Add(fluentWriteTimeout))
+			_, err := conn.Write(fluentForwardMessage(f.cfg.tag, entries))
+			return err
+		}()
+		if err == nil {
+			delay = fluentMinReconnectDelay
+			continue
+		}
+
+		log.G(context.Background()).WithError(err).Warnf("failed to forward fluent records to %s, retry in %s", f.cfg.address, delay)
+		if conn != nil {
+			conn.Close()
+			conn = nil
+		}
+		f.requeue(entries)
+
+		if closed {
+			return
+		}
+		retryAt = time.Now().Add(delay)
+		if delay *= 2; delay > fluentMaxReconnectDelay {
+			delay = fluentMaxReconnectDelay
+		}
+	}
+}
+
+// fluentEntry encodes the [time, record] entry of forward mode.
+func fluentEntry(t time.Time, line []byte, partial bool, fields [][2]string) []byte {
+	var buf bytes.Buffer
+
+	size := len(fields) + 1
+	if partial {
+		size++
+	}
+
+	msgpackArrayHeader(&buf, 2)
+	msgpackEventTime(&buf, t)
+	msgpackMapHeader(&buf, size)
+	msgpackString(&buf, "log")
+	msgpackBytesAsString(&buf, line)
+	if partial {
+		msgpackString(&buf, "partial_message")
+		msgpackString(&buf, "true")
+	}
+	for _, kv := range fields {
+		msgpackString(&buf, kv[0])
+		msgpackString(&buf, kv[1])
+	}
+	return buf.Bytes()
+}
+
+// fluentForwardMessage encodes the forward mode's [tag, [entry, ...]].
+func fluentForwardMessage(tag string, entries [][]byte) []byte {
+	var buf bytes.Buffer
+
+	msgpackArrayHeader(&buf, 2)
+	msgpackString(&buf, tag)
+	msgpackArrayHeader(&buf, len(entries))
+	for _, entry := range entries {
+		buf.Write(entry)
+	}
+	return buf.Bytes()
+}
+
+func msgpackArrayHeader(buf *bytes.Buffer, n int) {
+	switch {
+	case n < 16:
+		buf.WriteByte(0x90 | byte(n))
+	case n <= math.MaxUint16:
+		buf.WriteByte(0xdc)
+		binary.Write(buf, binary.BigEndian, uint16(n))
+	default:
+		buf.WriteByte(0xdd)
+		binary.Write(buf, binary.BigEndian, uint32(n))
+	}
+}
+
+func msgpackMapHeader(buf *bytes.Buffer, n int) {
+	switch {
+	case n < 16:
+		buf.WriteByte(0x80 | byte(n))
+	case n <= math.MaxUint16:
+		buf.WriteByte(0xde)
+		binary.Write(buf, binary.BigEndian, uint16(n))
+	default:
+		buf.WriteByte(0xdf)
+		binary.Write(buf, binary.BigEndian, uint32(n))
+	}
+}
+
+func msgpackString(buf *bytes.Buffer, s string) {
+	msgpackStringHeader(buf, len(s))
+	buf.WriteString(s)
+}
+
+func msgpackBytesAsString(buf *bytes.Buffer, b []byte) {
+	msgpackStringHeader(buf, len(b))
+	buf.Write(b)
+}
+
+func msgpackStringHeader(buf *bytes.Buffer, n int) {
+	switch {
+	case n < 32:
+		buf.WriteByte(0xa0 | byte(n))
+	case n <= math.MaxUint8:
+		buf.WriteByte(0xd9)
+		buf.WriteByte(byte(n))
+	case n <= math.MaxUint16:
+		buf.WriteByte(0xda)
+		binary.Write(buf, binary.BigEndian, uint16(n))
+	default:
+		buf.WriteByte(0xdb)
+		binary.Write(buf, binary.BigEndian, uint32(n))
+	}
+}
+
+// msgpackEventTime encodes the Fluent's EventTime, which is the ext type 0
+// with 32-bit seconds and nanoseconds.
+func msgpackEventTime(buf *bytes.Buffer, t time.Time) {
+	buf.WriteByte(0xd7)
+	buf.WriteByte(0x00)
+	binary.Write(buf, binary.BigEndian, uint32(t.Unix()))
+	binary.Write(buf, binary.BigEndian, uint32(t.Nanosecond()))
+}
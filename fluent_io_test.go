@@ -0,0 +1,139 @@
+//go:build linux
+// +build linux
+
+package embedshim
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestFluentConfigFromAnnotations(t *testing.T) {
+	cfg, err := fluentConfigFromAnnotations(StdioModeDefault, nil, "c1")
+	if err != nil || cfg != nil {
+		t.Fatalf("expected nil config, but got %v (err: %v)", cfg, err)
+	}
+
+	cfg, err = fluentConfigFromAnnotations(StdioModeFluent, map[string]string{
+		annotationFluentAddress: "tcp://127.0.0.1:24224",
+	}, "c1")
+	if err != nil {
+		t.Fatalf("failed to parse fluent config: %v", err)
+	}
+	expected := fluentConfig{network: "tcp", address: "127.0.0.1:24224", tag: "c1", bufferLimit: defaultFluentBufferLimit}
+	if *cfg != expected {
+		t.Fatalf("expected %+v, but got %+v", expected, *cfg)
+	}
+
+	cfg, err = fluentConfigFromAnnotations(StdioModeFluent, map[string]string{
+		annotationFluentAddress:     "unix:///run/fluent.sock",
+		annotationFluentTag:         "docker.web",
+		annotationFluentBufferLimit: "65536",
+	}, "c1")
+	if err != nil {
+		t.Fatalf("failed to parse fluent config: %v", err)
+	}
+	expected = fluentConfig{network: "unix", address: "/run/fluent.sock", tag: "docker.web", bufferLimit: 65536}
+	if *cfg != expected {
+		t.Fatalf("expected %+v, but got %+v", expected, *cfg)
+	}
+
+	for _, annotations := range []map[string]string{
+		{},
+		{annotationFluentAddress: "udp://127.0.0.1:24224"},
+		{annotationFluentAddress: "tcp://"},
+		{annotationFluentAddress: "unix:///run/fluent.sock", annotationFluentBufferLimit: "1"},
+	} {
+		if _, err := fluentConfigFromAnnotations(StdioModeFluent, annotations, "c1"); err == nil {
+			t.Fatalf("expected error for %v, but got nil", annotations)
+		}
+	}
+
+	if _, err := fluentConfigFromAnnotations(StdioModeNull, map[string]string{
+		annotationFluentAddress: "tcp://127.0.0.1:24224",
+	}, "c1"); err == nil {
+		t.Fatalf("expected error for address without fluent mode, but got nil")
+	}
+}
+
+func TestFluentEntry(t *testing.T) {
+	got := fluentEntry(time.Unix(1, 2), []byte("hi"), true, [][2]string{{"source", "stdout"}})
+
+	expected := []byte{
+		0x92,
+		0xd7, 0x00, 0x00, 0x00, 0x00, 0x01, 0x00, 0x00, 0x00, 0x02,
+		0x83,
+		0xa3, 'l', 'o', 'g', 0xa2, 'h', 'i',
+		0xaf, 'p', 'a', 'r', 't', 'i', 'a', 'l', '_', 'm', 'e', 's', 's', 'a', 'g', 'e', 0xa4, 't', 'r', 'u', 'e',
+		0xa6, 's', 'o', 'u', 'r', 'c', 'e', 0xa6, 's', 't', 'd', 'o', 'u', 't',
+	}
+	if !bytes.Equal(got, expected) {
+		t.Fatalf("expected %x, but got %x", expected, got)
+	}
+
+	var buf bytes.Buffer
+	msgpackString(&buf, string(make([]byte, 300)))
+	if h := buf.Bytes()[:3]; !bytes.Equal(h, []byte{0xda, 0x01, 0x2c}) {
+		t.Fatalf("expected str16 header, but got %x", h)
+	}
+}
+
+func TestFluentForwarder(t *testing.T) {
+	addr := filepath.Join(t.TempDir(), "fluent.sock")
+
+	entries := [][]byte{
+		fluentEntry(time.Unix(1, 0), []byte("a"), false, nil),
+		fluentEntry(time.Unix(2, 0), []byte("b"), false, nil),
+		fluentEntry(time.Unix(3, 0), []byte("c"), false, nil),
+	}
+
+	// the buffer holds two entries only, and the oldest one is dropped
+	f := newFluentForwarder(&fluentConfig{
+		network:     "unix",
+		address:     addr,
+		tag:         "test",
+		bufferLimit: len(entries[0]) * 2,
+	})
+	for _, entry := range entries {
+		f.push(entry)
+	}
+
+	ln, err := net.Listen("unix", addr)
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	defer ln.Close()
+
+	done := make(chan []byte)
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			close(done)
+			return
+		}
+		defer conn.Close()
+
+		data, _ := io.ReadAll(conn)
+		done <- data
+	}()
+
+	f.close()
+
+	select {
+	case data := <-done:
+		expected := fluentForwardMessage("test", entries[1:])
+		if !bytes.Equal(data, expected) {
+			t.Fatalf("expected %x, but got %x", expected, data)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatalf("timeout to receive fluent records")
+	}
+
+	if f.dropped != 1 {
+		t.Fatalf("expected 1 dropped record, but got %v", f.dropped)
+	}
+}
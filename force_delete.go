@@ -0,0 +1,72 @@
+//go:build linux
+// +build linux
+
+package embedshim
+
+import (
+	"context"
+	"time"
+
+	"github.com/containerd/containerd/log"
+	"github.com/containerd/go-runc"
+	"golang.org/x/sys/unix"
+)
+
+// forceDeleteTimeout is the max time to wait for the init process to exit
+// after it is killed by force delete.
+var forceDeleteTimeout = 10 * time.Second
+
+type ctxForceDeleteKey struct{}
+
+// WithForceDelete makes the task's Delete kill the container in any state,
+// like `runc delete --force`. The wedged init process, which doesn't exit in
+// time after SIGKILL, is marked exited and its tracing is dropped.
+func WithForceDelete(ctx context.Context) context.Context {
+	return context.WithValue(ctx, ctxForceDeleteKey{}, true)
+}
+
+func isForceDelete(ctx context.Context) bool {
+	force, _ := ctx.Value(ctxForceDeleteKey{}).(bool)
+	return force
+}
+
+// forceStop kills the container and waits for the init process to exit so
+// that the task can be deleted in stopped state.
+func (s *shim) forceStop(ctx context.Context) error {
+	s.markStopped()
+
+	p := s.init
+	switch status, _ := p.Status(ctx); status {
+	case "stopped", "deleted":
+		return nil
+	}
+
+	var err error
+	if p.externalCgroup {
+		// NOTE: `runc delete --force` destroys the cgroup.
+		err = p.runtime.Kill(ctx, p.ID(), int(unix.SIGKILL), &runc.KillOpts{All: true})
+	} else {
+		err = p.runtime.Delete(ctx, p.ID(), &runc.DeleteOpts{Force: true})
+	}
+	if err != nil && !isRuntimeNotExist(err) {
+		log.G(ctx).WithError(p.runtimeError(err, "OCI runtime force delete failed")).Warnf("failed to kill task %s", s.ID())
+	}
+
+	// The checkpointed init process hasn't been restored yet.
+	if p.Pid() == 0 {
+		return nil
+	}
+
+	select {
+	case <-p.waitChan():
+		return nil
+	case <-time.After(forceDeleteTimeout):
+	}
+
+	log.G(ctx).Warnf("init process of task %s doesn't exit after force delete, mark it exited", s.ID())
+	if err := s.manager.monitor.untrace(p); err != nil {
+		return err
+	}
+	p.setExitedWithLock(unexpectedExitCode)
+	return nil
+}
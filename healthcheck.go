@@ -0,0 +1,370 @@
+//go:build linux
+// +build linux
+
+package embedshim
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/containerd/containerd/errdefs"
+	"github.com/containerd/containerd/log"
+	"github.com/containerd/containerd/runtime"
+	"github.com/containerd/typeurl"
+	"golang.org/x/sys/unix"
+)
+
+// TaskHealthEventTopic is the topic of TaskHealth event.
+const TaskHealthEventTopic = "/tasks/health"
+
+func init() {
+	typeurl.Register(&TaskHealth{}, "io.embedshim.events.v1", "TaskHealth")
+}
+
+// HealthStatus is the result of the container's health check.
+type HealthStatus string
+
+const (
+	// HealthStarting means that there is no conclusion yet.
+	HealthStarting HealthStatus = "starting"
+	// HealthHealthy means that the last check passed.
+	HealthHealthy HealthStatus = "healthy"
+	// HealthUnhealthy means that the check failed for retries times in
+	// a row.
+	HealthUnhealthy HealthStatus = "unhealthy"
+)
+
+var (
+	defaultHealthCheckInterval = 30 * time.Second
+	defaultHealthCheckTimeout  = 30 * time.Second
+	defaultHealthCheckRetries  = 3
+
+	// healthCheckOutputMaxBytes is the cap of the check's output.
+	healthCheckOutputMaxBytes = 4096
+
+	// healthCheckExecIDPrefix is the prefix of internal exec process.
+	healthCheckExecIDPrefix = "embedshim-healthcheck-"
+)
+
+// TaskHealth is published when the container's health status changes.
+type TaskHealth struct {
+	ContainerID   string       `json:"container_id"`
+	Status        HealthStatus `json:"status"`
+	FailingStreak int          `json:"failing_streak"`
+	Output        string       `json:"output"`
+}
+
+// Field implements events.Event.
+func (e *TaskHealth) Field(fieldpath []string) (string, bool) {
+	if len(fieldpath) == 0 {
+		return "", false
+	}
+
+	switch fieldpath[0] {
+	case "container_id":
+		return e.ContainerID, len(e.ContainerID) > 0
+	case "status":
+		return string(e.Status), len(e.Status) > 0
+	}
+	return "", false
+}
+
+// HealthState is the snapshot of the container's health check.
+type HealthState struct {
+	Status        HealthStatus
+	FailingStreak int
+	LastOutput    string
+	LastCheckedAt time.Time
+}
+
+// healthCheckConfig is the container's health check defined by annotations.
+type healthCheckConfig struct {
+	cmd           []string
+	interval      time.Duration
+	timeout       time.Duration
+	startPeriod   time.Duration
+	retries       int
+	killUnhealthy bool
+}
+
+// healthCheckFromAnnotations returns nil if the health check isn't defined.
+func healthCheckFromAnnotations(annotations map[string]string) (*healthCheckConfig, error) {
+	v, ok := annotations[annotationHealthCheckCmd]
+	if !ok || v == "" {
+		return nil, nil
+	}
+
+	cfg := &healthCheckConfig{
+		interval: defaultHealthCheckInterval,
+		timeout:  defaultHealthCheckTimeout,
+		retries:  defaultHealthCheckRetries,
+	}
+
+	if err := json.Unmarshal([]byte(v), &cfg.cmd); err != nil || len(cfg.cmd) == 0 {
+		return nil, fmt.Errorf("invalid annotation %s=%q: %w", annotationHealthCheckCmd, v, errdefs.ErrInvalidArgument)
+	}
+
+	for key, d := range map[string]*time.Duration{
+		annotationHealthCheckInterval:    &cfg.interval,
+		annotationHealthCheckTimeout:     &cfg.timeout,
+		annotationHealthCheckStartPeriod: &cfg.startPeriod,
+	} {
+		v := annotations[key]
+		if v == "" {
+			continue
+		}
+
+		parsed, err := time.ParseDuration(v)
+		if err != nil || parsed < 0 || (parsed == 0 && key != annotationHealthCheckStartPeriod) {
+			return nil, fmt.Errorf("invalid annotation %s=%q: %w", key, v, errdefs.ErrInvalidArgument)
+		}
+		*d = parsed
+	}
+
+	if v := annotations[annotationHealthCheckRetries]; v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n <= 0 {
+			return nil, fmt.Errorf("invalid annotation %s=%q: %w", annotationHealthCheckRetries, v, errdefs.ErrInvalidArgument)
+		}
+		cfg.retries = n
+	}
+
+	var err error
+	if cfg.killUnhealthy, err = annotationBool(annotations, annotationHealthCheckKillUnhealthy); err != nil {
+		return nil, err
+	}
+	return cfg, nil
+}
+
+// Health returns the task's health check state.
+func (manager *TaskManager) Health(ctx context.Context, id string) (*HealthState, error) {
+	t, err := manager.tasks.Get(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+
+	s, ok := t.(*shim)
+	if !ok {
+		return nil, errdefs.ErrNotImplemented
+	}
+
+	if s.health == nil {
+		return nil, fmt.Errorf("task %s has no health check: %w", id, errdefs.ErrNotFound)
+	}
+	return s.health.state(), nil
+}
+
+// initHealthChecker creates the checker if the health check is defined.
+func (s *shim) initHealthChecker() {
+	if s.init.healthCheck != nil {
+		s.health = newHealthChecker(s, s.init.healthCheck)
+	}
+}
+
+// healthChecker runs the health check as internal exec process periodically.
+type healthChecker struct {
+	s   *shim
+	cfg *healthCheckConfig
+
+	mu            sync.Mutex
+	status        HealthStatus
+	failingStreak int
+	lastOutput    string
+	lastCheckedAt time.Time
+	startedAt     time.Time
+	seq           uint64
+
+	startOnce sync.Once
+	stopOnce  sync.Once
+	done      chan struct{}
+}
+
+func newHealthChecker(s *shim, cfg *healthCheckConfig) *healthChecker {
+	return &healthChecker{
+		s:      s,
+		cfg:    cfg,
+		status: HealthStarting,
+		done:   make(chan struct{}),
+	}
+}
+
+func (h *healthChecker) state() *HealthState {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	return &HealthState{
+		Status:        h.status,
+		FailingStreak: h.failingStreak,
+		LastOutput:    h.lastOutput,
+		LastCheckedAt: h.lastCheckedAt,
+	}
+}
+
+// start runs the checker in background. It is safe to call it many times.
+func (h *healthChecker) start() {
+	h.startOnce.Do(func() {
+		h.mu.Lock()
+		h.startedAt = time.Now()
+		h.mu.Unlock()
+
+		go h.run()
+	})
+}
+
+func (h *healthChecker) stop() {
+	h.stopOnce.Do(func() {
+		close(h.done)
+	})
+}
+
+// reset is called when the init process is restarted.
+func (h *healthChecker) reset() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	h.startedAt = time.Now()
+	h.failingStreak = 0
+	h.setStatusLocked(HealthStarting)
+}
+
+func (h *healthChecker) run() {
+	ticker := time.NewTicker(h.cfg.interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-h.done:
+			return
+		case <-ticker.C:
+		}
+
+		if status, _ := h.s.init.Status(context.Background()); status != "running" {
+			continue
+		}
+		h.check()
+	}
+}
+
+func (h *healthChecker) check() {
+	ctx := context.Background()
+
+	exitCode, output, err := h.probe(ctx)
+	if err != nil {
+		log.G(ctx).WithError(err).Warnf("failed to run health check for task %s", h.s.ID())
+		output = err.Error()
+		exitCode = -1
+	}
+
+	if !h.record(exitCode, output) || !h.cfg.killUnhealthy {
+		return
+	}
+
+	// NOTE: The init is killed without marking stopped so that the
+	// restart policy is able to restart it.
+	if err := h.s.init.Kill(ctx, uint32(unix.SIGKILL), false); err != nil {
+		log.G(ctx).WithError(err).Warnf("failed to kill unhealthy task %s", h.s.ID())
+	}
+}
+
+// record updates the status with the check's result. It returns true if the
+// container becomes unhealthy.
+func (h *healthChecker) record(exitCode int, output string) bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	h.lastOutput = output
+	h.lastCheckedAt = time.Now()
+
+	if exitCode == 0 {
+		h.failingStreak = 0
+		h.setStatusLocked(HealthHealthy)
+		return false
+	}
+
+	// The failure in start period doesn't count unless the check has
+	// passed before.
+	if h.status == HealthStarting && time.Since(h.startedAt) < h.cfg.startPeriod {
+		return false
+	}
+
+	h.failingStreak++
+	if h.failingStreak < h.cfg.retries || h.status == HealthUnhealthy {
+		return false
+	}
+	h.setStatusLocked(HealthUnhealthy)
+	return true
+}
+
+// setStatusLocked publishes TaskHealth event if the status changes. The
+// caller must hold h.mu.
+func (h *healthChecker) setStatusLocked(status HealthStatus) {
+	if h.status == status {
+		return
+	}
+	h.status = status
+
+	h.s.manager.publishEvent(h.s.Namespace(), TaskHealthEventTopic, &TaskHealth{
+		ContainerID:   h.s.ID(),
+		Status:        status,
+		FailingStreak: h.failingStreak,
+		Output:        h.lastOutput,
+	})
+}
+
+func (h *healthChecker) probe(ctx context.Context) (int, string, error) {
+	h.mu.Lock()
+	h.seq++
+	execID := fmt.Sprintf("%s%d", healthCheckExecIDPrefix, h.seq)
+	h.mu.Unlock()
+
+	return h.s.runProbe(ctx, execID, h.cfg.cmd, h.cfg.timeout)
+}
+
+// runProbe runs the command as exec process with the init process's
+// settings, like user, env and cwd. The output is captured by buffer IO.
+func (s *shim) runProbe(ctx context.Context, execID string, cmd []string, timeout time.Duration) (int, string, error) {
+	spec, err := s.execSpecFromProfile(ExecProfile{Args: cmd})
+	if err != nil {
+		return 0, "", err
+	}
+
+	stdout := fmt.Sprintf("buffer://?%s=%d", bufferQueryMaxBytes, healthCheckOutputMaxBytes)
+	p, err := s.Exec(ctx, execID, runtime.ExecOpts{
+		Spec: spec,
+		IO:   runtime.IO{Stdout: stdout, Stderr: stdout},
+	})
+	if err != nil {
+		return 0, "", err
+	}
+	defer func() {
+		deferCtx, deferCancel := deferContext()
+		defer deferCancel()
+
+		if _, err := p.Delete(deferCtx); err != nil {
+			log.G(ctx).WithError(err).Warnf("failed to delete probe %s", execID)
+		}
+	}()
+
+	if err := p.Start(ctx); err != nil {
+		return 0, "", err
+	}
+
+	waitCtx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	if _, err := p.Wait(waitCtx); err != nil {
+		p.Kill(ctx, uint32(unix.SIGKILL), false)
+		p.Wait(ctx)
+		return -1, fmt.Sprintf("probe timed out after %s", timeout), nil
+	}
+
+	out, err := p.(*execProcess).output()
+	if err != nil {
+		return 0, "", err
+	}
+	return int(out.ExitStatus), string(out.Stdout) + string(out.Stderr), nil
+}
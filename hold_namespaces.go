@@ -0,0 +1,294 @@
+//go:build linux
+// +build linux
+
+package embedshim
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/containerd/containerd/errdefs"
+	"github.com/containerd/containerd/log"
+	"github.com/containerd/typeurl"
+	"golang.org/x/sys/unix"
+)
+
+// TaskNamespacesHeldEventTopic is the topic of TaskNamespacesHeld event.
+const TaskNamespacesHeldEventTopic = "/tasks/namespaces-held"
+
+func init() {
+	typeurl.Register(&TaskNamespacesHeld{}, "io.embedshim.events.v1", "TaskNamespacesHeld")
+}
+
+var (
+	// heldNamespacesDirName is the dir in state dir for the held
+	// namespaces. It starts with dot so that it isn't loaded as namespace.
+	heldNamespacesDirName = ".held-namespaces"
+
+	// heldNamespacesDeadlineFile stores the deadline of the held
+	// namespaces so that they are released after the plugin restarts.
+	heldNamespacesDeadlineFile = "deadline"
+
+	// maxHoldNamespacesDuration bounds the window of the held namespaces.
+	maxHoldNamespacesDuration = 24 * time.Hour
+
+	defaultHoldNamespaceTypes = []string{"net", "mnt"}
+
+	supportedHoldNamespaceTypes = map[string]struct{}{
+		"net": {}, "mnt": {}, "pid": {}, "ipc": {}, "uts": {}, "cgroup": {},
+	}
+)
+
+// TaskNamespacesHeld is published when the namespaces of the crashed init
+// process are held. The debugger can nsenter the paths until the deadline,
+// like `nsenter --net=<path>`.
+type TaskNamespacesHeld struct {
+	ContainerID string `json:"container_id"`
+	Pid         uint32 `json:"pid"`
+	ExitStatus  uint32 `json:"exit_status"`
+	// Paths are the bind-mounted namespace files by type, like net.
+	Paths    map[string]string `json:"paths"`
+	Deadline time.Time         `json:"deadline"`
+}
+
+// Field implements events.Event.
+func (e *TaskNamespacesHeld) Field(fieldpath []string) (string, bool) {
+	if len(fieldpath) == 0 {
+		return "", false
+	}
+
+	switch fieldpath[0] {
+	case "container_id":
+		return e.ContainerID, len(e.ContainerID) > 0
+	}
+	return "", false
+}
+
+// holdNamespacesConfig is defined by annotations.
+type holdNamespacesConfig struct {
+	window time.Duration
+	types  []string
+}
+
+// holdNamespacesConfigFromAnnotations returns nil if the namespaces aren't
+// held on crash.
+func holdNamespacesConfigFromAnnotations(annotations map[string]string) (*holdNamespacesConfig, error) {
+	v := annotations[annotationHoldNamespacesDuration]
+	if v == "" {
+		if annotations[annotationHoldNamespacesTypes] != "" {
+			return nil, fmt.Errorf("annotation %s requires %s: %w",
+				annotationHoldNamespacesTypes, annotationHoldNamespacesDuration, errdefs.ErrInvalidArgument)
+		}
+		return nil, nil
+	}
+
+	window, err := time.ParseDuration(v)
+	if err != nil || window <= 0 || window > maxHoldNamespacesDuration {
+		return nil, fmt.Errorf("invalid annotation %s=%q, expected duration in (0, %s]: %w",
+			annotationHoldNamespacesDuration, v, maxHoldNamespacesDuration, errdefs.ErrInvalidArgument)
+	}
+
+	cfg := &holdNamespacesConfig{window: window, types: defaultHoldNamespaceTypes}
+	if v := annotations[annotationHoldNamespacesTypes]; v != "" {
+		cfg.types = nil
+
+		seen := make(map[string]struct{})
+		for _, typ := range strings.Split(v, ",") {
+			typ = strings.TrimSpace(typ)
+			if _, ok := supportedHoldNamespaceTypes[typ]; !ok {
+				return nil, fmt.Errorf("invalid namespace type %q in annotation %s: %w",
+					typ, annotationHoldNamespacesTypes, errdefs.ErrInvalidArgument)
+			}
+			if _, ok := seen[typ]; ok {
+				continue
+			}
+			seen[typ] = struct{}{}
+			cfg.types = append(cfg.types, typ)
+		}
+	}
+	return cfg, nil
+}
+
+// initNamespaceHolder creates the holder if it is enabled by annotations.
+func (s *shim) initNamespaceHolder() {
+	if s.init.holdNamespaces != nil {
+		s.nsHolder = &namespaceHolder{s: s, cfg: s.init.holdNamespaces}
+	}
+}
+
+// namespaceHolder pins the init process's namespaces by fd while it runs,
+// because they are gone after it exits. The pinned namespaces are
+// bind-mounted if the init process exits non-zero, and released after the
+// window.
+type namespaceHolder struct {
+	s   *shim
+	cfg *holdNamespacesConfig
+
+	mu  sync.Mutex
+	pid int
+	fds map[string]int
+}
+
+// pin opens the namespaces of the running init process. It is safe to call
+// it many times, like restart.
+func (h *namespaceHolder) pin(pid int) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if h.pid == pid && h.fds != nil {
+		return
+	}
+	h.closeLocked()
+
+	fds := make(map[string]int, len(h.cfg.types))
+	for _, typ := range h.cfg.types {
+		fd, err := unix.Open(filepath.Join("/proc", strconv.Itoa(pid), "ns", typ), unix.O_RDONLY|unix.O_CLOEXEC, 0)
+		if err != nil {
+			log.G(context.Background()).WithError(err).Warnf("failed to pin %s namespace of task %s", typ, h.s.ID())
+			continue
+		}
+		fds[typ] = fd
+	}
+	h.pid, h.fds = pid, fds
+}
+
+// exited holds the pinned namespaces if the exit status is non-zero. The
+// pinned fds are closed anyway.
+func (h *namespaceHolder) exited(exitStatus int) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	defer h.closeLocked()
+
+	if exitStatus == 0 || len(h.fds) == 0 {
+		return
+	}
+
+	ctx := context.Background()
+	s := h.s
+
+	dir := filepath.Join(s.manager.stateDir, heldNamespacesDirName, s.Namespace(), fmt.Sprintf("%s.%d", s.ID(), h.pid))
+	deadline := time.Now().Add(h.cfg.window)
+
+	paths, err := holdNamespaces(dir, h.fds, deadline)
+	if err != nil {
+		log.G(ctx).WithError(err).Warnf("failed to hold namespaces of task %s", s.ID())
+		return
+	}
+	time.AfterFunc(h.cfg.window, func() {
+		releaseHeldNamespaces(dir)
+	})
+
+	log.G(ctx).Infof("namespaces of task %s are held in %s until %s", s.ID(), dir, deadline.Format(time.RFC3339))
+	s.manager.publishEvent(s.Namespace(), TaskNamespacesHeldEventTopic, &TaskNamespacesHeld{
+		ContainerID: s.ID(),
+		Pid:         uint32(h.pid),
+		ExitStatus:  uint32(exitStatus),
+		Paths:       paths,
+		Deadline:    deadline,
+	})
+}
+
+// close releases the pinned fds without holding.
+func (h *namespaceHolder) close() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	h.closeLocked()
+}
+
+func (h *namespaceHolder) closeLocked() {
+	for _, fd := range h.fds {
+		unix.Close(fd)
+	}
+	h.fds = nil
+}
+
+// holdNamespaces bind-mounts the namespace fds into dir and stores the
+// deadline.
+func holdNamespaces(dir string, fds map[string]int, deadline time.Time) (_ map[string]string, retErr error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	defer func() {
+		if retErr != nil {
+			releaseHeldNamespaces(dir)
+		}
+	}()
+
+	if err := os.WriteFile(filepath.Join(dir, heldNamespacesDeadlineFile),
+		[]byte(deadline.Format(time.RFC3339Nano)), 0600); err != nil {
+		return nil, err
+	}
+
+	paths := make(map[string]string, len(fds))
+	for typ, fd := range fds {
+		target := filepath.Join(dir, typ)
+		if err := os.WriteFile(target, nil, 0600); err != nil {
+			return nil, err
+		}
+
+		source := filepath.Join("/proc/self/fd", strconv.Itoa(fd))
+		if err := unix.Mount(source, target, "", unix.MS_BIND, ""); err != nil {
+			return nil, fmt.Errorf("failed to bind-mount %s namespace: %w", typ, err)
+		}
+		paths[typ] = target
+	}
+	return paths, nil
+}
+
+// releaseHeldNamespaces unmounts the held namespaces and removes the dir.
+func releaseHeldNamespaces(dir string) {
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			log.G(context.Background()).WithError(err).Warnf("failed to read held namespaces %s", dir)
+		}
+		return
+	}
+
+	for _, e := range entries {
+		if e.Name() == heldNamespacesDeadlineFile {
+			continue
+		}
+		target := filepath.Join(dir, e.Name())
+		if err := unix.Unmount(target, unix.MNT_DETACH); err != nil && err != unix.EINVAL && err != unix.ENOENT {
+			log.G(context.Background()).WithError(err).Warnf("failed to unmount held namespace %s", target)
+		}
+	}
+
+	if err := os.RemoveAll(dir); err != nil {
+		log.G(context.Background()).WithError(err).Warnf("failed to remove held namespaces %s", dir)
+	}
+}
+
+// scheduleHeldNamespacesRelease releases the held namespaces left by the
+// last run when their deadlines are reached.
+func (manager *TaskManager) scheduleHeldNamespacesRelease() {
+	root := filepath.Join(manager.stateDir, heldNamespacesDirName)
+
+	dirs, err := filepath.Glob(filepath.Join(root, "*", "*"))
+	if err != nil {
+		return
+	}
+
+	for _, dir := range dirs {
+		dir := dir
+
+		var deadline time.Time
+		if data, err := os.ReadFile(filepath.Join(dir, heldNamespacesDeadlineFile)); err == nil {
+			deadline, _ = time.Parse(time.RFC3339Nano, string(data))
+		}
+
+		// NOTE: The one without valid deadline is released right now.
+		time.AfterFunc(time.Until(deadline), func() {
+			releaseHeldNamespaces(dir)
+		})
+	}
+}
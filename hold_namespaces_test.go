@@ -0,0 +1,78 @@
+//go:build linux
+// +build linux
+
+package embedshim
+
+import (
+	"os"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestHoldNamespacesConfigFromAnnotations(t *testing.T) {
+	for _, tc := range []struct {
+		annotations map[string]string
+		expected    *holdNamespacesConfig
+		hasErr      bool
+	}{
+		{annotations: nil},
+		{
+			annotations: map[string]string{annotationHoldNamespacesDuration: "10m"},
+			expected:    &holdNamespacesConfig{window: 10 * time.Minute, types: []string{"net", "mnt"}},
+		},
+		{
+			annotations: map[string]string{
+				annotationHoldNamespacesDuration: "30s",
+				annotationHoldNamespacesTypes:    "pid, net,pid",
+			},
+			expected: &holdNamespacesConfig{window: 30 * time.Second, types: []string{"pid", "net"}},
+		},
+		{annotations: map[string]string{annotationHoldNamespacesDuration: "0s"}, hasErr: true},
+		{annotations: map[string]string{annotationHoldNamespacesDuration: "25h"}, hasErr: true},
+		{annotations: map[string]string{annotationHoldNamespacesDuration: "forever"}, hasErr: true},
+		{annotations: map[string]string{annotationHoldNamespacesTypes: "net"}, hasErr: true},
+		{
+			annotations: map[string]string{
+				annotationHoldNamespacesDuration: "1m",
+				annotationHoldNamespacesTypes:    "user",
+			},
+			hasErr: true,
+		},
+	} {
+		got, err := holdNamespacesConfigFromAnnotations(tc.annotations)
+		if tc.hasErr {
+			if err == nil {
+				t.Fatalf("expected error for %v, but got nil", tc.annotations)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("unexpected error for %v: %v", tc.annotations, err)
+		}
+		if !reflect.DeepEqual(got, tc.expected) {
+			t.Fatalf("expected %+v, but got %+v", tc.expected, got)
+		}
+	}
+}
+
+func TestNamespaceHolderClosesOnCleanExit(t *testing.T) {
+	h := &namespaceHolder{cfg: &holdNamespacesConfig{window: time.Minute, types: []string{"net", "mnt"}}}
+
+	h.pin(os.Getpid())
+	if len(h.fds) != 2 {
+		t.Fatalf("expected 2 pinned namespaces, but got %v", h.fds)
+	}
+
+	// pin is idempotent for the same pid
+	fds := h.fds
+	h.pin(os.Getpid())
+	if !reflect.DeepEqual(fds, h.fds) {
+		t.Fatalf("expected %v, but got %v", fds, h.fds)
+	}
+
+	h.exited(0)
+	if h.fds != nil {
+		t.Fatalf("expected pinned namespaces closed, but got %v", h.fds)
+	}
+}
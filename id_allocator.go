@@ -1,3 +1,6 @@
+//go:build linux
+// +build linux
+
 package embedshim
 
 import (
@@ -43,6 +46,23 @@ func (ida *idAllocator) nextID() (uint64, error) {
 	return id, nil
 }
 
+// ensureAbove moves the sequence forward so that the next ID is greater than
+// id. It keeps the allocated IDs unique if the db is lost or older than the
+// bundles.
+func (ida *idAllocator) ensureAbove(id uint64) error {
+	return ida.db.Update(func(tx *bolt.Tx) error {
+		v1bkt, err := tx.CreateBucketIfNotExists([]byte(idaBucketVersion))
+		if err != nil {
+			return fmt.Errorf("failed to create version bucket: %w", err)
+		}
+
+		if v1bkt.Sequence() >= id {
+			return nil
+		}
+		return v1bkt.SetSequence(id)
+	})
+}
+
 func (ida *idAllocator) close() error {
 	return ida.db.Close()
 }
@@ -0,0 +1,108 @@
+//go:build linux
+// +build linux
+
+package embedshim
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os/exec"
+	"strings"
+
+	"github.com/containerd/cgroups"
+	"github.com/containerd/containerd/log"
+	"github.com/containerd/go-runc"
+	"github.com/opencontainers/runtime-spec/specs-go"
+)
+
+// defaultRuntimeBinary is the OCI runtime used if the task doesn't specify.
+var defaultRuntimeBinary = "runc"
+
+// RuntimeInfo is the OCI runtime's version and features with the embedshim's
+// features, like the v2 shim's info and features call.
+type RuntimeInfo struct {
+	// RuntimeName is the OCI runtime binary name, like "runc" or "crun".
+	RuntimeName string `json:"runtime_name"`
+	// RuntimeVersion is the version reported by `$binary --version`.
+	RuntimeVersion string `json:"runtime_version"`
+	// RuntimeCommit is the git commit reported by `$binary --version`.
+	RuntimeCommit string `json:"runtime_commit,omitempty"`
+	// SpecVersion is the OCI spec version supported by the OCI runtime.
+	SpecVersion string `json:"spec_version"`
+	// EmbedshimSpecVersion is the OCI spec version used by embedshim.
+	EmbedshimSpecVersion string `json:"embedshim_spec_version"`
+
+	// RuntimeFeatures is the output of `$binary features` in JSON, which is
+	// empty if the OCI runtime doesn't support it.
+	RuntimeFeatures json.RawMessage `json:"runtime_features,omitempty"`
+
+	// Features are the embedshim's features enabled on this node, like
+	// "checkpoint", "restore", "pause" and "idmap".
+	Features map[string]bool `json:"features"`
+}
+
+// runtimeFeatures is the subset of `runc features` output used to detect
+// embedshim's features.
+type runtimeFeatures struct {
+	Linux *struct {
+		MountExtensions *struct {
+			IDMap *struct {
+				Enabled *bool `json:"enabled,omitempty"`
+			} `json:"idmap,omitempty"`
+		} `json:"mountExtensions,omitempty"`
+	} `json:"linux,omitempty"`
+}
+
+func (f *runtimeFeatures) idmap() bool {
+	if f.Linux == nil || f.Linux.MountExtensions == nil || f.Linux.MountExtensions.IDMap == nil {
+		return false
+	}
+	enabled := f.Linux.MountExtensions.IDMap.Enabled
+	return enabled != nil && *enabled
+}
+
+// Info returns the OCI runtime's version and features. The binaryName is
+// the OCI runtime binary, like the task's runc options. The runc is used if
+// it is empty.
+func (manager *TaskManager) Info(ctx context.Context, binaryName string) (*RuntimeInfo, error) {
+	if binaryName == "" {
+		binaryName = defaultRuntimeBinary
+	}
+
+	r := &runc.Runc{Command: binaryName}
+	version, err := r.Version(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get version of %s: %w", binaryName, err)
+	}
+
+	info := &RuntimeInfo{
+		RuntimeName:          binaryName,
+		RuntimeVersion:       version.Runc,
+		RuntimeCommit:        version.Commit,
+		SpecVersion:          version.Spec,
+		EmbedshimSpecVersion: specs.Version,
+		Features: map[string]bool{
+			"restore":        true,
+			"pause":          true,
+			"checkpoint":     true,
+			"time_namespace": manager.caps != nil && manager.caps.TimeNamespace,
+			"exec_subgroups": cgroups.Mode() == cgroups.Unified,
+		},
+	}
+
+	out, err := exec.CommandContext(ctx, binaryName, "features").Output()
+	if err != nil {
+		log.G(ctx).WithError(err).Debugf("%s doesn't support features command", binaryName)
+		info.Features["idmap"] = false
+		return info, nil
+	}
+
+	var features runtimeFeatures
+	if err := json.Unmarshal(out, &features); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal features of %s: %w", binaryName, err)
+	}
+	info.RuntimeFeatures = json.RawMessage(strings.TrimSpace(string(out)))
+	info.Features["idmap"] = features.idmap()
+	return info, nil
+}
@@ -0,0 +1,124 @@
+//go:build linux
+// +build linux
+
+package embedshim
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/containerd/containerd/errdefs"
+	ptypes "github.com/gogo/protobuf/types"
+)
+
+// injectedInitPath is where the init binary is bind-mounted in the
+// container, like docker's /sbin/docker-init.
+const injectedInitPath = "/sbin/embedshim-init"
+
+// InitInjectionConfig injects the minimal init, like tini, as the
+// container's pid 1, which is the equivalent of `docker run --init`. The
+// init reaps the zombies and forwards the signals to the entrypoint, for
+// the images whose entrypoint doesn't reap its children.
+type InitInjectionConfig struct {
+	// Path is the host path of the static init binary, which is called as
+	// `init -- <args>`, like tini-static.
+	Path string `toml:"path"`
+
+	// Default injects the init into all the tasks unless the task's
+	// annotation disables it.
+	Default bool `toml:"default"`
+}
+
+// initInjectionEnabled returns the task's annotation if it is set, or the
+// plugin's default.
+func initInjectionEnabled(annotations map[string]string, cfg InitInjectionConfig) (bool, error) {
+	if v, ok := annotations[annotationInit]; ok && v != "" {
+		return annotationBool(annotations, annotationInit)
+	}
+	return cfg.Default, nil
+}
+
+// applyInitInjection bind-mounts the init binary into the container
+// read-only and prepends it to the spec's process.args. The spec is
+// returned as it is if the init isn't injected.
+//
+// NOTE: The init is pid 1 only if the container has its own pid namespace.
+// Otherwise it still runs the entrypoint but doesn't reap the orphans.
+func applyInitInjection(spec *ptypes.Any, cfg InitInjectionConfig) (*ptypes.Any, error) {
+	if spec == nil {
+		return spec, nil
+	}
+
+	return patchRawJSON(spec, "spec", func(root map[string]json.RawMessage) (bool, error) {
+		var annotations map[string]string
+		if _, err := unmarshalRawField(root, "annotations", "spec annotations", &annotations); err != nil {
+			return false, err
+		}
+
+		enabled, err := initInjectionEnabled(annotations, cfg)
+		if err != nil || !enabled {
+			return false, err
+		}
+
+		if cfg.Path == "" {
+			return false, fmt.Errorf("init injection requires plugin's init_injection.path: %w", errdefs.ErrFailedPrecondition)
+		}
+		if !filepath.IsAbs(cfg.Path) {
+			return false, fmt.Errorf("init binary %q must be absolute path: %w", cfg.Path, errdefs.ErrFailedPrecondition)
+		}
+		if st, err := os.Stat(cfg.Path); err != nil || !st.Mode().IsRegular() {
+			return false, fmt.Errorf("init binary %q isn't regular file: %v: %w", cfg.Path, err, errdefs.ErrFailedPrecondition)
+		}
+
+		var process map[string]json.RawMessage
+		if ok, err := unmarshalRawField(root, "process", "process spec", &process); err != nil {
+			return false, err
+		} else if !ok {
+			return false, fmt.Errorf("init injection requires process spec: %w", errdefs.ErrInvalidArgument)
+		}
+
+		var args []string
+		if _, err := unmarshalRawField(process, "args", "process args", &args); err != nil {
+			return false, err
+		}
+		if len(args) == 0 {
+			return false, fmt.Errorf("init injection requires process.args: %w", errdefs.ErrInvalidArgument)
+		}
+
+		// The spec might be injected already, like the task is re-created
+		// from the spec read back from the bundle.
+		if args[0] == injectedInitPath {
+			return false, nil
+		}
+
+		var mounts []json.RawMessage
+		if _, err := unmarshalRawField(root, "mounts", "spec mounts", &mounts); err != nil {
+			return false, err
+		}
+
+		// NOTE: The mount is appended so that it isn't hidden by the spec's
+		// mounts, like the tmpfs on /sbin.
+		mount, err := json.Marshal(map[string]interface{}{
+			"destination": injectedInitPath,
+			"type":        "bind",
+			"source":      cfg.Path,
+			"options":     []string{"bind", "ro", "nosuid", "nodev"},
+		})
+		if err != nil {
+			return false, err
+		}
+		if root["mounts"], err = json.Marshal(append(mounts, mount)); err != nil {
+			return false, err
+		}
+
+		if process["args"], err = json.Marshal(append([]string{injectedInitPath, "--"}, args...)); err != nil {
+			return false, err
+		}
+		if root["process"], err = json.Marshal(process); err != nil {
+			return false, err
+		}
+		return true, nil
+	})
+}
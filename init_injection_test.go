@@ -0,0 +1,91 @@
+//go:build linux
+// +build linux
+
+package embedshim
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/containerd/containerd/errdefs"
+	ptypes "github.com/gogo/protobuf/types"
+	"github.com/opencontainers/runtime-spec/specs-go"
+)
+
+func TestApplyInitInjection(t *testing.T) {
+	initPath := filepath.Join(t.TempDir(), "tini")
+	if err := os.WriteFile(initPath, []byte("#!/bin/sh\n"), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	raw := []byte(`{
+		"annotations": {"` + annotationInit + `": "true"},
+		"process": {"args": ["nginx", "-g", "daemon off;"], "x-unknown": true},
+		"mounts": [{"destination": "/proc", "type": "proc", "source": "proc"}]
+	}`)
+
+	spec := &ptypes.Any{Value: raw}
+	_, err := applyInitInjection(spec, InitInjectionConfig{})
+	if !errors.Is(err, errdefs.ErrFailedPrecondition) {
+		t.Fatalf("expected ErrFailedPrecondition without init path, but got %v", err)
+	}
+
+	got, err := applyInitInjection(spec, InitInjectionConfig{Path: initPath})
+	if err != nil {
+		t.Fatalf("failed to inject init: %v", err)
+	}
+
+	var s specs.Spec
+	if err := json.Unmarshal(got.Value, &s); err != nil {
+		t.Fatal(err)
+	}
+	if expected := []string{injectedInitPath, "--", "nginx", "-g", "daemon off;"}; !reflect.DeepEqual(s.Process.Args, expected) {
+		t.Fatalf("expected args %v, but got %v", expected, s.Process.Args)
+	}
+	if len(s.Mounts) != 2 || s.Mounts[1].Destination != injectedInitPath || s.Mounts[1].Source != initPath {
+		t.Fatalf("expected init bind mount appended, but got %+v", s.Mounts)
+	}
+
+	var root, process map[string]json.RawMessage
+	if err := json.Unmarshal(got.Value, &root); err != nil {
+		t.Fatal(err)
+	}
+	if err := json.Unmarshal(root["process"], &process); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := process["x-unknown"]; !ok {
+		t.Fatalf("expected unknown process field kept, but got %s", got.Value)
+	}
+
+	// the injected spec isn't injected twice
+	again, err := applyInitInjection(got, InitInjectionConfig{Path: initPath})
+	if err != nil || again != got {
+		t.Fatalf("expected injected spec unchanged, but got %v (err: %v)", again, err)
+	}
+}
+
+func TestInitInjectionEnabled(t *testing.T) {
+	for _, tc := range []struct {
+		annotations map[string]string
+		def         bool
+		expected    bool
+	}{
+		{annotations: nil, def: false, expected: false},
+		{annotations: nil, def: true, expected: true},
+		{annotations: map[string]string{annotationInit: "false"}, def: true, expected: false},
+		{annotations: map[string]string{annotationInit: "true"}, def: false, expected: true},
+	} {
+		enabled, err := initInjectionEnabled(tc.annotations, InitInjectionConfig{Default: tc.def})
+		if err != nil || enabled != tc.expected {
+			t.Fatalf("expected %v for %v with default %v, but got %v (err: %v)", tc.expected, tc.annotations, tc.def, enabled, err)
+		}
+	}
+
+	if _, err := initInjectionEnabled(map[string]string{annotationInit: "yes"}, InitInjectionConfig{}); !errors.Is(err, errdefs.ErrInvalidArgument) {
+		t.Fatalf("expected ErrInvalidArgument, but got %v", err)
+	}
+}
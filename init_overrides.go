@@ -0,0 +1,175 @@
+//go:build linux
+// +build linux
+
+package embedshim
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/containerd/containerd/errdefs"
+	"github.com/containerd/containerd/runtime"
+	"github.com/containerd/containerd/runtime/v2/runc/options"
+	"github.com/containerd/typeurl"
+	ptypes "github.com/gogo/protobuf/types"
+)
+
+func init() {
+	typeurl.Register(&InitOverrides{}, "io.embedshim.types.v1", "InitOverrides")
+}
+
+// maxEnvFileSize is the max size of the init overrides' env file.
+const maxEnvFileSize = 1 << 20
+
+// InitOverrides overrides the init process's env and argv at task create,
+// which is passed as the create's task options. The client doesn't need to
+// regenerate the spec for the simple overrides.
+//
+// The overrides are applied on the spec merged with the image config. The
+// precedence of env from low to high is: the spec's env, EnvFile, Env. The
+// variable with the same name is replaced in place, and the new one is
+// appended. The env policy is applied after the overrides.
+type InitOverrides struct {
+	// EnvFile is the host path of the file with one KEY=VALUE per line.
+	// The empty line and the line starting with # are ignored.
+	EnvFile string `json:"env_file,omitempty"`
+	// Env is the KEY=VALUE list.
+	Env []string `json:"env,omitempty"`
+	// Args replaces the spec's process.args if it isn't empty.
+	Args []string `json:"args,omitempty"`
+	// Options is the runc options, because the task options can't carry
+	// both. The container's runtime options take precedence over it.
+	Options *options.Options `json:"options,omitempty"`
+}
+
+// initOverridesFromCreateOpts returns nil if the task options aren't
+// InitOverrides.
+func initOverridesFromCreateOpts(opts runtime.CreateOpts) (*InitOverrides, error) {
+	if opts.TaskOptions == nil || !typeurl.Is(opts.TaskOptions, &InitOverrides{}) {
+		return nil, nil
+	}
+
+	v, err := typeurl.UnmarshalAny(opts.TaskOptions)
+	if err != nil {
+		return nil, fmt.Errorf("failed to unmarshal init overrides: %s: %w", err, errdefs.ErrInvalidArgument)
+	}
+	return v.(*InitOverrides), nil
+}
+
+// applyInitOverrides applies the overrides on the spec's process. The spec
+// is returned as it is if there is no override.
+func applyInitOverrides(spec *ptypes.Any, o *InitOverrides) (*ptypes.Any, error) {
+	if spec == nil || o == nil {
+		return spec, nil
+	}
+
+	env, err := o.envs()
+	if err != nil {
+		return nil, err
+	}
+	if len(env) == 0 && len(o.Args) == 0 {
+		return spec, nil
+	}
+
+	return patchRawJSON(spec, "spec", func(root map[string]json.RawMessage) (bool, error) {
+		var err error
+		process := make(map[string]json.RawMessage)
+		if _, err := unmarshalRawField(root, "process", "process spec", &process); err != nil {
+			return false, err
+		}
+
+		if len(env) > 0 {
+			var specEnv []string
+			if _, err := unmarshalRawField(process, "env", "process env", &specEnv); err != nil {
+				return false, err
+			}
+			if process["env"], err = json.Marshal(mergeEnv(specEnv, env)); err != nil {
+				return false, err
+			}
+		}
+
+		if len(o.Args) > 0 {
+			if process["args"], err = json.Marshal(o.Args); err != nil {
+				return false, err
+			}
+		}
+
+		if root["process"], err = json.Marshal(process); err != nil {
+			return false, err
+		}
+		return true, nil
+	})
+}
+
+// envs returns the env file's variables followed by the inline ones.
+func (o *InitOverrides) envs() ([]string, error) {
+	var env []string
+	if o.EnvFile != "" {
+		fileEnv, err := readEnvFile(o.EnvFile)
+		if err != nil {
+			return nil, err
+		}
+		env = append(env, fileEnv...)
+	}
+
+	for _, kv := range o.Env {
+		if err := validateEnvEntry(kv); err != nil {
+			return nil, fmt.Errorf("invalid init override env %q: %w", kv, err)
+		}
+	}
+	return append(env, o.Env...), nil
+}
+
+// readEnvFile reads the KEY=VALUE lines. The empty lines and comments are
+// skipped. Unlike docker's env file, the KEY without value isn't resolved
+// from the host's env, which is the plugin's env.
+func readEnvFile(path string) ([]string, error) {
+	st, err := os.Stat(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to stat env file %s: %w", path, err)
+	}
+	if !st.Mode().IsRegular() || st.Size() > maxEnvFileSize {
+		return nil, fmt.Errorf("env file %s should be regular file no larger than %d bytes: %w",
+			path, maxEnvFileSize, errdefs.ErrInvalidArgument)
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read env file %s: %w", path, err)
+	}
+
+	var env []string
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	scanner.Buffer(make([]byte, 0, 64*1024), maxEnvFileSize)
+	for n := 1; scanner.Scan(); n++ {
+		// NOTE: The value's trailing spaces are kept.
+		line := strings.TrimLeft(scanner.Text(), " \t")
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		if err := validateEnvEntry(line); err != nil {
+			return nil, fmt.Errorf("invalid line %d of env file %s: %w", n, path, err)
+		}
+		env = append(env, line)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read env file %s: %w", path, err)
+	}
+	return env, nil
+}
+
+func validateEnvEntry(kv string) error {
+	idx := strings.Index(kv, "=")
+	if idx <= 0 {
+		return fmt.Errorf("expected KEY=VALUE: %w", errdefs.ErrInvalidArgument)
+	}
+	if strings.ContainsAny(kv[:idx], " \t") || strings.Contains(kv, "\x00") {
+		return fmt.Errorf("invalid character: %w", errdefs.ErrInvalidArgument)
+	}
+	return nil
+}
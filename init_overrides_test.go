@@ -0,0 +1,109 @@
+//go:build linux
+// +build linux
+
+package embedshim
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/containerd/containerd/runtime"
+	"github.com/containerd/containerd/runtime/v2/runc/options"
+	"github.com/containerd/typeurl"
+	ptypes "github.com/gogo/protobuf/types"
+)
+
+func TestApplyInitOverrides(t *testing.T) {
+	envFile := filepath.Join(t.TempDir(), "env")
+	if err := os.WriteFile(envFile, []byte("# comment\n\nA=file\n  C=file-c \n"), 0600); err != nil {
+		t.Fatalf("failed to write env file: %v", err)
+	}
+
+	spec := &ptypes.Any{Value: []byte(`{"ociVersion":"1.0.2","process":{"args":["sh"],"env":["PATH=/bin","A=spec","B=spec"],"cwd":"/"},"x-unknown":1}`)}
+	got, err := applyInitOverrides(spec, &InitOverrides{
+		EnvFile: envFile,
+		Env:     []string{"B=inline", "C=inline", "D=inline"},
+		Args:    []string{"sleep", "infinity"},
+	})
+	if err != nil {
+		t.Fatalf("failed to apply overrides: %v", err)
+	}
+
+	var root struct {
+		Process struct {
+			Args []string `json:"args"`
+			Env  []string `json:"env"`
+			Cwd  string   `json:"cwd"`
+		} `json:"process"`
+		Unknown int `json:"x-unknown"`
+	}
+	if err := json.Unmarshal(got.Value, &root); err != nil {
+		t.Fatalf("failed to unmarshal spec: %v", err)
+	}
+
+	expectedEnv := []string{"PATH=/bin", "A=file", "B=inline", "C=inline", "D=inline"}
+	if !reflect.DeepEqual(root.Process.Env, expectedEnv) {
+		t.Fatalf("expected env %v, but got %v", expectedEnv, root.Process.Env)
+	}
+	if expected := []string{"sleep", "infinity"}; !reflect.DeepEqual(root.Process.Args, expected) {
+		t.Fatalf("expected args %v, but got %v", expected, root.Process.Args)
+	}
+	if root.Process.Cwd != "/" || root.Unknown != 1 {
+		t.Fatalf("expected other fields kept, but got %s", string(got.Value))
+	}
+
+	// no override
+	if got, err := applyInitOverrides(spec, &InitOverrides{}); err != nil || got != spec {
+		t.Fatalf("expected spec unchanged, but got %v, %v", got, err)
+	}
+
+	for _, o := range []*InitOverrides{
+		{Env: []string{"NOVALUE"}},
+		{Env: []string{"=empty"}},
+		{Env: []string{"BAD KEY=1"}},
+		{EnvFile: filepath.Join(t.TempDir(), "not-exist")},
+	} {
+		if _, err := applyInitOverrides(spec, o); err == nil {
+			t.Fatalf("expected error for %+v, but got nil", o)
+		}
+	}
+}
+
+func TestInitOverridesFromCreateOpts(t *testing.T) {
+	value, err := typeurl.MarshalAny(&InitOverrides{
+		Args:    []string{"true"},
+		Options: &options.Options{BinaryName: "crun"},
+	})
+	if err != nil {
+		t.Fatalf("failed to marshal overrides: %v", err)
+	}
+	opts := runtime.CreateOpts{TaskOptions: value}
+
+	o, err := initOverridesFromCreateOpts(opts)
+	if err != nil {
+		t.Fatalf("failed to get overrides: %v", err)
+	}
+	if o == nil || !reflect.DeepEqual(o.Args, []string{"true"}) {
+		t.Fatalf("expected args [true], but got %+v", o)
+	}
+
+	initOpts, err := initOptionsFromCreateOpts(opts)
+	if err != nil {
+		t.Fatalf("failed to get init options: %v", err)
+	}
+	if initOpts.BinaryName != "crun" {
+		t.Fatalf("expected binary crun, but got %v", initOpts.BinaryName)
+	}
+
+	// the runc options aren't overrides
+	runcOpts, err := typeurl.MarshalAny(&options.Options{BinaryName: "runc"})
+	if err != nil {
+		t.Fatalf("failed to marshal options: %v", err)
+	}
+	if o, err := initOverridesFromCreateOpts(runtime.CreateOpts{TaskOptions: runcOpts}); err != nil || o != nil {
+		t.Fatalf("expected nil overrides, but got %v, %v", o, err)
+	}
+}
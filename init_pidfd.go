@@ -0,0 +1,79 @@
+//go:build linux
+// +build linux
+
+package embedshim
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+
+	"github.com/containerd/containerd/errdefs"
+	"golang.org/x/sys/unix"
+)
+
+// InitPidFD returns the duplicate of the init process's pidfd, which is
+// readable when the process exits. The caller owns the returned file.
+//
+// The pidfd is duplicated from the one opened when the init process is
+// traced, instead of opening by pid, so that it never refers to the reused
+// pid.
+func (manager *TaskManager) InitPidFD(ctx context.Context, id string) (*os.File, error) {
+	f, _, err := manager.initPidFD(ctx, id)
+	return f, err
+}
+
+// SendInitPidFD sends the duplicate of the init process's pidfd to the peer
+// by SCM_RIGHTS, for the external supervisor in other process. The payload
+// is the init process's pid in decimal.
+func (manager *TaskManager) SendInitPidFD(ctx context.Context, id string, conn *net.UnixConn) error {
+	f, pid, err := manager.initPidFD(ctx, id)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	payload := []byte(strconv.Itoa(int(pid)))
+	if _, _, err := conn.WriteMsgUnix(payload, unix.UnixRights(int(f.Fd())), nil); err != nil {
+		return fmt.Errorf("failed to send pidfd of task %s: %w", id, err)
+	}
+	return nil
+}
+
+func (manager *TaskManager) initPidFD(ctx context.Context, id string) (*os.File, uint32, error) {
+	t, err := manager.tasks.Get(ctx, id)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	s, ok := t.(*shim)
+	if !ok {
+		return nil, 0, errdefs.ErrNotImplemented
+	}
+
+	pid := s.PID()
+	fd, err := manager.monitor.dupInitPidFD(s.init)
+	if err != nil {
+		return nil, 0, err
+	}
+	return os.NewFile(uintptr(fd), fmt.Sprintf("pidfd:%d", pid)), pid, nil
+}
+
+// dupInitPidFD duplicates the traced init process's pidfd with close-on-exec.
+func (m *monitor) dupInitPidFD(init *initProcess) (int, error) {
+	m.Lock()
+	defer m.Unlock()
+
+	fd, ok := m.initPidFDs[init.traceEventID]
+	if !ok {
+		return -1, fmt.Errorf("init process of %s isn't traced: %w", init.ID(), errdefs.ErrNotFound)
+	}
+
+	dup, err := unix.FcntlInt(uintptr(fd), unix.F_DUPFD_CLOEXEC, 0)
+	if err != nil {
+		return -1, fmt.Errorf("failed to duplicate pidfd: %w", err)
+	}
+	return dup, nil
+}
@@ -1,3 +1,6 @@
+//go:build linux
+// +build linux
+
 /*
    Copyright The containerd Authors.
 
@@ -19,16 +22,20 @@ package embedshim
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
+	"os"
 	"path/filepath"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	pkgbundle "github.com/fuweid/embedshim/pkg/bundle"
 
 	"github.com/containerd/console"
+	"github.com/containerd/containerd/errdefs"
 	"github.com/containerd/containerd/log"
 	"github.com/containerd/containerd/mount"
 	"github.com/containerd/containerd/pkg/stdio"
@@ -45,27 +52,63 @@ type initProcess struct {
 	parent *shim
 
 	initState initState
+	snapshot  atomic.Value // *initSnapshot
 	bundle    *pkgbundle.Bundle
 
-	runtime      *runc.Runc
-	options      *options.Options
-	traceEventID uint64
+	runtime       ociRuntime
+	options       *options.Options
+	traceEventID  uint64
+	restoreConfig *RestoreConfig
+	exitPolicy    exitPolicy
+
+	execOOMScoreAdj oomScoreAdjPolicy
+	stdioMode       StdioMode
+	ioLimiter       *ioRateLimiter
+	stopSignal      unix.Signal
+	restartPolicy   restartPolicy
+	healthCheck     *healthCheckConfig
+	execProfiles    map[string]ExecProfile
+	sched           *schedConfig
+	coreSched       bool
+	memoryQoS       *memoryQoS
+	execSubgroups   *execSubgroupConfig
+	lifetime        *lifetimeConfig
+	startPaused     bool
+	consoleSocket   string
+	keyring         KeyringMode
+	readiness       *readinessConfig
+	notifyProxy     *notifyProxyConfig
+	execUser        *userOverride
+	ioprio          *ioprioConfig
+	execIOPrio      *ioprioConfig
+	webhook         *webhookConfig
+	holdNamespaces  *holdNamespacesConfig
+	fluent          *fluentConfig
+
+	// externalCgroup means that the cgroup is managed by others and it
+	// must not be removed when the task is deleted.
+	externalCgroup bool
 
 	wg sync.WaitGroup
 
+	// waitBlock is closed when the init process exits. It is replaced by
+	// the restart, so that it is read by waitChan outside p.mu.
+	waitMu    sync.Mutex
 	waitBlock chan struct{}
 
 	stdio    stdio.Stdio
 	console  console.Console
+	recorder *sessionRecorder
 	platform stdio.Platform // TODO: as shim level instead of initProcess
 	io       *processIO
 	stdin    io.Closer
 	closers  []io.Closer
 
-	mu     sync.Mutex
-	status int
-	exited time.Time
-	pid    int
+	mu        sync.Mutex
+	status    int
+	startedAt time.Time
+	exited    time.Time
+	pid       int
 }
 
 func newInitProcess(bundle *pkgbundle.Bundle) (_ *initProcess, retErr error) {
@@ -84,6 +127,153 @@ func newInitProcess(bundle *pkgbundle.Bundle) (_ *initProcess, retErr error) {
 		return nil, err
 	}
 
+	spec, err := readInitOCISpec(bundle)
+	if err != nil {
+		return nil, err
+	}
+
+	policy, err := exitPolicyFromAnnotations(spec.Annotations)
+	if err != nil {
+		return nil, err
+	}
+
+	execOOMScoreAdj, err := execOOMScoreAdjPolicyFromAnnotations(spec.Annotations)
+	if err != nil {
+		return nil, err
+	}
+
+	stdioMode, err := stdioModeFromAnnotations(spec.Annotations)
+	if err != nil {
+		return nil, err
+	}
+
+	fluent, err := fluentConfigFromAnnotations(stdioMode, spec.Annotations, bundle.ID)
+	if err != nil {
+		return nil, err
+	}
+
+	if stdioMode == StdioModeNull || stdioMode == StdioModeFluent {
+		if initIO.Terminal {
+			return nil, fmt.Errorf("terminal can't be used with stdio mode %s: %w", stdioMode, errdefs.ErrInvalidArgument)
+		}
+		initIO = runtime.IO{}
+	}
+
+	for _, uri := range []string{initIO.Stdout, initIO.Stderr} {
+		if strings.HasPrefix(uri, "buffer:") {
+			return nil, fmt.Errorf("buffer stdio is only supported by exec process: %w", errdefs.ErrInvalidArgument)
+		}
+	}
+
+	if err := validateVsockStdio(stdio.Stdio{
+		Stdin:    initIO.Stdin,
+		Stdout:   initIO.Stdout,
+		Stderr:   initIO.Stderr,
+		Terminal: initIO.Terminal,
+	}); err != nil {
+		return nil, err
+	}
+
+	ioLimiter, err := ioRateLimiterFromAnnotations(spec.Annotations)
+	if err != nil {
+		return nil, err
+	}
+
+	stopSignal, err := stopSignalFromAnnotations(spec.Annotations)
+	if err != nil {
+		return nil, err
+	}
+
+	restartPolicy, err := restartPolicyFromAnnotations(spec.Annotations)
+	if err != nil {
+		return nil, err
+	}
+
+	healthCheck, err := healthCheckFromAnnotations(spec.Annotations)
+	if err != nil {
+		return nil, err
+	}
+
+	execProfiles, err := execProfilesFromAnnotations(spec.Annotations)
+	if err != nil {
+		return nil, err
+	}
+
+	sched, err := schedConfigFromAnnotations(spec.Annotations)
+	if err != nil {
+		return nil, err
+	}
+
+	coreSched, err := annotationBool(spec.Annotations, annotationSchedCore)
+	if err != nil {
+		return nil, err
+	}
+
+	memoryQoS, err := memoryQoSFromAnnotations(spec)
+	if err != nil {
+		return nil, err
+	}
+
+	execSubgroups, err := execSubgroupConfigFromAnnotations(spec.Annotations)
+	if err != nil {
+		return nil, err
+	}
+
+	lifetime, err := lifetimeConfigFromAnnotations(spec.Annotations)
+	if err != nil {
+		return nil, err
+	}
+
+	holdNamespaces, err := holdNamespacesConfigFromAnnotations(spec.Annotations)
+	if err != nil {
+		return nil, err
+	}
+
+	startPaused, err := annotationBool(spec.Annotations, annotationStartPaused)
+	if err != nil {
+		return nil, err
+	}
+
+	consoleSocket, err := consoleSocketFromAnnotations(spec.Annotations, initIO)
+	if err != nil {
+		return nil, err
+	}
+
+	keyring, err := keyringModeFromAnnotations(spec.Annotations)
+	if err != nil {
+		return nil, err
+	}
+
+	readiness, err := readinessFromAnnotations(spec.Annotations)
+	if err != nil {
+		return nil, err
+	}
+
+	notifyProxy, err := notifyProxyFromAnnotations(spec.Annotations)
+	if err != nil {
+		return nil, err
+	}
+
+	execUserOverride, err := execUserOverrideFromAnnotations(spec.Annotations)
+	if err != nil {
+		return nil, err
+	}
+
+	ioprio, err := initIOPrioFromAnnotations(spec.Annotations)
+	if err != nil {
+		return nil, err
+	}
+
+	execIOPrio, err := execIOPrioFromAnnotations(spec.Annotations)
+	if err != nil {
+		return nil, err
+	}
+
+	webhook, err := webhookFromAnnotations(spec.Annotations)
+	if err != nil {
+		return nil, err
+	}
+
 	platform, err := NewPlatform()
 	if err != nil {
 		return nil, err
@@ -99,14 +289,15 @@ func newInitProcess(bundle *pkgbundle.Bundle) (_ *initProcess, retErr error) {
 		filepath.Join(bundle.Path, "work"), // for log.json
 		bundle.Namespace,                   // for isolation
 		opts.BinaryName,                    // other implementation, like crun, youki
-		"",
-		opts.SystemdCgroup, // use systemd's cgroup
+		opts.CriuPath,                      // for checkpoint/restore
+		opts.SystemdCgroup,                 // use systemd's cgroup
 	)
 
 	p := &initProcess{
 		bundle:       bundle,
 		options:      opts,
 		traceEventID: eventID,
+		exitPolicy:   policy,
 		runtime:      runtime,
 		stdio: stdio.Stdio{
 			Stdin:    initIO.Stdin,
@@ -117,54 +308,237 @@ func newInitProcess(bundle *pkgbundle.Bundle) (_ *initProcess, retErr error) {
 		status:    0,
 		platform:  platform,
 		waitBlock: make(chan struct{}),
+
+		execOOMScoreAdj: execOOMScoreAdj,
+		stdioMode:       stdioMode,
+		ioLimiter:       ioLimiter,
+		stopSignal:      stopSignal,
+		restartPolicy:   restartPolicy,
+		healthCheck:     healthCheck,
+		execProfiles:    execProfiles,
+		sched:           sched,
+		coreSched:       coreSched,
+		memoryQoS:       memoryQoS,
+		execSubgroups:   execSubgroups,
+		lifetime:        lifetime,
+		startPaused:     startPaused,
+		consoleSocket:   consoleSocket,
+		keyring:         keyring,
+		readiness:       readiness,
+		notifyProxy:     notifyProxy,
+		execUser:        execUserOverride,
+		ioprio:          ioprio,
+		execIOPrio:      execIOPrio,
+		webhook:         webhook,
+		holdNamespaces:  holdNamespaces,
+		fluent:          fluent,
+
+		externalCgroup: hasExternalCgroup(bundle),
 	}
-	p.initState = &createdState{p: p}
+	p.setState(&createdState{p: p})
 	return p, nil
 }
 
 func (p *initProcess) Create(ctx context.Context) (retErr error) {
+	// The checkpointed init process will be restored in Start.
+	if p.restoreConfig != nil {
+		p.setState(&createdCheckpointState{p: p})
+		return nil
+	}
+
+	pidFile := newInitPidFile(p.bundle)
+
+	socket, err := p.createIO(ctx)
+	if err != nil {
+		return err
+	}
+	if socket != nil {
+		defer socket.Close()
+	}
+
+	opts := &runc.CreateOpts{
+		PidFile:      pidFile.Path(),
+		NoPivot:      p.options.NoPivotRoot,
+		NoNewKeyring: p.noNewKeyring(),
+	}
+	if p.io != nil {
+		opts.IO = p.io.IO()
+	}
+	if socket != nil {
+		opts.ConsoleSocket = socket
+	} else if p.consoleSocket != "" {
+		opts.ConsoleSocket = externalConsoleSocket(p.consoleSocket)
+	}
+
+	if err := p.runtime.Create(ctx, p.ID(), p.bundle.Path, opts); err != nil {
+		return p.keyringError(p.runtimeError(err, "OCI runtime create failed"))
+	}
+
+	if err := p.copyIO(ctx, socket); err != nil {
+		return err
+	}
+
+	pid, err := pidFile.Read()
+	if err != nil {
+		return fmt.Errorf("failed to retrieve OCI runtime container pid: %w", err)
+	}
+	p.pid = pid
+	return nil
+}
+
+// restore restores the init process from checkpoint image.
+func (p *initProcess) restore(ctx context.Context) error {
 	var (
-		err     error
-		socket  *runc.Socket
-		pio     *processIO
+		config  = p.restoreConfig
 		pidFile = newInitPidFile(p.bundle)
+	)
+
+	if config.TimeNamespaceOffsets {
+		if err := ensureTimeNamespace(p.bundle); err != nil {
+			return err
+		}
+		if p.parent != nil {
+			p.parent.manager.refreshBundle(p.bundle)
+		}
+	}
 
+	if err := p.verifyRestoreStdio(config.ImagePath); err != nil {
+		return err
+	}
+
+	network, err := readCheckpointNetwork(config.ImagePath)
+	if err != nil {
+		return err
+	}
+
+	socket, err := p.createIO(ctx)
+	if err != nil {
+		return err
+	}
+	if socket != nil {
+		defer socket.Close()
+	}
+
+	opts := &runc.RestoreOpts{
+		CheckpointOpts: runc.CheckpointOpts{
+			ImagePath: config.ImagePath,
+			WorkDir:   config.WorkDir,
+			// NOTE: CRIU refuses to restore the dumped established
+			// connections without tcp-established.
+			AllowOpenTCP: network != nil && network.TCPEstablished,
+		},
+		PidFile: pidFile.Path(),
+		Detach:  true,
+		NoPivot: p.options.NoPivotRoot,
+	}
+	if p.io != nil {
+		opts.IO = p.io.IO()
+	}
+	if socket != nil {
+		opts.ConsoleSocket = socket
+	} else if p.consoleSocket != "" {
+		opts.ConsoleSocket = externalConsoleSocket(p.consoleSocket)
+	}
+
+	if _, err := p.runtime.Restore(ctx, p.ID(), p.bundle.Path, opts); err != nil {
+		return p.runtimeError(err, "OCI runtime restore failed")
+	}
+
+	if err := p.copyIO(ctx, socket); err != nil {
+		return err
+	}
+
+	pid, err := pidFile.Read()
+	if err != nil {
+		return fmt.Errorf("failed to retrieve OCI runtime container pid: %w", err)
+	}
+	p.pid = pid
+
+	// NOTE: CRIU doesn't dump the cookie. The restored processes forked
+	// before this point keep running without it.
+	if p.coreSched {
+		if err := createCoreSchedCookie(p.pid); err != nil {
+			return fmt.Errorf("failed to create core scheduling cookie for restored init process %d: %w", p.pid, err)
+		}
+	}
+
+	if network != nil && network.TCPEstablished {
+		p.repairRestoredTCP(ctx, network)
+	}
+	return nil
+}
+
+// createIO prepares the init process's stdio. The console socket is returned
+// if the init process needs terminal.
+func (p *initProcess) createIO(ctx context.Context) (*runc.Socket, error) {
+	var (
 		ioUID = int(p.options.IoUid)
 		ioGID = int(p.options.IoGid)
 	)
 
+	if p.stdioMode == StdioModeNull {
+		nullIO, err := newDevNullIO()
+		if err != nil {
+			return nil, fmt.Errorf("failed to create init process null I/O: %w", err)
+		}
+		p.io = &processIO{io: nullIO}
+		return nil, nil
+	}
+
+	if p.stdioMode == StdioModeFluent {
+		fluentIO, err := newFluentIO(ioUID, ioGID, p.fluent, stdioOwner{namespace: p.bundle.Namespace, containerID: p.ID()})
+		if err != nil {
+			return nil, fmt.Errorf("failed to create init process fluent I/O: %w", err)
+		}
+		p.io = &processIO{io: fluentIO}
+		return nil, nil
+	}
+
+	// The caller receives the PTY master by its own console socket.
+	if p.consoleSocket != "" {
+		return nil, nil
+	}
+
 	// TODO(fuweid):
 	//
 	// Terminal console poller should be shared in plugin Level.
 	if p.stdio.Terminal {
-		if socket, err = runc.NewTempConsoleSocket(); err != nil {
-			return fmt.Errorf("failed to create OCI runtime console socket: %w", err)
-		}
-		defer socket.Close()
-	} else {
-		if pio, err = createIO(ctx, p.ID(), ioUID, ioGID, p.stdio); err != nil {
-			return fmt.Errorf("failed to create init process I/O: %w", err)
+		socket, err := runc.NewTempConsoleSocket()
+		if err != nil {
+			return nil, fmt.Errorf("failed to create OCI runtime console socket: %w", err)
 		}
-		p.io = pio
+		return socket, nil
 	}
 
-	opts := &runc.CreateOpts{
-		PidFile:      pidFile.Path(),
-		NoPivot:      p.options.NoPivotRoot,
-		NoNewKeyring: p.options.NoNewKeyring,
+	pio, err := createIO(ctx, stdioOwner{namespace: p.bundle.Namespace, containerID: p.ID()}, ioUID, ioGID, p.stdio)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create init process I/O: %w", err)
 	}
-	if p.io != nil {
-		opts.IO = p.io.IO()
+	if err := pio.withRateLimit(ioUID, ioGID, p.ioLimiter); err != nil {
+		pio.Close()
+		return nil, fmt.Errorf("failed to rate limit init process I/O: %w", err)
 	}
-	if socket != nil {
-		opts.ConsoleSocket = socket
+	p.io = pio
+	return nil, nil
+}
+
+// copyIO starts to copy the stdio after the OCI runtime has setup the init
+// process.
+func (p *initProcess) copyIO(ctx context.Context, socket *runc.Socket) error {
+	if p.consoleSocket != "" {
+		return nil
 	}
 
-	if err := p.runtime.Create(ctx, p.ID(), p.bundle.Path, opts); err != nil {
-		return p.runtimeError(err, "OCI runtime create failed")
+	if isStdinSource(p.stdio.Stdin) {
+		src, err := p.parent.manager.openStdinSource(p.bundle.Namespace, p.stdio.Stdin)
+		if err != nil {
+			return err
+		}
+		p.io.copyStdinFrom(src)
+		return nil
 	}
 
-	if p.stdio.Stdin != "" {
+	if p.stdio.Stdin != "" && !isVsockURI(p.stdio.Stdin) {
 		if err := p.openStdin(p.stdio.Stdin); err != nil {
 			return err
 		}
@@ -178,39 +552,42 @@ func (p *initProcess) Create(ctx context.Context) (retErr error) {
 			return fmt.Errorf("failed to retrieve console master: %w", err)
 		}
 
-		console, err = p.platform.CopyConsole(ctx, console, p.ID(), p.stdio.Stdin, p.stdio.Stdout, p.stdio.Stderr, &p.wg)
+		var proc *specs.Process
+		if spec, err := readInitOCISpec(p.bundle); err == nil {
+			proc = spec.Process
+		}
+		rec := p.parent.manager.openSessionRecording(p.bundle, "init", proc)
+
+		console, err = copyRecordedConsole(ctx, p.platform, rec, console, p.ID(), p.stdio, &p.wg)
 		if err != nil {
+			rec.close()
 			return fmt.Errorf("failed to start console copy: %w", err)
 		}
 		p.console = console
-	} else {
-		// NOTE: There is no stdout/stderr copy because we open Read-Write
-		// fifo as init process's stdout/stderr. Unlike the shim server's
-		// pipe, the containerd restarts without closing the init process
-		// stdout/stderr so that it is easy to recover.
-		//
-		// But the stdin still needs pipe as relay because we need to
-		// notify the init process that the stdin has been closed, like
-		//
-		// 	echo "hello, world" | cat
-		//
-		// So, for the init process which needs stdin, we can't recover
-		// the stdin after containerd restart, A.K.A we can't re-attach
-		// to stdin.
-		//
-		// This embedshim plugin can't cover 100% cases from shim server,
-		// but in producation, most of workloads are headless. The stdin
-		// is used to debug or exec operations job. I think it is acceptable :P.
-		if err := pio.CopyStdin(); err != nil {
-			return fmt.Errorf("failed to start io pipe copy: %w", err)
-		}
+		p.recorder = rec
+		return nil
 	}
 
-	pid, err := pidFile.Read()
-	if err != nil {
-		return fmt.Errorf("failed to retrieve OCI runtime container pid: %w", err)
+	// NOTE: There is no stdout/stderr copy because we open Read-Write
+	// fifo as init process's stdout/stderr. Unlike the shim server's
+	// pipe, the containerd restarts without closing the init process
+	// stdout/stderr so that it is easy to recover.
+	//
+	// But the stdin still needs pipe as relay because we need to
+	// notify the init process that the stdin has been closed, like
+	//
+	// 	echo "hello, world" | cat
+	//
+	// So, for the init process which needs stdin, we can't recover
+	// the stdin after containerd restart, A.K.A we can't re-attach
+	// to stdin.
+	//
+	// This embedshim plugin can't cover 100% cases from shim server,
+	// but in producation, most of workloads are headless. The stdin
+	// is used to debug or exec operations job. I think it is acceptable :P.
+	if err := p.io.CopyStdin(); err != nil {
+		return fmt.Errorf("failed to start io pipe copy: %w", err)
 	}
-	p.pid = pid
 	return nil
 }
 
@@ -227,7 +604,15 @@ func (p *initProcess) openStdin(path string) error {
 
 // Wait for the process to exit
 func (p *initProcess) Wait() {
-	<-p.waitBlock
+	<-p.waitChan()
+}
+
+// waitChan returns the channel closed when the current init process exits.
+func (p *initProcess) waitChan() <-chan struct{} {
+	p.waitMu.Lock()
+	defer p.waitMu.Unlock()
+
+	return p.waitBlock
 }
 
 // ID of the process
@@ -242,26 +627,20 @@ func (p *initProcess) Pid() int {
 
 // exitStatus of the process
 func (p *initProcess) ExitStatus() int {
-	p.mu.Lock()
-	defer p.mu.Unlock()
-
-	return p.status
+	return p.loadSnapshot().exitStatus
 }
 
 // ExitedAt at time when the process exited
 func (p *initProcess) ExitedAt() time.Time {
-	p.mu.Lock()
-	defer p.mu.Unlock()
-
-	return p.exited
+	return p.loadSnapshot().exitedAt
 }
 
 // Status of the process
-func (p *initProcess) Status(ctx context.Context) (string, error) {
-	p.mu.Lock()
-	defer p.mu.Unlock()
-
-	return p.initState.Status(ctx)
+//
+// NOTE: It reads the published snapshot and never blocks on the lifecycle
+// operations.
+func (p *initProcess) Status(_ context.Context) (string, error) {
+	return p.loadSnapshot().status, nil
 }
 
 // Start the init process
@@ -273,12 +652,61 @@ func (p *initProcess) Start(ctx context.Context) error {
 }
 
 func (p *initProcess) start(ctx context.Context) error {
-	err := p.runtime.Start(ctx, p.ID())
-	return p.runtimeError(err, "OCI runtime start failed")
+	if p.sched != nil {
+		if err := p.sched.apply(p.pid); err != nil {
+			return fmt.Errorf("failed to apply scheduling attributes on init process %d: %w", p.pid, err)
+		}
+	}
+
+	if p.ioprio != nil {
+		if err := p.ioprio.apply(p.pid); err != nil {
+			return fmt.Errorf("failed to apply ioprio on init process %d: %w", p.pid, err)
+		}
+	}
+
+	if p.coreSched {
+		if err := createCoreSchedCookie(p.pid); err != nil {
+			return fmt.Errorf("failed to create core scheduling cookie for init process %d: %w", p.pid, err)
+		}
+	}
+
+	if p.startPaused {
+		if err := p.startFrozen(ctx); err != nil {
+			return err
+		}
+	} else if err := p.runtimeStart(ctx); err != nil {
+		return err
+	}
+	p.startedAt = time.Now()
+	return nil
+}
+
+func (p *initProcess) pause(ctx context.Context) error {
+	err := p.runtime.Pause(ctx, p.ID())
+	return p.runtimeError(err, "OCI runtime pause failed")
+}
+
+func (p *initProcess) resume(ctx context.Context) error {
+	err := p.runtime.Resume(ctx, p.ID())
+	return p.runtimeError(err, "OCI runtime resume failed")
 }
 
 // SetExited of the init process with the next status
 func (p *initProcess) SetExited(status int) {
+	if p.exitPolicy == exitPolicyCgroupEmpty && p.parent != nil {
+		// NOTE: It is called by pidfd poller and we should not block
+		// the poller when waiting for the cgroup.
+		cg := p.parent.cg
+		go func() {
+			p.parent.waitCgroupEmpty(cg)
+			p.setExitedWithLock(status)
+		}()
+		return
+	}
+	p.setExitedWithLock(status)
+}
+
+func (p *initProcess) setExitedWithLock(status int) {
 	p.mu.Lock()
 	defer p.mu.Unlock()
 
@@ -287,7 +715,7 @@ func (p *initProcess) SetExited(status int) {
 
 func (p *initProcess) setExited(status int) {
 	p.exited = time.Now()
-	p.status = unix.WaitStatus(status).ExitStatus()
+	p.status = exitStatus(status)
 	if p.platform != nil {
 		p.platform.ShutdownConsole(context.Background(), p.console)
 
@@ -295,6 +723,19 @@ func (p *initProcess) setExited(status int) {
 		p.platform = nil
 	}
 	close(p.waitBlock)
+	p.publishSnapshot()
+
+	if p.parent != nil {
+		corePath := p.parent.manager.collectCoreDump(p.bundle, p.ID(), p.pid, status)
+		p.parent.manager.recordExit(p.bundle.Namespace, p.ID(), "", p.pid, status, p.startedAt, p.exited, corePath)
+		p.parent.manager.notifyExit(p.bundle.Namespace, p.ID(), "", p.pid, uint32(p.status), p.exited)
+		p.parent.publishTaskEvent(runtime.TaskExitEventTopic, "", uint32(p.pid),
+			newTaskExit(p.ID(), p.ID(), uint32(p.pid), uint32(p.status), p.exited, corePath))
+		if h := p.parent.nsHolder; h != nil {
+			h.exited(p.status)
+		}
+		p.parent.scheduleRestart(p.status)
+	}
 }
 
 // Delete the init process
@@ -307,17 +748,23 @@ func (p *initProcess) Delete(ctx context.Context) error {
 
 func (p *initProcess) delete(ctx context.Context) error {
 	waitTimeout(ctx, &p.wg, 2*time.Second)
-	err := p.runtime.Delete(ctx, p.ID(), nil)
-	// ignore errors if a runtime has already deleted the process
-	// but we still hold metadata and pipes
-	//
-	// this is common during a checkpoint, runc will delete the container state
-	// after a checkpoint and the container will no longer exist within runc
-	if err != nil {
-		if strings.Contains(err.Error(), "does not exist") {
-			err = nil
-		} else {
-			err = p.runtimeError(err, "failed to delete task")
+
+	var err error
+	if p.externalCgroup {
+		err = p.deleteKeepCgroup(ctx)
+	} else {
+		err = p.runtime.Delete(ctx, p.ID(), nil)
+		// ignore errors if a runtime has already deleted the process
+		// but we still hold metadata and pipes
+		//
+		// this is common during a checkpoint, runc will delete the container state
+		// after a checkpoint and the container will no longer exist within runc
+		if err != nil {
+			if isRuntimeNotExist(err) {
+				err = nil
+			} else {
+				err = p.runtimeError(err, "failed to delete task")
+			}
 		}
 	}
 	if p.io != nil {
@@ -327,11 +774,14 @@ func (p *initProcess) delete(ctx context.Context) error {
 		p.io.Close()
 	}
 
+	// NOTE: The rootfs dir is only created if there are rootfs mounts.
 	rootfs := p.bundle.Rootfs()
-	if err2 := mount.UnmountAll(rootfs, 0); err2 != nil {
-		log.G(ctx).WithError(err2).Warn("failed to cleanup rootfs mount")
-		if err == nil {
-			err = fmt.Errorf("failed rootfs umount: %w", err)
+	if _, serr := os.Stat(rootfs); serr == nil {
+		if err2 := mount.UnmountAll(rootfs, 0); err2 != nil {
+			log.G(ctx).WithError(err2).Warn("failed to cleanup rootfs mount")
+			if err == nil {
+				err = fmt.Errorf("failed rootfs umount: %w", err)
+			}
 		}
 	}
 	return err
@@ -345,7 +795,11 @@ func (p *initProcess) Resize(ws console.WinSize) error {
 	if p.console == nil {
 		return nil
 	}
-	return p.console.Resize(ws)
+	if err := p.console.Resize(ws); err != nil {
+		return err
+	}
+	p.recorder.resize(ws)
+	return nil
 }
 
 // Pause the init process and all its child processes
@@ -373,10 +827,28 @@ func (p *initProcess) Kill(ctx context.Context, signal uint32, all bool) error {
 }
 
 func (p *initProcess) kill(ctx context.Context, signal uint32, all bool) error {
-	err := p.runtime.Kill(ctx, p.ID(), int(signal), &runc.KillOpts{
+	// NOTE: The init process might have exited while its descendants are
+	// still in the cgroup. The pod teardown depends on reaping them.
+	_, stopped := p.initState.(*stoppedState)
+
+	if all && p.parent != nil {
+		_, paused := p.initState.(*pausedState)
+		err := p.parent.killAll(ctx, signal, paused)
+		if stopped && errors.Is(err, errdefs.ErrNotFound) {
+			return nil
+		}
+		if !errors.Is(err, errKillAllFallback) {
+			return err
+		}
+	}
+
+	err := checkKillError(p.runtime.Kill(ctx, p.ID(), int(signal), &runc.KillOpts{
 		All: all,
-	})
-	return checkKillError(err)
+	}))
+	if all && stopped && p.parent != nil && errors.Is(err, errdefs.ErrNotFound) {
+		return p.parent.killLeftovers(ctx, signal)
+	}
+	return err
 }
 
 // KillAll processes belonging to the init process
@@ -384,6 +856,13 @@ func (p *initProcess) KillAll(ctx context.Context) error {
 	p.mu.Lock()
 	defer p.mu.Unlock()
 
+	if p.parent != nil {
+		_, paused := p.initState.(*pausedState)
+		if err := p.parent.killAll(ctx, uint32(unix.SIGKILL), paused); !errors.Is(err, errKillAllFallback) {
+			return err
+		}
+	}
+
 	err := p.runtime.Kill(ctx, p.ID(), int(unix.SIGKILL), &runc.KillOpts{
 		All: true,
 	})
@@ -396,7 +875,7 @@ func (p *initProcess) Stdin() io.Closer {
 }
 
 // Runtime returns the OCI runtime configured for the init process
-func (p *initProcess) Runtime() *runc.Runc {
+func (p *initProcess) Runtime() ociRuntime {
 	return p.runtime
 }
 
@@ -418,6 +897,15 @@ func (p *initProcess) exec(ctx context.Context, execID string, opts runtime.Exec
 	}
 
 	spec.Terminal = opts.IO.Terminal
+	if err := validateVsockStdio(stdio.Stdio{
+		Stdin:    opts.IO.Stdin,
+		Stdout:   opts.IO.Stdout,
+		Stderr:   opts.IO.Stderr,
+		Terminal: opts.IO.Terminal,
+	}); err != nil {
+		return nil, err
+	}
+
 	e := &execProcess{
 		parent:       p,
 		id:           execID,
@@ -437,8 +925,11 @@ func (p *initProcess) exec(ctx context.Context, execID string, opts runtime.Exec
 }
 
 // Checkpoint the init process
-func (p *initProcess) Checkpoint(_ context.Context, _ *CheckpointConfig) error {
-	return fmt.Errorf("checkpoint not implemented yet")
+func (p *initProcess) Checkpoint(ctx context.Context, r *CheckpointConfig) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	return p.initState.Checkpoint(ctx, r)
 }
 
 // Update the processes resource configuration
@@ -467,7 +958,7 @@ func (p *initProcess) runtimeError(rErr error, msg string) error {
 		return nil
 	}
 
-	rMsg, err := getLastRuntimeError(p.runtime)
+	rMsg, err := p.runtime.LastError()
 	switch {
 	case err != nil:
 		return fmt.Errorf("%s: %s (%s)", msg, "unable to retrieve OCI runtime error", err.Error())
@@ -478,6 +969,10 @@ func (p *initProcess) runtimeError(rErr error, msg string) error {
 	}
 }
 
+func (p *initProcess) pidMonitor() *monitor {
+	return p.parent.manager.monitor
+}
+
 func (p *initProcess) String() string {
 	return fmt.Sprintf("init process(id=%v, namespace=%v)", p.ID(), p.bundle.Namespace)
 }
@@ -1,3 +1,6 @@
+//go:build linux
+// +build linux
+
 /*
    Copyright The containerd Authors.
 
@@ -20,6 +23,7 @@ import (
 	"context"
 	"fmt"
 
+	"github.com/containerd/containerd/errdefs"
 	"github.com/containerd/containerd/runtime"
 	google_protobuf "github.com/gogo/protobuf/types"
 	"github.com/pkg/errors"
@@ -36,6 +40,7 @@ type CheckpointConfig struct {
 	AllowTerminal            bool
 	FileLocks                bool
 	EmptyNamespaces          []string
+	CgroupsMode              string
 }
 
 type initState interface {
@@ -58,11 +63,13 @@ type createdState struct {
 func (s *createdState) transition(name string) error {
 	switch name {
 	case "running":
-		s.p.initState = &runningState{p: s.p}
+		s.p.setState(&runningState{p: s.p})
+	case "paused":
+		s.p.setState(&pausedState{p: s.p})
 	case "stopped":
-		s.p.initState = &stoppedState{p: s.p}
+		s.p.setState(&stoppedState{p: s.p})
 	case "deleted":
-		s.p.initState = &deletedState{}
+		s.p.setState(&deletedState{})
 	default:
 		return fmt.Errorf("invalid state transition %q to %q", stateName(s), name)
 	}
@@ -89,6 +96,9 @@ func (s *createdState) Start(ctx context.Context) error {
 	if err := s.p.start(ctx); err != nil {
 		return err
 	}
+	if s.p.startPaused {
+		return s.transition("paused")
+	}
 	return s.transition("running")
 }
 
@@ -119,6 +129,80 @@ func (s *createdState) Status(_ context.Context) (string, error) {
 	return "created", nil
 }
 
+type createdCheckpointState struct {
+	p *initProcess
+}
+
+func (s *createdCheckpointState) transition(name string) error {
+	switch name {
+	case "running":
+		s.p.setState(&runningState{p: s.p})
+	case "stopped":
+		s.p.setState(&stoppedState{p: s.p})
+	case "deleted":
+		s.p.setState(&deletedState{})
+	default:
+		return fmt.Errorf("invalid state transition %q to %q", stateName(s), name)
+	}
+	return nil
+}
+
+func (s *createdCheckpointState) Pause(_ context.Context) error {
+	return fmt.Errorf("cannot pause task in created state")
+}
+
+func (s *createdCheckpointState) Resume(_ context.Context) error {
+	return fmt.Errorf("cannot resume task in created state")
+}
+
+func (s *createdCheckpointState) Update(ctx context.Context, r *google_protobuf.Any) error {
+	return s.p.update(ctx, r)
+}
+
+func (s *createdCheckpointState) Checkpoint(_ context.Context, _ *CheckpointConfig) error {
+	return fmt.Errorf("cannot checkpoint a task in created state")
+}
+
+func (s *createdCheckpointState) Start(ctx context.Context) error {
+	if err := s.p.restore(ctx); err != nil {
+		return err
+	}
+
+	if err := s.p.pidMonitor().traceRestoredInitProcess(s.p); err != nil {
+		return err
+	}
+	return s.transition("running")
+}
+
+func (s *createdCheckpointState) Delete(ctx context.Context) error {
+	if err := s.p.delete(ctx); err != nil {
+		return err
+	}
+	return s.transition("deleted")
+}
+
+func (s *createdCheckpointState) Kill(_ context.Context, _ uint32, _ bool) error {
+	// NOTE: The container doesn't exist until the checkpoint is
+	// restored by Start, so there is nothing to signal.
+	return fmt.Errorf("cannot kill task %s before checkpoint is restored: %w", s.p.ID(), errdefs.ErrFailedPrecondition)
+}
+
+func (s *createdCheckpointState) SetExited(status int) {
+	s.p.setExited(status)
+
+	if err := s.transition("stopped"); err != nil {
+		panic(err)
+	}
+}
+
+func (s *createdCheckpointState) Exec(_ context.Context, _ string, _ runtime.ExecOpts) (runtime.Process, error) {
+	return nil, fmt.Errorf("cannot exec in a created state")
+}
+
+func (s *createdCheckpointState) Status(_ context.Context) (string, error) {
+	return "created", nil
+}
+
 type runningState struct {
 	p *initProcess
 }
@@ -126,17 +210,22 @@ type runningState struct {
 func (s *runningState) transition(name string) error {
 	switch name {
 	case "stopped":
-		s.p.initState = &stoppedState{p: s.p}
+		s.p.setState(&stoppedState{p: s.p})
+	case "stopping":
+		s.p.setState(&stoppingState{p: s.p})
 	case "paused":
-		s.p.initState = &pausedState{p: s.p}
+		s.p.setState(&pausedState{p: s.p})
 	default:
 		return fmt.Errorf("invalid state transition %q to %q", stateName(s), name)
 	}
 	return nil
 }
 
-func (s *runningState) Pause(_ context.Context) error {
-	return fmt.Errorf("pause not implemented yet")
+func (s *runningState) Pause(ctx context.Context) error {
+	if err := s.p.pause(ctx); err != nil {
+		return err
+	}
+	return s.transition("paused")
 }
 
 func (s *runningState) Resume(_ context.Context) error {
@@ -147,8 +236,8 @@ func (s *runningState) Update(ctx context.Context, r *google_protobuf.Any) error
 	return s.p.update(ctx, r)
 }
 
-func (s *runningState) Checkpoint(_ context.Context, _ *CheckpointConfig) error {
-	return fmt.Errorf("checkpoint not implemented yet")
+func (s *runningState) Checkpoint(ctx context.Context, r *CheckpointConfig) error {
+	return s.p.checkpoint(ctx, r)
 }
 
 func (s *runningState) Start(_ context.Context) error {
@@ -160,7 +249,13 @@ func (s *runningState) Delete(_ context.Context) error {
 }
 
 func (s *runningState) Kill(ctx context.Context, sig uint32, all bool) error {
-	return s.p.kill(ctx, sig, all)
+	if err := s.p.kill(ctx, sig, all); err != nil {
+		return err
+	}
+	if s.p.isStoppingSignal(sig) {
+		return s.transition("stopping")
+	}
+	return nil
 }
 
 func (s *runningState) SetExited(status int) {
@@ -186,9 +281,9 @@ type pausedState struct {
 func (s *pausedState) transition(name string) error {
 	switch name {
 	case "running":
-		s.p.initState = &runningState{p: s.p}
+		s.p.setState(&runningState{p: s.p})
 	case "stopped":
-		s.p.initState = &stoppedState{p: s.p}
+		s.p.setState(&stoppedState{p: s.p})
 	default:
 		return fmt.Errorf("invalid state transition %q to %q", stateName(s), name)
 	}
@@ -199,16 +294,19 @@ func (s *pausedState) Pause(_ context.Context) error {
 	return fmt.Errorf("cannot pause a paused container")
 }
 
-func (s *pausedState) Resume(_ context.Context) error {
-	return fmt.Errorf("resume not implemented yet")
+func (s *pausedState) Resume(ctx context.Context) error {
+	if err := s.p.resume(ctx); err != nil {
+		return err
+	}
+	return s.transition("running")
 }
 
 func (s *pausedState) Update(ctx context.Context, r *google_protobuf.Any) error {
 	return s.p.update(ctx, r)
 }
 
-func (s *pausedState) Checkpoint(_ context.Context, _ *CheckpointConfig) error {
-	return fmt.Errorf("checkpoint not implemented yet")
+func (s *pausedState) Checkpoint(ctx context.Context, r *CheckpointConfig) error {
+	return s.p.checkpoint(ctx, r)
 }
 
 func (s *pausedState) Start(_ context.Context) error {
@@ -250,7 +348,7 @@ type stoppedState struct {
 func (s *stoppedState) transition(name string) error {
 	switch name {
 	case "deleted":
-		s.p.initState = &deletedState{}
+		s.p.setState(&deletedState{})
 	default:
 		return fmt.Errorf("invalid state transition %q to %q", stateName(s), name)
 	}
@@ -305,8 +403,14 @@ func stateName(v interface{}) string {
 	switch v.(type) {
 	case *runningState:
 		return "running"
+	case *stoppingState:
+		return "stopping"
+	case *pausedState:
+		return "paused"
 	case *createdState:
 		return "created"
+	case *createdCheckpointState:
+		return "created checkpoint"
 	case *deletedState:
 		return "deleted"
 	case *stoppedState:
@@ -0,0 +1,315 @@
+//go:build linux
+// +build linux
+
+package embedshim
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"syscall"
+	"testing"
+	"time"
+
+	pkgbundle "github.com/fuweid/embedshim/pkg/bundle"
+
+	eventstypes "github.com/containerd/containerd/api/events"
+	"github.com/containerd/containerd/errdefs"
+	"github.com/containerd/containerd/events"
+	"github.com/containerd/containerd/events/exchange"
+	"github.com/containerd/containerd/namespaces"
+	"github.com/containerd/containerd/runtime"
+	"github.com/containerd/containerd/runtime/v2/runc/options"
+	"github.com/containerd/typeurl"
+	"github.com/gogo/protobuf/types"
+	"github.com/opencontainers/runtime-spec/specs-go"
+)
+
+// testHarness drives the task's state machine with fakeRuntime and collects
+// the published events. The exit event is simulated by SetExited because
+// the exitsnoop monitor requires root.
+type testHarness struct {
+	t *testing.T
+
+	ctx     context.Context
+	manager *TaskManager
+	shim    *shim
+	runtime *fakeRuntime
+	events  <-chan *events.Envelope
+}
+
+func newTestHarness(t *testing.T, id string) *testHarness {
+	return newTestHarnessInNamespace(t, "testing", id)
+}
+
+func newTestHarnessInNamespace(t *testing.T, ns string, id string) *testHarness {
+	ctx, cancel := context.WithCancel(namespaces.WithNamespace(context.Background(), ns))
+	t.Cleanup(cancel)
+
+	manager := &TaskManager{
+		rootDir:  t.TempDir(),
+		stateDir: t.TempDir(),
+		tasks:    runtime.NewTaskList(),
+		events:   exchange.NewExchange(),
+	}
+
+	specValue, err := json.Marshal(&specs.Spec{
+		Version: specs.Version,
+		Process: &specs.Process{Args: []string{"sleep", "infinity"}},
+	})
+	if err != nil {
+		t.Fatalf("failed to marshal spec: %v", err)
+	}
+
+	bundle, err := pkgbundle.NewBundle(manager.rootDir, manager.stateDir,
+		ns, id,
+		withBundleApplyFormatVersion(),
+		withBundleApplyInitOCISpec(&types.Any{Value: specValue}),
+		withBundleApplyInitOptions(&options.Options{}),
+		withBundleApplyInitStdio(runtime.IO{}),
+		withBundleApplyInitTraceEventID(1),
+	)
+	if err != nil {
+		t.Fatalf("failed to create bundle: %v", err)
+	}
+
+	s, err := newShim(manager, bundle)
+	if err != nil {
+		t.Fatalf("failed to new shim: %v", err)
+	}
+
+	fake := newFakeRuntime(t.TempDir())
+	s.init.runtime = fake
+
+	evCh, _ := manager.events.Subscribe(ctx)
+	return &testHarness{
+		t:       t,
+		ctx:     ctx,
+		manager: manager,
+		shim:    s,
+		runtime: fake,
+		events:  evCh,
+	}
+}
+
+func (h *testHarness) expectStatus(expected string) {
+	h.t.Helper()
+
+	got, err := h.shim.init.Status(h.ctx)
+	if err != nil {
+		h.t.Fatalf("failed to get status: %v", err)
+	}
+	if got != expected {
+		h.t.Fatalf("expected status %v, but got %v", expected, got)
+	}
+}
+
+func (h *testHarness) expectEvent(topic string) interface{} {
+	h.t.Helper()
+
+	for {
+		select {
+		case env := <-h.events:
+			if env.Topic != topic {
+				continue
+			}
+
+			v, err := typeurl.UnmarshalAny(env.Event)
+			if err != nil {
+				h.t.Fatalf("failed to unmarshal event: %v", err)
+			}
+			return v
+		case <-time.After(5 * time.Second):
+			h.t.Fatalf("expected event %v, but got nothing", topic)
+		}
+	}
+}
+
+func TestInitProcessLifecycle(t *testing.T) {
+	h := newTestHarness(t, "lifecycle")
+	init := h.shim.init
+
+	if err := init.Create(h.ctx); err != nil {
+		t.Fatalf("failed to create: %v", err)
+	}
+	h.expectStatus("created")
+
+	if err := init.Start(h.ctx); err != nil {
+		t.Fatalf("failed to start: %v", err)
+	}
+	h.expectStatus("running")
+
+	if err := init.Start(h.ctx); err == nil {
+		t.Fatal("expected error when starting running process, but got nil")
+	}
+
+	if err := init.Delete(h.ctx); err == nil {
+		t.Fatal("expected error when deleting running process, but got nil")
+	}
+
+	if err := init.Kill(h.ctx, uint32(syscall.SIGTERM), false); err != nil {
+		t.Fatalf("failed to kill: %v", err)
+	}
+	if got := h.runtime.receivedSignals(init.ID()); len(got) != 1 || got[0] != int(syscall.SIGTERM) {
+		t.Fatalf("expected signals [%v], but got %v", int(syscall.SIGTERM), got)
+	}
+
+	// simulate the monitor: init exits with code 1
+	h.runtime.setStatus(init.ID(), "stopped")
+	init.SetExited(1 << 8)
+	h.expectStatus("stopped")
+
+	exit := h.expectEvent(runtime.TaskExitEventTopic).(*eventstypes.TaskExit)
+	if exit.ExitStatus != 1 {
+		t.Fatalf("expected exit status 1, but got %v", exit.ExitStatus)
+	}
+	if exit.Pid != uint32(init.Pid()) {
+		t.Fatalf("expected pid %v, but got %v", init.Pid(), exit.Pid)
+	}
+
+	if err := init.Kill(h.ctx, uint32(syscall.SIGKILL), false); !errors.Is(err, errdefs.ErrNotFound) {
+		t.Fatalf("expected ErrNotFound when killing stopped process, but got %v", err)
+	}
+
+	if err := init.Delete(h.ctx); err != nil {
+		t.Fatalf("failed to delete: %v", err)
+	}
+	if err := init.Delete(h.ctx); !errors.Is(err, errdefs.ErrNotFound) {
+		t.Fatalf("expected ErrNotFound when deleting twice, but got %v", err)
+	}
+
+	if _, err := h.runtime.State(h.ctx, init.ID()); err == nil {
+		t.Fatal("expected container removed from runtime, but got nil")
+	}
+}
+
+func TestInitProcessExitBeforeStart(t *testing.T) {
+	h := newTestHarness(t, "exit-before-start")
+	init := h.shim.init
+
+	if err := init.Create(h.ctx); err != nil {
+		t.Fatalf("failed to create: %v", err)
+	}
+
+	init.SetExited(137 << 8)
+	h.expectStatus("stopped")
+
+	if err := init.Start(h.ctx); err == nil {
+		t.Fatal("expected error when starting stopped process, but got nil")
+	}
+
+	exit := h.expectEvent(runtime.TaskExitEventTopic).(*eventstypes.TaskExit)
+	if exit.ExitStatus != 137 {
+		t.Fatalf("expected exit status 137, but got %v", exit.ExitStatus)
+	}
+}
+
+func TestInitProcessKillBeforeRestore(t *testing.T) {
+	h := newTestHarness(t, "kill-before-restore")
+	init := h.shim.init
+
+	init.initState = &createdCheckpointState{p: init}
+	if err := init.Kill(h.ctx, uint32(syscall.SIGTERM), false); !errors.Is(err, errdefs.ErrFailedPrecondition) {
+		t.Fatalf("expected ErrFailedPrecondition when killing unrestored process, but got %v", err)
+	}
+	if got := h.runtime.receivedSignals(init.ID()); len(got) != 0 {
+		t.Fatalf("expected no signal, but got %v", got)
+	}
+}
+
+func TestShimKillMarksStoppedOnlyForStoppingSignal(t *testing.T) {
+	h := newTestHarness(t, "kill-marks-stopped")
+	init := h.shim.init
+	init.restartPolicy = restartPolicy{name: restartPolicyAlways}
+
+	if err := init.Create(h.ctx); err != nil {
+		t.Fatalf("failed to create: %v", err)
+	}
+	if err := init.Start(h.ctx); err != nil {
+		t.Fatalf("failed to start: %v", err)
+	}
+
+	stopped := func() bool {
+		h.shim.restart.mu.Lock()
+		defer h.shim.restart.mu.Unlock()
+		return h.shim.restart.stopped
+	}
+
+	if err := h.shim.Kill(h.ctx, uint32(syscall.SIGHUP), false); err != nil {
+		t.Fatalf("failed to kill: %v", err)
+	}
+	if stopped() {
+		t.Fatal("expected restart kept after SIGHUP")
+	}
+
+	h.runtime.injectError("Kill", errors.New("oci runtime failure"))
+	if err := h.shim.Kill(h.ctx, uint32(syscall.SIGTERM), false); err == nil {
+		t.Fatal("expected error when runtime fails to kill, but got nil")
+	}
+	if stopped() {
+		t.Fatal("expected restart kept after failed kill")
+	}
+
+	h.runtime.injectError("Kill", nil)
+	if err := h.shim.Kill(h.ctx, uint32(syscall.SIGTERM), false); err != nil {
+		t.Fatalf("failed to kill: %v", err)
+	}
+	if !stopped() {
+		t.Fatal("expected restart disabled after SIGTERM")
+	}
+}
+
+func TestInitProcessCreateFailure(t *testing.T) {
+	h := newTestHarness(t, "create-failure")
+	init := h.shim.init
+
+	h.runtime.injectError("Create", errors.New("oci runtime failure"))
+	if err := init.Create(h.ctx); err == nil {
+		t.Fatal("expected error when runtime fails to create, but got nil")
+	}
+}
+
+func TestInitProcessStartRetry(t *testing.T) {
+	h := newTestHarness(t, "start-retry")
+	h.manager.config = &Config{
+		StartRetry: StartRetryConfig{MaxRetries: 2, Backoff: "1ms"},
+	}
+	init := h.shim.init
+
+	if err := init.Create(h.ctx); err != nil {
+		t.Fatalf("failed to create: %v", err)
+	}
+
+	h.runtime.injectError("Start", errors.New("resource temporarily unavailable"))
+	if err := init.Start(h.ctx); err == nil {
+		t.Fatal("expected error after retries, but got nil")
+	}
+	h.expectStatus("created")
+
+	// the start took effect but the OCI runtime reported failure
+	h.runtime.setStatus(init.ID(), "running")
+	if err := init.Start(h.ctx); err != nil {
+		t.Fatalf("expected nil, but got %v", err)
+	}
+	h.expectStatus("running")
+}
+
+func TestInitProcessStartNoRetryOnPermanentError(t *testing.T) {
+	h := newTestHarness(t, "start-no-retry")
+	h.manager.config = &Config{
+		StartRetry: StartRetryConfig{MaxRetries: 2, Backoff: "1ms"},
+	}
+	init := h.shim.init
+
+	if err := init.Create(h.ctx); err != nil {
+		t.Fatalf("failed to create: %v", err)
+	}
+
+	// the state isn't checked for the permanent error
+	h.runtime.injectError("Start", errors.New("exec: \"foo\": executable file not found in $PATH"))
+	h.runtime.setStatus(init.ID(), "running")
+	if err := init.Start(h.ctx); err == nil {
+		t.Fatal("expected error, but got nil")
+	}
+	h.expectStatus("created")
+}
@@ -0,0 +1,58 @@
+//go:build linux
+// +build linux
+
+package embedshim
+
+import (
+	"context"
+	"time"
+)
+
+// initSnapshot is the immutable view of the init process's state.
+//
+// It is published atomically on every state change so that the status queries
+// don't contend with the lifecycle operations holding the process lock, like
+// a long Kill or Checkpoint.
+type initSnapshot struct {
+	status     string
+	stopping   bool
+	deleted    bool
+	pid        int
+	exitStatus int
+	startedAt  time.Time
+	exitedAt   time.Time
+}
+
+// setState transitions the init process into the new state and publishes the
+// snapshot. The caller must hold p.mu.
+func (p *initProcess) setState(s initState) {
+	p.initState = s
+	p.publishSnapshot()
+}
+
+// publishSnapshot copies the current state into a new snapshot. The caller
+// must hold p.mu.
+func (p *initProcess) publishSnapshot() {
+	status, _ := p.initState.Status(context.Background())
+	_, stopping := p.initState.(*stoppingState)
+	_, deleted := p.initState.(*deletedState)
+
+	p.snapshot.Store(&initSnapshot{
+		status:     status,
+		stopping:   stopping,
+		deleted:    deleted,
+		pid:        p.pid,
+		exitStatus: p.status,
+		startedAt:  p.startedAt,
+		exitedAt:   p.exited,
+	})
+
+	if p.parent != nil {
+		p.parent.persistStatus()
+	}
+}
+
+// loadSnapshot returns the last published snapshot without locking.
+func (p *initProcess) loadSnapshot() *initSnapshot {
+	return p.snapshot.Load().(*initSnapshot)
+}
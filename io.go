@@ -1,3 +1,6 @@
+//go:build linux
+// +build linux
+
 /*
    Copyright The containerd Authors.
 
@@ -27,6 +30,7 @@ import (
 	"sync"
 	"syscall"
 
+	"github.com/containerd/containerd/errdefs"
 	"github.com/containerd/containerd/pkg/stdio"
 	"github.com/containerd/fifo"
 	"github.com/containerd/go-runc"
@@ -151,8 +155,29 @@ func (p *processIO) IO() runc.IO {
 	return p.io
 }
 
+// withRateLimit relays the stdout and stderr with rate limiter. The buffer
+// IO is capped by itself and it is not limited.
+func (p *processIO) withRateLimit(uid, gid int, l *ioRateLimiter) error {
+	if l == nil || p.stdio.IsNull() {
+		return nil
+	}
+
+	switch p.io.(type) {
+	case *pipeIO, *fileIO:
+	default:
+		return nil
+	}
+
+	rio, err := newRateLimitedIO(p.io, uid, gid, l)
+	if err != nil {
+		return err
+	}
+	p.io = rio
+	return nil
+}
+
 func (p *processIO) CopyStdin() error {
-	if p.stdio.Stdin == "" {
+	if p.stdio.Stdin == "" || isVsockURI(p.stdio.Stdin) {
 		return nil
 	}
 
@@ -176,7 +201,61 @@ func (p *processIO) CopyStdin() error {
 	return nil
 }
 
-func createIO(_ context.Context, _ string, ioUID, ioGID int, stdio stdio.Stdio) (*processIO, error) {
+// StdioMode is the way to setup init process's stdio.
+type StdioMode string
+
+const (
+	// StdioModeDefault uses the stdio URIs provided by caller.
+	StdioModeDefault StdioMode = "default"
+
+	// StdioModeNull attaches /dev/null to stdio and ignores the URIs
+	// provided by caller. There is no copy goroutine for the init process.
+	StdioModeNull StdioMode = "null"
+
+	// StdioModeFluent forwards stdout and stderr to the Fluentd or Fluent
+	// Bit forward input defined by annotations, and ignores the URIs
+	// provided by caller. The exec processes' stdio isn't changed.
+	StdioModeFluent StdioMode = "fluent"
+)
+
+func stdioModeFromAnnotations(annotations map[string]string) (StdioMode, error) {
+	v, ok := annotations[annotationStdioMode]
+	if !ok || v == "" {
+		return StdioModeDefault, nil
+	}
+
+	switch mode := StdioMode(v); mode {
+	case StdioModeDefault, StdioModeNull, StdioModeFluent:
+		return mode, nil
+	default:
+		return "", fmt.Errorf("invalid annotation %s=%q: %w", annotationStdioMode, v, errdefs.ErrInvalidArgument)
+	}
+}
+
+// newDevNullIO attaches /dev/null to stdout and stderr. Unlike the runc's
+// NullIO, the /dev/null is opened in write mode so that the writes from
+// container are discarded instead of failing with EBADF.
+func newDevNullIO() (_ runc.IO, retErr error) {
+	var files []*os.File
+	defer func() {
+		if retErr != nil {
+			for _, f := range files {
+				f.Close()
+			}
+		}
+	}()
+
+	for i := 0; i < 2; i++ {
+		f, err := os.OpenFile(os.DevNull, os.O_WRONLY, 0)
+		if err != nil {
+			return nil, err
+		}
+		files = append(files, f)
+	}
+	return &pipeIO{out: files[0], err: files[1]}, nil
+}
+
+func createIO(_ context.Context, owner stdioOwner, ioUID, ioGID int, stdio stdio.Stdio) (*processIO, error) {
 	pio := &processIO{
 		stdio: stdio,
 	}
@@ -190,6 +269,16 @@ func createIO(_ context.Context, _ string, ioUID, ioGID int, stdio stdio.Stdio)
 		return pio, nil
 	}
 
+	// NOTE: The stdout might be empty if only the stdin uses vsock.
+	if isVsockStdio(stdio) {
+		i, err := newRuncVsockIO(stdio)
+		if err != nil {
+			return nil, err
+		}
+		pio.io = i
+		return pio, nil
+	}
+
 	u, err := url.Parse(stdio.Stdout)
 	if err != nil {
 		return nil, fmt.Errorf("unable to parse stdout uri: %w", err)
@@ -201,6 +290,12 @@ func createIO(_ context.Context, _ string, ioUID, ioGID int, stdio stdio.Stdio)
 	switch u.Scheme {
 	case "fifo":
 		pio.io, err = newRuncPipeIO(ioUID, ioGID, stdio)
+	case "file":
+		pio.io, err = newRuncFileIO(ioUID, ioGID, u, stdio)
+	case "buffer":
+		pio.io, err = newRuncBufferIO(ioUID, ioGID, stdio)
+	case "journald":
+		pio.io, err = newRuncJournalIO(ioUID, ioGID, u, owner, stdio)
 	default:
 		return nil, fmt.Errorf("unknown STDIO scheme %s", u.Scheme)
 	}
@@ -0,0 +1,293 @@
+//go:build linux
+// +build linux
+
+package embedshim
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/containerd/containerd/errdefs"
+	"github.com/containerd/go-runc"
+)
+
+// rateLimitDrainTimeout is the max time to wait for the relay goroutines to
+// drain the pipes when the IO is closed.
+var rateLimitDrainTimeout = time.Second
+
+// ioRateLimitMode decides what to do with the output beyond the rate limit.
+type ioRateLimitMode string
+
+const (
+	// ioRateLimitThrottle blocks the relay until there are enough tokens.
+	// The container's write will be blocked once the pipe is full.
+	ioRateLimitThrottle ioRateLimitMode = "throttle"
+
+	// ioRateLimitDrop discards the output beyond the rate limit.
+	ioRateLimitDrop ioRateLimitMode = "drop"
+)
+
+// ioRateLimiter is token bucket shared by the container's init and exec
+// processes' stdout and stderr.
+type ioRateLimiter struct {
+	mode  ioRateLimitMode
+	rate  float64 // bytes per second
+	burst float64
+
+	mu     sync.Mutex
+	tokens float64
+	last   time.Time
+
+	droppedBytes   uint64
+	throttledNanos uint64
+}
+
+func newIORateLimiter(mode ioRateLimitMode, rate, burst int64) *ioRateLimiter {
+	return &ioRateLimiter{
+		mode:   mode,
+		rate:   float64(rate),
+		burst:  float64(burst),
+		tokens: float64(burst),
+		last:   time.Now(),
+	}
+}
+
+// ioRateLimiterFromAnnotations returns nil if the rate limit isn't set.
+func ioRateLimiterFromAnnotations(annotations map[string]string) (*ioRateLimiter, error) {
+	v, ok := annotations[annotationStdioRateLimit]
+	if !ok || v == "" {
+		return nil, nil
+	}
+
+	rate, err := strconv.ParseInt(v, 10, 64)
+	if err != nil || rate <= 0 {
+		return nil, fmt.Errorf("invalid annotation %s=%q: %w", annotationStdioRateLimit, v, errdefs.ErrInvalidArgument)
+	}
+
+	burst := rate
+	if v := annotations[annotationStdioRateBurst]; v != "" {
+		burst, err = strconv.ParseInt(v, 10, 64)
+		if err != nil || burst <= 0 {
+			return nil, fmt.Errorf("invalid annotation %s=%q: %w", annotationStdioRateBurst, v, errdefs.ErrInvalidArgument)
+		}
+	}
+
+	mode := ioRateLimitThrottle
+	if v := annotations[annotationStdioRateLimitMode]; v != "" {
+		switch m := ioRateLimitMode(v); m {
+		case ioRateLimitThrottle, ioRateLimitDrop:
+			mode = m
+		default:
+			return nil, fmt.Errorf("invalid annotation %s=%q: %w", annotationStdioRateLimitMode, v, errdefs.ErrInvalidArgument)
+		}
+	}
+	return newIORateLimiter(mode, rate, burst), nil
+}
+
+// refill must be called with l.mu held.
+func (l *ioRateLimiter) refill(now time.Time) {
+	l.tokens += now.Sub(l.last).Seconds() * l.rate
+	if l.tokens > l.burst {
+		l.tokens = l.burst
+	}
+	l.last = now
+}
+
+// allow returns the number of bytes which can be written right now.
+func (l *ioRateLimiter) allow(n int) int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.refill(time.Now())
+	if l.tokens < 1 {
+		return 0
+	}
+	if float64(n) > l.tokens {
+		n = int(l.tokens)
+	}
+	l.tokens -= float64(n)
+	return n
+}
+
+// reserve takes n tokens and returns the time to wait before writing.
+func (l *ioRateLimiter) reserve(n int) time.Duration {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.refill(time.Now())
+	l.tokens -= float64(n)
+	if l.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-l.tokens / l.rate * float64(time.Second))
+}
+
+// write writes p into dst based on the mode. It returns false if done is
+// closed during throttling.
+func (l *ioRateLimiter) write(done <-chan struct{}, dst io.Writer, p []byte) bool {
+	if l.mode == ioRateLimitDrop {
+		n := l.allow(len(p))
+		if n > 0 {
+			dst.Write(p[:n])
+		}
+		if dropped := len(p) - n; dropped > 0 {
+			atomic.AddUint64(&l.droppedBytes, uint64(dropped))
+		}
+		return true
+	}
+
+	for len(p) > 0 {
+		chunk := p
+		if float64(len(chunk)) > l.burst {
+			chunk = chunk[:int(l.burst)]
+		}
+
+		if wait := l.reserve(len(chunk)); wait > 0 {
+			atomic.AddUint64(&l.throttledNanos, uint64(wait))
+
+			timer := time.NewTimer(wait)
+			select {
+			case <-done:
+				timer.Stop()
+				return false
+			case <-timer.C:
+			}
+		}
+
+		dst.Write(chunk)
+		p = p[len(chunk):]
+	}
+	return true
+}
+
+func (l *ioRateLimiter) dropped() uint64 {
+	return atomic.LoadUint64(&l.droppedBytes)
+}
+
+func (l *ioRateLimiter) throttled() time.Duration {
+	return time.Duration(atomic.LoadUint64(&l.throttledNanos))
+}
+
+// rateLimitedIO relays the stdout and stderr into the destinations of the
+// underlying IO with rate limit.
+//
+// NOTE: Unlike the fifo and file, the process writes into the pipe and the
+// relay goroutine is required. Like terminal, the relay stops if containerd
+// restarts.
+type rateLimitedIO struct {
+	runc.IO
+
+	out, err *os.File
+	readers  []*os.File
+
+	done      chan struct{}
+	wg        sync.WaitGroup
+	closeOnce sync.Once
+}
+
+// newRateLimitedIO wraps the IO whose stdout and stderr are writable files,
+// like fifo and file.
+func newRateLimitedIO(rio runc.IO, uid, gid int, l *ioRateLimiter) (_ runc.IO, retErr error) {
+	i := &rateLimitedIO{
+		IO:   rio,
+		done: make(chan struct{}),
+	}
+	defer func() {
+		if retErr != nil {
+			i.closeRelay()
+		}
+	}()
+
+	for _, target := range []struct {
+		dst io.ReadCloser
+		w   **os.File
+	}{
+		{rio.Stdout(), &i.out},
+		{rio.Stderr(), &i.err},
+	} {
+		dst, ok := target.dst.(*os.File)
+		if !ok || dst == nil {
+			continue
+		}
+
+		r, w, err := os.Pipe()
+		if err != nil {
+			return nil, err
+		}
+		i.readers = append(i.readers, r)
+		*target.w = w
+
+		if err := w.Chown(uid, gid); err != nil {
+			return nil, fmt.Errorf("failed to chown rate limited pipe: %w", err)
+		}
+
+		i.wg.Add(1)
+		go func() {
+			defer i.wg.Done()
+
+			buf := bufPool.Get().(*[]byte)
+			defer bufPool.Put(buf)
+
+			for {
+				n, err := r.Read(*buf)
+				if n > 0 && !l.write(i.done, dst, (*buf)[:n]) {
+					return
+				}
+				if err != nil {
+					return
+				}
+			}
+		}()
+	}
+	return i, nil
+}
+
+// Set sets the io to the exec.Cmd.
+func (i *rateLimitedIO) Set(cmd *exec.Cmd) {
+	i.IO.Set(cmd)
+	if i.out != nil {
+		cmd.Stdout = i.out
+	}
+	if i.err != nil {
+		cmd.Stderr = i.err
+	}
+}
+
+// CloseAfterStart closes the write side of relay pipes. The destinations are
+// still held by relay goroutines.
+func (i *rateLimitedIO) CloseAfterStart() error {
+	for _, f := range []*os.File{i.out, i.err} {
+		if f != nil {
+			f.Close()
+		}
+	}
+	return nil
+}
+
+// closeRelay gives the relay goroutines a chance to drain the pipes and then
+// stops them. The pipe might be held by the daemon process forked by the
+// container.
+func (i *rateLimitedIO) closeRelay() {
+	i.closeOnce.Do(func() {
+		i.CloseAfterStart()
+		waitTimeout(context.Background(), &i.wg, rateLimitDrainTimeout)
+
+		close(i.done)
+		for _, r := range i.readers {
+			r.Close()
+		}
+		i.wg.Wait()
+	})
+}
+
+func (i *rateLimitedIO) Close() error {
+	i.closeRelay()
+	return i.IO.Close()
+}
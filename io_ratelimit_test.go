@@ -0,0 +1,25 @@
+//go:build linux
+// +build linux
+
+package embedshim
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestIORateLimiterDrop(t *testing.T) {
+	var (
+		l   = newIORateLimiter(ioRateLimitDrop, 1, 10)
+		dst bytes.Buffer
+	)
+
+	l.write(nil, &dst, bytes.Repeat([]byte("x"), 25))
+
+	if dst.Len() != 10 {
+		t.Fatalf("expected %v bytes written, but got %v", 10, dst.Len())
+	}
+	if got := l.dropped(); got != 15 {
+		t.Fatalf("expected %v bytes dropped, but got %v", 15, got)
+	}
+}
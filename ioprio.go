@@ -0,0 +1,151 @@
+//go:build linux
+// +build linux
+
+package embedshim
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+
+	"github.com/containerd/containerd/errdefs"
+	"golang.org/x/sys/unix"
+)
+
+// The ioprio values are from linux/ioprio.h.
+const (
+	ioprioClassNone = 0
+	ioprioClassRT   = 1
+	ioprioClassBE   = 2
+	ioprioClassIdle = 3
+
+	ioprioClassShift = 13
+	ioprioWhoProcess = 1
+
+	defaultIOPrioLevel = 4
+)
+
+// ioprioClasses maps the annotation value to the I/O scheduling class.
+var ioprioClasses = map[string]int{
+	"none":        ioprioClassNone,
+	"realtime":    ioprioClassRT,
+	"best-effort": ioprioClassBE,
+	"idle":        ioprioClassIdle,
+}
+
+// ioprioConfig is the I/O scheduling class and priority of the process,
+// like ionice(1), which is honored by the BFQ and mq-deadline schedulers.
+type ioprioConfig struct {
+	class int
+	// level is in [0, 7] and the lower one has higher priority. It is
+	// ignored by the idle class.
+	level int
+}
+
+func (cfg *ioprioConfig) value() int {
+	return cfg.class<<ioprioClassShift | cfg.level
+}
+
+func (cfg *ioprioConfig) String() string {
+	for name, class := range ioprioClasses {
+		if class == cfg.class {
+			return fmt.Sprintf("%s:%d", name, cfg.level)
+		}
+	}
+	return strconv.Itoa(cfg.value())
+}
+
+// initIOPrioFromAnnotations returns nil if the init process's ioprio isn't
+// set.
+func initIOPrioFromAnnotations(annotations map[string]string) (*ioprioConfig, error) {
+	return ioprioFromAnnotations(annotations, annotationIOPrioClass, annotationIOPrioLevel)
+}
+
+// execIOPrioFromAnnotations returns the exec processes' ioprio. The init
+// process's one is used if it is unset.
+func execIOPrioFromAnnotations(annotations map[string]string) (*ioprioConfig, error) {
+	if annotations[annotationExecIOPrioClass] == "" {
+		return initIOPrioFromAnnotations(annotations)
+	}
+	return ioprioFromAnnotations(annotations, annotationExecIOPrioClass, annotationExecIOPrioLevel)
+}
+
+func ioprioFromAnnotations(annotations map[string]string, classKey, levelKey string) (*ioprioConfig, error) {
+	v := annotations[classKey]
+	if v == "" {
+		if annotations[levelKey] != "" {
+			return nil, fmt.Errorf("annotation %s requires %s: %w", levelKey, classKey, errdefs.ErrInvalidArgument)
+		}
+		return nil, nil
+	}
+
+	class, ok := ioprioClasses[v]
+	if !ok {
+		return nil, fmt.Errorf("invalid annotation %s=%q: %w", classKey, v, errdefs.ErrInvalidArgument)
+	}
+
+	cfg := &ioprioConfig{class: class, level: defaultIOPrioLevel}
+	if class == ioprioClassNone || class == ioprioClassIdle {
+		cfg.level = 0
+	}
+
+	if v := annotations[levelKey]; v != "" {
+		level, err := strconv.Atoi(v)
+		if err != nil || level < 0 || level > 7 {
+			return nil, fmt.Errorf("invalid annotation %s=%q, expected [0, 7]: %w", levelKey, v, errdefs.ErrInvalidArgument)
+		}
+		if class == ioprioClassNone || class == ioprioClassIdle {
+			return nil, fmt.Errorf("annotation %s can't be used with %s class: %w", levelKey, annotations[classKey], errdefs.ErrInvalidArgument)
+		}
+		cfg.level = level
+	}
+	return cfg, nil
+}
+
+// apply sets the ioprio of all the threads of the process and reads it
+// back, since the I/O context is per thread. The ioprio is inherited by
+// the children and kept across execve.
+func (cfg *ioprioConfig) apply(pid int) error {
+	tids, err := os.ReadDir(filepath.Join("/proc", strconv.Itoa(pid), "task"))
+	if err != nil {
+		return err
+	}
+
+	for _, entry := range tids {
+		tid, err := strconv.Atoi(entry.Name())
+		if err != nil {
+			continue
+		}
+
+		if err := cfg.applyThread(tid); err != nil {
+			// The thread might exit.
+			if err == unix.ESRCH {
+				continue
+			}
+			return fmt.Errorf("failed to set ioprio %s on thread %d: %w", cfg, tid, err)
+		}
+	}
+	return nil
+}
+
+func (cfg *ioprioConfig) applyThread(tid int) error {
+	if _, _, errno := unix.Syscall(unix.SYS_IOPRIO_SET, ioprioWhoProcess, uintptr(tid), uintptr(cfg.value())); errno != 0 {
+		return errno
+	}
+
+	// NOTE: The none class is reported as the effective priority derived
+	// from the nice value by the newer kernel, so it can't be verified.
+	if cfg.class == ioprioClassNone {
+		return nil
+	}
+
+	got, _, errno := unix.Syscall(unix.SYS_IOPRIO_GET, ioprioWhoProcess, uintptr(tid), 0)
+	if errno != 0 {
+		return errno
+	}
+	if int(got) != cfg.value() {
+		return fmt.Errorf("ioprio is %d after set, expected %d", int(got), cfg.value())
+	}
+	return nil
+}
@@ -0,0 +1,60 @@
+//go:build linux
+// +build linux
+
+package embedshim
+
+import (
+	"testing"
+)
+
+func TestIOPrioFromAnnotations(t *testing.T) {
+	for _, tc := range []struct {
+		annotations map[string]string
+		expected    *ioprioConfig
+		hasErr      bool
+	}{
+		{annotations: nil},
+		{annotations: map[string]string{annotationIOPrioClass: "idle"}, expected: &ioprioConfig{class: ioprioClassIdle}},
+		{annotations: map[string]string{annotationIOPrioClass: "best-effort"}, expected: &ioprioConfig{class: ioprioClassBE, level: 4}},
+		{annotations: map[string]string{annotationIOPrioClass: "realtime", annotationIOPrioLevel: "0"}, expected: &ioprioConfig{class: ioprioClassRT}},
+		{annotations: map[string]string{annotationIOPrioClass: "best-effort", annotationIOPrioLevel: "8"}, hasErr: true},
+		{annotations: map[string]string{annotationIOPrioClass: "idle", annotationIOPrioLevel: "1"}, hasErr: true},
+		{annotations: map[string]string{annotationIOPrioLevel: "1"}, hasErr: true},
+		{annotations: map[string]string{annotationIOPrioClass: "low"}, hasErr: true},
+	} {
+		cfg, err := initIOPrioFromAnnotations(tc.annotations)
+		if got := err != nil; got != tc.hasErr {
+			t.Fatalf("expected error %v for %v, but got %v", tc.hasErr, tc.annotations, err)
+		}
+		if tc.hasErr {
+			continue
+		}
+
+		if (cfg == nil) != (tc.expected == nil) || (cfg != nil && *cfg != *tc.expected) {
+			t.Fatalf("expected %v, but got %v", tc.expected, cfg)
+		}
+	}
+}
+
+func TestExecIOPrioFromAnnotations(t *testing.T) {
+	annotations := map[string]string{
+		annotationIOPrioClass: "best-effort",
+		annotationIOPrioLevel: "2",
+	}
+
+	cfg, err := execIOPrioFromAnnotations(annotations)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if cfg.value() != ioprioClassBE<<ioprioClassShift|2 {
+		t.Fatalf("expected init's ioprio, but got %v", cfg)
+	}
+
+	annotations[annotationExecIOPrioClass] = "idle"
+	if cfg, err = execIOPrioFromAnnotations(annotations); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if cfg.class != ioprioClassIdle {
+		t.Fatalf("expected idle class, but got %v", cfg)
+	}
+}
@@ -0,0 +1,284 @@
+//go:build linux
+// +build linux
+
+package embedshim
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/containerd/containerd/errdefs"
+	"github.com/containerd/containerd/pkg/stdio"
+	"github.com/containerd/go-runc"
+	"github.com/pkg/errors"
+	"golang.org/x/sys/unix"
+)
+
+var (
+	// journalSocketPath is the journald's native protocol socket.
+	journalSocketPath = "/run/systemd/journal/socket"
+
+	// journalStreamSocketPath is the journald's stdout stream socket.
+	journalStreamSocketPath = "/run/systemd/journal/stdout"
+
+	// journalQueryMode is the URI query key of the mode, native or stream.
+	// The default is native.
+	//
+	// The native mode copies each line into one entry with the container's
+	// metadata fields. Since the pipe is held by the plugin, the init
+	// process's entries stop after the plugin restarts.
+	//
+	// The stream mode passes the journald's stream socket as the process's
+	// stdout and stderr directly, which is copy-free and survives the
+	// plugin's restart. But the entries only have SYSLOG_IDENTIFIER and the
+	// fields added by journald, like _PID and _SYSTEMD_UNIT.
+	journalQueryMode = "mode"
+
+	// journalQueryName is the URI query key of CONTAINER_NAME, like
+	// journald://?name=web. The default is the container ID.
+	journalQueryName = "name"
+
+	// journalQueryTag is the URI query key of SYSLOG_IDENTIFIER. The
+	// default is the container name.
+	journalQueryTag = "tag"
+
+	// journalMaxLineSize is the max size of one entry's message. The longer
+	// line is split into the entries with CONTAINER_PARTIAL_MESSAGE=true,
+	// which keeps the datagram small enough without memfd.
+	journalMaxLineSize = 16 * 1024
+)
+
+const (
+	journalModeNative = "native"
+	journalModeStream = "stream"
+
+	journalPriorityErr  = "3"
+	journalPriorityInfo = "6"
+)
+
+// stdioOwner is the process which the stdio belongs to.
+type stdioOwner struct {
+	namespace   string
+	containerID string
+	// execID is empty for the init process.
+	execID string
+}
+
+// journalIO sends the stdout and stderr into journald, so that there is no
+// logging sidecar or intermediate log file on the systemd host.
+type journalIO struct {
+	*pipeIO
+
+	conn    *net.UnixConn
+	readers []*os.File
+	wg      sync.WaitGroup
+}
+
+func (i *journalIO) Close() error {
+	err := i.pipeIO.Close()
+	for _, r := range i.readers {
+		r.Close()
+	}
+	if i.conn != nil {
+		i.conn.Close()
+	}
+	return err
+}
+
+// newRuncJournalIO creates pipes as stdout and stderr, and sends each line
+// into journald. The stream mode uses the journald's sockets instead.
+func newRuncJournalIO(uid, gid int, u *url.URL, owner stdioOwner, stdio stdio.Stdio) (_ runc.IO, retErr error) {
+	if stdio.Terminal {
+		return nil, fmt.Errorf("journald stdio can't be used with terminal: %w", errdefs.ErrInvalidArgument)
+	}
+
+	mode := u.Query().Get(journalQueryMode)
+	switch mode {
+	case "":
+		mode = journalModeNative
+	case journalModeNative, journalModeStream:
+	default:
+		return nil, fmt.Errorf("invalid %s=%q: %w", journalQueryMode, mode, errdefs.ErrInvalidArgument)
+	}
+
+	fields := journalFieldsFromURL(u, owner)
+
+	i := &journalIO{pipeIO: &pipeIO{}}
+	defer func() {
+		if retErr != nil {
+			i.Close()
+		}
+	}()
+
+	var err error
+	if mode == journalModeNative {
+		i.conn, err = net.DialUnix("unixgram", nil, &net.UnixAddr{Name: journalSocketPath, Net: "unixgram"})
+		if err != nil {
+			return nil, fmt.Errorf("failed to connect journald: %w", err)
+		}
+	}
+
+	if stdio.Stdin != "" {
+		if i.in, err = newPipe(); err != nil {
+			return nil, err
+		}
+		if err = unix.Fchown(int(i.in.r.Fd()), uid, gid); err != nil {
+			return nil, errors.Wrap(err, "failed to chown stdin")
+		}
+	}
+
+	for _, target := range []struct {
+		uri      string
+		w        **os.File
+		priority string
+	}{
+		{stdio.Stdout, &i.out, journalPriorityInfo},
+		{stdio.Stderr, &i.err, journalPriorityErr},
+	} {
+		if target.uri == "" {
+			continue
+		}
+
+		if mode == journalModeStream {
+			// NOTE: fields[0] is SYSLOG_IDENTIFIER.
+			if *target.w, err = openJournalStream(fields[0][1], target.priority); err != nil {
+				return nil, err
+			}
+			continue
+		}
+
+		r, w, err := os.Pipe()
+		if err != nil {
+			return nil, err
+		}
+		i.readers = append(i.readers, r)
+		*target.w = w
+
+		if err = unix.Fchown(int(w.Fd()), uid, gid); err != nil {
+			return nil, errors.Wrap(err, "failed to chown output pipe")
+		}
+
+		entryFields := append(append([][2]string{}, fields...), [2]string{"PRIORITY", target.priority})
+
+		i.wg.Add(1)
+		go func() {
+			defer i.wg.Done()
+
+			sendJournalLines(i.conn, r, entryFields)
+		}()
+	}
+	return i, nil
+}
+
+// openJournalStream connects the journald's stream socket, which is used as
+// the process's output.
+func openJournalStream(identifier string, priority string) (*os.File, error) {
+	conn, err := net.DialUnix("unix", nil, &net.UnixAddr{Name: journalStreamSocketPath, Net: "unix"})
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect journald stream: %w", err)
+	}
+	defer conn.Close()
+
+	if err := conn.CloseRead(); err != nil {
+		return nil, err
+	}
+
+	// The header is identifier, unit ID, priority, level prefix, forward to
+	// syslog, kmsg and console.
+	header := fmt.Sprintf("%s\n\n%s\n0\n0\n0\n0\n", strings.ReplaceAll(identifier, "\n", " "), priority)
+	if _, err := conn.Write([]byte(header)); err != nil {
+		return nil, fmt.Errorf("failed to write journald stream header: %w", err)
+	}
+
+	// NOTE: File returns the blocking duplicate which is owned by caller.
+	return conn.File()
+}
+
+// journalFieldsFromURL returns the metadata fields of each entry. The first
+// one is SYSLOG_IDENTIFIER.
+func journalFieldsFromURL(u *url.URL, owner stdioOwner) [][2]string {
+	query := u.Query()
+
+	name := query.Get(journalQueryName)
+	if name == "" {
+		name = owner.containerID
+	}
+	tag := query.Get(journalQueryTag)
+	if tag == "" {
+		tag = name
+	}
+
+	fields := [][2]string{
+		{"SYSLOG_IDENTIFIER", tag},
+		{"CONTAINER_ID", owner.containerID},
+		{"CONTAINER_NAME", name},
+		{"CONTAINER_NAMESPACE", owner.namespace},
+	}
+	if owner.execID != "" {
+		fields = append(fields, [2]string{"CONTAINER_EXEC_ID", owner.execID})
+	}
+	return fields
+}
+
+// sendJournalLines sends each line as one entry until EOF. The entry is
+// dropped if journald isn't available, so that the process isn't blocked
+// on write.
+func sendJournalLines(conn *net.UnixConn, r io.Reader, fields [][2]string) {
+	br := bufio.NewReaderSize(r, journalMaxLineSize)
+	for {
+		line, err := br.ReadSlice('\n')
+		partial := err == bufio.ErrBufferFull
+
+		line = bytes.TrimSuffix(line, []byte("\n"))
+		if len(line) > 0 || (err == nil && !partial) {
+			conn.Write(journalEntry(line, partial, fields))
+		}
+
+		if err != nil && !partial {
+			return
+		}
+	}
+}
+
+// journalEntry encodes the entry in journald's native protocol.
+func journalEntry(message []byte, partial bool, fields [][2]string) []byte {
+	var buf bytes.Buffer
+
+	writeJournalField(&buf, "MESSAGE", message)
+	if partial {
+		writeJournalField(&buf, "CONTAINER_PARTIAL_MESSAGE", []byte("true"))
+	}
+	for _, f := range fields {
+		writeJournalField(&buf, f[0], []byte(f[1]))
+	}
+	return buf.Bytes()
+}
+
+// writeJournalField writes KEY=VALUE, or the binary-safe form if the value
+// contains newline: KEY, newline, 64-bit little-endian size, value, newline.
+func writeJournalField(buf *bytes.Buffer, key string, value []byte) {
+	if bytes.IndexByte(value, '\n') < 0 {
+		buf.WriteString(key)
+		buf.WriteByte('=')
+		buf.Write(value)
+		buf.WriteByte('\n')
+		return
+	}
+
+	var size [8]byte
+	binary.LittleEndian.PutUint64(size[:], uint64(len(value)))
+
+	buf.WriteString(key)
+	buf.WriteByte('\n')
+	buf.Write(size[:])
+	buf.Write(value)
+	buf.WriteByte('\n')
+}
@@ -0,0 +1,138 @@
+//go:build linux
+// +build linux
+
+package embedshim
+
+import (
+	"bufio"
+	"bytes"
+	"net"
+	"net/url"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/containerd/containerd/pkg/stdio"
+)
+
+func TestJournalEntry(t *testing.T) {
+	got := journalEntry([]byte("hello"), true, [][2]string{{"CONTAINER_ID", "c1"}, {"CONTAINER_NAME", "a\nb"}})
+
+	expected := "MESSAGE=hello\nCONTAINER_PARTIAL_MESSAGE=true\nCONTAINER_ID=c1\n" +
+		"CONTAINER_NAME\n\x03\x00\x00\x00\x00\x00\x00\x00a\nb\n"
+	if string(got) != expected {
+		t.Fatalf("expected %q, but got %q", expected, string(got))
+	}
+}
+
+func TestRuncJournalIONative(t *testing.T) {
+	old := journalSocketPath
+	journalSocketPath = filepath.Join(t.TempDir(), "socket")
+	defer func() { journalSocketPath = old }()
+
+	ln, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: journalSocketPath, Net: "unixgram"})
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	defer ln.Close()
+
+	oldMax := journalMaxLineSize
+	journalMaxLineSize = 16
+	defer func() { journalMaxLineSize = oldMax }()
+
+	u, _ := url.Parse("journald://?name=web")
+	i, err := newRuncJournalIO(0, 0, u, stdioOwner{namespace: "default", containerID: "c1", execID: "e1"},
+		stdio.Stdio{Stdout: u.String()})
+	if err != nil {
+		t.Fatalf("failed to create journald IO: %v", err)
+	}
+	defer i.Close()
+
+	w := i.(*journalIO).out
+	w.Write([]byte("first\n" + strings.Repeat("x", 20) + "\n"))
+	w.Close()
+
+	var entries []string
+	ln.SetReadDeadline(time.Now().Add(5 * time.Second))
+	for len(entries) < 3 {
+		buf := make([]byte, 4096)
+		n, err := ln.Read(buf)
+		if err != nil {
+			t.Fatalf("expected 3 entries, but got %v: %v", entries, err)
+		}
+		entries = append(entries, string(buf[:n]))
+	}
+
+	for _, field := range []string{"MESSAGE=first\n", "CONTAINER_ID=c1\n", "CONTAINER_NAME=web\n",
+		"CONTAINER_NAMESPACE=default\n", "CONTAINER_EXEC_ID=e1\n", "SYSLOG_IDENTIFIER=web\n", "PRIORITY=6\n"} {
+		if !strings.Contains(entries[0], field) {
+			t.Fatalf("expected %q in entry, but got %q", field, entries[0])
+		}
+	}
+	if !strings.Contains(entries[1], "MESSAGE="+strings.Repeat("x", 16)+"\n") ||
+		!strings.Contains(entries[1], "CONTAINER_PARTIAL_MESSAGE=true\n") {
+		t.Fatalf("expected partial entry, but got %q", entries[1])
+	}
+	if !strings.Contains(entries[2], "MESSAGE=xxxx\n") || strings.Contains(entries[2], "PARTIAL") {
+		t.Fatalf("expected last part of line, but got %q", entries[2])
+	}
+}
+
+func TestRuncJournalIOStream(t *testing.T) {
+	old := journalStreamSocketPath
+	journalStreamSocketPath = filepath.Join(t.TempDir(), "stdout")
+	defer func() { journalStreamSocketPath = old }()
+
+	ln, err := net.ListenUnix("unix", &net.UnixAddr{Name: journalStreamSocketPath, Net: "unix"})
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	defer ln.Close()
+
+	u, _ := url.Parse("journald://?mode=stream&tag=app")
+	i, err := newRuncJournalIO(0, 0, u, stdioOwner{namespace: "default", containerID: "c1"},
+		stdio.Stdio{Stderr: u.String()})
+	if err != nil {
+		t.Fatalf("failed to create journald IO: %v", err)
+	}
+	defer i.Close()
+
+	conn, err := ln.Accept()
+	if err != nil {
+		t.Fatalf("failed to accept: %v", err)
+	}
+	defer conn.Close()
+
+	w := i.(*journalIO).err
+	w.Write([]byte("oops\n"))
+	w.Close()
+
+	data, err := readAllWithTimeout(conn, 5*time.Second)
+	if err != nil {
+		t.Fatalf("failed to read stream: %v", err)
+	}
+	if expected := "app\n\n3\n0\n0\n0\n0\noops\n"; string(data) != expected {
+		t.Fatalf("expected %q, but got %q", expected, string(data))
+	}
+
+	if _, err := newRuncJournalIO(0, 0, mustParseURL(t, "journald://?mode=unknown"), stdioOwner{}, stdio.Stdio{}); err == nil {
+		t.Fatal("expected error for unknown mode, but got nil")
+	}
+}
+
+func readAllWithTimeout(conn net.Conn, timeout time.Duration) ([]byte, error) {
+	conn.SetReadDeadline(time.Now().Add(timeout))
+
+	var buf bytes.Buffer
+	_, err := buf.ReadFrom(bufio.NewReader(conn))
+	return buf.Bytes(), err
+}
+
+func mustParseURL(t *testing.T, s string) *url.URL {
+	u, err := url.Parse(s)
+	if err != nil {
+		t.Fatalf("failed to parse %s: %v", s, err)
+	}
+	return u
+}
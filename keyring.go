@@ -0,0 +1,67 @@
+//go:build linux
+// +build linux
+
+package embedshim
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/containerd/containerd/errdefs"
+)
+
+// KeyringMode is the way to setup the init process's kernel keyring.
+type KeyringMode string
+
+const (
+	// KeyringModeSession creates the new session keyring for the
+	// container, which is the OCI runtime's default behavior.
+	KeyringModeSession KeyringMode = "session"
+
+	// KeyringModeNone doesn't create the session keyring and the container
+	// inherits the caller's one, like --no-new-keyring. It is used on the
+	// hardened kernels which refuse to create keyring, or the keyring
+	// quota is exhausted by the many containers.
+	KeyringModeNone KeyringMode = "none"
+)
+
+// keyringModeFromAnnotations returns the empty mode if it isn't set, which
+// follows the runtime options' NoNewKeyring.
+func keyringModeFromAnnotations(annotations map[string]string) (KeyringMode, error) {
+	v, ok := annotations[annotationKeyring]
+	if !ok || v == "" {
+		return "", nil
+	}
+
+	switch mode := KeyringMode(v); mode {
+	case KeyringModeSession, KeyringModeNone:
+		return mode, nil
+	default:
+		return "", fmt.Errorf("invalid annotation %s=%q: %w", annotationKeyring, v, errdefs.ErrInvalidArgument)
+	}
+}
+
+// noNewKeyring returns true if the OCI runtime shouldn't create the session
+// keyring.
+func (p *initProcess) noNewKeyring() bool {
+	switch p.keyring {
+	case KeyringModeSession:
+		return false
+	case KeyringModeNone:
+		return true
+	default:
+		return p.options.NoNewKeyring
+	}
+}
+
+// keyringError explains the OCI runtime's failure to create the session
+// keyring, which is opaque, like "join session keyring: create session key:
+// disk quota exceeded".
+func (p *initProcess) keyringError(err error) error {
+	if err == nil || p.noNewKeyring() || !strings.Contains(err.Error(), "session key") {
+		return err
+	}
+	return fmt.Errorf("%v: the kernel refuses to create session keyring for the container, "+
+		"check kernel.keys.maxkeys and kernel.keys.maxbytes, or set annotation %s=%s: %w",
+		err, annotationKeyring, KeyringModeNone, errdefs.ErrFailedPrecondition)
+}
@@ -0,0 +1,238 @@
+//go:build linux
+// +build linux
+
+package embedshim
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"syscall"
+
+	"github.com/fuweid/embedshim/pkg/pidfd"
+
+	"github.com/containerd/cgroups"
+	cgroupsv2 "github.com/containerd/cgroups/v2"
+	"github.com/containerd/containerd/errdefs"
+	"github.com/containerd/containerd/log"
+	"golang.org/x/sys/unix"
+)
+
+const (
+	killAllFallbackNoPidfd  = "pidfd-unsupported"
+	killAllFallbackNoCgroup = "cgroup-unavailable"
+	killAllFallbackPaused   = "paused"
+)
+
+// killAllMaxPasses is the max number of the cgroup scans for SIGKILL, since
+// the processes might fork during the scan.
+var killAllMaxPasses = 8
+
+// errKillAllFallback means that the processes can't be signaled by pidfd,
+// and the caller should use `runc kill --all`.
+var errKillAllFallback = errors.New("kill all by pidfd is unavailable")
+
+// killAllFallbackStats counts the kill(all) calls which fall back to
+// `runc kill --all` by reason.
+type killAllFallbackStats struct {
+	noPidfd  uint64
+	noCgroup uint64
+	paused   uint64
+}
+
+func (stats *killAllFallbackStats) add(reason string) {
+	switch reason {
+	case killAllFallbackNoPidfd:
+		atomic.AddUint64(&stats.noPidfd, 1)
+	case killAllFallbackNoCgroup:
+		atomic.AddUint64(&stats.noCgroup, 1)
+	case killAllFallbackPaused:
+		atomic.AddUint64(&stats.paused, 1)
+	}
+}
+
+func (stats *killAllFallbackStats) snapshot() map[string]uint64 {
+	return map[string]uint64{
+		killAllFallbackNoPidfd:  atomic.LoadUint64(&stats.noPidfd),
+		killAllFallbackNoCgroup: atomic.LoadUint64(&stats.noCgroup),
+		killAllFallbackPaused:   atomic.LoadUint64(&stats.paused),
+	}
+}
+
+// killAll signals all the processes in the container's cgroup by
+// pidfd_send_signal. Unlike kill(2) by the pid read from cgroup.procs, the
+// pidfd pins the process, so that the signal can't be delivered to the
+// unrelated process which reuses the pid after the member exits.
+//
+// It returns errKillAllFallback if pidfd or cgroup is unavailable.
+//
+// NOTE: The paused container always falls back, because `runc kill --all`
+// thaws the cgroup so that SIGKILL takes effect.
+func (s *shim) killAll(ctx context.Context, signal uint32, paused bool) error {
+	reason, err := s.signalCgroupMembers(signal, paused)
+	if reason != "" {
+		s.manager.killFallbacks.add(reason)
+		log.G(ctx).WithError(err).Debugf("kill all of task %s falls back to runtime: %s", s.ID(), reason)
+		return errKillAllFallback
+	}
+	return err
+}
+
+func (s *shim) signalCgroupMembers(signal uint32, paused bool) (string, error) {
+	if paused {
+		return killAllFallbackPaused, nil
+	}
+
+	root := s.trimInitSubgroup(s.loadedIdentity().CgroupPath)
+	if root == "" || s.cg == nil {
+		return killAllFallbackNoCgroup, nil
+	}
+
+	passes := 1
+	if syscall.Signal(signal) == unix.SIGKILL {
+		passes = killAllMaxPasses
+	}
+
+	signaled := make(map[int]struct{})
+	for pass := 0; pass < passes; pass++ {
+		pids, err := s.cgroupPids()
+		if err != nil {
+			return killAllFallbackNoCgroup, err
+		}
+
+		n := 0
+		for _, pid := range pids {
+			if _, ok := signaled[pid]; ok {
+				continue
+			}
+
+			if err := signalCgroupMember(pid, root, syscall.Signal(signal)); err != nil {
+				if errors.Is(err, unix.ENOSYS) {
+					return killAllFallbackNoPidfd, err
+				}
+				return "", err
+			}
+			signaled[pid] = struct{}{}
+			n++
+		}
+
+		if n == 0 {
+			break
+		}
+	}
+
+	if len(signaled) == 0 {
+		return "", checkKillError(unix.ESRCH)
+	}
+	return "", nil
+}
+
+// killLeftovers signals the processes left in the cgroup after the init
+// process exits, when the OCI runtime refuses to signal the stopped
+// container. The frozen cgroup is thawed so that SIGKILL takes effect.
+//
+// NOTE: kill(2) is used if pidfd is unsupported. The membership is checked
+// right before signaling so that the window of pid reuse is narrow.
+func (s *shim) killLeftovers(ctx context.Context, signal uint32) error {
+	root := s.trimInitSubgroup(s.loadedIdentity().CgroupPath)
+	if root == "" || s.cg == nil {
+		return fmt.Errorf("cgroup of task %s is unavailable: %w", s.ID(), errdefs.ErrNotFound)
+	}
+
+	pids, err := s.cgroupPids()
+	if err != nil {
+		return fmt.Errorf("failed to get cgroup pids of task %s: %w", s.ID(), err)
+	}
+
+	n := 0
+	for _, pid := range pids {
+		err := signalCgroupMember(pid, root, syscall.Signal(signal))
+		if errors.Is(err, unix.ENOSYS) {
+			err = killCgroupMember(pid, root, syscall.Signal(signal))
+		}
+		if err != nil {
+			return err
+		}
+		n++
+	}
+
+	if n > 0 {
+		log.G(ctx).Infof("signaled %d leftover processes of stopped task %s with %d", n, s.ID(), signal)
+		if err := s.thawCgroup(); err != nil {
+			log.G(ctx).WithError(err).Warnf("failed to thaw cgroup of task %s", s.ID())
+		}
+	}
+	return nil
+}
+
+// thawCgroup thaws the task's cgroup, which is no-op if it isn't frozen.
+func (s *shim) thawCgroup() error {
+	switch cg := s.cg.(type) {
+	case cgroups.Cgroup:
+		return cg.Thaw()
+	case *cgroupsv2.Manager:
+		return cg.Thaw()
+	}
+	return nil
+}
+
+// killCgroupMember signals the pid by kill(2) if it is in the cgroup root.
+func killCgroupMember(pid int, root string, signal syscall.Signal) error {
+	cgroupPath, err := pidCgroupPath(pid)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return fmt.Errorf("failed to get cgroup of %d: %w", pid, err)
+	}
+	if !cgroupPathUnder(cgroupPath, root) {
+		return nil
+	}
+
+	if err := unix.Kill(pid, signal); err != nil && !errors.Is(err, unix.ESRCH) {
+		return fmt.Errorf("failed to signal %d: %w", pid, err)
+	}
+	return nil
+}
+
+// signalCgroupMember signals the pid if it is still in the cgroup root
+// after the pidfd is opened. The exited process is ignored.
+func signalCgroupMember(pid int, root string, signal syscall.Signal) error {
+	fd, err := pidfd.Open(uint32(pid), 0)
+	if err != nil {
+		if errors.Is(err, unix.ESRCH) {
+			return nil
+		}
+		return fmt.Errorf("failed to open pidfd for %d: %w", pid, err)
+	}
+	defer unix.Close(int(fd))
+
+	// NOTE: The pid might be reused between reading cgroup.procs and
+	// pidfd_open, so that it must be checked after the process is pinned.
+	cgroupPath, err := pidCgroupPath(pid)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return fmt.Errorf("failed to get cgroup of %d: %w", pid, err)
+	}
+	if !cgroupPathUnder(cgroupPath, root) {
+		return nil
+	}
+
+	if err := fd.SendSignal(signal, 0); err != nil && !errors.Is(err, unix.ESRCH) {
+		return fmt.Errorf("failed to signal %d: %w", pid, err)
+	}
+	return nil
+}
+
+// cgroupPathUnder returns true if the cgroup path is the root or its
+// descendant, like the exec subgroups.
+func cgroupPathUnder(cgroupPath, root string) bool {
+	root = filepath.Clean(root)
+	return cgroupPath == root || strings.HasPrefix(cgroupPath, root+"/")
+}
@@ -0,0 +1,84 @@
+//go:build linux
+// +build linux
+
+package embedshim
+
+import (
+	"errors"
+	"os"
+	"syscall"
+	"testing"
+
+	"github.com/containerd/containerd/errdefs"
+)
+
+func TestCgroupPathUnder(t *testing.T) {
+	for _, tc := range []struct {
+		cgroupPath string
+		root       string
+		expected   bool
+	}{
+		{cgroupPath: "/default/redis", root: "/default/redis", expected: true},
+		{cgroupPath: "/default/redis/exec-1", root: "/default/redis", expected: true},
+		{cgroupPath: "/default/redis/exec-1", root: "/default/redis/", expected: true},
+		{cgroupPath: "/default/redis-1", root: "/default/redis", expected: false},
+		{cgroupPath: "/default", root: "/default/redis", expected: false},
+	} {
+		if got := cgroupPathUnder(tc.cgroupPath, tc.root); got != tc.expected {
+			t.Fatalf("expected %v for %s under %s, but got %v", tc.expected, tc.cgroupPath, tc.root, got)
+		}
+	}
+}
+
+func TestKillAllFallbackStats(t *testing.T) {
+	var stats killAllFallbackStats
+
+	stats.add(killAllFallbackNoPidfd)
+	stats.add(killAllFallbackNoPidfd)
+	stats.add(killAllFallbackPaused)
+
+	got := stats.snapshot()
+	if got[killAllFallbackNoPidfd] != 2 || got[killAllFallbackPaused] != 1 || got[killAllFallbackNoCgroup] != 0 {
+		t.Fatalf("expected 2 %s and 1 %s, but got %v", killAllFallbackNoPidfd, killAllFallbackPaused, got)
+	}
+}
+
+func TestKillCgroupMember(t *testing.T) {
+	pid := os.Getpid()
+	cgroupPath, err := pidCgroupPath(pid)
+	if err != nil {
+		t.Skipf("cgroup is unavailable: %v", err)
+	}
+
+	// signal 0 only checks the permission
+	if err := killCgroupMember(pid, cgroupPath, syscall.Signal(0)); err != nil {
+		t.Fatalf("expected nil, but got %v", err)
+	}
+
+	// the process outside the root is skipped
+	if err := killCgroupMember(pid, "/embedshim-not-exist", syscall.SIGKILL); err != nil {
+		t.Fatalf("expected nil, but got %v", err)
+	}
+}
+
+func TestKillAllStoppedWithoutCgroup(t *testing.T) {
+	h := newTestHarness(t, "kill-all-stopped")
+	init := h.shim.init
+
+	if err := init.Create(h.ctx); err != nil {
+		t.Fatalf("failed to create: %v", err)
+	}
+	if err := init.Start(h.ctx); err != nil {
+		t.Fatalf("failed to start: %v", err)
+	}
+
+	h.runtime.setStatus(init.ID(), "stopped")
+	init.SetExited(0)
+	h.expectStatus("stopped")
+
+	// The runtime refuses to signal the stopped container and there is no
+	// cgroup to find the leftovers.
+	if err := init.Kill(h.ctx, uint32(syscall.SIGKILL), true); !errors.Is(err, errdefs.ErrNotFound) {
+		t.Fatalf("expected ErrNotFound, but got %v", err)
+	}
+}
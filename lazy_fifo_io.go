@@ -0,0 +1,138 @@
+//go:build linux
+// +build linux
+
+package embedshim
+
+import (
+	"context"
+	"io"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"sync"
+
+	"github.com/containerd/containerd/log"
+	"github.com/containerd/containerd/pkg/stdio"
+	"golang.org/x/sys/unix"
+)
+
+// lazyFifoIO relays the exec process's stdout and stderr by pipes, and opens
+// the client's FIFO at the first output. Most of the probes exit without
+// output or only check the exit code, so that the FIFO's mknod and open are
+// skipped in the common case.
+type lazyFifoIO struct {
+	*pipeIO
+
+	readers []*os.File
+}
+
+func (i *lazyFifoIO) Close() error {
+	err := i.pipeIO.Close()
+	for _, r := range i.readers {
+		r.Close()
+	}
+	return err
+}
+
+// canUseLazyFifoIO returns true if the stdout and stderr are FIFOs without
+// stdin and terminal.
+func canUseLazyFifoIO(stdio stdio.Stdio) bool {
+	if stdio.Terminal || stdio.Stdin != "" {
+		return false
+	}
+
+	for _, uri := range []string{stdio.Stdout, stdio.Stderr} {
+		if uri == "" {
+			continue
+		}
+
+		u, err := url.Parse(uri)
+		if err != nil || u.Scheme != "" {
+			return false
+		}
+	}
+	return true
+}
+
+// newLazyFifoIO creates the pipes as stdout and stderr. The relay goroutines
+// are tracked by wg, so that the exec's delete waits for them.
+func newLazyFifoIO(uid, gid int, stdio stdio.Stdio, wg *sync.WaitGroup) (_ *lazyFifoIO, retErr error) {
+	i := &lazyFifoIO{pipeIO: &pipeIO{}}
+	defer func() {
+		if retErr != nil {
+			i.Close()
+		}
+	}()
+
+	for _, target := range []struct {
+		path string
+		w    **os.File
+	}{
+		{stdio.Stdout, &i.out},
+		{stdio.Stderr, &i.err},
+	} {
+		if target.path == "" {
+			continue
+		}
+
+		r, w, err := os.Pipe()
+		if err != nil {
+			return nil, err
+		}
+		i.readers = append(i.readers, r)
+		*target.w = w
+
+		if err := unix.Fchown(int(w.Fd()), uid, gid); err != nil {
+			return nil, err
+		}
+
+		path := target.path
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			relayLazyFifo(r, path)
+		}()
+	}
+	return i, nil
+}
+
+// relayLazyFifo opens the FIFO after the first read and copies until EOF.
+func relayLazyFifo(r io.Reader, path string) {
+	buf := bufPool.Get().(*[]byte)
+	defer bufPool.Put(buf)
+
+	n, err := r.Read(*buf)
+	if n == 0 && err != nil {
+		notifyFifoEOF(path)
+		return
+	}
+
+	f, ferr := openRWFifo(context.TODO(), path, 0700)
+	if ferr != nil {
+		log.G(context.Background()).WithError(ferr).Warnf("failed to open exec fifo %s, discard output", path)
+
+		// NOTE: Drain the pipe so that the process isn't blocked.
+		io.CopyBuffer(ioutil.Discard, r, *buf)
+		return
+	}
+	defer f.Close()
+
+	// NOTE: The first read might return data with EOF.
+	if _, werr := f.Write((*buf)[:n]); werr != nil || err != nil {
+		return
+	}
+	io.CopyBuffer(f, r, *buf)
+}
+
+// notifyFifoEOF opens and closes the FIFO's write end, so that the attached
+// reader sees EOF. It does nothing if the client hasn't opened the FIFO,
+// which means that the client only waits for the exit code.
+func notifyFifoEOF(path string) {
+	fd, err := unix.Open(path, unix.O_WRONLY|unix.O_NONBLOCK|unix.O_CLOEXEC, 0)
+	if err != nil {
+		// ENXIO means no reader and ENOENT means no FIFO.
+		return
+	}
+	unix.Close(fd)
+}
@@ -0,0 +1,95 @@
+//go:build linux
+// +build linux
+
+package embedshim
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/containerd/containerd/pkg/stdio"
+)
+
+func TestCanUseLazyFifoIO(t *testing.T) {
+	for _, tc := range []struct {
+		stdio    stdio.Stdio
+		expected bool
+	}{
+		{stdio.Stdio{Stdout: "/run/fifo/out", Stderr: "/run/fifo/err"}, true},
+		{stdio.Stdio{Stdout: "/run/fifo/out"}, true},
+		{stdio.Stdio{Stdin: "/run/fifo/in", Stdout: "/run/fifo/out"}, false},
+		{stdio.Stdio{Stdout: "/run/fifo/out", Terminal: true}, false},
+		{stdio.Stdio{Stdout: "file:///var/log/out"}, false},
+		{stdio.Stdio{Stdout: "buffer://?size=1024"}, false},
+	} {
+		if got := canUseLazyFifoIO(tc.stdio); got != tc.expected {
+			t.Fatalf("expected %v for %+v, but got %v", tc.expected, tc.stdio, got)
+		}
+	}
+}
+
+func TestLazyFifoIOWithoutOutput(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "stdout")
+
+	var wg sync.WaitGroup
+	i, err := newLazyFifoIO(os.Getuid(), os.Getgid(), stdio.Stdio{Stdout: path}, &wg)
+	if err != nil {
+		t.Fatalf("failed to create lazy fifo io: %v", err)
+	}
+	defer i.Close()
+
+	i.CloseAfterStart()
+	wg.Wait()
+
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Fatalf("expected fifo not created, but got %v", err)
+	}
+}
+
+func TestLazyFifoIOWithOutput(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "stdout")
+
+	var wg sync.WaitGroup
+	i, err := newLazyFifoIO(os.Getuid(), os.Getgid(), stdio.Stdio{Stdout: path}, &wg)
+	if err != nil {
+		t.Fatalf("failed to create lazy fifo io: %v", err)
+	}
+	defer i.Close()
+
+	if _, err := i.out.Write([]byte("hello")); err != nil {
+		t.Fatalf("failed to write: %v", err)
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		if _, err := os.Stat(path); err == nil {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("expected fifo created after output")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	r, err := os.OpenFile(path, os.O_RDONLY|syscall.O_NONBLOCK, 0)
+	if err != nil {
+		t.Fatalf("failed to open fifo: %v", err)
+	}
+	defer r.Close()
+
+	i.CloseAfterStart()
+	wg.Wait()
+
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		t.Fatalf("failed to read fifo: %v", err)
+	}
+	if string(data) != "hello" {
+		t.Fatalf("expected hello, but got %q", string(data))
+	}
+}
@@ -0,0 +1,87 @@
+//go:build linux
+// +build linux
+
+package embedshim
+
+import (
+	"context"
+	"time"
+
+	"github.com/fuweid/embedshim/pkg/exitsnoop"
+
+	"github.com/containerd/containerd/log"
+)
+
+var (
+	// defaultMapResizeThreshold is the fill ratio of exitsnoop maps which
+	// triggers resize.
+	defaultMapResizeThreshold = 0.8
+
+	// mapResizeCheckInterval is the interval to check the maps' occupancy.
+	mapResizeCheckInterval = 30 * time.Second
+)
+
+// mapMaxEntries returns the exitsnoop maps' capacity based on MaxContainers
+// with 25% headroom. Zero means the default capacity in BPF object.
+func (manager *TaskManager) mapMaxEntries() uint32 {
+	if manager.config == nil || manager.config.MaxContainers == 0 {
+		return 0
+	}
+
+	n := manager.config.MaxContainers
+	return n + n/4
+}
+
+func (manager *TaskManager) mapResizeThreshold() float64 {
+	if manager.config == nil || manager.config.MapResizeThreshold <= 0 || manager.config.MapResizeThreshold > 1 {
+		return defaultMapResizeThreshold
+	}
+	return manager.config.MapResizeThreshold
+}
+
+// autoResizeMaps doubles the exitsnoop maps when their occupancy exceeds the
+// threshold so that the task creation doesn't fail at high container counts.
+func (manager *TaskManager) autoResizeMaps() {
+	ticker := time.NewTicker(mapResizeCheckInterval)
+	defer ticker.Stop()
+
+	threshold := manager.mapResizeThreshold()
+	for range ticker.C {
+		stats, err := manager.monitor.initStore.MapStats()
+		if err != nil {
+			log.G(context.Background()).WithError(err).Warn("failed to check exitsnoop maps occupancy")
+			continue
+		}
+
+		var maxEntries uint32
+		for _, st := range stats {
+			if st.MaxEntries == 0 || float64(st.Entries)/float64(st.MaxEntries) < threshold {
+				continue
+			}
+			if st.MaxEntries*2 > maxEntries {
+				maxEntries = st.MaxEntries * 2
+			}
+		}
+		if maxEntries == 0 {
+			continue
+		}
+
+		if err := manager.monitor.resizeMaps(manager.rootDir, maxEntries); err != nil {
+			log.G(context.Background()).WithError(err).Errorf("failed to resize exitsnoop maps to %d", maxEntries)
+			continue
+		}
+		log.G(context.Background()).Infof("resized exitsnoop maps to %d entries", maxEntries)
+	}
+}
+
+// resizeMaps resizes the pinned maps and reloads the store. It holds the lock
+// so that there is no new task traced during resize.
+func (m *monitor) resizeMaps(bpffsRoot string, maxEntries uint32) error {
+	m.Lock()
+	defer m.Unlock()
+
+	if err := exitsnoop.Resize(bpffsRoot, maxEntries); err != nil {
+		return err
+	}
+	return m.initStore.Reload(bpffsRoot)
+}
@@ -0,0 +1,201 @@
+//go:build linux
+// +build linux
+
+package embedshim
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/containerd/containerd/errdefs"
+	"github.com/containerd/containerd/log"
+	"github.com/containerd/typeurl"
+	"golang.org/x/sys/unix"
+)
+
+// TaskLifetimeExceededEventTopic is the topic of TaskLifetimeExceeded event.
+const TaskLifetimeExceededEventTopic = "/tasks/lifetime-exceeded"
+
+func init() {
+	typeurl.Register(&TaskLifetimeExceeded{}, "io.embedshim.events.v1", "TaskLifetimeExceeded")
+}
+
+var (
+	defaultLifetimeGracePeriod = 10 * time.Second
+
+	// bundleFileKeyLifetimeDeadline stores the deadline of the task's max
+	// lifetime so that it survives the plugin's restart.
+	bundleFileKeyLifetimeDeadline = "lifetime_deadline"
+)
+
+// TaskLifetimeExceeded is published before the task is killed because it
+// runs longer than the max lifetime. The following TaskExit event is caused
+// by this kill.
+type TaskLifetimeExceeded struct {
+	ContainerID string        `json:"container_id"`
+	MaxLifetime time.Duration `json:"max_lifetime"`
+	Signal      uint32        `json:"signal"`
+}
+
+// Field implements events.Event.
+func (e *TaskLifetimeExceeded) Field(fieldpath []string) (string, bool) {
+	if len(fieldpath) == 0 {
+		return "", false
+	}
+
+	switch fieldpath[0] {
+	case "container_id":
+		return e.ContainerID, len(e.ContainerID) > 0
+	}
+	return "", false
+}
+
+// lifetimeConfig is the task's max lifetime defined by annotations.
+type lifetimeConfig struct {
+	max time.Duration
+	// signal is sent first. The stop signal is used if it is zero.
+	signal syscall.Signal
+	// gracePeriod is the duration between signal and SIGKILL.
+	gracePeriod time.Duration
+}
+
+// lifetimeConfigFromAnnotations returns nil if the max lifetime isn't set.
+func lifetimeConfigFromAnnotations(annotations map[string]string) (*lifetimeConfig, error) {
+	v, ok := annotations[annotationMaxLifetime]
+	if !ok || v == "" {
+		return nil, nil
+	}
+
+	max, err := time.ParseDuration(v)
+	if err != nil || max <= 0 {
+		return nil, fmt.Errorf("invalid annotation %s=%q: %w", annotationMaxLifetime, v, errdefs.ErrInvalidArgument)
+	}
+
+	cfg := &lifetimeConfig{
+		max:         max,
+		gracePeriod: defaultLifetimeGracePeriod,
+	}
+
+	if v := annotations[annotationMaxLifetimeSignal]; v != "" {
+		if cfg.signal, err = parseSignal(v); err != nil {
+			return nil, fmt.Errorf("invalid annotation %s=%q: %w", annotationMaxLifetimeSignal, v, errdefs.ErrInvalidArgument)
+		}
+	}
+
+	if v := annotations[annotationMaxLifetimeGracePeriod]; v != "" {
+		if cfg.gracePeriod, err = time.ParseDuration(v); err != nil || cfg.gracePeriod < 0 {
+			return nil, fmt.Errorf("invalid annotation %s=%q: %w", annotationMaxLifetimeGracePeriod, v, errdefs.ErrInvalidArgument)
+		}
+	}
+	return cfg, nil
+}
+
+// initLifetimeEnforcer creates the enforcer if the max lifetime is defined.
+func (s *shim) initLifetimeEnforcer() {
+	if s.init.lifetime != nil {
+		s.lifetime = &lifetimeEnforcer{s: s, cfg: s.init.lifetime}
+	}
+}
+
+// lifetimeEnforcer kills the task when the max lifetime is exceeded. The
+// lifetime is counted from the first start and the restarts don't reset it.
+type lifetimeEnforcer struct {
+	s   *shim
+	cfg *lifetimeConfig
+
+	mu      sync.Mutex
+	timer   *time.Timer
+	stopped bool
+}
+
+// arm starts the timer with the persisted deadline, or the new one from
+// now. It is safe to call it many times.
+func (l *lifetimeEnforcer) arm() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.timer != nil || l.stopped {
+		return
+	}
+
+	pathname := filepath.Join(l.s.bundle.Path, bundleFileKeyLifetimeDeadline)
+
+	var deadline time.Time
+	if data, err := os.ReadFile(pathname); err == nil {
+		deadline, err = time.Parse(time.RFC3339Nano, string(data))
+		if err != nil {
+			log.G(context.Background()).WithError(err).Warnf("invalid lifetime deadline of task %s", l.s.ID())
+		}
+	}
+
+	if deadline.IsZero() {
+		deadline = time.Now().Add(l.cfg.max)
+		if err := os.WriteFile(pathname, []byte(deadline.Format(time.RFC3339Nano)), 0644); err != nil {
+			log.G(context.Background()).WithError(err).Warnf("failed to store lifetime deadline of task %s", l.s.ID())
+		}
+	}
+	l.timer = time.AfterFunc(time.Until(deadline), l.expire)
+}
+
+func (l *lifetimeEnforcer) stop() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.stopped = true
+	if l.timer != nil {
+		l.timer.Stop()
+	}
+}
+
+// expire sends the signal and then SIGKILL to all the processes if the init
+// process doesn't exit in grace period.
+func (l *lifetimeEnforcer) expire() {
+	ctx := context.Background()
+	s := l.s
+
+	l.mu.Lock()
+	stopped := l.stopped
+	l.mu.Unlock()
+	if stopped {
+		return
+	}
+
+	switch status, _ := s.init.Status(ctx); status {
+	case "stopped", "deleted":
+		return
+	}
+
+	signal := uint32(l.cfg.signal)
+	if signal == 0 {
+		signal = s.stopSignal()
+	}
+
+	log.G(ctx).Warnf("task %s exceeds max lifetime %s", s.ID(), l.cfg.max)
+	s.manager.publishEvent(s.Namespace(), TaskLifetimeExceededEventTopic, &TaskLifetimeExceeded{
+		ContainerID: s.ID(),
+		MaxLifetime: l.cfg.max,
+		Signal:      signal,
+	})
+
+	// NOTE: The task is marked stopped by Kill so that the restart policy
+	// doesn't restart it.
+	waitBlock := s.init.waitChan()
+	if err := s.Kill(ctx, signal, false); err != nil {
+		log.G(ctx).WithError(err).Warnf("failed to kill task %s exceeding max lifetime", s.ID())
+	}
+
+	select {
+	case <-waitBlock:
+		return
+	case <-time.After(l.cfg.gracePeriod):
+	}
+
+	if err := s.init.Kill(ctx, uint32(unix.SIGKILL), true); err != nil {
+		log.G(ctx).WithError(err).Warnf("failed to SIGKILL task %s exceeding max lifetime", s.ID())
+	}
+}
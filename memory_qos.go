@@ -0,0 +1,160 @@
+//go:build linux
+// +build linux
+
+package embedshim
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+
+	"github.com/containerd/cgroups"
+	"github.com/containerd/containerd/errdefs"
+	"github.com/containerd/containerd/log"
+	ptypes "github.com/gogo/protobuf/types"
+	"github.com/opencontainers/runtime-spec/specs-go"
+)
+
+// defaultMemoryThrottlingFactor is the same to kubelet's default.
+var defaultMemoryThrottlingFactor = 0.9
+
+// memoryQoS computes memory.min and memory.high like kubelet's Memory QoS
+// feature from the pod-level hints, which is only for cgroup v2.
+type memoryQoS struct {
+	// request is the memory request in bytes, which is used as
+	// memory.min.
+	request int64
+	// throttlingFactor is in (0, 1].
+	throttlingFactor float64
+	// nodeAllocatable is used to compute memory.high if there is no
+	// memory limit.
+	nodeAllocatable int64
+
+	mu sync.Mutex
+	// limit is the current memory limit of the container.
+	limit int64
+}
+
+func memoryQoSFromAnnotations(spec *specs.Spec) (*memoryQoS, error) {
+	annotations := spec.Annotations
+
+	v, ok := annotations[annotationMemoryQoSRequest]
+	if !ok || v == "" {
+		return nil, nil
+	}
+
+	request, err := strconv.ParseInt(v, 10, 64)
+	if err != nil || request < 0 {
+		return nil, fmt.Errorf("invalid annotation %s=%q: %w", annotationMemoryQoSRequest, v, errdefs.ErrInvalidArgument)
+	}
+
+	q := &memoryQoS{
+		request:          request,
+		throttlingFactor: defaultMemoryThrottlingFactor,
+	}
+
+	if v := annotations[annotationMemoryQoSThrottlingFactor]; v != "" {
+		factor, err := strconv.ParseFloat(v, 64)
+		if err != nil || factor <= 0 || factor > 1 {
+			return nil, fmt.Errorf("invalid annotation %s=%q, expected (0, 1]: %w", annotationMemoryQoSThrottlingFactor, v, errdefs.ErrInvalidArgument)
+		}
+		q.throttlingFactor = factor
+	}
+
+	if v := annotations[annotationMemoryQoSNodeAllocatable]; v != "" {
+		allocatable, err := strconv.ParseInt(v, 10, 64)
+		if err != nil || allocatable < 0 {
+			return nil, fmt.Errorf("invalid annotation %s=%q: %w", annotationMemoryQoSNodeAllocatable, v, errdefs.ErrInvalidArgument)
+		}
+		q.nodeAllocatable = allocatable
+	}
+
+	if r := spec.Linux; r != nil && r.Resources != nil && r.Resources.Memory != nil && r.Resources.Memory.Limit != nil {
+		q.limit = *r.Resources.Memory.Limit
+	}
+	return q, nil
+}
+
+// compute returns memory.min and memory.high. The zero high means "max".
+//
+// memory.high = floor[(request + factor * (limit - request)) / pageSize] * pageSize
+func (q *memoryQoS) compute(limit int64, pageSize int64) (min int64, high int64) {
+	if limit <= 0 {
+		limit = q.nodeAllocatable
+	}
+	if limit <= 0 || limit <= q.request {
+		return q.request, 0
+	}
+
+	high = q.request + int64(q.throttlingFactor*float64(limit-q.request))
+	high = high / pageSize * pageSize
+	if high >= limit {
+		high = 0
+	}
+	return q.request, high
+}
+
+// applyMemoryQoS programs memory.min and memory.high in the task's cgroup.
+func (s *shim) applyMemoryQoS(ctx context.Context) error {
+	q := s.init.memoryQoS
+	if q == nil {
+		return nil
+	}
+
+	if cgroups.Mode() != cgroups.Unified {
+		log.G(ctx).Warnf("memory QoS of task %s is ignored because it requires cgroup v2", s.ID())
+		return nil
+	}
+
+	cgroupPath := s.loadedIdentity().CgroupPath
+	if cgroupPath == "" {
+		return fmt.Errorf("cgroup of task %s is unavailable: %w", s.ID(), errdefs.ErrNotFound)
+	}
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	min, high := q.compute(q.limit, int64(os.Getpagesize()))
+
+	highValue := "max"
+	if high > 0 {
+		highValue = strconv.FormatInt(high, 10)
+	}
+
+	for file, value := range map[string]string{
+		"memory.min":  strconv.FormatInt(min, 10),
+		"memory.high": highValue,
+	} {
+		pathname := filepath.Join(cgroupv2Root, cgroupPath, file)
+		if err := os.WriteFile(pathname, []byte(value), 0); err != nil {
+			return fmt.Errorf("failed to write %s into %s: %w", value, pathname, err)
+		}
+	}
+	return nil
+}
+
+// updateMemoryQoS recomputes the memory QoS if the memory limit is updated.
+func (s *shim) updateMemoryQoS(ctx context.Context, r *ptypes.Any) error {
+	q := s.init.memoryQoS
+	if q == nil {
+		return nil
+	}
+
+	var resources specs.LinuxResources
+	if err := json.Unmarshal(r.Value, &resources); err != nil {
+		return err
+	}
+	if resources.Memory == nil || resources.Memory.Limit == nil {
+		return nil
+	}
+
+	q.mu.Lock()
+	q.limit = *resources.Memory.Limit
+	q.mu.Unlock()
+
+	return s.applyMemoryQoS(ctx)
+}
@@ -0,0 +1,40 @@
+//go:build linux
+// +build linux
+
+package embedshim
+
+import "testing"
+
+func TestMemoryQoSCompute(t *testing.T) {
+	const (
+		mib      = int64(1 << 20)
+		pageSize = int64(4096)
+	)
+
+	factor := 0.9
+	q := &memoryQoS{
+		request:          128 * mib,
+		throttlingFactor: factor,
+		nodeAllocatable:  1024 * mib,
+	}
+
+	for _, tc := range []struct {
+		limit        int64
+		expectedHigh int64
+	}{
+		// 128Mi + 0.9 * (256Mi - 128Mi), aligned by page size
+		{limit: 256 * mib, expectedHigh: (128*mib + int64(factor*float64(128*mib))) / pageSize * pageSize},
+		// node allocatable is used if no limit
+		{limit: 0, expectedHigh: (128*mib + int64(factor*float64(896*mib))) / pageSize * pageSize},
+		// limit is not greater than request
+		{limit: 128 * mib, expectedHigh: 0},
+	} {
+		min, high := q.compute(tc.limit, pageSize)
+		if min != q.request {
+			t.Fatalf("expected memory.min %v, but got %v", q.request, min)
+		}
+		if high != tc.expectedHigh {
+			t.Fatalf("expected memory.high %v with limit %v, but got %v", tc.expectedHigh, tc.limit, high)
+		}
+	}
+}
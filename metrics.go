@@ -0,0 +1,365 @@
+//go:build linux
+// +build linux
+
+package embedshim
+
+import (
+	"context"
+	"sync/atomic"
+
+	"github.com/fuweid/embedshim/pkg/exitsnoop"
+
+	"github.com/containerd/cgroups"
+	"github.com/containerd/containerd/log"
+	"github.com/containerd/containerd/namespaces"
+	metrics "github.com/docker/go-metrics"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	exitsnoopProgramRunCountDesc = prometheus.NewDesc(
+		"embedshim_exitsnoop_program_run_count",
+		"The number of times the exitsnoop program has run",
+		nil, nil,
+	)
+	exitsnoopProgramRunSecondsDesc = prometheus.NewDesc(
+		"embedshim_exitsnoop_program_run_seconds",
+		"The total time the exitsnoop program has run in seconds",
+		nil, nil,
+	)
+	exitsnoopMapEntriesDesc = prometheus.NewDesc(
+		"embedshim_exitsnoop_map_entries",
+		"The number of entries in the exitsnoop map",
+		[]string{"map"}, nil,
+	)
+	exitsnoopMapMaxEntriesDesc = prometheus.NewDesc(
+		"embedshim_exitsnoop_map_max_entries",
+		"The capacity of the exitsnoop map",
+		[]string{"map"}, nil,
+	)
+	exitsnoopMapFillRatioDesc = prometheus.NewDesc(
+		"embedshim_exitsnoop_map_fill_ratio",
+		"The ratio of used entries in the exitsnoop map",
+		[]string{"map"}, nil,
+	)
+	exitsnoopLostExitEventsDesc = prometheus.NewDesc(
+		"embedshim_exitsnoop_lost_exit_events_total",
+		"The number of exited init processes without exit event recorded by exitsnoop",
+		nil, nil,
+	)
+	stdioDroppedBytesDesc = prometheus.NewDesc(
+		"embedshim_stdio_rate_limit_dropped_bytes_total",
+		"The number of stdout and stderr bytes dropped by the rate limit",
+		[]string{"namespace", "id"}, nil,
+	)
+	stdioThrottledSecondsDesc = prometheus.NewDesc(
+		"embedshim_stdio_rate_limit_throttled_seconds_total",
+		"The total time the stdout and stderr have been throttled by the rate limit in seconds",
+		[]string{"namespace", "id"}, nil,
+	)
+	operationInflightDesc = prometheus.NewDesc(
+		"embedshim_operation_inflight",
+		"The number of the task operations being processed",
+		[]string{"operation"}, nil,
+	)
+	operationQueueDepthDesc = prometheus.NewDesc(
+		"embedshim_operation_queue_depth",
+		"The number of the task operations waiting for the limiter",
+		[]string{"operation", "namespace"}, nil,
+	)
+	miscUsageDesc = prometheus.NewDesc(
+		"embedshim_misc_usage",
+		"The usage of the misc controller's resource, like sgx_epc",
+		[]string{"namespace", "id", "resource"}, nil,
+	)
+	miscLimitDesc = prometheus.NewDesc(
+		"embedshim_misc_limit",
+		"The limit of the misc controller's resource, and -1 means unlimited",
+		[]string{"namespace", "id", "resource"}, nil,
+	)
+	miscMaxEventsDesc = prometheus.NewDesc(
+		"embedshim_misc_max_events_total",
+		"The number of times the misc controller's resource usage was about to go over the limit",
+		[]string{"namespace", "id", "resource"}, nil,
+	)
+	networkBytesDesc = prometheus.NewDesc(
+		"embedshim_network_bytes_total",
+		"The number of bytes of the interface in the container's network namespace",
+		[]string{"namespace", "id", "interface", "direction"}, nil,
+	)
+	networkPacketsDesc = prometheus.NewDesc(
+		"embedshim_network_packets_total",
+		"The number of packets of the interface in the container's network namespace",
+		[]string{"namespace", "id", "interface", "direction"}, nil,
+	)
+	networkErrorsDesc = prometheus.NewDesc(
+		"embedshim_network_errors_total",
+		"The number of errors of the interface in the container's network namespace",
+		[]string{"namespace", "id", "interface", "direction"}, nil,
+	)
+	networkDroppedDesc = prometheus.NewDesc(
+		"embedshim_network_dropped_total",
+		"The number of dropped packets of the interface in the container's network namespace",
+		[]string{"namespace", "id", "interface", "direction"}, nil,
+	)
+	killAllFallbacksDesc = prometheus.NewDesc(
+		"embedshim_kill_all_fallback_total",
+		"The number of kill(all) calls which fall back to runc kill --all instead of pidfd",
+		[]string{"reason"}, nil,
+	)
+)
+
+// registerMetrics exports the exitsnoop statistics by containerd's metrics
+// endpoint.
+func (manager *TaskManager) registerMetrics() {
+	ns := metrics.NewNamespace("embedshim", "", nil)
+	ns.Add(&exitsnoopCollector{manager: manager})
+	ns.Add(&stdioRateLimitCollector{manager: manager})
+	ns.Add(&killAllCollector{manager: manager})
+	ns.Add(&operationLimiterCollector{manager: manager})
+	ns.Add(&miscCollector{manager: manager})
+	ns.Add(&networkCollector{manager: manager})
+	metrics.Register(ns)
+}
+
+// exitsnoopCollector collects the statistics when it is scraped.
+type exitsnoopCollector struct {
+	manager *TaskManager
+}
+
+// Describe implements prometheus.Collector.
+func (c *exitsnoopCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- exitsnoopProgramRunCountDesc
+	ch <- exitsnoopProgramRunSecondsDesc
+	ch <- exitsnoopMapEntriesDesc
+	ch <- exitsnoopMapMaxEntriesDesc
+	ch <- exitsnoopMapFillRatioDesc
+	ch <- exitsnoopLostExitEventsDesc
+}
+
+// Collect implements prometheus.Collector.
+func (c *exitsnoopCollector) Collect(ch chan<- prometheus.Metric) {
+	ctx := context.Background()
+
+	progStats, err := exitsnoop.LoadProgramStats(c.manager.rootDir)
+	if err != nil {
+		log.G(ctx).WithError(err).Warn("failed to collect exitsnoop program stats")
+	} else {
+		ch <- prometheus.MustNewConstMetric(exitsnoopProgramRunCountDesc,
+			prometheus.CounterValue, float64(progStats.RunCount))
+		ch <- prometheus.MustNewConstMetric(exitsnoopProgramRunSecondsDesc,
+			prometheus.CounterValue, progStats.RunTime.Seconds())
+	}
+
+	mapStats, err := c.manager.monitor.initStore.MapStats()
+	if err != nil {
+		log.G(ctx).WithError(err).Warn("failed to collect exitsnoop map stats")
+	} else {
+		for _, st := range mapStats {
+			ch <- prometheus.MustNewConstMetric(exitsnoopMapEntriesDesc,
+				prometheus.GaugeValue, float64(st.Entries), st.Name)
+			ch <- prometheus.MustNewConstMetric(exitsnoopMapMaxEntriesDesc,
+				prometheus.GaugeValue, float64(st.MaxEntries), st.Name)
+
+			ratio := 0.0
+			if st.MaxEntries > 0 {
+				ratio = float64(st.Entries) / float64(st.MaxEntries)
+			}
+			ch <- prometheus.MustNewConstMetric(exitsnoopMapFillRatioDesc,
+				prometheus.GaugeValue, ratio, st.Name)
+		}
+	}
+
+	ch <- prometheus.MustNewConstMetric(exitsnoopLostExitEventsDesc,
+		prometheus.CounterValue, float64(atomic.LoadUint64(&c.manager.monitor.lostExitEvents)))
+}
+
+// stdioRateLimitCollector collects the counters of the containers which have
+// stdio rate limit.
+type stdioRateLimitCollector struct {
+	manager *TaskManager
+}
+
+// Describe implements prometheus.Collector.
+func (c *stdioRateLimitCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- stdioDroppedBytesDesc
+	ch <- stdioThrottledSecondsDesc
+}
+
+// Collect implements prometheus.Collector.
+func (c *stdioRateLimitCollector) Collect(ch chan<- prometheus.Metric) {
+	ctx := context.Background()
+
+	tasks, err := c.manager.tasks.GetAll(ctx, true)
+	if err != nil {
+		log.G(ctx).WithError(err).Warn("failed to list tasks for stdio rate limit stats")
+		return
+	}
+
+	for _, t := range tasks {
+		s, ok := t.(*shim)
+		if !ok || s.init.ioLimiter == nil {
+			continue
+		}
+
+		ns, id := s.Namespace(), s.ID()
+		ch <- prometheus.MustNewConstMetric(stdioDroppedBytesDesc,
+			prometheus.CounterValue, float64(s.init.ioLimiter.dropped()), ns, id)
+		ch <- prometheus.MustNewConstMetric(stdioThrottledSecondsDesc,
+			prometheus.CounterValue, s.init.ioLimiter.throttled().Seconds(), ns, id)
+	}
+}
+
+// killAllCollector collects the fallback counters of kill(all).
+type killAllCollector struct {
+	manager *TaskManager
+}
+
+// Describe implements prometheus.Collector.
+func (c *killAllCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- killAllFallbacksDesc
+}
+
+// Collect implements prometheus.Collector.
+func (c *killAllCollector) Collect(ch chan<- prometheus.Metric) {
+	for reason, count := range c.manager.killFallbacks.snapshot() {
+		ch <- prometheus.MustNewConstMetric(killAllFallbacksDesc,
+			prometheus.CounterValue, float64(count), reason)
+	}
+}
+
+// operationLimiterCollector collects the in-flight operations and the queue
+// depth of the operation limiters.
+type operationLimiterCollector struct {
+	manager *TaskManager
+}
+
+// Describe implements prometheus.Collector.
+func (c *operationLimiterCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- operationInflightDesc
+	ch <- operationQueueDepthDesc
+}
+
+// Collect implements prometheus.Collector.
+func (c *operationLimiterCollector) Collect(ch chan<- prometheus.Metric) {
+	for _, l := range c.manager.opLimits.all() {
+		inflight, depths := l.stats()
+		ch <- prometheus.MustNewConstMetric(operationInflightDesc,
+			prometheus.GaugeValue, float64(inflight), l.operation)
+		for ns, depth := range depths {
+			ch <- prometheus.MustNewConstMetric(operationQueueDepthDesc,
+				prometheus.GaugeValue, float64(depth), l.operation, ns)
+		}
+	}
+}
+
+// miscCollector collects the misc controller's usage of the tasks, which is
+// unavailable in the cgroup v2 metrics.
+type miscCollector struct {
+	manager *TaskManager
+}
+
+// Describe implements prometheus.Collector.
+func (c *miscCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- miscUsageDesc
+	ch <- miscLimitDesc
+	ch <- miscMaxEventsDesc
+}
+
+// Collect implements prometheus.Collector.
+func (c *miscCollector) Collect(ch chan<- prometheus.Metric) {
+	if cgroups.Mode() != cgroups.Unified {
+		return
+	}
+
+	ctx := context.Background()
+
+	tasks, err := c.manager.tasks.GetAll(ctx, true)
+	if err != nil {
+		log.G(ctx).WithError(err).Warn("failed to list tasks for misc stats")
+		return
+	}
+
+	for _, t := range tasks {
+		s, ok := t.(*shim)
+		if !ok {
+			continue
+		}
+
+		// NOTE: The misc controller might be disabled for the task.
+		stats, err := s.miscStats()
+		if err != nil {
+			continue
+		}
+
+		ns, id := s.Namespace(), s.ID()
+		for name, st := range stats {
+			ch <- prometheus.MustNewConstMetric(miscUsageDesc,
+				prometheus.GaugeValue, float64(st.Current), ns, id, name)
+			ch <- prometheus.MustNewConstMetric(miscLimitDesc,
+				prometheus.GaugeValue, float64(st.Max), ns, id, name)
+			ch <- prometheus.MustNewConstMetric(miscMaxEventsDesc,
+				prometheus.CounterValue, float64(st.MaxEvents), ns, id, name)
+		}
+	}
+}
+
+// networkCollector collects the interfaces' counters in the tasks' network
+// namespaces. The loopback is excluded.
+type networkCollector struct {
+	manager *TaskManager
+}
+
+// Describe implements prometheus.Collector.
+func (c *networkCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- networkBytesDesc
+	ch <- networkPacketsDesc
+	ch <- networkErrorsDesc
+	ch <- networkDroppedDesc
+}
+
+// Collect implements prometheus.Collector.
+func (c *networkCollector) Collect(ch chan<- prometheus.Metric) {
+	ctx := context.Background()
+
+	tasks, err := c.manager.tasks.GetAll(ctx, true)
+	if err != nil {
+		log.G(ctx).WithError(err).Warn("failed to list tasks for network stats")
+		return
+	}
+
+	for _, t := range tasks {
+		s, ok := t.(*shim)
+		if !ok {
+			continue
+		}
+
+		// NOTE: The stopped task has no network namespace.
+		ns, id := s.Namespace(), s.ID()
+		ifaces, err := c.manager.NetworkStats(namespaces.WithNamespace(ctx, ns), id)
+		if err != nil {
+			continue
+		}
+
+		for _, iface := range ifaces {
+			if iface.Name == "lo" {
+				continue
+			}
+
+			for _, m := range []struct {
+				desc   *prometheus.Desc
+				rx, tx uint64
+			}{
+				{networkBytesDesc, iface.RxBytes, iface.TxBytes},
+				{networkPacketsDesc, iface.RxPackets, iface.TxPackets},
+				{networkErrorsDesc, iface.RxErrors, iface.TxErrors},
+				{networkDroppedDesc, iface.RxDropped, iface.TxDropped},
+			} {
+				ch <- prometheus.MustNewConstMetric(m.desc,
+					prometheus.CounterValue, float64(m.rx), ns, id, iface.Name, "receive")
+				ch <- prometheus.MustNewConstMetric(m.desc,
+					prometheus.CounterValue, float64(m.tx), ns, id, iface.Name, "transmit")
+			}
+		}
+	}
+}
@@ -0,0 +1,257 @@
+//go:build linux
+// +build linux
+
+package embedshim
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/containerd/cgroups"
+	"github.com/containerd/containerd/errdefs"
+	ptypes "github.com/gogo/protobuf/types"
+)
+
+// miscMaxFile is the unified key of the misc controller's limits in the
+// Update's resources, like {"unified": {"misc.max": "sgx_epc 1048576"}}.
+// The value has one "<resource> <limit|max>" per line.
+const miscMaxFile = "misc.max"
+
+// MiscResourceStats is the usage of one misc controller's resource, like
+// sgx_epc, sev and sev_es.
+type MiscResourceStats struct {
+	// Current is the usage of the task's cgroup.
+	Current uint64 `json:"current"`
+	// Max is the limit of the task's cgroup, and -1 means unlimited.
+	Max int64 `json:"max"`
+	// MaxEvents is the number of times the usage was about to go over the
+	// limit.
+	MaxEvents uint64 `json:"max_events"`
+	// Capacity is the host's capacity of the resource.
+	Capacity uint64 `json:"capacity"`
+}
+
+// MiscStats returns the misc controller's usage by resource name. It
+// requires cgroup v2 with the misc controller enabled for the task's cgroup.
+func (manager *TaskManager) MiscStats(ctx context.Context, id string) (map[string]MiscResourceStats, error) {
+	t, err := manager.tasks.Get(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+
+	s, ok := t.(*shim)
+	if !ok {
+		return nil, errdefs.ErrNotImplemented
+	}
+	return s.miscStats()
+}
+
+func (s *shim) miscStats() (map[string]MiscResourceStats, error) {
+	dir, err := s.miscCgroupDir()
+	if err != nil {
+		return nil, err
+	}
+	return readMiscStats(cgroupv2Root, dir)
+}
+
+func (s *shim) miscCgroupDir() (string, error) {
+	if cgroups.Mode() != cgroups.Unified {
+		return "", fmt.Errorf("misc controller requires cgroup v2: %w", errdefs.ErrNotImplemented)
+	}
+
+	cgroupPath := s.loadedIdentity().CgroupPath
+	if cgroupPath == "" {
+		return "", fmt.Errorf("cgroup of task %s is unavailable: %w", s.ID(), errdefs.ErrNotFound)
+	}
+	return filepath.Join(cgroupv2Root, cgroupPath), nil
+}
+
+// readMiscStats reads the misc controller's files in dir. The capacity is
+// only available in the root cgroup.
+func readMiscStats(root, dir string) (map[string]MiscResourceStats, error) {
+	current, err := readFlatKeyedFile(filepath.Join(dir, "misc.current"))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, fmt.Errorf("misc controller isn't enabled for %s: %w", dir, errdefs.ErrNotFound)
+		}
+		return nil, err
+	}
+
+	stats := make(map[string]MiscResourceStats, len(current))
+	for name, v := range current {
+		stats[name] = MiscResourceStats{Current: parseCgroupUint(v), Max: -1}
+	}
+
+	if max, err := readFlatKeyedFile(filepath.Join(dir, miscMaxFile)); err == nil {
+		for name, v := range max {
+			st := stats[name]
+			if v != "max" {
+				st.Max = int64(parseCgroupUint(v))
+			}
+			stats[name] = st
+		}
+	}
+
+	// NOTE: The events are keyed by "<resource>.max".
+	if events, err := readFlatKeyedFile(filepath.Join(dir, "misc.events")); err == nil {
+		for key, v := range events {
+			name := strings.TrimSuffix(key, ".max")
+			if st, ok := stats[name]; ok && name != key {
+				st.MaxEvents = parseCgroupUint(v)
+				stats[name] = st
+			}
+		}
+	}
+
+	if capacity, err := readFlatKeyedFile(filepath.Join(root, "misc.capacity")); err == nil {
+		for name, v := range capacity {
+			if st, ok := stats[name]; ok {
+				st.Capacity = parseCgroupUint(v)
+				stats[name] = st
+			}
+		}
+	}
+	return stats, nil
+}
+
+// readFlatKeyedFile reads the cgroup v2 file with one "<key> <value>" per
+// line.
+func readFlatKeyedFile(pathname string) (map[string]string, error) {
+	data, err := os.ReadFile(pathname)
+	if err != nil {
+		return nil, err
+	}
+
+	values := make(map[string]string)
+	for _, line := range strings.Split(string(data), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) != 2 {
+			continue
+		}
+		values[fields[0]] = fields[1]
+	}
+	return values, nil
+}
+
+func parseCgroupUint(v string) uint64 {
+	n, _ := strconv.ParseUint(v, 10, 64)
+	return n
+}
+
+// splitMiscLimits removes misc.max from the resources' unified, because the
+// OCI runtime's update might not write it. The returned limits are applied
+// by updateMiscLimits. The resources are returned as it is if there is no
+// misc limit.
+func splitMiscLimits(r *ptypes.Any) (*ptypes.Any, map[string]string, error) {
+	var limits map[string]string
+	r, err := patchRawJSON(r, "resources", func(root map[string]json.RawMessage) (bool, error) {
+		var unified map[string]string
+		if ok, err := unmarshalRawField(root, "unified", "unified resources", &unified); err != nil || !ok {
+			return false, err
+		}
+
+		value, ok := unified[miscMaxFile]
+		if !ok {
+			return false, nil
+		}
+
+		var err error
+		if limits, err = parseMiscLimits(value); err != nil {
+			return false, err
+		}
+
+		delete(unified, miscMaxFile)
+		if len(unified) == 0 {
+			delete(root, "unified")
+		} else if root["unified"], err = json.Marshal(unified); err != nil {
+			return false, err
+		}
+		return true, nil
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+	return r, limits, nil
+}
+
+// parseMiscLimits parses the lines of "<resource> <limit|max>".
+func parseMiscLimits(value string) (map[string]string, error) {
+	limits := make(map[string]string)
+	for _, line := range strings.Split(value, "\n") {
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("invalid %s line %q, expected <resource> <limit|max>: %w",
+				miscMaxFile, line, errdefs.ErrInvalidArgument)
+		}
+		if fields[1] != "max" {
+			if _, err := strconv.ParseUint(fields[1], 10, 64); err != nil {
+				return nil, fmt.Errorf("invalid %s limit %q of %s: %w",
+					miscMaxFile, fields[1], fields[0], errdefs.ErrInvalidArgument)
+			}
+		}
+		limits[fields[0]] = fields[1]
+	}
+
+	if len(limits) == 0 {
+		return nil, fmt.Errorf("empty %s: %w", miscMaxFile, errdefs.ErrInvalidArgument)
+	}
+	return limits, nil
+}
+
+// validateMiscLimits checks the resources against the host's capacity
+// before any controller is updated.
+func (s *shim) validateMiscLimits(limits map[string]string) error {
+	if len(limits) == 0 {
+		return nil
+	}
+
+	if _, err := s.miscCgroupDir(); err != nil {
+		return err
+	}
+
+	capacity, err := readFlatKeyedFile(filepath.Join(cgroupv2Root, "misc.capacity"))
+	if err != nil {
+		return fmt.Errorf("failed to read misc capacity: %w", err)
+	}
+	for name := range limits {
+		if _, ok := capacity[name]; !ok {
+			return fmt.Errorf("misc resource %s is unsupported by host: %w", name, errdefs.ErrInvalidArgument)
+		}
+	}
+	return nil
+}
+
+// updateMiscLimits writes the limits into the task's misc.max.
+func (s *shim) updateMiscLimits(limits map[string]string) error {
+	if len(limits) == 0 {
+		return nil
+	}
+
+	dir, err := s.miscCgroupDir()
+	if err != nil {
+		return err
+	}
+
+	names := make([]string, 0, len(limits))
+	for name := range limits {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		if err := writeCgroupFile(dir, miscMaxFile, name+" "+limits[name]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
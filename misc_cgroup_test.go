@@ -0,0 +1,93 @@
+//go:build linux
+// +build linux
+
+package embedshim
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	ptypes "github.com/gogo/protobuf/types"
+)
+
+func TestReadMiscStats(t *testing.T) {
+	root, dir := t.TempDir(), t.TempDir()
+
+	for pathname, data := range map[string]string{
+		filepath.Join(root, "misc.capacity"): "sgx_epc 8388608\nsev 509\n",
+		filepath.Join(dir, "misc.current"):   "sgx_epc 4096\nsev 0\n",
+		filepath.Join(dir, miscMaxFile):      "sgx_epc 1048576\nsev max\n",
+		filepath.Join(dir, "misc.events"):    "sgx_epc.max 3\nsev.max 0\n",
+	} {
+		if err := os.WriteFile(pathname, []byte(data), 0600); err != nil {
+			t.Fatalf("failed to write %s: %v", pathname, err)
+		}
+	}
+
+	stats, err := readMiscStats(root, dir)
+	if err != nil {
+		t.Fatalf("failed to read misc stats: %v", err)
+	}
+
+	expected := map[string]MiscResourceStats{
+		"sgx_epc": {Current: 4096, Max: 1048576, MaxEvents: 3, Capacity: 8388608},
+		"sev":     {Current: 0, Max: -1, MaxEvents: 0, Capacity: 509},
+	}
+	if !reflect.DeepEqual(stats, expected) {
+		t.Fatalf("expected %v, but got %v", expected, stats)
+	}
+
+	if _, err := readMiscStats(root, t.TempDir()); err == nil {
+		t.Fatalf("expected error without misc controller, but got nil")
+	}
+}
+
+func TestSplitMiscLimits(t *testing.T) {
+	r := &ptypes.Any{Value: []byte(`{"pids":{"limit":10},"unified":{"misc.max":"sgx_epc 1024\nsev max","memory.high":"max"}}`)}
+
+	rest, limits, err := splitMiscLimits(r)
+	if err != nil {
+		t.Fatalf("failed to split misc limits: %v", err)
+	}
+
+	expected := map[string]string{"sgx_epc": "1024", "sev": "max"}
+	if !reflect.DeepEqual(limits, expected) {
+		t.Fatalf("expected %v, but got %v", expected, limits)
+	}
+
+	var got map[string]interface{}
+	if err := json.Unmarshal(rest.Value, &got); err != nil {
+		t.Fatalf("failed to unmarshal resources: %v", err)
+	}
+	if unified := got["unified"].(map[string]interface{}); len(unified) != 1 || unified["memory.high"] != "max" {
+		t.Fatalf("expected memory.high only, but got %v", unified)
+	}
+	if got["pids"] == nil {
+		t.Fatalf("expected pids kept, but got %v", got)
+	}
+
+	// the unified is removed if misc.max is the only one
+	rest, _, err = splitMiscLimits(&ptypes.Any{Value: []byte(`{"unified":{"misc.max":"sev 1"}}`)})
+	if err != nil {
+		t.Fatalf("failed to split misc limits: %v", err)
+	}
+	if string(rest.Value) != `{}` {
+		t.Fatalf("expected empty resources, but got %s", rest.Value)
+	}
+
+	// the resources without misc.max are returned as it is
+	r = &ptypes.Any{Value: []byte(`{"pids":{"limit":10}}`)}
+	if rest, limits, err = splitMiscLimits(r); err != nil || rest != r || limits != nil {
+		t.Fatalf("expected resources unchanged, but got %v, %v (err: %v)", rest, limits, err)
+	}
+
+	for _, invalid := range []string{``, `sev`, `sev -1`, `sev 1 2`} {
+		value, _ := json.Marshal(map[string]map[string]string{"unified": {miscMaxFile: invalid}})
+		if _, _, err := splitMiscLimits(&ptypes.Any{Value: value}); err == nil {
+			t.Fatalf("expected error for %q, but got nil", invalid)
+		}
+	}
+}
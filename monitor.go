@@ -1,3 +1,6 @@
+//go:build linux
+// +build linux
+
 package embedshim
 
 import (
@@ -6,6 +9,7 @@ import (
 	"path/filepath"
 	"strconv"
 	"sync"
+	"sync/atomic"
 	"syscall"
 
 	"github.com/fuweid/embedshim/pkg/exitsnoop"
@@ -27,6 +31,14 @@ type monitor struct {
 	pidPoller *pidfd.Epoller
 	initStore *exitsnoop.Store
 	execStore *exitsnoop.Store
+
+	// initPidFDs maps the init process's trace event ID to the pidfd
+	// registered in pidPoller.
+	initPidFDs map[uint64]pidfd.FD
+
+	// lostExitEvents counts the exited init processes without exit event
+	// recorded by exitsnoop, like the exited_events map is full.
+	lostExitEvents uint64
 }
 
 func newMonitor(stateDir string) (_ *monitor, retErr error) {
@@ -56,9 +68,10 @@ func newMonitor(stateDir string) (_ *monitor, retErr error) {
 	}
 
 	m := &monitor{
-		pidPoller: epoller,
-		initStore: initStore,
-		execStore: execStore,
+		pidPoller:  epoller,
+		initStore:  initStore,
+		execStore:  execStore,
+		initPidFDs: make(map[uint64]pidfd.FD),
 	}
 
 	// TODO: check the return
@@ -68,7 +81,20 @@ func newMonitor(stateDir string) (_ *monitor, retErr error) {
 
 // traceInitProcess checks init process is alive and starts to trace it's exit
 // event by exitsnoop bpf tracepoint.
-func (m *monitor) traceInitProcess(init *initProcess) (retErr error) {
+func (m *monitor) traceInitProcess(init *initProcess) error {
+	return m.trace(init, true)
+}
+
+// traceRestoredInitProcess starts to trace the init process restored from
+// checkpoint.
+//
+// NOTE: The restored init process has been running and there is no runc-init
+// holding exec.fifo, so that the identity check is skipped.
+func (m *monitor) traceRestoredInitProcess(init *initProcess) error {
+	return m.trace(init, false)
+}
+
+func (m *monitor) trace(init *initProcess, checkRuncInit bool) (retErr error) {
 	m.Lock()
 	defer m.Unlock()
 
@@ -91,8 +117,10 @@ func (m *monitor) traceInitProcess(init *initProcess) (retErr error) {
 	// The runc-state command only checks /proc/$pid/status's starttime,
 	// which is not reliable. And then it only checks exec.fifo exist in
 	// disk, but the runc-init has been killed. So we can't just use it.
-	if err := checkRuncInitAlive(init); err != nil {
-		return err
+	if checkRuncInit {
+		if err := checkRuncInitAlive(init); err != nil {
+			return err
+		}
 	}
 
 	nsInfo, err := getPidnsInfo(uint32(init.Pid()))
@@ -120,9 +148,12 @@ func (m *monitor) traceInitProcess(init *initProcess) (retErr error) {
 	}
 
 	if err := m.pidPoller.Add(fd, func() error {
+		m.forgetPidFD(init.traceEventID)
+
 		// TODO(fuweid): do we need to check the pid value in event?
 		status, err := m.initStore.GetExitedEvent(init.traceEventID)
 		if err != nil {
+			atomic.AddUint64(&m.lostExitEvents, 1)
 			init.SetExited(unexpectedExitCode)
 			return fmt.Errorf("failed to get exited status: %w", err)
 		}
@@ -132,9 +163,39 @@ func (m *monitor) traceInitProcess(init *initProcess) (retErr error) {
 	}); err != nil {
 		return err
 	}
+	m.initPidFDs[init.traceEventID] = fd
 	return nil
 }
 
+// untrace stops tracing the init process and releases the pidfd. The init
+// process will not be notified when it exits.
+func (m *monitor) untrace(init *initProcess) error {
+	m.Lock()
+	defer m.Unlock()
+
+	if fd, ok := m.initPidFDs[init.traceEventID]; ok {
+		if err := m.pidPoller.Remove(fd); err != nil {
+			return err
+		}
+		delete(m.initPidFDs, init.traceEventID)
+	}
+
+	if err := m.initStore.DeleteTracingTask(uint32(init.Pid())); err != nil && !errors.Is(err, ebpf.ErrKeyNotExist) {
+		return fmt.Errorf("failed to delete taskinfo for %s: %w", init, err)
+	}
+	if err := m.initStore.DeleteExitedEvent(init.traceEventID); err != nil && !errors.Is(err, ebpf.ErrKeyNotExist) {
+		return fmt.Errorf("failed to delete exited event for %s: %w", init, err)
+	}
+	return nil
+}
+
+func (m *monitor) forgetPidFD(traceEventID uint64) {
+	m.Lock()
+	defer m.Unlock()
+
+	delete(m.initPidFDs, traceEventID)
+}
+
 // repollingInitProcess is used to watch pidfd event after containerd restarts.
 func (m *monitor) repollingInitProcess(init *initProcess) (retErr error) {
 	var (
@@ -181,21 +242,34 @@ func (m *monitor) repollingInitProcess(init *initProcess) (retErr error) {
 	}
 
 	// Just in case, the pid has been reused by other init process
+	//
+	// NOTE: The state has been resolved by resolveReloadedState, which
+	// keeps the created state only if runc-init is still waiting for
+	// start.
 	if taskInfo != nil && taskInfo.TraceID == eventID {
-		// TODO(fuweid): Ugly! Need interface here.
-		init.initState.(*createdState).transition("running")
+		// NOTE: Hold the lock so that the callback can't forget the
+		// pidfd before it is recorded.
+		m.Lock()
+		defer m.Unlock()
+
+		if err := m.pidPoller.Add(fd, func() error {
+			m.forgetPidFD(init.traceEventID)
 
-		return m.pidPoller.Add(fd, func() error {
 			// TODO(fuweid): do we need to check the pid value in event?
 			exitedStatus, err = m.initStore.GetExitedEvent(init.traceEventID)
 			if err != nil {
+				atomic.AddUint64(&m.lostExitEvents, 1)
 				init.SetExited(unexpectedExitCode)
 				return fmt.Errorf("failed to get exited status: %w", err)
 			}
 
 			init.SetExited(int(exitedStatus.ExitCode))
 			return nil
-		})
+		}); err != nil {
+			return err
+		}
+		m.initPidFDs[init.traceEventID] = fd
+		return nil
 	}
 
 	unix.Close(int(fd))
@@ -0,0 +1,70 @@
+//go:build !linux
+// +build !linux
+
+package embedshim
+
+import (
+	"fmt"
+
+	"github.com/fuweid/embedshim/pkg/exitsnoop"
+
+	"golang.org/x/sys/unix"
+)
+
+var (
+	// unexpectedExitCode is used when failed to get correct exit code.
+	unexpectedExitCode = 128
+)
+
+// monitor is the process-wait monitor on the platform without the exitsnoop
+// eBPF program and pidfd. The task's process is the plugin's child, so that
+// its wait status is reaped by wait4(2) and recorded into exitsnoop's
+// in-memory store, like the eBPF program does on linux.
+type monitor struct {
+	store *exitsnoop.Store
+}
+
+func newMonitor(stateDir string) (*monitor, error) {
+	store, err := exitsnoop.NewStore(stateDir)
+	if err != nil {
+		return nil, err
+	}
+	return &monitor{store: store}, nil
+}
+
+// traceProcess reaps the child process in background and calls onExit with
+// its exit status. The unexpectedExitCode is used if the process can't be
+// reaped, like it isn't the plugin's child.
+func (m *monitor) traceProcess(pid int, traceEventID uint64, onExit func(status int)) error {
+	if err := m.store.Trace(uint32(pid), &exitsnoop.TaskInfo{TraceID: traceEventID}); err != nil {
+		return fmt.Errorf("failed to trace process %d: %w", pid, err)
+	}
+
+	go func() {
+		var (
+			ws  unix.WaitStatus
+			err error
+		)
+		for {
+			if _, err = unix.Wait4(pid, &ws, 0, nil); err != unix.EINTR {
+				break
+			}
+		}
+		m.store.DeleteTracingTask(uint32(pid))
+		if err == nil {
+			m.store.ExitedEventFromWaitStatus(traceEventID, uint32(pid), uint32(ws))
+		}
+
+		status := unexpectedExitCode
+		if ev, err := m.store.GetExitedEvent(traceEventID); err == nil {
+			status = exitStatus(int(ev.ExitCode))
+			m.store.DeleteExitedEvent(traceEventID)
+		}
+		onExit(status)
+	}()
+	return nil
+}
+
+func (m *monitor) close() error {
+	return m.store.Close()
+}
@@ -0,0 +1,166 @@
+//go:build linux
+// +build linux
+
+package embedshim
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"github.com/containerd/containerd/errdefs"
+	ptypes "github.com/gogo/protobuf/types"
+	"github.com/opencontainers/runtime-spec/specs-go"
+)
+
+// mountPropagations are the propagation values accepted by runc, both in
+// linux.rootfsPropagation and in the mount's options.
+var mountPropagations = map[string]struct{}{
+	"private":     {},
+	"rprivate":    {},
+	"slave":       {},
+	"rslave":      {},
+	"shared":      {},
+	"rshared":     {},
+	"unbindable":  {},
+	"runbindable": {},
+}
+
+// MountPropagationConfig controls the propagation of the task's rootfs and
+// bind mounts.
+//
+// The shared propagation leaks the mounts created in the container into the
+// host, and the other way around, like the NFS automounts triggered in the
+// container being left in the host's mount table.
+type MountPropagationConfig struct {
+	// Default is applied to the rootfs and bind mounts without explicit
+	// propagation, like "rslave". It is overridden by the task's
+	// annotation. The OCI runtime's default is used if it is empty.
+	Default string `toml:"default"`
+
+	// DenyShared rejects the task whose rootfs or bind mount has the
+	// shared or rshared propagation.
+	DenyShared bool `toml:"deny_shared"`
+}
+
+func isSharedPropagation(p string) bool {
+	return p == "shared" || p == "rshared"
+}
+
+// mountOptionsPropagation returns the propagation in the mount's options.
+// It is an error if there are more than one.
+func mountOptionsPropagation(options []string) (string, error) {
+	var found string
+	for _, o := range options {
+		if _, ok := mountPropagations[o]; !ok {
+			continue
+		}
+		if found != "" && found != o {
+			return "", fmt.Errorf("conflicting propagation %s and %s", found, o)
+		}
+		found = o
+	}
+	return found, nil
+}
+
+// applyMountPropagation fills the default propagation into the spec's
+// linux.rootfsPropagation and the bind mounts' options, and audits the
+// resulting propagation. The spec is returned as it is if nothing is
+// changed.
+func applyMountPropagation(spec *ptypes.Any, cfg MountPropagationConfig) (*ptypes.Any, error) {
+	if spec == nil {
+		return spec, nil
+	}
+
+	return patchRawJSON(spec, "spec", func(root map[string]json.RawMessage) (bool, error) {
+		var annotations map[string]string
+		if _, err := unmarshalRawField(root, "annotations", "spec annotations", &annotations); err != nil {
+			return false, err
+		}
+
+		def := cfg.Default
+		if v, ok := annotations[annotationMountPropagation]; ok {
+			if _, known := mountPropagations[v]; !known {
+				return false, fmt.Errorf("invalid annotation %s=%q: %w", annotationMountPropagation, v, errdefs.ErrInvalidArgument)
+			}
+			def = v
+		}
+		if def == "" && !cfg.DenyShared {
+			return false, nil
+		}
+
+		var changed bool
+
+		var linux map[string]json.RawMessage
+		if _, err := unmarshalRawField(root, "linux", "spec linux", &linux); err != nil {
+			return false, err
+		}
+
+		var rootfsPropagation string
+		if _, err := unmarshalRawField(linux, "rootfsPropagation", "linux.rootfsPropagation", &rootfsPropagation); err != nil {
+			return false, err
+		}
+		if rootfsPropagation == "" && def != "" && linux != nil {
+			rootfsPropagation = def
+			linux["rootfsPropagation"], _ = json.Marshal(def)
+			changed = true
+		}
+		if _, ok := mountPropagations[rootfsPropagation]; rootfsPropagation != "" && !ok {
+			return false, fmt.Errorf("invalid linux.rootfsPropagation %q: %w", rootfsPropagation, errdefs.ErrInvalidArgument)
+		}
+		if cfg.DenyShared && isSharedPropagation(rootfsPropagation) {
+			return false, fmt.Errorf("%s propagation of rootfs is denied: %w", rootfsPropagation, errdefs.ErrInvalidArgument)
+		}
+
+		var mounts []map[string]json.RawMessage
+		if _, err := unmarshalRawField(root, "mounts", "spec mounts", &mounts); err != nil {
+			return false, err
+		}
+
+		for i, m := range mounts {
+			var (
+				typ         string
+				destination string
+				options     []string
+			)
+			json.Unmarshal(m["type"], &typ)
+			json.Unmarshal(m["destination"], &destination)
+			if _, err := unmarshalRawField(m, "options", fmt.Sprintf("options of mounts[%d]", i), &options); err != nil {
+				return false, err
+			}
+
+			if !isBindMount(specs.Mount{Type: typ, Options: options}) {
+				continue
+			}
+
+			propagation, err := mountOptionsPropagation(options)
+			if err != nil {
+				return false, fmt.Errorf("invalid bind mount %s: %v: %w", destination, err, errdefs.ErrInvalidArgument)
+			}
+			if propagation == "" && def != "" {
+				propagation = def
+				m["options"], _ = json.Marshal(append(options, def))
+				changed = true
+			}
+			if cfg.DenyShared && isSharedPropagation(propagation) {
+				return false, fmt.Errorf("%s propagation of bind mount %s is denied: %w", propagation, destination, errdefs.ErrInvalidArgument)
+			}
+		}
+
+		if !changed {
+			return false, nil
+		}
+
+		var err error
+		if linux != nil {
+			if root["linux"], err = json.Marshal(linux); err != nil {
+				return false, err
+			}
+		}
+		if mounts != nil {
+			if root["mounts"], err = json.Marshal(mounts); err != nil {
+				return false, err
+			}
+		}
+		return true, nil
+	})
+}
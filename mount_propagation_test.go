@@ -0,0 +1,81 @@
+//go:build linux
+// +build linux
+
+package embedshim
+
+import (
+	"encoding/json"
+	"errors"
+	"reflect"
+	"testing"
+
+	"github.com/containerd/containerd/errdefs"
+	ptypes "github.com/gogo/protobuf/types"
+	"github.com/opencontainers/runtime-spec/specs-go"
+)
+
+func TestApplyMountPropagation(t *testing.T) {
+	raw := []byte(`{
+		"mounts": [
+			{"destination": "/proc", "type": "proc", "source": "proc"},
+			{"destination": "/data", "type": "bind", "source": "/data", "options": ["rbind", "ro"]},
+			{"destination": "/cache", "type": "bind", "source": "/cache", "options": ["rbind", "rprivate"]}
+		],
+		"linux": {"x-unknown": true}
+	}`)
+
+	spec := &ptypes.Any{Value: raw}
+	got, err := applyMountPropagation(spec, MountPropagationConfig{})
+	if err != nil || got != spec {
+		t.Fatalf("expected spec unchanged without default, but got %v (err: %v)", got, err)
+	}
+
+	got, err = applyMountPropagation(spec, MountPropagationConfig{Default: "rslave"})
+	if err != nil {
+		t.Fatalf("failed to apply mount propagation: %v", err)
+	}
+
+	var s specs.Spec
+	if err := json.Unmarshal(got.Value, &s); err != nil {
+		t.Fatal(err)
+	}
+	if s.Linux.RootfsPropagation != "rslave" {
+		t.Fatalf("expected rootfs rslave, but got %q", s.Linux.RootfsPropagation)
+	}
+	for i, expected := range [][]string{nil, {"rbind", "ro", "rslave"}, {"rbind", "rprivate"}} {
+		if !reflect.DeepEqual(s.Mounts[i].Options, expected) {
+			t.Fatalf("expected mounts[%d] options %v, but got %v", i, expected, s.Mounts[i].Options)
+		}
+	}
+
+	var root, linux map[string]json.RawMessage
+	if err := json.Unmarshal(got.Value, &root); err != nil {
+		t.Fatal(err)
+	}
+	if err := json.Unmarshal(root["linux"], &linux); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := linux["x-unknown"]; !ok {
+		t.Fatalf("expected unknown linux field kept, but got %s", got.Value)
+	}
+}
+
+func TestApplyMountPropagationDenyShared(t *testing.T) {
+	for _, raw := range []string{
+		`{"linux": {"rootfsPropagation": "rshared"}}`,
+		`{"mounts": [{"destination": "/data", "type": "bind", "source": "/data", "options": ["rbind", "rshared"]}]}`,
+		`{"annotations": {"` + annotationMountPropagation + `": "shared"}, "linux": {}}`,
+		`{"annotations": {"` + annotationMountPropagation + `": "invalid"}}`,
+		`{"mounts": [{"destination": "/data", "type": "bind", "source": "/data", "options": ["rprivate", "rslave"]}]}`,
+	} {
+		_, err := applyMountPropagation(&ptypes.Any{Value: []byte(raw)}, MountPropagationConfig{DenyShared: true})
+		if !errors.Is(err, errdefs.ErrInvalidArgument) {
+			t.Fatalf("expected ErrInvalidArgument for %s, but got %v", raw, err)
+		}
+	}
+
+	raw := `{"linux": {"rootfsPropagation": "rshared"}}`
+	if _, err := applyMountPropagation(&ptypes.Any{Value: []byte(raw)}, MountPropagationConfig{Default: "rslave"}); err != nil {
+		t.Fatalf("expected explicit rshared allowed, but got %v", err)
+	}
+}
@@ -0,0 +1,90 @@
+//go:build linux
+// +build linux
+
+package embedshim
+
+import (
+	"errors"
+	"testing"
+
+	pkgbundle "github.com/fuweid/embedshim/pkg/bundle"
+
+	"github.com/containerd/containerd/errdefs"
+	"github.com/containerd/containerd/runtime"
+)
+
+func TestTaskListNamespaceIsolation(t *testing.T) {
+	h1 := newTestHarnessInNamespace(t, "ns1", "c1")
+	h2 := newTestHarnessInNamespace(t, "ns2", "c1")
+
+	manager := h1.manager
+	h2.shim.manager = manager
+
+	if err := manager.Add(h1.ctx, h1.shim); err != nil {
+		t.Fatalf("failed to add task in ns1: %v", err)
+	}
+	if err := manager.Add(h2.ctx, h2.shim); err != nil {
+		t.Fatalf("failed to add task with same ID in ns2: %v", err)
+	}
+
+	for _, h := range []*testHarness{h1, h2} {
+		got, err := manager.Get(h.ctx, "c1")
+		if err != nil {
+			t.Fatalf("failed to get task: %v", err)
+		}
+		if got != h.shim {
+			t.Fatalf("expected task in %s, but got task in %s", h.shim.Namespace(), got.Namespace())
+		}
+	}
+
+	manager.Delete(h1.ctx, "c1")
+	if _, err := manager.Get(h1.ctx, "c1"); !errors.Is(err, runtime.ErrTaskNotExists) {
+		t.Fatalf("expected ErrTaskNotExists in ns1, but got %v", err)
+	}
+	if got, err := manager.Get(h2.ctx, "c1"); err != nil || got != h2.shim {
+		t.Fatalf("expected task in ns2 kept, but got %v (err: %v)", got, err)
+	}
+}
+
+func TestReserveTraceEventIDAcrossNamespaces(t *testing.T) {
+	rootDir, stateDir := t.TempDir(), t.TempDir()
+
+	idAlloc, err := newIDAllocator(rootDir, traceEventIDDBName)
+	if err != nil {
+		t.Fatalf("failed to create id allocator: %v", err)
+	}
+	defer idAlloc.close()
+
+	manager := &TaskManager{rootDir: rootDir, stateDir: stateDir, idAlloc: idAlloc}
+
+	newBundle := func(ns string, traceID uint64) *pkgbundle.Bundle {
+		b, err := pkgbundle.NewBundle(rootDir, stateDir, ns, "c1",
+			withBundleApplyInitTraceEventID(traceID))
+		if err != nil {
+			t.Fatalf("failed to create bundle in %s: %v", ns, err)
+		}
+		return b
+	}
+
+	traceIDs := make(map[uint64]TaskRef)
+	if err := manager.reserveTraceEventID(traceIDs, TaskRef{Namespace: "ns1", ID: "c1"}, newBundle("ns1", 7)); err != nil {
+		t.Fatalf("failed to reserve trace event ID in ns1: %v", err)
+	}
+
+	err = manager.reserveTraceEventID(traceIDs, TaskRef{Namespace: "ns2", ID: "c1"}, newBundle("ns2", 7))
+	if !errors.Is(err, errdefs.ErrAlreadyExists) {
+		t.Fatalf("expected ErrAlreadyExists for duplicate trace event ID, but got %v", err)
+	}
+
+	if err := manager.reserveTraceEventID(traceIDs, TaskRef{Namespace: "ns3", ID: "c1"}, newBundle("ns3", 3)); err != nil {
+		t.Fatalf("failed to reserve trace event ID in ns3: %v", err)
+	}
+
+	id, err := manager.nextTraceEventID()
+	if err != nil {
+		t.Fatalf("failed to allocate trace event ID: %v", err)
+	}
+	if id != 8 {
+		t.Fatalf("expected next trace event ID 8, but got %v", id)
+	}
+}
@@ -0,0 +1,103 @@
+//go:build linux
+// +build linux
+
+package embedshim
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+
+	"golang.org/x/sys/unix"
+)
+
+// InterfaceStats is the counters of one network interface in the
+// container's network namespace, with the same JSON layout to cadvisor's
+// InterfaceStats.
+type InterfaceStats struct {
+	Name      string `json:"name"`
+	RxBytes   uint64 `json:"rx_bytes"`
+	RxPackets uint64 `json:"rx_packets"`
+	RxErrors  uint64 `json:"rx_errors"`
+	RxDropped uint64 `json:"rx_dropped"`
+	TxBytes   uint64 `json:"tx_bytes"`
+	TxPackets uint64 `json:"tx_packets"`
+	TxErrors  uint64 `json:"tx_errors"`
+	TxDropped uint64 `json:"tx_dropped"`
+}
+
+// NetworkStats returns the interfaces' counters in the task's network
+// namespace, which doesn't depend on the CNI or the net_cls controller. The
+// loopback is included.
+//
+// NOTE: The tasks sharing one network namespace, like the containers in
+// one pod, report the same counters.
+func (manager *TaskManager) NetworkStats(ctx context.Context, id string) ([]InterfaceStats, error) {
+	fd, err := manager.openInitProcEntry(ctx, id, "net/dev", unix.O_RDONLY)
+	if err != nil {
+		return nil, err
+	}
+
+	f := os.NewFile(uintptr(fd), "net/dev")
+	defer f.Close()
+
+	stats, err := parseNetDev(f)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse net/dev of task %s: %w", id, err)
+	}
+	return stats, nil
+}
+
+// parseNetDev parses the /proc/net/dev. The first two lines are headers.
+func parseNetDev(r io.Reader) ([]InterfaceStats, error) {
+	var stats []InterfaceStats
+
+	scanner := bufio.NewScanner(r)
+	for n := 1; scanner.Scan(); n++ {
+		if n <= 2 {
+			continue
+		}
+
+		idx := strings.LastIndex(scanner.Text(), ":")
+		if idx < 0 {
+			return nil, fmt.Errorf("invalid line %d: %q", n, scanner.Text())
+		}
+
+		fields := strings.Fields(scanner.Text()[idx+1:])
+		if len(fields) < 16 {
+			return nil, fmt.Errorf("invalid line %d: %q", n, scanner.Text())
+		}
+
+		values := make([]uint64, 16)
+		for i := range values {
+			v, err := strconv.ParseUint(fields[i], 10, 64)
+			if err != nil {
+				return nil, fmt.Errorf("invalid line %d: %w", n, err)
+			}
+			values[i] = v
+		}
+
+		// The receive columns are bytes, packets, errs, drop, fifo,
+		// frame, compressed and multicast, followed by the transmit
+		// ones starting with bytes, packets, errs and drop.
+		stats = append(stats, InterfaceStats{
+			Name:      strings.TrimSpace(scanner.Text()[:idx]),
+			RxBytes:   values[0],
+			RxPackets: values[1],
+			RxErrors:  values[2],
+			RxDropped: values[3],
+			TxBytes:   values[8],
+			TxPackets: values[9],
+			TxErrors:  values[10],
+			TxDropped: values[11],
+		})
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return stats, nil
+}
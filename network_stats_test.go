@@ -0,0 +1,46 @@
+//go:build linux
+// +build linux
+
+package embedshim
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseNetDev(t *testing.T) {
+	data := `Inter-|   Receive                                                |  Transmit
+ face |bytes    packets errs drop fifo frame compressed multicast|bytes    packets errs drop fifo colls carrier compressed
+    lo:     100       2    0    0    0     0          0         0      100       2    0    0    0     0       0          0
+  eth0:    2048      16    1    2    0     0          0         3     1024       8    4    5    0     0       0          0
+`
+
+	stats, err := parseNetDev(strings.NewReader(data))
+	if err != nil {
+		t.Fatalf("failed to parse net/dev: %v", err)
+	}
+
+	expected := []InterfaceStats{
+		{Name: "lo", RxBytes: 100, RxPackets: 2, TxBytes: 100, TxPackets: 2},
+		{
+			Name:    "eth0",
+			RxBytes: 2048, RxPackets: 16, RxErrors: 1, RxDropped: 2,
+			TxBytes: 1024, TxPackets: 8, TxErrors: 4, TxDropped: 5,
+		},
+	}
+	if !reflect.DeepEqual(stats, expected) {
+		t.Fatalf("expected %+v, but got %+v", expected, stats)
+	}
+
+	network := cadvisorNetworkStats(stats)
+	if network.Name != "eth0" || len(network.Interfaces) != 1 {
+		t.Fatalf("expected eth0 only, but got %+v", network)
+	}
+
+	for _, line := range []string{"eth0 1 2 3", "eth0: 1 2 3", "eth0: " + strings.Repeat("x ", 16)} {
+		if _, err := parseNetDev(strings.NewReader("h1\nh2\n" + line + "\n")); err == nil {
+			t.Fatalf("expected error for %q, but got nil", line)
+		}
+	}
+}
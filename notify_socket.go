@@ -0,0 +1,332 @@
+//go:build linux
+// +build linux
+
+package embedshim
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+
+	pkgbundle "github.com/fuweid/embedshim/pkg/bundle"
+
+	"github.com/containerd/containerd/errdefs"
+	"github.com/containerd/containerd/log"
+	"github.com/containerd/typeurl"
+	"github.com/opencontainers/runtime-spec/specs-go"
+)
+
+// TaskNotifyEventTopic is the topic of TaskNotify event.
+const TaskNotifyEventTopic = "/tasks/notify"
+
+func init() {
+	typeurl.Register(&TaskNotify{}, "io.embedshim.events.v1", "TaskNotify")
+}
+
+// TaskNotify is published for each sd_notify message from the container.
+type TaskNotify struct {
+	ContainerID string `json:"container_id"`
+	Ready       bool   `json:"ready"`
+	Reloading   bool   `json:"reloading"`
+	Stopping    bool   `json:"stopping"`
+	Watchdog    bool   `json:"watchdog"`
+	Status      string `json:"status,omitempty"`
+	// Message is the raw assignments, like "READY=1\nSTATUS=serving".
+	Message string `json:"message"`
+}
+
+// Field implements events.Event.
+func (e *TaskNotify) Field(fieldpath []string) (string, bool) {
+	if len(fieldpath) == 0 {
+		return "", false
+	}
+
+	switch fieldpath[0] {
+	case "container_id":
+		return e.ContainerID, len(e.ContainerID) > 0
+	}
+	return "", false
+}
+
+func newTaskNotify(id string, kvs [][2]string) *TaskNotify {
+	ev := &TaskNotify{ContainerID: id}
+	for i, kv := range kvs {
+		switch kv[0] {
+		case "READY":
+			ev.Ready = kv[1] == "1"
+		case "RELOADING":
+			ev.Reloading = kv[1] == "1"
+		case "STOPPING":
+			ev.Stopping = kv[1] == "1"
+		case "WATCHDOG":
+			ev.Watchdog = kv[1] == "1"
+		case "STATUS":
+			ev.Status = kv[1]
+		}
+
+		if i > 0 {
+			ev.Message += "\n"
+		}
+		ev.Message += kv[0] + "=" + kv[1]
+	}
+	return ev
+}
+
+var (
+	// bundleDirNotify is the bundle's dir holding the notify socket. The
+	// dir instead of the socket is bind-mounted into the container so that
+	// the socket can be re-created after containerd restarts.
+	bundleDirNotify = "notify"
+
+	notifySocketName = "notify.sock"
+
+	// notifySocketContainerDir is where the notify dir is mounted in the
+	// container.
+	notifySocketContainerDir = "/run/embedshim-notify"
+
+	// notifySocketMaxMessageBytes is the max size of one sd_notify
+	// message.
+	notifySocketMaxMessageBytes = 4096
+)
+
+// ensureNotifySocketSpec bind-mounts the bundle's notify dir into the
+// container and sets NOTIFY_SOCKET for the init process. It is no-op if the
+// spec has been patched.
+func ensureNotifySocketSpec(bundle *pkgbundle.Bundle) error {
+	spec, err := readInitOCISpec(bundle)
+	if err != nil {
+		return err
+	}
+
+	for _, m := range spec.Mounts {
+		if m.Destination == notifySocketContainerDir {
+			return nil
+		}
+	}
+
+	if spec.Process == nil {
+		spec.Process = &specs.Process{}
+	}
+	env := "NOTIFY_SOCKET=" + filepath.Join(notifySocketContainerDir, notifySocketName)
+	for i, e := range spec.Process.Env {
+		if strings.HasPrefix(e, "NOTIFY_SOCKET=") {
+			spec.Process.Env = append(spec.Process.Env[:i], spec.Process.Env[i+1:]...)
+			break
+		}
+	}
+	spec.Process.Env = append(spec.Process.Env, env)
+
+	spec.Mounts = append(spec.Mounts, specs.Mount{
+		Destination: notifySocketContainerDir,
+		Type:        "bind",
+		Source:      filepath.Join(bundle.Path, bundleDirNotify),
+		Options:     []string{"bind", "rw", "nosuid", "nodev", "noexec"},
+	})
+	return writeInitOCISpec(bundle, spec)
+}
+
+// notifySocket receives the sd_notify messages from the container.
+type notifySocket struct {
+	conn *net.UnixConn
+	// handle is called with the message's assignments, like READY=1, in
+	// the order of the message.
+	handle func(kvs [][2]string)
+}
+
+// listenNotifySocket creates the notify socket in the bundle. The stale
+// socket is replaced.
+func listenNotifySocket(bundle *pkgbundle.Bundle, handle func(kvs [][2]string)) (*notifySocket, error) {
+	dir := filepath.Join(bundle.Path, bundleDirNotify)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+
+	pathname := filepath.Join(dir, notifySocketName)
+	if err := os.Remove(pathname); err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	conn, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: pathname, Net: "unixgram"})
+	if err != nil {
+		return nil, fmt.Errorf("failed to listen notify socket %s: %w", pathname, err)
+	}
+
+	// NOTE: The container's user might not be root.
+	if err := os.Chmod(pathname, 0777); err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	n := &notifySocket{conn: conn, handle: handle}
+	go n.serve()
+	return n, nil
+}
+
+func (n *notifySocket) serve() {
+	buf := make([]byte, notifySocketMaxMessageBytes)
+	for {
+		size, _, err := n.conn.ReadFromUnix(buf)
+		if err != nil {
+			if !errors.Is(err, net.ErrClosed) {
+				log.G(context.Background()).WithError(err).Warn("failed to read notify socket")
+			}
+			return
+		}
+		n.handle(parseNotifyMessage(string(buf[:size])))
+	}
+}
+
+func (n *notifySocket) close() error {
+	return n.conn.Close()
+}
+
+// parseNotifyMessage parses the newline-separated assignments, like
+// "READY=1\nSTATUS=serving".
+func parseNotifyMessage(msg string) [][2]string {
+	var kvs [][2]string
+	for _, line := range strings.Split(msg, "\n") {
+		idx := strings.IndexByte(line, '=')
+		if idx <= 0 {
+			continue
+		}
+		kvs = append(kvs, [2]string{line[:idx], line[idx+1:]})
+	}
+	return kvs
+}
+
+// notifyProxyConfig forwards the sd_notify messages from the container,
+// which is defined by annotations.
+type notifyProxyConfig struct {
+	// events publishes TaskNotify event for each message.
+	events bool
+	// forward is the host's notify socket, like /run/systemd/notify.
+	forward string
+}
+
+// notifyProxyFromAnnotations returns nil if the proxy isn't defined.
+func notifyProxyFromAnnotations(annotations map[string]string) (*notifyProxyConfig, error) {
+	events, err := annotationBool(annotations, annotationNotifySocketEvents)
+	if err != nil {
+		return nil, err
+	}
+
+	forward := annotations[annotationNotifySocketForward]
+	if forward != "" && !filepath.IsAbs(forward) {
+		return nil, fmt.Errorf("invalid annotation %s=%q, it must be absolute path: %w",
+			annotationNotifySocketForward, forward, errdefs.ErrInvalidArgument)
+	}
+
+	if !events && forward == "" {
+		return nil, nil
+	}
+	return &notifyProxyConfig{events: events, forward: forward}, nil
+}
+
+// needsNotifySocket returns true if the sd_notify messages are consumed by
+// readiness or proxy.
+func (s *shim) needsNotifySocket() bool {
+	return s.init.notifyProxy != nil ||
+		(s.readiness != nil && s.readiness.cfg.mode == ReadinessModeNotify)
+}
+
+// prepareNotifySocket mounts the notify socket into the container before
+// the init process is created.
+func (s *shim) prepareNotifySocket() error {
+	if !s.needsNotifySocket() {
+		return nil
+	}
+
+	if err := ensureNotifySocketSpec(s.bundle); err != nil {
+		return fmt.Errorf("failed to mount notify socket: %w", err)
+	}
+	s.manager.refreshBundle(s.bundle)
+	return s.listenNotifySocket()
+}
+
+// listenNotifySocket creates the notify socket. It is also used to re-create
+// the socket for the reloaded task, which is visible in the container
+// because the dir is bind-mounted.
+func (s *shim) listenNotifySocket() error {
+	if !s.needsNotifySocket() {
+		return nil
+	}
+
+	n, err := listenNotifySocket(s.bundle, s.handleNotify)
+	if err != nil {
+		return err
+	}
+	s.notify = n
+	return nil
+}
+
+func (s *shim) closeNotifySocket() {
+	if s.notify != nil {
+		s.notify.close()
+	}
+}
+
+func (s *shim) handleNotify(kvs [][2]string) {
+	if s.readiness != nil {
+		s.readiness.handleNotify(kvs)
+	}
+
+	cfg := s.init.notifyProxy
+	if cfg == nil {
+		return
+	}
+
+	if cfg.events {
+		s.manager.publishEvent(s.Namespace(), TaskNotifyEventTopic, newTaskNotify(s.ID(), kvs))
+	}
+	if cfg.forward != "" {
+		if err := forwardNotifyMessage(cfg.forward, s.PID(), kvs); err != nil {
+			log.G(context.Background()).WithError(err).Warnf("failed to forward notify message of task %s to %s",
+				s.ID(), cfg.forward)
+		}
+	}
+}
+
+// notifyForwardKeys are the assignments forwarded to the host. The FDSTORE
+// isn't supported because the fds aren't received.
+var notifyForwardKeys = map[string]struct{}{
+	"READY":               {},
+	"RELOADING":           {},
+	"STOPPING":            {},
+	"STATUS":              {},
+	"ERRNO":               {},
+	"WATCHDOG":            {},
+	"WATCHDOG_USEC":       {},
+	"EXTEND_TIMEOUT_USEC": {},
+}
+
+// forwardNotifyMessage sends the message to the host's notify socket with
+// MAINPID of the init process's host pid, because the pid in container is
+// meaningless to the host's systemd. The unit must allow the embedshim's
+// messages, like NotifyAccess=all.
+func forwardNotifyMessage(socket string, mainPid uint32, kvs [][2]string) error {
+	var lines []string
+	for _, kv := range kvs {
+		if _, ok := notifyForwardKeys[kv[0]]; ok {
+			lines = append(lines, kv[0]+"="+kv[1])
+		}
+	}
+	if len(lines) == 0 {
+		return nil
+	}
+	if mainPid > 0 {
+		lines = append(lines, fmt.Sprintf("MAINPID=%d", mainPid))
+	}
+
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: socket, Net: "unixgram"})
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	_, err = conn.Write([]byte(strings.Join(lines, "\n")))
+	return err
+}
@@ -0,0 +1,40 @@
+//go:build linux
+// +build linux
+
+package embedshim
+
+import (
+	"net"
+	"path/filepath"
+	"testing"
+)
+
+func TestForwardNotifyMessage(t *testing.T) {
+	socket := filepath.Join(t.TempDir(), "notify.sock")
+	conn, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: socket, Net: "unixgram"})
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	defer conn.Close()
+
+	kvs := parseNotifyMessage("READY=1\nFDSTORE=1\nSTATUS=serving")
+	if err := forwardNotifyMessage(socket, 1234, kvs); err != nil {
+		t.Fatalf("failed to forward: %v", err)
+	}
+
+	buf := make([]byte, notifySocketMaxMessageBytes)
+	n, _, err := conn.ReadFromUnix(buf)
+	if err != nil {
+		t.Fatalf("failed to read: %v", err)
+	}
+
+	expected := "READY=1\nSTATUS=serving\nMAINPID=1234"
+	if got := string(buf[:n]); got != expected {
+		t.Fatalf("expected %q, but got %q", expected, got)
+	}
+
+	ev := newTaskNotify("c1", kvs)
+	if !ev.Ready || ev.Status != "serving" || ev.Message != "READY=1\nFDSTORE=1\nSTATUS=serving" {
+		t.Fatalf("unexpected event %+v", ev)
+	}
+}
@@ -0,0 +1,53 @@
+//go:build linux
+// +build linux
+
+package embedshim
+
+import (
+	"context"
+	"os/exec"
+
+	"github.com/fuweid/embedshim/pkg/runcext"
+
+	"github.com/containerd/go-runc"
+	"github.com/opencontainers/runtime-spec/specs-go"
+)
+
+// ociRuntime is the OCI runtime used by the init process. It is implemented
+// by runcRuntime and the fake runtime in tests.
+type ociRuntime interface {
+	Create(ctx context.Context, id, bundle string, opts *runc.CreateOpts) error
+	Start(ctx context.Context, id string) error
+	Delete(ctx context.Context, id string, opts *runc.DeleteOpts) error
+	Kill(ctx context.Context, id string, sig int, opts *runc.KillOpts) error
+	Pause(ctx context.Context, id string) error
+	Resume(ctx context.Context, id string) error
+	Update(ctx context.Context, id string, resources *specs.LinuxResources) error
+	State(ctx context.Context, id string) (*runc.Container, error)
+	Restore(ctx context.Context, id, bundle string, opts *runc.RestoreOpts) (int, error)
+	Checkpoint(ctx context.Context, id string, opts *runc.CheckpointOpts, actions ...runc.CheckpointAction) error
+
+	// RootDir returns the runtime's state root dir.
+	RootDir() string
+	// LastError returns the last error message in runtime's log.
+	LastError() (string, error)
+	// ExtCommand returns the runcext command, which is used to exec process.
+	ExtCommand(ctx context.Context, args ...string) *exec.Cmd
+}
+
+// runcRuntime is the runc-like command line.
+type runcRuntime struct {
+	*runc.Runc
+}
+
+func (r *runcRuntime) RootDir() string {
+	return r.Root
+}
+
+func (r *runcRuntime) LastError() (string, error) {
+	return getLastRuntimeError(r.Runc)
+}
+
+func (r *runcRuntime) ExtCommand(ctx context.Context, args ...string) *exec.Cmd {
+	return runcext.RuntimeCommand(ctx, true, r.Runc, args...)
+}
@@ -0,0 +1,107 @@
+//go:build linux
+// +build linux
+
+package embedshim
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/containerd/containerd/errdefs"
+)
+
+const (
+	minOOMScoreAdj = -1000
+	maxOOMScoreAdj = 1000
+)
+
+// oomScoreAdjPolicy decides the oom_score_adj for the exec processes.
+type oomScoreAdjPolicy struct {
+	// inherit is to copy the oom_score_adj from the init process.
+	inherit bool
+	// value is the explicit oom_score_adj if it is not nil.
+	value *int
+}
+
+// defaultExecOOMScoreAdjPolicy inherits the init's oom_score_adj. Otherwise,
+// the exec process has the same value with runc-exec's parent, which is
+// containerd and it is likely to be the last victim of OOM killer.
+var defaultExecOOMScoreAdjPolicy = oomScoreAdjPolicy{inherit: true}
+
+func execOOMScoreAdjPolicyFromAnnotations(annotations map[string]string) (oomScoreAdjPolicy, error) {
+	v, ok := annotations[annotationExecOOMScoreAdj]
+	if !ok || v == "" {
+		return defaultExecOOMScoreAdjPolicy, nil
+	}
+
+	switch v {
+	case "inherit":
+		return oomScoreAdjPolicy{inherit: true}, nil
+	case "default":
+		return oomScoreAdjPolicy{}, nil
+	}
+
+	score, err := strconv.Atoi(v)
+	if err != nil {
+		return oomScoreAdjPolicy{}, fmt.Errorf("invalid annotation %s=%q: %w", annotationExecOOMScoreAdj, v, errdefs.ErrInvalidArgument)
+	}
+	if err := validateOOMScoreAdj(score); err != nil {
+		return oomScoreAdjPolicy{}, err
+	}
+	return oomScoreAdjPolicy{value: &score}, nil
+}
+
+// applyOOMScoreAdj sets the exec process's oom_score_adj. The value from
+// process spec takes precedence over the container's policy.
+func (e *execProcess) applyOOMScoreAdj(pid uint32) error {
+	var score int
+
+	switch policy := e.parent.execOOMScoreAdj; {
+	case e.spec.OOMScoreAdj != nil:
+		score = *e.spec.OOMScoreAdj
+		if err := validateOOMScoreAdj(score); err != nil {
+			return err
+		}
+	case policy.value != nil:
+		score = *policy.value
+	case policy.inherit:
+		var err error
+		if score, err = readOOMScoreAdj(e.parent.Pid()); err != nil {
+			return fmt.Errorf("failed to inherit oom_score_adj from %s: %w", e.parent, err)
+		}
+	default:
+		return nil
+	}
+
+	if err := writeOOMScoreAdj(int(pid), score); err != nil {
+		return fmt.Errorf("failed to set oom_score_adj for exec process %s: %w", e.id, err)
+	}
+	return nil
+}
+
+func validateOOMScoreAdj(score int) error {
+	if score < minOOMScoreAdj || score > maxOOMScoreAdj {
+		return fmt.Errorf("oom_score_adj %d out of range [%d, %d]: %w",
+			score, minOOMScoreAdj, maxOOMScoreAdj, errdefs.ErrInvalidArgument)
+	}
+	return nil
+}
+
+func readOOMScoreAdj(pid int) (int, error) {
+	value, err := os.ReadFile(oomScoreAdjPath(pid))
+	if err != nil {
+		return 0, err
+	}
+	return strconv.Atoi(strings.TrimSpace(string(value)))
+}
+
+func writeOOMScoreAdj(pid int, score int) error {
+	return os.WriteFile(oomScoreAdjPath(pid), []byte(strconv.Itoa(score)), 0644)
+}
+
+func oomScoreAdjPath(pid int) string {
+	return filepath.Join("/proc", strconv.Itoa(pid), "oom_score_adj")
+}
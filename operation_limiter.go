@@ -0,0 +1,189 @@
+//go:build linux
+// +build linux
+
+package embedshim
+
+import (
+	"context"
+	"sync"
+)
+
+const (
+	operationCreate = "create"
+	operationStart  = "start"
+	operationDelete = "delete"
+)
+
+// OperationLimitsConfig bounds the number of the tasks being created,
+// started or deleted at the same time. The excess operations are queued and
+// granted in round-robin by namespace, so that the pod storm in one
+// namespace doesn't starve the others. The zero means unlimited.
+type OperationLimitsConfig struct {
+	MaxConcurrentCreates int `toml:"max_concurrent_creates"`
+	MaxConcurrentStarts  int `toml:"max_concurrent_starts"`
+	MaxConcurrentDeletes int `toml:"max_concurrent_deletes"`
+}
+
+// operationLimiters are the limiters of the task operations. The zero value
+// means unlimited.
+type operationLimiters struct {
+	create *operationLimiter
+	start  *operationLimiter
+	delete *operationLimiter
+}
+
+func newOperationLimiters(cfg OperationLimitsConfig) operationLimiters {
+	return operationLimiters{
+		create: newOperationLimiter(operationCreate, cfg.MaxConcurrentCreates),
+		start:  newOperationLimiter(operationStart, cfg.MaxConcurrentStarts),
+		delete: newOperationLimiter(operationDelete, cfg.MaxConcurrentDeletes),
+	}
+}
+
+func (ls operationLimiters) all() []*operationLimiter {
+	var limiters []*operationLimiter
+	for _, l := range []*operationLimiter{ls.create, ls.start, ls.delete} {
+		if l != nil {
+			limiters = append(limiters, l)
+		}
+	}
+	return limiters
+}
+
+// operationLimiter is the semaphore with per-namespace FIFO queues. The
+// released slot is handed over to the first waiter of the next namespace
+// in round-robin order.
+//
+// The nil limiter means unlimited.
+type operationLimiter struct {
+	operation string
+	limit     int
+
+	mu       sync.Mutex
+	inflight int
+	queues   map[string][]*operationWaiter
+	// order is the round-robin ring of the namespaces with waiters.
+	order []string
+}
+
+type operationWaiter struct {
+	ready   chan struct{}
+	granted bool
+}
+
+func newOperationLimiter(operation string, limit int) *operationLimiter {
+	if limit <= 0 {
+		return nil
+	}
+	return &operationLimiter{
+		operation: operation,
+		limit:     limit,
+		queues:    make(map[string][]*operationWaiter),
+	}
+}
+
+// acquire waits for the slot until the context is done.
+func (l *operationLimiter) acquire(ctx context.Context, ns string) error {
+	if l == nil {
+		return nil
+	}
+
+	l.mu.Lock()
+	if l.inflight < l.limit && len(l.order) == 0 {
+		l.inflight++
+		l.mu.Unlock()
+		return nil
+	}
+
+	w := &operationWaiter{ready: make(chan struct{})}
+	if len(l.queues[ns]) == 0 {
+		l.order = append(l.order, ns)
+	}
+	l.queues[ns] = append(l.queues[ns], w)
+	l.mu.Unlock()
+
+	select {
+	case <-w.ready:
+		return nil
+	case <-ctx.Done():
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	// The slot might be granted right after the context is done.
+	if w.granted {
+		l.releaseLocked()
+		return ctx.Err()
+	}
+	l.removeLocked(ns, w)
+	return ctx.Err()
+}
+
+func (l *operationLimiter) release() {
+	if l == nil {
+		return
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.releaseLocked()
+}
+
+func (l *operationLimiter) releaseLocked() {
+	l.inflight--
+
+	for l.inflight < l.limit && len(l.order) > 0 {
+		ns := l.order[0]
+		l.order = l.order[1:]
+
+		queue := l.queues[ns]
+		w := queue[0]
+		if len(queue) > 1 {
+			l.queues[ns] = queue[1:]
+			l.order = append(l.order, ns)
+		} else {
+			delete(l.queues, ns)
+		}
+
+		w.granted = true
+		l.inflight++
+		close(w.ready)
+	}
+}
+
+func (l *operationLimiter) removeLocked(ns string, w *operationWaiter) {
+	queue := l.queues[ns]
+	for i := range queue {
+		if queue[i] == w {
+			queue = append(queue[:i], queue[i+1:]...)
+			break
+		}
+	}
+	if len(queue) > 0 {
+		l.queues[ns] = queue
+		return
+	}
+
+	delete(l.queues, ns)
+	for i := range l.order {
+		if l.order[i] == ns {
+			l.order = append(l.order[:i], l.order[i+1:]...)
+			break
+		}
+	}
+}
+
+// stats returns the number of the in-flight operations and the queue depth
+// of each namespace.
+func (l *operationLimiter) stats() (int, map[string]int) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	depths := make(map[string]int, len(l.queues))
+	for ns, queue := range l.queues {
+		depths[ns] = len(queue)
+	}
+	return l.inflight, depths
+}
@@ -0,0 +1,71 @@
+//go:build linux
+// +build linux
+
+package embedshim
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestOperationLimiterFairness(t *testing.T) {
+	ctx := context.Background()
+	l := newOperationLimiter(operationCreate, 1)
+
+	if err := l.acquire(ctx, "a"); err != nil {
+		t.Fatal(err)
+	}
+
+	granted := make(chan string, 4)
+	enqueue := func(ns string, depth int) {
+		go func() {
+			if err := l.acquire(ctx, ns); err == nil {
+				granted <- ns
+			}
+		}()
+
+		for i := 0; i < 100; i++ {
+			if _, depths := l.stats(); depths[ns] == depth {
+				return
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+		t.Fatalf("expected %d waiters in %s", depth, ns)
+	}
+	enqueue("a", 1)
+	enqueue("a", 2)
+	enqueue("a", 3)
+	enqueue("b", 1)
+
+	var got []string
+	for i := 0; i < 4; i++ {
+		l.release()
+		got = append(got, <-granted)
+	}
+
+	expected := []string{"a", "b", "a", "a"}
+	for i := range expected {
+		if got[i] != expected[i] {
+			t.Fatalf("expected %v, but got %v", expected, got)
+		}
+	}
+}
+
+func TestOperationLimiterCancel(t *testing.T) {
+	l := newOperationLimiter(operationDelete, 1)
+	if err := l.acquire(context.Background(), "a"); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if err := l.acquire(ctx, "b"); err != context.DeadlineExceeded {
+		t.Fatalf("expected %v, but got %v", context.DeadlineExceeded, err)
+	}
+
+	l.release()
+	if inflight, depths := l.stats(); inflight != 0 || len(depths) != 0 {
+		t.Fatalf("expected no inflight and waiters, but got %v and %v", inflight, depths)
+	}
+}
@@ -0,0 +1,160 @@
+//go:build linux
+// +build linux
+
+package embedshim
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	goruntime "runtime"
+
+	"github.com/containerd/containerd/errdefs"
+	"github.com/containerd/containerd/log"
+	"golang.org/x/sys/unix"
+)
+
+// PathRestrictions are the additional paths applied to the running
+// container, which have the same semantics to the spec's linux.maskedPaths
+// and linux.readonlyPaths.
+type PathRestrictions struct {
+	// MaskedPaths are covered by /dev/null for file, or by read-only tmpfs
+	// for directory.
+	MaskedPaths []string `json:"masked_paths,omitempty"`
+	// ReadonlyPaths are bind-mounted onto themselves and remounted
+	// read-only.
+	ReadonlyPaths []string `json:"readonly_paths,omitempty"`
+}
+
+// RestrictPaths masks and remounts the paths read-only in the container's
+// mount namespace, so that the attack surface of the compromised container
+// is reduced without restart. The path which doesn't exist is skipped, like
+// the OCI runtime. It stops at the first failure, and the applied paths
+// aren't reverted.
+//
+// NOTE: The restrictions aren't persisted. The restarted init process uses
+// the spec's paths. The exec processes started before might hold the opened
+// files.
+func (manager *TaskManager) RestrictPaths(ctx context.Context, id string, r PathRestrictions) error {
+	for _, paths := range [][]string{r.MaskedPaths, r.ReadonlyPaths} {
+		if err := validateRestrictedPaths(paths); err != nil {
+			return err
+		}
+	}
+
+	nsFD, err := manager.openInitProcEntry(ctx, id, "ns/mnt", unix.O_RDONLY)
+	if err != nil {
+		return err
+	}
+	defer unix.Close(nsFD)
+
+	err = runInMountNS(nsFD, func() error {
+		for _, p := range r.ReadonlyPaths {
+			if err := readonlyPath(p); err != nil {
+				return err
+			}
+		}
+		for _, p := range r.MaskedPaths {
+			if err := maskPath(p); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("failed to restrict paths of task %s: %w", id, err)
+	}
+
+	log.G(ctx).Infof("paths of task %s are restricted: masked %v, readonly %v", id, r.MaskedPaths, r.ReadonlyPaths)
+	return nil
+}
+
+func validateRestrictedPaths(paths []string) error {
+	for _, p := range paths {
+		if !filepath.IsAbs(p) || filepath.Clean(p) != p || p == "/" {
+			return fmt.Errorf("path %q should be clean absolute path other than /: %w", p, errdefs.ErrInvalidArgument)
+		}
+	}
+	return nil
+}
+
+// runInMountNS runs fn in the mount namespace nsFD.
+//
+// NOTE: The setns(CLONE_NEWNS) requires the thread's own fs_struct, which
+// is unshared from the other threads. The thread is never unlocked, so that
+// it is terminated with the goroutine instead of being reused.
+func runInMountNS(nsFD int, fn func() error) error {
+	errCh := make(chan error, 1)
+	go func() {
+		goruntime.LockOSThread()
+
+		if err := unix.Unshare(unix.CLONE_FS); err != nil {
+			errCh <- fmt.Errorf("failed to unshare fs: %w", err)
+			return
+		}
+		if err := unix.Setns(nsFD, unix.CLONE_NEWNS); err != nil {
+			errCh <- fmt.Errorf("failed to enter mount namespace: %w", err)
+			return
+		}
+		errCh <- fn()
+	}()
+	return <-errCh
+}
+
+// maskPath is based on runc's libcontainer/rootfs_linux.go.
+func maskPath(p string) error {
+	st, err := os.Stat(p)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+
+	if st.IsDir() {
+		err = unix.Mount("tmpfs", p, "tmpfs", unix.MS_RDONLY, "")
+	} else {
+		err = unix.Mount("/dev/null", p, "", unix.MS_BIND, "")
+	}
+	if err != nil {
+		return fmt.Errorf("failed to mask %s: %w", p, err)
+	}
+	return nil
+}
+
+// readonlyPath is based on runc's libcontainer/rootfs_linux.go. The mount
+// flags locked in the user namespace, like nosuid, are kept.
+func readonlyPath(p string) error {
+	if err := unix.Mount(p, p, "", unix.MS_BIND|unix.MS_REC, ""); err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return fmt.Errorf("failed to bind-mount %s: %w", p, err)
+	}
+
+	var st unix.Statfs_t
+	if err := unix.Statfs(p, &st); err != nil {
+		return err
+	}
+
+	flags := uintptr(unix.MS_BIND | unix.MS_REMOUNT | unix.MS_RDONLY)
+	for statFlag, mountFlag := range map[int64]uintptr{
+		unix.ST_NOSUID:      unix.MS_NOSUID,
+		unix.ST_NODEV:       unix.MS_NODEV,
+		unix.ST_NOEXEC:      unix.MS_NOEXEC,
+		unix.ST_NOATIME:     unix.MS_NOATIME,
+		unix.ST_NODIRATIME:  unix.MS_NODIRATIME,
+		unix.ST_RELATIME:    unix.MS_RELATIME,
+		unix.ST_SYNCHRONOUS: unix.MS_SYNCHRONOUS,
+	} {
+		if st.Flags&statFlag != 0 {
+			flags |= mountFlag
+		}
+	}
+
+	if err := unix.Mount(p, p, "", flags, ""); err != nil {
+		return fmt.Errorf("failed to remount %s read-only: %w", p, err)
+	}
+	return nil
+}
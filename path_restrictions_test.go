@@ -0,0 +1,71 @@
+//go:build linux
+// +build linux
+
+package embedshim
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"golang.org/x/sys/unix"
+)
+
+func TestValidateRestrictedPaths(t *testing.T) {
+	if err := validateRestrictedPaths([]string{"/proc/kcore", "/etc"}); err != nil {
+		t.Fatalf("expected valid paths, but got %v", err)
+	}
+
+	for _, p := range []string{"", "/", "etc", "/etc/", "/etc/../proc"} {
+		if err := validateRestrictedPaths([]string{p}); err == nil {
+			t.Fatalf("expected error for %q, but got nil", p)
+		}
+	}
+}
+
+func TestRestrictPathsInMountNS(t *testing.T) {
+	dir := t.TempDir()
+	if err := unix.Mount("tmpfs", dir, "tmpfs", 0, ""); err != nil {
+		t.Skipf("tmpfs mount is unavailable: %v", err)
+	}
+	defer unix.Unmount(dir, unix.MNT_DETACH|unix.MNT_FORCE)
+
+	secret := filepath.Join(dir, "secret")
+	if err := os.WriteFile(secret, []byte("token"), 0600); err != nil {
+		t.Fatalf("failed to write file: %v", err)
+	}
+	config := filepath.Join(dir, "config")
+	if err := os.Mkdir(config, 0700); err != nil {
+		t.Fatalf("failed to create dir: %v", err)
+	}
+
+	nsFD, err := unix.Open("/proc/self/ns/mnt", unix.O_RDONLY|unix.O_CLOEXEC, 0)
+	if err != nil {
+		t.Fatalf("failed to open mount namespace: %v", err)
+	}
+	defer unix.Close(nsFD)
+
+	err = runInMountNS(nsFD, func() error {
+		if err := maskPath(secret); err != nil {
+			return err
+		}
+		if err := maskPath(filepath.Join(dir, "missing")); err != nil {
+			return err
+		}
+		return readonlyPath(config)
+	})
+	if err != nil {
+		t.Fatalf("failed to restrict paths: %v", err)
+	}
+
+	data, err := os.ReadFile(secret)
+	if err != nil || len(data) != 0 {
+		t.Fatalf("expected masked file, but got %q (err: %v)", data, err)
+	}
+
+	err = os.WriteFile(filepath.Join(config, "file"), nil, 0600)
+	if !errors.Is(err, unix.EROFS) {
+		t.Fatalf("expected EROFS, but got %v", err)
+	}
+}
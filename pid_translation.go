@@ -0,0 +1,122 @@
+//go:build linux
+// +build linux
+
+package embedshim
+
+import (
+	"sync/atomic"
+
+	"github.com/containerd/containerd/runtime"
+	"github.com/containerd/typeurl"
+)
+
+func init() {
+	typeurl.Register(&ProcessDetails{}, "io.embedshim.types.v1", "ProcessDetails")
+}
+
+// ProcessDetails is the Info of the process returned by Pids, which maps the
+// host pid to the container's pid namespace.
+type ProcessDetails struct {
+	// ExecID is the ID of the init or exec process which the process
+	// belongs to.
+	ExecID string `json:"exec_id"`
+	// NsPid is the process ID in the container's pid namespace. It is zero
+	// if it is unknown.
+	NsPid uint32 `json:"ns_pid"`
+}
+
+// pidnsLevel returns the index of NSpid for the container's pid namespace,
+// which is decided by the init process so that the nested pid namespace
+// inside the container is handled. It returns -1 if it is unknown.
+func (s *shim) pidnsLevel() int {
+	initPid := int(s.PID())
+	if initPid <= 0 {
+		return -1
+	}
+
+	st, err := readProcStatus(initPid)
+	if err != nil {
+		return -1
+	}
+	return len(st.nsPids) - 1
+}
+
+// nsPidOf translates the host pid into the container's pid namespace. It
+// returns zero if the process has exited or the level is unknown.
+func nsPidOf(pid uint32, level int) uint32 {
+	if pid == 0 || level < 0 {
+		return 0
+	}
+
+	st, err := readProcStatus(int(pid))
+	if err != nil || level >= len(st.nsPids) {
+		return 0
+	}
+	return st.nsPids[level]
+}
+
+// processNsPid returns the in-container pid of the init or exec process.
+// The pid captured during start is preferred because the host pid might be
+// reused after the process exits.
+func (s *shim) processNsPid(execID string, pid uint32) uint32 {
+	var nsPid uint32
+	if execID == "" || execID == s.ID() {
+		nsPid = s.loadedIdentity().InitNsPid
+	} else {
+		s.mu.Lock()
+		p := s.execProcesses[execID]
+		s.mu.Unlock()
+
+		if e, ok := p.(*execProcess); ok {
+			nsPid = e.NsPid()
+		}
+	}
+
+	if nsPid == 0 {
+		nsPid = nsPidOf(pid, s.pidnsLevel())
+	}
+	return nsPid
+}
+
+// NsPid returns the exec process's pid in the container's pid namespace.
+func (e *execProcess) NsPid() uint32 {
+	return atomic.LoadUint32(&e.nsPid)
+}
+
+// processInfos returns all the processes in the task's cgroup with the
+// in-container pid and the owner's ID.
+func (s *shim) processInfos() ([]runtime.ProcessInfo, error) {
+	roots, err := s.processTree()
+	if err != nil {
+		return nil, err
+	}
+
+	var (
+		infos []runtime.ProcessInfo
+		walk  func(nodes []*ProcessTreeNode) error
+	)
+	walk = func(nodes []*ProcessTreeNode) error {
+		for _, node := range nodes {
+			info, err := typeurl.MarshalAny(&ProcessDetails{
+				ExecID: node.ExecID,
+				NsPid:  node.NsPid,
+			})
+			if err != nil {
+				return err
+			}
+
+			infos = append(infos, runtime.ProcessInfo{
+				Pid:  node.Pid,
+				Info: info,
+			})
+			if err := walk(node.Children); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	if err := walk(roots); err != nil {
+		return nil, err
+	}
+	return infos, nil
+}
@@ -0,0 +1,57 @@
+package bundle
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestBundleIsolatedByNamespace(t *testing.T) {
+	var (
+		root  = t.TempDir()
+		state = t.TempDir()
+		id    = "same-id"
+	)
+
+	b1, err := NewBundle(root, state, "ns1", id)
+	if err != nil {
+		t.Fatalf("failed to create bundle in ns1: %v", err)
+	}
+
+	b2, err := NewBundle(root, state, "ns2", id)
+	if err != nil {
+		t.Fatalf("failed to create bundle in ns2 with same id: %v", err)
+	}
+
+	if b1.Path == b2.Path {
+		t.Fatalf("expected different bundle path, but got same %v", b1.Path)
+	}
+
+	for _, b := range []*Bundle{b1, b2} {
+		workDir, err := os.Readlink(filepath.Join(b.Path, "work"))
+		if err != nil {
+			t.Fatalf("failed to readlink workdir: %v", err)
+		}
+
+		expected := filepath.Join(root, b.Namespace, id)
+		if workDir != expected {
+			t.Fatalf("expected workdir %v, but got %v", expected, workDir)
+		}
+	}
+
+	if err := b1.Delete(); err != nil {
+		t.Fatalf("failed to delete bundle in ns1: %v", err)
+	}
+
+	if err := b2.IsValid(); err != nil {
+		t.Fatalf("expected bundle in ns2 is still valid, but got: %v", err)
+	}
+
+	loaded, err := LoadBundle(state, "ns2", id)
+	if err != nil {
+		t.Fatalf("failed to load bundle in ns2: %v", err)
+	}
+	if loaded.Path != b2.Path {
+		t.Fatalf("expected %v, but got %v", b2.Path, loaded.Path)
+	}
+}
@@ -3,8 +3,11 @@ package exitsnoop
 import (
 	"bytes"
 	_ "embed"
+	"fmt"
 	"os"
 	"path/filepath"
+	"strconv"
+	"strings"
 	"syscall"
 
 	"github.com/cilium/ebpf"
@@ -24,6 +27,16 @@ var (
 
 	pinnedDir = ".exitsnoop.bpf"
 
+	// pinnedVersionFile records the layout version of pinned maps. It is
+	// stored next to pinned directory because bpffs doesn't support
+	// regular file.
+	pinnedVersionFile = ".exitsnoop.version"
+
+	// LayoutVersion is the version of the pinned maps' key and value
+	// layout, like TaskInfo and ExitStatus. It should be increased if the
+	// layout changes.
+	LayoutVersion = 1
+
 	bpfProgName        = "handle_sched_process_exit"
 	bpfMapTracingTasks = "tracing_tasks"
 	bpfMapExitedEvents = "exited_events"
@@ -75,7 +88,10 @@ func NewStoreFromAttach() (_ *Store, retErr error) {
 }
 
 // EnsureRunning makes sure that the exitsnoop has been pinned in BPF filesystem.
-func EnsureRunning(bpffsRoot string) error {
+//
+// The maps are created in maxEntries capacity. Zero means the default one in
+// the BPF object. The pinned maps will be resized if they are smaller.
+func EnsureRunning(bpffsRoot string, maxEntries uint32) error {
 	rootDir := filepath.Join(bpffsRoot, pinnedDir)
 
 	if err := ensureBPFFsMount(rootDir); err != nil {
@@ -84,6 +100,17 @@ func EnsureRunning(bpffsRoot string) error {
 
 	_, err := os.Stat(filepath.Join(rootDir, bpfProgName))
 	if err == nil {
+		if err := checkLayoutVersion(bpffsRoot); err != nil {
+			return err
+		}
+
+		current, err := MapMaxEntries(bpffsRoot)
+		if err != nil {
+			return err
+		}
+		if maxEntries > current {
+			return Resize(bpffsRoot, maxEntries)
+		}
 		return nil
 	}
 
@@ -100,12 +127,7 @@ func EnsureRunning(bpffsRoot string) error {
 		return err
 	}
 
-	spec, err := ebpf.LoadCollectionSpecFromReader(bytes.NewReader(progByteCode))
-	if err != nil {
-		return err
-	}
-
-	collection, err := ebpf.NewCollection(spec)
+	collection, err := newCollection(bpffsRoot, maxEntries)
 	if err != nil {
 		return err
 	}
@@ -140,7 +162,33 @@ func EnsureRunning(bpffsRoot string) error {
 			return err
 		}
 	}
-	return err
+	return writeLayoutVersion(bpffsRoot)
+}
+
+// checkLayoutVersion makes sure that the pinned maps are compatible with
+// current layout. The maps pinned before versioning are treated as version 1.
+func checkLayoutVersion(bpffsRoot string) error {
+	value, err := os.ReadFile(filepath.Join(bpffsRoot, pinnedVersionFile))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return writeLayoutVersion(bpffsRoot)
+		}
+		return err
+	}
+
+	version, err := strconv.Atoi(strings.TrimSpace(string(value)))
+	if err != nil {
+		return fmt.Errorf("invalid layout version %q: %w", value, err)
+	}
+
+	if version != LayoutVersion {
+		return fmt.Errorf("pinned exitsnoop maps have layout version %d, but expected %d", version, LayoutVersion)
+	}
+	return nil
+}
+
+func writeLayoutVersion(bpffsRoot string) error {
+	return os.WriteFile(filepath.Join(bpffsRoot, pinnedVersionFile), []byte(strconv.Itoa(LayoutVersion)), 0600)
 }
 
 func ensureBPFFsMount(bpffsRoot string) error {
@@ -3,32 +3,12 @@ package exitsnoop
 import (
 	"fmt"
 	"path/filepath"
+	"sync"
 
 	"github.com/cilium/ebpf"
 	"github.com/cilium/ebpf/link"
 )
 
-// TaskInfo is used to trace the target task.
-type TaskInfo struct {
-	// TraceID is allocated by userspace to identity the pid of task.
-	TraceID uint64
-	// PidnsInfo is used to check the pid namespace.
-	PidnsInfo PidnsInfo
-}
-
-type PidnsInfo struct {
-	Dev uint64
-	Ino uint64
-}
-
-// ExitStatus is used to record the exit event when the target task exits.
-type ExitStatus struct {
-	Pid           uint32
-	ExitCode      int32
-	StartBoottime uint64
-	ExittedTime   uint64
-}
-
 func NewStore(bpffsRoot string) (*Store, error) {
 	pinnedPath := filepath.Join(bpffsRoot, pinnedDir)
 
@@ -50,6 +30,9 @@ func NewStore(bpffsRoot string) (*Store, error) {
 
 // Store is used to trace target task and receive the exited event by trace ID.
 type Store struct {
+	// mu protects the maps from Reload.
+	mu sync.RWMutex
+
 	tracingTasks *ebpf.Map
 	exitedEvents *ebpf.Map
 
@@ -59,10 +42,16 @@ type Store struct {
 }
 
 func (store *Store) Trace(pid uint32, taskInfo *TaskInfo) error {
+	store.mu.RLock()
+	defer store.mu.RUnlock()
+
 	return store.tracingTasks.Update(pid, taskInfo, ebpf.UpdateNoExist)
 }
 
 func (store *Store) GetTracingTask(pid uint32) (*TaskInfo, error) {
+	store.mu.RLock()
+	defer store.mu.RUnlock()
+
 	info := &TaskInfo{}
 
 	if err := store.tracingTasks.Lookup(pid, info); err != nil {
@@ -72,10 +61,16 @@ func (store *Store) GetTracingTask(pid uint32) (*TaskInfo, error) {
 }
 
 func (store *Store) DeleteTracingTask(pid uint32) error {
+	store.mu.RLock()
+	defer store.mu.RUnlock()
+
 	return store.tracingTasks.Delete(pid)
 }
 
 func (store *Store) ExitedEventFromWaitStatus(traceEventID uint64, pid uint32, status uint32) error {
+	store.mu.RLock()
+	defer store.mu.RUnlock()
+
 	info := ExitStatus{
 		Pid:      pid,
 		ExitCode: int32(status),
@@ -85,6 +80,9 @@ func (store *Store) ExitedEventFromWaitStatus(traceEventID uint64, pid uint32, s
 }
 
 func (store *Store) GetExitedEvent(traceEventID uint64) (*ExitStatus, error) {
+	store.mu.RLock()
+	defer store.mu.RUnlock()
+
 	info := &ExitStatus{}
 
 	if err := store.exitedEvents.Lookup(traceEventID, info); err != nil {
@@ -94,6 +92,9 @@ func (store *Store) GetExitedEvent(traceEventID uint64) (*ExitStatus, error) {
 }
 
 func (store *Store) DeleteExitedEvent(traceEventID uint64) error {
+	store.mu.RLock()
+	defer store.mu.RUnlock()
+
 	return store.exitedEvents.Delete(traceEventID)
 }
 
@@ -0,0 +1,221 @@
+package exitsnoop
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+
+	"github.com/cilium/ebpf"
+	"github.com/cilium/ebpf/link"
+)
+
+// pinnedTmpSuffix is used to pin the new objects before they replace the
+// current ones.
+var pinnedTmpSuffix = ".new"
+
+// MapMaxEntries returns the capacity of the pinned maps.
+func MapMaxEntries(bpffsRoot string) (uint32, error) {
+	m, err := loadPinnedMap(filepath.Join(bpffsRoot, pinnedDir, bpfMapTracingTasks))
+	if err != nil {
+		return 0, err
+	}
+	defer m.Close()
+
+	return m.MaxEntries(), nil
+}
+
+// Resize replaces the pinned maps with new ones in maxEntries capacity.
+//
+// The maps can't be resized in place. The new program is loaded with the new
+// maps and attached before the entries are copied and the old program is
+// detached, so that there is no gap to lose the exit event. The exited events
+// recorded by the old program during the switch are copied again after the
+// old program is detached.
+//
+// NOTE: The task might exit after its tracing entry is read from the old map
+// but before the entry is copied into the new one. The final pass drops such
+// stale entries, otherwise they leak and fire a false exit when the pid is
+// reused.
+//
+// NOTE: The caller should not trace new task during resize and must Reload
+// the opened Store after that.
+func Resize(bpffsRoot string, maxEntries uint32) (retErr error) {
+	rootDir := filepath.Join(bpffsRoot, pinnedDir)
+
+	oldStore, err := NewStore(bpffsRoot)
+	if err != nil {
+		return err
+	}
+	defer oldStore.Close()
+
+	if maxEntries <= oldStore.tracingTasks.MaxEntries() {
+		return fmt.Errorf("max entries %d should be larger than current %d",
+			maxEntries, oldStore.tracingTasks.MaxEntries())
+	}
+
+	collection, err := newCollection(bpffsRoot, maxEntries)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		for _, m := range collection.Maps {
+			m.Close()
+		}
+		for _, p := range collection.Programs {
+			p.Close()
+		}
+	}()
+
+	newStore := &Store{
+		tracingTasks: collection.Maps[bpfMapTracingTasks],
+		exitedEvents: collection.Maps[bpfMapExitedEvents],
+	}
+
+	l, err := link.AttachRawTracepoint(link.RawTracepointOptions{
+		Name:    "sched_process_exit",
+		Program: collection.Programs[bpfProgName],
+	})
+	if err != nil {
+		return err
+	}
+	defer l.Close()
+
+	if err := copyTracingTasks(oldStore, newStore); err != nil {
+		return err
+	}
+	if err := copyExitedEvents(oldStore, newStore); err != nil {
+		return err
+	}
+
+	for _, pinnable := range []struct {
+		name string
+		obj  interface {
+			Pin(string) error
+		}
+	}{
+		{bpfMapTracingTasks, collection.Maps[bpfMapTracingTasks]},
+		{bpfMapExitedEvents, collection.Maps[bpfMapExitedEvents]},
+		{bpfProgName, l},
+	} {
+		target := filepath.Join(rootDir, pinnable.name)
+		tmp := target + pinnedTmpSuffix
+
+		if err := os.Remove(tmp); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		if err := pinnable.obj.Pin(tmp); err != nil {
+			return err
+		}
+
+		// NOTE: Replacing the pinned link drops the old link and
+		// detaches the old program.
+		if err := os.Rename(tmp, target); err != nil {
+			os.Remove(tmp)
+			return fmt.Errorf("failed to replace pinned %s: %w", pinnable.name, err)
+		}
+	}
+
+	// The old program might record the exit events before it is detached.
+	if err := copyExitedEvents(oldStore, newStore); err != nil {
+		return err
+	}
+	return pruneTracingTasks(newStore)
+}
+
+// Reload reopens the pinned maps after Resize.
+func (store *Store) Reload(bpffsRoot string) error {
+	reloaded, err := NewStore(bpffsRoot)
+	if err != nil {
+		return err
+	}
+
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	store.tracingTasks.Close()
+	store.exitedEvents.Close()
+
+	store.tracingTasks = reloaded.tracingTasks
+	store.exitedEvents = reloaded.exitedEvents
+	return nil
+}
+
+func newCollection(bpffsRoot string, maxEntries uint32) (*ebpf.Collection, error) {
+	spec, err := loadCollectionSpec(bpffsRoot)
+	if err != nil {
+		return nil, err
+	}
+
+	if maxEntries > 0 {
+		for _, name := range []string{bpfMapTracingTasks, bpfMapExitedEvents} {
+			spec.Maps[name].MaxEntries = maxEntries
+		}
+	}
+	return ebpf.NewCollection(spec)
+}
+
+func copyTracingTasks(src, dst *Store) error {
+	var (
+		pid  uint32
+		info TaskInfo
+	)
+
+	iter := src.tracingTasks.Iterate()
+	for iter.Next(&pid, &info) {
+		if err := dst.tracingTasks.Update(pid, &info, ebpf.UpdateNoExist); err != nil &&
+			!errors.Is(err, ebpf.ErrKeyExist) {
+			return fmt.Errorf("failed to copy tracing task %d: %w", pid, err)
+		}
+	}
+	return iter.Err()
+}
+
+// pruneTracingTasks drops the tracing entries whose task has exited, which
+// is the pid no longer existing or having the exited event.
+func pruneTracingTasks(store *Store) error {
+	var (
+		pid    uint32
+		info   TaskInfo
+		status ExitStatus
+		stale  []uint32
+	)
+
+	iter := store.tracingTasks.Iterate()
+	for iter.Next(&pid, &info) {
+		if err := store.exitedEvents.Lookup(info.TraceID, &status); err == nil {
+			stale = append(stale, pid)
+			continue
+		}
+		if _, err := os.Stat(filepath.Join("/proc", strconv.FormatUint(uint64(pid), 10))); os.IsNotExist(err) {
+			stale = append(stale, pid)
+		}
+	}
+	if err := iter.Err(); err != nil {
+		return err
+	}
+
+	for _, pid := range stale {
+		if err := store.tracingTasks.Delete(pid); err != nil && !errors.Is(err, ebpf.ErrKeyNotExist) {
+			return fmt.Errorf("failed to drop stale tracing task %d: %w", pid, err)
+		}
+	}
+	return nil
+}
+
+func copyExitedEvents(src, dst *Store) error {
+	var (
+		id     uint64
+		status ExitStatus
+	)
+
+	iter := src.exitedEvents.Iterate()
+	for iter.Next(&id, &status) {
+		if err := dst.exitedEvents.Update(id, &status, ebpf.UpdateNoExist); err != nil &&
+			!errors.Is(err, ebpf.ErrKeyExist) {
+			return fmt.Errorf("failed to copy exited event %d: %w", id, err)
+		}
+	}
+	return iter.Err()
+}
@@ -0,0 +1,87 @@
+package exitsnoop
+
+import (
+	"encoding/binary"
+	"os"
+	"os/exec"
+	"testing"
+
+	"github.com/cilium/ebpf"
+)
+
+func TestPruneTracingTasks(t *testing.T) {
+	store := newTestStore(t)
+	defer store.Close()
+
+	running := exec.Command("sleep", "1d")
+	if err := running.Start(); err != nil {
+		t.Fatalf("failed to start sleep command: %v", err)
+	}
+	defer func() {
+		running.Process.Kill()
+		running.Wait()
+	}()
+
+	exited := exec.Command("true")
+	if err := exited.Run(); err != nil {
+		t.Fatalf("failed to run true command: %v", err)
+	}
+
+	self := uint32(os.Getpid())
+	for pid, traceID := range map[uint32]uint64{
+		self:                              1,
+		uint32(running.Process.Pid):       2,
+		uint32(exited.ProcessState.Pid()): 3,
+	} {
+		if err := store.Trace(pid, &TaskInfo{TraceID: traceID}); err != nil {
+			t.Fatalf("failed to trace %d: %v", pid, err)
+		}
+	}
+
+	// the running task whose exit is recorded by the old program during
+	// resize
+	if err := store.ExitedEventFromWaitStatus(2, uint32(running.Process.Pid), 0); err != nil {
+		t.Fatalf("failed to record exited event: %v", err)
+	}
+
+	if err := pruneTracingTasks(store); err != nil {
+		t.Fatalf("failed to prune tracing tasks: %v", err)
+	}
+
+	if _, err := store.GetTracingTask(self); err != nil {
+		t.Fatalf("expected running task kept, but got %v", err)
+	}
+	for _, pid := range []uint32{uint32(running.Process.Pid), uint32(exited.ProcessState.Pid())} {
+		if _, err := store.GetTracingTask(pid); err == nil {
+			t.Fatalf("expected stale tracing task %d dropped, but got it", pid)
+		}
+	}
+}
+
+func newTestStore(t *testing.T) *Store {
+	tracingTasks, err := ebpf.NewMap(&ebpf.MapSpec{
+		Type:       ebpf.Hash,
+		KeySize:    4,
+		ValueSize:  uint32(binary.Size(TaskInfo{})),
+		MaxEntries: 16,
+	})
+	if err != nil {
+		t.Fatalf("failed to create tracing tasks map: %v", err)
+	}
+
+	exitedEvents, err := ebpf.NewMap(&ebpf.MapSpec{
+		Type:       ebpf.Hash,
+		KeySize:    8,
+		ValueSize:  uint32(binary.Size(ExitStatus{})),
+		MaxEntries: 16,
+	})
+	if err != nil {
+		tracingTasks.Close()
+		t.Fatalf("failed to create exited events map: %v", err)
+	}
+
+	return &Store{
+		tracingTasks: tracingTasks,
+		exitedEvents: exitedEvents,
+	}
+}
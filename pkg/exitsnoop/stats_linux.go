@@ -0,0 +1,95 @@
+package exitsnoop
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"path/filepath"
+
+	"github.com/cilium/ebpf"
+	"github.com/cilium/ebpf/link"
+	"golang.org/x/sys/unix"
+)
+
+// EnableStats enables the BPF programs' runtime statistics until the returned
+// closer is closed.
+func EnableStats() (io.Closer, error) {
+	return ebpf.EnableStats(uint32(unix.BPF_STATS_RUN_TIME))
+}
+
+// LoadProgramStats returns the statistics of the pinned exitsnoop program.
+func LoadProgramStats(bpffsRoot string) (*ProgramStats, error) {
+	l, err := link.LoadPinnedLink(filepath.Join(bpffsRoot, pinnedDir, bpfProgName), nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load pinned link: %w", err)
+	}
+	defer l.Close()
+
+	linfo, err := l.Info()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get link info: %w", err)
+	}
+
+	prog, err := ebpf.NewProgramFromID(linfo.Program)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load program %v: %w", linfo.Program, err)
+	}
+	defer prog.Close()
+
+	pinfo, err := prog.Info()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get program info: %w", err)
+	}
+
+	stats := &ProgramStats{}
+	stats.RunCount, _ = pinfo.RunCount()
+	stats.RunTime, _ = pinfo.Runtime()
+	return stats, nil
+}
+
+// MapStats returns the occupancy of the tracing tasks and exited events maps.
+func (store *Store) MapStats() ([]MapStats, error) {
+	store.mu.RLock()
+	defer store.mu.RUnlock()
+
+	stats := make([]MapStats, 0, 2)
+	for _, m := range []struct {
+		name string
+		m    *ebpf.Map
+	}{
+		{bpfMapTracingTasks, store.tracingTasks},
+		{bpfMapExitedEvents, store.exitedEvents},
+	} {
+		n, err := countEntries(m.m)
+		if err != nil {
+			return nil, fmt.Errorf("failed to count entries of %s: %w", m.name, err)
+		}
+
+		stats = append(stats, MapStats{
+			Name:       m.name,
+			Entries:    n,
+			MaxEntries: m.m.MaxEntries(),
+		})
+	}
+	return stats, nil
+}
+
+func countEntries(m *ebpf.Map) (uint32, error) {
+	var (
+		n    uint32
+		key  []byte
+		next = make([]byte, m.KeySize())
+	)
+
+	for {
+		if err := m.NextKey(key, next); err != nil {
+			if errors.Is(err, ebpf.ErrKeyNotExist) {
+				return n, nil
+			}
+			return 0, err
+		}
+		n++
+
+		key = append(key[:0], next...)
+	}
+}
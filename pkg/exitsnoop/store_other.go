@@ -0,0 +1,161 @@
+//go:build !linux
+// +build !linux
+
+package exitsnoop
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+
+	"github.com/cilium/ebpf"
+)
+
+// ErrNotSupported is returned by the functions which require the eBPF
+// program on the platform without it.
+var ErrNotSupported = errors.New("exitsnoop is only supported on linux")
+
+// Store keeps the tracing tasks and exited events in memory on the platform
+// without eBPF. Nothing records the exited event automatically, so that the
+// event is only recorded by ExitedEventFromWaitStatus, which is called by
+// the process's reaper.
+type Store struct {
+	mu sync.Mutex
+
+	tracingTasks map[uint32]TaskInfo
+	exitedEvents map[uint64]ExitStatus
+}
+
+func newStore() *Store {
+	return &Store{
+		tracingTasks: make(map[uint32]TaskInfo),
+		exitedEvents: make(map[uint64]ExitStatus),
+	}
+}
+
+// NewStore returns the in-memory store. The bpffsRoot is ignored.
+func NewStore(bpffsRoot string) (*Store, error) {
+	return newStore(), nil
+}
+
+// NewStoreFromAttach returns the in-memory store.
+func NewStoreFromAttach() (*Store, error) {
+	return newStore(), nil
+}
+
+// EnsureRunning is no-op since there is no program to pin.
+func EnsureRunning(bpffsRoot string, maxEntries uint32) error {
+	return nil
+}
+
+func MapMaxEntries(bpffsRoot string) (uint32, error) {
+	return 0, ErrNotSupported
+}
+
+func Resize(bpffsRoot string, maxEntries uint32) error {
+	return ErrNotSupported
+}
+
+func Upgrade(bpffsRoot string, objPath string) error {
+	return ErrNotSupported
+}
+
+func EnableStats() (io.Closer, error) {
+	return nil, ErrNotSupported
+}
+
+func LoadProgramStats(bpffsRoot string) (*ProgramStats, error) {
+	return nil, ErrNotSupported
+}
+
+// NOTE: The missing key is reported as ebpf.ErrKeyNotExist, like the eBPF
+// map, so that the callers don't need to care about the platform.
+
+func (store *Store) Trace(pid uint32, taskInfo *TaskInfo) error {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	if _, ok := store.tracingTasks[pid]; ok {
+		return ebpf.ErrKeyExist
+	}
+	store.tracingTasks[pid] = *taskInfo
+	return nil
+}
+
+func (store *Store) GetTracingTask(pid uint32) (*TaskInfo, error) {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	info, ok := store.tracingTasks[pid]
+	if !ok {
+		return nil, fmt.Errorf("failed to get task with given pid %v: %w", pid, ebpf.ErrKeyNotExist)
+	}
+	return &info, nil
+}
+
+func (store *Store) DeleteTracingTask(pid uint32) error {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	if _, ok := store.tracingTasks[pid]; !ok {
+		return ebpf.ErrKeyNotExist
+	}
+	delete(store.tracingTasks, pid)
+	return nil
+}
+
+func (store *Store) ExitedEventFromWaitStatus(traceEventID uint64, pid uint32, status uint32) error {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	if _, ok := store.exitedEvents[traceEventID]; ok {
+		return ebpf.ErrKeyExist
+	}
+	store.exitedEvents[traceEventID] = ExitStatus{
+		Pid:      pid,
+		ExitCode: int32(status),
+	}
+	return nil
+}
+
+func (store *Store) GetExitedEvent(traceEventID uint64) (*ExitStatus, error) {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	info, ok := store.exitedEvents[traceEventID]
+	if !ok {
+		return nil, fmt.Errorf("failed to get task exited status with given id %v: %w", traceEventID, ebpf.ErrKeyNotExist)
+	}
+	return &info, nil
+}
+
+func (store *Store) DeleteExitedEvent(traceEventID uint64) error {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	if _, ok := store.exitedEvents[traceEventID]; !ok {
+		return ebpf.ErrKeyNotExist
+	}
+	delete(store.exitedEvents, traceEventID)
+	return nil
+}
+
+// Reload is no-op since the store is never resized.
+func (store *Store) Reload(bpffsRoot string) error {
+	return nil
+}
+
+func (store *Store) MapStats() ([]MapStats, error) {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	return []MapStats{
+		{Name: "tracing_tasks", Entries: uint32(len(store.tracingTasks))},
+		{Name: "exited_events", Entries: uint32(len(store.exitedEvents))},
+	}, nil
+}
+
+func (store *Store) Close() error {
+	return nil
+}
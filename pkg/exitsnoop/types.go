@@ -0,0 +1,42 @@
+package exitsnoop
+
+import (
+	"time"
+)
+
+// TaskInfo is used to trace the target task.
+type TaskInfo struct {
+	// TraceID is allocated by userspace to identity the pid of task.
+	TraceID uint64
+	// PidnsInfo is used to check the pid namespace.
+	PidnsInfo PidnsInfo
+}
+
+type PidnsInfo struct {
+	Dev uint64
+	Ino uint64
+}
+
+// ExitStatus is used to record the exit event when the target task exits.
+type ExitStatus struct {
+	Pid           uint32
+	ExitCode      int32
+	StartBoottime uint64
+	ExittedTime   uint64
+}
+
+// ProgramStats is the runtime statistics of the pinned exitsnoop program.
+//
+// NOTE: The kernel only accounts them if kernel.bpf_stats_enabled sysctl is
+// set or EnableStats has been called.
+type ProgramStats struct {
+	RunCount uint64
+	RunTime  time.Duration
+}
+
+// MapStats is the occupancy of the map.
+type MapStats struct {
+	Name       string
+	Entries    uint32
+	MaxEntries uint32
+}
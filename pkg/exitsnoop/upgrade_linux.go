@@ -0,0 +1,148 @@
+package exitsnoop
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/cilium/ebpf"
+	"github.com/cilium/ebpf/link"
+)
+
+// programObjectFile is the BPF object installed by Upgrade. It takes
+// precedence over the embedded one so that the upgraded program is still
+// used after the maps are resized or re-pinned. It is stored next to pinned
+// directory because bpffs doesn't support regular file.
+var programObjectFile = ".exitsnoop.bpf.o"
+
+// loadCollectionSpec loads the installed BPF object if any. Otherwise, the
+// embedded one is used.
+func loadCollectionSpec(bpffsRoot string) (*ebpf.CollectionSpec, error) {
+	byteCode, err := os.ReadFile(filepath.Join(bpffsRoot, programObjectFile))
+	if err != nil {
+		if !os.IsNotExist(err) {
+			return nil, err
+		}
+		byteCode = progByteCode
+	}
+	return ebpf.LoadCollectionSpecFromReader(bytes.NewReader(byteCode))
+}
+
+// Upgrade replaces the attached program with the one in the BPF object in
+// place. The new program reuses the pinned maps so that the tracing tasks and
+// exited events are kept. It is attached before the old one is detached, so
+// that there is no gap to lose the exit event.
+//
+// The object must have the same maps as the current one. Empty objPath means
+// the embedded object, which is used to roll back.
+func Upgrade(bpffsRoot string, objPath string) (retErr error) {
+	byteCode := progByteCode
+	if objPath != "" {
+		data, err := os.ReadFile(objPath)
+		if err != nil {
+			return err
+		}
+		byteCode = data
+	}
+
+	spec, err := ebpf.LoadCollectionSpecFromReader(bytes.NewReader(byteCode))
+	if err != nil {
+		return fmt.Errorf("failed to load BPF object: %w", err)
+	}
+	if _, ok := spec.Programs[bpfProgName]; !ok {
+		return fmt.Errorf("program %s not found in BPF object", bpfProgName)
+	}
+
+	store, err := NewStore(bpffsRoot)
+	if err != nil {
+		return err
+	}
+	defer store.Close()
+
+	replacements := make(map[string]*ebpf.Map)
+	defer func() {
+		for _, m := range replacements {
+			m.Close()
+		}
+	}()
+
+	for name, m := range map[string]*ebpf.Map{
+		bpfMapTracingTasks: store.tracingTasks,
+		bpfMapExitedEvents: store.exitedEvents,
+	} {
+		ms, ok := spec.Maps[name]
+		if !ok {
+			return fmt.Errorf("map %s not found in BPF object", name)
+		}
+		// NOTE: The pinned maps might be resized.
+		ms.MaxEntries = m.MaxEntries()
+
+		clone, err := m.Clone()
+		if err != nil {
+			return err
+		}
+		replacements[name] = clone
+	}
+
+	collection, err := ebpf.NewCollectionWithOptions(spec, ebpf.CollectionOptions{
+		MapReplacements: replacements,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to load BPF object with pinned maps: %w", err)
+	}
+	defer collection.Close()
+
+	l, err := link.AttachRawTracepoint(link.RawTracepointOptions{
+		Name:    "sched_process_exit",
+		Program: collection.Programs[bpfProgName],
+	})
+	if err != nil {
+		return err
+	}
+	defer l.Close()
+
+	if err := installProgramObject(bpffsRoot, objPath, byteCode); err != nil {
+		return err
+	}
+
+	target := filepath.Join(bpffsRoot, pinnedDir, bpfProgName)
+	tmp := target + pinnedTmpSuffix
+
+	if err := os.Remove(tmp); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if err := l.Pin(tmp); err != nil {
+		return err
+	}
+
+	// NOTE: Replacing the pinned link drops the old link and detaches the
+	// old program.
+	if err := os.Rename(tmp, target); err != nil {
+		os.Remove(tmp)
+		return fmt.Errorf("failed to replace pinned %s: %w", bpfProgName, err)
+	}
+	return nil
+}
+
+// installProgramObject stores the BPF object for the later loading. The
+// installed object is removed if it is rolled back to the embedded one.
+func installProgramObject(bpffsRoot string, objPath string, byteCode []byte) error {
+	target := filepath.Join(bpffsRoot, programObjectFile)
+	if objPath == "" {
+		if err := os.Remove(target); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		return nil
+	}
+
+	tmp := target + pinnedTmpSuffix
+	if err := os.WriteFile(tmp, byteCode, 0600); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, target); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return nil
+}
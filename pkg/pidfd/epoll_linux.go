@@ -57,6 +57,25 @@ func (e *Epoller) Add(fd FD, onClose func() error) error {
 	return nil
 }
 
+// Remove stops monitoring the PID file descriptor and closes it without
+// calling the registered onClose.
+func (e *Epoller) Remove(fd FD) error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	if _, ok := e.fdOnCloses[fd]; !ok {
+		return fmt.Errorf("the pidfd %v is not exist", fd)
+	}
+
+	if err := unix.EpollCtl(e.efd, unix.EPOLL_CTL_DEL, int(fd), &unix.EpollEvent{}); err != nil {
+		return fmt.Errorf("failed to remove pidfd from interest list: %w", err)
+	}
+
+	delete(e.fdOnCloses, fd)
+	unix.Close(int(fd))
+	return nil
+}
+
 // Run starts to monitor the event on PID file descriptor.
 func (e *Epoller) Run() error {
 	events := make([]unix.EpollEvent, maxEvents)
@@ -76,14 +95,20 @@ func (e *Epoller) Run() error {
 		for i := 0; i < n; i++ {
 			fd := FD(events[i].Fd)
 
+			e.mu.Lock()
+
+			onClose, ok := e.fdOnCloses[fd]
+			if !ok {
+				// It has been removed by Remove.
+				e.mu.Unlock()
+				continue
+			}
+
 			err := unix.EpollCtl(e.efd, unix.EPOLL_CTL_DEL, int(fd), &unix.EpollEvent{})
 			if err != nil {
+				e.mu.Unlock()
 				return fmt.Errorf("failed to remove pidfd from interest list: %w", err)
 			}
-
-			e.mu.Lock()
-
-			onClose := e.fdOnCloses[fd]
 			delete(e.fdOnCloses, fd)
 
 			e.mu.Unlock()
@@ -0,0 +1,145 @@
+//go:build !linux
+// +build !linux
+
+package pidfd
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// PPIDFD is the first argument to waitid for pidfd.
+const PPIDFD int = 3
+
+// Siginfo is the same as the linux one, so that the callers build.
+type Siginfo struct {
+	Signo int32
+	Errno int32
+	Code  int32
+	_     int32
+	Pid   uint32
+	_     [108]byte
+}
+
+type Rusage = unix.Rusage
+
+// FD is the pid itself on the platform without pidfd.
+//
+// NOTE: The pid might be reused after the process exits, so that the FD is
+// only reliable while the process is alive.
+type FD int
+
+// Open checks the process is alive and returns its pid as FD.
+func Open(pid uint32, flags int) (FD, error) {
+	if err := unix.Kill(int(pid), 0); err != nil && err != unix.EPERM {
+		return 0, err
+	}
+	return FD(pid), nil
+}
+
+// SendSignal sends a signal to the process by kill(2).
+func (fd FD) SendSignal(signal unix.Signal, flags int) error {
+	return unix.Kill(int(fd), signal)
+}
+
+// Waitid isn't supported since the process isn't the caller's child.
+func (fd FD) Waitid(info *Siginfo, options int, rusage *Rusage) error {
+	return unix.ENOSYS
+}
+
+// GetFd isn't supported.
+func (fd FD) GetFd(targetFD int, flags int) (int, error) {
+	return -1, unix.ENOSYS
+}
+
+type pidOnClose func() error
+
+// pollInterval is how often the Epoller checks the processes.
+var pollInterval = 100 * time.Millisecond
+
+// Epoller is the process-wait monitor on the platform without pidfd. It
+// polls the processes by kill(pid, 0) and calls the callback after the
+// process is gone.
+//
+// NOTE: The zombie process is still alive for kill(2) until its parent
+// reaps it.
+type Epoller struct {
+	mu         sync.Mutex
+	done       chan struct{}
+	closeOnce  sync.Once
+	fdOnCloses map[FD]pidOnClose
+}
+
+func NewEpoller() (*Epoller, error) {
+	return &Epoller{
+		done:       make(chan struct{}),
+		fdOnCloses: make(map[FD]pidOnClose),
+	}, nil
+}
+
+// Add monitors the process and registers the onClose for it.
+func (e *Epoller) Add(fd FD, onClose func() error) error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	if _, ok := e.fdOnCloses[fd]; ok {
+		return fmt.Errorf("the pidfd %v is exist", fd)
+	}
+
+	e.fdOnCloses[fd] = onClose
+	return nil
+}
+
+// Remove stops monitoring the process without calling the registered
+// onClose.
+func (e *Epoller) Remove(fd FD) error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	if _, ok := e.fdOnCloses[fd]; !ok {
+		return fmt.Errorf("the pidfd %v is not exist", fd)
+	}
+
+	delete(e.fdOnCloses, fd)
+	return nil
+}
+
+// Run starts to poll the processes until Close.
+func (e *Epoller) Run() error {
+	ticker := time.NewTicker(pollInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-e.done:
+			return nil
+		case <-ticker.C:
+		}
+
+		var exited []pidOnClose
+
+		e.mu.Lock()
+		for fd, onClose := range e.fdOnCloses {
+			if err := unix.Kill(int(fd), 0); err == unix.ESRCH {
+				delete(e.fdOnCloses, fd)
+				exited = append(exited, onClose)
+			}
+		}
+		e.mu.Unlock()
+
+		for _, onClose := range exited {
+			onClose()
+		}
+	}
+}
+
+// Close stops the monitor.
+func (e *Epoller) Close() error {
+	e.closeOnce.Do(func() {
+		close(e.done)
+	})
+	return nil
+}
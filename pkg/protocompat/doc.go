@@ -0,0 +1,12 @@
+// Package protocompat converts the protobuf types between gogo/protobuf and
+// the maintained google.golang.org/protobuf.
+//
+// embedshim's own API, like AdoptOpts and SpecDigest, takes anypb.Any so
+// that the embedders on the containerd 1.7+ or 2.x trees can pass their
+// types without gogo. The task manager itself still implements containerd
+// 1.5's runtime.PlatformRuntime, whose methods take and return gogo's
+// types.Any, so that the root package keeps depending on gogo.
+//
+// The conversions are in gogo.go, which is excluded by the no_gogo build
+// tag. This package is gogo-free with the tag.
+package protocompat
@@ -0,0 +1,34 @@
+//go:build !no_gogo
+// +build !no_gogo
+
+package protocompat
+
+import (
+	gogotypes "github.com/gogo/protobuf/types"
+	"google.golang.org/protobuf/types/known/anypb"
+)
+
+// ToGogo converts the maintained protobuf's Any into gogo's Any, which is
+// used by containerd 1.5's runtime interfaces. The value is copied, and nil
+// is returned for nil.
+func ToGogo(a *anypb.Any) *gogotypes.Any {
+	if a == nil {
+		return nil
+	}
+	return &gogotypes.Any{
+		TypeUrl: a.GetTypeUrl(),
+		Value:   append([]byte(nil), a.GetValue()...),
+	}
+}
+
+// FromGogo converts gogo's Any into the maintained protobuf's Any. The value
+// is copied, and nil is returned for nil.
+func FromGogo(a *gogotypes.Any) *anypb.Any {
+	if a == nil {
+		return nil
+	}
+	return &anypb.Any{
+		TypeUrl: a.TypeUrl,
+		Value:   append([]byte(nil), a.Value...),
+	}
+}
@@ -0,0 +1,34 @@
+//go:build !no_gogo
+// +build !no_gogo
+
+package protocompat
+
+import (
+	"testing"
+
+	gogotypes "github.com/gogo/protobuf/types"
+)
+
+func TestGogoRoundTrip(t *testing.T) {
+	if ToGogo(nil) != nil || FromGogo(nil) != nil {
+		t.Fatalf("expected nil for nil")
+	}
+
+	ga := &gogotypes.Any{TypeUrl: "types.containerd.io/opencontainers/runtime-spec/1/LinuxResources", Value: []byte(`{}`)}
+
+	a := FromGogo(ga)
+	if a.GetTypeUrl() != ga.TypeUrl {
+		t.Fatalf("expected %v, but got %v", ga.TypeUrl, a.GetTypeUrl())
+	}
+
+	// the value is copied
+	a.Value[0] = '['
+	if ga.Value[0] != '{' {
+		t.Fatalf("expected value copied, but got %s", ga.Value)
+	}
+
+	got := ToGogo(a)
+	if got.TypeUrl != ga.TypeUrl || string(got.Value) != `[}` {
+		t.Fatalf("expected %v, but got %v", a, got)
+	}
+}
@@ -1,3 +1,6 @@
+//go:build linux
+// +build linux
+
 /*
    Copyright The containerd Authors.
 
@@ -46,6 +49,12 @@ type linuxPlatform struct {
 }
 
 func (p *linuxPlatform) CopyConsole(ctx context.Context, console console.Console, _, stdin, stdout, _ string, wg *sync.WaitGroup) (cons console.Console, retErr error) {
+	return p.copyConsole(ctx, console, stdin, stdout, nil, wg)
+}
+
+// copyConsole copies the console and records the session into rec if it
+// isn't nil. The rec is closed after the output copy is done.
+func (p *linuxPlatform) copyConsole(ctx context.Context, console console.Console, stdin, stdout string, rec *sessionRecorder, wg *sync.WaitGroup) (cons console.Console, retErr error) {
 	if p.epoller == nil {
 		return nil, fmt.Errorf("uninitialized epoller")
 	}
@@ -62,12 +71,19 @@ func (p *linuxPlatform) CopyConsole(ctx context.Context, console console.Console
 			return nil, err
 		}
 
+		var src io.Reader = in
+		if rec != nil {
+			if w := rec.input(); w != nil {
+				src = io.TeeReader(in, w)
+			}
+		}
+
 		cwg.Add(1)
 		go func() {
 			cwg.Done()
 			bp := bufPool.Get().(*[]byte)
 			defer bufPool.Put(bp)
-			io.CopyBuffer(epollConsole, in, *bp)
+			io.CopyBuffer(epollConsole, src, *bp)
 			// we need to shutdown epollConsole when pipe broken
 			epollConsole.Shutdown(p.epoller.CloseConsole)
 			epollConsole.Close()
@@ -79,15 +95,21 @@ func (p *linuxPlatform) CopyConsole(ctx context.Context, console console.Console
 		return nil, err
 	}
 
+	var dst io.Writer = out
+	if rec != nil {
+		dst = io.MultiWriter(out, rec.output())
+	}
+
 	wg.Add(1)
 	cwg.Add(1)
 	go func() {
 		cwg.Done()
 		buf := bufPool.Get().(*[]byte)
 		defer bufPool.Put(buf)
-		io.CopyBuffer(out, epollConsole, *buf)
+		io.CopyBuffer(dst, epollConsole, *buf)
 
 		out.Close()
+		rec.close()
 		wg.Done()
 	}()
 	cwg.Wait()
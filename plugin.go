@@ -1,24 +1,34 @@
+//go:build linux
+// +build linux
+
 package embedshim
 
 import (
 	"context"
+	"encoding/json"
 	"fmt"
+	"io"
 	"os"
 
 	pkgbundle "github.com/fuweid/embedshim/pkg/bundle"
 	"github.com/fuweid/embedshim/pkg/exitsnoop"
 
+	eventstypes "github.com/containerd/containerd/api/events"
 	"github.com/containerd/containerd/containers"
+	"github.com/containerd/containerd/content"
 	"github.com/containerd/containerd/events/exchange"
 	"github.com/containerd/containerd/identifiers"
+	"github.com/containerd/containerd/log"
 	"github.com/containerd/containerd/metadata"
 	"github.com/containerd/containerd/namespaces"
 	"github.com/containerd/containerd/platforms"
 	"github.com/containerd/containerd/plugin"
 	"github.com/containerd/containerd/runtime"
 	"github.com/containerd/containerd/runtime/v2/runc/options"
+	"github.com/containerd/containerd/snapshots"
 	"github.com/containerd/typeurl"
 	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/opencontainers/runtime-spec/specs-go"
 	"github.com/pkg/errors"
 )
 
@@ -28,7 +38,106 @@ var (
 	traceEventIDDBName = "trace_event_id.db"
 )
 
-type Config struct{}
+// Config is the configuration of embedshim plugin.
+type Config struct {
+	// AdmissionCheck verifies the host can satisfy the task's spec, like
+	// memory limit, devices and cgroup controllers, before creating task.
+	AdmissionCheck bool `toml:"admission_check"`
+
+	// CoreDump collects the core files of the crashed processes.
+	CoreDump CoreDumpConfig `toml:"core_dump"`
+
+	// BundleDriftDetection watches the task's bundle files and publishes
+	// TaskBundleDrift event if they are modified externally.
+	BundleDriftDetection bool `toml:"bundle_drift_detection"`
+
+	// BPFStats enables the BPF programs' runtime statistics, which are
+	// exported as metrics. It has slight overhead on each program run.
+	BPFStats bool `toml:"bpf_stats"`
+
+	// MaxContainers is the expected max number of tasks, which is used to
+	// size the exitsnoop maps with headroom.
+	MaxContainers uint32 `toml:"max_containers"`
+
+	// MapResizeThreshold is the fill ratio of exitsnoop maps which
+	// triggers growing them. The default is 0.8.
+	MapResizeThreshold float64 `toml:"map_resize_threshold"`
+
+	// IdentityEvents publishes TaskIdentity event with the container's
+	// cgroup path and pid namespace inode after each lifecycle event.
+	IdentityEvents bool `toml:"identity_events"`
+
+	// StatusPersistInterval is the interval to persist the tasks' status
+	// records, like "10s". The record is also persisted on every state
+	// transition.
+	StatusPersistInterval string `toml:"status_persist_interval"`
+
+	// ExitEventBatch publishes the TaskExit events in TaskExitBatch event
+	// to reduce the overhead during mass container churn. The TaskIdentity
+	// event following TaskExit doesn't wait for the batch.
+	ExitEventBatch ExitEventBatchConfig `toml:"exit_event_batch"`
+
+	// EnvPolicy strips the environment variables of init and exec
+	// processes, like the proxy settings leaked from host.
+	EnvPolicy EnvPolicyConfig `toml:"env_policy"`
+
+	// SpecValidation validates the OCI spec before creating task and
+	// returns all the problems in one SpecValidationError, instead of the
+	// OCI runtime's first error.
+	SpecValidation bool `toml:"spec_validation"`
+
+	// MaxConcurrentExecStarts is the max number of exec processes being
+	// started at the same time. The others wait for the slot. The zero
+	// means unlimited.
+	MaxConcurrentExecStarts int `toml:"max_concurrent_exec_starts"`
+
+	// SeccompAudit publishes the seccomp audit records of the tasks'
+	// processes as TaskSeccompAudit events, like SCMP_ACT_LOG.
+	SeccompAudit SeccompAuditConfig `toml:"seccomp_audit"`
+
+	// StartRetry retries the OCI runtime's start on transient failures.
+	StartRetry StartRetryConfig `toml:"start_retry"`
+
+	// SessionRecording records the terminal sessions of the init and exec
+	// processes for audit and postmortem replay.
+	SessionRecording SessionRecordingConfig `toml:"session_recording"`
+
+	// ExitRecords keeps the historical exit records which can be queried
+	// by ExitRecords API.
+	ExitRecords ExitRecordsConfig `toml:"exit_records"`
+
+	// Webhook allows the tasks to send the lifecycle webhooks defined by
+	// annotations.
+	Webhook WebhookConfig `toml:"webhook"`
+
+	// OperationLimits bounds the concurrent create, start and delete
+	// operations to keep the tail latency bounded under pod storms.
+	OperationLimits OperationLimitsConfig `toml:"operation_limits"`
+
+	// Reconcile periodically corrects the tasks whose internal state
+	// disagrees with the OCI runtime and cgroup, like the lost exit.
+	Reconcile ReconcileConfig `toml:"reconcile"`
+
+	// MountPropagation is the default propagation of the rootfs and bind
+	// mounts which don't specify it, and the policy of shared propagation.
+	MountPropagation MountPropagationConfig `toml:"mount_propagation"`
+
+	// SysctlPolicy rejects the unsafe sysctls which aren't allowed. The
+	// sysctls are always checked against the container's namespaces.
+	SysctlPolicy SysctlPolicyConfig `toml:"sysctl_policy"`
+
+	// InitInjection injects the minimal init as the container's pid 1 to
+	// reap the zombies, like `docker run --init`.
+	InitInjection InitInjectionConfig `toml:"init_injection"`
+
+	// StoppingExec is the exec behavior after the task is signaled to stop
+	// but before it exits, which is "allow" (default) or "reject".
+	StoppingExec StoppingExecPolicy `toml:"stopping_exec"`
+
+	// Resume restores the tasks dumped by CheckpointAll on plugin start,
+	// like after the node reboots.
+	Resume ResumeConfig `toml:"resume"`
+}
 
 func init() {
 	plugin.Register(&plugin.Registration{
@@ -60,14 +169,32 @@ func New(ic *plugin.InitContext) (interface{}, error) {
 	}
 
 	cfg := ic.Config.(*Config)
+
+	caps := detectCapabilities()
+	for k, v := range caps.Exports() {
+		ic.Meta.Exports[k] = v
+	}
+	if err := writeCapabilities(ic.Root, caps); err != nil {
+		return nil, err
+	}
+	if err := caps.Supported(); err != nil {
+		return nil, fmt.Errorf("refuse to load embedshim: %w", err)
+	}
+	degradeConfig(cfg, caps)
 	tm := &TaskManager{
-		rootDir:    ic.Root,
-		stateDir:   ic.State,
-		tasks:      runtime.NewTaskList(),
-		containers: metadata.NewContainerStore(m.(*metadata.DB)),
-		events:     ic.Events,
-		config:     cfg,
+		rootDir:      ic.Root,
+		stateDir:     ic.State,
+		tasks:        runtime.NewTaskList(),
+		containers:   metadata.NewContainerStore(m.(*metadata.DB)),
+		contentStore: m.(*metadata.DB).ContentStore(),
+		snapshotter:  m.(*metadata.DB).Snapshotter,
+		events:       ic.Events,
+		config:       cfg,
+		caps:         caps,
 	}
+	tm.exitBatcher = newExitEventBatcher(cfg.ExitEventBatch, tm.publishEvent)
+	tm.execStarts = newExecStartLimiter(cfg.MaxConcurrentExecStarts)
+	tm.opLimits = newOperationLimiters(cfg.OperationLimits)
 
 	if err := tm.init(); err != nil {
 		return nil, err
@@ -75,6 +202,29 @@ func New(ic *plugin.InitContext) (interface{}, error) {
 	if err := tm.reloadExistingTasks(context.TODO()); err != nil {
 		return nil, err
 	}
+	tm.scheduleHeldNamespacesRelease()
+	tm.registerMetrics()
+
+	go tm.autoResizeMaps()
+	go tm.persistStatusPeriodically()
+	if cfg.SeccompAudit.Enabled {
+		go tm.collectSeccompAudit(cfg.SeccompAudit)
+	}
+	if tm.exitRecords != nil {
+		go tm.pruneExitRecordsPeriodically()
+	}
+	if cfg.Reconcile.Enabled {
+		tm.reconciler = newTaskReconciler()
+		go tm.reconcilePeriodically()
+	}
+	if cfg.Resume.ManifestDir != "" {
+		go func() {
+			ctx := context.Background()
+			if err := tm.resumeFromManifest(ctx, cfg.Resume); err != nil {
+				log.G(ctx).WithError(err).Errorf("failed to resume tasks from %s", cfg.Resume.ManifestDir)
+			}
+		}()
+	}
 	return tm, nil
 }
 
@@ -82,6 +232,7 @@ type TaskManager struct {
 	rootDir  string
 	stateDir string
 	config   *Config
+	caps     *Capabilities
 
 	tasks      *runtime.TaskList
 	containers containers.Store
@@ -89,6 +240,22 @@ type TaskManager struct {
 
 	idAlloc *idAllocator
 	monitor *monitor
+
+	contentStore  content.Store
+	bundleWatcher *bundleWatcher
+	bpfStats      io.Closer
+	cgroupIDs     cgroupIDIndex
+	exitBatcher   *exitEventBatcher
+	execStarts    execStartLimiter
+	exitRecords   *exitRecordStore
+	exitNotifiers exitNotifierSet
+	killFallbacks killAllFallbackStats
+	opLimits      operationLimiters
+	reconciler    *taskReconciler
+
+	// snapshotter returns the snapshotter by name, which provides the
+	// rootfs of the resumed tasks.
+	snapshotter func(name string) snapshots.Snapshotter
 }
 
 func (*TaskManager) ID() string {
@@ -105,6 +272,77 @@ func (manager *TaskManager) Create(ctx context.Context, id string, opts runtime.
 		return nil, err
 	}
 
+	if err := manager.opLimits.create.acquire(ctx, ns); err != nil {
+		return nil, err
+	}
+	defer manager.opLimits.create.release()
+
+	if err := manager.validateStdinSource(ns, opts.IO.Stdin, opts.IO.Terminal); err != nil {
+		return nil, err
+	}
+
+	container, err := manager.containers.Get(ctx, id)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get container %s: %w", id, err)
+	}
+	fillCreateOptsFromContainer(container, &opts)
+
+	overrides, err := initOverridesFromCreateOpts(opts)
+	if err != nil {
+		return nil, err
+	}
+
+	opts.Spec, err = applyInitOverrides(opts.Spec, overrides)
+	if err != nil {
+		return nil, err
+	}
+
+	opts.Spec, err = manager.sanitizeInitSpecEnv(ctx, id, opts.Spec)
+	if err != nil {
+		return nil, err
+	}
+
+	opts.Spec, err = applyInitUserOverride(opts.Spec)
+	if err != nil {
+		return nil, err
+	}
+
+	opts.Spec, err = applyDeviceOwnership(opts.Spec)
+	if err != nil {
+		return nil, err
+	}
+
+	opts.Spec, err = applyMountPropagation(opts.Spec, manager.config.MountPropagation)
+	if err != nil {
+		return nil, err
+	}
+
+	opts.Spec, err = applyInitInjection(opts.Spec, manager.config.InitInjection)
+	if err != nil {
+		return nil, err
+	}
+
+	var spec specs.Spec
+	if err := json.Unmarshal(opts.Spec.Value, &spec); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal spec: %w", err)
+	}
+
+	if manager.config.SpecValidation {
+		if err := validateSpec(&spec); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := validateSysctls(&spec, manager.config.SysctlPolicy); err != nil {
+		return nil, err
+	}
+
+	if manager.config.AdmissionCheck {
+		if err := manager.admit(&spec); err != nil {
+			return nil, err
+		}
+	}
+
 	traceEventID, err := manager.nextTraceEventID()
 	if err != nil {
 		return nil, err
@@ -117,10 +355,12 @@ func (manager *TaskManager) Create(ctx context.Context, id string, opts runtime.
 
 	bundle, err := pkgbundle.NewBundle(manager.rootDir, manager.stateDir,
 		ns, id,
+		withBundleApplyFormatVersion(),
 		withBundleApplyInitOCISpec(opts.Spec),
 		withBundleApplyInitOptions(initOpts),
 		withBundleApplyInitStdio(opts.IO),
 		withBundleApplyInitTraceEventID(traceEventID),
+		withBundleApplyExternalCgroup(initOpts.SystemdCgroup),
 	)
 	if err != nil {
 		return nil, err
@@ -135,6 +375,7 @@ func (manager *TaskManager) Create(ctx context.Context, id string, opts runtime.
 	if err != nil {
 		return nil, err
 	}
+	s.labels = container.Labels
 
 	task, err := s.Create(ctx, opts)
 	if err != nil {
@@ -142,6 +383,20 @@ func (manager *TaskManager) Create(ctx context.Context, id string, opts runtime.
 	}
 
 	manager.tasks.Add(ctx, task)
+	manager.watchBundle(bundle)
+
+	s.publishTaskEvent(runtime.TaskCreateEventTopic, "", task.PID(), &eventstypes.TaskCreate{
+		ContainerID: id,
+		Bundle:      bundle.Path,
+		IO: &eventstypes.TaskIO{
+			Stdin:    opts.IO.Stdin,
+			Stdout:   opts.IO.Stdout,
+			Stderr:   opts.IO.Stderr,
+			Terminal: opts.IO.Terminal,
+		},
+		Checkpoint: opts.Checkpoint,
+		Pid:        task.PID(),
+	})
 	return task, nil
 }
 
@@ -162,7 +417,7 @@ func (manager *TaskManager) Tasks(ctx context.Context, all bool) ([]runtime.Task
 }
 
 func (manager *TaskManager) init() (retErr error) {
-	err := exitsnoop.EnsureRunning(manager.rootDir)
+	err := exitsnoop.EnsureRunning(manager.rootDir, manager.mapMaxEntries())
 	if err != nil {
 		return err
 	}
@@ -181,6 +436,34 @@ func (manager *TaskManager) init() (retErr error) {
 	if err != nil {
 		return err
 	}
+
+	if manager.config != nil && manager.config.ExitRecords.Enabled {
+		manager.exitRecords, err = newExitRecordStore(manager.rootDir, manager.config.ExitRecords)
+		if err != nil {
+			return err
+		}
+		defer func() {
+			if retErr != nil {
+				manager.exitRecords.close()
+			}
+		}()
+	}
+
+	if manager.config != nil && manager.config.BPFStats {
+		manager.bpfStats, err = exitsnoop.EnableStats()
+		if err != nil {
+			return fmt.Errorf("failed to enable bpf stats: %w", err)
+		}
+	}
+
+	if manager.config != nil && manager.config.BundleDriftDetection {
+		manager.bundleWatcher, err = newBundleWatcher(func(ns string, event *TaskBundleDrift) {
+			manager.publishEvent(ns, TaskBundleDriftEventTopic, event)
+		})
+		if err != nil {
+			return err
+		}
+	}
 	return nil
 }
 
@@ -213,8 +496,13 @@ func initOptionsFromCreateOpts(createOpts runtime.CreateOpts) (*options.Options,
 			return nil, err
 		}
 
-		if vopts, ok := v.(*options.Options); ok {
+		switch vopts := v.(type) {
+		case *options.Options:
 			initOpts = vopts
+		case *InitOverrides:
+			if vopts.Options != nil {
+				initOpts = vopts.Options
+			}
 		}
 	}
 	return initOpts, nil
@@ -0,0 +1,155 @@
+//go:build !linux
+// +build !linux
+
+package embedshim
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+
+	eventstypes "github.com/containerd/containerd/api/events"
+	"github.com/containerd/containerd/errdefs"
+	"github.com/containerd/containerd/events/exchange"
+	"github.com/containerd/containerd/identifiers"
+	"github.com/containerd/containerd/namespaces"
+	"github.com/containerd/containerd/platforms"
+	"github.com/containerd/containerd/plugin"
+	"github.com/containerd/containerd/runtime"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/opencontainers/runtime-spec/specs-go"
+	"github.com/pkg/errors"
+)
+
+var (
+	pluginID = fmt.Sprintf("%s.%s", plugin.RuntimePlugin, "embed")
+)
+
+// Config is empty on the platform without runc.
+type Config struct{}
+
+func init() {
+	plugin.Register(&plugin.Registration{
+		Type:   plugin.RuntimePlugin,
+		ID:     "embed",
+		InitFn: New,
+		Config: &Config{},
+	})
+}
+
+// New returns the task manager which runs the spec's process on the host
+// without isolation, and tracks its exit by the process-wait monitor. It's
+// only for development, like the embedders' unit tests on darwin.
+func New(ic *plugin.InitContext) (interface{}, error) {
+	if err := os.MkdirAll(ic.Root, 0700); err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(ic.State, 0700); err != nil {
+		return nil, err
+	}
+
+	ic.Meta.Platforms = []ocispec.Platform{
+		platforms.DefaultSpec(),
+	}
+	return newTaskManager(ic.Root, ic.State, ic.Events)
+}
+
+// TaskManager manages the tasks running as the plugin's children.
+type TaskManager struct {
+	rootDir  string
+	stateDir string
+
+	tasks   *runtime.TaskList
+	events  *exchange.Exchange
+	monitor *monitor
+
+	traceEventID uint64
+}
+
+func newTaskManager(rootDir, stateDir string, events *exchange.Exchange) (*TaskManager, error) {
+	m, err := newMonitor(stateDir)
+	if err != nil {
+		return nil, err
+	}
+
+	return &TaskManager{
+		rootDir:  rootDir,
+		stateDir: stateDir,
+		tasks:    runtime.NewTaskList(),
+		events:   events,
+		monitor:  m,
+	}, nil
+}
+
+func (*TaskManager) ID() string {
+	return pluginID
+}
+
+func (manager *TaskManager) Create(ctx context.Context, id string, opts runtime.CreateOpts) (runtime.Task, error) {
+	if err := identifiers.Validate(id); err != nil {
+		return nil, errors.Wrapf(err, "invalid task id %s", id)
+	}
+
+	ns, err := namespaces.NamespaceRequired(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	if opts.IO.Stdin != "" || opts.IO.Terminal {
+		return nil, fmt.Errorf("task with stdin or terminal: %w", errdefs.ErrNotImplemented)
+	}
+
+	if opts.Spec == nil {
+		return nil, fmt.Errorf("spec is empty: %w", errdefs.ErrInvalidArgument)
+	}
+
+	var spec specs.Spec
+	if err := json.Unmarshal(opts.Spec.Value, &spec); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal spec: %v: %w", err, errdefs.ErrInvalidArgument)
+	}
+	if spec.Process == nil || len(spec.Process.Args) == 0 {
+		return nil, fmt.Errorf("process.args is required: %w", errdefs.ErrInvalidArgument)
+	}
+
+	// The bundle is only the working dir of the process.
+	bundle := filepath.Join(manager.stateDir, ns, id)
+	if err := os.MkdirAll(bundle, 0700); err != nil {
+		return nil, err
+	}
+
+	t := newProcessTask(manager, ns, id, bundle, spec.Process, opts.IO,
+		atomic.AddUint64(&manager.traceEventID, 1))
+	if err := manager.tasks.Add(ctx, t); err != nil {
+		os.RemoveAll(bundle)
+		return nil, err
+	}
+
+	manager.publishEvent(ns, runtime.TaskCreateEventTopic, &eventstypes.TaskCreate{
+		ContainerID: id,
+		Bundle:      bundle,
+		IO: &eventstypes.TaskIO{
+			Stdout: opts.IO.Stdout,
+			Stderr: opts.IO.Stderr,
+		},
+	})
+	return t, nil
+}
+
+func (manager *TaskManager) Get(ctx context.Context, id string) (runtime.Task, error) {
+	return manager.tasks.Get(ctx, id)
+}
+
+func (manager *TaskManager) Tasks(ctx context.Context, all bool) ([]runtime.Task, error) {
+	return manager.tasks.GetAll(ctx, all)
+}
+
+func (manager *TaskManager) Add(ctx context.Context, task runtime.Task) error {
+	return manager.tasks.Add(ctx, task)
+}
+
+func (manager *TaskManager) Delete(ctx context.Context, id string) {
+	manager.tasks.Delete(ctx, id)
+}
@@ -0,0 +1,111 @@
+//go:build linux
+// +build linux
+
+package embedshim
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	goruntime "runtime"
+
+	"github.com/containerd/containerd/log"
+	"golang.org/x/sys/unix"
+)
+
+// PortForward connects to the port on the loopback of the container's
+// network namespace and proxies the stream, which backs the CRI streaming
+// port-forward without socat in the host. It returns when the container
+// side is closed or ctx is done. The caller owns the stream.
+func (manager *TaskManager) PortForward(ctx context.Context, id string, port uint16, stream io.ReadWriter) error {
+	nsFD, err := manager.openInitProcEntry(ctx, id, "ns/net", unix.O_RDONLY)
+	if err != nil {
+		return err
+	}
+	defer unix.Close(nsFD)
+
+	conn, err := dialInNetNS(ctx, nsFD, "tcp4", fmt.Sprintf("127.0.0.1:%d", port))
+	if err != nil {
+		log.G(ctx).WithError(err).Debugf("failed to connect to port %d over IPv4 in task %s, trying IPv6", port, id)
+
+		conn, err = dialInNetNS(ctx, nsFD, "tcp6", fmt.Sprintf("[::1]:%d", port))
+		if err != nil {
+			return fmt.Errorf("failed to connect to port %d in task %s: %w", port, id, err)
+		}
+	}
+	defer conn.Close()
+
+	return proxyStream(ctx, conn, stream)
+}
+
+// dialInNetNS creates the socket in the network namespace nsFD and connects
+// to the address. The socket keeps the namespace after the thread leaves.
+//
+// NOTE: The network namespace is per thread so that it is switched in the
+// locked thread. The thread is terminated with the goroutine instead of
+// being reused if it fails to switch back.
+func dialInNetNS(ctx context.Context, nsFD int, network, address string) (net.Conn, error) {
+	type result struct {
+		conn net.Conn
+		err  error
+	}
+
+	resCh := make(chan result, 1)
+	go func() {
+		goruntime.LockOSThread()
+
+		origin, err := unix.Open("/proc/thread-self/ns/net", unix.O_RDONLY|unix.O_CLOEXEC, 0)
+		if err != nil {
+			goruntime.UnlockOSThread()
+			resCh <- result{err: fmt.Errorf("failed to open current network namespace: %w", err)}
+			return
+		}
+		defer unix.Close(origin)
+
+		if err := unix.Setns(nsFD, unix.CLONE_NEWNET); err != nil {
+			goruntime.UnlockOSThread()
+			resCh <- result{err: fmt.Errorf("failed to enter network namespace: %w", err)}
+			return
+		}
+
+		var d net.Dialer
+		conn, err := d.DialContext(ctx, network, address)
+
+		if rerr := unix.Setns(origin, unix.CLONE_NEWNET); rerr == nil {
+			goruntime.UnlockOSThread()
+		} else {
+			log.G(ctx).WithError(rerr).Warn("failed to restore network namespace, the thread will be terminated")
+		}
+		resCh <- result{conn: conn, err: err}
+	}()
+
+	res := <-resCh
+	return res.conn, res.err
+}
+
+// proxyStream copies data in both directions. The write side of conn is
+// closed when the stream reaches EOF, and it returns when conn reaches EOF.
+func proxyStream(ctx context.Context, conn net.Conn, stream io.ReadWriter) error {
+	go func() {
+		if _, err := io.Copy(conn, stream); err != nil {
+			log.G(ctx).WithError(err).Debug("failed to copy stream into port-forward connection")
+		}
+		if tc, ok := conn.(*net.TCPConn); ok {
+			tc.CloseWrite()
+		}
+	}()
+
+	errCh := make(chan error, 1)
+	go func() {
+		_, err := io.Copy(stream, conn)
+		errCh <- err
+	}()
+
+	select {
+	case err := <-errCh:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
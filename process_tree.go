@@ -0,0 +1,183 @@
+//go:build linux
+// +build linux
+
+package embedshim
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/containerd/containerd/errdefs"
+)
+
+// ProcessTreeNode is the process in the container's process tree.
+type ProcessTreeNode struct {
+	// Pid is the process ID in the host's pid namespace.
+	Pid uint32
+	// NsPid is the process ID in the container's pid namespace. It is zero
+	// if the process isn't in the container's pid namespace.
+	NsPid uint32
+	// PPid is the parent process ID in the host's pid namespace.
+	PPid uint32
+	// Comm is the process's command name.
+	Comm string
+	// ExecID is the ID of the init or exec process which the process
+	// belongs to. It is empty if the process isn't forked by any of them,
+	// like the process joined the cgroup by others.
+	ExecID   string
+	Children []*ProcessTreeNode
+}
+
+// ProcessTree returns the task's processes in trees. The root is the process
+// whose parent isn't in the task's cgroup, like the init and exec processes.
+func (manager *TaskManager) ProcessTree(ctx context.Context, id string) ([]*ProcessTreeNode, error) {
+	t, err := manager.tasks.Get(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+
+	s, ok := t.(*shim)
+	if !ok {
+		return nil, errdefs.ErrNotImplemented
+	}
+	return s.processTree()
+}
+
+func (s *shim) processTree() ([]*ProcessTreeNode, error) {
+	pids, err := s.cgroupPids()
+	if err != nil {
+		return nil, fmt.Errorf("failed to list processes of task %s: %w", s.ID(), err)
+	}
+
+	nsLevel := s.pidnsLevel()
+
+	procs := make([]procStatus, 0, len(pids))
+	for _, pid := range pids {
+		st, err := readProcStatus(pid)
+		if err != nil {
+			// The process might exit during the walk.
+			if os.IsNotExist(err) {
+				continue
+			}
+			return nil, err
+		}
+		procs = append(procs, st)
+	}
+	return buildProcessTree(procs, s.processOwners(), nsLevel), nil
+}
+
+// processOwners returns the map from the running init and exec processes'
+// pid to their ID.
+func (s *shim) processOwners() map[uint32]string {
+	owners := make(map[uint32]string)
+	if pid := s.PID(); pid > 0 {
+		owners[pid] = s.ID()
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for id, p := range s.execProcesses {
+		if e, ok := p.(*execProcess); ok && e.Pid() > 0 {
+			owners[uint32(e.Pid())] = id
+		}
+	}
+	return owners
+}
+
+// procStatus is the subset of /proc/[pid]/status.
+type procStatus struct {
+	pid    uint32
+	ppid   uint32
+	comm   string
+	nsPids []uint32
+}
+
+func readProcStatus(pid int) (procStatus, error) {
+	f, err := os.Open(filepath.Join("/proc", strconv.Itoa(pid), "status"))
+	if err != nil {
+		return procStatus{}, err
+	}
+	defer f.Close()
+
+	st := procStatus{pid: uint32(pid)}
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		parts := strings.SplitN(scanner.Text(), ":", 2)
+		if len(parts) != 2 {
+			continue
+		}
+
+		value := strings.TrimSpace(parts[1])
+		switch parts[0] {
+		case "Name":
+			st.comm = value
+		case "PPid":
+			ppid, err := strconv.ParseUint(value, 10, 32)
+			if err != nil {
+				return procStatus{}, fmt.Errorf("invalid PPid %q of %d: %w", value, pid, err)
+			}
+			st.ppid = uint32(ppid)
+		case "NSpid":
+			for _, field := range strings.Fields(value) {
+				nsPid, err := strconv.ParseUint(field, 10, 32)
+				if err != nil {
+					return procStatus{}, fmt.Errorf("invalid NSpid %q of %d: %w", value, pid, err)
+				}
+				st.nsPids = append(st.nsPids, uint32(nsPid))
+			}
+		}
+	}
+	return st, scanner.Err()
+}
+
+// buildProcessTree links the processes by parent pid. The process inherits
+// the owner's ID from the nearest ancestor in owners. The nsLevel is the
+// index of NSpid for the container's pid namespace, and -1 means unknown.
+func buildProcessTree(procs []procStatus, owners map[uint32]string, nsLevel int) []*ProcessTreeNode {
+	nodes := make(map[uint32]*ProcessTreeNode, len(procs))
+	for _, st := range procs {
+		node := &ProcessTreeNode{
+			Pid:  st.pid,
+			PPid: st.ppid,
+			Comm: st.comm,
+		}
+		if nsLevel >= 0 && nsLevel < len(st.nsPids) {
+			node.NsPid = st.nsPids[nsLevel]
+		}
+		nodes[st.pid] = node
+	}
+
+	var roots []*ProcessTreeNode
+	for _, node := range nodes {
+		if parent, ok := nodes[node.PPid]; ok && node.PPid != node.Pid {
+			parent.Children = append(parent.Children, node)
+			continue
+		}
+		roots = append(roots, node)
+	}
+
+	var walk func(nodes []*ProcessTreeNode, execID string)
+	walk = func(nodes []*ProcessTreeNode, execID string) {
+		sort.Slice(nodes, func(i, j int) bool {
+			return nodes[i].Pid < nodes[j].Pid
+		})
+
+		for _, node := range nodes {
+			node.ExecID = execID
+			if id, ok := owners[node.Pid]; ok {
+				node.ExecID = id
+			}
+			walk(node.Children, node.ExecID)
+		}
+	}
+	walk(roots, "")
+	return roots
+}
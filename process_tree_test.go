@@ -0,0 +1,62 @@
+//go:build linux
+// +build linux
+
+package embedshim
+
+import "testing"
+
+func TestBuildProcessTree(t *testing.T) {
+	procs := []procStatus{
+		{pid: 100, ppid: 10, comm: "sh", nsPids: []uint32{100, 1}},
+		{pid: 101, ppid: 100, comm: "sleep", nsPids: []uint32{101, 2}},
+		{pid: 200, ppid: 10, comm: "bash", nsPids: []uint32{200, 3}},
+		{pid: 201, ppid: 200, comm: "top", nsPids: []uint32{201, 4}},
+		{pid: 300, ppid: 1, comm: "other"},
+	}
+	owners := map[uint32]string{
+		100: "task",
+		200: "exec1",
+	}
+
+	roots := buildProcessTree(procs, owners, 1)
+	if len(roots) != 3 {
+		t.Fatalf("expected 3 roots, but got %v", len(roots))
+	}
+
+	for i, expected := range []struct {
+		pid    uint32
+		execID string
+		child  uint32
+	}{
+		{pid: 100, execID: "task", child: 101},
+		{pid: 200, execID: "exec1", child: 201},
+		{pid: 300, execID: ""},
+	} {
+		root := roots[i]
+		if root.Pid != expected.pid || root.ExecID != expected.execID {
+			t.Fatalf("expected root %v owned by %q, but got %v owned by %q", expected.pid, expected.execID, root.Pid, root.ExecID)
+		}
+
+		if expected.child == 0 {
+			if len(root.Children) != 0 {
+				t.Fatalf("expected no child, but got %v", len(root.Children))
+			}
+			if root.NsPid != 0 {
+				t.Fatalf("expected no pid in container, but got %v", root.NsPid)
+			}
+			continue
+		}
+
+		if len(root.Children) != 1 {
+			t.Fatalf("expected 1 child, but got %v", len(root.Children))
+		}
+		child := root.Children[0]
+		if child.Pid != expected.child || child.ExecID != expected.execID {
+			t.Fatalf("expected child %v owned by %q, but got %v owned by %q", expected.child, expected.execID, child.Pid, child.ExecID)
+		}
+	}
+
+	if roots[0].NsPid != 1 {
+		t.Fatalf("expected pid 1 in container, but got %v", roots[0].NsPid)
+	}
+}
@@ -0,0 +1,237 @@
+//go:build linux
+// +build linux
+
+package embedshim
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/containerd/containerd/errdefs"
+	"github.com/containerd/containerd/log"
+)
+
+// ReadinessMode is the way to detect that the workload is ready.
+type ReadinessMode string
+
+const (
+	// ReadinessModeNotify waits for READY=1 from the sd_notify socket,
+	// which is mounted into the container with NOTIFY_SOCKET env.
+	ReadinessModeNotify ReadinessMode = "notify"
+	// ReadinessModeExec runs the readiness command as exec process until
+	// it exits with zero.
+	ReadinessModeExec ReadinessMode = "exec"
+)
+
+var (
+	defaultReadinessTimeout  = time.Minute
+	defaultReadinessInterval = time.Second
+
+	// readinessExecIDPrefix is the prefix of internal exec process.
+	readinessExecIDPrefix = "embedshim-readiness-"
+)
+
+// ReadinessState is the snapshot of the workload's readiness.
+type ReadinessState struct {
+	Mode    ReadinessMode
+	Ready   bool
+	ReadyAt time.Time
+	// Status is the last STATUS= of sd_notify, or the last output of the
+	// readiness command.
+	Status string
+}
+
+// readinessConfig is the blocking-start mode defined by annotations. Start
+// doesn't return until the workload is ready, or the timeout.
+type readinessConfig struct {
+	mode     ReadinessMode
+	cmd      []string
+	timeout  time.Duration
+	interval time.Duration
+}
+
+// readinessFromAnnotations returns nil if the readiness isn't defined.
+func readinessFromAnnotations(annotations map[string]string) (*readinessConfig, error) {
+	v, ok := annotations[annotationReadiness]
+	if !ok || v == "" {
+		return nil, nil
+	}
+
+	cfg := &readinessConfig{
+		mode:     ReadinessMode(v),
+		timeout:  defaultReadinessTimeout,
+		interval: defaultReadinessInterval,
+	}
+
+	switch cfg.mode {
+	case ReadinessModeNotify:
+	case ReadinessModeExec:
+		cmd := annotations[annotationReadinessCmd]
+		if err := json.Unmarshal([]byte(cmd), &cfg.cmd); err != nil || len(cfg.cmd) == 0 {
+			return nil, fmt.Errorf("invalid annotation %s=%q: %w", annotationReadinessCmd, cmd, errdefs.ErrInvalidArgument)
+		}
+	default:
+		return nil, fmt.Errorf("invalid annotation %s=%q: %w", annotationReadiness, v, errdefs.ErrInvalidArgument)
+	}
+
+	for key, d := range map[string]*time.Duration{
+		annotationReadinessTimeout:  &cfg.timeout,
+		annotationReadinessInterval: &cfg.interval,
+	} {
+		v := annotations[key]
+		if v == "" {
+			continue
+		}
+
+		parsed, err := time.ParseDuration(v)
+		if err != nil || parsed <= 0 {
+			return nil, fmt.Errorf("invalid annotation %s=%q: %w", key, v, errdefs.ErrInvalidArgument)
+		}
+		*d = parsed
+	}
+	return cfg, nil
+}
+
+// Readiness returns the task's readiness state.
+func (manager *TaskManager) Readiness(ctx context.Context, id string) (*ReadinessState, error) {
+	t, err := manager.tasks.Get(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+
+	s, ok := t.(*shim)
+	if !ok {
+		return nil, errdefs.ErrNotImplemented
+	}
+
+	if s.readiness == nil {
+		return nil, fmt.Errorf("task %s has no readiness: %w", id, errdefs.ErrNotFound)
+	}
+	return s.readiness.state(), nil
+}
+
+// initReadinessTracker creates the tracker if the readiness is defined.
+func (s *shim) initReadinessTracker() {
+	if s.init.readiness != nil {
+		s.readiness = &readinessTracker{
+			cfg:     s.init.readiness,
+			readyCh: make(chan struct{}),
+		}
+	}
+}
+
+// readinessTracker records the workload's readiness.
+type readinessTracker struct {
+	cfg *readinessConfig
+
+	mu      sync.Mutex
+	ready   bool
+	readyAt time.Time
+	status  string
+	seq     uint64
+	readyCh chan struct{}
+}
+
+func (r *readinessTracker) state() *ReadinessState {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	return &ReadinessState{
+		Mode:    r.cfg.mode,
+		Ready:   r.ready,
+		ReadyAt: r.readyAt,
+		Status:  r.status,
+	}
+}
+
+func (r *readinessTracker) markReady() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.ready {
+		return
+	}
+	r.ready = true
+	r.readyAt = time.Now()
+	close(r.readyCh)
+}
+
+func (r *readinessTracker) setStatus(status string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.status = status
+}
+
+// handleNotify records READY=1 and STATUS= from the notify socket.
+func (r *readinessTracker) handleNotify(kvs [][2]string) {
+	for _, kv := range kvs {
+		switch kv[0] {
+		case "READY":
+			if kv[1] == "1" {
+				r.markReady()
+			}
+		case "STATUS":
+			r.setStatus(kv[1])
+		}
+	}
+}
+
+// waitReady blocks until the workload is ready. The task keeps running if
+// it isn't ready in timeout, and the caller decides whether to kill it.
+func (s *shim) waitReady(ctx context.Context) error {
+	r := s.readiness
+	if r == nil {
+		return nil
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, r.cfg.timeout)
+	defer cancel()
+
+	if r.cfg.mode == ReadinessModeExec {
+		go s.probeReadiness(ctx)
+	}
+
+	select {
+	case <-r.readyCh:
+		return nil
+	case <-s.init.waitChan():
+		return fmt.Errorf("task %s exited before ready: %w", s.ID(), errdefs.ErrFailedPrecondition)
+	case <-ctx.Done():
+		return fmt.Errorf("task %s isn't ready in %s (status: %q): %w",
+			s.ID(), r.cfg.timeout, r.state().Status, errdefs.ErrUnavailable)
+	}
+}
+
+// probeReadiness runs the readiness command until it passes or the context
+// is done.
+func (s *shim) probeReadiness(ctx context.Context) {
+	r := s.readiness
+
+	for {
+		r.mu.Lock()
+		r.seq++
+		execID := fmt.Sprintf("%s%d", readinessExecIDPrefix, r.seq)
+		r.mu.Unlock()
+
+		exitCode, output, err := s.runProbe(ctx, execID, r.cfg.cmd, r.cfg.interval)
+		if err != nil {
+			log.G(ctx).WithError(err).Debugf("failed to run readiness probe for task %s", s.ID())
+			output = err.Error()
+		}
+		r.setStatus(output)
+		if err == nil && exitCode == 0 {
+			r.markReady()
+			return
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(r.cfg.interval):
+		}
+	}
+}
@@ -0,0 +1,59 @@
+//go:build linux
+// +build linux
+
+package embedshim
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/containerd/containerd/errdefs"
+)
+
+func TestReadinessFromAnnotations(t *testing.T) {
+	cfg, err := readinessFromAnnotations(map[string]string{
+		annotationReadiness:        "exec",
+		annotationReadinessCmd:     `["cat", "/tmp/ready"]`,
+		annotationReadinessTimeout: "5s",
+	})
+	if err != nil {
+		t.Fatalf("expected nil, but got %v", err)
+	}
+	if cfg.mode != ReadinessModeExec || len(cfg.cmd) != 2 || cfg.timeout != 5*time.Second || cfg.interval != defaultReadinessInterval {
+		t.Fatalf("unexpected config %+v", cfg)
+	}
+
+	for _, annotations := range []map[string]string{
+		{annotationReadiness: "tcp"},
+		{annotationReadiness: "exec"},
+		{annotationReadiness: "notify", annotationReadinessTimeout: "0s"},
+	} {
+		if _, err := readinessFromAnnotations(annotations); !errors.Is(err, errdefs.ErrInvalidArgument) {
+			t.Fatalf("expected %v, but got %v", errdefs.ErrInvalidArgument, err)
+		}
+	}
+}
+
+func TestReadinessTrackerHandleNotify(t *testing.T) {
+	r := &readinessTracker{
+		cfg:     &readinessConfig{mode: ReadinessModeNotify},
+		readyCh: make(chan struct{}),
+	}
+
+	r.handleNotify(parseNotifyMessage("STATUS=loading\nWATCHDOG=1"))
+	if st := r.state(); st.Ready || st.Status != "loading" {
+		t.Fatalf("expected not ready with status loading, but got %+v", st)
+	}
+
+	r.handleNotify(parseNotifyMessage("READY=1\nSTATUS=serving\n"))
+	r.handleNotify(parseNotifyMessage("READY=1"))
+	select {
+	case <-r.readyCh:
+	default:
+		t.Fatal("expected ready channel closed")
+	}
+	if st := r.state(); !st.Ready || st.Status != "serving" {
+		t.Fatalf("expected ready with status serving, but got %+v", st)
+	}
+}
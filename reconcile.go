@@ -0,0 +1,339 @@
+//go:build linux
+// +build linux
+
+package embedshim
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/cilium/ebpf"
+	"github.com/containerd/containerd/log"
+	"github.com/containerd/containerd/namespaces"
+	"github.com/containerd/typeurl"
+)
+
+// TaskReconciledEventTopic is the topic of TaskReconciled event.
+const TaskReconciledEventTopic = "/tasks/reconciled"
+
+func init() {
+	typeurl.Register(&TaskReconciled{}, "io.embedshim.events.v1", "TaskReconciled")
+}
+
+const (
+	// reconcileExitLost means that the runtime reports the container
+	// stopped but the init process is still created, running or paused,
+	// because the exit event is lost.
+	reconcileExitLost = "exit-lost"
+	// reconcilePausedDrift means that the container is paused by others.
+	reconcilePausedDrift = "paused-drift"
+	// reconcileResumedDrift means that the container is resumed by others.
+	reconcileResumedDrift = "resumed-drift"
+	// reconcileLeftover means that the init process has stopped but its
+	// cgroup is still populated.
+	reconcileLeftover = "leftover-processes"
+)
+
+var (
+	defaultReconcileInterval = time.Minute
+
+	// lostExitWaitStatus is the wait status of the init process whose exit
+	// status is unknown, which is reported as unexpectedExitCode.
+	lostExitWaitStatus = unexpectedExitCode << 8
+)
+
+// ReconcileConfig enables the periodic reconciliation, which compares the
+// task's internal state, the OCI runtime's state and the cgroup population.
+// The disagreement observed in two consecutive passes is corrected and
+// published as TaskReconciled event, so that the stuck task self-heals.
+type ReconcileConfig struct {
+	Enabled bool `toml:"enabled"`
+	// Interval is the duration between passes, like "30s". The default is
+	// 1m.
+	Interval string `toml:"interval"`
+}
+
+// TaskReconciled is published after the task's disagreement is corrected.
+type TaskReconciled struct {
+	ContainerID string `json:"container_id"`
+	Pid         uint32 `json:"pid"`
+	// Mismatch is the kind of the disagreement, like exit-lost.
+	Mismatch string `json:"mismatch"`
+	// InternalState is the init process's state before correction.
+	InternalState string `json:"internal_state"`
+	// RuntimeState is the state reported by the OCI runtime.
+	RuntimeState    string `json:"runtime_state"`
+	CgroupPopulated bool   `json:"cgroup_populated"`
+	// Action is the corrective action, like set-exited.
+	Action       string    `json:"action"`
+	ReconciledAt time.Time `json:"reconciled_at"`
+}
+
+// Field implements events.Event.
+func (e *TaskReconciled) Field(fieldpath []string) (string, bool) {
+	if len(fieldpath) == 0 {
+		return "", false
+	}
+
+	switch fieldpath[0] {
+	case "container_id":
+		return e.ContainerID, len(e.ContainerID) > 0
+	case "mismatch":
+		return e.Mismatch, len(e.Mismatch) > 0
+	case "action":
+		return e.Action, len(e.Action) > 0
+	}
+	return "", false
+}
+
+// taskReconciler remembers the disagreements observed in the last pass.
+type taskReconciler struct {
+	mu sync.Mutex
+	// pending is the last observed mismatch by namespace/id.
+	pending map[string]reconcileObservation
+}
+
+type reconcileObservation struct {
+	mismatch        string
+	pid             int
+	internalState   string
+	runtimeState    string
+	cgroupPopulated bool
+}
+
+func newTaskReconciler() *taskReconciler {
+	return &taskReconciler{pending: make(map[string]reconcileObservation)}
+}
+
+// confirm returns true if the same mismatch has been observed in the last
+// pass. The transient disagreement, like the exit being handled, is not
+// confirmed.
+func (r *taskReconciler) confirm(key string, ob reconcileObservation, seen map[string]struct{}) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	seen[key] = struct{}{}
+	last, ok := r.pending[key]
+	if ok && last.mismatch == ob.mismatch && last.pid == ob.pid {
+		delete(r.pending, key)
+		return true
+	}
+	r.pending[key] = ob
+	return false
+}
+
+// forget drops the pending observations which are not seen in this pass.
+func (r *taskReconciler) forget(seen map[string]struct{}) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	for key := range r.pending {
+		if _, ok := seen[key]; !ok {
+			delete(r.pending, key)
+		}
+	}
+}
+
+func (manager *TaskManager) reconcileInterval() time.Duration {
+	cfg := manager.config.Reconcile
+	if cfg.Interval == "" {
+		return defaultReconcileInterval
+	}
+
+	d, err := time.ParseDuration(cfg.Interval)
+	if err != nil || d <= 0 {
+		log.G(context.Background()).WithError(err).Warnf("invalid reconcile interval %q, use %s",
+			cfg.Interval, defaultReconcileInterval)
+		return defaultReconcileInterval
+	}
+	return d
+}
+
+// reconcilePeriodically reconciles all the tasks in each interval.
+func (manager *TaskManager) reconcilePeriodically() {
+	ticker := time.NewTicker(manager.reconcileInterval())
+	defer ticker.Stop()
+
+	for range ticker.C {
+		manager.reconcileTasks(context.Background())
+	}
+}
+
+func (manager *TaskManager) reconcileTasks(ctx context.Context) {
+	tasks, err := manager.tasks.GetAll(ctx, true)
+	if err != nil {
+		log.G(ctx).WithError(err).Warn("failed to list tasks for reconciliation")
+		return
+	}
+
+	seen := make(map[string]struct{}, len(tasks))
+	for _, t := range tasks {
+		s, ok := t.(*shim)
+		if !ok {
+			continue
+		}
+
+		tctx := namespaces.WithNamespace(ctx, s.Namespace())
+		ob, ok := s.observeMismatch(tctx)
+		if !ok {
+			continue
+		}
+
+		if !manager.reconciler.confirm(s.Namespace()+"/"+s.ID(), ob, seen) {
+			continue
+		}
+
+		action, err := s.correctMismatch(tctx, ob)
+		if err != nil {
+			log.G(tctx).WithError(err).Warnf("failed to reconcile task %s: %s", s.ID(), ob.mismatch)
+			continue
+		}
+		if action == "" {
+			continue
+		}
+
+		log.G(tctx).Warnf("task %s reconciled: %s, internal %s, runtime %s, action %s",
+			s.ID(), ob.mismatch, ob.internalState, ob.runtimeState, action)
+		manager.publishEvent(s.Namespace(), TaskReconciledEventTopic, &TaskReconciled{
+			ContainerID:     s.ID(),
+			Pid:             uint32(ob.pid),
+			Mismatch:        ob.mismatch,
+			InternalState:   ob.internalState,
+			RuntimeState:    ob.runtimeState,
+			CgroupPopulated: ob.cgroupPopulated,
+			Action:          action,
+			ReconciledAt:    time.Now(),
+		})
+	}
+	manager.reconciler.forget(seen)
+}
+
+// observeMismatch returns false if the task's states agree.
+func (s *shim) observeMismatch(ctx context.Context) (reconcileObservation, bool) {
+	snapshot := s.init.loadSnapshot()
+	ob := reconcileObservation{
+		pid:           snapshot.pid,
+		internalState: snapshot.status,
+	}
+
+	pids, err := s.cgroupPids()
+	if err != nil {
+		log.G(ctx).WithError(err).Debugf("failed to get cgroup pids of task %s", s.ID())
+	}
+	ob.cgroupPopulated = len(pids) > 0
+
+	switch ob.internalState {
+	case "created", "running", "paused":
+	case "stopped":
+		if ob.cgroupPopulated {
+			ob.mismatch = reconcileLeftover
+			return ob, true
+		}
+		return ob, false
+	default:
+		// the transient or deleted states
+		return ob, false
+	}
+
+	state, err := s.init.runtime.State(ctx, s.ID())
+	if err != nil {
+		log.G(ctx).WithError(err).Debugf("failed to get runtime state of task %s", s.ID())
+		return ob, false
+	}
+	ob.runtimeState = state.Status
+
+	switch {
+	case ob.runtimeState == "stopped":
+		ob.mismatch = reconcileExitLost
+	case ob.internalState == "running" && ob.runtimeState == "paused":
+		ob.mismatch = reconcilePausedDrift
+	case ob.internalState == "paused" && ob.runtimeState == "running":
+		ob.mismatch = reconcileResumedDrift
+	default:
+		return ob, false
+	}
+	return ob, true
+}
+
+// correctMismatch applies the corrective transition. It returns the empty
+// action if the task has changed since the observation.
+func (s *shim) correctMismatch(ctx context.Context, ob reconcileObservation) (string, error) {
+	p := s.init
+
+	switch ob.mismatch {
+	case reconcileExitLost:
+		if !p.reconcileState(ob, nil) {
+			return "", nil
+		}
+
+		status := lostExitWaitStatus
+		if s.manager.monitor != nil {
+			status = s.manager.monitor.releaseLostExit(p)
+		}
+		p.SetExited(status)
+		return "set-exited", nil
+	case reconcilePausedDrift:
+		if !p.reconcileState(ob, &pausedState{p: p}) {
+			return "", nil
+		}
+		return "set-paused", nil
+	case reconcileResumedDrift:
+		if !p.reconcileState(ob, &runningState{p: p}) {
+			return "", nil
+		}
+		return "set-running", nil
+	case reconcileLeftover:
+		if p.loadSnapshot().status != "stopped" {
+			return "", nil
+		}
+		if err := p.KillAll(ctx); err != nil {
+			return "", err
+		}
+		return "kill-all", nil
+	}
+	return "", nil
+}
+
+// reconcileState transitions into the state if the init process is still
+// in the observed state. It returns false if the process has changed. The
+// nil state only checks.
+func (p *initProcess) reconcileState(ob reconcileObservation, state initState) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	status, _ := p.initState.Status(context.Background())
+	if status != ob.internalState || p.pid != ob.pid {
+		return false
+	}
+	if state != nil {
+		p.setState(state)
+	}
+	return true
+}
+
+// releaseLostExit stops polling the init process whose exit event is lost
+// and returns the wait status recorded by exitsnoop. The lostExitWaitStatus
+// is returned if there is no record.
+func (m *monitor) releaseLostExit(init *initProcess) int {
+	m.Lock()
+	if fd, ok := m.initPidFDs[init.traceEventID]; ok {
+		if err := m.pidPoller.Remove(fd); err != nil {
+			log.G(context.Background()).WithError(err).Warnf("failed to stop polling %s", init)
+		}
+		delete(m.initPidFDs, init.traceEventID)
+	}
+	m.Unlock()
+
+	status, err := m.initStore.GetExitedEvent(init.traceEventID)
+	if err != nil {
+		if !errors.Is(err, ebpf.ErrKeyNotExist) {
+			log.G(context.Background()).WithError(err).Warnf("failed to get exited status of %s", init)
+		}
+		atomic.AddUint64(&m.lostExitEvents, 1)
+		return lostExitWaitStatus
+	}
+	return int(status.ExitCode)
+}
@@ -0,0 +1,87 @@
+//go:build linux
+// +build linux
+
+package embedshim
+
+import (
+	"testing"
+
+	eventstypes "github.com/containerd/containerd/api/events"
+	"github.com/containerd/containerd/runtime"
+)
+
+func newReconcileHarness(t *testing.T, id string) *testHarness {
+	h := newTestHarness(t, id)
+	h.manager.reconciler = newTaskReconciler()
+
+	if err := h.shim.init.Create(h.ctx); err != nil {
+		t.Fatalf("failed to create: %v", err)
+	}
+	if err := h.shim.init.Start(h.ctx); err != nil {
+		t.Fatalf("failed to start: %v", err)
+	}
+	if err := h.manager.tasks.Add(h.ctx, h.shim); err != nil {
+		t.Fatalf("failed to add task: %v", err)
+	}
+	return h
+}
+
+func TestReconcilePausedDrift(t *testing.T) {
+	h := newReconcileHarness(t, "reconcile-paused")
+
+	h.runtime.setStatus(h.shim.ID(), "paused")
+
+	// the first observation isn't confirmed
+	h.manager.reconcileTasks(h.ctx)
+	h.expectStatus("running")
+
+	h.manager.reconcileTasks(h.ctx)
+	h.expectStatus("paused")
+
+	ev := h.expectEvent(TaskReconciledEventTopic).(*TaskReconciled)
+	if ev.Mismatch != reconcilePausedDrift || ev.Action != "set-paused" {
+		t.Fatalf("expected %v with set-paused, but got %v with %v", reconcilePausedDrift, ev.Mismatch, ev.Action)
+	}
+
+	h.runtime.setStatus(h.shim.ID(), "running")
+	h.manager.reconcileTasks(h.ctx)
+	h.manager.reconcileTasks(h.ctx)
+	h.expectStatus("running")
+}
+
+func TestReconcileTransientMismatch(t *testing.T) {
+	h := newReconcileHarness(t, "reconcile-transient")
+
+	h.runtime.setStatus(h.shim.ID(), "paused")
+	h.manager.reconcileTasks(h.ctx)
+
+	h.runtime.setStatus(h.shim.ID(), "running")
+	h.manager.reconcileTasks(h.ctx)
+
+	h.runtime.setStatus(h.shim.ID(), "paused")
+	h.manager.reconcileTasks(h.ctx)
+	h.expectStatus("running")
+
+	if got := len(h.manager.reconciler.pending); got != 1 {
+		t.Fatalf("expected 1 pending observation, but got %v", got)
+	}
+}
+
+func TestReconcileExitLost(t *testing.T) {
+	h := newReconcileHarness(t, "reconcile-exit-lost")
+
+	h.runtime.setStatus(h.shim.ID(), "stopped")
+	h.manager.reconcileTasks(h.ctx)
+	h.manager.reconcileTasks(h.ctx)
+	h.expectStatus("stopped")
+
+	exit := h.expectEvent(runtime.TaskExitEventTopic).(*eventstypes.TaskExit)
+	if exit.ExitStatus != uint32(unexpectedExitCode) {
+		t.Fatalf("expected exit status %v, but got %v", unexpectedExitCode, exit.ExitStatus)
+	}
+
+	ev := h.expectEvent(TaskReconciledEventTopic).(*TaskReconciled)
+	if ev.Mismatch != reconcileExitLost || ev.InternalState != "running" || ev.RuntimeState != "stopped" {
+		t.Fatalf("expected %v from running to stopped, but got %+v", reconcileExitLost, ev)
+	}
+}
@@ -1,3 +1,6 @@
+//go:build linux
+// +build linux
+
 package embedshim
 
 import (
@@ -8,6 +11,7 @@ import (
 
 	pkgbundle "github.com/fuweid/embedshim/pkg/bundle"
 
+	"github.com/containerd/containerd/errdefs"
 	"github.com/containerd/containerd/log"
 	"github.com/containerd/containerd/namespaces"
 	"github.com/containerd/containerd/runtime"
@@ -19,6 +23,9 @@ func (manager *TaskManager) reloadExistingTasks(ctx context.Context) error {
 		return err
 	}
 
+	// NOTE: The trace event ID is the key of exitsnoop's maps, which are
+	// shared by all the namespaces.
+	traceIDs := make(map[uint64]TaskRef)
 	for _, nsd := range nsDirs {
 		if !nsd.IsDir() {
 			continue
@@ -30,7 +37,7 @@ func (manager *TaskManager) reloadExistingTasks(ctx context.Context) error {
 		}
 
 		log.G(ctx).WithField("namespace", ns).Info("loading tasks in namespace")
-		if err := manager.loadTasks(namespaces.WithNamespace(ctx, ns)); err != nil {
+		if err := manager.loadTasks(namespaces.WithNamespace(ctx, ns), traceIDs); err != nil {
 			log.G(ctx).WithField("namespace", ns).WithError(err).Error("loading tasks in namespace")
 			continue
 		}
@@ -38,7 +45,7 @@ func (manager *TaskManager) reloadExistingTasks(ctx context.Context) error {
 	return nil
 }
 
-func (manager *TaskManager) loadTasks(ctx context.Context) error {
+func (manager *TaskManager) loadTasks(ctx context.Context, traceIDs map[uint64]TaskRef) error {
 	ns, err := namespaces.NamespaceRequired(ctx)
 	if err != nil {
 		return err
@@ -71,6 +78,19 @@ func (manager *TaskManager) loadTasks(ctx context.Context) error {
 			continue
 		}
 
+		if err := manager.reserveTraceEventID(traceIDs, TaskRef{Namespace: ns, ID: id}, bundle); err != nil {
+			log.G(ctx).WithError(err).Errorf("skip bundle %s", bundle.Path)
+			continue
+		}
+
+		// NOTE: The bundle is kept if the migration fails, because the
+		// container might be still running and the failure might be
+		// transient, like I/O error.
+		if err := migrateBundle(bundle); err != nil {
+			log.G(ctx).WithError(err).Errorf("bundle %s can't be migrated, skip", bundle.Path)
+			continue
+		}
+
 		shim, err := manager.loadShim(ctx, bundle)
 		if err != nil {
 			log.G(ctx).WithError(err).Errorf("failed to load exiting task %s", id)
@@ -78,12 +98,30 @@ func (manager *TaskManager) loadTasks(ctx context.Context) error {
 			continue
 		}
 
-		if _, err := manager.containers.Get(ctx, id); err != nil {
+		container, err := manager.containers.Get(ctx, id)
+		if err != nil {
 			log.G(ctx).WithError(err).Errorf("failed to load container %s and start to delete task", id)
 			shim.Delete(ctx)
 			continue
 		}
+		shim.labels = container.Labels
 		manager.tasks.Add(ctx, shim)
+		manager.watchBundle(shim.bundle)
+
+		if shim.health != nil {
+			shim.health.start()
+		}
+		if err := shim.listenNotifySocket(); err != nil {
+			log.G(ctx).WithError(err).Warnf("failed to re-create notify socket of task %s", id)
+		}
+		if status, _ := shim.init.Status(ctx); status == "running" || status == "paused" {
+			if shim.lifetime != nil {
+				shim.lifetime.arm()
+			}
+			if shim.nsHolder != nil {
+				shim.nsHolder.pin(shim.init.Pid())
+			}
+		}
 	}
 	return nil
 }
@@ -105,10 +143,15 @@ func (manager *TaskManager) loadShim(_ context.Context, bundle *pkgbundle.Bundle
 		}
 	}()
 
+	// NOTE: The shim should be renewed before repolling so that the init
+	// process is able to publish exit event if it has exited.
+	s := renewShim(manager, init)
+	s.loadIdentity()
+
 	if err := manager.repollingInitProcess(init); err != nil {
 		return nil, err
 	}
-	return renewShim(manager, init), nil
+	return s, nil
 }
 
 func renewShim(manager *TaskManager, init *initProcess) *shim {
@@ -121,6 +164,11 @@ func renewShim(manager *TaskManager, init *initProcess) *shim {
 		reservedExecIDs: make(map[string]struct{}),
 	}
 	init.parent = s
+	s.initHealthChecker()
+	s.initLifetimeEnforcer()
+	s.initReadinessTracker()
+	s.initWebhookNotifier()
+	s.initNamespaceHolder()
 	return s
 }
 
@@ -136,5 +184,30 @@ func renewInitProcess(bundle *pkgbundle.Bundle) (*initProcess, error) {
 	}
 
 	init.pid = pid
+	init.resolveReloadedState()
 	return init, nil
 }
+
+// reserveTraceEventID records the bundle's trace event ID and moves the
+// allocator beyond it. The bundle is rejected if the ID is owned by the task
+// in the other namespace, because the exit events in exitsnoop's maps can't
+// be told apart.
+func (manager *TaskManager) reserveTraceEventID(traceIDs map[uint64]TaskRef, ref TaskRef, bundle *pkgbundle.Bundle) error {
+	traceID, err := readInitTraceEventID(bundle)
+	if err != nil {
+		return err
+	}
+
+	if owner, ok := traceIDs[traceID]; ok {
+		return fmt.Errorf("trace event ID %d of task %s/%s is owned by task %s/%s: %w",
+			traceID, ref.Namespace, ref.ID, owner.Namespace, owner.ID, errdefs.ErrAlreadyExists)
+	}
+	traceIDs[traceID] = ref
+
+	if manager.idAlloc != nil {
+		if err := manager.idAlloc.ensureAbove(traceID); err != nil {
+			return fmt.Errorf("failed to reserve trace event ID %d: %w", traceID, err)
+		}
+	}
+	return nil
+}
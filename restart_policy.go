@@ -0,0 +1,351 @@
+//go:build linux
+// +build linux
+
+package embedshim
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	pkgbundle "github.com/fuweid/embedshim/pkg/bundle"
+
+	eventstypes "github.com/containerd/containerd/api/events"
+	"github.com/containerd/containerd/errdefs"
+	"github.com/containerd/containerd/log"
+	"github.com/containerd/containerd/runtime"
+	"github.com/containerd/go-runc"
+)
+
+// restartPolicyName decides whether the task is restarted after the init
+// process exits, like docker's restart policy.
+type restartPolicyName string
+
+const (
+	// restartPolicyNo never restarts the task. It is default policy.
+	restartPolicyNo restartPolicyName = "no"
+
+	// restartPolicyOnFailure restarts the task if the exit status is
+	// non-zero. The max retries can be set by "on-failure:N".
+	restartPolicyOnFailure restartPolicyName = "on-failure"
+
+	// restartPolicyAlways restarts the task unless it is stopped by Kill.
+	// The stopped task is restarted after containerd restarts.
+	restartPolicyAlways restartPolicyName = "always"
+
+	// restartPolicyUnlessStopped is like always, but the task stopped by
+	// Kill is not restarted even if containerd restarts.
+	restartPolicyUnlessStopped restartPolicyName = "unless-stopped"
+)
+
+var (
+	// restartBackoffBase is the first delay before restart, which is
+	// doubled for each consecutive restart.
+	restartBackoffBase = 100 * time.Millisecond
+
+	// restartBackoffMax is the max delay before restart.
+	restartBackoffMax = time.Minute
+
+	// restartBackoffReset resets the backoff if the task has been running
+	// longer than it.
+	restartBackoffReset = 10 * time.Second
+
+	// bundleFileKeyStopRequested is the filename to mark the task stopped
+	// by Kill, which is used by unless-stopped policy after reload.
+	bundleFileKeyStopRequested = "stop_requested"
+
+	// restartFailedStatus is the wait status of the init process which
+	// fails to be restarted. It is reported as exit code 255.
+	restartFailedStatus = 255 << 8
+)
+
+type restartPolicy struct {
+	name       restartPolicyName
+	maxRetries int
+}
+
+func restartPolicyFromAnnotations(annotations map[string]string) (restartPolicy, error) {
+	v, ok := annotations[annotationRestartPolicy]
+	if !ok || v == "" {
+		return restartPolicy{name: restartPolicyNo}, nil
+	}
+
+	invalid := fmt.Errorf("invalid annotation %s=%q: %w", annotationRestartPolicy, v, errdefs.ErrInvalidArgument)
+
+	parts := strings.SplitN(v, ":", 2)
+	hasRetries := len(parts) == 2
+
+	switch policy := restartPolicyName(parts[0]); policy {
+	case restartPolicyOnFailure:
+		p := restartPolicy{name: policy}
+		if hasRetries {
+			n, err := strconv.Atoi(parts[1])
+			if err != nil || n <= 0 {
+				return restartPolicy{}, invalid
+			}
+			p.maxRetries = n
+		}
+		return p, nil
+	case restartPolicyNo, restartPolicyAlways, restartPolicyUnlessStopped:
+		if hasRetries {
+			return restartPolicy{}, invalid
+		}
+		return restartPolicy{name: policy}, nil
+	default:
+		return restartPolicy{}, invalid
+	}
+}
+
+// restartTracker is the task's restart state.
+type restartTracker struct {
+	mu sync.Mutex
+
+	// count is the number of restarts.
+	count int
+	// retries is the number of consecutive restarts for backoff.
+	retries int
+	// startedAt is the time the init process was (re)started.
+	startedAt time.Time
+	// stopped is set if the task is stopped by Kill.
+	stopped bool
+	// cancelled is set if the task is being deleted.
+	cancelled bool
+}
+
+// markStopped disables the restart because the task is stopped by Kill.
+func (s *shim) markStopped() {
+	if s.init.restartPolicy.name == restartPolicyNo {
+		return
+	}
+
+	s.restart.mu.Lock()
+	s.restart.stopped = true
+	s.restart.mu.Unlock()
+
+	if s.init.restartPolicy.name == restartPolicyUnlessStopped {
+		pathname := filepath.Join(s.bundle.Path, bundleFileKeyStopRequested)
+		if err := os.WriteFile(pathname, nil, 0644); err != nil {
+			log.G(context.Background()).WithError(err).Warnf("failed to mark task %s stopped", s.ID())
+		}
+	}
+}
+
+// cancelRestart stops the pending restart before the task is deleted.
+func (s *shim) cancelRestart() {
+	s.restart.mu.Lock()
+	defer s.restart.mu.Unlock()
+
+	s.restart.cancelled = true
+}
+
+func (s *shim) restartCount() int {
+	s.restart.mu.Lock()
+	defer s.restart.mu.Unlock()
+
+	return s.restart.count
+}
+
+// scheduleRestart restarts the task in background with backoff if the
+// policy allows. It is called with s.init.mu held when the init exits.
+func (s *shim) scheduleRestart(exitStatus int) {
+	policy := s.init.restartPolicy
+
+	r := &s.restart
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.cancelled || r.stopped {
+		return
+	}
+
+	if !r.startedAt.IsZero() && time.Since(r.startedAt) >= restartBackoffReset {
+		r.retries = 0
+	}
+
+	switch policy.name {
+	case restartPolicyOnFailure:
+		if exitStatus == 0 {
+			return
+		}
+		if policy.maxRetries > 0 && r.retries >= policy.maxRetries {
+			log.G(context.Background()).Warnf("task %s exceeds max retries %d", s.ID(), policy.maxRetries)
+			return
+		}
+	case restartPolicyAlways:
+	case restartPolicyUnlessStopped:
+		if hasStopRequested(s.bundle) {
+			return
+		}
+	default:
+		return
+	}
+
+	delay := restartBackoffMax
+	if r.retries < 20 {
+		if d := restartBackoffBase << r.retries; d < restartBackoffMax {
+			delay = d
+		}
+	}
+	r.retries++
+
+	go func() {
+		time.Sleep(delay)
+
+		if err := s.restartInit(context.Background()); err != nil {
+			log.G(context.Background()).WithError(err).Errorf("failed to restart task %s", s.ID())
+		}
+	}()
+}
+
+// restartInit re-creates and starts the init process with the same bundle.
+func (s *shim) restartInit(ctx context.Context) error {
+	p := s.init
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	s.restart.mu.Lock()
+	skip := s.restart.cancelled || s.restart.stopped
+	s.restart.mu.Unlock()
+	if skip {
+		return nil
+	}
+
+	if _, ok := p.initState.(*stoppedState); !ok {
+		return nil
+	}
+
+	if err := s.recreateInit(ctx); err != nil {
+		s.rollbackRestart(ctx)
+		return err
+	}
+
+	if s.nsHolder != nil {
+		s.nsHolder.pin(p.Pid())
+	}
+
+	s.restart.mu.Lock()
+	s.restart.count++
+	s.restart.startedAt = time.Now()
+	s.restart.mu.Unlock()
+
+	if s.health != nil {
+		s.health.reset()
+	}
+
+	log.G(ctx).WithField("id", s.ID()).Infof("restarted task by %s policy", p.restartPolicy.name)
+	s.publishTaskEvent(runtime.TaskStartEventTopic, "", s.PID(), &eventstypes.TaskStart{
+		ContainerID: s.ID(),
+		Pid:         s.PID(),
+	})
+	return nil
+}
+
+// recreateInit resets the stopped init process and starts it again. The
+// caller must hold s.init.mu.
+func (s *shim) recreateInit(ctx context.Context) error {
+	p := s.init
+
+	if err := p.resetForRestart(ctx); err != nil {
+		return err
+	}
+
+	if err := p.Create(ctx); err != nil {
+		return err
+	}
+
+	if err := s.manager.traceInitProcess(p); err != nil {
+		return err
+	}
+	s.loadCgroup()
+	if err := s.setupSubgroups(); err != nil {
+		return err
+	}
+	if err := s.applyMemoryQoS(ctx); err != nil {
+		return err
+	}
+	return p.initState.Start(ctx)
+}
+
+// rollbackRestart moves the task which fails to be restarted back to
+// stopped, instead of leaving it created without process, so that the
+// restart is rescheduled with backoff. The caller must hold s.init.mu.
+func (s *shim) rollbackRestart(ctx context.Context) {
+	p := s.init
+
+	if _, ok := p.initState.(*createdState); !ok {
+		// It failed before the init process was reset.
+		s.scheduleRestart(p.status)
+		return
+	}
+
+	if err := p.removeFromRuntime(ctx); err != nil {
+		log.G(ctx).WithError(err).Warnf("failed to remove task %s after restart failure", s.ID())
+	}
+	p.initState.SetExited(restartFailedStatus)
+}
+
+// removeFromRuntime removes the exited container from OCI runtime. The
+// external cgroup is kept.
+func (p *initProcess) removeFromRuntime(ctx context.Context) error {
+	if p.externalCgroup {
+		return p.deleteKeepCgroup(ctx)
+	}
+	if err := p.runtime.Delete(ctx, p.ID(), &runc.DeleteOpts{Force: true}); err != nil && !isRuntimeNotExist(err) {
+		return p.runtimeError(err, "OCI runtime delete failed")
+	}
+	return nil
+}
+
+// resetForRestart removes the exited container from OCI runtime and resets
+// the init process into created state. The rootfs is kept, but the
+// checkpoint isn't restored again. The caller must hold p.mu.
+func (p *initProcess) resetForRestart(ctx context.Context) error {
+	waitTimeout(ctx, &p.wg, 2*time.Second)
+
+	if err := p.removeFromRuntime(ctx); err != nil {
+		return err
+	}
+
+	if p.io != nil {
+		for _, c := range p.closers {
+			c.Close()
+		}
+		p.closers = nil
+		p.io.Close()
+		p.io = nil
+	}
+	p.stdin = nil
+
+	if p.parent != nil {
+		p.parent.manager.cleanInitProcessTraceEvent(p)
+	}
+
+	if p.platform == nil {
+		platform, err := NewPlatform()
+		if err != nil {
+			return err
+		}
+		p.platform = platform
+	}
+
+	p.restoreConfig = nil
+	p.pid = 0
+	p.status = 0
+	p.exited = time.Time{}
+	p.waitMu.Lock()
+	p.waitBlock = make(chan struct{})
+	p.waitMu.Unlock()
+	p.setState(&createdState{p: p})
+	return nil
+}
+
+func hasStopRequested(b *pkgbundle.Bundle) bool {
+	_, err := os.Stat(filepath.Join(b.Path, bundleFileKeyStopRequested))
+	return err == nil
+}
@@ -0,0 +1,87 @@
+//go:build linux
+// +build linux
+
+package embedshim
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+
+	pkgbundle "github.com/fuweid/embedshim/pkg/bundle"
+
+	"github.com/containerd/containerd/errdefs"
+	"github.com/opencontainers/runtime-spec/specs-go"
+)
+
+// timeNamespace is the OCI namespace type of time namespace, which is not
+// defined by the vendored runtime-spec yet.
+var timeNamespace specs.LinuxNamespaceType = "time"
+
+// RestoreConfig holds task restore configuration.
+type RestoreConfig struct {
+	// ImagePath is the checkpoint image path prepared by containerd.
+	ImagePath string
+	// WorkDir is used by CRIU to store the logs.
+	WorkDir string
+	// TimeNamespaceOffsets is to restore the init process in the new time
+	// namespace. CRIU sets the time namespace's offsets based on the dumped
+	// clocks so that CLOCK_MONOTONIC and CLOCK_BOOTTIME keep continuity on
+	// different host.
+	TimeNamespaceOffsets bool
+}
+
+func newRestoreConfig(bundle *pkgbundle.Bundle, imagePath, workDir string) (*RestoreConfig, error) {
+	spec, err := readInitOCISpec(bundle)
+	if err != nil {
+		return nil, err
+	}
+
+	timensOffsets, err := annotationBool(spec.Annotations, annotationRestoreTimeNamespaceOffsets)
+	if err != nil {
+		return nil, err
+	}
+
+	if workDir == "" {
+		workDir = filepath.Join(bundle.Path, "work")
+	}
+	return &RestoreConfig{
+		ImagePath:            imagePath,
+		WorkDir:              workDir,
+		TimeNamespaceOffsets: timensOffsets,
+	}, nil
+}
+
+// ensureTimeNamespace makes sure that the init process will be restored in
+// new time namespace.
+//
+// NOTE: The OCI runtime must support time namespace, like runc >= v1.2.
+func ensureTimeNamespace(bundle *pkgbundle.Bundle) error {
+	if _, err := os.Stat("/proc/self/ns/time"); err != nil {
+		if os.IsNotExist(err) {
+			return fmt.Errorf("time namespace is not supported by kernel: %w", errdefs.ErrFailedPrecondition)
+		}
+		return err
+	}
+
+	spec, err := readInitOCISpec(bundle)
+	if err != nil {
+		return err
+	}
+
+	if spec.Linux == nil {
+		spec.Linux = &specs.Linux{}
+	}
+
+	for _, ns := range spec.Linux.Namespaces {
+		if ns.Type == timeNamespace {
+			if ns.Path != "" {
+				return fmt.Errorf("time namespace offsets can't be applied on existing namespace %s: %w",
+					ns.Path, errdefs.ErrInvalidArgument)
+			}
+			return nil
+		}
+	}
+	spec.Linux.Namespaces = append(spec.Linux.Namespaces, specs.LinuxNamespace{Type: timeNamespace})
+	return writeInitOCISpec(bundle, spec)
+}
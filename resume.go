@@ -0,0 +1,248 @@
+//go:build linux
+// +build linux
+
+package embedshim
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/containerd/containerd/errdefs"
+	"github.com/containerd/containerd/log"
+	"github.com/containerd/containerd/namespaces"
+	"github.com/containerd/containerd/runtime"
+	"github.com/containerd/typeurl"
+)
+
+// TaskResumeSummaryEventTopic is the topic of TaskResumeSummary event.
+const TaskResumeSummaryEventTopic = "/tasks/resume-summary"
+
+var (
+	// labelResumeDependsOn is the container label with the comma separated
+	// IDs of the tasks in the same namespace which must be resumed before
+	// this one.
+	labelResumeDependsOn = "io.embedshim.resume.depends-on"
+
+	// labelCRIKind and labelCRIPodUID order the CRI containers after their
+	// pod's sandbox.
+	labelCRIKind   = "io.cri-containerd.kind"
+	labelCRIPodUID = "io.kubernetes.pod.uid"
+
+	// resumeDoneSuffix is appended to the processed manifest so that the
+	// tasks aren't resumed again by the next plugin start.
+	resumeDoneSuffix = ".done"
+)
+
+func init() {
+	typeurl.Register(&TaskResumeSummary{}, "io.embedshim.events.v1", "TaskResumeSummary")
+}
+
+// ResumeConfig resumes the tasks dumped by CheckpointAll on plugin start,
+// like after the node reboots for kernel patching.
+type ResumeConfig struct {
+	// ManifestDir is the CheckpointAll's directory. The tasks are resumed
+	// if the manifest exists, and the manifest is renamed with .done
+	// suffix afterwards.
+	ManifestDir string `toml:"manifest_dir"`
+
+	// ColdStartOnFailure creates and starts the task from its container's
+	// spec and rootfs if the restore fails or the task failed to dump.
+	ColdStartOnFailure bool `toml:"cold_start_on_failure"`
+}
+
+// TaskResumeSummary is published once per namespace after the tasks in the
+// manifest are resumed.
+type TaskResumeSummary struct {
+	Restored    []string `json:"restored,omitempty"`
+	ColdStarted []string `json:"cold_started,omitempty"`
+	// Failed is the error by task ID.
+	Failed map[string]string `json:"failed,omitempty"`
+}
+
+// Field implements events.Event.
+func (e *TaskResumeSummary) Field(fieldpath []string) (string, bool) {
+	return "", false
+}
+
+// resumeFromManifest resumes the tasks in the manifest in dependency order.
+// It is no-op if the manifest doesn't exist.
+//
+// The restored task's stdout and stderr are written into the log file next
+// to its image, because the original fifos' reader is gone with the reboot.
+// The task dumped with terminal can't be restored without the console, and
+// it falls back to cold start if configured.
+func (manager *TaskManager) resumeFromManifest(ctx context.Context, cfg ResumeConfig) error {
+	manifest, err := ReadBulkCheckpointManifest(cfg.ManifestDir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+
+	order, err := sortResumeResults(manifest.Results)
+	if err != nil {
+		return err
+	}
+
+	summaries := make(map[string]*TaskResumeSummary)
+	for _, r := range order {
+		summary, ok := summaries[r.Namespace]
+		if !ok {
+			summary = &TaskResumeSummary{Failed: make(map[string]string)}
+			summaries[r.Namespace] = summary
+		}
+
+		// NOTE: The task is still running if it wasn't exited by dump
+		// and the node didn't reboot.
+		if _, err := manager.tasks.Get(namespaces.WithNamespace(ctx, r.Namespace), r.ID); err == nil {
+			log.G(ctx).Infof("task %s in namespace %s exists, skip resume", r.ID, r.Namespace)
+			continue
+		}
+
+		var restoreErr error
+		if r.Error == "" {
+			if restoreErr = manager.resumeTask(ctx, cfg.ManifestDir, r, true); restoreErr == nil {
+				summary.Restored = append(summary.Restored, r.ID)
+				continue
+			}
+			log.G(ctx).WithError(restoreErr).Warnf("failed to restore task %s in namespace %s", r.ID, r.Namespace)
+		} else {
+			restoreErr = fmt.Errorf("failed to dump: %s", r.Error)
+		}
+
+		if !cfg.ColdStartOnFailure {
+			summary.Failed[r.ID] = restoreErr.Error()
+			continue
+		}
+
+		if err := manager.resumeTask(ctx, cfg.ManifestDir, r, false); err != nil {
+			log.G(ctx).WithError(err).Warnf("failed to cold start task %s in namespace %s", r.ID, r.Namespace)
+			summary.Failed[r.ID] = fmt.Sprintf("%v, cold start: %v", restoreErr, err)
+			continue
+		}
+		summary.ColdStarted = append(summary.ColdStarted, r.ID)
+	}
+
+	for ns, summary := range summaries {
+		log.G(ctx).Infof("resumed tasks in namespace %s: %d restored, %d cold started, %d failed",
+			ns, len(summary.Restored), len(summary.ColdStarted), len(summary.Failed))
+		manager.publishEvent(ns, TaskResumeSummaryEventTopic, summary)
+	}
+
+	manifestPath := filepath.Join(cfg.ManifestDir, bulkCheckpointManifestFile)
+	return os.Rename(manifestPath, manifestPath+resumeDoneSuffix)
+}
+
+// resumeTask creates the task with its container's spec and rootfs, and
+// starts it. The task is restored from its image if fromImage is true. The
+// task is deleted if it fails to start.
+func (manager *TaskManager) resumeTask(ctx context.Context, dir string, r BulkCheckpointResult, fromImage bool) error {
+	ctx = namespaces.WithNamespace(ctx, r.Namespace)
+
+	container, err := manager.containers.Get(ctx, r.ID)
+	if err != nil {
+		return fmt.Errorf("failed to get container: %w", err)
+	}
+
+	if manager.snapshotter == nil {
+		return fmt.Errorf("snapshotter is unavailable: %w", errdefs.ErrNotImplemented)
+	}
+	sn := manager.snapshotter(container.Snapshotter)
+	if sn == nil {
+		return fmt.Errorf("snapshotter %s is unavailable: %w", container.Snapshotter, errdefs.ErrNotFound)
+	}
+
+	mounts, err := sn.Mounts(ctx, container.SnapshotKey)
+	if err != nil {
+		return fmt.Errorf("failed to get rootfs mounts: %w", err)
+	}
+
+	logURI := "file://" + filepath.Join(dir, r.Namespace, r.ID+".log")
+	opts := runtime.CreateOpts{
+		Rootfs: mounts,
+		IO: runtime.IO{
+			Stdout: logURI,
+			Stderr: logURI,
+		},
+	}
+	if fromImage {
+		opts.Checkpoint = r.ImagePath
+	}
+
+	t, err := manager.Create(ctx, r.ID, opts)
+	if err != nil {
+		return err
+	}
+
+	if err := t.Start(ctx); err != nil {
+		if _, derr := t.Delete(WithForceDelete(ctx)); derr != nil {
+			log.G(ctx).WithError(derr).Warnf("failed to delete task %s after failed start", r.ID)
+		}
+		return err
+	}
+	return nil
+}
+
+// sortResumeResults returns the results in dependency order. The task
+// depends on the tasks in its depends-on label, and the CRI container
+// depends on its pod's sandbox. The dependency which isn't in the manifest
+// is ignored.
+func sortResumeResults(results []BulkCheckpointResult) ([]BulkCheckpointResult, error) {
+	key := func(ns, id string) string {
+		return ns + "/" + id
+	}
+
+	var (
+		byKey     = make(map[string]BulkCheckpointResult, len(results))
+		sandboxes = make(map[string]string)
+	)
+	for _, r := range results {
+		byKey[key(r.Namespace, r.ID)] = r
+		if r.Labels[labelCRIKind] == "sandbox" && r.Labels[labelCRIPodUID] != "" {
+			sandboxes[key(r.Namespace, r.Labels[labelCRIPodUID])] = r.ID
+		}
+	}
+
+	members := make([]StartGroupMember, 0, len(results))
+	for _, r := range results {
+		m := StartGroupMember{ID: key(r.Namespace, r.ID)}
+
+		var deps []string
+		if v := r.Labels[labelResumeDependsOn]; v != "" {
+			deps = strings.Split(v, ",")
+		}
+		if r.Labels[labelCRIKind] == "container" {
+			if sandbox, ok := sandboxes[key(r.Namespace, r.Labels[labelCRIPodUID])]; ok {
+				deps = append(deps, sandbox)
+			}
+		}
+
+		seen := make(map[string]struct{}, len(deps))
+		for _, dep := range deps {
+			dep = key(r.Namespace, strings.TrimSpace(dep))
+			if _, ok := byKey[dep]; !ok || dep == m.ID {
+				continue
+			}
+			if _, ok := seen[dep]; !ok {
+				seen[dep] = struct{}{}
+				m.DependsOn = append(m.DependsOn, dep)
+			}
+		}
+		members = append(members, m)
+	}
+
+	order, err := sortStartGroup(members)
+	if err != nil {
+		return nil, err
+	}
+
+	sorted := make([]BulkCheckpointResult, 0, len(order))
+	for _, k := range order {
+		sorted = append(sorted, byKey[k])
+	}
+	return sorted, nil
+}
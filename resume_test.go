@@ -0,0 +1,79 @@
+//go:build linux
+// +build linux
+
+package embedshim
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/containerd/containerd/runtime"
+)
+
+func TestSortResumeResults(t *testing.T) {
+	results := []BulkCheckpointResult{
+		{Namespace: "k8s.io", ID: "app", Labels: map[string]string{
+			labelCRIKind: "container", labelCRIPodUID: "uid1",
+		}},
+		{Namespace: "k8s.io", ID: "sidecar", Labels: map[string]string{
+			labelCRIKind: "container", labelCRIPodUID: "uid1", labelResumeDependsOn: "app, missing",
+		}},
+		{Namespace: "k8s.io", ID: "pause", Labels: map[string]string{
+			labelCRIKind: "sandbox", labelCRIPodUID: "uid1",
+		}},
+		{Namespace: "default", ID: "app"},
+	}
+
+	sorted, err := sortResumeResults(results)
+	if err != nil {
+		t.Fatalf("failed to sort: %v", err)
+	}
+
+	var got []string
+	for _, r := range sorted {
+		got = append(got, r.Namespace+"/"+r.ID)
+	}
+	expected := []string{"k8s.io/pause", "k8s.io/app", "k8s.io/sidecar", "default/app"}
+	if !reflect.DeepEqual(got, expected) {
+		t.Fatalf("expected %v, but got %v", expected, got)
+	}
+
+	results[2].Labels[labelResumeDependsOn] = "sidecar"
+	if _, err := sortResumeResults(results); err == nil {
+		t.Fatalf("expected error for dependency cycle, but got nil")
+	}
+}
+
+func TestResumeFromManifest(t *testing.T) {
+	dir := t.TempDir()
+	manager := &TaskManager{tasks: runtime.NewTaskList()}
+
+	if err := manager.resumeFromManifest(context.Background(), ResumeConfig{ManifestDir: dir}); err != nil {
+		t.Fatalf("expected no-op without manifest, but got %v", err)
+	}
+
+	data, err := json.Marshal(&BulkCheckpointManifest{
+		Results: []BulkCheckpointResult{{Namespace: "default", ID: "c1", Error: "criu failed"}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	manifestPath := filepath.Join(dir, bulkCheckpointManifestFile)
+	if err := os.WriteFile(manifestPath, data, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := manager.resumeFromManifest(context.Background(), ResumeConfig{ManifestDir: dir}); err != nil {
+		t.Fatalf("failed to resume: %v", err)
+	}
+	if _, err := os.Stat(manifestPath); !os.IsNotExist(err) {
+		t.Fatalf("expected manifest renamed, but got %v", err)
+	}
+	if _, err := os.Stat(manifestPath + resumeDoneSuffix); err != nil {
+		t.Fatalf("expected done manifest, but got %v", err)
+	}
+}
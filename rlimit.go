@@ -0,0 +1,151 @@
+//go:build linux
+// +build linux
+
+package embedshim
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/containerd/containerd/errdefs"
+	"github.com/opencontainers/runtime-spec/specs-go"
+	"golang.org/x/sys/unix"
+)
+
+// rlimitResources maps the OCI rlimit type to the resource.
+var rlimitResources = map[string]int{
+	"RLIMIT_AS":         unix.RLIMIT_AS,
+	"RLIMIT_CORE":       unix.RLIMIT_CORE,
+	"RLIMIT_CPU":        unix.RLIMIT_CPU,
+	"RLIMIT_DATA":       unix.RLIMIT_DATA,
+	"RLIMIT_FSIZE":      unix.RLIMIT_FSIZE,
+	"RLIMIT_LOCKS":      unix.RLIMIT_LOCKS,
+	"RLIMIT_MEMLOCK":    unix.RLIMIT_MEMLOCK,
+	"RLIMIT_MSGQUEUE":   unix.RLIMIT_MSGQUEUE,
+	"RLIMIT_NICE":       unix.RLIMIT_NICE,
+	"RLIMIT_NOFILE":     unix.RLIMIT_NOFILE,
+	"RLIMIT_NPROC":      unix.RLIMIT_NPROC,
+	"RLIMIT_RSS":        unix.RLIMIT_RSS,
+	"RLIMIT_RTPRIO":     unix.RLIMIT_RTPRIO,
+	"RLIMIT_RTTIME":     unix.RLIMIT_RTTIME,
+	"RLIMIT_SIGPENDING": unix.RLIMIT_SIGPENDING,
+	"RLIMIT_STACK":      unix.RLIMIT_STACK,
+}
+
+// RlimitUpdateOpts is used to update the rlimits of running task.
+type RlimitUpdateOpts struct {
+	// Rlimits are the new limits in OCI format.
+	Rlimits []specs.POSIXRlimit
+	// AllProcesses applies the limits to all the processes in the task's
+	// cgroup. Otherwise, only the init process is updated.
+	AllProcesses bool
+}
+
+// RlimitResult is the result of updating one process's rlimits.
+type RlimitResult struct {
+	Pid int
+	Err error
+}
+
+// UpdateRlimits adjusts the rlimits of the running task by prlimit(2)
+// without restart, for instance, raising RLIMIT_NOFILE.
+//
+// The returned error is about the validation. The failure of each process is
+// reported in the results.
+func (manager *TaskManager) UpdateRlimits(ctx context.Context, id string, opts RlimitUpdateOpts) ([]RlimitResult, error) {
+	t, err := manager.tasks.Get(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+
+	s, ok := t.(*shim)
+	if !ok {
+		return nil, fmt.Errorf("task %s is not managed by embedshim: %w", id, errdefs.ErrNotImplemented)
+	}
+	return s.updateRlimits(ctx, opts)
+}
+
+func (s *shim) updateRlimits(ctx context.Context, opts RlimitUpdateOpts) ([]RlimitResult, error) {
+	if err := validateRlimits(opts.Rlimits); err != nil {
+		return nil, err
+	}
+
+	st, err := s.init.Status(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if st != "running" && st != "paused" {
+		return nil, fmt.Errorf("rlimits can't be updated in %s state: %w", st, errdefs.ErrFailedPrecondition)
+	}
+
+	pids := []int{s.init.Pid()}
+	if opts.AllProcesses {
+		pids, err = s.cgroupPids()
+		if err != nil {
+			return nil, fmt.Errorf("failed to list processes in cgroup: %w", err)
+		}
+	}
+
+	results := make([]RlimitResult, 0, len(pids))
+	for _, pid := range pids {
+		results = append(results, RlimitResult{
+			Pid: pid,
+			Err: prlimit(pid, opts.Rlimits),
+		})
+	}
+	return results, nil
+}
+
+func prlimit(pid int, rlimits []specs.POSIXRlimit) error {
+	for _, rl := range rlimits {
+		limit := unix.Rlimit{Cur: rl.Soft, Max: rl.Hard}
+
+		if err := unix.Prlimit(pid, rlimitResources[rl.Type], &limit, nil); err != nil {
+			return fmt.Errorf("failed to set %s: %w", rl.Type, err)
+		}
+	}
+	return nil
+}
+
+func validateRlimits(rlimits []specs.POSIXRlimit) error {
+	if len(rlimits) == 0 {
+		return fmt.Errorf("rlimits are required: %w", errdefs.ErrInvalidArgument)
+	}
+
+	for _, rl := range rlimits {
+		if _, ok := rlimitResources[rl.Type]; !ok {
+			return fmt.Errorf("unknown rlimit type %s: %w", rl.Type, errdefs.ErrInvalidArgument)
+		}
+
+		if rl.Soft > rl.Hard {
+			return fmt.Errorf("soft limit %d of %s exceeds hard limit %d: %w",
+				rl.Soft, rl.Type, rl.Hard, errdefs.ErrInvalidArgument)
+		}
+
+		// NOTE: The hard limit of RLIMIT_NOFILE can't exceed the
+		// fs.nr_open even if the caller has CAP_SYS_RESOURCE.
+		if rl.Type == "RLIMIT_NOFILE" {
+			nrOpen, err := readNrOpen()
+			if err != nil {
+				return err
+			}
+
+			if rl.Hard > nrOpen {
+				return fmt.Errorf("hard limit %d of RLIMIT_NOFILE exceeds fs.nr_open %d: %w",
+					rl.Hard, nrOpen, errdefs.ErrInvalidArgument)
+			}
+		}
+	}
+	return nil
+}
+
+func readNrOpen() (uint64, error) {
+	value, err := os.ReadFile("/proc/sys/fs/nr_open")
+	if err != nil {
+		return 0, err
+	}
+	return strconv.ParseUint(strings.TrimSpace(string(value)), 10, 64)
+}
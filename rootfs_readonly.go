@@ -0,0 +1,68 @@
+//go:build linux
+// +build linux
+
+package embedshim
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/containerd/containerd/errdefs"
+	"github.com/containerd/containerd/log"
+	"golang.org/x/sys/unix"
+)
+
+// SetRootfsReadOnly flips the container's rootfs mount between read-only and
+// read-write at runtime, like locking down the container after the
+// initialization completes. The submounts, like /proc and the volumes, are
+// not changed.
+//
+// The mount is changed by mount_setattr(2) on the container's root, which is
+// opened in the container's mount namespace. It requires kernel 5.12.
+//
+// NOTE: The change isn't persisted. The restarted init process uses the
+// spec's root.readonly.
+func (manager *TaskManager) SetRootfsReadOnly(ctx context.Context, id string, readonly bool) error {
+	rootFD, err := manager.openContainerRoot(ctx, id)
+	if err != nil {
+		return err
+	}
+	defer unix.Close(rootFD)
+
+	if err := setMountReadOnly(rootFD, readonly); err != nil {
+		return fmt.Errorf("failed to set rootfs of task %s readonly=%v: %w", id, readonly, err)
+	}
+
+	log.G(ctx).Infof("rootfs of task %s is remounted with readonly=%v", id, readonly)
+	return nil
+}
+
+// setMountReadOnly changes the read-only flag of the mount which fd refers
+// to.
+func setMountReadOnly(fd int, readonly bool) error {
+	attr := &unix.MountAttr{}
+	if readonly {
+		attr.Attr_set = unix.MOUNT_ATTR_RDONLY
+	} else {
+		attr.Attr_clr = unix.MOUNT_ATTR_RDONLY
+	}
+
+	err := unix.MountSetattr(fd, "", unix.AT_EMPTY_PATH, attr)
+	switch {
+	case err == nil:
+		return nil
+	case errors.Is(err, unix.ENOSYS):
+		return fmt.Errorf("mount_setattr requires kernel 5.12: %w", errdefs.ErrNotImplemented)
+	case errors.Is(err, unix.EBUSY):
+		// NOTE: The mount can't be read-only if there is any file
+		// opened for writing.
+		return fmt.Errorf("rootfs has files opened for writing: %v: %w", err, errdefs.ErrFailedPrecondition)
+	case errors.Is(err, unix.EPERM):
+		// The read-only flag is locked if the mount is propagated into
+		// the less privileged user namespace.
+		return fmt.Errorf("rootfs read-only flag is locked: %v: %w", err, errdefs.ErrFailedPrecondition)
+	default:
+		return err
+	}
+}
@@ -0,0 +1,47 @@
+//go:build linux
+// +build linux
+
+package embedshim
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/containerd/containerd/errdefs"
+	"golang.org/x/sys/unix"
+)
+
+func TestSetMountReadOnly(t *testing.T) {
+	dir := t.TempDir()
+	if err := unix.Mount("tmpfs", dir, "tmpfs", 0, ""); err != nil {
+		t.Skipf("tmpfs mount is unavailable: %v", err)
+	}
+	defer unix.Unmount(dir, unix.MNT_DETACH)
+
+	fd, err := unix.Open(dir, unix.O_PATH|unix.O_DIRECTORY|unix.O_CLOEXEC, 0)
+	if err != nil {
+		t.Fatalf("failed to open %s: %v", dir, err)
+	}
+	defer unix.Close(fd)
+
+	if err := setMountReadOnly(fd, true); err != nil {
+		if errors.Is(err, errdefs.ErrNotImplemented) {
+			t.Skipf("mount_setattr is unavailable: %v", err)
+		}
+		t.Fatalf("failed to set mount readonly: %v", err)
+	}
+
+	err = os.WriteFile(filepath.Join(dir, "file"), nil, 0600)
+	if !errors.Is(err, unix.EROFS) {
+		t.Fatalf("expected EROFS, but got %v", err)
+	}
+
+	if err := setMountReadOnly(fd, false); err != nil {
+		t.Fatalf("failed to set mount read-write: %v", err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "file"), nil, 0600); err != nil {
+		t.Fatalf("expected writable rootfs, but got %v", err)
+	}
+}
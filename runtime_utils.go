@@ -1,3 +1,6 @@
+//go:build linux
+// +build linux
+
 /*
    Copyright The containerd Authors.
 
@@ -36,12 +39,12 @@ const (
 	runcRoot = "/run/containerd/runc"
 )
 
-func newRuncRuntime(root, path, namespace, runtime, criu string, systemd bool) *runc.Runc {
+func newRuncRuntime(root, path, namespace, runtime, criu string, systemd bool) *runcRuntime {
 	if root == "" {
 		root = runcRoot
 	}
 
-	return &runc.Runc{
+	return &runcRuntime{Runc: &runc.Runc{
 		Command:   runtime,
 		Log:       filepath.Join(path, "log.json"),
 		LogFormat: runc.JSON,
@@ -55,7 +58,7 @@ func newRuncRuntime(root, path, namespace, runtime, criu string, systemd bool) *
 		Root:          filepath.Join(root, namespace),
 		Criu:          criu,
 		SystemdCgroup: systemd,
-	}
+	}}
 }
 
 func getLastRuntimeError(r *runc.Runc) (string, error) {
@@ -113,7 +116,7 @@ func checkRuncInitAlive(init *initProcess) error {
 		id  = init.ID()
 		pid = init.pid
 
-		execFIFO  = filepath.Join(init.runtime.Root, id, "exec.fifo")
+		execFIFO  = filepath.Join(init.runtime.RootDir(), id, "exec.fifo")
 		procFDDir = filepath.Join("/proc", strconv.Itoa(pid), "fd")
 	)
 
@@ -0,0 +1,28 @@
+//go:build linux
+// +build linux
+
+package embedshim
+
+import (
+	"testing"
+)
+
+func TestExitStatus(t *testing.T) {
+	for _, tc := range []struct {
+		status   int
+		expected int
+	}{
+		// exit(0)
+		{status: 0, expected: 0},
+		// exit(3)
+		{status: 3 << 8, expected: 3},
+		// killed by SIGKILL
+		{status: 9, expected: 137},
+		// killed by SIGSEGV with core dump
+		{status: 11 | 0x80, expected: 139},
+	} {
+		if got := exitStatus(tc.status); got != tc.expected {
+			t.Fatalf("expected %v for wait status %#x, but got %v", tc.expected, tc.status, got)
+		}
+	}
+}
@@ -0,0 +1,171 @@
+//go:build linux
+// +build linux
+
+package embedshim
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/containerd/containerd/errdefs"
+	"golang.org/x/sys/unix"
+)
+
+// schedPolicies maps the annotation value to the scheduling policy.
+var schedPolicies = map[string]uint32{
+	"other": unix.SCHED_NORMAL,
+	"batch": unix.SCHED_BATCH,
+	"idle":  unix.SCHED_IDLE,
+	"fifo":  unix.SCHED_FIFO,
+	"rr":    unix.SCHED_RR,
+}
+
+// schedConfig is the init process's scheduling attributes, which are beyond
+// the OCI spec, for latency tiering on shared nodes.
+type schedConfig struct {
+	// policy is nil if the policy isn't changed.
+	policy   *uint32
+	priority uint32
+	// nice is nil if the nice value isn't changed.
+	nice *int
+	// cpus is nil if the affinity isn't changed.
+	cpus *unix.CPUSet
+}
+
+func schedConfigFromAnnotations(annotations map[string]string) (*schedConfig, error) {
+	var (
+		cfg     schedConfig
+		changed bool
+	)
+
+	if v := annotations[annotationSchedPolicy]; v != "" {
+		policy, ok := schedPolicies[v]
+		if !ok {
+			return nil, fmt.Errorf("invalid annotation %s=%q: %w", annotationSchedPolicy, v, errdefs.ErrInvalidArgument)
+		}
+		cfg.policy, changed = &policy, true
+	}
+
+	realtime := cfg.policy != nil && (*cfg.policy == unix.SCHED_FIFO || *cfg.policy == unix.SCHED_RR)
+	if v := annotations[annotationSchedPriority]; v != "" {
+		prio, err := strconv.ParseUint(v, 10, 32)
+		if err != nil || prio < 1 || prio > 99 {
+			return nil, fmt.Errorf("invalid annotation %s=%q, expected [1, 99]: %w", annotationSchedPriority, v, errdefs.ErrInvalidArgument)
+		}
+		if !realtime {
+			return nil, fmt.Errorf("annotation %s requires fifo or rr policy: %w", annotationSchedPriority, errdefs.ErrInvalidArgument)
+		}
+		cfg.priority = uint32(prio)
+	} else if realtime {
+		return nil, fmt.Errorf("annotation %s is required by fifo or rr policy: %w", annotationSchedPriority, errdefs.ErrInvalidArgument)
+	}
+
+	if v := annotations[annotationSchedNice]; v != "" {
+		nice, err := strconv.Atoi(v)
+		if err != nil || nice < -20 || nice > 19 {
+			return nil, fmt.Errorf("invalid annotation %s=%q, expected [-20, 19]: %w", annotationSchedNice, v, errdefs.ErrInvalidArgument)
+		}
+		if realtime {
+			return nil, fmt.Errorf("annotation %s can't be used with fifo or rr policy: %w", annotationSchedNice, errdefs.ErrInvalidArgument)
+		}
+		cfg.nice, changed = &nice, true
+	}
+
+	if v := annotations[annotationSchedCPUs]; v != "" {
+		cpus, err := parseCPUList(v)
+		if err != nil {
+			return nil, fmt.Errorf("invalid annotation %s=%q: %v: %w", annotationSchedCPUs, v, err, errdefs.ErrInvalidArgument)
+		}
+		cfg.cpus, changed = cpus, true
+	}
+
+	if !changed {
+		return nil, nil
+	}
+	return &cfg, nil
+}
+
+// parseCPUList parses the cpu list, like "0-3,6".
+func parseCPUList(v string) (*unix.CPUSet, error) {
+	var set unix.CPUSet
+	for _, part := range strings.Split(v, ",") {
+		bounds := strings.SplitN(strings.TrimSpace(part), "-", 2)
+
+		start, err := strconv.Atoi(bounds[0])
+		if err != nil {
+			return nil, err
+		}
+		end := start
+		if len(bounds) == 2 {
+			if end, err = strconv.Atoi(bounds[1]); err != nil {
+				return nil, err
+			}
+		}
+
+		if start < 0 || end < start || end >= len(set)*64 {
+			return nil, fmt.Errorf("invalid cpu range %q", part)
+		}
+		for cpu := start; cpu <= end; cpu++ {
+			set.Set(cpu)
+		}
+	}
+	return &set, nil
+}
+
+// apply applies the scheduling attributes to all the threads of the
+// process.
+//
+// NOTE: It is applied on the runc-init before starting so that the workload
+// inherits them from the first instruction. The attributes are kept across
+// execve.
+func (cfg *schedConfig) apply(pid int) error {
+	tids, err := os.ReadDir(filepath.Join("/proc", strconv.Itoa(pid), "task"))
+	if err != nil {
+		return err
+	}
+
+	for _, entry := range tids {
+		tid, err := strconv.Atoi(entry.Name())
+		if err != nil {
+			continue
+		}
+
+		if err := cfg.applyThread(tid); err != nil {
+			// The thread might exit.
+			if err == unix.ESRCH {
+				continue
+			}
+			return fmt.Errorf("failed to apply scheduling attributes on thread %d: %w", tid, err)
+		}
+	}
+	return nil
+}
+
+func (cfg *schedConfig) applyThread(tid int) error {
+	if cfg.policy != nil {
+		attr := &unix.SchedAttr{
+			Policy:   *cfg.policy,
+			Priority: cfg.priority,
+		}
+		if cfg.nice != nil {
+			attr.Nice = int32(*cfg.nice)
+		}
+		if err := unix.SchedSetAttr(tid, attr, 0); err != nil {
+			return err
+		}
+	} else if cfg.nice != nil {
+		if err := unix.Setpriority(unix.PRIO_PROCESS, tid, *cfg.nice); err != nil {
+			return err
+		}
+	}
+
+	if cfg.cpus != nil {
+		if err := unix.SchedSetaffinity(tid, cfg.cpus); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,94 @@
+#!/usr/bin/env bash
+
+# Runs critest against embedshim-containerd with the embed runtime as the CRI
+# default runtime. The containerd is started with temporary root and state
+# directories so that it doesn't touch the host's containerd.
+#
+# Environment variables:
+#
+#   CRITEST_SUBSET      one of all, lifecycle, exec, attach and stop. The
+#                       default is all.
+#   CRITEST_FOCUS       ginkgo focus regex, which overrides CRITEST_SUBSET.
+#   CRITEST_SKIP        ginkgo skip regex.
+#   CRITEST_PARALLEL    the number of parallel nodes. The default is 8.
+#   CRITEST_REPORT_DIR  the directory of junit reports.
+#   CONTAINERD_BIN      the default is /usr/local/bin/embedshim-containerd.
+
+set -euo pipefail
+
+readonly CONTAINERD_BIN="${CONTAINERD_BIN:-/usr/local/bin/embedshim-containerd}"
+readonly CRITEST_SUBSET="${CRITEST_SUBSET:-all}"
+readonly CRITEST_SKIP="${CRITEST_SKIP:-}"
+readonly CRITEST_PARALLEL="${CRITEST_PARALLEL:-8}"
+readonly CRITEST_REPORT_DIR="${CRITEST_REPORT_DIR:-}"
+
+subset_focus() {
+  case "$1" in
+    all)       echo "" ;;
+    lifecycle) echo "runtime should support (basic operations on container|starting container|stopping container|removing)" ;;
+    exec)      echo "runtime should support (exec|execSync)" ;;
+    attach)    echo "runtime should support (attach|.*tty)" ;;
+    stop)      echo "runtime should support (stopping container|removing a running container)" ;;
+    *)
+      echo "unknown CRITEST_SUBSET $1" >&2
+      return 1
+      ;;
+  esac
+}
+
+CRITEST_FOCUS="${CRITEST_FOCUS:-$(subset_focus "${CRITEST_SUBSET}")}"
+
+BDIR="$(mktemp -d -p "${PWD}")"
+mkdir -p "${BDIR}"/{root,state}
+
+cleanup() {
+  if [ -n "${CONTAINERD_PID:-}" ]; then
+    sudo kill -9 "${CONTAINERD_PID}" || true
+    wait "${CONTAINERD_PID}" 2>/dev/null || true
+  fi
+
+  sudo -E umount "${BDIR}/root/io.containerd.runtime.v1.embed/.exitsnoop.bpf" 2>/dev/null || true
+  sudo -E rm -rf "${BDIR}"
+}
+trap cleanup EXIT
+
+cat > "${BDIR}/config.toml" <<EOT
+version = 2
+[plugins."io.containerd.grpc.v1.cri".containerd.runtimes.runc]
+  runtime_type = "io.containerd.runtime.v1.embed"
+EOT
+
+sudo -E PATH="${PATH}" "${CONTAINERD_BIN}" \
+  -a "${BDIR}/c.sock" \
+  --config "${BDIR}/config.toml" \
+  --root "${BDIR}/root" \
+  --state "${BDIR}/state" \
+  --log-level debug &> "${BDIR}/containerd-cri.log" &
+CONTAINERD_PID=$!
+
+for _ in $(seq 1 30); do
+  if sudo -E PATH="${PATH}" ctr -a "${BDIR}/c.sock" version &> /dev/null; then
+    break
+  fi
+  sleep 1
+done
+sudo -E PATH="${PATH}" ctr -a "${BDIR}/c.sock" version
+
+args=(--runtime-endpoint="unix:///${BDIR}/c.sock" --parallel="${CRITEST_PARALLEL}")
+if [ -n "${CRITEST_REPORT_DIR}" ]; then
+  args+=(--report-dir "${CRITEST_REPORT_DIR}")
+fi
+if [ -n "${CRITEST_FOCUS}" ]; then
+  args+=(--ginkgo.focus "${CRITEST_FOCUS}")
+fi
+if [ -n "${CRITEST_SKIP}" ]; then
+  args+=(--ginkgo.skip "${CRITEST_SKIP}")
+fi
+
+set +e
+sudo -E PATH="${PATH}" critest "${args[@]}"
+TEST_RC=$?
+set -e
+
+test "${TEST_RC}" -ne 0 && cat "${BDIR}/containerd-cri.log"
+exit "${TEST_RC}"
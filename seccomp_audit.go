@@ -0,0 +1,351 @@
+//go:build linux
+// +build linux
+
+package embedshim
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/containerd/containerd/log"
+	"github.com/containerd/typeurl"
+	"golang.org/x/sys/unix"
+)
+
+// TaskSeccompAuditEventTopic is the topic of TaskSeccompAudit event.
+const TaskSeccompAuditEventTopic = "/tasks/seccomp-audit"
+
+func init() {
+	typeurl.Register(&TaskSeccompAudit{}, "io.embedshim.events.v1", "TaskSeccompAudit")
+}
+
+var (
+	// seccompAuditSourceKmsg reads the audit records from kernel log, which
+	// is used if auditd isn't running.
+	seccompAuditSourceKmsg = "kmsg"
+
+	// seccompAuditPollInterval is the interval to poll the audit log file
+	// for new records.
+	seccompAuditPollInterval = time.Second
+)
+
+// SeccompAuditConfig collects the seccomp audit records, like the syscalls
+// logged by SCMP_ACT_LOG, and publishes them as TaskSeccompAudit events.
+//
+// The kernel logs the actions listed in /proc/sys/kernel/seccomp/actions_logged.
+type SeccompAuditConfig struct {
+	// Enabled collects the seccomp audit records.
+	Enabled bool `toml:"enabled"`
+	// Source is "kmsg" or the path of auditd's log file, like
+	// "/var/log/audit/audit.log". The default is "kmsg". The kernel sends
+	// the records to auditd instead of kernel log if auditd is running.
+	Source string `toml:"source"`
+}
+
+// TaskSeccompAudit is published when the task's process makes the syscall
+// logged by seccomp.
+type TaskSeccompAudit struct {
+	ContainerID string    `json:"container_id"`
+	Pid         uint32    `json:"pid"`
+	Comm        string    `json:"comm"`
+	Exe         string    `json:"exe"`
+	Arch        string    `json:"arch"`
+	Syscall     uint32    `json:"syscall"`
+	Action      string    `json:"action"`
+	Timestamp   time.Time `json:"timestamp"`
+}
+
+// Field implements events.Event.
+func (e *TaskSeccompAudit) Field(fieldpath []string) (string, bool) {
+	if len(fieldpath) == 0 {
+		return "", false
+	}
+
+	switch fieldpath[0] {
+	case "container_id":
+		return e.ContainerID, len(e.ContainerID) > 0
+	case "action":
+		return e.Action, len(e.Action) > 0
+	}
+	return "", false
+}
+
+// seccompActions maps the SECCOMP_RET_ACTION_FULL to libseccomp's name.
+var seccompActions = map[uint32]string{
+	0x80000000: "SCMP_ACT_KILL_PROCESS",
+	0x00000000: "SCMP_ACT_KILL_THREAD",
+	0x00030000: "SCMP_ACT_TRAP",
+	0x00050000: "SCMP_ACT_ERRNO",
+	0x7fc00000: "SCMP_ACT_NOTIFY",
+	0x7ff00000: "SCMP_ACT_TRACE",
+	0x7ffc0000: "SCMP_ACT_LOG",
+	0x7fff0000: "SCMP_ACT_ALLOW",
+}
+
+// parseSeccompAuditRecord parses the AUDIT_SECCOMP record from kernel log or
+// auditd's log. The task isn't resolved. It returns false if the line isn't
+// seccomp record.
+//
+//	audit: type=1326 audit(1690000000.123:45): ... pid=1234 comm="ls" exe="/usr/bin/ls" sig=0 arch=c000003e syscall=39 compat=0 ip=0x7f code=0x7ffc0000
+//	type=SECCOMP msg=audit(1690000000.123:45): ... pid=1234 comm="ls" exe="/usr/bin/ls" sig=0 arch=c000003e syscall=39 compat=0 ip=0x7f code=0x7ffc0000
+func parseSeccompAuditRecord(line string) (*TaskSeccompAudit, bool) {
+	if !strings.Contains(line, "type=1326 ") && !strings.Contains(line, "type=SECCOMP ") {
+		return nil, false
+	}
+
+	ev := &TaskSeccompAudit{}
+	// The timestamp is "msg=audit(...)" in auditd's log, but the bare
+	// "audit(...)" in kmsg.
+	if idx := strings.Index(line, "audit("); idx >= 0 {
+		ev.Timestamp = parseAuditTimestamp(line[idx:])
+	}
+
+	for _, field := range strings.Fields(line) {
+		idx := strings.IndexByte(field, '=')
+		if idx < 0 {
+			continue
+		}
+		key, value := field[:idx], strings.Trim(field[idx+1:], `"`)
+
+		switch key {
+		case "pid":
+			pid, err := strconv.ParseUint(value, 10, 32)
+			if err != nil {
+				return nil, false
+			}
+			ev.Pid = uint32(pid)
+		case "comm":
+			ev.Comm = value
+		case "exe":
+			ev.Exe = value
+		case "arch":
+			ev.Arch = value
+		case "syscall":
+			nr, err := strconv.ParseUint(value, 10, 32)
+			if err != nil {
+				return nil, false
+			}
+			ev.Syscall = uint32(nr)
+		case "code":
+			code, err := strconv.ParseUint(strings.TrimPrefix(value, "0x"), 16, 32)
+			if err != nil {
+				return nil, false
+			}
+			ev.Action = seccompActionName(uint32(code))
+		}
+	}
+
+	if ev.Pid == 0 {
+		return nil, false
+	}
+	return ev, true
+}
+
+func seccompActionName(code uint32) string {
+	// SECCOMP_RET_ACTION_FULL
+	if name, ok := seccompActions[code&0xffff0000]; ok {
+		return name
+	}
+	return fmt.Sprintf("0x%08x", code)
+}
+
+// parseAuditTimestamp parses "audit(1690000000.123:45):", which might be
+// followed by the rest of the record. It returns the zero time if the value
+// is invalid.
+func parseAuditTimestamp(value string) time.Time {
+	value = strings.TrimPrefix(value, "audit(")
+	if idx := strings.IndexByte(value, ':'); idx >= 0 {
+		value = value[:idx]
+	}
+
+	idx := strings.IndexByte(value, '.')
+	if idx < 0 {
+		return time.Time{}
+	}
+
+	secs, err := strconv.ParseInt(value[:idx], 10, 64)
+	if err != nil {
+		return time.Time{}
+	}
+	msecs, err := strconv.ParseInt(value[idx+1:], 10, 64)
+	if err != nil {
+		return time.Time{}
+	}
+	return time.Unix(secs, msecs*int64(time.Millisecond))
+}
+
+// collectSeccompAudit reads the seccomp records from the source and
+// publishes the ones attributable to tasks. It runs until the source fails.
+func (manager *TaskManager) collectSeccompAudit(cfg SeccompAuditConfig) {
+	ctx := context.Background()
+
+	source := cfg.Source
+	if source == "" {
+		source = seccompAuditSourceKmsg
+	}
+
+	var err error
+	if source == seccompAuditSourceKmsg {
+		err = readKmsg(manager.handleSeccompAuditLine)
+	} else {
+		err = tailFile(source, seccompAuditPollInterval, manager.handleSeccompAuditLine)
+	}
+	log.G(ctx).WithError(err).Errorf("stopped collecting seccomp audit records from %s", source)
+}
+
+func (manager *TaskManager) handleSeccompAuditLine(line string) {
+	ev, ok := parseSeccompAuditRecord(line)
+	if !ok {
+		return
+	}
+
+	ref, ok := manager.taskByHostPid(ev.Pid)
+	if !ok {
+		return
+	}
+	ev.ContainerID = ref.ID
+	manager.publishEvent(ref.Namespace, TaskSeccompAuditEventTopic, ev)
+}
+
+// taskByHostPid resolves the host pid to task by the cgroup ID, or the pid
+// namespace on cgroup v1. It returns false if the process has exited or it
+// doesn't belong to any task.
+func (manager *TaskManager) taskByHostPid(pid uint32) (TaskRef, bool) {
+	if cgroupID, err := pidCgroupID(int(pid)); err == nil {
+		if ref, ok := manager.cgroupIDs.get(cgroupID); ok {
+			return ref, true
+		}
+	}
+
+	pidnsInode, err := pidNamespaceInode(int(pid))
+	if err != nil {
+		return TaskRef{}, false
+	}
+
+	tasks, err := manager.tasks.GetAll(context.Background(), true)
+	if err != nil {
+		return TaskRef{}, false
+	}
+	for _, t := range tasks {
+		s, ok := t.(*shim)
+		if !ok {
+			continue
+		}
+		if s.loadedIdentity().PidNamespaceInode == pidnsInode {
+			return TaskRef{Namespace: s.Namespace(), ID: s.ID()}, true
+		}
+	}
+	return TaskRef{}, false
+}
+
+// readKmsg reads the new kernel log records from /dev/kmsg. Each record is
+// "<prio>,<seq>,<ts>,<flags>;<message>".
+func readKmsg(fn func(line string)) error {
+	f, err := os.OpenFile("/dev/kmsg", os.O_RDONLY, 0)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	// skip the existing records
+	if _, err := f.Seek(0, io.SeekEnd); err != nil {
+		return err
+	}
+
+	buf := make([]byte, 8192)
+	for {
+		n, err := f.Read(buf)
+		if err != nil {
+			// EPIPE means that the records are overwritten before read
+			if errors.Is(err, unix.EPIPE) || errors.Is(err, unix.EINTR) {
+				continue
+			}
+			return err
+		}
+
+		record := string(buf[:n])
+		if idx := strings.IndexByte(record, ';'); idx >= 0 {
+			record = record[idx+1:]
+		}
+		if idx := strings.IndexByte(record, '\n'); idx >= 0 {
+			record = record[:idx]
+		}
+		fn(record)
+	}
+}
+
+// tailFile reads the new lines appended to the file. The file is reopened
+// if it is rotated.
+func tailFile(path string, interval time.Duration, fn func(line string)) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		f.Close()
+	}()
+
+	if _, err := f.Seek(0, io.SeekEnd); err != nil {
+		return err
+	}
+
+	r := bufio.NewReader(f)
+	var partial string
+	for {
+		line, err := r.ReadString('\n')
+		if err == nil {
+			fn(partial + strings.TrimSuffix(line, "\n"))
+			partial = ""
+			continue
+		}
+		if err != io.EOF {
+			return err
+		}
+		partial += line
+
+		time.Sleep(interval)
+
+		rotated, rerr := fileRotated(f, path)
+		if rerr != nil || !rotated {
+			continue
+		}
+
+		nf, oerr := os.Open(path)
+		if oerr != nil {
+			continue
+		}
+		f.Close()
+		f, partial = nf, ""
+		r.Reset(f)
+	}
+}
+
+// fileRotated returns true if the path refers to the other file, or the file
+// is truncated.
+func fileRotated(f *os.File, path string) (bool, error) {
+	cur, err := f.Stat()
+	if err != nil {
+		return false, err
+	}
+
+	fi, err := os.Stat(path)
+	if err != nil {
+		return false, err
+	}
+	if !os.SameFile(cur, fi) {
+		return true, nil
+	}
+
+	offset, err := f.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return false, err
+	}
+	return fi.Size() < offset, nil
+}
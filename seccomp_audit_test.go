@@ -0,0 +1,55 @@
+//go:build linux
+// +build linux
+
+package embedshim
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseSeccompAuditRecord(t *testing.T) {
+	for _, line := range []string{
+		`audit: type=1326 audit(1690000000.500:45): auid=4294967295 uid=0 gid=0 ses=4294967295 subj=unconfined pid=1234 comm="ls" exe="/usr/bin/ls" sig=0 arch=c000003e syscall=39 compat=0 ip=0x7f0a code=0x7ffc0000`,
+		`type=SECCOMP msg=audit(1690000000.500:45): auid=4294967295 uid=0 gid=0 ses=4294967295 subj=unconfined pid=1234 comm="ls" exe="/usr/bin/ls" sig=0 arch=c000003e syscall=39 compat=0 ip=0x7f0a code=0x7ffc0000`,
+	} {
+		ev, ok := parseSeccompAuditRecord(line)
+		if !ok {
+			t.Fatalf("expected seccomp record, but got none from %q", line)
+		}
+
+		expected := TaskSeccompAudit{
+			Pid:       1234,
+			Comm:      "ls",
+			Exe:       "/usr/bin/ls",
+			Arch:      "c000003e",
+			Syscall:   39,
+			Action:    "SCMP_ACT_LOG",
+			Timestamp: time.Unix(1690000000, int64(500*time.Millisecond)),
+		}
+		if !ev.Timestamp.Equal(expected.Timestamp) {
+			t.Fatalf("expected %v, but got %v", expected.Timestamp, ev.Timestamp)
+		}
+		ev.Timestamp = expected.Timestamp
+		if *ev != expected {
+			t.Fatalf("expected %+v, but got %+v", expected, *ev)
+		}
+	}
+
+	if _, ok := parseSeccompAuditRecord(`audit: type=1400 audit(1690000000.500:46): apparmor="DENIED" pid=1234`); ok {
+		t.Fatalf("expected non-seccomp record to be ignored")
+	}
+}
+
+func TestSeccompActionName(t *testing.T) {
+	for code, expected := range map[uint32]string{
+		0x7ffc0000: "SCMP_ACT_LOG",
+		0x00050001: "SCMP_ACT_ERRNO",
+		0x80000000: "SCMP_ACT_KILL_PROCESS",
+		0x12340000: "0x12340000",
+	} {
+		if got := seccompActionName(code); got != expected {
+			t.Fatalf("expected %v, but got %v", expected, got)
+		}
+	}
+}
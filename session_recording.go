@@ -0,0 +1,418 @@
+//go:build linux
+// +build linux
+
+package embedshim
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	pkgbundle "github.com/fuweid/embedshim/pkg/bundle"
+
+	"github.com/containerd/console"
+	"github.com/containerd/containerd/log"
+	"github.com/containerd/containerd/pkg/stdio"
+	"github.com/containerd/typeurl"
+	"github.com/opencontainers/runtime-spec/specs-go"
+)
+
+// TaskSessionRecordedEventTopic is the topic of TaskSessionRecorded event.
+const TaskSessionRecordedEventTopic = "/tasks/session-recorded"
+
+func init() {
+	typeurl.Register(&TaskSessionRecorded{}, "io.embedshim.events.v1", "TaskSessionRecorded")
+}
+
+var (
+	// sessionRecordingExt is the extension of the asciinema v2 file.
+	sessionRecordingExt = ".cast"
+
+	// defaultSessionWinSize is used in the recording's header if the
+	// process doesn't specify the console size.
+	defaultSessionWinSize = console.WinSize{Width: 80, Height: 24}
+)
+
+// SessionRecordingConfig records the terminal sessions of the init and exec
+// processes into the asciinema v2 files with timing data, which can be
+// replayed by `asciinema play`.
+//
+// The files are stored in Dir named like "<namespace>/<id>/<exec-id>-<unix-nano>.cast".
+// The init process's exec id is "init".
+type SessionRecordingConfig struct {
+	// Dir is where the recordings are stored. The recording is disabled
+	// if it is empty.
+	Dir string `toml:"dir"`
+	// MaxBytes is the size cap of one recording. The output after the cap
+	// is dropped and the recording ends with a "truncated" marker. Zero
+	// means no limit.
+	MaxBytes int64 `toml:"max_bytes"`
+	// Retention is how long the recordings are kept, like "720h". Zero
+	// means forever.
+	Retention string `toml:"retention"`
+	// MaxFiles is the max number of the recordings kept in Dir. The
+	// oldest ones are removed first. Zero means no limit.
+	MaxFiles int `toml:"max_files"`
+	// RecordInput records the terminal's input as "i" events, which might
+	// contain the secrets typed by the user, like password.
+	RecordInput bool `toml:"record_input"`
+}
+
+// TaskSessionRecorded is published when the terminal session of the task's
+// process has been recorded.
+type TaskSessionRecorded struct {
+	ContainerID string    `json:"container_id"`
+	ID          string    `json:"id"`
+	Path        string    `json:"path"`
+	Size        int64     `json:"size"`
+	Truncated   bool      `json:"truncated"`
+	StartedAt   time.Time `json:"started_at"`
+	EndedAt     time.Time `json:"ended_at"`
+}
+
+// Field implements events.Event.
+func (e *TaskSessionRecorded) Field(fieldpath []string) (string, bool) {
+	if len(fieldpath) == 0 {
+		return "", false
+	}
+
+	switch fieldpath[0] {
+	case "container_id":
+		return e.ContainerID, len(e.ContainerID) > 0
+	case "id":
+		return e.ID, len(e.ID) > 0
+	case "path":
+		return e.Path, len(e.Path) > 0
+	}
+	return "", false
+}
+
+// sessionHeader is the first line of the asciinema v2 file.
+type sessionHeader struct {
+	Version   int               `json:"version"`
+	Width     uint16            `json:"width"`
+	Height    uint16            `json:"height"`
+	Timestamp int64             `json:"timestamp"`
+	Title     string            `json:"title,omitempty"`
+	Env       map[string]string `json:"env,omitempty"`
+}
+
+// sessionRecorder writes the terminal's output, input and resize as the
+// asciinema v2 events, like `[0.248848, "o", "hello\r\n"]`. The recording
+// never fails the stdio copy. It stops recording on the first write error.
+type sessionRecorder struct {
+	manager *TaskManager
+	ns      string
+	id      string
+	execID  string
+	path    string
+
+	maxBytes    int64
+	recordInput bool
+
+	mu        sync.Mutex
+	f         *os.File
+	started   time.Time
+	size      int64
+	truncated bool
+	closed    bool
+	// pending holds the incomplete UTF-8 sequence of each stream because
+	// the event's data must be valid string.
+	pending map[string][]byte
+}
+
+// openSessionRecording returns nil if the recording is disabled or failed
+// to open, since it shouldn't block the process.
+func (manager *TaskManager) openSessionRecording(bundle *pkgbundle.Bundle, execID string, proc *specs.Process) *sessionRecorder {
+	if manager.config == nil || manager.config.SessionRecording.Dir == "" {
+		return nil
+	}
+	cfg := manager.config.SessionRecording
+
+	rec, err := manager.newSessionRecorder(cfg, bundle, execID, proc)
+	if err != nil {
+		log.G(context.Background()).WithError(err).
+			WithField("id", bundle.ID).WithField("exec", execID).
+			Warn("failed to open session recording")
+		return nil
+	}
+
+	if err := pruneSessionRecordings(cfg, time.Now()); err != nil {
+		log.G(context.Background()).WithError(err).Warn("failed to prune session recordings")
+	}
+	return rec
+}
+
+func (manager *TaskManager) newSessionRecorder(cfg SessionRecordingConfig, bundle *pkgbundle.Bundle, execID string, proc *specs.Process) (*sessionRecorder, error) {
+	dir := filepath.Join(cfg.Dir, bundle.Namespace, bundle.ID)
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	path := filepath.Join(dir, fmt.Sprintf("%s-%d%s", execID, now.UnixNano(), sessionRecordingExt))
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_EXCL, 0600)
+	if err != nil {
+		return nil, err
+	}
+
+	header := sessionHeader{
+		Version:   2,
+		Width:     defaultSessionWinSize.Width,
+		Height:    defaultSessionWinSize.Height,
+		Timestamp: now.Unix(),
+		Title:     bundle.Namespace + "/" + bundle.ID + "/" + execID,
+	}
+	if proc != nil {
+		if proc.ConsoleSize != nil && proc.ConsoleSize.Width > 0 && proc.ConsoleSize.Height > 0 {
+			header.Width, header.Height = uint16(proc.ConsoleSize.Width), uint16(proc.ConsoleSize.Height)
+		}
+		for _, kv := range proc.Env {
+			if strings.HasPrefix(kv, "TERM=") {
+				header.Env = map[string]string{"TERM": strings.TrimPrefix(kv, "TERM=")}
+			}
+		}
+	}
+
+	data, err := json.Marshal(header)
+	if err != nil {
+		f.Close()
+		os.Remove(path)
+		return nil, err
+	}
+	data = append(data, '\n')
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		os.Remove(path)
+		return nil, err
+	}
+
+	return &sessionRecorder{
+		manager:     manager,
+		ns:          bundle.Namespace,
+		id:          bundle.ID,
+		execID:      execID,
+		path:        path,
+		maxBytes:    cfg.MaxBytes,
+		recordInput: cfg.RecordInput,
+		f:           f,
+		started:     now,
+		size:        int64(len(data)),
+		pending:     make(map[string][]byte),
+	}, nil
+}
+
+// output returns the writer which records the terminal's output.
+func (r *sessionRecorder) output() io.Writer {
+	return sessionStream{r: r, code: "o"}
+}
+
+// input returns the writer which records the terminal's input. It is nil
+// if the input isn't recorded.
+func (r *sessionRecorder) input() io.Writer {
+	if !r.recordInput {
+		return nil
+	}
+	return sessionStream{r: r, code: "i"}
+}
+
+// resize records the terminal's resize as "r" event.
+func (r *sessionRecorder) resize(ws console.WinSize) {
+	if r == nil {
+		return
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.writeEvent("r", fmt.Sprintf("%dx%d", ws.Width, ws.Height))
+}
+
+// record writes the data as the event of the stream. The trailing
+// incomplete UTF-8 sequence is held until the next write.
+func (r *sessionRecorder) record(code string, data []byte) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.closed || r.truncated {
+		return
+	}
+
+	buf := append(r.pending[code], data...)
+	n := completeUTF8Len(buf)
+	r.pending[code] = append([]byte(nil), buf[n:]...)
+	if n == 0 {
+		return
+	}
+	r.writeEvent(code, string(buf[:n]))
+}
+
+// writeEvent must be called with r.mu held.
+func (r *sessionRecorder) writeEvent(code string, data string) {
+	if r.closed || r.truncated {
+		return
+	}
+
+	elapsed := time.Since(r.started).Seconds()
+	line, err := json.Marshal([]interface{}{json.Number(fmt.Sprintf("%.6f", elapsed)), code, data})
+	if err != nil {
+		return
+	}
+	line = append(line, '\n')
+
+	if r.maxBytes > 0 && r.size+int64(len(line)) > r.maxBytes {
+		r.truncated = true
+		marker, _ := json.Marshal([]interface{}{json.Number(fmt.Sprintf("%.6f", elapsed)), "m", "truncated"})
+		if n, err := r.f.Write(append(marker, '\n')); err == nil {
+			r.size += int64(n)
+		}
+		return
+	}
+
+	n, err := r.f.Write(line)
+	r.size += int64(n)
+	if err != nil {
+		log.G(context.Background()).WithError(err).Warnf("failed to write session recording %s", r.path)
+		r.truncated = true
+	}
+}
+
+// close ends the recording and publishes TaskSessionRecorded event. It is
+// safe to call it many times.
+func (r *sessionRecorder) close() {
+	if r == nil {
+		return
+	}
+
+	r.mu.Lock()
+	if r.closed {
+		r.mu.Unlock()
+		return
+	}
+	for code, buf := range r.pending {
+		if len(buf) > 0 {
+			r.writeEvent(code, string(buf))
+		}
+	}
+	r.closed = true
+	err := r.f.Close()
+	ev := &TaskSessionRecorded{
+		ContainerID: r.id,
+		ID:          r.execID,
+		Path:        r.path,
+		Size:        r.size,
+		Truncated:   r.truncated,
+		StartedAt:   r.started,
+		EndedAt:     time.Now(),
+	}
+	r.mu.Unlock()
+
+	if err != nil {
+		log.G(context.Background()).WithError(err).Warnf("failed to close session recording %s", r.path)
+	}
+	r.manager.publishEvent(r.ns, TaskSessionRecordedEventTopic, ev)
+}
+
+// sessionStream is the writer of one stream, which never returns error so
+// that it can be used in io.MultiWriter and io.TeeReader with the stdio.
+type sessionStream struct {
+	r    *sessionRecorder
+	code string
+}
+
+func (s sessionStream) Write(data []byte) (int, error) {
+	s.r.record(s.code, data)
+	return len(data), nil
+}
+
+// completeUTF8Len returns the length of buf without the trailing incomplete
+// UTF-8 sequence. The invalid bytes are kept and replaced by json.Marshal.
+func completeUTF8Len(buf []byte) int {
+	for i := len(buf) - 1; i >= 0 && i >= len(buf)-utf8.UTFMax; i-- {
+		if !utf8.RuneStart(buf[i]) {
+			continue
+		}
+		if !utf8.FullRune(buf[i:]) {
+			return i
+		}
+		break
+	}
+	return len(buf)
+}
+
+// pruneSessionRecordings removes the recordings older than the retention
+// and then the oldest ones beyond MaxFiles.
+func pruneSessionRecordings(cfg SessionRecordingConfig, now time.Time) error {
+	var retention time.Duration
+	if cfg.Retention != "" {
+		var err error
+		if retention, err = time.ParseDuration(cfg.Retention); err != nil {
+			return fmt.Errorf("invalid session recording retention %q: %w", cfg.Retention, err)
+		}
+	}
+	if retention <= 0 && cfg.MaxFiles <= 0 {
+		return nil
+	}
+
+	type recording struct {
+		path    string
+		modTime time.Time
+	}
+
+	var recordings []recording
+	err := filepath.Walk(cfg.Dir, func(path string, fi os.FileInfo, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+		if fi.IsDir() || filepath.Ext(path) != sessionRecordingExt {
+			return nil
+		}
+
+		if retention > 0 && now.Sub(fi.ModTime()) > retention {
+			if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+				return err
+			}
+			return nil
+		}
+		recordings = append(recordings, recording{path: path, modTime: fi.ModTime()})
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	if cfg.MaxFiles <= 0 || len(recordings) <= cfg.MaxFiles {
+		return nil
+	}
+
+	sort.Slice(recordings, func(i, j int) bool {
+		return recordings[i].modTime.Before(recordings[j].modTime)
+	})
+	for _, rec := range recordings[:len(recordings)-cfg.MaxFiles] {
+		if err := os.Remove(rec.path); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return nil
+}
+
+// copyRecordedConsole is like the platform's CopyConsole but also records
+// the session if the recorder isn't nil.
+func copyRecordedConsole(ctx context.Context, platform stdio.Platform, rec *sessionRecorder, console console.Console, id string, sio stdio.Stdio, wg *sync.WaitGroup) (console.Console, error) {
+	lp, ok := platform.(*linuxPlatform)
+	if rec == nil || !ok {
+		return platform.CopyConsole(ctx, console, id, sio.Stdin, sio.Stdout, sio.Stderr, wg)
+	}
+	return lp.copyConsole(ctx, console, sio.Stdin, sio.Stdout, rec, wg)
+}
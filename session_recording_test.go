@@ -0,0 +1,132 @@
+//go:build linux
+// +build linux
+
+package embedshim
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	pkgbundle "github.com/fuweid/embedshim/pkg/bundle"
+
+	"github.com/containerd/console"
+	"github.com/opencontainers/runtime-spec/specs-go"
+)
+
+func TestSessionRecorder(t *testing.T) {
+	dir := t.TempDir()
+	cfg := SessionRecordingConfig{Dir: dir, RecordInput: true}
+	manager := &TaskManager{config: &Config{SessionRecording: cfg}}
+
+	bundle := &pkgbundle.Bundle{ID: "c1", Namespace: "default"}
+	rec, err := manager.newSessionRecorder(cfg, bundle, "exec1", &specs.Process{
+		Env:         []string{"PATH=/bin", "TERM=xterm"},
+		ConsoleSize: &specs.Box{Width: 120, Height: 40},
+	})
+	if err != nil {
+		t.Fatalf("failed to create recorder: %v", err)
+	}
+
+	// "你" is split into two writes, the complete "hi " is recorded at once
+	// and the incomplete sequence is held until the next write.
+	ni := []byte("你")
+	rec.output().Write(append([]byte("hi "), ni[:1]...))
+	rec.output().Write(ni[1:])
+	rec.input().Write([]byte("ls\r"))
+	rec.resize(console.WinSize{Width: 100, Height: 30})
+	rec.close()
+	rec.close()
+
+	data, err := os.ReadFile(rec.path)
+	if err != nil {
+		t.Fatalf("failed to read recording: %v", err)
+	}
+	lines := strings.Split(strings.TrimSpace(string(data)), "\n")
+	if len(lines) != 5 {
+		t.Fatalf("expected 5 lines, but got %v", lines)
+	}
+
+	var header sessionHeader
+	if err := json.Unmarshal([]byte(lines[0]), &header); err != nil {
+		t.Fatalf("failed to unmarshal header: %v", err)
+	}
+	if header.Version != 2 || header.Width != 120 || header.Height != 40 || header.Env["TERM"] != "xterm" {
+		t.Fatalf("unexpected header %+v", header)
+	}
+
+	for i, expected := range [][2]string{{"o", "hi "}, {"o", "你"}, {"i", "ls\r"}, {"r", "100x30"}} {
+		var ev []interface{}
+		if err := json.Unmarshal([]byte(lines[i+1]), &ev); err != nil {
+			t.Fatalf("failed to unmarshal event %s: %v", lines[i+1], err)
+		}
+		if ev[1] != expected[0] || ev[2] != expected[1] {
+			t.Fatalf("expected %v, but got %v", expected, ev)
+		}
+	}
+}
+
+func TestSessionRecorderMaxBytes(t *testing.T) {
+	cfg := SessionRecordingConfig{Dir: t.TempDir(), MaxBytes: 256}
+	manager := &TaskManager{config: &Config{SessionRecording: cfg}}
+
+	rec, err := manager.newSessionRecorder(cfg, &pkgbundle.Bundle{ID: "c1", Namespace: "default"}, "init", nil)
+	if err != nil {
+		t.Fatalf("failed to create recorder: %v", err)
+	}
+	if rec.input() != nil {
+		t.Fatalf("expected input isn't recorded")
+	}
+
+	for i := 0; i < 10; i++ {
+		rec.output().Write([]byte(strings.Repeat("x", 64)))
+	}
+	rec.close()
+
+	data, err := os.ReadFile(rec.path)
+	if err != nil {
+		t.Fatalf("failed to read recording: %v", err)
+	}
+	if !rec.truncated || !strings.HasSuffix(string(data), "\"m\",\"truncated\"]\n") {
+		t.Fatalf("expected truncated recording, but got %s", data)
+	}
+}
+
+func TestPruneSessionRecordings(t *testing.T) {
+	dir := t.TempDir()
+	now := time.Now()
+
+	files := []string{"old.cast", "a.cast", "b.cast", "c.cast", "keep.log"}
+	for i, name := range files {
+		path := filepath.Join(dir, "default", "c1", name)
+		if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, nil, 0600); err != nil {
+			t.Fatal(err)
+		}
+		mtime := now.Add(time.Duration(i-len(files)) * time.Hour)
+		if name == "old.cast" {
+			mtime = now.Add(-48 * time.Hour)
+		}
+		if err := os.Chtimes(path, mtime, mtime); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	cfg := SessionRecordingConfig{Dir: dir, Retention: "24h", MaxFiles: 2}
+	if err := pruneSessionRecordings(cfg, now); err != nil {
+		t.Fatalf("failed to prune: %v", err)
+	}
+
+	for _, name := range files {
+		_, err := os.Stat(filepath.Join(dir, "default", "c1", name))
+		expected := name == "b.cast" || name == "c.cast" || name == "keep.log"
+		if got := err == nil; got != expected {
+			t.Fatalf("expected %s exists %v, but got %v", name, expected, got)
+		}
+	}
+}
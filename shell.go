@@ -0,0 +1,254 @@
+//go:build linux
+// +build linux
+
+package embedshim
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/containerd/containerd/errdefs"
+	"github.com/containerd/containerd/log"
+	"github.com/containerd/containerd/runtime"
+	"github.com/containerd/fifo"
+	"github.com/opencontainers/runtime-spec/specs-go"
+	"golang.org/x/sys/unix"
+)
+
+var (
+	// defaultShellCandidates are probed in the container's rootfs in order
+	// if the shell's args aren't provided.
+	defaultShellCandidates = []string{"/bin/bash", "/bin/sh"}
+
+	defaultShellTerm = "xterm"
+
+	// shellCloseTimeout is the grace period for the shell to exit after
+	// the stdin is closed.
+	shellCloseTimeout = 5 * time.Second
+)
+
+// ShellOpts is the options of OpenShell. The unset fields inherit from the
+// init process's spec.
+type ShellOpts struct {
+	// ExecID is generated like shell-<random> if it is empty.
+	ExecID string
+	// Args is the shell command. The default is the first existing one of
+	// /bin/bash and /bin/sh in the container.
+	Args []string
+	// Env is merged into the init process's env in KEY=VALUE format.
+	Env  []string
+	User *specs.User
+	Cwd  string
+	// Term is the TERM env. The default is xterm.
+	Term string
+	// Size is the initial console size.
+	Size runtime.ConsoleSize
+}
+
+// Shell is the duplex stream attached to the shell's pty. The reads are the
+// pty's output and the writes are the pty's input.
+type Shell struct {
+	ExecID string
+	Pid    uint32
+
+	process runtime.Process
+	stdin   io.WriteCloser
+	stdout  io.ReadCloser
+	dir     string
+
+	closeOnce sync.Once
+}
+
+// Read implements io.Reader.
+func (sh *Shell) Read(p []byte) (int, error) {
+	return sh.stdout.Read(p)
+}
+
+// Write implements io.Writer.
+func (sh *Shell) Write(p []byte) (int, error) {
+	return sh.stdin.Write(p)
+}
+
+// Resize resizes the shell's pty.
+func (sh *Shell) Resize(ctx context.Context, size runtime.ConsoleSize) error {
+	return sh.process.ResizePty(ctx, size)
+}
+
+// Wait waits for the shell to exit.
+func (sh *Shell) Wait(ctx context.Context) (*runtime.Exit, error) {
+	return sh.process.Wait(ctx)
+}
+
+// Close closes the stdin, kills the shell if it doesn't exit in time, and
+// deletes the exec process.
+func (sh *Shell) Close() error {
+	var err error
+	sh.closeOnce.Do(func() {
+		err = sh.close(context.Background())
+	})
+	return err
+}
+
+func (sh *Shell) close(ctx context.Context) error {
+	sh.stdin.Close()
+
+	waitCtx, cancel := context.WithTimeout(ctx, shellCloseTimeout)
+	_, werr := sh.process.Wait(waitCtx)
+	cancel()
+	if werr != nil {
+		if err := sh.process.Kill(ctx, uint32(unix.SIGKILL), false); err != nil && !errdefs.IsNotFound(err) {
+			log.G(ctx).WithError(err).Warnf("failed to kill shell %s", sh.ExecID)
+		}
+		if _, err := sh.process.Wait(ctx); err != nil {
+			return err
+		}
+	}
+
+	_, err := sh.process.Delete(ctx)
+	sh.stdout.Close()
+	os.RemoveAll(sh.dir)
+	return err
+}
+
+// OpenShell starts the interactive shell in the running task with pty,
+// like `kubectl exec -it`. The user, cwd and env default to the init
+// process's, with TERM set. The caller must close the returned shell.
+func (manager *TaskManager) OpenShell(ctx context.Context, id string, opts ShellOpts) (_ *Shell, retErr error) {
+	t, err := manager.tasks.Get(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+
+	s, ok := t.(*shim)
+	if !ok {
+		return nil, errdefs.ErrNotImplemented
+	}
+
+	if status, _ := s.init.Status(ctx); status != "running" {
+		return nil, fmt.Errorf("task %s is %s: %w", id, status, errdefs.ErrFailedPrecondition)
+	}
+
+	if opts.ExecID == "" {
+		if opts.ExecID, err = newShellExecID(); err != nil {
+			return nil, err
+		}
+	}
+
+	if len(opts.Args) == 0 {
+		if opts.Args, err = manager.defaultShellArgs(ctx, id); err != nil {
+			return nil, err
+		}
+	}
+
+	term := opts.Term
+	if term == "" {
+		term = defaultShellTerm
+	}
+
+	spec, err := s.execSpecFromProfile(ExecProfile{
+		Args:     opts.Args,
+		Env:      append([]string{"TERM=" + term}, opts.Env...),
+		User:     opts.User,
+		Cwd:      opts.Cwd,
+		Terminal: true,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	dir, err := os.MkdirTemp("", "embedshim-shell-")
+	if err != nil {
+		return nil, err
+	}
+
+	sh := &Shell{ExecID: opts.ExecID, dir: dir}
+	defer func() {
+		if retErr != nil {
+			if sh.stdin != nil {
+				sh.stdin.Close()
+			}
+			if sh.stdout != nil {
+				sh.stdout.Close()
+			}
+			os.RemoveAll(dir)
+		}
+	}()
+
+	stdinPath, stdoutPath := filepath.Join(dir, "stdin"), filepath.Join(dir, "stdout")
+
+	// NOTE: The FIFOs are opened in non-blocking mode, and the open is
+	// completed after the exec process opens the other side.
+	if sh.stdin, err = fifo.OpenFifo(ctx, stdinPath, syscall.O_WRONLY|syscall.O_CREAT|syscall.O_NONBLOCK, 0700); err != nil {
+		return nil, fmt.Errorf("failed to open shell stdin: %w", err)
+	}
+	if sh.stdout, err = fifo.OpenFifo(ctx, stdoutPath, syscall.O_RDONLY|syscall.O_CREAT|syscall.O_NONBLOCK, 0700); err != nil {
+		return nil, fmt.Errorf("failed to open shell stdout: %w", err)
+	}
+
+	p, err := s.Exec(ctx, opts.ExecID, runtime.ExecOpts{
+		Spec: spec,
+		IO: runtime.IO{
+			Stdin:    stdinPath,
+			Stdout:   stdoutPath,
+			Terminal: true,
+		},
+	})
+	if err != nil {
+		return nil, err
+	}
+	sh.process = p
+
+	if err := p.Start(ctx); err != nil {
+		p.Delete(ctx)
+		return nil, err
+	}
+
+	if opts.Size.Width > 0 && opts.Size.Height > 0 {
+		if err := p.ResizePty(ctx, opts.Size); err != nil {
+			log.G(ctx).WithError(err).Warnf("failed to set initial size of shell %s", opts.ExecID)
+		}
+	}
+
+	state, err := p.State(ctx)
+	if err != nil {
+		sh.close(ctx)
+		return nil, err
+	}
+	sh.Pid = state.Pid
+	return sh, nil
+}
+
+// defaultShellArgs returns the first existing shell in the container.
+func (manager *TaskManager) defaultShellArgs(ctx context.Context, id string) ([]string, error) {
+	rootFD, err := manager.openContainerRoot(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	defer unix.Close(rootFD)
+
+	for _, candidate := range defaultShellCandidates {
+		fd, err := openInContainerRoot(rootFD, candidate, unix.O_PATH)
+		if err != nil {
+			continue
+		}
+		unix.Close(fd)
+		return []string{candidate}, nil
+	}
+	return nil, fmt.Errorf("no shell in task %s, tried %v: %w", id, defaultShellCandidates, errdefs.ErrNotFound)
+}
+
+func newShellExecID() (string, error) {
+	b := make([]byte, 6)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return "shell-" + hex.EncodeToString(b), nil
+}
@@ -0,0 +1,26 @@
+//go:build linux
+// +build linux
+
+package embedshim
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestNewShellExecID(t *testing.T) {
+	seen := make(map[string]struct{})
+	for i := 0; i < 16; i++ {
+		id, err := newShellExecID()
+		if err != nil {
+			t.Fatalf("failed to generate exec ID: %v", err)
+		}
+		if !strings.HasPrefix(id, "shell-") || len(id) != len("shell-")+12 {
+			t.Fatalf("expected shell-<12 hex>, but got %v", id)
+		}
+		if _, ok := seen[id]; ok {
+			t.Fatalf("expected unique exec ID, but got duplicate %v", id)
+		}
+		seen[id] = struct{}{}
+	}
+}
@@ -1,3 +1,6 @@
+//go:build linux
+// +build linux
+
 package embedshim
 
 import (
@@ -5,6 +8,7 @@ import (
 	"fmt"
 	"os"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	pkgbundle "github.com/fuweid/embedshim/pkg/bundle"
@@ -12,9 +16,11 @@ import (
 	"github.com/containerd/cgroups"
 	cgroupsv2 "github.com/containerd/cgroups/v2"
 	"github.com/containerd/console"
+	eventstypes "github.com/containerd/containerd/api/events"
 	"github.com/containerd/containerd/errdefs"
 	"github.com/containerd/containerd/log"
 	"github.com/containerd/containerd/mount"
+	"github.com/containerd/containerd/namespaces"
 	"github.com/containerd/containerd/runtime"
 	"github.com/containerd/typeurl"
 	ptypes "github.com/gogo/protobuf/types"
@@ -33,6 +39,20 @@ type shim struct {
 	init *initProcess
 	cg   interface{}
 
+	identity  atomic.Value // *taskIdentity
+	restart   restartTracker
+	quotaRamp cpuQuotaRamp
+	health    *healthChecker
+	lifetime  *lifetimeEnforcer
+	readiness *readinessTracker
+	notify    *notifySocket
+	webhook   *webhookNotifier
+	nsHolder  *namespaceHolder
+
+	// labels are the containerd container's labels, which are used to
+	// filter tasks without metadata store lookup.
+	labels map[string]string
+
 	execProcesses   map[string]runtime.Process
 	reservedExecIDs map[string]struct{}
 }
@@ -51,6 +71,11 @@ func newShim(manager *TaskManager, bundle *pkgbundle.Bundle) (*shim, error) {
 		reservedExecIDs: make(map[string]struct{}),
 	}
 	init.parent = s
+	s.initHealthChecker()
+	s.initLifetimeEnforcer()
+	s.initReadinessTracker()
+	s.initWebhookNotifier()
+	s.initNamespaceHolder()
 	return s, nil
 }
 
@@ -77,10 +102,32 @@ func (s *shim) Create(ctx context.Context, opts runtime.CreateOpts) (_ runtime.T
 		}
 	}
 
+	if opts.Checkpoint != "" {
+		config, err := newRestoreConfig(s.bundle, opts.Checkpoint, "")
+		if err != nil {
+			return nil, err
+		}
+		s.init.restoreConfig = config
+	}
+
+	if err := s.prepareNotifySocket(); err != nil {
+		return nil, err
+	}
+	defer func() {
+		if retErr != nil {
+			s.closeNotifySocket()
+		}
+	}()
+
 	if err := s.init.Create(ctx); err != nil {
 		return nil, err
 	}
 
+	// The checkpointed init process will be traced after restore.
+	if s.init.restoreConfig != nil {
+		return s, nil
+	}
+
 	defer func() {
 		if retErr != nil {
 			deferCtx, deferCancel := deferContext()
@@ -96,33 +143,49 @@ func (s *shim) Create(ctx context.Context, opts runtime.CreateOpts) (_ runtime.T
 		return nil, err
 	}
 
-	if pid := int(s.PID()); pid > 0 {
-		var cg interface{}
-		var err error
-		func() {
-			if cgroups.Mode() == cgroups.Unified {
-				g, err := cgroupsv2.PidGroupPath(pid)
-				if err != nil {
-					logrus.WithError(err).Errorf("loading cgroup2 for %d", pid)
-					return
-				}
-
-				cg, err = cgroupsv2.LoadManager("/sys/fs/cgroup", g)
-				if err != nil {
-					logrus.WithError(err).Errorf("loading cgroup2 for %d", pid)
-				}
-			} else {
-				cg, err = cgroups.Load(cgroups.V1, cgroups.PidPath(pid))
-				if err != nil {
-					logrus.WithError(err).Errorf("loading cgroup for %d", pid)
-				}
-			}
-		}()
-		s.cg = cg
+	s.loadCgroup()
+	if err := s.setupSubgroups(); err != nil {
+		return nil, fmt.Errorf("failed to setup sub-cgroups: %w", err)
+	}
+	if err := s.applyMemoryQoS(ctx); err != nil {
+		return nil, err
 	}
 	return s, nil
 }
 
+// loadCgroup loads the init process's cgroup for stats.
+func (s *shim) loadCgroup() {
+	pid := int(s.PID())
+	if pid <= 0 {
+		return
+	}
+
+	var cg interface{}
+	var err error
+	func() {
+		if cgroups.Mode() == cgroups.Unified {
+			g, err := cgroupsv2.PidGroupPath(pid)
+			if err != nil {
+				logrus.WithError(err).Errorf("loading cgroup2 for %d", pid)
+				return
+			}
+			g = s.trimInitSubgroup(g)
+
+			cg, err = cgroupsv2.LoadManager("/sys/fs/cgroup", g)
+			if err != nil {
+				logrus.WithError(err).Errorf("loading cgroup2 for %d", pid)
+			}
+		} else {
+			cg, err = cgroups.Load(cgroups.V1, cgroups.PidPath(pid))
+			if err != nil {
+				logrus.WithError(err).Errorf("loading cgroup for %d", pid)
+			}
+		}
+	}()
+	s.cg = cg
+	s.loadIdentity()
+}
+
 func (s *shim) ID() string {
 	return s.bundle.ID
 }
@@ -135,23 +198,102 @@ func (s *shim) Namespace() string {
 	return s.bundle.Namespace
 }
 
-func (s *shim) Pause(_ context.Context) error {
-	return fmt.Errorf("pause not implemented yet")
+func (s *shim) Pause(ctx context.Context) error {
+	if err := s.init.Pause(ctx); err != nil {
+		return err
+	}
+
+	s.publishTaskEvent(runtime.TaskPausedEventTopic, "", s.PID(), &eventstypes.TaskPaused{
+		ContainerID: s.ID(),
+	})
+	return nil
 }
 
-func (s *shim) Resume(_ context.Context) error {
-	return fmt.Errorf("resume not implemented yet")
+func (s *shim) Resume(ctx context.Context) error {
+	if err := s.init.Resume(ctx); err != nil {
+		return err
+	}
+
+	s.publishTaskEvent(runtime.TaskResumedEventTopic, "", s.PID(), &eventstypes.TaskResumed{
+		ContainerID: s.ID(),
+	})
+	return nil
 }
 
 func (s *shim) Start(ctx context.Context) error {
-	return s.init.Start(ctx)
+	if err := s.manager.opLimits.start.acquire(ctx, s.Namespace()); err != nil {
+		return err
+	}
+	defer s.manager.opLimits.start.release()
+
+	if err := s.init.Start(ctx); err != nil {
+		return err
+	}
+
+	if s.init.restoreConfig != nil && s.cg == nil {
+		s.loadCgroup()
+		if err := s.setupSubgroups(); err != nil {
+			log.G(ctx).WithError(err).Warnf("failed to setup sub-cgroups on restored task %s", s.ID())
+		}
+		if err := s.applyMemoryQoS(ctx); err != nil {
+			log.G(ctx).WithError(err).Warnf("failed to apply memory QoS on restored task %s", s.ID())
+		}
+	}
+
+	s.restart.mu.Lock()
+	s.restart.startedAt = time.Now()
+	s.restart.mu.Unlock()
+
+	if s.health != nil {
+		s.health.start()
+	}
+	if s.lifetime != nil {
+		s.lifetime.arm()
+	}
+	if s.nsHolder != nil {
+		s.nsHolder.pin(s.init.Pid())
+	}
+
+	s.publishTaskEvent(runtime.TaskStartEventTopic, "", s.PID(), &eventstypes.TaskStart{
+		ContainerID: s.ID(),
+		Pid:         s.PID(),
+	})
+	return s.waitReady(ctx)
 }
 
 func (s *shim) Kill(ctx context.Context, signal uint32, all bool) error {
-	return s.init.Kill(ctx, signal, all)
+	if signal == 0 {
+		signal = s.stopSignal()
+	}
+	if err := s.init.Kill(ctx, signal, all); err != nil {
+		return err
+	}
+
+	// NOTE: The restart is delayed by backoff and re-checks the flag, so
+	// that the init process which exits before the flag is set isn't
+	// restarted.
+	if s.init.isStoppingSignal(signal) {
+		s.markStopped()
+	}
+	return nil
 }
 
 func (s *shim) Exec(ctx context.Context, execID string, opts runtime.ExecOpts) (runtime.Process, error) {
+	if err := s.manager.validateStdinSource(s.Namespace(), opts.IO.Stdin, opts.IO.Terminal); err != nil {
+		return nil, err
+	}
+
+	spec, err := s.manager.sanitizeExecSpecEnv(ctx, s.ID(), execID, opts.Spec)
+	if err != nil {
+		return nil, err
+	}
+
+	spec, err = s.init.execUser.applyExecSpec(spec)
+	if err != nil {
+		return nil, err
+	}
+	opts.Spec = spec
+
 	traceID, err := s.manager.nextTraceEventID()
 	if err != nil {
 		return nil, fmt.Errorf("failed to allocate trace ID for exec %s: %w", execID, err)
@@ -170,13 +312,16 @@ func (s *shim) Exec(ctx context.Context, execID string, opts runtime.ExecOpts) (
 		return nil, err
 	}
 	s.addExecProcess(process)
+
+	s.publishTaskEvent(runtime.TaskExecAddedEventTopic, execID, 0, &eventstypes.TaskExecAdded{
+		ContainerID: s.ID(),
+		ExecID:      execID,
+	})
 	return process, nil
 }
 
 func (s *shim) Pids(_ context.Context) ([]runtime.ProcessInfo, error) {
-	return []runtime.ProcessInfo{
-		{Pid: s.PID()},
-	}, nil
+	return s.processInfos()
 }
 
 func (s *shim) ResizePty(_ context.Context, size runtime.ConsoleSize) error {
@@ -195,11 +340,17 @@ func (s *shim) CloseIO(_ context.Context) error {
 	return nil
 }
 
-func (s *shim) Wait(_ context.Context) (*runtime.Exit, error) {
+func (s *shim) Wait(ctx context.Context) (*runtime.Exit, error) {
 	taskPid := s.PID()
 
-	// TODO: use ctx
-	s.init.Wait()
+	// NOTE: The caller, like CRI's StopContainer, cancels the context
+	// after the stop timeout and then sends SIGKILL, so that Wait must
+	// not block the request forever.
+	select {
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	case <-s.init.waitChan():
+	}
 
 	return &runtime.Exit{
 		Pid:       taskPid,
@@ -208,43 +359,57 @@ func (s *shim) Wait(_ context.Context) (*runtime.Exit, error) {
 	}, nil
 }
 
-func (s *shim) Checkpoint(_ context.Context, _ string, _ *ptypes.Any) error {
-	return fmt.Errorf("checkpoint not implemented yet")
+func (s *shim) Checkpoint(ctx context.Context, path string, opts *ptypes.Any) error {
+	cfg, err := checkpointConfigFromOptions(path, opts)
+	if err != nil {
+		return err
+	}
+
+	// NOTE: The container exits after dump and it must not be restarted.
+	if cfg.Exit {
+		s.markStopped()
+	}
+	if err := s.init.Checkpoint(ctx, cfg); err != nil {
+		return err
+	}
+
+	s.publishTaskEvent(runtime.TaskCheckpointedEventTopic, "", s.PID(), &eventstypes.TaskCheckpointed{
+		ContainerID: s.ID(),
+	})
+	return nil
 }
 
 func (s *shim) Close() error {
 	return nil
 }
 
-func (s *shim) Update(ctx context.Context, resources *ptypes.Any, _ map[string]string) error {
-	return s.init.Update(ctx, resources)
+func (s *shim) Update(ctx context.Context, resources *ptypes.Any, annotations map[string]string) error {
+	return s.updateResources(ctx, resources, annotations)
 }
 
 func (s *shim) Stats(_ context.Context) (*ptypes.Any, error) {
+	statsx, err := s.cgroupStats()
+	if err != nil {
+		return nil, err
+	}
+	return typeurl.MarshalAny(statsx)
+}
+
+// cgroupStats returns the cgroup v1 or v2 metrics.
+func (s *shim) cgroupStats() (interface{}, error) {
 	cgx := s.cg
 	if cgx == nil {
 		return nil, fmt.Errorf("cgroup does not exist: %w", errdefs.ErrNotFound)
 	}
 
-	var statsx interface{}
 	switch cg := cgx.(type) {
 	case cgroups.Cgroup:
-		stats, err := cg.Stat(cgroups.IgnoreNotExist)
-		if err != nil {
-			return nil, err
-		}
-		statsx = stats
+		return cg.Stat(cgroups.IgnoreNotExist)
 	case *cgroupsv2.Manager:
-		stats, err := cg.Stat()
-		if err != nil {
-			return nil, err
-		}
-		statsx = stats
+		return cg.Stat()
 	default:
 		return nil, fmt.Errorf("unsupported cgroup type %T: %w", cg, errdefs.ErrNotImplemented)
 	}
-
-	return typeurl.MarshalAny(statsx)
 }
 
 func (s *shim) Process(ctx context.Context, id string) (runtime.Process, error) {
@@ -265,13 +430,12 @@ func (s *shim) Process(ctx context.Context, id string) (runtime.Process, error)
 }
 
 func (s *shim) State(ctx context.Context) (runtime.State, error) {
-	st, err := s.init.Status(ctx)
-	if err != nil {
-		return runtime.State{}, err
-	}
+	// NOTE: Use one snapshot so that the status and exit status are
+	// consistent.
+	snapshot := s.init.loadSnapshot()
 
 	status := runtime.Status(0) // Unknown
-	switch st {
+	switch snapshot.status {
 	case "created":
 		status = runtime.CreatedStatus
 	case "running":
@@ -286,23 +450,48 @@ func (s *shim) State(ctx context.Context) (runtime.State, error) {
 		Stdout:     s.init.stdio.Stdout,
 		Stderr:     s.init.stdio.Stderr,
 		Terminal:   s.init.stdio.Terminal,
-		ExitStatus: uint32(s.init.ExitStatus()),
-		ExitedAt:   s.init.ExitedAt(),
+		ExitStatus: uint32(snapshot.exitStatus),
+		ExitedAt:   snapshot.exitedAt,
 	}, nil
 }
 
 func (s *shim) Delete(ctx context.Context) (*runtime.Exit, error) {
+	if err := s.manager.opLimits.delete.acquire(ctx, s.Namespace()); err != nil {
+		return nil, err
+	}
+	defer s.manager.opLimits.delete.release()
+
+	if isForceDelete(ctx) {
+		if err := s.forceStop(ctx); err != nil {
+			return nil, fmt.Errorf("failed to force delete task %s: %w", s.ID(), err)
+		}
+	}
+
+	if status, _ := s.init.Status(ctx); status == "stopped" {
+		s.killLingeringExecs(ctx)
+	}
+
 	err := s.init.Delete(ctx)
 	if err != nil && !errors.Is(err, errdefs.ErrNotFound) {
 		return nil, err
 	}
-
+	s.teardown()
 	if err := s.bundle.Delete(); err != nil {
 		return nil, err
 	}
 
 	s.manager.cleanInitProcessTraceEvent(s.init)
-	s.manager.Delete(ctx, s.init.ID())
+	// NOTE: The task is removed from its own namespace instead of the
+	// caller's, so that the task with the same ID in the other namespace
+	// isn't touched.
+	s.manager.Delete(namespaces.WithNamespace(ctx, s.Namespace()), s.init.ID())
+
+	s.publishTaskEvent(runtime.TaskDeleteEventTopic, "", uint32(s.init.pid), &eventstypes.TaskDelete{
+		ContainerID: s.ID(),
+		Pid:         uint32(s.init.pid),
+		ExitStatus:  uint32(s.init.ExitStatus()),
+		ExitedAt:    s.init.ExitedAt(),
+	})
 
 	return &runtime.Exit{
 		Pid:       uint32(s.init.pid),
@@ -311,6 +500,28 @@ func (s *shim) Delete(ctx context.Context) (*runtime.Exit, error) {
 	}, nil
 }
 
+// teardown stops the task's background workers which act on the task, like
+// the restart policy and the health checker. It is used when the task is
+// deleted or disowned.
+func (s *shim) teardown() {
+	s.cancelRestart()
+	s.quotaRamp.stop()
+	if s.health != nil {
+		s.health.stop()
+	}
+	if s.lifetime != nil {
+		s.lifetime.stop()
+	}
+	if s.nsHolder != nil {
+		s.nsHolder.close()
+	}
+	s.closeNotifySocket()
+	s.webhook.close()
+
+	s.manager.unwatchBundle(s.bundle)
+	s.forgetCgroupID()
+}
+
 func (s *shim) reserveExecID(id string) (bool, func()) {
 	s.mu.Lock()
 	defer s.mu.Unlock()
@@ -333,18 +544,20 @@ func (s *shim) reserveExecID(id string) (bool, func()) {
 
 func (s *shim) addExecProcess(process runtime.Process) {
 	s.mu.Lock()
-	defer s.mu.Unlock()
-
 	delete(s.reservedExecIDs, process.ID())
 	s.execProcesses[process.ID()] = process
+	s.mu.Unlock()
+
+	s.persistStatus()
 }
 
 func (s *shim) deleteExecProcess(id string) {
 	s.mu.Lock()
-	defer s.mu.Unlock()
-
 	delete(s.reservedExecIDs, id)
 	delete(s.execProcesses, id)
+	s.mu.Unlock()
+
+	s.persistStatus()
 }
 
 func deferContext() (context.Context, context.CancelFunc) {
@@ -0,0 +1,174 @@
+//go:build linux
+// +build linux
+
+package embedshim
+
+import (
+	"context"
+	"fmt"
+	"path/filepath"
+	"strings"
+
+	"github.com/containerd/containerd/errdefs"
+	"github.com/containerd/go-runc"
+	"github.com/opencontainers/runtime-spec/specs-go"
+)
+
+// SpecPatch is the change applied to the created task's OCI spec, which is
+// used to inject late-binding settings, like secrets.
+type SpecPatch struct {
+	// Env are the environment variables in KEY=VALUE format. The existing
+	// one with same key will be replaced.
+	Env []string
+	// Mounts are appended into the spec.
+	Mounts []specs.Mount
+}
+
+// PatchSpec applies the patch to the task which is created but not started.
+//
+// The runc-init has loaded the config.json when the task is created. So the
+// container is re-created with the patched config.json. The task with stdin
+// or terminal is not supported because the relay can't be re-attached.
+func (manager *TaskManager) PatchSpec(ctx context.Context, id string, patch SpecPatch) error {
+	t, err := manager.tasks.Get(ctx, id)
+	if err != nil {
+		return err
+	}
+
+	s, ok := t.(*shim)
+	if !ok {
+		return fmt.Errorf("task %s is not managed by embedshim: %w", id, errdefs.ErrNotImplemented)
+	}
+
+	if err := s.patchSpec(ctx, patch); err != nil {
+		return fmt.Errorf("failed to patch spec of task %s: %w", id, err)
+	}
+	return nil
+}
+
+func (s *shim) patchSpec(ctx context.Context, patch SpecPatch) error {
+	if err := validateSpecPatch(patch); err != nil {
+		return err
+	}
+
+	p := s.init
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	switch p.initState.(type) {
+	case *createdCheckpointState:
+		// It will be restored in Start so that it is enough to
+		// update the config.json.
+		if err := p.patchSpec(patch); err != nil {
+			return err
+		}
+		s.manager.refreshBundle(s.bundle)
+		return nil
+	case *createdState:
+	default:
+		return fmt.Errorf("spec can't be patched in %s state: %w", stateName(p.initState), errdefs.ErrFailedPrecondition)
+	}
+
+	if p.stdio.Stdin != "" || p.stdio.Terminal {
+		return fmt.Errorf("spec of task with stdin or terminal can't be patched: %w", errdefs.ErrNotImplemented)
+	}
+
+	if err := p.patchSpec(patch); err != nil {
+		return err
+	}
+	s.manager.refreshBundle(s.bundle)
+
+	// Stop tracing the current runc-init so that the delete doesn't
+	// publish exit event.
+	if err := s.manager.monitor.untrace(p); err != nil {
+		return err
+	}
+
+	if err := p.runtime.Delete(ctx, p.ID(), &runc.DeleteOpts{Force: true}); err != nil {
+		return p.runtimeError(err, "OCI runtime delete failed")
+	}
+
+	if p.io != nil {
+		for _, c := range p.closers {
+			c.Close()
+		}
+		p.closers = nil
+		p.io.Close()
+		p.io = nil
+	}
+
+	if err := p.Create(ctx); err != nil {
+		return err
+	}
+
+	if err := s.manager.traceInitProcess(p); err != nil {
+		return err
+	}
+	s.loadCgroup()
+	return nil
+}
+
+// patchSpec applies the patch into the config.json.
+func (p *initProcess) patchSpec(patch SpecPatch) error {
+	spec, err := readInitOCISpec(p.bundle)
+	if err != nil {
+		return err
+	}
+
+	if len(patch.Env) > 0 {
+		if spec.Process == nil {
+			return fmt.Errorf("spec without process can't be patched with env: %w", errdefs.ErrInvalidArgument)
+		}
+		spec.Process.Env = mergeEnv(spec.Process.Env, patch.Env)
+	}
+
+	for _, m := range patch.Mounts {
+		for _, existing := range spec.Mounts {
+			if filepath.Clean(existing.Destination) == filepath.Clean(m.Destination) {
+				return fmt.Errorf("mount destination %s already exists: %w", m.Destination, errdefs.ErrAlreadyExists)
+			}
+		}
+		spec.Mounts = append(spec.Mounts, m)
+	}
+	return writeInitOCISpec(p.bundle, spec)
+}
+
+func validateSpecPatch(patch SpecPatch) error {
+	if len(patch.Env) == 0 && len(patch.Mounts) == 0 {
+		return fmt.Errorf("empty spec patch: %w", errdefs.ErrInvalidArgument)
+	}
+
+	for _, env := range patch.Env {
+		if idx := strings.Index(env, "="); idx <= 0 {
+			return fmt.Errorf("invalid env %q, expected KEY=VALUE: %w", env, errdefs.ErrInvalidArgument)
+		}
+	}
+
+	for _, m := range patch.Mounts {
+		if !filepath.IsAbs(m.Destination) {
+			return fmt.Errorf("mount destination %q must be absolute: %w", m.Destination, errdefs.ErrInvalidArgument)
+		}
+		if m.Source == "" {
+			return fmt.Errorf("mount source of %s is required: %w", m.Destination, errdefs.ErrInvalidArgument)
+		}
+	}
+	return nil
+}
+
+// mergeEnv replaces the env with same key and appends the new ones.
+func mergeEnv(current, patch []string) []string {
+	merged := make([]string, 0, len(current)+len(patch))
+	index := make(map[string]int, len(current))
+
+	for _, env := range append(append([]string{}, current...), patch...) {
+		key := strings.SplitN(env, "=", 2)[0]
+		if i, ok := index[key]; ok {
+			merged[i] = env
+			continue
+		}
+		index[key] = len(merged)
+		merged = append(merged, env)
+	}
+	return merged
+}
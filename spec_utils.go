@@ -0,0 +1,56 @@
+//go:build linux
+// +build linux
+
+package embedshim
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"github.com/containerd/containerd/errdefs"
+	ptypes "github.com/gogo/protobuf/types"
+)
+
+// patchRawJSON patches the JSON object in the Any, like the OCI spec and
+// the resources. The object is decoded as raw fields so that the fields
+// unknown to the vendored runtime-spec are kept. The Any is returned as it
+// is if fn reports nothing changed.
+func patchRawJSON(a *ptypes.Any, name string, fn func(root map[string]json.RawMessage) (bool, error)) (*ptypes.Any, error) {
+	var root map[string]json.RawMessage
+	if err := unmarshalRawJSON(a.Value, name, &root); err != nil {
+		return nil, err
+	}
+
+	changed, err := fn(root)
+	if err != nil {
+		return nil, err
+	}
+	if !changed {
+		return a, nil
+	}
+
+	value, err := json.Marshal(root)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal %s: %w", name, err)
+	}
+	return &ptypes.Any{TypeUrl: a.TypeUrl, Value: value}, nil
+}
+
+// unmarshalRawField decodes the field of the raw JSON object into v. It
+// returns false if the field doesn't exist.
+func unmarshalRawField(obj map[string]json.RawMessage, key string, name string, v interface{}) (bool, error) {
+	raw, ok := obj[key]
+	if !ok {
+		return false, nil
+	}
+	return true, unmarshalRawJSON(raw, name, v)
+}
+
+// unmarshalRawJSON decodes the data into v. The error is ErrInvalidArgument
+// with the cause, and name is the decoded part, like "spec annotations".
+func unmarshalRawJSON(data []byte, name string, v interface{}) error {
+	if err := json.Unmarshal(data, v); err != nil {
+		return fmt.Errorf("failed to unmarshal %s: %v: %w", name, err, errdefs.ErrInvalidArgument)
+	}
+	return nil
+}
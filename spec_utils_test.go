@@ -0,0 +1,65 @@
+//go:build linux
+// +build linux
+
+package embedshim
+
+import (
+	"encoding/json"
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/containerd/containerd/errdefs"
+	ptypes "github.com/gogo/protobuf/types"
+)
+
+func TestPatchRawJSON(t *testing.T) {
+	spec := &ptypes.Any{TypeUrl: "spec", Value: []byte(`{"process":{"args":["sh"]},"unknown":{"key":1}}`)}
+
+	got, err := patchRawJSON(spec, "spec", func(root map[string]json.RawMessage) (bool, error) {
+		return false, nil
+	})
+	if err != nil || got != spec {
+		t.Fatalf("expected the same spec, but got %v (err: %v)", got, err)
+	}
+
+	got, err = patchRawJSON(spec, "spec", func(root map[string]json.RawMessage) (bool, error) {
+		root["hostname"], _ = json.Marshal("test")
+		return true, nil
+	})
+	if err != nil {
+		t.Fatalf("failed to patch spec: %v", err)
+	}
+	if got.TypeUrl != spec.TypeUrl {
+		t.Fatalf("expected type url %v, but got %v", spec.TypeUrl, got.TypeUrl)
+	}
+
+	var root map[string]json.RawMessage
+	if err := json.Unmarshal(got.Value, &root); err != nil {
+		t.Fatalf("failed to unmarshal patched spec: %v", err)
+	}
+	if string(root["unknown"]) != `{"key":1}` || string(root["hostname"]) != `"test"` {
+		t.Fatalf("expected unknown field kept and hostname set, but got %s", got.Value)
+	}
+}
+
+func TestPatchRawJSONInvalid(t *testing.T) {
+	_, err := patchRawJSON(&ptypes.Any{Value: []byte(`{`)}, "spec", func(map[string]json.RawMessage) (bool, error) {
+		t.Fatalf("expected invalid spec not to be patched")
+		return false, nil
+	})
+	if !errors.Is(err, errdefs.ErrInvalidArgument) || !strings.Contains(err.Error(), "unexpected end of JSON input") {
+		t.Fatalf("expected invalid argument with json error, but got %v", err)
+	}
+
+	var args []string
+	obj := map[string]json.RawMessage{"args": json.RawMessage(`"sh"`)}
+	if _, err := unmarshalRawField(obj, "args", "process args", &args); !errors.Is(err, errdefs.ErrInvalidArgument) ||
+		!strings.Contains(err.Error(), "process args: json: cannot unmarshal") {
+		t.Fatalf("expected invalid argument with json error, but got %v", err)
+	}
+
+	if ok, err := unmarshalRawField(obj, "env", "process env", &args); ok || err != nil {
+		t.Fatalf("expected missing field, but got %v (err: %v)", ok, err)
+	}
+}
@@ -0,0 +1,283 @@
+//go:build linux
+// +build linux
+
+package embedshim
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/containerd/containerd/errdefs"
+	"github.com/opencontainers/runtime-spec/specs-go"
+)
+
+// SpecProblem is one problem found in the OCI spec.
+type SpecProblem struct {
+	// Field is the spec field in JSON path, like "linux.maskedPaths[0]".
+	Field string
+	// Message describes what is wrong with the field.
+	Message string
+}
+
+func (p SpecProblem) String() string {
+	return p.Field + ": " + p.Message
+}
+
+// SpecValidationError aggregates all the problems found in the OCI spec so
+// that the user is able to fix them at once. It is ErrInvalidArgument.
+type SpecValidationError struct {
+	Problems []SpecProblem
+}
+
+func (e *SpecValidationError) Error() string {
+	msgs := make([]string, 0, len(e.Problems))
+	for _, p := range e.Problems {
+		msgs = append(msgs, p.String())
+	}
+	return fmt.Sprintf("invalid spec with %d problem(s): %s", len(e.Problems), strings.Join(msgs, "; "))
+}
+
+func (e *SpecValidationError) Unwrap() error {
+	return errdefs.ErrInvalidArgument
+}
+
+// specValidator collects the problems of spec.
+type specValidator struct {
+	problems []SpecProblem
+}
+
+func (v *specValidator) addf(field string, format string, args ...interface{}) {
+	v.problems = append(v.problems, SpecProblem{Field: field, Message: fmt.Sprintf(format, args...)})
+}
+
+// validateSpec checks the init process's OCI spec before invoking OCI
+// runtime. The rootfs isn't checked because it is mounted by the plugin.
+func validateSpec(spec *specs.Spec) error {
+	v := &specValidator{}
+
+	v.validatePlatform(spec)
+	v.validateProcess(spec.Process)
+	v.validateMounts(spec.Mounts)
+	v.validateHooks(spec.Hooks)
+	if spec.Linux != nil {
+		v.validateNamespaces(spec.Linux)
+		v.validatePathLists(spec.Linux)
+		v.validateRootfsPropagation(spec.Linux)
+	}
+
+	if len(v.problems) == 0 {
+		return nil
+	}
+	return &SpecValidationError{Problems: v.problems}
+}
+
+func (v *specValidator) validatePlatform(spec *specs.Spec) {
+	if spec.Root == nil {
+		v.addf("root", "is required")
+	}
+	if spec.Linux == nil {
+		v.addf("linux", "is required")
+	}
+	if spec.Windows != nil {
+		v.addf("windows", "is not supported on linux")
+	}
+	if spec.Solaris != nil {
+		v.addf("solaris", "is not supported on linux")
+	}
+	if spec.VM != nil {
+		v.addf("vm", "is not supported by runc")
+	}
+}
+
+func (v *specValidator) validateProcess(p *specs.Process) {
+	if p == nil {
+		v.addf("process", "is required for init process")
+		return
+	}
+
+	if len(p.Args) == 0 {
+		v.addf("process.args", "is required")
+	}
+	if !filepath.IsAbs(p.Cwd) {
+		v.addf("process.cwd", "%q must be absolute path", p.Cwd)
+	}
+	if p.ConsoleSize != nil && !p.Terminal {
+		v.addf("process.consoleSize", "requires process.terminal")
+	}
+	for i, env := range p.Env {
+		if !strings.Contains(env, "=") {
+			v.addf(fmt.Sprintf("process.env[%d]", i), "%q must be in KEY=VALUE format", env)
+		}
+	}
+}
+
+func (v *specValidator) validateMounts(mounts []specs.Mount) {
+	for i, m := range mounts {
+		field := fmt.Sprintf("mounts[%d]", i)
+
+		if !filepath.IsAbs(m.Destination) {
+			v.addf(field+".destination", "%q must be absolute path", m.Destination)
+		}
+
+		if _, err := mountOptionsPropagation(m.Options); err != nil {
+			v.addf(field+".options", "%v", err)
+		}
+
+		if !isBindMount(m) {
+			continue
+		}
+		if _, err := os.Stat(m.Source); err != nil {
+			v.addf(field+".source", "bind mount source %q: %v", m.Source, err)
+		}
+	}
+}
+
+func isBindMount(m specs.Mount) bool {
+	if m.Type == "bind" {
+		return true
+	}
+	for _, o := range m.Options {
+		if o == "bind" || o == "rbind" {
+			return true
+		}
+	}
+	return false
+}
+
+func (v *specValidator) validateHooks(hooks *specs.Hooks) {
+	if hooks == nil {
+		return
+	}
+
+	for _, stage := range []struct {
+		name  string
+		hooks []specs.Hook
+	}{
+		{"prestart", hooks.Prestart},
+		{"createRuntime", hooks.CreateRuntime},
+		{"createContainer", hooks.CreateContainer},
+		{"startContainer", hooks.StartContainer},
+		{"poststart", hooks.Poststart},
+		{"poststop", hooks.Poststop},
+	} {
+		for i, h := range stage.hooks {
+			field := fmt.Sprintf("hooks.%s[%d].path", stage.name, i)
+
+			if !filepath.IsAbs(h.Path) {
+				v.addf(field, "%q must be absolute path", h.Path)
+				continue
+			}
+
+			// NOTE: The startContainer hook runs in the container's
+			// namespace so that the path isn't in the host.
+			if stage.name == "startContainer" {
+				continue
+			}
+			if _, err := os.Stat(h.Path); err != nil {
+				v.addf(field, "hook %q: %v", h.Path, err)
+			}
+		}
+	}
+}
+
+var knownNamespaces = map[specs.LinuxNamespaceType]struct{}{
+	specs.PIDNamespace:     {},
+	specs.NetworkNamespace: {},
+	specs.MountNamespace:   {},
+	specs.IPCNamespace:     {},
+	specs.UTSNamespace:     {},
+	specs.UserNamespace:    {},
+	specs.CgroupNamespace:  {},
+	timeNamespace:          {},
+}
+
+func (v *specValidator) validateNamespaces(linux *specs.Linux) {
+	var (
+		seen   = make(map[specs.LinuxNamespaceType]int)
+		userns bool
+	)
+
+	for i, ns := range linux.Namespaces {
+		field := fmt.Sprintf("linux.namespaces[%d]", i)
+
+		if _, ok := knownNamespaces[ns.Type]; !ok {
+			v.addf(field+".type", "unknown namespace type %q", ns.Type)
+			continue
+		}
+		if j, ok := seen[ns.Type]; ok {
+			v.addf(field+".type", "duplicate %s namespace with linux.namespaces[%d]", ns.Type, j)
+			continue
+		}
+		seen[ns.Type] = i
+
+		if ns.Type == specs.UserNamespace {
+			userns = true
+		}
+
+		if ns.Path == "" {
+			continue
+		}
+		if _, err := os.Stat(ns.Path); err != nil {
+			v.addf(field+".path", "namespace %q: %v", ns.Path, err)
+		}
+	}
+
+	_, mntns := seen[specs.MountNamespace]
+	if !mntns && (len(linux.MaskedPaths) > 0 || len(linux.ReadonlyPaths) > 0) {
+		v.addf("linux.namespaces", "mount namespace is required by masked and readonly paths")
+	}
+
+	hasMappings := len(linux.UIDMappings) > 0 || len(linux.GIDMappings) > 0
+	switch {
+	case hasMappings && !userns:
+		v.addf("linux.uidMappings", "requires user namespace")
+	case userns && linux.Namespaces[seen[specs.UserNamespace]].Path == "" && !hasMappings:
+		v.addf("linux.uidMappings", "is required by new user namespace")
+	}
+
+	v.validateSysctlNamespaces(linux)
+}
+
+func (v *specValidator) validateRootfsPropagation(linux *specs.Linux) {
+	if linux.RootfsPropagation == "" {
+		return
+	}
+	if _, ok := mountPropagations[linux.RootfsPropagation]; !ok {
+		v.addf("linux.rootfsPropagation", "unknown propagation %q", linux.RootfsPropagation)
+	}
+}
+
+func (v *specValidator) validatePathLists(linux *specs.Linux) {
+	readonly := make(map[string]int, len(linux.ReadonlyPaths))
+	for i, p := range linux.ReadonlyPaths {
+		field := fmt.Sprintf("linux.readonlyPaths[%d]", i)
+
+		if !filepath.IsAbs(p) {
+			v.addf(field, "%q must be absolute path", p)
+			continue
+		}
+		if filepath.Clean(p) == "/" {
+			v.addf(field, "rootfs can't be readonly path, use root.readonly instead")
+			continue
+		}
+		readonly[filepath.Clean(p)] = i
+	}
+
+	for i, p := range linux.MaskedPaths {
+		field := fmt.Sprintf("linux.maskedPaths[%d]", i)
+
+		if !filepath.IsAbs(p) {
+			v.addf(field, "%q must be absolute path", p)
+			continue
+		}
+		if filepath.Clean(p) == "/" {
+			v.addf(field, "rootfs can't be masked")
+			continue
+		}
+		if j, ok := readonly[filepath.Clean(p)]; ok {
+			v.addf(field, "%q is also linux.readonlyPaths[%d]", p, j)
+		}
+	}
+}
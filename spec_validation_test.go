@@ -0,0 +1,81 @@
+//go:build linux
+// +build linux
+
+package embedshim
+
+import (
+	"errors"
+	"path/filepath"
+	"testing"
+
+	"github.com/containerd/containerd/errdefs"
+	"github.com/opencontainers/runtime-spec/specs-go"
+)
+
+func TestValidateSpecAggregatesProblems(t *testing.T) {
+	missing := filepath.Join(t.TempDir(), "missing")
+
+	spec := &specs.Spec{
+		Root: &specs.Root{Path: "rootfs"},
+		Process: &specs.Process{
+			Args: []string{"sh"},
+			Cwd:  "relative",
+		},
+		Mounts: []specs.Mount{
+			{Destination: "/data", Type: "bind", Source: missing, Options: []string{"rbind"}},
+		},
+		Linux: &specs.Linux{
+			Namespaces: []specs.LinuxNamespace{
+				{Type: specs.MountNamespace},
+				{Type: specs.MountNamespace},
+			},
+			MaskedPaths:   []string{"/proc/kcore"},
+			ReadonlyPaths: []string{"/proc/kcore"},
+		},
+		Windows: &specs.Windows{},
+	}
+
+	err := validateSpec(spec)
+	if !errors.Is(err, errdefs.ErrInvalidArgument) {
+		t.Fatalf("expected ErrInvalidArgument, but got %v", err)
+	}
+
+	var verr *SpecValidationError
+	if !errors.As(err, &verr) {
+		t.Fatalf("expected SpecValidationError, but got %T", err)
+	}
+
+	expected := []string{
+		"windows",
+		"process.cwd",
+		"mounts[0].source",
+		"linux.namespaces[1].type",
+		"linux.maskedPaths[0]",
+	}
+	if len(verr.Problems) != len(expected) {
+		t.Fatalf("expected %v problems, but got %v", len(expected), verr.Problems)
+	}
+	for i, field := range expected {
+		if verr.Problems[i].Field != field {
+			t.Fatalf("expected problem[%d] on %v, but got %v", i, field, verr.Problems[i])
+		}
+	}
+}
+
+func TestValidateSpecValid(t *testing.T) {
+	spec := &specs.Spec{
+		Root:    &specs.Root{Path: "rootfs"},
+		Process: &specs.Process{Args: []string{"sh"}, Cwd: "/"},
+		Linux: &specs.Linux{
+			Namespaces: []specs.LinuxNamespace{
+				{Type: specs.MountNamespace},
+				{Type: specs.NetworkNamespace},
+			},
+			Sysctl: map[string]string{"net.ipv4.ip_forward": "1"},
+		},
+	}
+
+	if err := validateSpec(spec); err != nil {
+		t.Fatalf("expected valid spec, but got %v", err)
+	}
+}
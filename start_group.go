@@ -0,0 +1,138 @@
+//go:build linux
+// +build linux
+
+package embedshim
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/containerd/containerd/errdefs"
+	"github.com/containerd/containerd/log"
+	"golang.org/x/sys/unix"
+)
+
+// startGroupRollbackTimeout is the max time to wait for the started member
+// to exit in rollback.
+var startGroupRollbackTimeout = 10 * time.Second
+
+// StartGroupMember is the created task in the start group.
+type StartGroupMember struct {
+	ID string
+	// DependsOn are the members which must be started before this one.
+	DependsOn []string
+}
+
+// StartGroup starts the created tasks in dependency order, like pod infra
+// container first and then the members. The order of independent members
+// follows the given order.
+//
+// If any member fails to start, the started members are killed in reverse
+// order and the error is returned.
+func (manager *TaskManager) StartGroup(ctx context.Context, members []StartGroupMember) (retErr error) {
+	order, err := sortStartGroup(members)
+	if err != nil {
+		return err
+	}
+
+	shims := make([]*shim, 0, len(order))
+	for _, id := range order {
+		t, err := manager.tasks.Get(ctx, id)
+		if err != nil {
+			return fmt.Errorf("failed to get member %s: %w", id, err)
+		}
+
+		s, ok := t.(*shim)
+		if !ok {
+			return fmt.Errorf("member %s is not managed by embedshim: %w", id, errdefs.ErrNotImplemented)
+		}
+
+		if status, _ := s.init.Status(ctx); status != "created" {
+			return fmt.Errorf("member %s is %s instead of created: %w", id, status, errdefs.ErrFailedPrecondition)
+		}
+		shims = append(shims, s)
+	}
+
+	started := make([]*shim, 0, len(shims))
+	defer func() {
+		if retErr != nil {
+			rollbackStartGroup(started)
+		}
+	}()
+
+	for _, s := range shims {
+		if err := s.Start(ctx); err != nil {
+			return fmt.Errorf("failed to start member %s: %w", s.ID(), err)
+		}
+		started = append(started, s)
+	}
+	return nil
+}
+
+// rollbackStartGroup kills the started members in reverse order.
+func rollbackStartGroup(started []*shim) {
+	ctx, cancel := context.WithTimeout(context.Background(), startGroupRollbackTimeout)
+	defer cancel()
+
+	for i := len(started) - 1; i >= 0; i-- {
+		s := started[i]
+
+		if err := s.Kill(ctx, uint32(unix.SIGKILL), true); err != nil {
+			log.G(ctx).WithError(err).Warnf("failed to kill member %s in rollback", s.ID())
+			continue
+		}
+
+		select {
+		case <-s.init.waitChan():
+		case <-ctx.Done():
+			log.G(ctx).WithError(ctx.Err()).Warnf("failed to wait member %s in rollback", s.ID())
+		}
+	}
+}
+
+// sortStartGroup returns the members' IDs in dependency order.
+func sortStartGroup(members []StartGroupMember) ([]string, error) {
+	var (
+		deps   = make(map[string][]string, len(members))
+		order  = make([]string, 0, len(members))
+		states = make(map[string]int, len(members)) // 1: visiting, 2: visited
+		visit  func(id string) error
+	)
+
+	for _, m := range members {
+		if _, ok := deps[m.ID]; ok {
+			return nil, fmt.Errorf("duplicate member %s: %w", m.ID, errdefs.ErrInvalidArgument)
+		}
+		deps[m.ID] = m.DependsOn
+	}
+
+	visit = func(id string) error {
+		switch states[id] {
+		case 1:
+			return fmt.Errorf("dependency cycle on member %s: %w", id, errdefs.ErrInvalidArgument)
+		case 2:
+			return nil
+		}
+
+		states[id] = 1
+		for _, dep := range deps[id] {
+			if _, ok := deps[dep]; !ok {
+				return fmt.Errorf("member %s depends on unknown member %s: %w", id, dep, errdefs.ErrInvalidArgument)
+			}
+			if err := visit(dep); err != nil {
+				return err
+			}
+		}
+		states[id] = 2
+		order = append(order, id)
+		return nil
+	}
+
+	for _, m := range members {
+		if err := visit(m.ID); err != nil {
+			return nil, err
+		}
+	}
+	return order, nil
+}
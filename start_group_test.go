@@ -0,0 +1,39 @@
+//go:build linux
+// +build linux
+
+package embedshim
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+
+	"github.com/containerd/containerd/errdefs"
+)
+
+func TestSortStartGroup(t *testing.T) {
+	order, err := sortStartGroup([]StartGroupMember{
+		{ID: "app", DependsOn: []string{"sidecar", "pause"}},
+		{ID: "sidecar", DependsOn: []string{"pause"}},
+		{ID: "pause"},
+		{ID: "logger"},
+	})
+	if err != nil {
+		t.Fatalf("failed to sort start group: %v", err)
+	}
+
+	expected := []string{"pause", "sidecar", "app", "logger"}
+	if !reflect.DeepEqual(order, expected) {
+		t.Fatalf("expected %v, but got %v", expected, order)
+	}
+
+	for _, members := range [][]StartGroupMember{
+		{{ID: "a", DependsOn: []string{"b"}}, {ID: "b", DependsOn: []string{"a"}}},
+		{{ID: "a", DependsOn: []string{"unknown"}}},
+		{{ID: "a"}, {ID: "a"}},
+	} {
+		if _, err := sortStartGroup(members); !errors.Is(err, errdefs.ErrInvalidArgument) {
+			t.Fatalf("expected %v, but got %v", errdefs.ErrInvalidArgument, err)
+		}
+	}
+}
@@ -0,0 +1,172 @@
+//go:build linux
+// +build linux
+
+package embedshim
+
+import (
+	"context"
+	"fmt"
+	goruntime "runtime"
+	"sync"
+	"time"
+
+	"github.com/containerd/containerd/log"
+	"golang.org/x/sys/unix"
+)
+
+// execStopPollInterval is the interval to poll the init process's exec stop.
+var execStopPollInterval = 10 * time.Millisecond
+
+// startFrozen starts the init process and freezes it before the first
+// instruction of the container's entrypoint.
+//
+// The runc-init is seized by ptrace with PTRACE_O_TRACEEXEC so that it stops
+// right after execve. The container is paused by the OCI runtime during the
+// stop and then the tracer detaches, so that the entrypoint doesn't run
+// until Resume. The init process is killed if it can't be paused.
+func (p *initProcess) startFrozen(ctx context.Context) error {
+	t, err := seizeExecTracer(p.pid)
+	if err != nil {
+		return fmt.Errorf("failed to trace init process %d: %w", p.pid, err)
+	}
+	defer t.release()
+
+	if err := p.runtime.Start(ctx, p.ID()); err != nil {
+		return p.runtimeError(err, "OCI runtime start failed")
+	}
+
+	if err := t.waitExec(ctx); err != nil {
+		return fmt.Errorf("failed to wait for init process %d to exec: %w", p.pid, err)
+	}
+
+	if err := p.runtime.Pause(ctx, p.ID()); err != nil {
+		rerr := p.runtimeError(err, "OCI runtime pause failed")
+		if kerr := p.kill(ctx, uint32(unix.SIGKILL), false); kerr != nil {
+			log.G(ctx).WithError(kerr).Warnf("failed to kill init process %d which can't be paused", p.pid)
+		}
+		return rerr
+	}
+	return t.detach()
+}
+
+// execTracer traces the process until its next execve. All the ptrace
+// requests are made in one locked thread. The thread exits without unlock if
+// it doesn't detach normally, so that the kernel detaches the tracee.
+type execTracer struct {
+	pid int
+
+	stopped  chan error
+	detachCh chan struct{}
+	detached chan error
+
+	cancelOnce sync.Once
+	cancel     chan struct{}
+}
+
+func seizeExecTracer(pid int) (*execTracer, error) {
+	t := &execTracer{
+		pid:      pid,
+		stopped:  make(chan error, 1),
+		detachCh: make(chan struct{}, 1),
+		detached: make(chan error, 1),
+		cancel:   make(chan struct{}),
+	}
+
+	seized := make(chan error, 1)
+	go func() {
+		goruntime.LockOSThread()
+
+		_, _, errno := unix.Syscall6(unix.SYS_PTRACE, unix.PTRACE_SEIZE,
+			uintptr(pid), 0, unix.PTRACE_O_TRACEEXEC, 0, 0)
+		if errno != 0 {
+			seized <- errno
+			return
+		}
+		seized <- nil
+
+		if err := t.waitExecStop(); err != nil {
+			t.stopped <- err
+			return
+		}
+		t.stopped <- nil
+
+		select {
+		case <-t.cancel:
+			return
+		case <-t.detachCh:
+		}
+
+		if err := unix.PtraceDetach(pid); err != nil {
+			t.detached <- err
+			return
+		}
+		goruntime.UnlockOSThread()
+		t.detached <- nil
+	}()
+
+	if err := <-seized; err != nil {
+		return nil, err
+	}
+	return t, nil
+}
+
+// waitExecStop polls the tracee's stop without blocking the thread so that
+// the tracer can be cancelled.
+func (t *execTracer) waitExecStop() error {
+	for {
+		var ws unix.WaitStatus
+
+		wpid, err := unix.Wait4(t.pid, &ws, unix.WNOHANG|unix.WALL, nil)
+		if err != nil && err != unix.EINTR {
+			return err
+		}
+
+		if wpid == t.pid {
+			switch {
+			case ws.Exited() || ws.Signaled():
+				return fmt.Errorf("process %d exited before exec", t.pid)
+			case ws.Stopped() && ws.StopSignal() == unix.SIGTRAP && ws.TrapCause() == unix.PTRACE_EVENT_EXEC:
+				return nil
+			case ws.Stopped():
+				// re-inject the signal for signal-delivery-stop
+				sig := 0
+				if ws.StopSignal() != unix.SIGTRAP {
+					sig = int(ws.StopSignal())
+				}
+				if err := unix.PtraceCont(t.pid, sig); err != nil {
+					return err
+				}
+			}
+			continue
+		}
+
+		select {
+		case <-t.cancel:
+			return context.Canceled
+		case <-time.After(execStopPollInterval):
+		}
+	}
+}
+
+func (t *execTracer) waitExec(ctx context.Context) error {
+	select {
+	case err := <-t.stopped:
+		return err
+	case <-ctx.Done():
+		t.release()
+		return ctx.Err()
+	}
+}
+
+func (t *execTracer) detach() error {
+	t.detachCh <- struct{}{}
+	return <-t.detached
+}
+
+// release cancels the tracer if it hasn't detached. It is safe to call it
+// many times.
+func (t *execTracer) release() {
+	t.cancelOnce.Do(func() {
+		close(t.cancel)
+	})
+}
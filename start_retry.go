@@ -0,0 +1,138 @@
+//go:build linux
+// +build linux
+
+package embedshim
+
+import (
+	"context"
+	"errors"
+	"os/exec"
+	"strings"
+	"time"
+
+	"github.com/containerd/containerd/log"
+)
+
+var (
+	defaultStartRetryBackoff = 100 * time.Millisecond
+
+	// defaultTransientStartErrors are the OCI runtime's error messages
+	// which might succeed in next try, like the host is under pressure.
+	defaultTransientStartErrors = []string{
+		"resource temporarily unavailable",
+		"interrupted system call",
+		"device or resource busy",
+		"connection reset by peer",
+		"broken pipe",
+	}
+)
+
+// StartRetryConfig retries the OCI runtime's start on transient failures
+// while the task is still in created state, instead of forcing the caller
+// to delete and recreate the task.
+type StartRetryConfig struct {
+	// MaxRetries is the max number of retries. Zero disables retry.
+	MaxRetries int `toml:"max_retries"`
+	// Backoff is the first delay before retry, like "100ms". It is
+	// doubled for each retry.
+	Backoff string `toml:"backoff"`
+	// TransientErrors are the extra substrings of the OCI runtime's error
+	// treated as transient.
+	TransientErrors []string `toml:"transient_errors"`
+	// TransientExitCodes are the OCI runtime's exit codes treated as
+	// transient. The OCI runtime killed by signal is always transient.
+	TransientExitCodes []int `toml:"transient_exit_codes"`
+}
+
+func (c *StartRetryConfig) backoff() time.Duration {
+	if c.Backoff == "" {
+		return defaultStartRetryBackoff
+	}
+
+	d, err := time.ParseDuration(c.Backoff)
+	if err != nil || d <= 0 {
+		log.G(context.Background()).WithError(err).Warnf("invalid start_retry.backoff %q, use %s",
+			c.Backoff, defaultStartRetryBackoff)
+		return defaultStartRetryBackoff
+	}
+	return d
+}
+
+// transient returns true if the OCI runtime's start might succeed in next
+// try. The err is the command's error and the msg is the OCI runtime's last
+// error message.
+func (c *StartRetryConfig) transient(err error, msg string) bool {
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) {
+		code := exitErr.ExitCode()
+		// killed by signal
+		if code == -1 {
+			return true
+		}
+		for _, v := range c.TransientExitCodes {
+			if v == code {
+				return true
+			}
+		}
+	}
+
+	text := strings.ToLower(err.Error() + ": " + msg)
+	for _, patterns := range [][]string{defaultTransientStartErrors, c.TransientErrors} {
+		for _, pattern := range patterns {
+			if pattern != "" && strings.Contains(text, strings.ToLower(pattern)) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func (p *initProcess) startRetryConfig() *StartRetryConfig {
+	if p.parent == nil || p.parent.manager.config == nil {
+		return &StartRetryConfig{}
+	}
+	return &p.parent.manager.config.StartRetry
+}
+
+// runtimeStart invokes the OCI runtime's start with bounded retry. Before
+// retry, the container's state is checked so that the start which took
+// effect but reported failure isn't retried.
+func (p *initProcess) runtimeStart(ctx context.Context) error {
+	cfg := p.startRetryConfig()
+	backoff := cfg.backoff()
+
+	for retries := 0; ; retries++ {
+		err := p.runtime.Start(ctx, p.ID())
+		if err == nil {
+			return nil
+		}
+
+		rerr := p.runtimeError(err, "OCI runtime start failed")
+		msg, _ := p.runtime.LastError()
+		if retries >= cfg.MaxRetries || !cfg.transient(err, msg) {
+			return rerr
+		}
+
+		c, serr := p.runtime.State(ctx, p.ID())
+		if serr != nil {
+			return rerr
+		}
+		switch c.Status {
+		case "running", "paused":
+			log.G(ctx).WithError(rerr).Warnf("OCI runtime start of task %s reported failure but it has started", p.ID())
+			return nil
+		case "created":
+		default:
+			return rerr
+		}
+
+		log.G(ctx).WithError(rerr).Warnf("retry OCI runtime start of task %s in %s (%d/%d)",
+			p.ID(), backoff, retries+1, cfg.MaxRetries)
+		select {
+		case <-ctx.Done():
+			return rerr
+		case <-time.After(backoff):
+		}
+		backoff *= 2
+	}
+}
@@ -0,0 +1,176 @@
+//go:build linux
+// +build linux
+
+package embedshim
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+
+	pkgbundle "github.com/fuweid/embedshim/pkg/bundle"
+
+	"github.com/containerd/containerd/log"
+)
+
+var (
+	// bundleFileKeyStatus is the filename about the task's status record,
+	// which is used to resolve the init process's state after reload.
+	bundleFileKeyStatus = "status.json"
+
+	defaultStatusPersistInterval = 10 * time.Second
+)
+
+// statusRecord is the lightweight snapshot of the task persisted in bundle.
+type statusRecord struct {
+	State      string    `json:"state"`
+	Pid        int       `json:"pid"`
+	StartedAt  time.Time `json:"started_at,omitempty"`
+	ExitedAt   time.Time `json:"exited_at,omitempty"`
+	ExitStatus int       `json:"exit_status"`
+	Execs      []string  `json:"execs,omitempty"`
+	UpdatedAt  time.Time `json:"updated_at"`
+}
+
+func (manager *TaskManager) statusPersistInterval() time.Duration {
+	if manager.config == nil || manager.config.StatusPersistInterval == "" {
+		return defaultStatusPersistInterval
+	}
+
+	d, err := time.ParseDuration(manager.config.StatusPersistInterval)
+	if err != nil || d <= 0 {
+		log.G(context.Background()).WithError(err).Warnf("invalid status_persist_interval %q, use %s",
+			manager.config.StatusPersistInterval, defaultStatusPersistInterval)
+		return defaultStatusPersistInterval
+	}
+	return d
+}
+
+// persistStatusPeriodically persists all the tasks' status records, which
+// covers the changes without state transition, like exec processes.
+func (manager *TaskManager) persistStatusPeriodically() {
+	ticker := time.NewTicker(manager.statusPersistInterval())
+	defer ticker.Stop()
+
+	for range ticker.C {
+		tasks, err := manager.tasks.GetAll(context.Background(), true)
+		if err != nil {
+			log.G(context.Background()).WithError(err).Warn("failed to list tasks for status persistence")
+			continue
+		}
+
+		for _, t := range tasks {
+			if s, ok := t.(*shim); ok {
+				s.persistStatus()
+			}
+		}
+	}
+}
+
+// persistStatus writes the task's status record into bundle. It reads the
+// init process's snapshot without locking so that it is safe to call it
+// with the init process's lock held.
+func (s *shim) persistStatus() {
+	snapshot := s.init.loadSnapshot()
+	if snapshot.deleted {
+		return
+	}
+
+	record := &statusRecord{
+		State:      snapshot.status,
+		Pid:        snapshot.pid,
+		StartedAt:  snapshot.startedAt,
+		ExitedAt:   snapshot.exitedAt,
+		ExitStatus: snapshot.exitStatus,
+		Execs:      s.execIDs(),
+		UpdatedAt:  time.Now(),
+	}
+
+	// NOTE: The bundle might be deleted by concurrent Delete.
+	if err := writeStatusRecord(s.bundle, record); err != nil && !errors.Is(err, os.ErrNotExist) {
+		log.G(context.Background()).WithError(err).Warnf("failed to persist status of task %s", s.ID())
+	}
+}
+
+func (s *shim) execIDs() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	ids := make([]string, 0, len(s.execProcesses))
+	for id := range s.execProcesses {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	return ids
+}
+
+func readStatusRecord(b *pkgbundle.Bundle) (*statusRecord, error) {
+	pathname := filepath.Join(b.Path, bundleFileKeyStatus)
+
+	value, err := os.ReadFile(pathname)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read %v: %w", pathname, err)
+	}
+
+	var record statusRecord
+	if err := json.Unmarshal(value, &record); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal json into status record: %w", err)
+	}
+	return &record, nil
+}
+
+// writeStatusRecord replaces the status record atomically so that the crash
+// doesn't leave partial record.
+func writeStatusRecord(b *pkgbundle.Bundle, record *statusRecord) error {
+	value, err := json.Marshal(record)
+	if err != nil {
+		return fmt.Errorf("failed to marshal %+v into json: %w", record, err)
+	}
+
+	pathname := filepath.Join(b.Path, bundleFileKeyStatus)
+	tmpPathname := pathname + ".tmp"
+	if err := os.WriteFile(tmpPathname, value, 0644); err != nil {
+		return fmt.Errorf("failed to store in %v: %w", tmpPathname, err)
+	}
+
+	if err := os.Rename(tmpPathname, pathname); err != nil {
+		os.Remove(tmpPathname)
+		return fmt.Errorf("failed to rename %v: %w", tmpPathname, err)
+	}
+	return nil
+}
+
+// resolveReloadedState decides the reloaded init process's state, which is
+// created by default. If the record is missing or in created state, the
+// runc-init holding exec.fifo is the source of truth, because the crash might
+// happen between `runc start` and persisting the running state.
+//
+// NOTE: It must be called before repolling, which doesn't change the state
+// but stops the exited init process.
+func (p *initProcess) resolveReloadedState() {
+	record, err := readStatusRecord(p.bundle)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		log.G(context.Background()).WithError(err).Warnf("failed to load status record of %s", p.ID())
+	}
+
+	if record != nil {
+		p.startedAt = record.StartedAt
+		if len(record.Execs) > 0 {
+			log.G(context.Background()).Warnf("exec processes %v of %s are not recovered after reload", record.Execs, p.ID())
+		}
+
+		if record.State == "running" || record.State == "paused" {
+			p.setState(&runningState{p: p})
+			return
+		}
+	}
+
+	if err := checkRuncInitAlive(p); err != nil {
+		p.setState(&runningState{p: p})
+	}
+}
@@ -0,0 +1,47 @@
+//go:build linux
+// +build linux
+
+package embedshim
+
+import (
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+)
+
+func TestPersistStatusSkipsDeletedTask(t *testing.T) {
+	h := newTestHarness(t, "persist-deleted")
+	init := h.shim.init
+
+	if err := init.Create(h.ctx); err != nil {
+		t.Fatalf("failed to create: %v", err)
+	}
+	if err := init.Start(h.ctx); err != nil {
+		t.Fatalf("failed to start: %v", err)
+	}
+
+	record, err := readStatusRecord(h.shim.bundle)
+	if err != nil {
+		t.Fatalf("failed to read status record: %v", err)
+	}
+	if record.State != "running" {
+		t.Fatalf("expected running record, but got %v", record.State)
+	}
+
+	h.runtime.setStatus(init.ID(), "stopped")
+	init.SetExited(int(syscall.SIGKILL))
+	if err := init.Delete(h.ctx); err != nil {
+		t.Fatalf("failed to delete: %v", err)
+	}
+
+	pathname := filepath.Join(h.shim.bundle.Path, bundleFileKeyStatus)
+	if err := os.Remove(pathname); err != nil {
+		t.Fatalf("failed to remove status record: %v", err)
+	}
+
+	h.shim.persistStatus()
+	if _, err := os.Stat(pathname); !os.IsNotExist(err) {
+		t.Fatalf("expected no status record for deleted task, but got %v", err)
+	}
+}
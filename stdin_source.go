@@ -0,0 +1,104 @@
+//go:build linux
+// +build linux
+
+package embedshim
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"strings"
+
+	"github.com/containerd/containerd/content"
+	"github.com/containerd/containerd/errdefs"
+	"github.com/containerd/containerd/namespaces"
+	"github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+var (
+	stdinSchemeFile = "file://"
+	stdinSchemeBlob = "blob://"
+)
+
+// isStdinSource returns true if the stdin is the host file, like
+// file:///data/manifest.json, or the content store blob, like
+// blob://sha256:xxx, instead of fifo.
+func isStdinSource(stdin string) bool {
+	return strings.HasPrefix(stdin, stdinSchemeFile) || strings.HasPrefix(stdin, stdinSchemeBlob)
+}
+
+// validateStdinSource makes sure that the stdin source is readable before
+// the process is created.
+func (manager *TaskManager) validateStdinSource(ns string, stdin string, terminal bool) error {
+	if !isStdinSource(stdin) {
+		return nil
+	}
+
+	if terminal {
+		return fmt.Errorf("stdin source %s can't be used with terminal: %w", stdin, errdefs.ErrInvalidArgument)
+	}
+
+	r, err := manager.openStdinSource(ns, stdin)
+	if err != nil {
+		return err
+	}
+	return r.Close()
+}
+
+// openStdinSource opens the stdin source in the task's namespace.
+func (manager *TaskManager) openStdinSource(ns string, stdin string) (io.ReadCloser, error) {
+	switch {
+	case strings.HasPrefix(stdin, stdinSchemeFile):
+		u, err := url.Parse(stdin)
+		if err != nil {
+			return nil, fmt.Errorf("unable to parse stdin uri %s: %w", stdin, err)
+		}
+
+		f, err := os.Open(u.Path)
+		if err != nil {
+			return nil, fmt.Errorf("failed to open stdin file %s: %w", u.Path, err)
+		}
+		return f, nil
+	case strings.HasPrefix(stdin, stdinSchemeBlob):
+		if manager.contentStore == nil {
+			return nil, fmt.Errorf("content store is unavailable: %w", errdefs.ErrNotImplemented)
+		}
+
+		// NOTE: The digest can't be parsed as URL host because of the
+		// colon. Use the raw string instead.
+		dgst, err := digest.Parse(strings.TrimPrefix(stdin, stdinSchemeBlob))
+		if err != nil {
+			return nil, fmt.Errorf("invalid stdin digest %s: %v: %w", stdin, err, errdefs.ErrInvalidArgument)
+		}
+
+		ctx := namespaces.WithNamespace(context.Background(), ns)
+		ra, err := manager.contentStore.ReaderAt(ctx, ocispec.Descriptor{Digest: dgst})
+		if err != nil {
+			return nil, fmt.Errorf("failed to open stdin blob %s: %w", dgst, err)
+		}
+		return &readCloser{Reader: content.NewReader(ra), Closer: ra}, nil
+	default:
+		return nil, fmt.Errorf("unknown stdin source %s: %w", stdin, errdefs.ErrInvalidArgument)
+	}
+}
+
+type readCloser struct {
+	io.Reader
+	io.Closer
+}
+
+// copyStdinFrom streams the source into the process's stdin and closes the
+// stdin once the source is drained.
+func (p *processIO) copyStdinFrom(src io.ReadCloser) {
+	go func() {
+		buf := bufPool.Get().(*[]byte)
+		defer bufPool.Put(buf)
+
+		io.CopyBuffer(p.io.Stdin(), src, *buf)
+		p.io.Stdin().Close()
+		src.Close()
+	}()
+}
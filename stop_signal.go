@@ -0,0 +1,69 @@
+//go:build linux
+// +build linux
+
+package embedshim
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"github.com/containerd/containerd/errdefs"
+	"golang.org/x/sys/unix"
+)
+
+// labelImageStopSignal is the container label set by containerd client from
+// the image config's StopSignal.
+var labelImageStopSignal = "io.containerd.image.config.stop-signal"
+
+// parseSignal parses the signal in number or name, like "9", "KILL" or
+// "SIGKILL".
+func parseSignal(v string) (syscall.Signal, error) {
+	if n, err := strconv.Atoi(v); err == nil {
+		if n <= 0 || n > 64 {
+			return 0, fmt.Errorf("invalid signal %q: %w", v, errdefs.ErrInvalidArgument)
+		}
+		return syscall.Signal(n), nil
+	}
+
+	name := strings.ToUpper(v)
+	if !strings.HasPrefix(name, "SIG") {
+		name = "SIG" + name
+	}
+
+	sig := unix.SignalNum(name)
+	if sig == 0 {
+		return 0, fmt.Errorf("invalid signal %q: %w", v, errdefs.ErrInvalidArgument)
+	}
+	return sig, nil
+}
+
+// stopSignalFromAnnotations returns zero if the stop signal isn't set.
+func stopSignalFromAnnotations(annotations map[string]string) (syscall.Signal, error) {
+	v, ok := annotations[annotationStopSignal]
+	if !ok || v == "" {
+		return 0, nil
+	}
+
+	sig, err := parseSignal(v)
+	if err != nil {
+		return 0, fmt.Errorf("invalid annotation %s=%q: %w", annotationStopSignal, v, errdefs.ErrInvalidArgument)
+	}
+	return sig, nil
+}
+
+// stopSignal returns the signal used by Kill without signal. The annotation
+// takes precedence over the image's StopSignal and SIGTERM is the default.
+func (s *shim) stopSignal() uint32 {
+	if s.init.stopSignal != 0 {
+		return uint32(s.init.stopSignal)
+	}
+
+	if v := s.labels[labelImageStopSignal]; v != "" {
+		if sig, err := parseSignal(v); err == nil {
+			return uint32(sig)
+		}
+	}
+	return uint32(unix.SIGTERM)
+}
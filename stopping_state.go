@@ -0,0 +1,131 @@
+//go:build linux
+// +build linux
+
+package embedshim
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/containerd/containerd/errdefs"
+	"github.com/containerd/containerd/runtime"
+	google_protobuf "github.com/gogo/protobuf/types"
+	"golang.org/x/sys/unix"
+)
+
+// ErrTaskStopping is returned by Exec and exec's Start if the task has been
+// signaled to stop but hasn't exited yet. It is ErrFailedPrecondition.
+var ErrTaskStopping = fmt.Errorf("task is stopping: %w", errdefs.ErrFailedPrecondition)
+
+// StoppingExecPolicy is the exec behavior in the stopping window, which is
+// between the stop signal's delivery and the init process's exit.
+type StoppingExecPolicy string
+
+const (
+	// StoppingExecReject rejects the exec with ErrTaskStopping. The exec
+	// started in the window might join the namespaces being torn down and
+	// hang until the task is deleted.
+	//
+	// NOTE: The init process which handles or ignores the stop signal stays
+	// in stopping until it exits, and rejects all the execs meanwhile.
+	StoppingExecReject StoppingExecPolicy = "reject"
+	// StoppingExecAllow allows the exec, like the pre-stop hooks which
+	// run after the stop signal, which is the default. The caller has to
+	// handle the exec killed by the exit.
+	StoppingExecAllow StoppingExecPolicy = "allow"
+)
+
+// stoppingState is the running init process which has received the stop
+// signal. It is reported as running because containerd has no such status.
+//
+// NOTE: The init process might handle the signal and keep running. It
+// stays in stopping until it exits, which is usually forced by SIGKILL
+// after the grace period.
+type stoppingState struct {
+	p *initProcess
+}
+
+func (s *stoppingState) transition(name string) error {
+	switch name {
+	case "stopped":
+		s.p.setState(&stoppedState{p: s.p})
+	default:
+		return fmt.Errorf("invalid state transition %q to %q", stateName(s), name)
+	}
+	return nil
+}
+
+func (s *stoppingState) Pause(_ context.Context) error {
+	return fmt.Errorf("cannot pause a stopping container")
+}
+
+func (s *stoppingState) Resume(_ context.Context) error {
+	return fmt.Errorf("cannot resume a stopping container")
+}
+
+func (s *stoppingState) Update(ctx context.Context, r *google_protobuf.Any) error {
+	return s.p.update(ctx, r)
+}
+
+func (s *stoppingState) Checkpoint(_ context.Context, _ *CheckpointConfig) error {
+	return fmt.Errorf("cannot checkpoint a stopping container")
+}
+
+func (s *stoppingState) Start(_ context.Context) error {
+	return fmt.Errorf("cannot start a stopping process")
+}
+
+func (s *stoppingState) Delete(_ context.Context) error {
+	return fmt.Errorf("cannot delete a stopping process")
+}
+
+func (s *stoppingState) Kill(ctx context.Context, sig uint32, all bool) error {
+	return s.p.kill(ctx, sig, all)
+}
+
+func (s *stoppingState) SetExited(status int) {
+	s.p.setExited(status)
+
+	if err := s.transition("stopped"); err != nil {
+		panic(err)
+	}
+}
+
+func (s *stoppingState) Exec(ctx context.Context, id string, opts runtime.ExecOpts) (runtime.Process, error) {
+	if !s.p.stoppingExecAllowed() {
+		return nil, fmt.Errorf("cannot exec %s in task %s: %w", id, s.p.ID(), ErrTaskStopping)
+	}
+	return s.p.exec(ctx, id, opts)
+}
+
+func (s *stoppingState) Status(_ context.Context) (string, error) {
+	return "running", nil
+}
+
+// isStoppingSignal returns true if the signal is expected to terminate the
+// init process, which is one of the common termination signals or the
+// task's stop signal.
+func (p *initProcess) isStoppingSignal(sig uint32) bool {
+	switch unix.Signal(sig) {
+	case unix.SIGKILL, unix.SIGTERM, unix.SIGINT, unix.SIGQUIT:
+		return true
+	}
+	return p.parent != nil && p.parent.stopSignal() == sig
+}
+
+func (p *initProcess) stoppingExecAllowed() bool {
+	if p.parent == nil || p.parent.manager.config == nil {
+		return true
+	}
+	return p.parent.manager.config.StoppingExec != StoppingExecReject
+}
+
+// checkExecStart rejects the created exec process being started in the
+// stopping window. It reads the snapshot so that it doesn't wait for the
+// init process's lock.
+func (p *initProcess) checkExecStart(execID string) error {
+	if p.loadSnapshot().stopping && !p.stoppingExecAllowed() {
+		return fmt.Errorf("cannot start exec %s in task %s: %w", execID, p.ID(), ErrTaskStopping)
+	}
+	return nil
+}
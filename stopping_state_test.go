@@ -0,0 +1,76 @@
+//go:build linux
+// +build linux
+
+package embedshim
+
+import (
+	"errors"
+	"syscall"
+	"testing"
+
+	"github.com/containerd/containerd/errdefs"
+	"github.com/containerd/containerd/runtime"
+)
+
+func TestInitProcessStopping(t *testing.T) {
+	h := newTestHarness(t, "stopping")
+	init := h.shim.init
+
+	if err := init.Create(h.ctx); err != nil {
+		t.Fatalf("failed to create: %v", err)
+	}
+	if err := init.Start(h.ctx); err != nil {
+		t.Fatalf("failed to start: %v", err)
+	}
+
+	// the non-terminating signal doesn't stop the task
+	if err := init.Kill(h.ctx, uint32(syscall.SIGHUP), false); err != nil {
+		t.Fatalf("failed to kill: %v", err)
+	}
+	if init.loadSnapshot().stopping {
+		t.Fatal("expected running task after SIGHUP, but got stopping")
+	}
+
+	if err := init.Kill(h.ctx, uint32(syscall.SIGTERM), false); err != nil {
+		t.Fatalf("failed to kill: %v", err)
+	}
+	if !init.loadSnapshot().stopping {
+		t.Fatal("expected stopping task after SIGTERM, but got running")
+	}
+	h.expectStatus("running")
+
+	// the exec is allowed by default
+	if err := init.checkExecStart("exec1"); err != nil {
+		t.Fatalf("expected exec allowed, but got %v", err)
+	}
+
+	h.manager.config = &Config{StoppingExec: StoppingExecReject}
+	_, err := init.Exec(h.ctx, "exec1", runtime.ExecOpts{})
+	if !errors.Is(err, ErrTaskStopping) || !errors.Is(err, errdefs.ErrFailedPrecondition) {
+		t.Fatalf("expected ErrTaskStopping, but got %v", err)
+	}
+	if err := init.checkExecStart("exec1"); !errors.Is(err, ErrTaskStopping) {
+		t.Fatalf("expected ErrTaskStopping, but got %v", err)
+	}
+
+	if err := init.Pause(h.ctx); err == nil {
+		t.Fatal("expected error when pausing stopping process, but got nil")
+	}
+
+	// the escalation is allowed
+	if err := init.Kill(h.ctx, uint32(syscall.SIGKILL), false); err != nil {
+		t.Fatalf("failed to kill: %v", err)
+	}
+
+	h.manager.config = &Config{StoppingExec: StoppingExecAllow}
+	if err := init.checkExecStart("exec1"); err != nil {
+		t.Fatalf("expected exec allowed, but got %v", err)
+	}
+
+	h.runtime.setStatus(init.ID(), "stopped")
+	init.SetExited(int(syscall.SIGKILL))
+	h.expectStatus("stopped")
+	if init.loadSnapshot().stopping {
+		t.Fatal("expected stopped task, but got stopping")
+	}
+}
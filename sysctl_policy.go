@@ -0,0 +1,128 @@
+//go:build linux
+// +build linux
+
+package embedshim
+
+import (
+	"sort"
+	"strings"
+
+	"github.com/opencontainers/runtime-spec/specs-go"
+)
+
+// SysctlPolicyConfig rejects the unsafe sysctls in the task's spec, like
+// kubelet's --allowed-unsafe-sysctls.
+type SysctlPolicyConfig struct {
+	Enabled bool `toml:"enabled"`
+
+	// AllowedUnsafe is the unsafe sysctls allowed in addition to the safe
+	// ones. The pattern is the exact key or the prefix ending with "*",
+	// like "net.core.*".
+	AllowedUnsafe []string `toml:"allowed_unsafe"`
+}
+
+// safeSysctls is kubelet's safe sysctl set, which is namespaced and
+// isolated from the other containers and the host.
+var safeSysctls = map[string]struct{}{
+	"kernel.shm_rmid_forced":              {},
+	"net.ipv4.ip_local_port_range":        {},
+	"net.ipv4.tcp_syncookies":             {},
+	"net.ipv4.ping_group_range":           {},
+	"net.ipv4.ip_unprivileged_port_start": {},
+	"net.ipv4.ip_local_reserved_ports":    {},
+	"net.ipv4.tcp_keepalive_time":         {},
+	"net.ipv4.tcp_fin_timeout":            {},
+	"net.ipv4.tcp_keepalive_intvl":        {},
+	"net.ipv4.tcp_keepalive_probes":       {},
+}
+
+// normalizeSysctl converts the key in slash format, like
+// "net/ipv4/ip_forward", into dot format.
+func normalizeSysctl(key string) string {
+	return strings.ReplaceAll(key, "/", ".")
+}
+
+// sysctlNamespace returns the namespace isolating the sysctl. It is false
+// if the sysctl isn't namespaced, which is the host's global setting. It
+// follows runc's libcontainer/configs/validate.
+func sysctlNamespace(key string) (specs.LinuxNamespaceType, bool) {
+	switch {
+	case strings.HasPrefix(key, "net."):
+		return specs.NetworkNamespace, true
+	case strings.HasPrefix(key, "fs.mqueue."),
+		strings.HasPrefix(key, "kernel.msg"),
+		strings.HasPrefix(key, "kernel.shm"),
+		key == "kernel.sem":
+		return specs.IPCNamespace, true
+	case key == "kernel.hostname", key == "kernel.domainname":
+		return specs.UTSNamespace, true
+	default:
+		return "", false
+	}
+}
+
+// sortedSysctlKeys returns the keys in order so that the problems are
+// stable.
+func sortedSysctlKeys(sysctl map[string]string) []string {
+	keys := make([]string, 0, len(sysctl))
+	for key := range sysctl {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// validateSysctlNamespaces checks each sysctl is isolated by the namespace
+// which the container has. The joined namespace by path counts.
+func (v *specValidator) validateSysctlNamespaces(linux *specs.Linux) {
+	has := make(map[specs.LinuxNamespaceType]bool, len(linux.Namespaces))
+	for _, ns := range linux.Namespaces {
+		has[ns.Type] = true
+	}
+
+	for _, key := range sortedSysctlKeys(linux.Sysctl) {
+		ns, ok := sysctlNamespace(normalizeSysctl(key))
+		if !ok {
+			v.addf("linux.sysctl."+key, "is not namespaced and can't be set in container")
+			continue
+		}
+		if !has[ns] {
+			v.addf("linux.sysctl."+key, "requires %s namespace", ns)
+		}
+	}
+}
+
+// validateUnsafeSysctls rejects the sysctls which are neither safe nor
+// allowed by the policy.
+func (v *specValidator) validateUnsafeSysctls(linux *specs.Linux, cfg SysctlPolicyConfig) {
+	for _, key := range sortedSysctlKeys(linux.Sysctl) {
+		name := normalizeSysctl(key)
+		if _, ok := safeSysctls[name]; ok {
+			continue
+		}
+		if matchEnvPatterns(cfg.AllowedUnsafe, name) {
+			continue
+		}
+		v.addf("linux.sysctl."+key, "unsafe sysctl is not allowed by plugin, see sysctl_policy.allowed_unsafe")
+	}
+}
+
+// validateSysctls checks the spec's sysctls against the container's
+// namespaces and the policy. The error is SpecValidationError with one
+// problem per sysctl.
+func validateSysctls(spec *specs.Spec, cfg SysctlPolicyConfig) error {
+	if spec.Linux == nil || len(spec.Linux.Sysctl) == 0 {
+		return nil
+	}
+
+	v := &specValidator{}
+	v.validateSysctlNamespaces(spec.Linux)
+	if cfg.Enabled {
+		v.validateUnsafeSysctls(spec.Linux, cfg)
+	}
+
+	if len(v.problems) == 0 {
+		return nil
+	}
+	return &SpecValidationError{Problems: v.problems}
+}
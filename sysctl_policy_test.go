@@ -0,0 +1,59 @@
+//go:build linux
+// +build linux
+
+package embedshim
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/opencontainers/runtime-spec/specs-go"
+)
+
+func TestValidateSysctls(t *testing.T) {
+	spec := &specs.Spec{
+		Linux: &specs.Linux{
+			Namespaces: []specs.LinuxNamespace{
+				{Type: specs.IPCNamespace},
+				{Type: specs.UTSNamespace},
+			},
+			Sysctl: map[string]string{
+				"kernel.shm_rmid_forced": "1",
+				"kernel.msgmax":          "65536",
+				"net/ipv4/ip_forward":    "1",
+				"vm.swappiness":          "10",
+				"kernel.domainname":      "example.com",
+			},
+		},
+	}
+
+	err := validateSysctls(spec, SysctlPolicyConfig{Enabled: true, AllowedUnsafe: []string{"kernel.msg*"}})
+
+	var verr *SpecValidationError
+	if !errors.As(err, &verr) {
+		t.Fatalf("expected SpecValidationError, but got %v", err)
+	}
+
+	expected := []SpecProblem{
+		{"linux.sysctl.net/ipv4/ip_forward", "requires network namespace"},
+		{"linux.sysctl.vm.swappiness", "is not namespaced and can't be set in container"},
+		{"linux.sysctl.kernel.domainname", "unsafe sysctl is not allowed by plugin, see sysctl_policy.allowed_unsafe"},
+		{"linux.sysctl.net/ipv4/ip_forward", "unsafe sysctl is not allowed by plugin, see sysctl_policy.allowed_unsafe"},
+		{"linux.sysctl.vm.swappiness", "unsafe sysctl is not allowed by plugin, see sysctl_policy.allowed_unsafe"},
+	}
+	if len(verr.Problems) != len(expected) {
+		t.Fatalf("expected %v, but got %v", expected, verr.Problems)
+	}
+	for i := range expected {
+		if verr.Problems[i] != expected[i] {
+			t.Fatalf("expected problem[%d] %v, but got %v", i, expected[i], verr.Problems[i])
+		}
+	}
+
+	// the unsafe sysctls are allowed if the policy is disabled
+	spec.Linux.Namespaces = append(spec.Linux.Namespaces, specs.LinuxNamespace{Type: specs.NetworkNamespace})
+	delete(spec.Linux.Sysctl, "vm.swappiness")
+	if err := validateSysctls(spec, SysctlPolicyConfig{}); err != nil {
+		t.Fatalf("expected valid sysctls, but got %v", err)
+	}
+}
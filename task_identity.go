@@ -0,0 +1,249 @@
+//go:build linux
+// +build linux
+
+package embedshim
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"syscall"
+
+	pkgbundle "github.com/fuweid/embedshim/pkg/bundle"
+
+	"github.com/containerd/cgroups"
+	cgroupsv2 "github.com/containerd/cgroups/v2"
+	eventstypes "github.com/containerd/containerd/api/events"
+	"github.com/containerd/containerd/events"
+	"github.com/containerd/typeurl"
+	"github.com/sirupsen/logrus"
+)
+
+// TaskIdentityEventTopic is the topic of TaskIdentity event.
+const TaskIdentityEventTopic = "/tasks/identity"
+
+var (
+	// bundleFileKeyIdentity is the filename about the init process's
+	// cgroup and pid namespace captured when it was running.
+	bundleFileKeyIdentity = "identity.json"
+
+	cgroupv2Root = "/sys/fs/cgroup"
+)
+
+func init() {
+	typeurl.Register(&TaskIdentity{}, "io.embedshim.events.v1", "TaskIdentity")
+}
+
+// TaskIdentity follows the task's lifecycle event, like create, start, exit
+// and delete. It carries the kernel-side identity of the container so that
+// the subscribers are able to correlate the eBPF telemetry keyed by cgroup
+// or pid namespace without extra lookups.
+type TaskIdentity struct {
+	ContainerID string `json:"container_id"`
+	ID          string `json:"id"`
+	// Topic is the lifecycle event's topic which this event follows.
+	Topic             string `json:"topic"`
+	Pid               uint32 `json:"pid"`
+	CgroupPath        string `json:"cgroup_path"`
+	CgroupID          uint64 `json:"cgroup_id"`
+	PidNamespaceInode uint64 `json:"pid_namespace_inode"`
+	// NsPid is the pid in the container's pid namespace. It is zero if it
+	// is unknown.
+	NsPid uint32 `json:"ns_pid"`
+}
+
+// Field implements events.Event.
+func (e *TaskIdentity) Field(fieldpath []string) (string, bool) {
+	if len(fieldpath) == 0 {
+		return "", false
+	}
+
+	switch fieldpath[0] {
+	case "container_id":
+		return e.ContainerID, len(e.ContainerID) > 0
+	case "id":
+		return e.ID, len(e.ID) > 0
+	case "topic":
+		return e.Topic, len(e.Topic) > 0
+	case "cgroup_path":
+		return e.CgroupPath, len(e.CgroupPath) > 0
+	}
+	return "", false
+}
+
+// taskIdentity is captured when the init process is alive, because the
+// procfs entries are gone after the process exits. It is stored in bundle so
+// that it is still available after containerd restarts.
+type taskIdentity struct {
+	CgroupPath        string `json:"cgroup_path"`
+	CgroupID          uint64 `json:"cgroup_id"`
+	PidNamespaceInode uint64 `json:"pid_namespace_inode"`
+	// InitNsPid is the init process's pid in its pid namespace.
+	InitNsPid uint32 `json:"init_ns_pid,omitempty"`
+}
+
+// loadIdentity captures the init process's cgroup path and pid namespace.
+// The identity stored in bundle is used if the init process has exited.
+func (s *shim) loadIdentity() {
+	identity, err := s.captureIdentity()
+	if err != nil {
+		identity, err = readTaskIdentity(s.bundle)
+		if err != nil {
+			logrus.WithError(err).Warnf("loading identity for task %s", s.ID())
+			return
+		}
+	} else if err := writeTaskIdentity(s.bundle, identity); err != nil {
+		logrus.WithError(err).Warnf("storing identity for task %s", s.ID())
+	}
+
+	s.identity.Store(identity)
+	s.manager.cgroupIDs.add(identity.CgroupID, s.Namespace(), s.ID())
+}
+
+func (s *shim) captureIdentity() (*taskIdentity, error) {
+	pid := int(s.PID())
+	if pid <= 0 {
+		return nil, fmt.Errorf("init process of task %s isn't running", s.ID())
+	}
+
+	cgroupPath, err := pidCgroupPath(pid)
+	if err != nil {
+		return nil, fmt.Errorf("loading cgroup path for %d: %w", pid, err)
+	}
+
+	pidnsInode, err := pidNamespaceInode(pid)
+	if err != nil {
+		return nil, fmt.Errorf("loading pid namespace for %d: %w", pid, err)
+	}
+
+	// NOTE: The cgroup ID is only available in cgroup v2 hierarchy, which
+	// is also mounted in hybrid mode.
+	var cgroupID uint64
+	if trimmed := s.trimInitSubgroup(cgroupPath); trimmed != cgroupPath {
+		// The identity is about the container's cgroup instead of the
+		// init's leaf cgroup.
+		cgroupPath = trimmed
+		cgroupID, err = inodeOf(filepath.Join(cgroupv2Root, cgroupPath))
+	} else {
+		cgroupID, err = pidCgroupID(pid)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	identity := &taskIdentity{
+		CgroupPath:        cgroupPath,
+		CgroupID:          cgroupID,
+		PidNamespaceInode: pidnsInode,
+	}
+	if st, err := readProcStatus(pid); err == nil && len(st.nsPids) > 0 {
+		identity.InitNsPid = st.nsPids[len(st.nsPids)-1]
+	}
+	return identity, nil
+}
+
+func (s *shim) loadedIdentity() *taskIdentity {
+	if v, ok := s.identity.Load().(*taskIdentity); ok {
+		return v
+	}
+	return &taskIdentity{}
+}
+
+// publishTaskEvent publishes the lifecycle event followed by TaskIdentity
+// event if it is enabled. The TaskExit event is queued if batching is
+// enabled. The task's webhook is notified as well.
+func (s *shim) publishTaskEvent(topic string, execID string, pid uint32, event events.Event) {
+	if b := s.manager.exitBatcher; b != nil {
+		if exit, ok := event.(*eventstypes.TaskExit); ok {
+			b.add(s.Namespace(), exit)
+		} else {
+			b.flushTask(s.Namespace(), s.ID())
+			s.manager.publishEvent(s.Namespace(), topic, event)
+		}
+	} else {
+		s.manager.publishEvent(s.Namespace(), topic, event)
+	}
+	s.webhook.notify(topic, execID, pid, event)
+
+	if s.manager.config == nil || !s.manager.config.IdentityEvents {
+		return
+	}
+
+	if execID == "" {
+		execID = s.ID()
+	}
+
+	identity := s.loadedIdentity()
+	s.manager.publishEvent(s.Namespace(), TaskIdentityEventTopic, &TaskIdentity{
+		ContainerID:       s.ID(),
+		ID:                execID,
+		Topic:             topic,
+		Pid:               pid,
+		CgroupPath:        identity.CgroupPath,
+		CgroupID:          identity.CgroupID,
+		PidNamespaceInode: identity.PidNamespaceInode,
+		NsPid:             s.processNsPid(execID, pid),
+	})
+}
+
+// pidCgroupPath returns the process's cgroup path. The memory controller's
+// path is used for cgroup v1.
+func pidCgroupPath(pid int) (string, error) {
+	if cgroups.Mode() == cgroups.Unified {
+		return cgroupsv2.PidGroupPath(pid)
+	}
+
+	paths, err := cgroups.ParseCgroupFile(filepath.Join("/proc", strconv.Itoa(pid), "cgroup"))
+	if err != nil {
+		return "", err
+	}
+	if p, ok := paths["memory"]; ok {
+		return p, nil
+	}
+	for _, p := range paths {
+		return p, nil
+	}
+	return "", fmt.Errorf("no cgroup found for %d", pid)
+}
+
+func pidNamespaceInode(pid int) (uint64, error) {
+	return inodeOf(filepath.Join("/proc", strconv.Itoa(pid), "ns", "pid"))
+}
+
+func inodeOf(path string) (uint64, error) {
+	fi, err := os.Stat(path)
+	if err != nil {
+		return 0, err
+	}
+	return fi.Sys().(*syscall.Stat_t).Ino, nil
+}
+
+func readTaskIdentity(b *pkgbundle.Bundle) (*taskIdentity, error) {
+	pathname := filepath.Join(b.Path, bundleFileKeyIdentity)
+
+	value, err := os.ReadFile(pathname)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read %v: %w", pathname, err)
+	}
+
+	var identity taskIdentity
+	if err := json.Unmarshal(value, &identity); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal json into identity: %w", err)
+	}
+	return &identity, nil
+}
+
+func writeTaskIdentity(b *pkgbundle.Bundle, identity *taskIdentity) error {
+	value, err := json.Marshal(identity)
+	if err != nil {
+		return fmt.Errorf("failed to marshal %+v into json: %w", identity, err)
+	}
+
+	pathname := filepath.Join(b.Path, bundleFileKeyIdentity)
+	if err := os.WriteFile(pathname, value, 0644); err != nil {
+		return fmt.Errorf("failed to store in %v: %w", pathname, err)
+	}
+	return nil
+}
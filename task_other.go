@@ -0,0 +1,280 @@
+//go:build !linux
+// +build !linux
+
+package embedshim
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"sync"
+	"time"
+
+	eventstypes "github.com/containerd/containerd/api/events"
+	"github.com/containerd/containerd/errdefs"
+	"github.com/containerd/containerd/namespaces"
+	"github.com/containerd/containerd/runtime"
+	"github.com/gogo/protobuf/types"
+	"github.com/opencontainers/runtime-spec/specs-go"
+	"golang.org/x/sys/unix"
+)
+
+// processTask runs the spec's process as the plugin's child, without the
+// rootfs, namespaces and cgroups.
+type processTask struct {
+	manager      *TaskManager
+	namespace    string
+	id           string
+	bundle       string
+	process      *specs.Process
+	stdio        runtime.IO
+	traceEventID uint64
+
+	waitCh chan struct{}
+
+	mu         sync.Mutex
+	status     runtime.Status
+	pid        int
+	exitStatus int
+	exitedAt   time.Time
+}
+
+func newProcessTask(manager *TaskManager, ns, id, bundle string, process *specs.Process, stdio runtime.IO, traceEventID uint64) *processTask {
+	return &processTask{
+		manager:      manager,
+		namespace:    ns,
+		id:           id,
+		bundle:       bundle,
+		process:      process,
+		stdio:        stdio,
+		traceEventID: traceEventID,
+		waitCh:       make(chan struct{}),
+		status:       runtime.CreatedStatus,
+	}
+}
+
+func (t *processTask) ID() string {
+	return t.id
+}
+
+func (t *processTask) Namespace() string {
+	return t.namespace
+}
+
+func (t *processTask) PID() uint32 {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	return uint32(t.pid)
+}
+
+func (t *processTask) State(ctx context.Context) (runtime.State, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	return runtime.State{
+		Pid:        uint32(t.pid),
+		Status:     t.status,
+		Stdout:     t.stdio.Stdout,
+		Stderr:     t.stdio.Stderr,
+		ExitStatus: uint32(t.exitStatus),
+		ExitedAt:   t.exitedAt,
+	}, nil
+}
+
+// Start starts the process in its own process group, so that Kill with all
+// signals its children too.
+func (t *processTask) Start(ctx context.Context) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.status != runtime.CreatedStatus {
+		return fmt.Errorf("task %s has been started: %w", t.id, errdefs.ErrFailedPrecondition)
+	}
+
+	cmd := exec.Command(t.process.Args[0], t.process.Args[1:]...)
+	cmd.Env = t.process.Env
+	cmd.Dir = t.bundle
+	cmd.SysProcAttr = &unix.SysProcAttr{Setpgid: true}
+
+	var files []*os.File
+	defer func() {
+		for _, f := range files {
+			f.Close()
+		}
+	}()
+	// NOTE: The fifos are passed as *os.File so that the process writes
+	// them directly without the copy goroutines of os/exec, which are only
+	// stopped by cmd.Wait.
+	for _, s := range []struct {
+		path string
+		dst  *io.Writer
+	}{
+		{t.stdio.Stdout, &cmd.Stdout},
+		{t.stdio.Stderr, &cmd.Stderr},
+	} {
+		if s.path == "" {
+			continue
+		}
+		f, err := os.OpenFile(s.path, os.O_WRONLY, 0)
+		if err != nil {
+			return fmt.Errorf("failed to open %s: %w", s.path, err)
+		}
+		files = append(files, f)
+		*s.dst = f
+	}
+
+	if err := cmd.Start(); err != nil {
+		return fmt.Errorf("failed to start task %s: %w", t.id, err)
+	}
+	if err := t.manager.monitor.traceProcess(cmd.Process.Pid, t.traceEventID, t.setExited); err != nil {
+		cmd.Process.Kill()
+		cmd.Wait()
+		return err
+	}
+	t.pid = cmd.Process.Pid
+	t.status = runtime.RunningStatus
+
+	t.manager.publishEvent(t.namespace, runtime.TaskStartEventTopic, &eventstypes.TaskStart{
+		ContainerID: t.id,
+		Pid:         uint32(t.pid),
+	})
+	return nil
+}
+
+func (t *processTask) setExited(status int) {
+	t.mu.Lock()
+	t.status = runtime.StoppedStatus
+	t.exitStatus = status
+	t.exitedAt = time.Now()
+	pid := t.pid
+	exitedAt := t.exitedAt
+	t.mu.Unlock()
+
+	close(t.waitCh)
+
+	t.manager.publishEvent(t.namespace, runtime.TaskExitEventTopic, &eventstypes.TaskExit{
+		ContainerID: t.id,
+		ID:          t.id,
+		Pid:         uint32(pid),
+		ExitStatus:  uint32(status),
+		ExitedAt:    exitedAt,
+	})
+}
+
+func (t *processTask) Kill(ctx context.Context, signal uint32, all bool) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.status != runtime.RunningStatus {
+		return fmt.Errorf("process already finished: %w", errdefs.ErrNotFound)
+	}
+
+	pid := t.pid
+	if all {
+		pid = -pid
+	}
+	if err := unix.Kill(pid, unix.Signal(signal)); err != nil {
+		if err == unix.ESRCH {
+			return fmt.Errorf("process already finished: %w", errdefs.ErrNotFound)
+		}
+		return err
+	}
+	return nil
+}
+
+func (t *processTask) Wait(ctx context.Context) (*runtime.Exit, error) {
+	select {
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	case <-t.waitCh:
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	return &runtime.Exit{
+		Pid:       uint32(t.pid),
+		Status:    uint32(t.exitStatus),
+		Timestamp: t.exitedAt,
+	}, nil
+}
+
+func (t *processTask) Delete(ctx context.Context) (*runtime.Exit, error) {
+	t.mu.Lock()
+	if t.status == runtime.RunningStatus {
+		t.mu.Unlock()
+		return nil, fmt.Errorf("task %s is running: %w", t.id, errdefs.ErrFailedPrecondition)
+	}
+	exit := &runtime.Exit{
+		Pid:       uint32(t.pid),
+		Status:    uint32(t.exitStatus),
+		Timestamp: t.exitedAt,
+	}
+	t.mu.Unlock()
+
+	if err := os.RemoveAll(t.bundle); err != nil {
+		return nil, fmt.Errorf("failed to remove bundle of task %s: %w", t.id, err)
+	}
+
+	// NOTE: The task is removed from its own namespace instead of the
+	// caller's, so that the task with the same ID in the other namespace
+	// isn't touched.
+	t.manager.Delete(namespaces.WithNamespace(ctx, t.namespace), t.id)
+
+	t.manager.publishEvent(t.namespace, runtime.TaskDeleteEventTopic, &eventstypes.TaskDelete{
+		ContainerID: t.id,
+		Pid:         exit.Pid,
+		ExitStatus:  exit.Status,
+		ExitedAt:    exit.Timestamp,
+	})
+	return exit, nil
+}
+
+func (t *processTask) Pids(ctx context.Context) ([]runtime.ProcessInfo, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.status != runtime.RunningStatus {
+		return nil, nil
+	}
+	return []runtime.ProcessInfo{{Pid: uint32(t.pid)}}, nil
+}
+
+func (t *processTask) CloseIO(ctx context.Context) error {
+	return nil
+}
+
+func (t *processTask) ResizePty(ctx context.Context, size runtime.ConsoleSize) error {
+	return fmt.Errorf("terminal: %w", errdefs.ErrNotImplemented)
+}
+
+func (t *processTask) Pause(ctx context.Context) error {
+	return fmt.Errorf("pause: %w", errdefs.ErrNotImplemented)
+}
+
+func (t *processTask) Resume(ctx context.Context) error {
+	return fmt.Errorf("resume: %w", errdefs.ErrNotImplemented)
+}
+
+func (t *processTask) Exec(ctx context.Context, id string, opts runtime.ExecOpts) (runtime.Process, error) {
+	return nil, fmt.Errorf("exec: %w", errdefs.ErrNotImplemented)
+}
+
+func (t *processTask) Process(ctx context.Context, id string) (runtime.Process, error) {
+	return nil, fmt.Errorf("process %s: %w", id, errdefs.ErrNotFound)
+}
+
+func (t *processTask) Checkpoint(ctx context.Context, path string, opts *types.Any) error {
+	return fmt.Errorf("checkpoint: %w", errdefs.ErrNotImplemented)
+}
+
+func (t *processTask) Update(ctx context.Context, resources *types.Any, annotations map[string]string) error {
+	return fmt.Errorf("update: %w", errdefs.ErrNotImplemented)
+}
+
+func (t *processTask) Stats(ctx context.Context) (*types.Any, error) {
+	return nil, fmt.Errorf("stats: %w", errdefs.ErrNotImplemented)
+}
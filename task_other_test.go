@@ -0,0 +1,100 @@
+//go:build !linux
+// +build !linux
+
+package embedshim
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/containerd/containerd/errdefs"
+	"github.com/containerd/containerd/namespaces"
+	"github.com/containerd/containerd/runtime"
+	"github.com/gogo/protobuf/types"
+	"github.com/opencontainers/runtime-spec/specs-go"
+)
+
+func newTestProcessTask(t *testing.T, args ...string) (context.Context, *TaskManager, runtime.Task) {
+	ctx, cancel := context.WithTimeout(namespaces.WithNamespace(context.Background(), "testing"), 10*time.Second)
+	t.Cleanup(cancel)
+
+	manager, err := newTaskManager(t.TempDir(), t.TempDir(), nil)
+	if err != nil {
+		t.Fatalf("failed to new task manager: %v", err)
+	}
+	t.Cleanup(func() { manager.monitor.close() })
+
+	specValue, err := json.Marshal(&specs.Spec{
+		Version: specs.Version,
+		Process: &specs.Process{Args: args},
+	})
+	if err != nil {
+		t.Fatalf("failed to marshal spec: %v", err)
+	}
+
+	task, err := manager.Create(ctx, "test", runtime.CreateOpts{Spec: &types.Any{Value: specValue}})
+	if err != nil {
+		t.Fatalf("failed to create task: %v", err)
+	}
+	return ctx, manager, task
+}
+
+func TestProcessTaskExit(t *testing.T) {
+	ctx, manager, task := newTestProcessTask(t, "sh", "-c", "exit 3")
+
+	if err := task.Start(ctx); err != nil {
+		t.Fatalf("failed to start task: %v", err)
+	}
+
+	exit, err := task.Wait(ctx)
+	if err != nil {
+		t.Fatalf("failed to wait task: %v", err)
+	}
+	if exit.Status != 3 || exit.Pid != task.PID() {
+		t.Fatalf("expected exit status 3 of pid %v, but got %+v", task.PID(), exit)
+	}
+
+	state, err := task.State(ctx)
+	if err != nil || state.Status != runtime.StoppedStatus || state.ExitStatus != 3 {
+		t.Fatalf("expected stopped with 3, but got %+v (err: %v)", state, err)
+	}
+
+	if _, err := task.Delete(ctx); err != nil {
+		t.Fatalf("failed to delete task: %v", err)
+	}
+	if _, err := manager.Get(ctx, "test"); !errors.Is(err, runtime.ErrTaskNotExists) {
+		t.Fatalf("expected task deleted, but got %v", err)
+	}
+}
+
+func TestProcessTaskKill(t *testing.T) {
+	ctx, _, task := newTestProcessTask(t, "sleep", "60")
+
+	if err := task.Start(ctx); err != nil {
+		t.Fatalf("failed to start task: %v", err)
+	}
+
+	if _, err := task.Delete(ctx); !errors.Is(err, errdefs.ErrFailedPrecondition) {
+		t.Fatalf("expected running task not deleted, but got %v", err)
+	}
+
+	if err := task.Kill(ctx, uint32(syscall.SIGKILL), true); err != nil {
+		t.Fatalf("failed to kill task: %v", err)
+	}
+
+	exit, err := task.Wait(ctx)
+	if err != nil {
+		t.Fatalf("failed to wait task: %v", err)
+	}
+	if expected := uint32(exitSignalOffset + syscall.SIGKILL); exit.Status != expected {
+		t.Fatalf("expected exit status %v, but got %v", expected, exit.Status)
+	}
+
+	if err := task.Kill(ctx, uint32(syscall.SIGKILL), false); !errors.Is(err, errdefs.ErrNotFound) {
+		t.Fatalf("expected exited task not found, but got %v", err)
+	}
+}
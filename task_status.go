@@ -0,0 +1,146 @@
+//go:build linux
+// +build linux
+
+package embedshim
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/containerd/containerd/errdefs"
+	"github.com/containerd/containerd/filters"
+	"github.com/containerd/containerd/log"
+	"github.com/containerd/containerd/runtime"
+)
+
+// TaskStatus is the snapshot of the embedshim task's status.
+type TaskStatus struct {
+	ID        string
+	Namespace string
+	Pid       uint32
+	// NsPid is the init process's pid in the container's pid namespace.
+	NsPid      uint32
+	Status     runtime.Status
+	ExitStatus uint32
+	ExitedAt   time.Time
+	// Execs is the number of exec processes, including the reserved ones.
+	Execs int
+	// StdioMode is the init process's stdio mode.
+	StdioMode StdioMode
+	// Stopping is true if the running task has been signaled to stop but
+	// hasn't exited yet.
+	Stopping bool
+	// RestartCount is the number of restarts by restart policy.
+	RestartCount int
+	// Labels are the containerd container's labels.
+	Labels map[string]string
+	// SpecDigest is the digest of the effective spec in the bundle, which
+	// can be compared with SpecDigest of the container's spec to audit the
+	// drift.
+	SpecDigest string
+}
+
+// Field implements filters.Adaptor so that the status can be filtered by
+// containerd filter syntax, like labels."io.kubernetes.pod.name"==nginx.
+func (st TaskStatus) Field(fieldpath []string) (string, bool) {
+	if len(fieldpath) == 0 {
+		return "", false
+	}
+
+	switch fieldpath[0] {
+	case "id":
+		return st.ID, len(st.ID) > 0
+	case "namespace":
+		return st.Namespace, len(st.Namespace) > 0
+	case "status":
+		return statusName(st.Status), true
+	case "stdio_mode":
+		return string(st.StdioMode), len(st.StdioMode) > 0
+	case "spec_digest":
+		return st.SpecDigest, len(st.SpecDigest) > 0
+	case "labels":
+		if len(fieldpath) < 2 {
+			return "", false
+		}
+		value, ok := st.Labels[strings.Join(fieldpath[1:], ".")]
+		return value, ok
+	}
+	return "", false
+}
+
+// TaskStatuses returns all the tasks' status in one call, which avoids
+// State round trips for each task. If all is true, the tasks in all the
+// namespaces are returned. The result can be filtered by containerd filters.
+func (manager *TaskManager) TaskStatuses(ctx context.Context, all bool, fs ...string) ([]TaskStatus, error) {
+	filter, err := filters.ParseAll(fs...)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", err.Error(), errdefs.ErrInvalidArgument)
+	}
+
+	tasks, err := manager.tasks.GetAll(ctx, all)
+	if err != nil {
+		return nil, err
+	}
+
+	statuses := make([]TaskStatus, 0, len(tasks))
+	for _, t := range tasks {
+		s, ok := t.(*shim)
+		if !ok {
+			continue
+		}
+
+		st, err := s.State(ctx)
+		if err != nil {
+			// the task has been deleted
+			continue
+		}
+
+		status := TaskStatus{
+			ID:         s.ID(),
+			Namespace:  s.Namespace(),
+			Pid:        st.Pid,
+			NsPid:      s.processNsPid("", st.Pid),
+			Status:     st.Status,
+			ExitStatus: st.ExitStatus,
+			ExitedAt:   st.ExitedAt,
+			Execs:      s.execCount(),
+			StdioMode:  s.init.stdioMode,
+			Stopping:   s.init.loadSnapshot().stopping,
+			Labels:     s.labels,
+
+			RestartCount: s.restartCount(),
+		}
+		if status.SpecDigest, err = readInitOCISpecDigest(s.bundle); err != nil {
+			log.G(ctx).WithError(err).Warnf("failed to read spec digest of task %s", s.ID())
+		}
+		if filter.Match(status) {
+			statuses = append(statuses, status)
+		}
+	}
+	return statuses, nil
+}
+
+func statusName(status runtime.Status) string {
+	switch status {
+	case runtime.CreatedStatus:
+		return "created"
+	case runtime.RunningStatus:
+		return "running"
+	case runtime.StoppedStatus:
+		return "stopped"
+	case runtime.PausedStatus:
+		return "paused"
+	case runtime.PausingStatus:
+		return "pausing"
+	}
+	return "unknown"
+}
+
+func (s *shim) execCount() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return len(s.execProcesses) + len(s.reservedExecIDs)
+}
@@ -0,0 +1,487 @@
+//go:build linux
+// +build linux
+
+package embedshim
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/containerd/cgroups"
+	"github.com/containerd/containerd/errdefs"
+	"github.com/containerd/containerd/log"
+	ptypes "github.com/gogo/protobuf/types"
+	"github.com/opencontainers/runc/libcontainer/configs"
+	"github.com/opencontainers/runtime-spec/specs-go"
+)
+
+// UpdateError is returned by Update if the resources are partially
+// applied. The touched controllers have been rolled back to the previous
+// values unless RollbackErr isn't nil.
+type UpdateError struct {
+	ID string
+	// Controllers are the cgroup controllers touched by the update, like
+	// "memory" and "cpu".
+	Controllers []string
+	// RollbackErr is the failure of the rollback, which means that the
+	// controllers might be in the half-new and half-old state.
+	RollbackErr error
+	Err         error
+}
+
+func (e *UpdateError) Error() string {
+	if e.RollbackErr != nil {
+		return fmt.Sprintf("failed to update %v of task %s: %v, and failed to roll back: %v",
+			e.Controllers, e.ID, e.Err, e.RollbackErr)
+	}
+	return fmt.Sprintf("failed to update %v of task %s and rolled back: %v", e.Controllers, e.ID, e.Err)
+}
+
+func (e *UpdateError) Unwrap() error {
+	return e.Err
+}
+
+// cgroupFileSnapshot is the value of one cgroup interface file.
+type cgroupFileSnapshot struct {
+	controller string
+	path       string
+	value      string
+	// reset is written with the key which is absent in the snapshot, for
+	// the keyed files like io.max. The keyed file is restored line by
+	// line. It is empty for the scalar files.
+	reset string
+}
+
+// resourceSnapshot is the task's cgroup settings before Update.
+type resourceSnapshot struct {
+	controllers []string
+	// runtime is the resources recorded in the OCI runtime's state, which
+	// is rolled back by the runtime's update. Otherwise the runtime's
+	// following update writes the failed values again.
+	runtime *specs.LinuxResources
+	files   []cgroupFileSnapshot
+	// devices is the v1 devices.list which is restored by deny-all and
+	// then allows.
+	devices *cgroupFileSnapshot
+	// memoryQoSLimit is the memory limit used by memory QoS.
+	memoryQoSLimit int64
+}
+
+// cgroupV2UpdateFiles are the files written by `runc update` for each
+// controller in cgroup v2. The device filter is replaced atomically so
+// that it isn't snapshotted.
+var cgroupV2UpdateFiles = map[string][]cgroupFileSnapshot{
+	"memory": {
+		{path: "memory.max"}, {path: "memory.swap.max"}, {path: "memory.high"},
+		{path: "memory.low"}, {path: "memory.min"},
+	},
+	"cpu":     {{path: "cpu.max"}, {path: "cpu.weight"}},
+	"cpuset":  {{path: "cpuset.cpus"}, {path: "cpuset.mems"}},
+	"pids":    {{path: "pids.max"}},
+	"io":      {{path: "io.weight"}, {path: "io.max", reset: "rbps=max wbps=max riops=max wiops=max"}},
+	"hugetlb": {{path: "hugetlb.*.max"}},
+	"misc":    {{path: miscMaxFile, reset: "max"}},
+}
+
+// cgroupV1UpdateFiles are the files written by `runc update` for each
+// controller in cgroup v1.
+var cgroupV1UpdateFiles = map[string][]cgroupFileSnapshot{
+	"memory": {
+		{path: "memory.limit_in_bytes"}, {path: "memory.memsw.limit_in_bytes"},
+		{path: "memory.soft_limit_in_bytes"}, {path: "memory.swappiness"},
+	},
+	"cpu": {
+		{path: "cpu.shares"}, {path: "cpu.cfs_period_us"}, {path: "cpu.cfs_quota_us"},
+		{path: "cpu.rt_period_us"}, {path: "cpu.rt_runtime_us"},
+	},
+	"cpuset": {{path: "cpuset.cpus"}, {path: "cpuset.mems"}},
+	"pids":   {{path: "pids.max"}},
+	"blkio": {
+		{path: "blkio.weight"},
+		{path: "blkio.weight_device", reset: "0"},
+		{path: "blkio.throttle.read_bps_device", reset: "0"},
+		{path: "blkio.throttle.write_bps_device", reset: "0"},
+		{path: "blkio.throttle.read_iops_device", reset: "0"},
+		{path: "blkio.throttle.write_iops_device", reset: "0"},
+	},
+	"hugetlb": {{path: "hugetlb.*.limit_in_bytes"}},
+}
+
+// touchedControllers returns the controllers which the resources update.
+func touchedControllers(resources *specs.LinuxResources) []string {
+	v2 := cgroups.Mode() == cgroups.Unified
+
+	set := map[string]struct{}{}
+	if resources.Memory != nil {
+		set["memory"] = struct{}{}
+	}
+	if cpu := resources.CPU; cpu != nil {
+		if cpu.Cpus != "" || cpu.Mems != "" {
+			set["cpuset"] = struct{}{}
+		}
+		if cpu.Shares != nil || cpu.Quota != nil || cpu.Period != nil ||
+			cpu.RealtimeRuntime != nil || cpu.RealtimePeriod != nil {
+			set["cpu"] = struct{}{}
+		}
+	}
+	if resources.Pids != nil {
+		set["pids"] = struct{}{}
+	}
+	if resources.BlockIO != nil {
+		if v2 {
+			set["io"] = struct{}{}
+		} else {
+			set["blkio"] = struct{}{}
+		}
+	}
+	if len(resources.HugepageLimits) > 0 {
+		set["hugetlb"] = struct{}{}
+	}
+	if len(resources.Devices) > 0 {
+		set["devices"] = struct{}{}
+	}
+	if _, ok := resources.Unified[miscMaxFile]; ok && v2 {
+		set["misc"] = struct{}{}
+	}
+
+	controllers := make([]string, 0, len(set))
+	for c := range set {
+		controllers = append(controllers, c)
+	}
+	sort.Strings(controllers)
+	return controllers
+}
+
+// snapshotResources reads the current values of the controllers which the
+// resources update.
+func (s *shim) snapshotResources(resources *specs.LinuxResources) (*resourceSnapshot, error) {
+	runtime, err := s.init.runtimeResources()
+	if err != nil {
+		return nil, err
+	}
+
+	snap := &resourceSnapshot{controllers: touchedControllers(resources), runtime: runtime}
+	if q := s.init.memoryQoS; q != nil {
+		q.mu.Lock()
+		snap.memoryQoSLimit = q.limit
+		q.mu.Unlock()
+	}
+
+	if cgroups.Mode() == cgroups.Unified {
+		cgroupPath := s.loadedIdentity().CgroupPath
+		if cgroupPath == "" {
+			return nil, fmt.Errorf("cgroup of task %s is unavailable: %w", s.ID(), errdefs.ErrNotFound)
+		}
+		dir := filepath.Join(cgroupv2Root, cgroupPath)
+
+		for _, c := range snap.controllers {
+			if err := snap.readFiles(c, dir, cgroupV2UpdateFiles[c]); err != nil {
+				return nil, err
+			}
+		}
+		return snap, nil
+	}
+
+	paths, err := cgroups.ParseCgroupFile(filepath.Join("/proc", strconv.Itoa(int(s.PID())), "cgroup"))
+	if err != nil {
+		return nil, err
+	}
+
+	for _, c := range snap.controllers {
+		cgroupPath, ok := paths[c]
+		if !ok {
+			continue
+		}
+
+		root, err := cgroupControllerRoot(c)
+		if err != nil {
+			return nil, err
+		}
+		dir := filepath.Join(root, s.trimInitSubgroup(cgroupPath))
+
+		if c == "devices" {
+			value, err := os.ReadFile(filepath.Join(dir, "devices.list"))
+			if err != nil {
+				return nil, err
+			}
+			snap.devices = &cgroupFileSnapshot{controller: c, path: dir, value: string(value)}
+			continue
+		}
+
+		if err := snap.readFiles(c, dir, cgroupV1UpdateFiles[c]); err != nil {
+			return nil, err
+		}
+	}
+	return snap, nil
+}
+
+// readFiles reads the existing files. The file name might be a glob
+// pattern, like "hugetlb.*.max".
+func (snap *resourceSnapshot) readFiles(controller, dir string, files []cgroupFileSnapshot) error {
+	for _, f := range files {
+		paths, err := filepath.Glob(filepath.Join(dir, f.path))
+		if err != nil {
+			return err
+		}
+
+		for _, pathname := range paths {
+			value, err := os.ReadFile(pathname)
+			if err != nil {
+				// The file doesn't exist if the kernel doesn't
+				// support it, like memory.memsw.* without swap
+				// accounting.
+				if os.IsNotExist(err) {
+					continue
+				}
+				return err
+			}
+			snap.files = append(snap.files, cgroupFileSnapshot{
+				controller: controller,
+				path:       pathname,
+				value:      strings.TrimSpace(string(value)),
+				reset:      f.reset,
+			})
+		}
+	}
+	return nil
+}
+
+// runtimeResources returns the resources recorded in runc's state.json,
+// which are updated by `runc update`.
+func (p *initProcess) runtimeResources() (*specs.LinuxResources, error) {
+	data, err := os.ReadFile(filepath.Join(p.runtime.RootDir(), p.ID(), "state.json"))
+	if err != nil {
+		return nil, err
+	}
+
+	var state struct {
+		Config struct {
+			Cgroups *configs.Cgroup `json:"cgroups"`
+		} `json:"config"`
+	}
+	if err := json.Unmarshal(data, &state); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal runtime state of task %s: %w", p.ID(), err)
+	}
+	if state.Config.Cgroups == nil || state.Config.Cgroups.Resources == nil {
+		return nil, fmt.Errorf("cgroup resources of task %s are unavailable in runtime state: %w", p.ID(), errdefs.ErrNotFound)
+	}
+	return runtimeResourcesToSpec(state.Config.Cgroups.Resources), nil
+}
+
+// runtimeResourcesToSpec converts the resources which `runc update` sets.
+// The zero value means unset, like runc.
+func runtimeResourcesToSpec(r *configs.Resources) *specs.LinuxResources {
+	return &specs.LinuxResources{
+		Memory: &specs.LinuxMemory{
+			Limit:       &r.Memory,
+			Reservation: &r.MemoryReservation,
+			Swap:        &r.MemorySwap,
+		},
+		CPU: &specs.LinuxCPU{
+			Shares:          &r.CpuShares,
+			Quota:           &r.CpuQuota,
+			Period:          &r.CpuPeriod,
+			RealtimeRuntime: &r.CpuRtRuntime,
+			RealtimePeriod:  &r.CpuRtPeriod,
+			Cpus:            r.CpusetCpus,
+			Mems:            r.CpusetMems,
+		},
+		BlockIO: &specs.LinuxBlockIO{Weight: &r.BlkioWeight},
+		Pids:    &specs.LinuxPids{Limit: r.PidsLimit},
+		Unified: r.Unified,
+	}
+}
+
+// restore rolls the runtime's state back by its update, and then writes the
+// snapshotted values back because the runtime doesn't write the unset ones.
+// The files are written in multiple passes because some limits depend on
+// the others, like memory.limit_in_bytes must not exceed
+// memory.memsw.limit_in_bytes.
+func (snap *resourceSnapshot) restore(ctx context.Context, s *shim, typeURL string) error {
+	var (
+		pending    = snap.files
+		errs       []string
+		runtimeErr error
+	)
+
+	if snap.runtime != nil {
+		runtimeErr = s.updateRuntimeResources(ctx, typeURL, snap.runtime)
+	}
+
+	for pass := 0; pass < 3 && len(pending) > 0; pass++ {
+		var failed []cgroupFileSnapshot
+
+		errs = errs[:0]
+		for _, f := range pending {
+			if err := f.restore(); err != nil {
+				failed = append(failed, f)
+				errs = append(errs, err.Error())
+			}
+		}
+		pending = failed
+	}
+
+	if snap.devices != nil {
+		if err := restoreDevicesV1(snap.devices.path, snap.devices.value); err != nil {
+			errs = append(errs, err.Error())
+		}
+	}
+
+	if q := s.init.memoryQoS; q != nil {
+		q.mu.Lock()
+		q.limit = snap.memoryQoSLimit
+		q.mu.Unlock()
+	}
+
+	if runtimeErr != nil {
+		errs = append([]string{fmt.Sprintf("failed to roll back runtime state: %v", runtimeErr)}, errs...)
+	}
+	if len(errs) > 0 {
+		return fmt.Errorf("%s", strings.Join(errs, "; "))
+	}
+	return nil
+}
+
+func (s *shim) updateRuntimeResources(ctx context.Context, typeURL string, resources *specs.LinuxResources) error {
+	value, err := json.Marshal(resources)
+	if err != nil {
+		return err
+	}
+	return s.init.Update(ctx, &ptypes.Any{TypeUrl: typeURL, Value: value})
+}
+
+func (f cgroupFileSnapshot) restore() error {
+	dir, file := filepath.Dir(f.path), filepath.Base(f.path)
+	if f.reset == "" && !strings.Contains(f.value, "\n") {
+		return writeCgroupFile(dir, file, f.value)
+	}
+
+	var lines []string
+	old := map[string]struct{}{}
+	for _, line := range strings.Split(f.value, "\n") {
+		if line = strings.TrimSpace(line); line == "" {
+			continue
+		}
+		old[strings.Fields(line)[0]] = struct{}{}
+		lines = append(lines, line)
+	}
+
+	// The keys added by the update are reset before the old ones are
+	// written back.
+	if f.reset != "" {
+		current, err := os.ReadFile(f.path)
+		if err != nil {
+			return err
+		}
+		for _, line := range strings.Split(string(current), "\n") {
+			fields := strings.Fields(line)
+			if len(fields) == 0 {
+				continue
+			}
+			if _, ok := old[fields[0]]; ok {
+				continue
+			}
+			if err := writeCgroupFile(dir, file, fields[0]+" "+f.reset); err != nil {
+				return err
+			}
+		}
+	}
+
+	for _, line := range lines {
+		if err := writeCgroupFile(dir, file, line); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// restoreDevicesV1 denies all the devices and then allows the ones in the
+// devices.list.
+func restoreDevicesV1(dir, list string) error {
+	if err := writeCgroupFile(dir, "devices.deny", "a"); err != nil {
+		return err
+	}
+	for _, line := range strings.Split(list, "\n") {
+		if line = strings.TrimSpace(line); line == "" {
+			continue
+		}
+		if err := writeCgroupFile(dir, "devices.allow", line); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// updateResources applies the resources by OCI runtime, device rules,
+// memory QoS and misc limits in order. The touched controllers are rolled back if any step
+// fails. The CPU quota is ramped to the target in background if the
+// annotations request it.
+func (s *shim) updateResources(ctx context.Context, r *ptypes.Any, annotations map[string]string) error {
+	var resources specs.LinuxResources
+	if err := json.Unmarshal(r.Value, &resources); err != nil {
+		return fmt.Errorf("failed to unmarshal resources: %v: %w", err, errdefs.ErrInvalidArgument)
+	}
+
+	r, miscLimits, err := splitMiscLimits(r)
+	if err != nil {
+		return err
+	}
+	if err := s.validateMiscLimits(miscLimits); err != nil {
+		return err
+	}
+
+	// NOTE: The update overrides the in-flight ramp, which must not
+	// write the stale quota after that. It's stopped before the plan reads
+	// the current quota, otherwise the in-flight ramp might step after the
+	// read and the new ramp starts from the stale quota.
+	s.quotaRamp.stop()
+
+	ramp, err := s.planCPUQuotaRamp(&resources, annotations)
+	if err != nil {
+		return err
+	}
+	if ramp != nil {
+		if r, err = setCPUQuota(r, ramp.from, ramp.period); err != nil {
+			return err
+		}
+	}
+
+	snap, err := s.snapshotResources(&resources)
+	if err != nil {
+		log.G(ctx).WithError(err).Warnf("failed to snapshot resources of task %s, update without rollback", s.ID())
+	}
+
+	err = s.init.Update(ctx, r)
+	if err == nil {
+		err = s.updateDevices(ctx, r)
+	}
+	if err == nil {
+		err = s.updateMemoryQoS(ctx, r)
+	}
+	if err == nil {
+		err = s.updateMiscLimits(miscLimits)
+	}
+	if err == nil && ramp != nil {
+		s.quotaRamp.start(s, ramp)
+	}
+	if err == nil || snap == nil {
+		return err
+	}
+
+	uerr := &UpdateError{
+		ID:          s.ID(),
+		Controllers: snap.controllers,
+		Err:         err,
+	}
+	if rerr := snap.restore(ctx, s, r.TypeUrl); rerr != nil {
+		uerr.RollbackErr = rerr
+	}
+	log.G(ctx).WithError(uerr).Warn("update failed")
+	return uerr
+}
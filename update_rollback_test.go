@@ -0,0 +1,99 @@
+//go:build linux
+// +build linux
+
+package embedshim
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	pkgbundle "github.com/fuweid/embedshim/pkg/bundle"
+	"github.com/opencontainers/runtime-spec/specs-go"
+)
+
+func TestTouchedControllers(t *testing.T) {
+	limit := int64(1 << 30)
+	shares := uint64(512)
+
+	got := touchedControllers(&specs.LinuxResources{
+		Memory: &specs.LinuxMemory{Limit: &limit},
+		CPU:    &specs.LinuxCPU{Shares: &shares, Cpus: "0-1"},
+		Devices: []specs.LinuxDeviceCgroup{
+			{Allow: true, Type: "c", Access: "rwm"},
+		},
+	})
+	expected := []string{"cpu", "cpuset", "devices", "memory"}
+	if !reflect.DeepEqual(got, expected) {
+		t.Fatalf("expected %v, but got %v", expected, got)
+	}
+
+	if got := touchedControllers(&specs.LinuxResources{CPU: &specs.LinuxCPU{}}); len(got) != 0 {
+		t.Fatalf("expected no controller, but got %v", got)
+	}
+}
+
+func TestCgroupFileSnapshotRestore(t *testing.T) {
+	dir := t.TempDir()
+
+	// NOTE: The regular file is overwritten by each write, unlike the
+	// cgroup interface file. It only verifies what is written last.
+	scalar := cgroupFileSnapshot{path: filepath.Join(dir, "memory.max"), value: "max"}
+	if err := os.WriteFile(scalar.path, []byte("1073741824\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := scalar.restore(); err != nil {
+		t.Fatalf("failed to restore: %v", err)
+	}
+	if data, _ := os.ReadFile(scalar.path); string(data) != "max" {
+		t.Fatalf("expected max, but got %q", data)
+	}
+
+	keyed := cgroupFileSnapshot{
+		path:  filepath.Join(dir, "io.max"),
+		value: "8:0 rbps=1024 wbps=max riops=max wiops=max",
+		reset: "rbps=max wbps=max riops=max wiops=max",
+	}
+	if err := os.WriteFile(keyed.path, []byte("8:16 rbps=2048 wbps=max riops=max wiops=max\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := keyed.restore(); err != nil {
+		t.Fatalf("failed to restore: %v", err)
+	}
+	if data, _ := os.ReadFile(keyed.path); string(data) != keyed.value {
+		t.Fatalf("unexpected io.max %q", data)
+	}
+}
+
+func TestRuntimeResources(t *testing.T) {
+	fake := newFakeRuntime(t.TempDir())
+	p := &initProcess{bundle: &pkgbundle.Bundle{ID: "test"}, runtime: fake}
+
+	if _, err := p.runtimeResources(); err == nil {
+		t.Fatalf("expected error without runtime state, but got nil")
+	}
+
+	state := `{"config":{"cgroups":{"memory":1073741824,"memory_swap":-1,"cpu_quota":50000,"cpu_period":100000,` +
+		`"cpuset_cpus":"0-1","pids_limit":100,"unified":{"memory.high":"max"}}}}`
+	if err := os.MkdirAll(filepath.Join(fake.root, "test"), 0700); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(fake.root, "test", "state.json"), []byte(state), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := p.runtimeResources()
+	if err != nil {
+		t.Fatalf("failed to read runtime resources: %v", err)
+	}
+	if *got.Memory.Limit != 1<<30 || *got.Memory.Swap != -1 || *got.Memory.Reservation != 0 {
+		t.Fatalf("unexpected memory resources %+v", got.Memory)
+	}
+	if *got.CPU.Quota != 50000 || *got.CPU.Period != 100000 || *got.CPU.Shares != 0 || got.CPU.Cpus != "0-1" {
+		t.Fatalf("unexpected cpu resources %+v", got.CPU)
+	}
+	if got.Pids.Limit != 100 || got.Unified["memory.high"] != "max" {
+		t.Fatalf("unexpected resources %+v", got)
+	}
+}
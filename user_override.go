@@ -0,0 +1,185 @@
+//go:build linux
+// +build linux
+
+package embedshim
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/containerd/containerd/errdefs"
+	ptypes "github.com/gogo/protobuf/types"
+)
+
+const (
+	maxUmask = 0777
+
+	// maxAdditionalGids is the kernel's NGROUPS_MAX.
+	maxAdditionalGids = 65536
+)
+
+// userOverride replaces the process spec's user.umask and
+// user.additionalGids, so that the non-022 umask doesn't require rebuilding
+// the image.
+type userOverride struct {
+	// umask is unchanged if it is nil.
+	umask *uint32
+	// additionalGids is unchanged if it is nil.
+	additionalGids []uint32
+}
+
+// initUserOverrideFromAnnotations returns nil if there is no override for
+// the init process.
+func initUserOverrideFromAnnotations(annotations map[string]string) (*userOverride, error) {
+	return userOverrideFromAnnotations(annotations, annotationUmask, annotationAdditionalGids)
+}
+
+// execUserOverrideFromAnnotations returns the override for the exec
+// processes. The unset one falls back to the init process's.
+func execUserOverrideFromAnnotations(annotations map[string]string) (*userOverride, error) {
+	umaskKey, gidsKey := annotationExecUmask, annotationExecAdditionalGids
+	if annotations[umaskKey] == "" {
+		umaskKey = annotationUmask
+	}
+	if _, ok := annotations[gidsKey]; !ok {
+		gidsKey = annotationAdditionalGids
+	}
+	return userOverrideFromAnnotations(annotations, umaskKey, gidsKey)
+}
+
+func userOverrideFromAnnotations(annotations map[string]string, umaskKey, gidsKey string) (*userOverride, error) {
+	var o userOverride
+
+	if v := annotations[umaskKey]; v != "" {
+		umask, err := strconv.ParseUint(v, 8, 32)
+		if err != nil || umask > maxUmask {
+			return nil, fmt.Errorf("invalid annotation %s=%q, expected octal in [0, 0777]: %w", umaskKey, v, errdefs.ErrInvalidArgument)
+		}
+		mask := uint32(umask)
+		o.umask = &mask
+	}
+
+	if v, ok := annotations[gidsKey]; ok {
+		gids, err := parseAdditionalGids(v)
+		if err != nil {
+			return nil, fmt.Errorf("invalid annotation %s=%q: %v: %w", gidsKey, v, err, errdefs.ErrInvalidArgument)
+		}
+		o.additionalGids = gids
+	}
+
+	if o.umask == nil && o.additionalGids == nil {
+		return nil, nil
+	}
+	return &o, nil
+}
+
+// parseAdditionalGids parses the comma separated gids. The empty value
+// clears the spec's additional gids.
+func parseAdditionalGids(v string) ([]uint32, error) {
+	gids := []uint32{}
+	if strings.TrimSpace(v) == "" {
+		return gids, nil
+	}
+
+	for _, s := range strings.Split(v, ",") {
+		// NOTE: 4294967295 is (gid_t)-1 which means "unchanged" for
+		// setgroups and the other syscalls.
+		gid, err := strconv.ParseUint(strings.TrimSpace(s), 10, 32)
+		if err != nil || gid == 1<<32-1 {
+			return nil, fmt.Errorf("gid %q out of range [0, 4294967294]", s)
+		}
+		gids = append(gids, uint32(gid))
+	}
+
+	if len(gids) > maxAdditionalGids {
+		return nil, fmt.Errorf("%d gids exceed the limit %d", len(gids), maxAdditionalGids)
+	}
+	return gids, nil
+}
+
+// applyInitUserOverride applies the override defined by the spec's
+// annotations on the spec's process. The spec is returned as it is if
+// there is no override.
+func applyInitUserOverride(spec *ptypes.Any) (*ptypes.Any, error) {
+	if spec == nil {
+		return spec, nil
+	}
+
+	return patchRawJSON(spec, "spec", func(root map[string]json.RawMessage) (bool, error) {
+		var annotations map[string]string
+		if _, err := unmarshalRawField(root, "annotations", "spec annotations", &annotations); err != nil {
+			return false, err
+		}
+
+		o, err := initUserOverrideFromAnnotations(annotations)
+		if err != nil || o == nil {
+			return false, err
+		}
+
+		rawProcess, ok := root["process"]
+		if !ok {
+			return false, nil
+		}
+
+		if root["process"], err = o.applyRaw(rawProcess); err != nil {
+			return false, err
+		}
+		return true, nil
+	})
+}
+
+// applyExecSpec applies the override on the exec process spec. The spec is
+// returned as it is if the override is nil.
+func (o *userOverride) applyExecSpec(spec *ptypes.Any) (*ptypes.Any, error) {
+	if o == nil || spec == nil {
+		return spec, nil
+	}
+
+	value, err := o.applyRaw(spec.Value)
+	if err != nil {
+		return nil, err
+	}
+	return &ptypes.Any{TypeUrl: spec.TypeUrl, Value: value}, nil
+}
+
+func (o *userOverride) applyRaw(raw json.RawMessage) (json.RawMessage, error) {
+	var process map[string]json.RawMessage
+	if err := unmarshalRawJSON(raw, "process spec", &process); err != nil {
+		return nil, err
+	}
+
+	user := map[string]json.RawMessage{}
+	if _, err := unmarshalRawField(process, "user", "process user", &user); err != nil {
+		return nil, err
+	}
+
+	if o.umask != nil {
+		v, err := json.Marshal(*o.umask)
+		if err != nil {
+			return nil, err
+		}
+		user["umask"] = v
+	}
+
+	if o.additionalGids != nil {
+		v, err := json.Marshal(o.additionalGids)
+		if err != nil {
+			return nil, err
+		}
+		user["additionalGids"] = v
+	}
+
+	v, err := json.Marshal(user)
+	if err != nil {
+		return nil, err
+	}
+	process["user"] = v
+
+	value, err := json.Marshal(process)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal process spec: %w", err)
+	}
+	return value, nil
+}
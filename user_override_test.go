@@ -0,0 +1,102 @@
+//go:build linux
+// +build linux
+
+package embedshim
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+
+	ptypes "github.com/gogo/protobuf/types"
+)
+
+func TestUserOverrideFromAnnotations(t *testing.T) {
+	for _, tc := range []struct {
+		annotations map[string]string
+		umask       *uint32
+		gids        []uint32
+		hasErr      bool
+	}{
+		{annotations: nil},
+		{annotations: map[string]string{annotationUmask: "0027"}, umask: uint32Ptr(027)},
+		{annotations: map[string]string{annotationUmask: "0777"}, umask: uint32Ptr(0777)},
+		{annotations: map[string]string{annotationUmask: "1000"}, hasErr: true},
+		{annotations: map[string]string{annotationUmask: "0089"}, hasErr: true},
+		{annotations: map[string]string{annotationAdditionalGids: "10, 20"}, gids: []uint32{10, 20}},
+		{annotations: map[string]string{annotationAdditionalGids: ""}, gids: []uint32{}},
+		{annotations: map[string]string{annotationAdditionalGids: "4294967295"}, hasErr: true},
+		{annotations: map[string]string{annotationAdditionalGids: "-1"}, hasErr: true},
+	} {
+		o, err := initUserOverrideFromAnnotations(tc.annotations)
+		if got := err != nil; got != tc.hasErr {
+			t.Fatalf("expected error %v for %v, but got %v", tc.hasErr, tc.annotations, err)
+		}
+		if tc.hasErr {
+			continue
+		}
+
+		if tc.umask == nil && tc.gids == nil {
+			if o != nil {
+				t.Fatalf("expected nil override for %v, but got %+v", tc.annotations, o)
+			}
+			continue
+		}
+		if !reflect.DeepEqual(o.umask, tc.umask) || !reflect.DeepEqual(o.additionalGids, tc.gids) {
+			t.Fatalf("expected umask %v gids %v, but got %+v", tc.umask, tc.gids, o)
+		}
+	}
+}
+
+func TestExecUserOverrideFallback(t *testing.T) {
+	o, err := execUserOverrideFromAnnotations(map[string]string{
+		annotationUmask:              "0027",
+		annotationAdditionalGids:     "10",
+		annotationExecAdditionalGids: "",
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if *o.umask != 027 || len(o.additionalGids) != 0 || o.additionalGids == nil {
+		t.Fatalf("expected init's umask and cleared gids, but got %+v", o)
+	}
+}
+
+func TestApplyInitUserOverride(t *testing.T) {
+	spec := &ptypes.Any{
+		TypeUrl: "spec",
+		Value: []byte(`{"annotations":{"io.embedshim.umask":"0002"},` +
+			`"process":{"user":{"uid":1000,"gid":1000,"additionalGids":[5]},"args":["sh"]}}`),
+	}
+
+	got, err := applyInitUserOverride(spec)
+	if err != nil {
+		t.Fatalf("failed to apply: %v", err)
+	}
+
+	var root struct {
+		Process struct {
+			User struct {
+				UID            uint32   `json:"uid"`
+				Umask          *uint32  `json:"umask"`
+				AdditionalGids []uint32 `json:"additionalGids"`
+			} `json:"user"`
+			Args []string `json:"args"`
+		} `json:"process"`
+	}
+	if err := json.Unmarshal(got.Value, &root); err != nil {
+		t.Fatalf("failed to unmarshal: %v", err)
+	}
+
+	u := root.Process.User
+	if u.UID != 1000 || u.Umask == nil || *u.Umask != 02 || !reflect.DeepEqual(u.AdditionalGids, []uint32{5}) {
+		t.Fatalf("unexpected user %+v", u)
+	}
+	if !reflect.DeepEqual(root.Process.Args, []string{"sh"}) {
+		t.Fatalf("expected args kept, but got %v", root.Process.Args)
+	}
+}
+
+func uint32Ptr(v uint32) *uint32 {
+	return &v
+}
@@ -0,0 +1,185 @@
+//go:build linux
+// +build linux
+
+package embedshim
+
+import (
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+
+	"github.com/containerd/containerd/errdefs"
+	"github.com/containerd/containerd/pkg/stdio"
+	"github.com/containerd/go-runc"
+	"golang.org/x/sys/unix"
+)
+
+// vsockScheme connects the process's stdio to the vsock endpoint, like
+// vsock://2:1024, where 2 is the host's CID. The CID can be "host" as well.
+var vsockScheme = "vsock"
+
+// vsockIO attaches the connected vsock sockets to the process's stdio
+// directly. There is no copy goroutine in plugin so that the host outside
+// the microVM receives the container's I/O without relay.
+//
+// NOTE: The stdin can't be closed by CloseIO because the peer owns the
+// write side. The peer should shutdown the connection instead.
+type vsockIO struct {
+	in  *os.File
+	out *os.File
+	err *os.File
+}
+
+func (i *vsockIO) Stdin() io.WriteCloser {
+	return nil
+}
+
+func (i *vsockIO) Stdout() io.ReadCloser {
+	return nil
+}
+
+func (i *vsockIO) Stderr() io.ReadCloser {
+	return nil
+}
+
+func (i *vsockIO) Close() error {
+	var err error
+	for _, f := range []*os.File{i.in, i.out, i.err} {
+		if f != nil {
+			if cerr := f.Close(); err == nil {
+				err = cerr
+			}
+		}
+	}
+	return err
+}
+
+// CloseAfterStart closes the plugin's copies because the process has owned
+// the sockets.
+func (i *vsockIO) CloseAfterStart() error {
+	return i.Close()
+}
+
+// Set sets the io to the exec.Cmd
+func (i *vsockIO) Set(cmd *exec.Cmd) {
+	if i.in != nil {
+		cmd.Stdin = i.in
+	}
+	if i.out != nil {
+		cmd.Stdout = i.out
+	}
+	if i.err != nil {
+		cmd.Stderr = i.err
+	}
+}
+
+func isVsockURI(uri string) bool {
+	return strings.HasPrefix(uri, vsockScheme+"://")
+}
+
+// isVsockStdio returns true if the process's stdio uses vsock scheme.
+func isVsockStdio(s stdio.Stdio) bool {
+	return isVsockURI(s.Stdin) || isVsockURI(s.Stdout) || isVsockURI(s.Stderr)
+}
+
+// validateVsockStdio makes sure that all the stdio use vsock scheme if any of
+// them does, because the stdio are created by one backend.
+func validateVsockStdio(s stdio.Stdio) error {
+	if !isVsockStdio(s) {
+		return nil
+	}
+
+	if s.Terminal {
+		return fmt.Errorf("vsock stdio can't be used with terminal: %w", errdefs.ErrInvalidArgument)
+	}
+
+	for _, uri := range []string{s.Stdin, s.Stdout, s.Stderr} {
+		if uri == "" {
+			continue
+		}
+		if _, _, err := parseVsockURI(uri); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func parseVsockURI(uri string) (cid uint32, port uint32, _ error) {
+	u, err := url.Parse(uri)
+	if err != nil || u.Scheme != vsockScheme {
+		return 0, 0, fmt.Errorf("invalid vsock uri %s, all the stdio should use vsock scheme: %w", uri, errdefs.ErrInvalidArgument)
+	}
+
+	switch host := u.Hostname(); host {
+	case "host":
+		cid = unix.VMADDR_CID_HOST
+	default:
+		n, err := strconv.ParseUint(host, 10, 32)
+		if err != nil {
+			return 0, 0, fmt.Errorf("invalid vsock cid in %s: %w", uri, errdefs.ErrInvalidArgument)
+		}
+		cid = uint32(n)
+	}
+
+	n, err := strconv.ParseUint(u.Port(), 10, 32)
+	if err != nil {
+		return 0, 0, fmt.Errorf("invalid vsock port in %s: %w", uri, errdefs.ErrInvalidArgument)
+	}
+	return cid, uint32(n), nil
+}
+
+func dialVsock(uri string) (*os.File, error) {
+	cid, port, err := parseVsockURI(uri)
+	if err != nil {
+		return nil, err
+	}
+
+	fd, err := unix.Socket(unix.AF_VSOCK, unix.SOCK_STREAM|unix.SOCK_CLOEXEC, 0)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create vsock socket: %w", err)
+	}
+
+	if err := unix.Connect(fd, &unix.SockaddrVM{CID: cid, Port: port}); err != nil {
+		unix.Close(fd)
+		return nil, fmt.Errorf("failed to connect %s: %w", uri, err)
+	}
+	return os.NewFile(uintptr(fd), uri), nil
+}
+
+// newRuncVsockIO connects the vsock endpoints for each stdio.
+func newRuncVsockIO(stdio stdio.Stdio) (_ runc.IO, retErr error) {
+	if err := validateVsockStdio(stdio); err != nil {
+		return nil, err
+	}
+
+	i := &vsockIO{}
+	defer func() {
+		if retErr != nil {
+			i.Close()
+		}
+	}()
+
+	for _, target := range []struct {
+		uri string
+		f   **os.File
+	}{
+		{stdio.Stdin, &i.in},
+		{stdio.Stdout, &i.out},
+		{stdio.Stderr, &i.err},
+	} {
+		if target.uri == "" {
+			continue
+		}
+
+		f, err := dialVsock(target.uri)
+		if err != nil {
+			return nil, err
+		}
+		*target.f = f
+	}
+	return i, nil
+}
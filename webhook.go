@@ -0,0 +1,352 @@
+//go:build linux
+// +build linux
+
+package embedshim
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/containerd/cgroups"
+	eventstypes "github.com/containerd/containerd/api/events"
+	"github.com/containerd/containerd/errdefs"
+	"github.com/containerd/containerd/events"
+	"github.com/containerd/containerd/log"
+	"github.com/containerd/containerd/runtime"
+)
+
+const (
+	webhookEventStarted = "started"
+	webhookEventExited  = "exited"
+	webhookEventOOM     = "oom"
+
+	// webhookQueueSize is the max number of the pending deliveries of one
+	// task. The event is dropped if the queue is full.
+	webhookQueueSize = 64
+)
+
+var (
+	defaultWebhookTimeout    = 5 * time.Second
+	defaultWebhookMaxRetries = 3
+	webhookRetryBackoff      = time.Second
+
+	webhookEvents = map[string]struct{}{
+		webhookEventStarted: {},
+		webhookEventExited:  {},
+		webhookEventOOM:     {},
+	}
+)
+
+// WebhookConfig enables the per-task lifecycle webhooks defined by the
+// annotations. The webhook is an HTTP POST with JSON payload, like
+//
+//	{"event":"exited","namespace":"default","container_id":"redis","pid":1234,"exit_status":137,"timestamp":"..."}
+//
+// The request is signed if the task references the secret, with the
+// headers X-Embedshim-Timestamp and X-Embedshim-Signature, which is
+// "sha256=" + hex(HMAC-SHA256(secret, timestamp + "." + body)).
+type WebhookConfig struct {
+	// Enabled allows the tasks to define webhooks, which are sent by the
+	// host's network.
+	Enabled bool `toml:"enabled"`
+	// Secrets are the named HMAC keys referenced by the tasks, so that the
+	// keys aren't in the OCI spec.
+	Secrets map[string]string `toml:"secrets"`
+	// Timeout is the timeout of each delivery, like "5s", which is the
+	// default.
+	Timeout string `toml:"timeout"`
+	// MaxRetries is the number of retries of the failed delivery. The
+	// default is 3.
+	MaxRetries int `toml:"max_retries"`
+}
+
+// webhookConfig is the task's webhook defined by annotations.
+type webhookConfig struct {
+	url    string
+	events map[string]struct{}
+	// secret is the name of the plugin's secret.
+	secret string
+}
+
+// webhookFromAnnotations returns nil if the task doesn't define webhook.
+func webhookFromAnnotations(annotations map[string]string) (*webhookConfig, error) {
+	v := annotations[annotationWebhookURL]
+	if v == "" {
+		return nil, nil
+	}
+
+	u, err := url.Parse(v)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return nil, fmt.Errorf("invalid annotation %s=%q, expected http or https URL: %w", annotationWebhookURL, v, errdefs.ErrInvalidArgument)
+	}
+
+	cfg := &webhookConfig{
+		url:    v,
+		events: webhookEvents,
+		secret: annotations[annotationWebhookSecret],
+	}
+
+	if v := annotations[annotationWebhookEvents]; v != "" {
+		cfg.events = make(map[string]struct{})
+		for _, ev := range strings.Split(v, ",") {
+			ev = strings.TrimSpace(ev)
+			if _, ok := webhookEvents[ev]; !ok {
+				return nil, fmt.Errorf("invalid annotation %s=%q, unknown event %q: %w", annotationWebhookEvents, v, ev, errdefs.ErrInvalidArgument)
+			}
+			cfg.events[ev] = struct{}{}
+		}
+	}
+	return cfg, nil
+}
+
+// WebhookPayload is the body of the webhook request.
+type WebhookPayload struct {
+	Event       string `json:"event"`
+	Namespace   string `json:"namespace"`
+	ContainerID string `json:"container_id"`
+	// ExecID is empty for the init process.
+	ExecID     string    `json:"exec_id,omitempty"`
+	Pid        uint32    `json:"pid"`
+	ExitStatus *uint32   `json:"exit_status,omitempty"`
+	Timestamp  time.Time `json:"timestamp"`
+}
+
+// initWebhookNotifier creates the notifier if the task defines webhook and
+// the plugin enables it.
+func (s *shim) initWebhookNotifier() {
+	cfg := s.init.webhook
+	if cfg == nil {
+		return
+	}
+
+	if s.manager.config == nil || !s.manager.config.Webhook.Enabled {
+		log.G(context.Background()).Warnf("webhook of task %s is ignored because it is disabled by plugin", s.ID())
+		return
+	}
+
+	pcfg := s.manager.config.Webhook
+	n := &webhookNotifier{
+		s:          s,
+		cfg:        cfg,
+		timeout:    defaultWebhookTimeout,
+		maxRetries: defaultWebhookMaxRetries,
+		queue:      make(chan *WebhookPayload, webhookQueueSize),
+	}
+	if pcfg.Timeout != "" {
+		if d, err := time.ParseDuration(pcfg.Timeout); err == nil && d > 0 {
+			n.timeout = d
+		}
+	}
+	if pcfg.MaxRetries > 0 {
+		n.maxRetries = pcfg.MaxRetries
+	}
+	if cfg.secret != "" {
+		key, ok := pcfg.Secrets[cfg.secret]
+		if !ok {
+			log.G(context.Background()).Warnf("webhook secret %s of task %s not found, send unsigned", cfg.secret, s.ID())
+		}
+		n.key = []byte(key)
+	}
+	n.client = &http.Client{Timeout: n.timeout}
+
+	go n.run()
+	s.webhook = n
+}
+
+// webhookNotifier delivers the task's lifecycle events in order.
+type webhookNotifier struct {
+	s          *shim
+	cfg        *webhookConfig
+	key        []byte
+	client     *http.Client
+	timeout    time.Duration
+	maxRetries int
+
+	mu     sync.Mutex
+	closed bool
+	queue  chan *WebhookPayload
+	// oomKills is the cgroup's oom_kill counter when the task starts.
+	oomKills uint64
+}
+
+// notify converts the lifecycle event into the webhook payloads.
+func (n *webhookNotifier) notify(topic string, execID string, pid uint32, event events.Event) {
+	if n == nil {
+		return
+	}
+
+	switch ev := event.(type) {
+	case *eventstypes.TaskStart:
+		if topic != runtime.TaskStartEventTopic {
+			return
+		}
+		n.oomKills, _ = n.s.oomKillCount()
+		n.enqueue(&WebhookPayload{Event: webhookEventStarted, Pid: ev.Pid, Timestamp: time.Now()})
+	case *eventstypes.TaskExit:
+		exitStatus := ev.ExitStatus
+		// NOTE: The OOM is detected by the cgroup's oom_kill counter
+		// when the init process exits.
+		if execID == "" {
+			if count, err := n.s.oomKillCount(); err == nil && count > n.oomKills {
+				n.oomKills = count
+				n.enqueue(&WebhookPayload{Event: webhookEventOOM, Pid: ev.Pid, Timestamp: ev.ExitedAt})
+			}
+		}
+		n.enqueue(&WebhookPayload{
+			Event:      webhookEventExited,
+			ExecID:     execID,
+			Pid:        ev.Pid,
+			ExitStatus: &exitStatus,
+			Timestamp:  ev.ExitedAt,
+		})
+	}
+}
+
+func (n *webhookNotifier) enqueue(payload *WebhookPayload) {
+	if _, ok := n.cfg.events[payload.Event]; !ok {
+		return
+	}
+	payload.Namespace = n.s.Namespace()
+	payload.ContainerID = n.s.ID()
+
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	if n.closed {
+		return
+	}
+	select {
+	case n.queue <- payload:
+	default:
+		log.G(context.Background()).Warnf("webhook queue of task %s is full, drop %s event", n.s.ID(), payload.Event)
+	}
+}
+
+func (n *webhookNotifier) run() {
+	for payload := range n.queue {
+		if err := n.deliver(payload); err != nil {
+			log.G(context.Background()).WithError(err).
+				WithField("id", payload.ContainerID).WithField("event", payload.Event).
+				Warn("failed to deliver webhook")
+		}
+	}
+}
+
+// deliver posts the payload and retries with doubling backoff on the
+// network error or 5xx response.
+func (n *webhookNotifier) deliver(payload *WebhookPayload) error {
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+
+	backoff := webhookRetryBackoff
+	for attempt := 0; ; attempt++ {
+		retryable, err := n.post(body, payload.Event)
+		if err == nil {
+			return nil
+		}
+		if !retryable || attempt >= n.maxRetries {
+			return err
+		}
+		time.Sleep(backoff)
+		backoff *= 2
+	}
+}
+
+func (n *webhookNotifier) post(body []byte, event string) (bool, error) {
+	req, err := http.NewRequest(http.MethodPost, n.cfg.url, bytes.NewReader(body))
+	if err != nil {
+		return false, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Embedshim-Event", event)
+	if len(n.key) > 0 {
+		ts := strconv.FormatInt(time.Now().Unix(), 10)
+		req.Header.Set("X-Embedshim-Timestamp", ts)
+		req.Header.Set("X-Embedshim-Signature", "sha256="+signWebhook(n.key, ts, body))
+	}
+
+	resp, err := n.client.Do(req)
+	if err != nil {
+		return true, err
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+		return false, nil
+	}
+	return resp.StatusCode >= 500, fmt.Errorf("webhook %s responded %s", n.cfg.url, resp.Status)
+}
+
+// close stops accepting events. The pending ones are still delivered.
+func (n *webhookNotifier) close() {
+	if n == nil {
+		return
+	}
+
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	if !n.closed {
+		n.closed = true
+		close(n.queue)
+	}
+}
+
+func signWebhook(key []byte, ts string, body []byte) string {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(ts))
+	mac.Write([]byte("."))
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// oomKillCount returns the oom_kill counter of the task's memory cgroup.
+func (s *shim) oomKillCount() (uint64, error) {
+	cgroupPath := s.loadedIdentity().CgroupPath
+	if cgroupPath == "" {
+		return 0, fmt.Errorf("cgroup of task %s is unavailable: %w", s.ID(), errdefs.ErrNotFound)
+	}
+
+	pathname := filepath.Join(cgroupv2Root, cgroupPath, "memory.events")
+	if cgroups.Mode() != cgroups.Unified {
+		root, err := cgroupControllerRoot("memory")
+		if err != nil {
+			return 0, err
+		}
+		pathname = filepath.Join(root, cgroupPath, "memory.oom_control")
+	}
+
+	f, err := os.Open(pathname)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 2 && fields[0] == "oom_kill" {
+			return strconv.ParseUint(fields[1], 10, 64)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return 0, err
+	}
+	return 0, fmt.Errorf("oom_kill not found in %s", pathname)
+}
@@ -0,0 +1,104 @@
+//go:build linux
+// +build linux
+
+package embedshim
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestWebhookFromAnnotations(t *testing.T) {
+	for _, tc := range []struct {
+		annotations map[string]string
+		events      []string
+		hasErr      bool
+	}{
+		{annotations: nil},
+		{annotations: map[string]string{annotationWebhookURL: "https://example.com/hook"}, events: []string{"started", "exited", "oom"}},
+		{annotations: map[string]string{annotationWebhookURL: "http://example.com", annotationWebhookEvents: "exited, oom"}, events: []string{"exited", "oom"}},
+		{annotations: map[string]string{annotationWebhookURL: "unix:///run/hook.sock"}, hasErr: true},
+		{annotations: map[string]string{annotationWebhookURL: "example.com/hook"}, hasErr: true},
+		{annotations: map[string]string{annotationWebhookURL: "http://example.com", annotationWebhookEvents: "paused"}, hasErr: true},
+	} {
+		cfg, err := webhookFromAnnotations(tc.annotations)
+		if got := err != nil; got != tc.hasErr {
+			t.Fatalf("expected error %v for %v, but got %v", tc.hasErr, tc.annotations, err)
+		}
+		if tc.hasErr {
+			continue
+		}
+
+		if tc.events == nil {
+			if cfg != nil {
+				t.Fatalf("expected nil, but got %v", cfg)
+			}
+			continue
+		}
+		if len(cfg.events) != len(tc.events) {
+			t.Fatalf("expected events %v, but got %v", tc.events, cfg.events)
+		}
+		for _, ev := range tc.events {
+			if _, ok := cfg.events[ev]; !ok {
+				t.Fatalf("expected events %v, but got %v", tc.events, cfg.events)
+			}
+		}
+	}
+}
+
+func TestWebhookDeliver(t *testing.T) {
+	key := []byte("s3cret")
+
+	var (
+		attempts int
+		got      WebhookPayload
+	)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		attempts++
+		if attempts == 1 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+
+		body, _ := io.ReadAll(r.Body)
+		expected := "sha256=" + signWebhook(key, r.Header.Get("X-Embedshim-Timestamp"), body)
+		if sig := r.Header.Get("X-Embedshim-Signature"); sig != expected {
+			t.Errorf("expected signature %s, but got %s", expected, sig)
+		}
+		if err := json.Unmarshal(body, &got); err != nil {
+			t.Errorf("failed to unmarshal payload: %v", err)
+		}
+	}))
+	defer srv.Close()
+
+	webhookRetryBackoff = time.Millisecond
+	n := &webhookNotifier{
+		cfg:        &webhookConfig{url: srv.URL, events: webhookEvents},
+		key:        key,
+		client:     srv.Client(),
+		maxRetries: 1,
+	}
+
+	exitStatus := uint32(137)
+	if err := n.deliver(&WebhookPayload{
+		Event:       webhookEventExited,
+		Namespace:   "default",
+		ContainerID: "redis",
+		Pid:         1234,
+		ExitStatus:  &exitStatus,
+		Timestamp:   time.Now(),
+	}); err != nil {
+		t.Fatalf("failed to deliver: %v", err)
+	}
+
+	if attempts != 2 {
+		t.Fatalf("expected 2 attempts, but got %v", attempts)
+	}
+	if got.Event != webhookEventExited || got.ContainerID != "redis" || got.ExitStatus == nil || *got.ExitStatus != 137 {
+		t.Fatalf("expected exited payload of redis with 137, but got %+v", got)
+	}
+}